@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os/exec"
 	"sync"
+	"time"
 
 	"github.com/mit-dci/opencbdc-tctl/logging"
 	"github.com/mit-dci/opencbdc-tctl/wire"
@@ -13,16 +14,59 @@ import (
 type Agent struct {
 	// The connection to the coordinator
 	conn *wire.Conn
+	// The session the agent is in with the coordinator, which changes when
+	// the agent reconnects without the coordinator resuming its session
+	session int
+	// The messages that could not be sent over the previous connection, which
+	// are sent first once the agent reconnects
+	unsent []wire.Msg
+	// The lock for conn, session and unsent
+	connLock sync.Mutex
+	// The coordinator's host and port, to reconnect to
+	coordinatorHost string
+	coordinatorPort int
+	// The persistent identity of the agent
+	identity agentIdentity
 	// The queue for incoming messages to process
-	processingQueue chan wire.Msg
+	processingQueue chan receivedMsg
 	// The queue for outgoing messages to send
 	outgoing chan wire.Msg
 	// The agent's version - injected by the main binary in cmd/agent/main.go
 	version string
+	// The method the agent uses to enroll with the coordinator
+	enrollmentMethod string
+	// The credential the agent presents to the coordinator for enrollment
+	enrollmentCredential []byte
 	// The list of commands running on the agent
 	pendingCommands []*pendingCommand
-	// The lock for pendingCommands
+	// The exit codes of the commands that finished recently, by the hex
+	// encoded ID of the command, which are passed to the coordinator when
+	// reconnecting in case it missed their completion
+	finishedCommands map[string]finishedCommand
+	// The lock for pendingCommands, finishedCommands, updating and
+	// updatedBinary
 	pendingCommandsLock sync.Mutex
+	// Set while the agent is replacing its binary with a new version
+	updating bool
+	// The path of the binary that was replaced with a new version, which the
+	// agent restarts on
+	updatedBinary string
+	// The faults injected for chaos testing that are still active, by their
+	// hex encoded ID
+	activeFaults map[string]*activeFault
+	// The lock for activeFaults
+	activeFaultsLock sync.Mutex
+	// The load profiles commands are throttled to, by the hex encoded ID of
+	// the command
+	loadProfiles map[string]*loadProfile
+	// The lock for loadProfiles
+	loadProfilesLock sync.Mutex
+	// The streaming of the output of the commands to the coordinator
+	logStream *logStream
+	// The chunked file transfers in progress, by their target file
+	transfers map[string]*chunkedTransfer
+	// The lock for transfers
+	transfersLock sync.Mutex
 }
 
 // pendingCommand describes a command that is currently being executed
@@ -31,30 +75,90 @@ type pendingCommand struct {
 	id []byte
 	// The underlying process that's being executed
 	cmd *exec.Cmd
+	// The cgroup enforcing the resource limits of the command, if it has any
+	cgroup string
+	// The files standard output and error of the command are written to
+	stdoutFile string
+	stderrFile string
+}
+
+// finishedCommandRetention is the time the agent remembers the exit codes of
+// finished commands, which should cover the time it takes to reconnect
+const finishedCommandRetention = 15 * time.Minute
+
+// finishedCommand is a command that finished recently
+type finishedCommand struct {
+	id       []byte
+	exitCode int
+	finished time.Time
+}
+
+// receivedMsg is a message received from the coordinator, and the session it
+// was received in
+type receivedMsg struct {
+	msg     wire.Msg
+	session int
 }
 
 // NewAgent creates a new instance of the Agent class. Requires injection of the
 // version number from the main binary, as well as the coordinator's host and
-// port to connect to
+// port to connect to and the method and credential used to enroll with the
+// coordinator
 func NewAgent(
 	version string,
 	coordinatorHost string,
 	coordinatorPort int,
+	enrollmentMethod string,
+	enrollmentCredential []byte,
 ) (*Agent, error) {
-	// Create new wire client to connect to the coordinator
-	clt, err := wire.NewClient(coordinatorHost, coordinatorPort)
+	identity, err := loadIdentity()
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("unable to load agent identity: %v", err)
 	}
 
 	// Create a new instance of the Agent
 	a := &Agent{
-		version:             version,
-		conn:                clt,
-		processingQueue:     make(chan wire.Msg, 100),
-		outgoing:            make(chan wire.Msg, 100),
-		pendingCommands:     []*pendingCommand{},
-		pendingCommandsLock: sync.Mutex{},
+		version:              version,
+		enrollmentMethod:     enrollmentMethod,
+		enrollmentCredential: enrollmentCredential,
+		coordinatorHost:      coordinatorHost,
+		coordinatorPort:      coordinatorPort,
+		identity:             identity,
+		processingQueue:      make(chan receivedMsg, 100),
+		outgoing:             make(chan wire.Msg, 100),
+		pendingCommands:      []*pendingCommand{},
+		finishedCommands:     map[string]finishedCommand{},
+		pendingCommandsLock:  sync.Mutex{},
+		activeFaults:         map[string]*activeFault{},
+		loadProfiles:         map[string]*loadProfile{},
+		logStream:            &logStream{},
+		transfers:            map[string]*chunkedTransfer{},
+	}
+
+	err = a.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	// Start the loop that will periodically send the system info
+	// to the coordinator
+	go a.updateSystemInfoLoop()
+
+	// Start the loop that will periodically report the utilization of the
+	// system to the coordinator
+	go a.healthLoop()
+
+	return a, nil
+}
+
+// connect connects to the coordinator and completes the handshake. If the
+// agent has a token to resume its session, the coordinator resumes it, after
+// which the replies to the requests received before are still delivered
+func (a *Agent) connect() error {
+	// Create new wire client to connect to the coordinator
+	clt, err := wire.NewClient(a.coordinatorHost, a.coordinatorPort)
+	if err != nil {
+		return err
 	}
 
 	// Send a Hello message to the coordinator to initiate
@@ -62,43 +166,94 @@ func NewAgent(
 	msg := a.composeHello()
 	err = clt.Send(msg)
 	if err != nil {
-		return nil, err
+		clt.Close()
+		return err
 	}
 	sentID := wire.GetMessageHeaderID(msg, "ID")
 
 	// Await a message reply to our handshake
 	reply, err := clt.Recv()
 	if err != nil {
-		return nil, err
+		clt.Close()
+		return err
 	}
 
 	// Check if the reply is a valid response to our handshake
 	ack := false
+	resumed := false
 	switch t := reply.(type) {
 	case *wire.HelloResponseMsg:
 		ack = (t.Header.YourID == sentID)
+		resumed = t.Resumed
 		clt.Tag = fmt.Sprintf("Agent %d", t.YourAgentID)
-		logging.Infof("We are agent ID %d on the coordinator", t.YourAgentID)
+		if resumed {
+			logging.Infof("Resumed our session as agent ID %d", t.YourAgentID)
+		} else {
+			logging.Infof("We are agent ID %d on the coordinator", t.YourAgentID)
+		}
+		if len(t.ResumeToken) > 0 {
+			a.identity.ResumeToken = t.ResumeToken
+			err = storeIdentity(a.identity)
+			if err != nil {
+				logging.Warnf("Unable to store resume token: %v", err)
+			}
+		}
 	case *wire.ErrorMsg:
-		return nil, fmt.Errorf("Handshake failed: %v", t.Error)
+		clt.Close()
+		if len(msg.ResumeToken) > 0 {
+			// The coordinator no longer knows our identity, enroll again on
+			// the next attempt
+			a.identity.ResumeToken = nil
+		}
+		return fmt.Errorf("Handshake failed: %v", t.Error)
 	}
 
 	if !ack {
-		return nil, fmt.Errorf("Handshake failed: no ack")
+		clt.Close()
+		return fmt.Errorf("Handshake failed: no ack")
 	}
 
-	// Start the loop that will periodically send the system info
-	// to the coordinator
-	go a.updateSystemInfoLoop()
+	a.connLock.Lock()
+	a.conn = clt
+	if !resumed {
+		a.session++
+	}
+	a.connLock.Unlock()
+	return nil
+}
 
-	return a, nil
+// connection returns the current connection to the coordinator and the
+// session it is in
+func (a *Agent) connection() (*wire.Conn, int) {
+	a.connLock.Lock()
+	defer a.connLock.Unlock()
+	return a.conn, a.session
 }
 
 // composeHello creates a new wire.HelloMsg with the current system information
-// and agent version
+// and agent version, and the agent's enrollment credential and identity. It
+// includes the commands the agent is running and the ones that finished
+// recently, to resync a resumed session
 func (a *Agent) composeHello() *wire.HelloMsg {
-	return &wire.HelloMsg{
-		SystemInfo:   GetSystemInfo(),
-		AgentVersion: a.version,
+	msg := &wire.HelloMsg{
+		SystemInfo:           GetSystemInfo(),
+		AgentVersion:         a.version,
+		EnrollmentMethod:     a.enrollmentMethod,
+		EnrollmentCredential: a.enrollmentCredential,
+		AgentIdentity:        a.identity.Identity,
+		ResumeToken:          a.identity.ResumeToken,
+		RunningCommands:      [][]byte{},
+		FinishedCommands:     [][]byte{},
+		FinishedExitCodes:    []int{},
+	}
+	a.pendingCommandsLock.Lock()
+	defer a.pendingCommandsLock.Unlock()
+	for _, c := range a.pendingCommands {
+		msg.RunningCommands = append(msg.RunningCommands, c.id)
+	}
+	for _, c := range a.finishedCommands {
+		msg.FinishedCommands = append(msg.FinishedCommands, c.id)
+		msg.FinishedExitCodes = append(msg.FinishedExitCodes, c.exitCode)
 	}
+	return msg
 }
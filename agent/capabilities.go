@@ -0,0 +1,72 @@
+package agent
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// HasLocalNVMe returns true if the system has NVMe storage other than EBS
+// volumes, which are attached as NVMe devices on Nitro instances as well
+func HasLocalNVMe() bool {
+	models, err := filepath.Glob("/sys/block/nvme*/device/model")
+	if err != nil {
+		return false
+	}
+	for _, m := range models {
+		b, err := ioutil.ReadFile(m)
+		if err != nil {
+			continue
+		}
+		if !strings.Contains(string(b), "Elastic Block Store") {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	zoneOnce         sync.Once
+	region           string
+	availabilityZone string
+)
+
+// GetZone returns the region and availability zone the agent runs in. These
+// are read from AGENT_REGION and AGENT_AVAILABILITY_ZONE if set, which allows
+// agents outside of AWS to advertise them, and otherwise from the instance
+// identity document of EC2 instances. They are determined once, since they
+// can't change while the agent runs
+func GetZone() (string, string) {
+	zoneOnce.Do(func() {
+		region = os.Getenv("AGENT_REGION")
+		availabilityZone = os.Getenv("AGENT_AVAILABILITY_ZONE")
+		if region != "" || os.Getenv("EC2_INSTANCE_ID") == "" {
+			return
+		}
+		get, err := imdsGetter()
+		if err != nil {
+			logging.Warnf("Unable to determine availability zone: %v", err)
+			return
+		}
+		b, err := get("/latest/dynamic/instance-identity/document")
+		if err != nil {
+			logging.Warnf("Unable to determine availability zone: %v", err)
+			return
+		}
+		var doc struct {
+			Region           string `json:"region"`
+			AvailabilityZone string `json:"availabilityZone"`
+		}
+		if err := json.Unmarshal(b, &doc); err != nil {
+			logging.Warnf("Unable to determine availability zone: %v", err)
+			return
+		}
+		region, availabilityZone = doc.Region, doc.AvailabilityZone
+	})
+	return region, availabilityZone
+}
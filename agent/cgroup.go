@@ -0,0 +1,228 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// cgroupParent is the cgroup, below the root, in which the agent creates the
+// cgroups of the commands it runs with resource limits
+const cgroupParent = "tctl"
+
+// cgroupCPUPeriod is the period over which the CPU quota of a cgroup applies,
+// in microseconds
+const cgroupCPUPeriod = 100000
+
+// cgroupSetupLock guards enabling the controllers of the parent cgroup
+var cgroupSetupLock = sync.Mutex{}
+
+// cgroupLimits are the resource limits of a command. Zero values are not
+// limited
+type cgroupLimits struct {
+	CPUs      float64
+	MemoryMiB int64
+	IOWeight  int
+}
+
+// empty returns whether none of the resources are limited
+func (l cgroupLimits) empty() bool {
+	return l.CPUs <= 0 && l.MemoryMiB <= 0 && l.IOWeight <= 0
+}
+
+// controllers returns the cgroup controllers needed to enforce the limits
+func (l cgroupLimits) controllers() []string {
+	ret := []string{}
+	if l.CPUs > 0 {
+		ret = append(ret, "cpu")
+	}
+	if l.MemoryMiB > 0 {
+		ret = append(ret, "memory")
+	}
+	if l.IOWeight > 0 {
+		ret = append(ret, "io")
+	}
+	return ret
+}
+
+// enableCgroupControllers creates the parent cgroup if needed, and enables the
+// controllers in the root and parent cgroup such that the cgroups of the
+// commands can use them. The root cgroup is exempt from the rule that cgroups
+// with processes can't delegate controllers, the parent cgroup never has
+// processes of its own
+func enableCgroupControllers(controllers []string) error {
+	available, err := ioutil.ReadFile(
+		filepath.Join(cgroupRoot, "cgroup.controllers"),
+	)
+	if err != nil {
+		return errors.New("cgroup v2 is not available on this agent")
+	}
+	enable := []string{}
+	for _, c := range controllers {
+		found := false
+		for _, a := range strings.Fields(string(available)) {
+			found = found || a == c
+		}
+		if !found {
+			return fmt.Errorf("the %s cgroup controller is not available", c)
+		}
+		enable = append(enable, "+"+c)
+	}
+
+	cgroupSetupLock.Lock()
+	defer cgroupSetupLock.Unlock()
+	parent := filepath.Join(cgroupRoot, cgroupParent)
+	err = os.MkdirAll(parent, 0755)
+	if err != nil {
+		return err
+	}
+	for _, dir := range []string{cgroupRoot, parent} {
+		err = ioutil.WriteFile(
+			filepath.Join(dir, "cgroup.subtree_control"),
+			[]byte(strings.Join(enable, " ")),
+			0644,
+		)
+		if err != nil {
+			return fmt.Errorf("unable to enable cgroup controllers: %v", err)
+		}
+	}
+	return nil
+}
+
+// createCgroup creates the cgroup for the command with the given ID that
+// enforces the limits, and returns its directory
+func createCgroup(commandID []byte, limits cgroupLimits) (string, error) {
+	err := enableCgroupControllers(limits.controllers())
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(
+		cgroupRoot,
+		cgroupParent,
+		fmt.Sprintf("command-%x", commandID),
+	)
+	err = os.Mkdir(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	settings := map[string]string{}
+	if limits.CPUs > 0 {
+		settings["cpu.max"] = fmt.Sprintf(
+			"%d %d",
+			int64(limits.CPUs*cgroupCPUPeriod),
+			cgroupCPUPeriod,
+		)
+	}
+	if limits.MemoryMiB > 0 {
+		settings["memory.max"] = strconv.FormatInt(limits.MemoryMiB<<20, 10)
+	}
+	if limits.IOWeight > 0 {
+		settings["io.weight"] = fmt.Sprintf("default %d", limits.IOWeight)
+	}
+	for file, value := range settings {
+		err = ioutil.WriteFile(filepath.Join(dir, file), []byte(value), 0644)
+		if err != nil {
+			removeCgroup(dir)
+			return "", fmt.Errorf("unable to set %s: %v", file, err)
+		}
+	}
+	// Don't let the process escape its memory limit by swapping. Not all
+	// systems have swap accounting, in which case there's no swap to escape
+	// to either
+	if limits.MemoryMiB > 0 {
+		_ = ioutil.WriteFile(
+			filepath.Join(dir, "memory.swap.max"),
+			[]byte("0"),
+			0644,
+		)
+	}
+	return dir, nil
+}
+
+// runInCgroup changes the command such that it moves itself into the cgroup
+// before executing, so none of the processes it starts escape the limits
+func runInCgroup(cmd *exec.Cmd, dir string) {
+	args := []string{
+		"sh",
+		"-c",
+		`echo $$ > "$0/cgroup.procs" && exec "$@"`,
+		dir,
+		cmd.Path,
+	}
+	cmd.Args = append(args, cmd.Args[1:]...)
+	cmd.Path = "/bin/sh"
+}
+
+// cgroupOOMKills returns the number of processes in the cgroup that were
+// killed for exceeding its memory limit
+func cgroupOOMKills(dir string) int {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "memory.events"))
+	if err != nil {
+		return 0
+	}
+	for _, l := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(l)
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			n, _ := strconv.Atoi(fields[1])
+			return n
+		}
+	}
+	return 0
+}
+
+// processCgroup returns the directory of the (v2) cgroup the process is in.
+// Use "self" for the agent itself
+func processCgroup(pid string) (string, error) {
+	b, err := ioutil.ReadFile(filepath.Join("/proc", pid, "cgroup"))
+	if err != nil {
+		return "", err
+	}
+	for _, l := range strings.Split(string(b), "\n") {
+		if strings.HasPrefix(l, "0::") {
+			return filepath.Join(cgroupRoot, strings.TrimPrefix(l, "0::")), nil
+		}
+	}
+	return "", fmt.Errorf("process %s is not in a cgroup v2", pid)
+}
+
+// removeCgroup removes the cgroup of a command once it exited
+func removeCgroup(dir string) {
+	err := os.Remove(dir)
+	if err != nil {
+		logging.Warnf("Unable to remove cgroup %s: %v", dir, err)
+	}
+}
+
+// containerLimitArgs returns the arguments to docker run that make it enforce
+// the limits on the container. The IO weight is scaled to the range of 10 to
+// 1000 docker accepts
+func containerLimitArgs(limits cgroupLimits) []string {
+	args := []string{}
+	if limits.CPUs > 0 {
+		args = append(args, "--cpus", strconv.FormatFloat(limits.CPUs, 'f', -1, 64))
+	}
+	if limits.MemoryMiB > 0 {
+		mem := fmt.Sprintf("%dm", limits.MemoryMiB)
+		args = append(args, "--memory", mem, "--memory-swap", mem)
+	}
+	if limits.IOWeight > 0 {
+		weight := limits.IOWeight / 10
+		if weight < 10 {
+			weight = 10
+		}
+		if weight > 1000 {
+			weight = 1000
+		}
+		args = append(args, "--blkio-weight", strconv.Itoa(weight))
+	}
+	return args
+}
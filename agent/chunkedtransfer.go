@@ -0,0 +1,334 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+	"github.com/mit-dci/opencbdc-tctl/wire"
+)
+
+// chunkedTransferPersistInterval is the number of chunks received after which
+// the state of a transfer is written to disk. Chunks received since are sent
+// again when the transfer is resumed after the agent restarted
+const chunkedTransferPersistInterval = 8
+
+// fileReadMaxLength is the largest chunk of a file the coordinator can read
+// at once
+const fileReadMaxLength = 16 << 20
+
+// chunkedTransfer is the state of a chunked file transfer into an
+// environment. It's kept in memory while the chunks arrive, and periodically
+// written next to the file being written, such that a transfer can be resumed
+// after the connection to the coordinator was lost or the agent restarted
+type chunkedTransfer struct {
+	TransferID []byte `json:"transferID"`
+	Size       int64  `json:"size"`
+	ChunkSize  int64  `json:"chunkSize"`
+	Received   []bool `json:"received"`
+	// Guards Received and unsaved, and serializes writing the state
+	lock sync.Mutex
+	// The number of chunks received since the state was written
+	unsaved int
+}
+
+// chunkedTransferStatePath returns the path of the state of a chunked
+// transfer to targetFile
+func chunkedTransferStatePath(targetFile string) string {
+	return targetFile + ".transfer.json"
+}
+
+// loadChunkedTransfer reads the state of the chunked transfer to targetFile
+func loadChunkedTransfer(targetFile string) (*chunkedTransfer, error) {
+	b, err := ioutil.ReadFile(chunkedTransferStatePath(targetFile))
+	if err != nil {
+		return nil, err
+	}
+	t := &chunkedTransfer{}
+	err = json.Unmarshal(b, t)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// chunkedTransfer returns the state of the transfer to targetFile, from
+// memory or from disk if the agent restarted since it started
+func (a *Agent) chunkedTransfer(targetFile string) (*chunkedTransfer, error) {
+	a.transfersLock.Lock()
+	defer a.transfersLock.Unlock()
+	if t, ok := a.transfers[targetFile]; ok {
+		return t, nil
+	}
+	t, err := loadChunkedTransfer(targetFile)
+	if err != nil {
+		return nil, err
+	}
+	a.transfers[targetFile] = t
+	return t, nil
+}
+
+// store writes the state of the chunked transfer to targetFile to disk. Must
+// be called with the lock of the transfer held
+func (t *chunkedTransfer) store(targetFile string) error {
+	b, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(chunkedTransferStatePath(targetFile), b, 0644)
+}
+
+// chunkBounds returns the offset and length of the chunk with the given index
+func (t *chunkedTransfer) chunkBounds(index int) (int64, int64) {
+	offset := int64(index) * t.ChunkSize
+	length := t.ChunkSize
+	if offset+length > t.Size {
+		length = t.Size - offset
+	}
+	return offset, length
+}
+
+// handleFileTransferStart handles the FileTransferStartRequestMsg. If the
+// agent has the state of an earlier attempt of the same transfer, it replies
+// with the chunks it already received. Otherwise the target file is created
+// at its full size, and the transfer starts from scratch
+func (a *Agent) handleFileTransferStart(
+	msg *wire.FileTransferStartRequestMsg,
+) (wire.Msg, error) {
+	if msg.ChunkSize <= 0 || msg.Size < 0 {
+		return nil, errors.New("invalid size or chunk size")
+	}
+	targetFile := filepath.Join(environmentDir(msg.EnvironmentID), msg.Path)
+
+	ret := &wire.FileTransferStartResponseMsg{ReceivedChunks: []int{}}
+	t, err := a.chunkedTransfer(targetFile)
+	if err == nil && bytes.Equal(t.TransferID, msg.TransferID) &&
+		t.Size == msg.Size && t.ChunkSize == msg.ChunkSize {
+		t.lock.Lock()
+		for i, received := range t.Received {
+			if received {
+				ret.ReceivedChunks = append(ret.ReceivedChunks, i)
+			}
+		}
+		t.lock.Unlock()
+		logging.Infof(
+			"Resuming transfer of %s with %d of %d chunks received",
+			msg.Path,
+			len(ret.ReceivedChunks),
+			len(t.Received),
+		)
+		return ret, nil
+	}
+
+	err = os.MkdirAll(filepath.Dir(targetFile), 0755)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(
+		targetFile,
+		os.O_WRONLY|os.O_CREATE|os.O_TRUNC,
+		0644,
+	)
+	if err != nil {
+		return nil, err
+	}
+	err = f.Truncate(msg.Size)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	chunks := (msg.Size + msg.ChunkSize - 1) / msg.ChunkSize
+	t = &chunkedTransfer{
+		TransferID: msg.TransferID,
+		Size:       msg.Size,
+		ChunkSize:  msg.ChunkSize,
+		Received:   make([]bool, chunks),
+	}
+	logging.Infof(
+		"Starting transfer of %s: %d bytes in %d chunks",
+		msg.Path,
+		msg.Size,
+		chunks,
+	)
+	a.transfersLock.Lock()
+	a.transfers[targetFile] = t
+	a.transfersLock.Unlock()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return ret, t.store(targetFile)
+}
+
+// handleFileChunk handles the FileChunkRequestMsg, which writes one chunk of
+// a transfer to the target file after checking it against its checksum
+func (a *Agent) handleFileChunk(
+	msg *wire.FileChunkRequestMsg,
+) (wire.Msg, error) {
+	targetFile := filepath.Join(environmentDir(msg.EnvironmentID), msg.Path)
+	t, err := a.chunkedTransfer(targetFile)
+	if err != nil || !bytes.Equal(t.TransferID, msg.TransferID) {
+		return nil, fmt.Errorf("no transfer of %s was started", msg.Path)
+	}
+	if msg.Index < 0 || msg.Index >= len(t.Received) {
+		return nil, fmt.Errorf("invalid chunk index %d", msg.Index)
+	}
+	offset, length := t.chunkBounds(msg.Index)
+	if int64(len(msg.Contents)) != length {
+		return nil, fmt.Errorf(
+			"expected %d bytes in chunk %d, got %d",
+			length,
+			msg.Index,
+			len(msg.Contents),
+		)
+	}
+	digest := sha256.Sum256(msg.Contents)
+	if !bytes.Equal(digest[:], msg.SHA256) {
+		return nil, fmt.Errorf("checksum mismatch for chunk %d", msg.Index)
+	}
+
+	f, err := os.OpenFile(targetFile, os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.WriteAt(msg.Contents, offset)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.Received[msg.Index] = true
+	t.unsaved++
+	if t.unsaved < chunkedTransferPersistInterval {
+		return &wire.AckMsg{}, nil
+	}
+	t.unsaved = 0
+	return &wire.AckMsg{}, t.store(targetFile)
+}
+
+// handleFileTransferFinish handles the FileTransferFinishRequestMsg. It checks
+// all chunks were received, verifies the file against its checksum and
+// unpacks it if requested. If the file doesn't match its checksum, the state
+// of the transfer is removed such that it starts from scratch when retried
+func (a *Agent) handleFileTransferFinish(
+	msg *wire.FileTransferFinishRequestMsg,
+) (wire.Msg, error) {
+	t := newTransferReporter(a, msg.TransferID)
+	err := a.finishFileTransfer(msg, t)
+	t.finish(err)
+	if err != nil {
+		return nil, err
+	}
+	return &wire.AckMsg{}, nil
+}
+
+// finishFileTransfer verifies and unpacks the file of the transfer finished
+// in msg, reporting its progress to t
+func (a *Agent) finishFileTransfer(
+	msg *wire.FileTransferFinishRequestMsg,
+	t *transferReporter,
+) error {
+	targetFile := filepath.Join(environmentDir(msg.EnvironmentID), msg.Path)
+	state, err := a.chunkedTransfer(targetFile)
+	if err != nil || !bytes.Equal(state.TransferID, msg.TransferID) {
+		return fmt.Errorf("no transfer of %s was started", msg.Path)
+	}
+	state.lock.Lock()
+	for i, received := range state.Received {
+		if !received {
+			state.lock.Unlock()
+			return fmt.Errorf("chunk %d of %s was not received", i, msg.Path)
+		}
+	}
+	state.lock.Unlock()
+	a.transfersLock.Lock()
+	delete(a.transfers, targetFile)
+	a.transfersLock.Unlock()
+
+	t.total = state.Size
+	t.bytes = state.Size
+	t.report(wire.TransferPhaseVerify)
+	err = verifyDownload(msg.SHA256, msg.Signature, false, targetFile)
+	os.Remove(chunkedTransferStatePath(targetFile))
+	if err != nil {
+		os.Remove(targetFile)
+		return fmt.Errorf("error verifying file %s: %v", msg.Path, err)
+	}
+
+	if msg.Unpack {
+		logging.Infof("Unpacking transferred file %s", targetFile)
+		t.report(wire.TransferPhaseUnpack)
+		err = common.TarExtractFlat(targetFile, msg.FlatUnpack, msg.UnpackNoDir)
+		if err != nil {
+			return fmt.Errorf("error extracting file %s: %v", msg.Path, err)
+		}
+		os.Remove(targetFile)
+	}
+	logging.Infof("Finished transfer of %s", msg.Path)
+	return nil
+}
+
+// handleFileRead handles the FileReadRequestMsg, which the coordinator uses
+// to fetch a file from the agent in chunks. Without a length, the size and
+// checksum of the file are returned in stead of its contents
+func (a *Agent) handleFileRead(
+	msg *wire.FileReadRequestMsg,
+) (wire.Msg, error) {
+	sourceFile := filepath.Join(environmentDir(msg.EnvironmentID), msg.Path)
+	ret := &wire.FileReadResponseMsg{}
+	if msg.Length > fileReadMaxLength {
+		return nil, fmt.Errorf(
+			"can't read more than %d bytes at once",
+			fileReadMaxLength,
+		)
+	}
+	if msg.Length <= 0 {
+		if msg.Validate {
+			if schema := common.OutputSchemaFor(sourceFile); schema != nil {
+				err := common.ValidateOutputFile(sourceFile, schema)
+				if err != nil && !os.IsNotExist(err) {
+					logging.Warnf(
+						"Output file %s is invalid: %v",
+						sourceFile,
+						err,
+					)
+					ret.ValidationError = err.Error()
+				}
+			}
+		}
+		digest, size, err := common.FileSHA256(sourceFile)
+		if err != nil {
+			return nil, err
+		}
+		ret.SHA256 = digest
+		ret.Size = size
+		return ret, nil
+	}
+
+	f, err := os.Open(sourceFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	ret.Size = stat.Size()
+	ret.Contents = make([]byte, msg.Length)
+	n, err := f.ReadAt(ret.Contents, msg.Offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	ret.Contents = ret.Contents[:n]
+	return ret, nil
+}
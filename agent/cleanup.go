@@ -0,0 +1,162 @@
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/logging"
+	"github.com/mit-dci/opencbdc-tctl/wire"
+)
+
+// residualProcess is a process found running in an environment after the
+// teardown of its test run
+type residualProcess struct {
+	pid  int
+	name string
+}
+
+// handleVerifyCleanup handles the VerifyCleanupRequestMsg, which verifies that
+// the teardown of a test run left no processes running in its environment, no
+// ports in use and removed the environment directory. If the request is
+// forced, the residue is cleaned and verified again. If the environment is
+// kept for the next test run, the outputs of the last one are removed from it
+func (a *Agent) handleVerifyCleanup(
+	msg *wire.VerifyCleanupRequestMsg,
+) (wire.Msg, error) {
+	dir := environmentDir(msg.EnvironmentID)
+	procs, ret := findCleanupResidue(dir, msg.Ports, msg.Keep)
+	if msg.Keep {
+		defer removeEnvironmentPaths(dir, msg.RemovePaths)
+		defer a.revertEnvironmentFaults(msg.EnvironmentID)
+	}
+	if !msg.Force || !hasResidue(ret) {
+		return ret, nil
+	}
+
+	logging.Warnf(
+		"Force-cleaning residue of environment %x: %d processes, %d ports, %d directories",
+		msg.EnvironmentID,
+		len(ret.Processes),
+		len(ret.Ports),
+		len(ret.Dirs),
+	)
+	for _, p := range procs {
+		err := syscall.Kill(p.pid, syscall.SIGKILL)
+		if err != nil {
+			logging.Warnf("Unable to kill process %d: %v", p.pid, err)
+		}
+	}
+	if !msg.Keep {
+		a.revertEnvironmentFaults(msg.EnvironmentID)
+		err := os.RemoveAll(dir)
+		if err != nil {
+			logging.Warnf("Unable to remove %s: %v", dir, err)
+		}
+	}
+
+	// Give the killed processes time to exit and release their ports
+	time.Sleep(2 * time.Second)
+	_, after := findCleanupResidue(dir, msg.Ports, msg.Keep)
+	ret.Cleaned = !hasResidue(after)
+	return ret, nil
+}
+
+// removeEnvironmentPaths removes the given paths, relative to the environment
+// directory and optionally containing glob patterns, from it. Paths outside of
+// the environment directory are ignored
+func removeEnvironmentPaths(dir string, paths []string) {
+	for _, p := range paths {
+		pattern := filepath.Join(dir, p)
+		if !strings.HasPrefix(pattern, dir+string(os.PathSeparator)) {
+			logging.Warnf("Not removing %s outside of %s", p, dir)
+			continue
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			logging.Warnf("Invalid path %s: %v", p, err)
+			continue
+		}
+		for _, path := range matches {
+			err := os.RemoveAll(path)
+			if err != nil {
+				logging.Warnf("Unable to remove %s: %v", path, err)
+			}
+		}
+	}
+}
+
+// findCleanupResidue returns the processes running in the directory, and a
+// response listing them together with the ports in use and the directory if
+// it still exists and is not kept
+func findCleanupResidue(
+	dir string,
+	ports []int,
+	keep bool,
+) ([]residualProcess, *wire.VerifyCleanupResponseMsg) {
+	ret := &wire.VerifyCleanupResponseMsg{
+		Processes: []string{},
+		Ports:     []int{},
+		Dirs:      []string{},
+	}
+	procs := processesInDir(dir)
+	for _, p := range procs {
+		ret.Processes = append(ret.Processes, fmt.Sprintf("%d %s", p.pid, p.name))
+	}
+	for _, port := range ports {
+		l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+		if err != nil {
+			ret.Ports = append(ret.Ports, port)
+			continue
+		}
+		l.Close()
+	}
+	if _, err := os.Stat(dir); err == nil && !keep {
+		ret.Dirs = append(ret.Dirs, dir)
+	}
+	return procs, ret
+}
+
+// hasResidue returns true if the response lists any residue
+func hasResidue(msg *wire.VerifyCleanupResponseMsg) bool {
+	return len(msg.Processes) > 0 || len(msg.Ports) > 0 || len(msg.Dirs) > 0
+}
+
+// processesInDir returns the processes of which the working directory is
+// (inside) dir, except the agent itself. The environment is usually removed
+// before its cleanup is verified, in which case the kernel reports the
+// working directory of the processes that were left in it with a " (deleted)"
+// suffix
+func processesInDir(dir string) []residualProcess {
+	ret := []residualProcess{}
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return ret
+	}
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+		cwd, err := os.Readlink(filepath.Join("/proc", e.Name(), "cwd"))
+		if err != nil {
+			continue
+		}
+		cwd = strings.TrimSuffix(cwd, " (deleted)")
+		if cwd != dir && !strings.HasPrefix(cwd, dir+string(os.PathSeparator)) {
+			continue
+		}
+		name, _ := ioutil.ReadFile(filepath.Join("/proc", e.Name(), "comm"))
+		ret = append(ret, residualProcess{
+			pid:  pid,
+			name: strings.TrimSpace(string(name)),
+		})
+	}
+	return ret
+}
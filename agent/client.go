@@ -2,78 +2,174 @@ package agent
 
 import (
 	"fmt"
+	"os"
 	"runtime"
+	"strconv"
+	"time"
 
 	"github.com/mit-dci/opencbdc-tctl/logging"
 	"github.com/mit-dci/opencbdc-tctl/wire"
 )
 
+// reconnectInterval is the time between attempts to reconnect to the
+// coordinator
+const reconnectInterval = 5 * time.Second
+
+// defaultReconnectTimeout is the time the agent keeps trying to reconnect to
+// the coordinator after the connection was lost, unless overridden by the
+// AGENT_RECONNECT_TIMEOUT environment variable (in seconds)
+const defaultReconnectTimeout = 5 * time.Minute
+
+// reconnectTimeout returns the time the agent keeps trying to reconnect to
+// the coordinator
+func reconnectTimeout() time.Duration {
+	s, err := strconv.Atoi(os.Getenv("AGENT_RECONNECT_TIMEOUT"))
+	if err != nil || s <= 0 {
+		return defaultReconnectTimeout
+	}
+	return time.Duration(s) * time.Second
+}
+
 // RunClient is the main loop for an agent
 func (a *Agent) RunClient() {
-	// Run the send loop in a separate go routine
-	go a.sendLoop()
-
 	// Run the incoming processing of the messages on as much
 	// goroutines as we have CPUs
 	for i := 0; i < runtime.NumCPU(); i++ {
 		go a.processingLoop()
 	}
 
-	// Close the processing queue if we exit this method. Most likely
-	// reason for exiting is that the connection to the coordinator
-	// has been closed. Generally speaking, the scripting that runs the
+	// Close the processing queue if we exit this method. The agent exits this
+	// method when it could not reconnect to the coordinator in time, or when
+	// it updated itself. Generally speaking, the scripting that runs the
 	// agent binary on an agent machine will do so in a loop, hence exiting
 	// this loop will cause a restart of the agent
 	defer close(a.processingQueue)
+	for {
+		conn, session := a.connection()
+		done := make(chan struct{})
+		// Run the send loop for this connection in a separate go routine
+		go a.sendLoop(conn, done)
+		a.receiveLoop(conn, session)
+		close(done)
+
+		if a.UpdatedBinary() != "" {
+			return
+		}
+		// The commands keep running while the agent reconnects, and their
+		// updates are sent once it has
+		if !a.reconnect() {
+			return
+		}
+	}
+}
+
+// receiveLoop reads the messages from the connection to the coordinator and
+// sends them to the processing queue, until the connection is closed
+func (a *Agent) receiveLoop(conn *wire.Conn, session int) {
 	for {
 		// Read a message from the coordinator
-		msg, err := a.conn.Recv()
+		msg, err := conn.Recv()
 		if err != nil {
 			if err.Error() != "EOF" {
 				logging.Warnf("Error reading message: %v", err.Error())
 			} else {
 				logging.Infof("Connection to coordinator closed: %v", err.Error())
 			}
-			a.conn.Close()
-			close(a.processingQueue)
+			conn.Close()
 			return
 		}
 		// Send the message to the processing queue
-		a.processingQueue <- msg
+		a.processingQueue <- receivedMsg{msg: msg, session: session}
 	}
 }
 
+// reconnect tries to connect to the coordinator again after the connection
+// was lost, until the reconnect timeout passes. Returns true if the agent
+// reconnected
+func (a *Agent) reconnect() bool {
+	timeout := reconnectTimeout()
+	deadline := time.Now().Add(timeout)
+	for attempt := 1; time.Now().Before(deadline); attempt++ {
+		time.Sleep(reconnectInterval)
+		logging.Infof("Reconnecting to coordinator (attempt %d)", attempt)
+		err := a.connect()
+		if err == nil {
+			return true
+		}
+		logging.Warnf("Failed to reconnect: %v", err)
+	}
+	logging.Errorf(
+		"Could not reconnect to the coordinator within %s, giving up",
+		timeout,
+	)
+	return false
+}
+
 // processingLoop reads from the processingQueue chan of wire messages and
 // processes the message - the result of processing is sent back to the
 // coordinator by placing it in the outgoing chan - which is then sent over
-// the wire by the sendLoop
+// the wire by the sendLoop. Replies to messages received in an earlier
+// session are dropped, since the coordinator no longer expects them and
+// could mistake them for replies to its new messages
 func (a *Agent) processingLoop() {
-	for msg := range a.processingQueue {
-		id := wire.GetMessageHeaderID(msg, "ID")
-		returnMsg, err := a.handleMsg(msg)
+	for rm := range a.processingQueue {
+		id := wire.GetMessageHeaderID(rm.msg, "ID")
+		returnMsg, err := a.handleMsg(rm.msg)
 		if err != nil {
 			logging.Errorf("Error handling message %d: %v", id, err)
 			returnMsg = &wire.ErrorMsg{Error: err.Error()}
 		}
 		if returnMsg != nil {
+			if _, session := a.connection(); session != rm.session {
+				logging.Infof(
+					"Dropping reply to message %d of an earlier session",
+					id,
+				)
+				continue
+			}
 			wire.SetMessageHeaderID(returnMsg, "YourID", id)
 			a.outgoing <- returnMsg
 		}
 	}
 }
 
-// sendLoop takes care of reading from the outgoing chan of messages and sending
-// them over the wire back to the coordinator
-func (a *Agent) sendLoop() {
-	for msg := range a.outgoing {
-		err := a.conn.Send(msg)
+// sendLoop takes care of reading from the outgoing chan of messages and queueing
+// them for sending over the wire back to the coordinator, until done is
+// closed. The connection writes them by priority, such that for instance an
+// acknowledgement does not wait for a large message sent before it. Messages
+// that could not be sent are kept, and sent first once the agent reconnected
+func (a *Agent) sendLoop(conn *wire.Conn, done chan struct{}) {
+	a.connLock.Lock()
+	unsent := a.unsent
+	a.unsent = nil
+	a.connLock.Unlock()
+	for i, msg := range unsent {
+		err := conn.Queue(msg)
 		if err != nil {
-			logging.Warnf("Could not send message: %v", err)
-			a.conn.Close()
-			break
+			a.connLock.Lock()
+			a.unsent = append(unsent[i:], a.unsent...)
+			a.connLock.Unlock()
+			conn.Close()
+			return
+		}
+	}
+
+	for {
+		select {
+		case <-done:
+			return
+		case msg := <-a.outgoing:
+			err := conn.Queue(msg)
+			if err != nil {
+				logging.Warnf("Could not send message: %v", err)
+				a.connLock.Lock()
+				a.unsent = append(a.unsent, msg)
+				a.connLock.Unlock()
+				conn.Close()
+				return
+			}
 		}
 	}
-	logging.Warnf("Send loop exited!")
 }
 
 // handleMsg is the main entry point for handling messages. Based on the message
@@ -95,6 +191,14 @@ func (a *Agent) handleMsg(msg wire.Msg) (wire.Msg, error) {
 		reply, err = a.handleDeployFile(t)
 	case *wire.DeployFileFromS3RequestMsg:
 		reply, err = a.handleDeployFileFromS3(t)
+	case *wire.FileTransferStartRequestMsg:
+		reply, err = a.handleFileTransferStart(t)
+	case *wire.FileChunkRequestMsg:
+		reply, err = a.handleFileChunk(t)
+	case *wire.FileTransferFinishRequestMsg:
+		reply, err = a.handleFileTransferFinish(t)
+	case *wire.FileReadRequestMsg:
+		reply, err = a.handleFileRead(t)
 	case *wire.RenameFileRequestMsg:
 		reply, err = a.handleRenameFile(t)
 	case *wire.ExecuteCommandRequestMsg:
@@ -105,6 +209,28 @@ func (a *Agent) handleMsg(msg wire.Msg) (wire.Msg, error) {
 		reply, err = a.handleBreakCommand(t)
 	case *wire.TerminateCommandRequestMsg:
 		reply, err = a.handleTerminateCommand(t)
+	case *wire.SuspendCommandRequestMsg:
+		reply, err = a.handleSuspendCommand(t)
+	case *wire.LoadProfileRequestMsg:
+		reply, err = a.handleLoadProfile(t)
+	case *wire.MatchOutputRequestMsg:
+		reply, err = a.handleMatchOutput(t)
+	case *wire.LiveSamplesRequestMsg:
+		reply, err = a.handleLiveSamples(t)
+	case *wire.VerifyCleanupRequestMsg:
+		reply, err = a.handleVerifyCleanup(t)
+	case *wire.InjectFaultRequestMsg:
+		reply, err = a.handleInjectFault(t)
+	case *wire.RotateCredentialRequestMsg:
+		reply, err = a.handleRotateCredential(t)
+	case *wire.DebugExecRequestMsg:
+		reply, err = a.handleDebugExec(t)
+	case *wire.LogStreamRequestMsg:
+		reply, err = a.handleLogStream(t)
+	case *wire.LogLinesAckMsg:
+		reply, err = a.handleLogLinesAck()
+	case *wire.AgentUpdateRequestMsg:
+		reply, err = a.handleAgentUpdate(t)
 	case *wire.PingMsg:
 		reply, err = &wire.AckMsg{}, nil
 	case *wire.AckMsg:
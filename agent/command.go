@@ -9,15 +9,18 @@ package agent
 
 import (
 	"bytes"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/mit-dci/opencbdc-tctl/common"
@@ -36,6 +39,14 @@ func (a *Agent) handleExecuteCommand(
 	ret := wire.ExecuteCommandResponseMsg{}
 	ret.Success = true
 
+	// Don't start commands that would be killed by the agent restarting on a
+	// new version
+	if a.isUpdating() {
+		ret.Success = false
+		ret.Error = "Agent is updating"
+		return &ret, nil
+	}
+
 	// Check if the environment in which we need to execute the command
 	// actually exists
 	if !environmentExists(msg.EnvironmentID) {
@@ -63,14 +74,15 @@ func (a *Agent) handleExecuteCommand(
 
 	// Create a command with the passed in (%ENV% substituted) command and
 	// parameters
-	cmd := exec.Command(msg.Command, msg.Parameters...)
+	command := msg.Command
+	params := msg.Parameters
+	exeDir, _ := filepath.Abs(filepath.Dir(os.Args[0]))
 	if msg.Debug {
 		// If the request asks for enabling debugging, change
 		// the command to be gdb in stead, with debug.cmd being the gdb script
 		// that will print proper stack traces upon exceptions that we can
 		// then read using the standard error/output streams
-		exeDir, _ := filepath.Abs(filepath.Dir(os.Args[0]))
-		params := []string{
+		params = []string{
 			"-q", "--batch",
 			"-x", filepath.Join(exeDir, "debug.cmd"),
 			"--return-child-result",
@@ -78,7 +90,15 @@ func (a *Agent) handleExecuteCommand(
 			msg.Command,
 		}
 		params = append(params, msg.Parameters...)
-		cmd = exec.Command("gdb", params...)
+		command = "gdb"
+	}
+	cmd := exec.Command(command, params...)
+
+	// The resources the command may use, if the request limits them
+	limits := cgroupLimits{
+		CPUs:      msg.CgroupCPUs,
+		MemoryMiB: msg.CgroupMemoryMiB,
+		IOWeight:  msg.CgroupIOWeight,
 	}
 
 	// Run the command with the environment directory as working dir
@@ -97,6 +117,37 @@ func (a *Agent) handleExecuteCommand(
 		cmd.Dir = filepath.Join(environmentDir(msg.EnvironmentID), msg.Dir)
 	}
 
+	// If the request asks for running the command in a container, pin the
+	// image by its digest and run the command inside it. Only the request's
+	// environment variables are passed into the container, such that the
+	// userspace environment is fully defined by the image
+	if msg.ContainerImage != "" {
+		ret.ImageDigest, err = resolveContainerImage(msg.ContainerImage)
+		if err != nil {
+			ret.Success = false
+			ret.Error = err.Error()
+			logging.Errorf("Failed to resolve container image: %v", err)
+			return &ret, nil
+		}
+		mounts := []string{environmentDir(msg.EnvironmentID)}
+		if msg.Debug {
+			mounts = append(mounts, exeDir)
+		}
+		dir := cmd.Dir
+		cmd = containerCommand(
+			ret.ImageDigest,
+			ret.CommandID,
+			dir,
+			mounts,
+			msg.Env,
+			msg.Debug,
+			limits,
+			command,
+			params,
+		)
+		cmd.Dir = dir
+	}
+
 	// Open the files that we'll redirect standard out and standard error to
 	outFile := filepath.Join(
 		environmentDir(msg.EnvironmentID),
@@ -133,14 +184,36 @@ func (a *Agent) handleExecuteCommand(
 	cmd.Stdout = wout
 	cmd.Stderr = werr
 
+	// Run the command in its own process group, such that it can be
+	// suspended along with the processes it starts
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	// If the request limits the resources of the command, run it in a cgroup
+	// that enforces them. Containers are limited by docker in stead
+	cgroupDir := ""
+	if !limits.empty() && ret.ImageDigest == "" {
+		cgroupDir, err = createCgroup(ret.CommandID, limits)
+		if err != nil {
+			ret.Success = false
+			ret.Error = fmt.Sprintf("Failed to create cgroup: %s", err.Error())
+			logging.Errorf("Failed to create cgroup: %v", err)
+			return &ret, nil
+		}
+		runInCgroup(cmd, cgroupDir)
+	}
+
 	// Start the command
 	err = cmd.Start()
 	if err != nil {
+		if cgroupDir != "" {
+			removeCgroup(cgroupDir)
+		}
 		ret.Success = false
 		ret.Error = fmt.Sprintf("Failed to start: %s", err.Error())
 		logging.Errorf("Failed to start process: %v", err)
 		return &ret, nil
 	}
+	writeCommandPid(ret.CommandID, cmd.Process.Pid)
 
 	// Create a channel to signal the command exiting to multiple subscribers
 	done := make(chan bool, 5)
@@ -159,13 +232,40 @@ func (a *Agent) handleExecuteCommand(
 			}
 		}
 
+		removeCommandPid(ret.CommandID)
+
+		if cgroupDir != "" {
+			// Make it clear from the output when the command was killed
+			// for exceeding its memory limit
+			if n := cgroupOOMKills(cgroupDir); n > 0 {
+				_, err = werr.Write([]byte(fmt.Sprintf(
+					"%d process(es) killed for exceeding the memory limit of %d MiB\n",
+					n,
+					limits.MemoryMiB,
+				)))
+				if err != nil {
+					logging.Warnf("Could not write OOM kills to stderr: %v", err)
+				}
+			}
+			removeCgroup(cgroupDir)
+		}
+
 		time.Sleep(time.Second * 1) // allow buffers to flush
 
 		done <- true // progress loop in this function
 		done <- true // performance profiling (generic)
 		done <- true // performance profiling (perf)
 		done <- true // network recording
+		done <- true // log rotation
 	}()
+	if msg.LogRotateBytes > 0 {
+		go rotateCommandLogs(
+			[]string{outFile, errFile},
+			msg.LogRotateBytes,
+			msg.LogRotateKeep,
+			done,
+		)
+	}
 	netFile := ""
 	if msg.RecordNetworkTraffic {
 		netFile = filepath.Join(
@@ -195,6 +295,15 @@ func (a *Agent) handleExecuteCommand(
 	}
 
 	processID := cmd.Process.Pid
+	if ret.ImageDigest != "" {
+		// Profile the process inside the container, not the docker client
+		pid, err := containerPid(ret.CommandID)
+		if err != nil {
+			logging.Warnf("Could not determine container PID: %v", err)
+		} else {
+			processID = pid
+		}
+	}
 	if msg.Profile {
 		// If we want to profile the performance while the command is running,
 		// then execute this in a separate goroutine. Pass in the done channel
@@ -241,7 +350,13 @@ func (a *Agent) handleExecuteCommand(
 	}()
 
 	// Insert the pending command into our pendingCommands array
-	a.addPendingCommand(&pendingCommand{cmd: cmd, id: ret.CommandID})
+	a.addPendingCommand(&pendingCommand{
+		cmd:        cmd,
+		id:         ret.CommandID,
+		cgroup:     cgroupDir,
+		stdoutFile: outFile,
+		stderrFile: errFile,
+	})
 
 	// Monitor the completion of the process in a separate goroutine - the main
 	// process loop should return the result to the ExecuteCommand request to
@@ -325,15 +440,16 @@ func (a *Agent) handleExecuteCommand(
 			}
 		}
 
+		// Remove the command from the pendingCommands array, remembering its
+		// exit code in case the coordinator misses the report below
+		a.finishPendingCommand(ret.CommandID, cmd.ProcessState.ExitCode())
+
 		// Report to the controller that the command has completed
 		a.outgoing <- &wire.ExecuteCommandStatusMsg{
 			CommandID: ret.CommandID,
 			Status:    wire.CommandStatusFinished,
 			ExitCode:  cmd.ProcessState.ExitCode(),
 		}
-
-		// Remove the command from the pendingCommands array
-		a.deletePendingCommand(ret.CommandID)
 	}()
 
 	return &ret, nil
@@ -670,8 +786,24 @@ func (a *Agent) getNetBuffers(pid int) ([]byte, error) {
 func (a *Agent) handleBreakCommand(
 	msg *wire.BreakCommandRequestMsg,
 ) (wire.Msg, error) {
+	// A throttled command may be frozen, and would not handle the interrupt
+	// until it is thawed
+	a.stopLoadProfile(msg.CommandID)
+	if found, err := interruptContainer(msg.CommandID); found {
+		if err != nil {
+			logging.Warnf("Error interrupting container: %v", err)
+		}
+		return &wire.AckMsg{}, nil
+	}
 	cmd, ok := a.getPendingExecutingCommand(msg.CommandID)
 	if !ok {
+		if p, found := orphanedCommandProcess(msg.CommandID); found {
+			err := p.Signal(os.Interrupt)
+			if err != nil {
+				logging.Warnf("Error sending Interrupt signal: %v", err)
+			}
+			return &wire.AckMsg{}, nil
+		}
 		logging.Warnf(
 			"Coordinator asked to break command %x which is unknown",
 			msg.CommandID,
@@ -699,8 +831,21 @@ func (a *Agent) handleBreakCommand(
 func (a *Agent) handleTerminateCommand(
 	msg *wire.TerminateCommandRequestMsg,
 ) (wire.Msg, error) {
+	// The docker client exits once its container is gone, so the command
+	// finishes as usual
+	if found, err := removeContainer(msg.CommandID); found && err != nil {
+		logging.Warnf("Error removing container: %v", err)
+	}
 	cmd, ok := a.getPendingExecutingCommand(msg.CommandID)
 	if !ok {
+		if p, found := orphanedCommandProcess(msg.CommandID); found {
+			err := p.Signal(os.Kill)
+			if err != nil {
+				logging.Warnf("Error sending Kill signal: %v", err)
+			}
+			removeCommandPid(msg.CommandID)
+			return &wire.AckMsg{}, nil
+		}
 		logging.Warnf(
 			"Coordinator asked to terminate command %x which is unknown",
 			msg.CommandID,
@@ -721,6 +866,81 @@ func (a *Agent) handleTerminateCommand(
 	return &wire.AckMsg{}, nil
 }
 
+// handleSuspendCommand handles the SuspendCommandRequestMsg. This message is
+// used to instruct the agent to suspend the command identified by its ID, or
+// to resume it after it was suspended
+func (a *Agent) handleSuspendCommand(
+	msg *wire.SuspendCommandRequestMsg,
+) (wire.Msg, error) {
+	if ok, err := a.suspendLoadProfile(msg.CommandID, msg.Resume); ok {
+		if err != nil {
+			return nil, err
+		}
+		return &wire.AckMsg{}, nil
+	}
+	if found, err := pauseContainer(msg.CommandID, msg.Resume); found {
+		if err != nil {
+			return nil, err
+		}
+		return &wire.AckMsg{}, nil
+	}
+	var proc *os.Process
+	cmd, ok := a.getPendingExecutingCommand(msg.CommandID)
+	if ok && cmd != nil {
+		proc = cmd.Process
+	} else if !ok {
+		proc, _ = orphanedCommandProcess(msg.CommandID)
+	}
+	if proc == nil {
+		return nil, fmt.Errorf("command %x is not running", msg.CommandID)
+	}
+	sig := syscall.SIGSTOP
+	if msg.Resume {
+		sig = syscall.SIGCONT
+	}
+	// Commands lead their own process group, which holds the processes they
+	// started as well
+	pid := proc.Pid
+	if pgid, err := syscall.Getpgid(pid); err == nil && pgid == pid {
+		pid = -pgid
+	}
+	err := syscall.Kill(pid, sig)
+	if err != nil {
+		return nil, fmt.Errorf("error sending %v signal: %v", sig, err)
+	}
+	return &wire.AckMsg{}, nil
+}
+
+// handleMatchOutput handles the MatchOutputRequestMsg. This message is used
+// to probe whether a role is ready by checking if a line of the standard
+// output or error of its command matches a regular expression
+func (a *Agent) handleMatchOutput(
+	msg *wire.MatchOutputRequestMsg,
+) (wire.Msg, error) {
+	re, err := regexp.Compile(msg.Pattern)
+	if err != nil {
+		return nil, err
+	}
+	for _, stream := range []string{"stdout", "stderr"} {
+		b, err := ioutil.ReadFile(filepath.Join(
+			environmentDir(msg.EnvironmentID),
+			fmt.Sprintf("command_%x_%s.txt", msg.CommandID, stream),
+		))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range strings.Split(string(b), "\n") {
+			if re.MatchString(l) {
+				return &wire.MatchOutputResponseMsg{Matched: true}, nil
+			}
+		}
+	}
+	return &wire.MatchOutputResponseMsg{Matched: false}, nil
+}
+
 // addPendingCommand acquires a lock on the pendingCommands array and inserts
 // a new command into it
 func (a *Agent) addPendingCommand(cmd *pendingCommand) {
@@ -729,9 +949,11 @@ func (a *Agent) addPendingCommand(cmd *pendingCommand) {
 	a.pendingCommands = append(a.pendingCommands, cmd)
 }
 
-// addPendingCommand acquires a lock on the pendingCommands array and removes
-// the command identified by the passed id from it
-func (a *Agent) deletePendingCommand(id []byte) {
+// finishPendingCommand acquires a lock on the pendingCommands array and
+// removes the command identified by the passed id from it. Its exit code is
+// kept for finishedCommandRetention, such that the agent can pass it to the
+// coordinator when it reconnects
+func (a *Agent) finishPendingCommand(id []byte, exitCode int) {
 	a.pendingCommandsLock.Lock()
 	defer a.pendingCommandsLock.Unlock()
 	newPendingCommands := []*pendingCommand{}
@@ -741,6 +963,17 @@ func (a *Agent) deletePendingCommand(id []byte) {
 		}
 	}
 	a.pendingCommands = newPendingCommands
+
+	for k, c := range a.finishedCommands {
+		if time.Since(c.finished) > finishedCommandRetention {
+			delete(a.finishedCommands, k)
+		}
+	}
+	a.finishedCommands[hex.EncodeToString(id)] = finishedCommand{
+		id:       id,
+		exitCode: exitCode,
+		finished: time.Now(),
+	}
 }
 
 // getPendingCommand returns the command identified by the given ID
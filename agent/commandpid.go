@@ -0,0 +1,67 @@
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// commandPidFile returns the file in which the process ID of a running
+// command is kept. The commands keep running when the agent restarts after
+// losing its connection to the coordinator, and these files allow the
+// restarted agent to still signal them
+func commandPidFile(commandID []byte) string {
+	return filepath.Join(common.DataDir(), "pids", fmt.Sprintf("%x", commandID))
+}
+
+// writeCommandPid records the process ID of a command that was started
+func writeCommandPid(commandID []byte, pid int) {
+	err := os.MkdirAll(filepath.Dir(commandPidFile(commandID)), 0755)
+	if err == nil {
+		err = ioutil.WriteFile(
+			commandPidFile(commandID),
+			[]byte(strconv.Itoa(pid)),
+			0644,
+		)
+	}
+	if err != nil {
+		logging.Warnf("Unable to record the PID of command %x: %v", commandID, err)
+	}
+}
+
+// removeCommandPid removes the process ID of a command that exited
+func removeCommandPid(commandID []byte) {
+	err := os.Remove(commandPidFile(commandID))
+	if err != nil && !os.IsNotExist(err) {
+		logging.Warnf("Unable to remove the PID of command %x: %v", commandID, err)
+	}
+}
+
+// orphanedCommandProcess returns the process of a command that was started
+// before the agent restarted and is still running. Returns false if there is
+// no such command
+func orphanedCommandProcess(commandID []byte) (*os.Process, bool) {
+	b, err := ioutil.ReadFile(commandPidFile(commandID))
+	if err != nil {
+		return nil, false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, false
+	}
+	if _, err := os.Stat(filepath.Join("/proc", strconv.Itoa(pid))); err != nil {
+		removeCommandPid(commandID)
+		return nil, false
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return nil, false
+	}
+	return p, true
+}
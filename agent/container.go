@@ -0,0 +1,202 @@
+package agent
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// resolveContainerImage makes sure the given image is present on the agent and
+// returns its digest-pinned reference (repository@sha256:...). Images that are
+// already pinned by digest and present locally are not pulled again
+func resolveContainerImage(image string) (string, error) {
+	if !strings.Contains(image, "@sha256:") || !containerImageExists(image) {
+		out, err := exec.Command("docker", "pull", image).CombinedOutput()
+		if err != nil {
+			return "", fmt.Errorf(
+				"unable to pull image %s: %v\n%s",
+				image,
+				err,
+				string(out),
+			)
+		}
+	}
+
+	out, err := exec.Command(
+		"docker",
+		"image",
+		"inspect",
+		"--format",
+		"{{range .RepoDigests}}{{println .}}{{end}}",
+		image,
+	).Output()
+	if err != nil {
+		return "", fmt.Errorf("unable to inspect image %s: %v", image, err)
+	}
+	digests := strings.Fields(string(out))
+	if len(digests) == 0 {
+		return "", fmt.Errorf("image %s has no repository digest", image)
+	}
+	// Prefer the digest of the repository the image was requested from
+	repo := strings.SplitN(image, "@", 2)[0]
+	if i := strings.LastIndex(repo, ":"); i > strings.LastIndex(repo, "/") {
+		repo = repo[:i]
+	}
+	for _, d := range digests {
+		if strings.HasPrefix(d, repo+"@") {
+			return d, nil
+		}
+	}
+	return digests[0], nil
+}
+
+func containerImageExists(image string) bool {
+	return exec.Command("docker", "image", "inspect", image).Run() == nil
+}
+
+// containerName returns the name of the container running the command with
+// the given ID
+func containerName(commandID []byte) string {
+	return fmt.Sprintf("tctl-%x", commandID)
+}
+
+// containerExists returns true if there is a container for the command with
+// the given ID
+func containerExists(commandID []byte) bool {
+	return exec.Command(
+		"docker",
+		"container",
+		"inspect",
+		containerName(commandID),
+	).Run() == nil
+}
+
+// runContainerCommand runs the docker command with the given arguments on
+// the container of the command with the given ID. Returns false if the
+// command does not run in a container
+func runContainerCommand(commandID []byte, args ...string) (bool, error) {
+	if !containerExists(commandID) {
+		return false, nil
+	}
+	args = append(args, containerName(commandID))
+	out, err := exec.Command("docker", args...).CombinedOutput()
+	if err != nil {
+		return true, fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return true, nil
+}
+
+// interruptContainer sends an interrupt to the main process in the container
+// of the command with the given ID. The docker client only forwards the
+// signals it receives while it's attached, so the container is signalled
+// directly
+func interruptContainer(commandID []byte) (bool, error) {
+	return runContainerCommand(commandID, "kill", "--signal", "SIGINT")
+}
+
+// removeContainer kills and removes the container of the command with the
+// given ID. Killing the docker client would leave the container running
+func removeContainer(commandID []byte) (bool, error) {
+	return runContainerCommand(commandID, "rm", "-f")
+}
+
+// pauseContainer suspends or resumes all processes in the container of the
+// command with the given ID
+func pauseContainer(commandID []byte, resume bool) (bool, error) {
+	if resume {
+		return runContainerCommand(commandID, "unpause")
+	}
+	return runContainerCommand(commandID, "pause")
+}
+
+// containerCgroup returns the directory of the cgroup of the container running
+// the command with the given ID. Returns false if the command does not run in
+// a container
+func containerCgroup(commandID []byte) (string, bool, error) {
+	if !containerExists(commandID) {
+		return "", false, nil
+	}
+	out, err := exec.Command(
+		"docker",
+		"container",
+		"inspect",
+		"--format",
+		"{{.State.Pid}}",
+		containerName(commandID),
+	).Output()
+	if err != nil {
+		return "", true, fmt.Errorf("unable to inspect container: %v", err)
+	}
+	dir, err := processCgroup(strings.TrimSpace(string(out)))
+	return dir, true, err
+}
+
+// containerCommand returns the docker command that runs the given command and
+// parameters inside the (digest-pinned) image. The container shares the
+// host's network and IPC namespaces, such that the roles behave the same as
+// when they run on the host, and the directory the command runs in is mounted
+// at the same path so paths in the parameters remain valid. Docker enforces
+// the resource limits on the container
+func containerCommand(
+	image string,
+	commandID []byte,
+	dir string,
+	mounts []string,
+	env []string,
+	privileged bool,
+	limits cgroupLimits,
+	command string,
+	params []string,
+) *exec.Cmd {
+	args := []string{
+		"run",
+		"--rm",
+		"--name", containerName(commandID),
+		"--network", "host",
+		"--ipc", "host",
+		"-w", dir,
+	}
+	for _, m := range mounts {
+		args = append(args, "-v", fmt.Sprintf("%s:%s", m, m))
+	}
+	for _, e := range env {
+		args = append(args, "-e", e)
+	}
+	if privileged {
+		// Needed for running the command in gdb
+		args = append(args, "--cap-add", "SYS_PTRACE")
+	}
+	args = append(args, containerLimitArgs(limits)...)
+	args = append(args, image, command)
+	args = append(args, params...)
+	return exec.Command("docker", args...)
+}
+
+// containerPid returns the host PID of the main process in the container that
+// runs the command with the given ID, waiting up to ten seconds for the
+// container to start
+func containerPid(commandID []byte) (int, error) {
+	var lastErr error
+	for i := 0; i < 20; i++ {
+		out, err := exec.Command(
+			"docker",
+			"inspect",
+			"--format",
+			"{{.State.Pid}}",
+			containerName(commandID),
+		).Output()
+		if err == nil {
+			pid, err := strconv.Atoi(strings.TrimSpace(string(out)))
+			if err == nil && pid > 0 {
+				return pid, nil
+			}
+			lastErr = fmt.Errorf("container is not running yet")
+		} else {
+			lastErr = err
+		}
+		time.Sleep(time.Millisecond * 500)
+	}
+	return 0, lastErr
+}
@@ -0,0 +1,48 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+	"github.com/mit-dci/opencbdc-tctl/wire"
+)
+
+// agentCredentialPath returns the path where the agent stores the credential
+// it received from the coordinator through credential rotation
+func agentCredentialPath() string {
+	return filepath.Join(common.DataDir(), "agent-credential")
+}
+
+// HasStoredCredential returns true if the agent received a credential from
+// the coordinator during an earlier connection, which it should then use to
+// enroll in stead of its initial enrollment method
+func HasStoredCredential() bool {
+	_, err := os.Stat(agentCredentialPath())
+	return err == nil
+}
+
+// readStoredCredential reads the credential stored by the last credential
+// rotation
+func readStoredCredential() ([]byte, error) {
+	return ioutil.ReadFile(agentCredentialPath())
+}
+
+// handleRotateCredential stores the new credential handed out by the
+// coordinator, replacing the previous one, and uses it for enrolling from now
+// on
+func (a *Agent) handleRotateCredential(
+	msg *wire.RotateCredentialRequestMsg,
+) (wire.Msg, error) {
+	err := writeFileAtomic(agentCredentialPath(), msg.Credential, 0600)
+	if err != nil {
+		logging.Errorf("Unable to store rotated credential: %v", err)
+		return &wire.RotateCredentialResponseMsg{Success: false}, nil
+	}
+	a.enrollmentMethod = common.EnrollmentMethodAgentCredential
+	a.enrollmentCredential = msg.Credential
+	logging.Infof("Stored rotated credential")
+	return &wire.RotateCredentialResponseMsg{Success: true}, nil
+}
@@ -0,0 +1,231 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+	"github.com/mit-dci/opencbdc-tctl/wire"
+)
+
+// debugExecDefaultTimeout is the time a debug command may run when the
+// coordinator didn't specify one
+const debugExecDefaultTimeout = 30 * time.Second
+
+// debugExecMaxTimeout is the longest time a debug command may run
+const debugExecMaxTimeout = 2 * time.Minute
+
+// debugExecMaxOutput is the maximum number of bytes of stdout and stderr each
+// that are returned from a debug command
+const debugExecMaxOutput = 64 << 10
+
+// debugReadableDirs are the directories, besides the environments in the data
+// directory, debug commands may read paths in
+var debugReadableDirs = []string{"/var/log", "/tmp", cgroupRoot}
+
+// limitedBuffer is a buffer that keeps at most max bytes written to it, and
+// discards the rest
+type limitedBuffer struct {
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+// Write implements io.Writer
+func (l *limitedBuffer) Write(p []byte) (int, error) {
+	room := l.max - l.buf.Len()
+	if len(p) > room {
+		l.truncated = true
+		l.buf.Write(p[:room])
+		return len(p), nil
+	}
+	return l.buf.Write(p)
+}
+
+// handleDebugExec handles the DebugExecRequestMsg. Since debug commands can
+// run for a while, the command is run in the background and its reply is sent
+// once it exited, such that it doesn't hold up the messages of the test runs
+func (a *Agent) handleDebugExec(
+	msg *wire.DebugExecRequestMsg,
+) (wire.Msg, error) {
+	id := wire.GetMessageHeaderID(msg, "ID")
+	_, session := a.connection()
+	go func() {
+		reply := a.debugExec(msg)
+		if _, current := a.connection(); current != session {
+			logging.Infof(
+				"Dropping reply to debug command %d of an earlier session",
+				id,
+			)
+			return
+		}
+		wire.SetMessageHeaderID(reply, "YourID", id)
+		a.outgoing <- reply
+	}()
+	return nil, nil
+}
+
+// debugExec checks the debug command can be run, and runs it
+func (a *Agent) debugExec(
+	msg *wire.DebugExecRequestMsg,
+) *wire.DebugExecResponseMsg {
+	ret := &wire.DebugExecResponseMsg{ExitCode: -1}
+	dir, err := debugExecDir(msg.Dir)
+	if err != nil {
+		ret.Error = err.Error()
+		return ret
+	}
+	paths, files, err := common.CheckDebugCommand(msg.Args)
+	if err != nil {
+		ret.Error = err.Error()
+		return ret
+	}
+	d, _ := common.FindDebugCommand(msg.Args[0])
+	if d.Recursive && len(paths) == 0 {
+		paths = []string{dir}
+	}
+	for _, p := range paths {
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(dir, p)
+		}
+		err = checkDebugPath(p, d.Recursive)
+		if err != nil {
+			ret.Error = err.Error()
+			return ret
+		}
+	}
+	for _, p := range files {
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(dir, p)
+		}
+		err = checkDebugPath(p, false)
+		if err != nil {
+			ret.Error = err.Error()
+			return ret
+		}
+	}
+
+	timeout := time.Duration(msg.TimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = debugExecDefaultTimeout
+	}
+	if timeout > debugExecMaxTimeout {
+		timeout = debugExecMaxTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	logging.Infof(
+		"Running debug command [%s] in %s",
+		strings.Join(msg.Args, " "),
+		dir,
+	)
+	stdout := &limitedBuffer{max: debugExecMaxOutput}
+	stderr := &limitedBuffer{max: debugExecMaxOutput}
+	cmd := exec.CommandContext(ctx, msg.Args[0], msg.Args[1:]...)
+	cmd.Dir = dir
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	err = cmd.Run()
+	ret.Stdout = stdout.buf.Bytes()
+	ret.Stderr = stderr.buf.Bytes()
+	ret.Truncated = stdout.truncated || stderr.truncated
+	ret.TimedOut = ctx.Err() == context.DeadlineExceeded
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		ret.ExitCode = exitErr.ExitCode()
+	} else if err != nil {
+		ret.Error = err.Error()
+	} else {
+		ret.ExitCode = 0
+	}
+	return ret
+}
+
+// debugExecDir returns the directory to run a debug command in, which must be
+// a directory debug commands may read
+func debugExecDir(dir string) (string, error) {
+	if dir == "" {
+		dir = common.DataDir()
+	} else if !filepath.IsAbs(dir) {
+		dir = filepath.Join(common.DataDir(), dir)
+	}
+	err := checkDebugPath(dir, false)
+	if err != nil {
+		return "", err
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return "", err
+	}
+	if !fi.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", dir)
+	}
+	return dir, nil
+}
+
+// checkDebugPath checks debug commands may read the path. They may read the
+// environments in the data directory and the directories in
+// debugReadableDirs, but not the files directly in the data directory since
+// these hold the credential and identity of the agent. For the same reason,
+// commands that read recursively may not be given the data directory itself
+func checkDebugPath(path string, recursive bool) error {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// Nothing to read, let the command report it
+			return nil
+		}
+		return err
+	}
+
+	dataDir, err := filepath.EvalSymlinks(common.DataDir())
+	if err == nil {
+		if resolved == dataDir {
+			if recursive {
+				return fmt.Errorf(
+					"%s can't be read recursively by debug commands",
+					path,
+				)
+			}
+			return nil
+		}
+		if rel, ok := pathWithin(dataDir, resolved); ok {
+			if strings.Contains(rel, string(filepath.Separator)) {
+				return nil
+			}
+			fi, err := os.Stat(resolved)
+			if err == nil && fi.IsDir() {
+				return nil
+			}
+			return fmt.Errorf("%s can't be read by debug commands", path)
+		}
+	}
+	for _, d := range debugReadableDirs {
+		if resolved == d {
+			return nil
+		}
+		if _, ok := pathWithin(d, resolved); ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s can't be read by debug commands", path)
+}
+
+// pathWithin returns the path relative to dir, if it is below it
+func pathWithin(dir, path string) (string, bool) {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil || rel == "." || rel == ".." ||
+		strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return rel, true
+}
@@ -0,0 +1,123 @@
+package agent
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+)
+
+// imdsEndpoint is the address of the EC2 instance metadata service
+const imdsEndpoint = "http://169.254.169.254"
+
+// GetEnrollmentCredential returns the credential the agent presents to the
+// coordinator upon connecting, based on the configured enrollment method. For
+// the bootstrap token and join token methods the token is passed in by the
+// caller, for the instance identity method the credential is fetched from the instance
+// metadata service. For the agent credential method, the credential stored by
+// the last credential rotation is used. If no method is configured, no
+// credential is returned
+func GetEnrollmentCredential(method, token string) ([]byte, error) {
+	switch method {
+	case "":
+		return nil, nil
+	case common.EnrollmentMethodBootstrapToken:
+		if token == "" {
+			return nil, fmt.Errorf("no bootstrap token configured")
+		}
+		return []byte(token), nil
+	case common.EnrollmentMethodJoinToken:
+		if token == "" {
+			return nil, fmt.Errorf("no join token configured")
+		}
+		return []byte(token), nil
+	case common.EnrollmentMethodInstanceIdentity:
+		return getInstanceIdentityCredential()
+	case common.EnrollmentMethodAgentCredential:
+		return readStoredCredential()
+	}
+	return nil, fmt.Errorf("unknown enrollment method [%s]", method)
+}
+
+// imdsGetter returns a func that fetches paths from the instance metadata
+// service, using an IMDSv2 session token
+func imdsGetter() (func(path string) ([]byte, error), error) {
+	clt := &http.Client{Timeout: time.Second * 5}
+
+	// Fetch a session token for IMDSv2
+	req, err := http.NewRequest(
+		"PUT",
+		fmt.Sprintf("%s/latest/api/token", imdsEndpoint),
+		nil,
+	)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+	token, err := imdsRequest(clt, req)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get IMDS token: %v", err)
+	}
+
+	return func(path string) ([]byte, error) {
+		req, err := http.NewRequest(
+			"GET",
+			fmt.Sprintf("%s%s", imdsEndpoint, path),
+			nil,
+		)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-aws-ec2-metadata-token", string(token))
+		return imdsRequest(clt, req)
+	}, nil
+}
+
+// getInstanceIdentityCredential fetches the instance identity document and its
+// signature from the instance metadata service (using IMDSv2) and returns them
+// JSON encoded
+func getInstanceIdentityCredential() ([]byte, error) {
+	get, err := imdsGetter()
+	if err != nil {
+		return nil, err
+	}
+
+	doc, err := get("/latest/dynamic/instance-identity/document")
+	if err != nil {
+		return nil, fmt.Errorf("Could not get instance identity: %v", err)
+	}
+	sig, err := get("/latest/dynamic/instance-identity/signature")
+	if err != nil {
+		return nil, fmt.Errorf("Could not get instance signature: %v", err)
+	}
+	sigBytes, err := base64.StdEncoding.DecodeString(
+		strings.TrimSpace(string(sig)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("Could not decode instance signature: %v", err)
+	}
+
+	return json.Marshal(common.InstanceIdentityCredential{
+		Document:  doc,
+		Signature: sigBytes,
+	})
+}
+
+// imdsRequest executes a request against the instance metadata service and
+// returns the response body
+func imdsRequest(clt *http.Client, req *http.Request) ([]byte, error) {
+	resp, err := clt.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
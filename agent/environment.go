@@ -52,6 +52,9 @@ func (a *Agent) handlePrepareEnvironment(
 func (a *Agent) handleDestroyEnvironment(
 	msg *wire.DestroyEnvironmentMsg,
 ) (wire.Msg, error) {
+	// Faults the coordinator didn't revert, for instance because it lost the
+	// connection to the agent, should not affect the next test run
+	a.revertEnvironmentFaults(msg.EnvironmentID)
 	err := os.RemoveAll(environmentDir(msg.EnvironmentID))
 	if err != nil {
 		return nil, err
@@ -0,0 +1,341 @@
+package agent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+	"github.com/mit-dci/opencbdc-tctl/wire"
+)
+
+// cgroupRoot is where the unified (v2) cgroup hierarchy is mounted
+const cgroupRoot = "/sys/fs/cgroup"
+
+// activeFault is a fault injected on the agent that has not been reverted
+type activeFault struct {
+	environmentID []byte
+	revert        func() error
+}
+
+// handleInjectFault handles the InjectFaultRequestMsg, which injects a network
+// or disk fault on the agent for chaos testing, or reverts it
+func (a *Agent) handleInjectFault(
+	msg *wire.InjectFaultRequestMsg,
+) (wire.Msg, error) {
+	id := fmt.Sprintf("%x", msg.FaultID)
+	if msg.Revert {
+		return &wire.AckMsg{}, a.revertFault(id)
+	}
+
+	var revert func() error
+	var err error
+	switch common.FaultKind(msg.Kind) {
+	case common.FaultKindPartition:
+		revert, err = injectPartition(id, msg.PeerIPs)
+	case common.FaultKindNetem:
+		revert, err = injectNetem(msg.LatencyMs, msg.JitterMs, msg.LossPercent)
+	case common.FaultKindDiskThrottle:
+		revert, err = a.injectDiskThrottle(id, msg.DiskBytesPerSecond)
+	default:
+		err = fmt.Errorf("unknown fault kind %q", msg.Kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	logging.Infof("Injected %s fault %s", msg.Kind, id)
+	a.activeFaultsLock.Lock()
+	a.activeFaults[id] = &activeFault{
+		environmentID: msg.EnvironmentID,
+		revert:        revert,
+	}
+	a.activeFaultsLock.Unlock()
+	return &wire.AckMsg{}, nil
+}
+
+// revertFault reverts the active fault with the given ID
+func (a *Agent) revertFault(id string) error {
+	a.activeFaultsLock.Lock()
+	f, ok := a.activeFaults[id]
+	delete(a.activeFaults, id)
+	a.activeFaultsLock.Unlock()
+	if !ok {
+		return fmt.Errorf("fault %s is not active", id)
+	}
+	logging.Infof("Reverting fault %s", id)
+	return f.revert()
+}
+
+// revertEnvironmentFaults reverts the faults that are still active for the
+// environment
+func (a *Agent) revertEnvironmentFaults(environmentID []byte) {
+	a.activeFaultsLock.Lock()
+	ids := []string{}
+	for id, f := range a.activeFaults {
+		if bytes.Equal(f.environmentID, environmentID) {
+			ids = append(ids, id)
+		}
+	}
+	a.activeFaultsLock.Unlock()
+	for _, id := range ids {
+		if err := a.revertFault(id); err != nil {
+			logging.Warnf("Unable to revert fault %s: %v", id, err)
+		}
+	}
+}
+
+// runFaultCommand runs a command to inject or revert a fault, and includes
+// its output in the error if it fails
+func runFaultCommand(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf(
+			"%s %s failed: %v (%s)",
+			name,
+			strings.Join(args, " "),
+			err,
+			strings.TrimSpace(string(out)),
+		)
+	}
+	return nil
+}
+
+// partitionRules returns the iptables rules that drop the traffic to and
+// from the peer IP. The comment identifies the rules of the fault
+func partitionRules(id, ip string) [][]string {
+	comment := []string{"-m", "comment", "--comment", "tctl-fault-" + id}
+	return [][]string{
+		append([]string{"INPUT", "-s", ip, "-j", "DROP"}, comment...),
+		append([]string{"OUTPUT", "-d", ip, "-j", "DROP"}, comment...),
+	}
+}
+
+// injectPartition drops all traffic between the agent and the peer IPs
+func injectPartition(id string, peerIPs []string) (func() error, error) {
+	if len(peerIPs) == 0 {
+		return nil, errors.New("no peers to partition from")
+	}
+	revert := func() error {
+		errs := []string{}
+		for _, ip := range peerIPs {
+			for _, rule := range partitionRules(id, ip) {
+				err := runFaultCommand("iptables", append([]string{"-D"}, rule...)...)
+				if err != nil {
+					errs = append(errs, err.Error())
+				}
+			}
+		}
+		if len(errs) > 0 {
+			return errors.New(strings.Join(errs, "; "))
+		}
+		return nil
+	}
+	for _, ip := range peerIPs {
+		for _, rule := range partitionRules(id, ip) {
+			err := runFaultCommand("iptables", append([]string{"-I"}, rule...)...)
+			if err != nil {
+				// Don't leave part of the partition in place
+				_ = revert()
+				return nil, err
+			}
+		}
+	}
+	return revert, nil
+}
+
+// injectNetem adds latency, jitter and packet loss to the agent's network
+// interface using a netem queueing discipline. Only one netem fault can be
+// active at a time
+func injectNetem(
+	latencyMs, jitterMs int,
+	lossPercent float64,
+) (func() error, error) {
+	iface, err := GetNetworkInterfaceName()
+	if err != nil {
+		return nil, err
+	}
+	args := []string{"qdisc", "add", "dev", iface, "root", "netem"}
+	if latencyMs > 0 {
+		args = append(args, "delay", fmt.Sprintf("%dms", latencyMs))
+		if jitterMs > 0 {
+			args = append(args, fmt.Sprintf("%dms", jitterMs))
+		}
+	}
+	if lossPercent > 0 {
+		args = append(args, "loss", fmt.Sprintf("%g%%", lossPercent))
+	}
+	err = runFaultCommand("tc", args...)
+	if err != nil {
+		return nil, err
+	}
+	return func() error {
+		return runFaultCommand("tc", "qdisc", "del", "dev", iface, "root")
+	}, nil
+}
+
+// blockDevice returns the major:minor number of the disk the agent's data
+// directory is on. The io controller only accepts whole disks, so for
+// partitions the disk they are on is returned
+func blockDevice() (string, error) {
+	var st syscall.Stat_t
+	err := syscall.Stat(common.DataDir(), &st)
+	if err != nil {
+		return "", err
+	}
+	dev := uint64(st.Dev)
+	major := (dev>>8)&0xfff | (dev>>32)&^0xfff
+	minor := dev&0xff | (dev>>12)&^0xff
+	devNum := fmt.Sprintf("%d:%d", major, minor)
+
+	// The entry in /sys/dev/block is a link into the device tree, in which
+	// partitions are below the disk they are on
+	sysDir, err := filepath.EvalSymlinks(filepath.Join("/sys/dev/block", devNum))
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(filepath.Join(sysDir, "partition")); err == nil {
+		b, err := ioutil.ReadFile(filepath.Join(sysDir, "..", "dev"))
+		if err != nil {
+			return "", err
+		}
+		devNum = strings.TrimSpace(string(b))
+	}
+	return devNum, nil
+}
+
+// injectDiskThrottle moves the processes of the running commands into a
+// cgroup that limits their disk bandwidth. Processes the commands start
+// afterwards inherit the cgroup. Commands that run in a cgroup enforcing
+// their resource limits are throttled in that cgroup in stead, such that they
+// keep their limits. Commands running in a container are not affected, since
+// their processes are children of the container runtime
+func (a *Agent) injectDiskThrottle(
+	id string,
+	bytesPerSecond int64,
+) (func() error, error) {
+	if bytesPerSecond <= 0 {
+		return nil, errors.New("disk bandwidth has to be positive")
+	}
+	dev, err := blockDevice()
+	if err != nil {
+		return nil, fmt.Errorf("unable to determine block device: %v", err)
+	}
+	// Enable the io controller for the cgroups below the root, which fails
+	// harmlessly if it already is
+	_ = ioutil.WriteFile(
+		filepath.Join(cgroupRoot, "cgroup.subtree_control"),
+		[]byte("+io"),
+		0644,
+	)
+	cgroup := filepath.Join(cgroupRoot, "tctl-fault-"+id)
+	err = os.Mkdir(cgroup, 0755)
+	if err != nil {
+		return nil, err
+	}
+	limited := []string{}
+	// The cgroups the processes were moved from, to which they are moved back
+	// when the fault is reverted. Processes the commands started afterwards
+	// are moved to the cgroup of the agent, which the commands inherited
+	original := map[string]string{}
+	fallback, err := processCgroup("self")
+	if err != nil {
+		fallback = cgroupRoot
+	}
+	revert := func() error {
+		for _, dir := range limited {
+			// The cgroup is gone if its command exited
+			_ = ioutil.WriteFile(
+				filepath.Join(dir, "io.max"),
+				[]byte(fmt.Sprintf("%s rbps=max wbps=max", dev)),
+				0644,
+			)
+		}
+		// Move the processes back to their original cgroup, which is
+		// required before the cgroup can be removed
+		b, err := ioutil.ReadFile(filepath.Join(cgroup, "cgroup.procs"))
+		if err == nil {
+			for _, pid := range strings.Fields(string(b)) {
+				dir, ok := original[pid]
+				if !ok {
+					dir = fallback
+				}
+				err = ioutil.WriteFile(
+					filepath.Join(dir, "cgroup.procs"),
+					[]byte(pid),
+					0644,
+				)
+				if err != nil && dir != cgroupRoot {
+					// The original cgroup could be gone
+					_ = ioutil.WriteFile(
+						filepath.Join(cgroupRoot, "cgroup.procs"),
+						[]byte(pid),
+						0644,
+					)
+				}
+			}
+		}
+		return os.Remove(cgroup)
+	}
+
+	ioMax := []byte(fmt.Sprintf(
+		"%s rbps=%d wbps=%d",
+		dev,
+		bytesPerSecond,
+		bytesPerSecond,
+	))
+	err = ioutil.WriteFile(filepath.Join(cgroup, "io.max"), ioMax, 0644)
+	if err != nil {
+		_ = revert()
+		return nil, fmt.Errorf("unable to set io.max: %v", err)
+	}
+
+	a.pendingCommandsLock.Lock()
+	defer a.pendingCommandsLock.Unlock()
+	for _, c := range a.pendingCommands {
+		if c.cmd == nil || c.cmd.Process == nil {
+			continue
+		}
+		if c.cgroup != "" {
+			err = enableCgroupControllers([]string{"io"})
+			if err == nil {
+				err = ioutil.WriteFile(
+					filepath.Join(c.cgroup, "io.max"),
+					ioMax,
+					0644,
+				)
+			}
+			if err != nil {
+				logging.Warnf("Unable to throttle cgroup %s: %v", c.cgroup, err)
+				continue
+			}
+			limited = append(limited, c.cgroup)
+			continue
+		}
+		pid := strconv.Itoa(c.cmd.Process.Pid)
+		if dir, err := processCgroup(pid); err == nil {
+			original[pid] = dir
+		}
+		err = ioutil.WriteFile(
+			filepath.Join(cgroup, "cgroup.procs"),
+			[]byte(pid),
+			0644,
+		)
+		if err != nil {
+			logging.Warnf(
+				"Unable to throttle process %d: %v",
+				c.cmd.Process.Pid,
+				err,
+			)
+		}
+	}
+	return revert, nil
+}
@@ -2,6 +2,7 @@ package agent
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 
@@ -80,3 +81,14 @@ func (a *Agent) handleDeployFile(
 
 	return ret, nil
 }
+
+// writeFileAtomic writes the file through a temporary file that replaces it
+// once it's complete, such that a crash can't leave a truncated file behind
+func writeFileAtomic(path string, b []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	err := ioutil.WriteFile(tmp, b, perm)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
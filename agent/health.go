@@ -0,0 +1,104 @@
+package agent
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/logging"
+	"github.com/mit-dci/opencbdc-tctl/wire"
+)
+
+// healthInterval is the interval at which the agent reports the utilization
+// of its system to the coordinator
+const healthInterval = 10 * time.Second
+
+// cpuTimes reads the total and idle CPU time over all cores from /proc/stat,
+// in clock ticks
+func cpuTimes() (total, idle uint64, ok bool) {
+	b, err := ioutil.ReadFile("/proc/stat")
+	if err != nil {
+		return 0, 0, false
+	}
+	for _, l := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(l)
+		if len(fields) < 5 || fields[0] != "cpu" {
+			continue
+		}
+		for i, f := range fields[1:] {
+			v, err := strconv.ParseUint(f, 10, 64)
+			if err != nil {
+				return 0, 0, false
+			}
+			total += v
+			// Both idle and iowait count as idle
+			if i == 3 || i == 4 {
+				idle += v
+			}
+		}
+		return total, idle, true
+	}
+	return 0, 0, false
+}
+
+// networkBytes reads the bytes received and sent on the network interface
+// from /proc/net/dev
+func networkBytes(iface string) (rx, tx uint64, ok bool) {
+	b, err := ioutil.ReadFile("/proc/net/dev")
+	if err != nil {
+		return 0, 0, false
+	}
+	for _, l := range strings.Split(string(b), "\n") {
+		parts := strings.SplitN(l, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) != iface {
+			continue
+		}
+		fields := strings.Fields(parts[1])
+		if len(fields) < 9 {
+			return 0, 0, false
+		}
+		rx, err1 := strconv.ParseUint(fields[0], 10, 64)
+		tx, err2 := strconv.ParseUint(fields[8], 10, 64)
+		return rx, tx, err1 == nil && err2 == nil
+	}
+	return 0, 0, false
+}
+
+// healthLoop periodically sends the utilization of the CPU, memory, disk and
+// network of the agent's system to the coordinator. CPU utilization and
+// network throughput are averaged over the interval since the previous report
+func (a *Agent) healthLoop() {
+	iface, err := GetNetworkInterfaceName()
+	if err != nil {
+		logging.Warnf("Not reporting network throughput: %v", err)
+	}
+	prevTotal, prevIdle, cpuOK := cpuTimes()
+	prevRx, prevTx, netOK := networkBytes(iface)
+	prevTime := time.Now()
+	for {
+		time.Sleep(healthInterval)
+		now := time.Now()
+		msg := &wire.AgentHealthMsg{Time: now.UnixNano()}
+		msg.MemTotal, msg.MemAvailable = GetSystemMemory()
+		msg.DiskAvailable = GetDiskSpace()
+
+		total, idle, ok := cpuTimes()
+		if ok && cpuOK && total > prevTotal {
+			busy := float64((total - prevTotal) - (idle - prevIdle))
+			msg.CPUPercent = busy / float64(total-prevTotal) * 100
+		}
+		prevTotal, prevIdle, cpuOK = total, idle, ok
+
+		rx, tx, ok := networkBytes(iface)
+		secs := now.Sub(prevTime).Seconds()
+		if ok && netOK && rx >= prevRx && tx >= prevTx {
+			msg.NetRxBytesPerSec = float64(rx-prevRx) / secs
+			msg.NetTxBytesPerSec = float64(tx-prevTx) / secs
+		}
+		prevRx, prevTx, netOK = rx, tx, ok
+		prevTime = now
+
+		a.outgoing <- msg
+	}
+}
@@ -0,0 +1,53 @@
+package agent
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+)
+
+// agentIdentity is the persistent identity of the agent, which it keeps across
+// reconnects and restarts, and the token the coordinator issued to resume the
+// session of that identity
+type agentIdentity struct {
+	Identity    string `json:"identity"`
+	ResumeToken []byte `json:"resumeToken,omitempty"`
+}
+
+// agentIdentityPath returns the path where the agent stores its identity
+func agentIdentityPath() string {
+	return filepath.Join(common.DataDir(), "agent-identity.json")
+}
+
+// loadIdentity reads the identity of the agent, or generates a new one if the
+// agent has none yet
+func loadIdentity() (agentIdentity, error) {
+	var id agentIdentity
+	b, err := ioutil.ReadFile(agentIdentityPath())
+	if err == nil {
+		err = json.Unmarshal(b, &id)
+	}
+	if err == nil && id.Identity != "" {
+		return id, nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return id, err
+	}
+	id.Identity, err = common.RandomID(32)
+	if err != nil {
+		return id, err
+	}
+	return id, storeIdentity(id)
+}
+
+// storeIdentity writes the identity of the agent to disk
+func storeIdentity(id agentIdentity) error {
+	b, err := json.Marshal(id)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(agentIdentityPath(), b, 0600)
+}
@@ -0,0 +1,65 @@
+package agent
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// signingPublicKey returns the key of the coordinator that deployed files
+// must be signed with, configured base64 encoded in
+// BINARIES_SIGNING_PUBLIC_KEY. Returns nil if no key is configured, in which
+// case signatures are not checked
+func signingPublicKey() (ed25519.PublicKey, error) {
+	v := os.Getenv("BINARIES_SIGNING_PUBLIC_KEY")
+	if v == "" {
+		return nil, nil
+	}
+	b, err := base64.StdEncoding.DecodeString(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid BINARIES_SIGNING_PUBLIC_KEY: %v", err)
+	}
+	if len(b) != ed25519.PublicKeySize {
+		return nil, errors.New("BINARIES_SIGNING_PUBLIC_KEY is not an ed25519 key")
+	}
+	return ed25519.PublicKey(b), nil
+}
+
+// verifyDownload checks the file downloaded at path against the checksum in
+// the deploy request and, if the agent is configured with the signing key of
+// the coordinator, its signature. Files deployed without a checksum are only
+// accepted if they are seed data, or if signatures are not checked
+func verifyDownload(
+	digest string,
+	signature []byte,
+	seedData bool,
+	path string,
+) error {
+	key, err := signingPublicKey()
+	if err != nil {
+		return err
+	}
+	if digest == "" {
+		if key != nil && !seedData {
+			return errors.New("file has no checksum to verify its signature")
+		}
+		return nil
+	}
+	err = common.VerifyFileSHA256(path, digest)
+	if err != nil {
+		return err
+	}
+	if key != nil {
+		err = common.VerifyDigestSignature(key, digest, signature)
+		if err != nil {
+			return err
+		}
+	}
+	logging.Infof("Verified checksum of %s", path)
+	return nil
+}
@@ -0,0 +1,99 @@
+package agent
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/mit-dci/opencbdc-tctl/wire"
+)
+
+// liveSamplesMaxRead is the maximum number of bytes read from a sample file
+// for a single LiveSamplesRequestMsg. Load generators falling further behind
+// are caught up over the following requests
+const liveSamplesMaxRead = 16 * 1024 * 1024
+
+// handleLiveSamples handles the LiveSamplesRequestMsg, which reads the
+// transaction samples a load generator appended to its sample file since the
+// given offset, and returns them aggregated per second. Each line of the file
+// is `<unix timestamp in nanoseconds> <latency in nanoseconds>`
+func (a *Agent) handleLiveSamples(
+	msg *wire.LiveSamplesRequestMsg,
+) (wire.Msg, error) {
+	ret := &wire.LiveSamplesResponseMsg{
+		Offset:  msg.Offset,
+		Buckets: []wire.SampleBucket{},
+	}
+	f, err := os.Open(filepath.Join(
+		environmentDir(msg.EnvironmentID),
+		msg.SourcePath,
+	))
+	if os.IsNotExist(err) {
+		// The load generator has not written any samples yet
+		return ret, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if st.Size() < msg.Offset {
+		// The file was recreated, so start reading it from the beginning
+		ret.Offset = 0
+	}
+	_, err = f.Seek(ret.Offset, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	b, err := io.ReadAll(io.LimitReader(f, liveSamplesMaxRead))
+	if err != nil {
+		return nil, err
+	}
+	// Leave the last line for the next request if it's not complete yet
+	end := bytes.LastIndexByte(b, '\n')
+	if end < 0 {
+		return ret, nil
+	}
+	ret.Offset += int64(end + 1)
+
+	buckets := map[int64]*wire.SampleBucket{}
+	for _, line := range bytes.Split(b[:end], []byte{'\n'}) {
+		fields := bytes.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		ts, err := strconv.ParseFloat(string(fields[0]), 64)
+		if err != nil {
+			continue
+		}
+		latency, err := strconv.ParseFloat(string(fields[1]), 64)
+		if err != nil {
+			continue
+		}
+		sec := int64(ts / 1e9)
+		bucket, ok := buckets[sec]
+		if !ok {
+			bucket = &wire.SampleBucket{Second: sec}
+			buckets[sec] = bucket
+		}
+		bucket.Count++
+		bucket.LatencySum += latency / 1e9
+		if latency/1e9 > bucket.LatencyMax {
+			bucket.LatencyMax = latency / 1e9
+		}
+	}
+	for _, bucket := range buckets {
+		ret.Buckets = append(ret.Buckets, *bucket)
+	}
+	sort.Slice(ret.Buckets, func(i, j int) bool {
+		return ret.Buckets[i].Second < ret.Buckets[j].Second
+	})
+	return ret, nil
+}
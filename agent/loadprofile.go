@@ -0,0 +1,355 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/logging"
+	"github.com/mit-dci/opencbdc-tctl/wire"
+)
+
+// loadProfilePeriod is the period of the duty cycle load generators are
+// throttled with. Within every period the load generator runs for the
+// fraction of the period its load profile prescribes, and is frozen for the
+// rest of it. The period is short such that the transactions in flight are
+// only held up briefly, and a rate-paced load generator has little to catch
+// up on once it's thawed
+const loadProfilePeriod = 20 * time.Millisecond
+
+// loadProfile is a load profile a command is throttled to
+type loadProfile struct {
+	offsets   []time.Duration
+	fractions []float64
+	// The cgroup holding the processes of the command, which is frozen to
+	// throttle them
+	cgroup string
+	// Whether the cgroup was created for the profile, in which case it's
+	// removed once the command exited
+	created bool
+	// Closed when the profile is replaced or the command is stopped
+	stop chan bool
+	// Guards freezing the cgroup, such that the throttle doesn't thaw a
+	// command the coordinator suspended
+	lock      sync.Mutex
+	suspended bool
+}
+
+// fraction returns the fraction of the configured rate the profile prescribes
+// after it has been running for the given time
+func (p *loadProfile) fraction(elapsed time.Duration) float64 {
+	f := p.fractions[len(p.fractions)-1]
+	if elapsed < p.offsets[0] {
+		f = p.fractions[0]
+	}
+	for i := 1; i < len(p.offsets) && elapsed >= p.offsets[0]; i++ {
+		if elapsed >= p.offsets[i] {
+			continue
+		}
+		// Points at the same offset are skipped above, so the span between
+		// the points elapsed falls between is never empty
+		span := p.offsets[i] - p.offsets[i-1]
+		pos := float64(elapsed-p.offsets[i-1]) / float64(span)
+		f = p.fractions[i-1] + pos*(p.fractions[i]-p.fractions[i-1])
+		break
+	}
+	if f < 0 {
+		return 0
+	}
+	if f > 1 {
+		return 1
+	}
+	return f
+}
+
+// freeze freezes or thaws the cgroup of the command, unless the coordinator
+// suspended it
+func (p *loadProfile) freeze(frozen bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.suspended {
+		return
+	}
+	err := freezeCgroup(p.cgroup, frozen)
+	if err != nil && !os.IsNotExist(err) {
+		logging.Warnf("Error freezing cgroup %s: %v", p.cgroup, err)
+	}
+}
+
+// freezeCgroup freezes or thaws all processes in the cgroup
+func freezeCgroup(dir string, frozen bool) error {
+	v := "0"
+	if frozen {
+		v = "1"
+	}
+	return ioutil.WriteFile(
+		filepath.Join(dir, "cgroup.freeze"),
+		[]byte(v),
+		0644,
+	)
+}
+
+// cgroupPopulated returns true if there are processes in the cgroup. A cgroup
+// that no longer exists is not
+func cgroupPopulated(dir string) bool {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "cgroup.events"))
+	if err != nil {
+		return false
+	}
+	for _, l := range strings.Split(string(b), "\n") {
+		if l == "populated 1" {
+			return true
+		}
+	}
+	return false
+}
+
+// removeCgroupWhenEmpty removes the cgroup once the processes in it exited
+func removeCgroupWhenEmpty(dir string) {
+	for cgroupPopulated(dir) {
+		time.Sleep(time.Second)
+	}
+	removeCgroup(dir)
+}
+
+// processGroupPids returns the IDs of the processes in the process group
+func processGroupPids(pgid int) ([]string, error) {
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	ret := []string{}
+	for _, e := range entries {
+		if _, err := strconv.Atoi(e.Name()); err != nil {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join("/proc", e.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+		// The process name is between parentheses and can contain spaces,
+		// the process group is the third field after it
+		s := string(b)
+		fields := strings.Fields(s[strings.LastIndex(s, ")")+1:])
+		if len(fields) > 2 && fields[2] == strconv.Itoa(pgid) {
+			ret = append(ret, e.Name())
+		}
+	}
+	return ret, nil
+}
+
+// commandCgroup returns the cgroup that holds all processes of the command
+// with the given ID and nothing else, such that it can be frozen. Containers
+// have a cgroup of their own, as do commands with resource limits. Other
+// commands share the cgroup of the agent, and their process group is moved to
+// a cgroup created for them, in which case created is true
+func (a *Agent) commandCgroup(
+	commandID []byte,
+) (dir string, created bool, err error) {
+	dir, found, err := containerCgroup(commandID)
+	if found {
+		return dir, false, err
+	}
+	var proc *os.Process
+	cmd, ok := a.getPendingExecutingCommand(commandID)
+	if ok && cmd != nil {
+		proc = cmd.Process
+	} else if !ok {
+		// Commands keep running when the agent restarts, and the profile is
+		// sent again when the coordinator picks them up again
+		proc, _ = orphanedCommandProcess(commandID)
+	}
+	if proc == nil {
+		return "", false, fmt.Errorf("command %x is not running", commandID)
+	}
+
+	pid := strconv.Itoa(proc.Pid)
+	dir, err = processCgroup(pid)
+	if err != nil {
+		return "", false, err
+	}
+	parent := filepath.Join(cgroupRoot, cgroupParent)
+	if strings.HasPrefix(dir, parent+string(filepath.Separator)) {
+		return dir, false, nil
+	}
+
+	err = os.MkdirAll(parent, 0755)
+	if err != nil {
+		return "", false, err
+	}
+	dir = filepath.Join(parent, fmt.Sprintf("profile-%x", commandID))
+	err = os.Mkdir(dir, 0755)
+	if err != nil {
+		return "", false, err
+	}
+	// Commands lead their own process group, which holds the processes they
+	// started as well. Processes they start later inherit the cgroup
+	pids := []string{pid}
+	if pgid, err := syscall.Getpgid(proc.Pid); err == nil && pgid == proc.Pid {
+		pids, err = processGroupPids(pgid)
+		if err != nil {
+			removeCgroup(dir)
+			return "", false, err
+		}
+	}
+	for _, p := range pids {
+		err = ioutil.WriteFile(
+			filepath.Join(dir, "cgroup.procs"),
+			[]byte(p),
+			0644,
+		)
+		// Processes can exit while they're being moved
+		if err != nil && !errors.Is(err, syscall.ESRCH) {
+			go removeCgroupWhenEmpty(dir)
+			return "", false, fmt.Errorf(
+				"unable to move process %s to cgroup: %v",
+				p,
+				err,
+			)
+		}
+	}
+	return dir, true, nil
+}
+
+// handleLoadProfile handles the LoadProfileRequestMsg. This message is used
+// to throttle a running load generator to a load profile. A profile sent for
+// a command that is already throttled replaces its current profile
+func (a *Agent) handleLoadProfile(
+	msg *wire.LoadProfileRequestMsg,
+) (wire.Msg, error) {
+	if len(msg.OffsetsMs) == 0 || len(msg.OffsetsMs) != len(msg.Fractions) {
+		return nil, errors.New("load profile has no or mismatching points")
+	}
+	id := fmt.Sprintf("%x", msg.CommandID)
+	a.loadProfilesLock.Lock()
+	defer a.loadProfilesLock.Unlock()
+	old, replaced := a.loadProfiles[id]
+
+	p := &loadProfile{
+		offsets:   make([]time.Duration, len(msg.OffsetsMs)),
+		fractions: msg.Fractions,
+		stop:      make(chan bool),
+	}
+	for i, o := range msg.OffsetsMs {
+		p.offsets[i] = time.Duration(o) * time.Millisecond
+	}
+	if replaced {
+		close(old.stop)
+		old.lock.Lock()
+		p.cgroup = old.cgroup
+		p.suspended = old.suspended
+		old.lock.Unlock()
+	} else {
+		var err error
+		p.cgroup, p.created, err = a.commandCgroup(msg.CommandID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	a.loadProfiles[id] = p
+
+	go a.throttleCommand(
+		msg.CommandID,
+		p,
+		time.Duration(msg.ElapsedMs)*time.Millisecond,
+	)
+	return &wire.AckMsg{}, nil
+}
+
+// throttleCommand runs the duty cycle of a load profile until the command
+// exits or the profile is stopped. The time the command is suspended by the
+// coordinator does not count towards the progress through the profile
+func (a *Agent) throttleCommand(
+	commandID []byte,
+	p *loadProfile,
+	elapsed time.Duration,
+) {
+	defer func() {
+		p.freeze(false)
+		id := fmt.Sprintf("%x", commandID)
+		a.loadProfilesLock.Lock()
+		current, ok := a.loadProfiles[id]
+		if current == p {
+			delete(a.loadProfiles, id)
+		}
+		a.loadProfilesLock.Unlock()
+		// A profile replacing this one keeps using the cgroup
+		if p.created && (!ok || current == p) {
+			removeCgroupWhenEmpty(p.cgroup)
+		}
+	}()
+	for {
+		select {
+		case <-p.stop:
+			return
+		default:
+		}
+		if !cgroupPopulated(p.cgroup) {
+			return
+		}
+		p.lock.Lock()
+		suspended := p.suspended
+		p.lock.Unlock()
+		if suspended {
+			time.Sleep(loadProfilePeriod)
+			continue
+		}
+
+		run := time.Duration(p.fraction(elapsed) * float64(loadProfilePeriod))
+		if run > 0 {
+			p.freeze(false)
+			time.Sleep(run)
+		}
+		if run < loadProfilePeriod {
+			p.freeze(true)
+			time.Sleep(loadProfilePeriod - run)
+		}
+		elapsed += loadProfilePeriod
+	}
+}
+
+// stopLoadProfile stops throttling the command and thaws it if the throttle
+// left it frozen, such that it can handle the signal to stop it
+func (a *Agent) stopLoadProfile(commandID []byte) {
+	id := fmt.Sprintf("%x", commandID)
+	a.loadProfilesLock.Lock()
+	p, ok := a.loadProfiles[id]
+	if ok {
+		close(p.stop)
+		delete(a.loadProfiles, id)
+	}
+	a.loadProfilesLock.Unlock()
+	if ok {
+		p.freeze(false)
+	}
+}
+
+// suspendLoadProfile records that the coordinator suspended or resumed a
+// throttled command, and freezes or thaws its cgroup accordingly. Returns
+// false if the command is not throttled
+func (a *Agent) suspendLoadProfile(
+	commandID []byte,
+	resume bool,
+) (bool, error) {
+	a.loadProfilesLock.Lock()
+	p, ok := a.loadProfiles[fmt.Sprintf("%x", commandID)]
+	a.loadProfilesLock.Unlock()
+	if !ok {
+		return false, nil
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.suspended = !resume
+	err := freezeCgroup(p.cgroup, !resume)
+	if err != nil {
+		return true, fmt.Errorf("error freezing cgroup: %v", err)
+	}
+	return true, nil
+}
@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// logRotateInterval is the interval at which the size of the standard output
+// and error of commands with log rotation is checked
+const logRotateInterval = 30 * time.Second
+
+// rotateCommandLogs is run in a goroutine while a command is running to rotate
+// its standard output and error files once they grow beyond maxBytes, such
+// that long-running commands don't fill the disk of the agent. Stops when the
+// done channel receives
+func rotateCommandLogs(
+	paths []string,
+	maxBytes int64,
+	keep int,
+	done chan bool,
+) {
+	if keep < 1 {
+		keep = 1
+	}
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(logRotateInterval):
+		}
+		for _, p := range paths {
+			fi, err := os.Stat(p)
+			if err != nil || fi.Size() <= maxBytes {
+				continue
+			}
+			err = rotateLog(p, keep)
+			if err != nil {
+				logging.Warnf("Unable to rotate %s: %v", p, err)
+			}
+		}
+	}
+}
+
+// rotateLog copies the log to <path>.1, shifting the previously rotated files
+// up to <path>.<keep>, and truncates it. The command keeps the log open in
+// append mode, so it continues writing at the start of the truncated file.
+// Lines written between the copy and the truncation are lost
+func rotateLog(path string, keep int) error {
+	for i := keep - 1; i >= 1; i-- {
+		err := os.Rename(
+			fmt.Sprintf("%s.%d", path, i),
+			fmt.Sprintf("%s.%d", path, i+1),
+		)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(fmt.Sprintf("%s.1", path))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if err != nil {
+		dst.Close()
+		return err
+	}
+	err = dst.Close()
+	if err != nil {
+		return err
+	}
+	return os.Truncate(path, 0)
+}
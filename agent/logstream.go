@@ -0,0 +1,302 @@
+package agent
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/logging"
+	"github.com/mit-dci/opencbdc-tctl/wire"
+)
+
+// logStreamInterval is how often the agent reads the new output of the
+// commands while streaming
+const logStreamInterval = 250 * time.Millisecond
+
+// logStreamLease is how long streaming continues after the last request of
+// the coordinator to stream
+const logStreamLease = 30 * time.Second
+
+// logStreamWindow is the number of LogLinesMsgs the agent sends before it
+// waits for the coordinator to acknowledge them
+const logStreamWindow = 4
+
+// logStreamAckTimeout is the time after which unacknowledged LogLinesMsgs are
+// considered lost, for instance because the connection was lost, such that the
+// next request to stream doesn't wait for them
+const logStreamAckTimeout = 10 * time.Second
+
+// logStreamDefaultLinesPerSecond is the rate output is streamed at when the
+// coordinator doesn't specify one
+const logStreamDefaultLinesPerSecond = 200
+
+// logStreamMaxLineLength is the length lines are cut off at
+const logStreamMaxLineLength = 4096
+
+// logStreamMaxBacklog is the amount of output the stream may fall behind on a
+// file before it skips ahead
+const logStreamMaxBacklog = 1 << 20
+
+// logStreamInitialTail is the amount of output that was written before
+// streaming started, that is streamed first
+const logStreamInitialTail = 16 << 10
+
+// logStreamMaxRead is the maximum amount of output read from a file at once
+const logStreamMaxRead = 256 << 10
+
+// logStream is the state of streaming the output of the running commands to
+// the coordinator. The output is tailed from the files the commands write it
+// to, so they are never slowed down by the stream: when the coordinator can't
+// keep up, the agent stops reading and the files buffer the output
+type logStream struct {
+	lock sync.Mutex
+	// Set while the loop streaming the output runs
+	running        bool
+	expires        time.Time
+	linesPerSecond int
+	// The number of LogLinesMsgs that can be sent before the coordinator
+	// acknowledges one, and when the last one was sent
+	credits  int
+	lastSent time.Time
+	// The positions in the output files up to which their output was
+	// streamed, only used by the streaming loop
+	tails map[string]*logTail
+}
+
+// logTail is the position up to which an output file was streamed
+type logTail struct {
+	offset int64
+	// Whether offset is at the start of a line
+	aligned bool
+}
+
+// handleLogStream handles the LogStreamRequestMsg, which starts, extends or
+// stops streaming the output of the commands
+func (a *Agent) handleLogStream(
+	msg *wire.LogStreamRequestMsg,
+) (wire.Msg, error) {
+	ls := a.logStream
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+	if !msg.Enable {
+		ls.expires = time.Time{}
+		return &wire.AckMsg{}, nil
+	}
+	ls.expires = time.Now().Add(logStreamLease)
+	ls.linesPerSecond = msg.MaxLinesPerSecond
+	if ls.linesPerSecond <= 0 {
+		ls.linesPerSecond = logStreamDefaultLinesPerSecond
+	}
+	if !ls.running {
+		ls.running = true
+		ls.credits = logStreamWindow
+		ls.tails = map[string]*logTail{}
+		logging.Infof("Streaming command output to the coordinator")
+		go a.logStreamLoop()
+	} else if ls.credits < logStreamWindow &&
+		time.Since(ls.lastSent) > logStreamAckTimeout {
+		ls.credits = logStreamWindow
+	}
+	return &wire.AckMsg{}, nil
+}
+
+// handleLogLinesAck handles the LogLinesAckMsg, which allows the agent to send
+// another LogLinesMsg
+func (a *Agent) handleLogLinesAck() (wire.Msg, error) {
+	ls := a.logStream
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+	if ls.credits < logStreamWindow {
+		ls.credits++
+	}
+	return nil, nil
+}
+
+// logStreamLoop sends the new output of the running commands to the
+// coordinator until the lease of the stream expires
+func (a *Agent) logStreamLoop() {
+	ls := a.logStream
+	for {
+		time.Sleep(logStreamInterval)
+		ls.lock.Lock()
+		if time.Now().After(ls.expires) {
+			ls.running = false
+			ls.tails = nil
+			ls.lock.Unlock()
+			logging.Infof("Stopped streaming command output")
+			return
+		}
+		if ls.credits <= 0 {
+			ls.lock.Unlock()
+			continue
+		}
+		budget := ls.linesPerSecond * int(logStreamInterval) / int(time.Second)
+		if budget < 1 {
+			budget = 1
+		}
+		ls.lock.Unlock()
+
+		msg := a.readLogLines(ls.tails, budget)
+		if len(msg.Lines) == 0 && msg.SkippedBytes == 0 {
+			continue
+		}
+		ls.lock.Lock()
+		ls.credits--
+		ls.lastSent = time.Now()
+		ls.lock.Unlock()
+		a.outgoing <- msg
+	}
+}
+
+// readLogLines reads up to budget new lines from the output files of the
+// running commands, sharing the budget between the files
+func (a *Agent) readLogLines(
+	tails map[string]*logTail,
+	budget int,
+) *wire.LogLinesMsg {
+	type outputFile struct {
+		commandID []byte
+		path      string
+		stderr    bool
+	}
+	files := []outputFile{}
+	a.pendingCommandsLock.Lock()
+	for _, c := range a.pendingCommands {
+		files = append(
+			files,
+			outputFile{c.id, c.stdoutFile, false},
+			outputFile{c.id, c.stderrFile, true},
+		)
+	}
+	a.pendingCommandsLock.Unlock()
+
+	ret := &wire.LogLinesMsg{Lines: []wire.LogLine{}}
+	current := map[string]bool{}
+	share := budget
+	if len(files) > 0 {
+		share = budget / len(files)
+		if share < 1 {
+			share = 1
+		}
+	}
+	for _, f := range files {
+		current[f.path] = true
+		t, ok := tails[f.path]
+		if !ok {
+			t = &logTail{aligned: true}
+			tails[f.path] = t
+			fi, err := os.Stat(f.path)
+			if err == nil && fi.Size() > logStreamInitialTail {
+				t.offset = fi.Size() - logStreamInitialTail
+				t.aligned = false
+			}
+		}
+		lines, skipped, err := readLogTail(f.path, t, share)
+		if err != nil {
+			logging.Warnf("Unable to read output %s: %v", f.path, err)
+			continue
+		}
+		ret.SkippedBytes += skipped
+		for _, l := range lines {
+			ret.Lines = append(ret.Lines, wire.LogLine{
+				CommandID: f.commandID,
+				Stderr:    f.stderr,
+				Line:      l,
+			})
+		}
+	}
+	// Forget the files of the commands that exited
+	for path := range tails {
+		if !current[path] {
+			delete(tails, path)
+		}
+	}
+	return ret
+}
+
+// readLogTail reads up to max complete lines from the file after the
+// position in t, and moves it past them. If the file is more than
+// logStreamMaxBacklog ahead of the position, the output in between is skipped
+// and its size returned
+func readLogTail(path string, t *logTail, max int) ([]string, int64, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	size := fi.Size()
+	if size < t.offset {
+		// The log was rotated, which truncates it
+		t.offset = 0
+		t.aligned = true
+	}
+	skipped := int64(0)
+	if size-t.offset > logStreamMaxBacklog {
+		skipped = size - logStreamMaxBacklog - t.offset
+		t.offset = size - logStreamMaxBacklog
+		t.aligned = false
+	}
+	length := size - t.offset
+	if length > logStreamMaxRead {
+		length = logStreamMaxRead
+	}
+	if length <= 0 {
+		return nil, skipped, nil
+	}
+	buf := make([]byte, length)
+	n, err := f.ReadAt(buf, t.offset)
+	if err != nil && err != io.EOF {
+		return nil, skipped, err
+	}
+	buf = buf[:n]
+
+	if !t.aligned {
+		// Continue at the start of the next line
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			if n == logStreamMaxRead {
+				t.offset += int64(n)
+			}
+			return nil, skipped, nil
+		}
+		t.offset += int64(i + 1)
+		t.aligned = true
+		buf = buf[i+1:]
+	}
+
+	lines := []string{}
+	for len(lines) < max {
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			break
+		}
+		line := buf[:i]
+		if len(line) > logStreamMaxLineLength {
+			line = line[:logStreamMaxLineLength]
+		}
+		lines = append(lines, string(line))
+		t.offset += int64(i + 1)
+		buf = buf[i+1:]
+	}
+	if len(lines) == 0 && n == logStreamMaxRead {
+		// A line longer than can be read at once, of which the start is sent
+		// and the rest skipped
+		start := buf
+		if len(start) > logStreamMaxLineLength {
+			start = start[:logStreamMaxLineLength]
+		}
+		lines = append(lines, string(start))
+		t.offset += int64(n)
+		t.aligned = false
+	}
+	return lines, skipped, nil
+}
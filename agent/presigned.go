@@ -0,0 +1,163 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// presignedDownloadAttempts is the number of times the agent tries to
+// download a file from a pre-signed URL. Each attempt continues where the
+// previous one stopped
+const presignedDownloadAttempts = 5
+
+// presignedRetryInterval is the time between the attempts to download a file
+// from a pre-signed URL
+const presignedRetryInterval = 5 * time.Second
+
+// presignedResponseTimeout is the time the agent waits for the response to a
+// request for a file from a pre-signed URL
+const presignedResponseTimeout = 30 * time.Second
+
+// presignedIdleTimeout is the time the agent waits for the next data of a
+// file it downloads from a pre-signed URL, after which the download is
+// considered stalled and resumed
+const presignedIdleTimeout = time.Minute
+
+// presignedClient is the client files are downloaded from pre-signed URLs
+// with. Unlike http.DefaultClient it gives up on a server that doesn't
+// respond, such that the download is retried. The download itself can take
+// long for large files, so it has no overall timeout
+var presignedClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: presignedResponseTimeout,
+	},
+}
+
+// downloadPresigned downloads the file at the pre-signed URL into f,
+// reporting its progress to t. If the download is interrupted, it is resumed
+// from the last byte written
+func downloadPresigned(url string, f *os.File, t *transferReporter) error {
+	var err error
+	offset := int64(0)
+	var w io.WriterAt
+	for attempt := 1; attempt <= presignedDownloadAttempts; attempt++ {
+		if attempt > 1 {
+			logging.Warnf(
+				"Download from pre-signed URL interrupted at %d bytes: %v",
+				offset,
+				err,
+			)
+			time.Sleep(presignedRetryInterval)
+		}
+		var n int64
+		n, err = downloadPresignedAttempt(url, f, t, offset, &w)
+		offset += n
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(presignedRefusedError); ok {
+			return fmt.Errorf("download from pre-signed URL refused: %v", err)
+		}
+	}
+	return err
+}
+
+// presignedRefusedError is returned when the server refused the download,
+// which trying again won't fix
+type presignedRefusedError struct {
+	status string
+}
+
+func (e presignedRefusedError) Error() string {
+	return fmt.Sprintf("unexpected status %s", e.status)
+}
+
+// downloadPresignedAttempt downloads the file at the pre-signed URL from the
+// offset onwards, and returns the number of bytes written to f. The download
+// is cancelled if no data was received for presignedIdleTimeout
+func downloadPresignedAttempt(
+	url string,
+	f *os.File,
+	t *transferReporter,
+	offset int64,
+	w *io.WriterAt,
+) (int64, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return 0, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	res, err := presignedClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	expected := http.StatusOK
+	if offset > 0 {
+		expected = http.StatusPartialContent
+	}
+	if res.StatusCode == http.StatusForbidden {
+		// The URL expired or its signature is invalid
+		return 0, presignedRefusedError{status: res.Status}
+	}
+	if res.StatusCode != expected {
+		return 0, fmt.Errorf("unexpected status %s", res.Status)
+	}
+	if *w == nil {
+		*w = t.startDownload(f, res.ContentLength)
+	}
+	idle := time.AfterFunc(presignedIdleTimeout, cancel)
+	defer idle.Stop()
+	n, err := io.Copy(
+		&offsetWriter{w: *w, offset: offset},
+		&idleTimeoutReader{r: res.Body, timer: idle},
+	)
+	if err != nil && ctx.Err() != nil {
+		err = fmt.Errorf("no data received for %v", presignedIdleTimeout)
+	}
+	return n, err
+}
+
+// idleTimeoutReader resets the timer every time data is read, such that it
+// only fires if the reads stall
+type idleTimeoutReader struct {
+	r     io.Reader
+	timer *time.Timer
+}
+
+func (i *idleTimeoutReader) Read(p []byte) (int, error) {
+	n, err := i.r.Read(p)
+	if n > 0 {
+		i.timer.Reset(presignedIdleTimeout)
+	}
+	return n, err
+}
+
+// offsetWriter writes to the underlying WriterAt from the offset onwards
+type offsetWriter struct {
+	w      io.WriterAt
+	offset int64
+}
+
+func (o *offsetWriter) Write(p []byte) (int, error) {
+	n, err := o.w.WriteAt(p, o.offset)
+	o.offset += int64(n)
+	return n, err
+}
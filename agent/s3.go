@@ -3,6 +3,7 @@ package agent
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 
@@ -16,19 +17,23 @@ import (
 )
 
 // handleDeployFileFromS3 handles a DeployFileFromS3RequestMsg. This instructs
-// the agent to download a file from S3 and write it to the agent's file system
+// the agent to download a file from S3 and write it to the agent's file system.
+// If the request has a TransferID, the progress is reported to the coordinator
 func (a *Agent) handleDeployFileFromS3(
 	msg *wire.DeployFileFromS3RequestMsg,
 ) (wire.Msg, error) {
-	cfg, err := config.LoadDefaultConfig(
-		context.TODO(),
-		config.WithRegion(msg.SourceRegion),
-		config.WithEndpointResolver(common.S3customResolver()),
-	)
-	if err != nil {
-		return nil, err
-	}
+	t := newTransferReporter(a, msg.TransferID)
+	ret, err := a.deployFileFromS3(msg, t)
+	t.finish(err)
+	return ret, err
+}
 
+// deployFileFromS3 downloads, verifies and unpacks the file requested in msg,
+// reporting its progress to t
+func (a *Agent) deployFileFromS3(
+	msg *wire.DeployFileFromS3RequestMsg,
+	t *transferReporter,
+) (wire.Msg, error) {
 	ret := &wire.DeployFileFromS3ResponseMsg{Success: true}
 	logging.Infof(
 		"Received request to deploy from S3 bucket %s - file %s at %s",
@@ -44,7 +49,7 @@ func (a *Agent) handleDeployFileFromS3(
 	)
 
 	// Ensure the directory where the file must go exists
-	err = os.MkdirAll(filepath.Dir(targetFile), 0755)
+	err := os.MkdirAll(filepath.Dir(targetFile), 0755)
 	if err != nil {
 		return nil, err
 	}
@@ -55,29 +60,16 @@ func (a *Agent) handleDeployFileFromS3(
 		return nil, err
 	}
 
-	// Create the S3 client
-	client := s3.NewFromConfig(
-		cfg,
-		func(opt *s3.Options) { opt.Region = msg.SourceRegion },
-	)
-
-	// Create a downloader
-	downloader := manager.NewDownloader(client)
-	downloader.PartSize = 5000000
-	downloader.Concurrency = 30
-	downloader.PartBodyMaxRetries = 500
-
-	// Download the object
-	_, err = downloader.Download(context.TODO(), f,
-		&s3.GetObjectInput{
-			Bucket: aws.String(msg.SourceBucket),
-			Key:    aws.String(msg.SourcePath),
-		})
+	if msg.PresignedURL != "" {
+		err = downloadPresigned(msg.PresignedURL, f, t)
+	} else {
+		err = downloadFromS3(msg, f, t)
+	}
+	t.stopDownload()
+	f.Close()
 	if err != nil {
-		f.Close()
 		return nil, err
 	}
-	f.Close()
 
 	stat, err := os.Stat(targetFile)
 	if err != nil {
@@ -86,9 +78,21 @@ func (a *Agent) handleDeployFileFromS3(
 
 	logging.Infof("File downloaded (%s): %d bytes", stat.Name(), stat.Size())
 
+	t.report(wire.TransferPhaseVerify)
+	err = verifyDownload(msg.SHA256, msg.Signature, msg.SeedData, targetFile)
+	if err != nil {
+		os.Remove(targetFile)
+		return nil, fmt.Errorf(
+			"error verifying file %s: %v",
+			msg.TargetPath,
+			err,
+		)
+	}
+
 	// Unpack the file if this has been requested
 	if msg.Unpack {
 		logging.Infof("Unpacking file from S3 (%s)", targetFile)
+		t.report(wire.TransferPhaseUnpack)
 		err = common.TarExtractFlat(targetFile, msg.FlatUnpack, msg.UnpackNoDir)
 		if err != nil {
 			return nil, fmt.Errorf(
@@ -105,6 +109,56 @@ func (a *Agent) handleDeployFileFromS3(
 	return ret, nil
 }
 
+// downloadFromS3 downloads the file requested in msg from S3 into f with the
+// agent's own credentials, reporting its progress to t
+func downloadFromS3(
+	msg *wire.DeployFileFromS3RequestMsg,
+	f *os.File,
+	t *transferReporter,
+) error {
+	cfg, err := config.LoadDefaultConfig(
+		context.TODO(),
+		config.WithRegion(msg.SourceRegion),
+		config.WithEndpointResolver(common.S3customResolver()),
+	)
+	if err != nil {
+		return err
+	}
+
+	// Create the S3 client
+	client := s3.NewFromConfig(
+		cfg,
+		func(opt *s3.Options) { opt.Region = msg.SourceRegion },
+	)
+
+	// Create a downloader
+	downloader := manager.NewDownloader(client)
+	downloader.PartSize = 5000000
+	downloader.Concurrency = 30
+	downloader.PartBodyMaxRetries = 500
+
+	// Determine the size of the object to report the download progress. The
+	// progress is reported without the size if this fails
+	total := int64(0)
+	if len(msg.TransferID) > 0 {
+		head, err := client.HeadObject(context.TODO(), &s3.HeadObjectInput{
+			Bucket: aws.String(msg.SourceBucket),
+			Key:    aws.String(msg.SourcePath),
+		})
+		if err == nil {
+			total = head.ContentLength
+		}
+	}
+
+	// Download the object
+	_, err = downloader.Download(context.TODO(), t.startDownload(f, total),
+		&s3.GetObjectInput{
+			Bucket: aws.String(msg.SourceBucket),
+			Key:    aws.String(msg.SourcePath),
+		})
+	return err
+}
+
 // handleUploadFileToS3 handles the UploadFileToS3RequestMsg. This is the
 // coordinator
 // instructing the agent to upload a file from its file system to an S3 bucket.
@@ -127,6 +181,29 @@ func (a *Agent) handleUploadFileToS3(
 		msg.TargetPath,
 		msg.SourcePath,
 	)
+	if msg.Archive {
+		archive, err := ioutil.TempFile("", "upload-*.tar.gz")
+		if err != nil {
+			return nil, err
+		}
+		archive.Close()
+		defer os.Remove(archive.Name())
+		err = common.CreateArchive(sourceFile, archive.Name())
+		if err != nil {
+			logging.Errorf("Error archiving %s: %v", sourceFile, err)
+			return nil, err
+		}
+		sourceFile = archive.Name()
+	}
+	if msg.Validate && !msg.Archive {
+		if schema := common.OutputSchemaFor(sourceFile); schema != nil {
+			err := common.ValidateOutputFile(sourceFile, schema)
+			if err != nil && !os.IsNotExist(err) {
+				logging.Warnf("Output file %s is invalid: %v", sourceFile, err)
+				ret.ValidationError = err.Error()
+			}
+		}
+	}
 	err := a.uploadFileToS3(
 		sourceFile,
 		msg.TargetRegion,
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
@@ -130,6 +131,58 @@ func GetDiskSpace() int64 {
 	return -1
 }
 
+// GetAccelerators detects the accelerators installed in the system: NVIDIA
+// GPUs through nvidia-smi, AWS Neuron devices from their device nodes and AWS
+// F1 FPGAs through the AWS FPGA management tools
+func GetAccelerators() []common.AgentAccelerator {
+	accs := []common.AgentAccelerator{}
+	if runtime.GOOS != "linux" {
+		return accs
+	}
+
+	out, err := exec.Command(
+		"nvidia-smi",
+		"--query-gpu=name,memory.total",
+		"--format=csv,noheader,nounits",
+	).Output()
+	if err == nil {
+		for _, l := range strings.Split(string(out), "\n") {
+			fields := strings.Split(l, ",")
+			if len(fields) < 2 {
+				continue
+			}
+			mem, _ := strconv.ParseInt(strings.TrimSpace(fields[1]), 10, 64)
+			accs = append(accs, common.AgentAccelerator{
+				Kind:   common.AcceleratorGPU,
+				Model:  strings.TrimSpace(fields[0]),
+				Memory: mem,
+			})
+		}
+	}
+
+	neurons, _ := filepath.Glob("/dev/neuron[0-9]*")
+	for range neurons {
+		accs = append(accs, common.AgentAccelerator{
+			Kind:  common.AcceleratorNeuron,
+			Model: "AWS Neuron",
+		})
+	}
+
+	// The AWS FPGA management tools list one AFIDEVICE line per FPGA slot
+	out, err = exec.Command("fpga-describe-local-image-slots").Output()
+	if err == nil {
+		for _, l := range strings.Split(string(out), "\n") {
+			if strings.HasPrefix(l, "AFIDEVICE") {
+				accs = append(accs, common.AgentAccelerator{
+					Kind:  common.AcceleratorFPGA,
+					Model: "AWS F1 FPGA",
+				})
+			}
+		}
+	}
+	return accs
+}
+
 // GetSystemInfo composes a copy of the common.AgentSystemInfo struct base on
 // the current system information
 func GetSystemInfo() common.AgentSystemInfo {
@@ -144,6 +197,7 @@ func GetSystemInfo() common.AgentSystemInfo {
 	freeDisk := GetDiskSpace()
 
 	ec2InstanceID := os.Getenv("EC2_INSTANCE_ID")
+	region, az := GetZone()
 
 	return common.AgentSystemInfo{
 		PublicIP:           publicIP,
@@ -157,6 +211,10 @@ func GetSystemInfo() common.AgentSystemInfo {
 		OperatingSystem:    runtime.GOOS,
 		AWS:                len(ec2InstanceID) > 0,
 		EC2InstanceID:      ec2InstanceID,
+		Accelerators:       GetAccelerators(),
+		NVMe:               HasLocalNVMe(),
+		Region:             region,
+		AvailabilityZone:   az,
 	}
 
 }
@@ -0,0 +1,104 @@
+package agent
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/wire"
+)
+
+// transferProgressInterval is the interval at which the agent reports the
+// progress of a download to the coordinator
+const transferProgressInterval = 2 * time.Second
+
+// transferReporter reports the progress of deploying a file to the
+// coordinator in TransferProgressMsgs. If the request didn't specify a
+// TransferID, nothing is reported
+type transferReporter struct {
+	a        *Agent
+	id       []byte
+	bytes    int64
+	total    int64
+	stop     chan bool
+	stopOnce sync.Once
+}
+
+// newTransferReporter creates a transferReporter for the transfer with the
+// given ID
+func newTransferReporter(a *Agent, id []byte) *transferReporter {
+	return &transferReporter{a: a, id: id, stop: make(chan bool)}
+}
+
+// report sends the current progress of the transfer in the given phase to the
+// coordinator
+func (t *transferReporter) report(phase wire.TransferPhase) {
+	if len(t.id) == 0 {
+		return
+	}
+	done := atomic.LoadInt64(&t.bytes)
+	if t.total > 0 && done > t.total {
+		// Retried parts are counted twice
+		done = t.total
+	}
+	t.a.outgoing <- &wire.TransferProgressMsg{
+		TransferID: t.id,
+		Phase:      phase,
+		Bytes:      done,
+		TotalBytes: t.total,
+	}
+}
+
+// startDownload reports the progress of the download of a file with the given
+// size periodically, until stopDownload is called. The returned WriterAt
+// counts the bytes written to w
+func (t *transferReporter) startDownload(
+	w io.WriterAt,
+	total int64,
+) io.WriterAt {
+	t.total = total
+	if len(t.id) == 0 {
+		return w
+	}
+	t.report(wire.TransferPhaseDownload)
+	go func() {
+		for {
+			select {
+			case <-t.stop:
+				return
+			case <-time.After(transferProgressInterval):
+				t.report(wire.TransferPhaseDownload)
+			}
+		}
+	}()
+	return &countingWriterAt{w: w, n: &t.bytes}
+}
+
+// stopDownload stops the periodic progress reports of the download
+func (t *transferReporter) stopDownload() {
+	t.stopOnce.Do(func() { close(t.stop) })
+}
+
+// finish reports the outcome of the transfer to the coordinator
+func (t *transferReporter) finish(err error) {
+	t.stopDownload()
+	if err != nil {
+		t.report(wire.TransferPhaseFailed)
+		return
+	}
+	t.report(wire.TransferPhaseDone)
+}
+
+// countingWriterAt counts the bytes written to the underlying WriterAt, which
+// can be written to concurrently
+type countingWriterAt struct {
+	w io.WriterAt
+	n *int64
+}
+
+func (c *countingWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	n, err := c.w.WriteAt(p, off)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
@@ -0,0 +1,195 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+	"github.com/mit-dci/opencbdc-tctl/wire"
+)
+
+// updateAckDelay is the time given to the acknowledgement of an update to
+// reach the coordinator before the agent closes the connection to restart
+const updateAckDelay = 2 * time.Second
+
+// handleAgentUpdate handles the AgentUpdateRequestMsg. The agent downloads
+// the new binary next to its own, verifies it against the checksum and the
+// offline signature of the agent update key and moves it over its own binary. It then
+// acknowledges the update and closes the connection, after which the main
+// binary restarts on the new version. Updates are refused while commands are
+// running, and no new commands are accepted while the update is in progress
+func (a *Agent) handleAgentUpdate(
+	msg *wire.AgentUpdateRequestMsg,
+) (wire.Msg, error) {
+	if msg.Version == a.version {
+		return nil, fmt.Errorf("already running version %s", msg.Version)
+	}
+	if msg.Architecture != runtime.GOARCH {
+		return nil, fmt.Errorf(
+			"binary is built for %s, not %s",
+			msg.Architecture,
+			runtime.GOARCH,
+		)
+	}
+	key, err := common.AgentUpdatePublicKey()
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, errors.New(
+			"AGENT_UPDATE_PUBLIC_KEY is not configured, refusing to " +
+				"update to an unsigned binary",
+		)
+	}
+
+	a.pendingCommandsLock.Lock()
+	if a.updating {
+		a.pendingCommandsLock.Unlock()
+		return nil, errors.New("an update is already in progress")
+	}
+	if len(a.pendingCommands) > 0 {
+		n := len(a.pendingCommands)
+		a.pendingCommandsLock.Unlock()
+		return nil, fmt.Errorf("%d commands are still running", n)
+	}
+	a.updating = true
+	a.pendingCommandsLock.Unlock()
+
+	exe, err := a.replaceBinary(msg)
+	if err != nil {
+		a.pendingCommandsLock.Lock()
+		a.updating = false
+		a.pendingCommandsLock.Unlock()
+		return nil, err
+	}
+
+	logging.Infof("Updated to version %s, restarting", msg.Version)
+	a.pendingCommandsLock.Lock()
+	a.updatedBinary = exe
+	a.pendingCommandsLock.Unlock()
+	go func() {
+		time.Sleep(updateAckDelay)
+		conn, _ := a.connection()
+		conn.Close()
+	}()
+	return &wire.AckMsg{}, nil
+}
+
+// replaceBinary downloads the binary requested in msg, verifies it and moves
+// it over the binary of the running agent. Returns the path of the binary
+func (a *Agent) replaceBinary(
+	msg *wire.AgentUpdateRequestMsg,
+) (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	exe, err = filepath.EvalSymlinks(exe)
+	if err != nil {
+		return "", err
+	}
+
+	// Download into the directory of the binary, such that it can be renamed
+	// over it atomically
+	f, err := ioutil.TempFile(filepath.Dir(exe), ".agent-update-*")
+	if err != nil {
+		return "", err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+
+	cfg, err := config.LoadDefaultConfig(
+		context.TODO(),
+		config.WithRegion(msg.SourceRegion),
+		config.WithEndpointResolver(common.S3customResolver()),
+	)
+	if err != nil {
+		f.Close()
+		return "", err
+	}
+	client := s3.NewFromConfig(
+		cfg,
+		func(opt *s3.Options) { opt.Region = msg.SourceRegion },
+	)
+	logging.Infof(
+		"Downloading agent version %s from S3 bucket %s - file %s",
+		msg.Version,
+		msg.SourceBucket,
+		msg.SourcePath,
+	)
+	_, err = manager.NewDownloader(client).Download(
+		context.TODO(),
+		f,
+		&s3.GetObjectInput{
+			Bucket: aws.String(msg.SourceBucket),
+			Key:    aws.String(msg.SourcePath),
+		},
+	)
+	f.Close()
+	if err != nil {
+		return "", err
+	}
+
+	key, err := common.AgentUpdatePublicKey()
+	if err != nil {
+		return "", err
+	}
+	err = common.VerifyFileSHA256(tmp, msg.SHA256)
+	if err != nil {
+		return "", fmt.Errorf("error verifying agent binary: %v", err)
+	}
+	err = common.VerifyAgentUpdateSignature(
+		key,
+		msg.Version,
+		msg.Architecture,
+		msg.SHA256,
+		msg.Signature,
+	)
+	if err != nil {
+		return "", fmt.Errorf("error verifying agent binary: %v", err)
+	}
+	logging.Infof("Verified agent binary version %s", msg.Version)
+
+	err = os.Chmod(tmp, 0755)
+	if err != nil {
+		return "", err
+	}
+	return exe, os.Rename(tmp, exe)
+}
+
+// isUpdating returns true if the agent accepted an update, in which case it
+// does not start new commands
+func (a *Agent) isUpdating() bool {
+	a.pendingCommandsLock.Lock()
+	defer a.pendingCommandsLock.Unlock()
+	return a.updating
+}
+
+// UpdatedBinary returns the path of the binary the agent replaced with a new
+// version, or an empty string if it was not updated. The agent is restarted
+// on it once the agent loop completes
+func (a *Agent) UpdatedBinary() string {
+	a.pendingCommandsLock.Lock()
+	defer a.pendingCommandsLock.Unlock()
+	return a.updatedBinary
+}
+
+// Restart replaces the running process with a fresh start of the binary at
+// path, keeping the arguments and the environment. The path is passed
+// explicitly since the running binary was replaced. It only returns if that
+// fails
+func Restart(path string) error {
+	return syscall.Exec(path, os.Args, os.Environ())
+}
@@ -11,6 +11,7 @@ import (
 
 	"github.com/mit-dci/opencbdc-tctl/agent"
 	"github.com/mit-dci/opencbdc-tctl/agent/scripts"
+	"github.com/mit-dci/opencbdc-tctl/common"
 	"github.com/mit-dci/opencbdc-tctl/logging"
 )
 
@@ -47,8 +48,22 @@ func main() {
 	// or the environment
 	host := ""
 	port := 0
+	enrollmentMethod := ""
+	token := ""
 	flag.StringVar(&host, "host", "", "Coordinator host to connect to")
 	flag.IntVar(&port, "port", 0, "Coordinator port to connect to")
+	flag.StringVar(
+		&enrollmentMethod,
+		"enrollment",
+		"",
+		"Method to enroll with the coordinator (bootstrap-token, join-token or aws-instance-identity)",
+	)
+	flag.StringVar(
+		&token,
+		"token",
+		"",
+		"Bootstrap token, or join token of the agent pool, to enroll with the coordinator",
+	)
 	flag.Parse()
 	if host == "" {
 		host = os.Getenv("COORDINATOR_HOST")
@@ -57,6 +72,45 @@ func main() {
 	if port == 0 {
 		port = 8000
 	}
+	if enrollmentMethod == "" {
+		enrollmentMethod = os.Getenv("AGENT_ENROLLMENT_METHOD")
+	}
+	if token == "" {
+		token = os.Getenv("AGENT_BOOTSTRAP_TOKEN")
+	}
+	// Static agents on lab hardware join their pool with its join token
+	if token == "" && enrollmentMethod == common.EnrollmentMethodJoinToken {
+		token = os.Getenv("AGENT_JOIN_TOKEN")
+	}
+	// Point the commands we execute at the coordinator's dependency cache, such
+	// that package downloads on the fleet are served from the cache
+	if cachePort := os.Getenv("DEPENDENCY_CACHE_PORT"); cachePort != "" &&
+		os.Getenv("http_proxy") == "" {
+		proxy := fmt.Sprintf("http://%s:%s", host, cachePort)
+		os.Setenv("http_proxy", proxy)
+		os.Setenv("HTTP_PROXY", proxy)
+		os.Setenv("DEPENDENCY_CACHE_URL", proxy+"/fetch?url=")
+	}
+	// If the coordinator handed us a credential during an earlier connection,
+	// use that - bootstrap tokens are single use, and the credential handed to
+	// us supersedes the one we originally enrolled with. Static agents stay in
+	// the pool they joined, the coordinator remembers it for our identity
+	if enrollmentMethod != "" && agent.HasStoredCredential() {
+		enrollmentMethod = common.EnrollmentMethodAgentCredential
+	}
+
+	// Obtain the credential we present to the coordinator to enroll
+	enrollmentCredential, err := agent.GetEnrollmentCredential(
+		enrollmentMethod,
+		token,
+	)
+	if err != nil {
+		logging.Errorf(
+			"Failed to obtain enrollment credential: [%s], exiting...\n",
+			err.Error(),
+		)
+		os.Exit(131)
+	}
 	if os.Getenv("S3_INTERFACE_ENDPOINT") == "" {
 		logging.Infof(
 			"S3_INTERFACE_ENDPOINT not set, S3 will default to public endpoints",
@@ -76,7 +130,13 @@ func main() {
 
 	// Connect the agent to the coordinator
 	logging.Infof("Connecting to server %s on port %d...\n", host, port)
-	a, err := agent.NewAgent(version, host, port)
+	a, err := agent.NewAgent(
+		version,
+		host,
+		port,
+		enrollmentMethod,
+		enrollmentCredential,
+	)
 	if err != nil {
 		logging.Errorf("Failed to connect: [%s], exiting...\n", err.Error())
 		os.Exit(129)
@@ -102,5 +162,14 @@ func main() {
 	// Execute the main agent loop
 	a.RunClient()
 
+	// If the coordinator pushed a new version, restart on it right away
+	// rather than relying on the scripting that runs the agent to do so
+	if path := a.UpdatedBinary(); path != "" {
+		logging.Infof("Agent loop complete, restarting on new version")
+		err = agent.Restart(path)
+		logging.Errorf("Failed to restart: [%s], exiting...\n", err.Error())
+		os.Exit(132)
+	}
+
 	logging.Infof("Agent loop complete, shutting down")
 }
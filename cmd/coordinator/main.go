@@ -11,6 +11,7 @@ import (
 	"github.com/mit-dci/opencbdc-tctl/coordinator/agents"
 	"github.com/mit-dci/opencbdc-tctl/coordinator/awsmgr"
 	"github.com/mit-dci/opencbdc-tctl/coordinator/http"
+	"github.com/mit-dci/opencbdc-tctl/coordinator/preflight"
 	"github.com/mit-dci/opencbdc-tctl/coordinator/scripts"
 	"github.com/mit-dci/opencbdc-tctl/coordinator/sources"
 	"github.com/mit-dci/opencbdc-tctl/coordinator/testruns"
@@ -50,9 +51,39 @@ func main() {
 		panic(err)
 	}
 
+	logging.Infof("Creating AWS manager")
+
+	awsm := awsmgr.NewAwsManager()
+
+	logging.Infof("Running preflight checks")
+
+	report := preflight.Run(awsm)
+	if report.Failed() {
+		if !preflight.WarnOnly() {
+			logging.Fatalf(
+				"%sFix the failed checks, or set PREFLIGHT_WARN_ONLY=1 "+
+					"to start anyway",
+				report.String(),
+			)
+		}
+		logging.Warnf("%s", report.String())
+	} else {
+		logging.Infof("%s", report.String())
+	}
+
 	logging.Infof("Creating sources manager")
 
-	s := sources.NewSourcesManager()
+	s, err := sources.NewSourcesManager()
+	if err != nil {
+		panic(err)
+	}
+
+	go func() {
+		err := s.DependencyCache().Run()
+		if err != nil {
+			logging.Errorf("Dependency cache stopped: %v", err)
+		}
+	}()
 
 	logging.Infof("Creating agents manager")
 
@@ -61,9 +92,19 @@ func main() {
 		panic(err)
 	}
 
-	logging.Infof("Creating AWS manager")
-
-	awsm := awsmgr.NewAwsManager()
+	// Allow agents we launched on EC2 to enroll using their instance
+	// identity, if we can verify it
+	iia, err := awsm.NewInstanceIdentityAuthenticator()
+	if err == awsmgr.ErrNoInstanceIdentityCert {
+		logging.Warnf(
+			"Instance identity enrollment is disabled: %v",
+			err,
+		)
+	} else if err != nil {
+		panic(err)
+	} else {
+		c.RegisterEnrollmentAuthenticator(iia)
+	}
 
 	logging.Infof("Creating TestRun manager")
 	tr, err := testruns.NewTestRunManager(c, am, s, ev, awsm, GitCommit)
@@ -0,0 +1,131 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// BuildConfig holds the CMake cache variables and environment overrides a
+// test run's binaries are compiled with. Binaries compiled with a different
+// configuration are archived separately, keyed by Key
+type BuildConfig struct {
+	// CMake cache variables, set in the build directory before the build
+	// script configures it
+	CMakeFlags map[string]string `json:"cmakeFlags,omitempty"`
+	// Environment variables set for the build script
+	Env map[string]string `json:"env,omitempty"`
+}
+
+var validBuildVariableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// reservedBuildEnv are the environment variables that cannot be overridden.
+// The coordinator sets most of them for the build script, CMAKE_FLAGS is set
+// by the build script itself, so overriding it would have no effect
+var reservedBuildEnv = map[string]bool{
+	"TARGET_ARCH":          true,
+	"CMAKE_TOOLCHAIN_FILE": true,
+	"CMAKE_FLAGS":          true,
+	"CCACHE_DIR":           true,
+	"http_proxy":           true,
+	"HTTP_PROXY":           true,
+}
+
+// Empty returns true if the configuration doesn't change the default build
+func (c *BuildConfig) Empty() bool {
+	return c == nil || (len(c.CMakeFlags) == 0 && len(c.Env) == 0)
+}
+
+// sortedEntries returns the name=value pairs of m, sorted by name
+func sortedEntries(m map[string]string) []string {
+	ret := make([]string, 0, len(m))
+	for k, v := range m {
+		ret = append(ret, k+"="+v)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Key identifies the configuration in the names of binaries archives. It is
+// empty for the default build, such that its archives keep their names
+func (c *BuildConfig) Key() string {
+	if c.Empty() {
+		return ""
+	}
+	h := sha256.New()
+	for _, e := range sortedEntries(c.CMakeFlags) {
+		fmt.Fprintf(h, "D%s\n", e)
+	}
+	for _, e := range sortedEntries(c.Env) {
+		fmt.Fprintf(h, "E%s\n", e)
+	}
+	return "cfg" + hex.EncodeToString(h.Sum(nil))[:12]
+}
+
+// Validate checks that the names of the variables are valid, that the values
+// fit on a single line and that no reserved environment variable is
+// overridden
+func (c *BuildConfig) Validate() []error {
+	ret := []error{}
+	if c == nil {
+		return ret
+	}
+	check := func(kind, name, value string) {
+		if !validBuildVariableName.MatchString(name) {
+			ret = append(ret, fmt.Errorf("Invalid %s name %q", kind, name))
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			ret = append(ret, fmt.Errorf(
+				"Value of %s %s cannot span multiple lines",
+				kind,
+				name,
+			))
+		}
+	}
+	for name, value := range c.CMakeFlags {
+		check("CMake cache variable", name, value)
+		if strings.ContainsAny(value, " \t\"'") {
+			ret = append(ret, fmt.Errorf(
+				"Value of CMake cache variable %s cannot contain whitespace "+
+					"or quotes",
+				name,
+			))
+		}
+	}
+	for name, value := range c.Env {
+		check("environment variable", name, value)
+		if reservedBuildEnv[name] {
+			ret = append(ret, fmt.Errorf(
+				"Environment variable %s is set by the coordinator and "+
+					"cannot be overridden",
+				name,
+			))
+		}
+	}
+	return ret
+}
+
+// Environ returns the environment variables the configuration sets for the
+// build script
+func (c *BuildConfig) Environ() []string {
+	if c.Empty() {
+		return []string{}
+	}
+	return sortedEntries(c.Env)
+}
+
+// CMakeArgs returns the -D<name>=<value> arguments that set the CMake cache
+// variables of the configuration
+func (c *BuildConfig) CMakeArgs() []string {
+	if c.Empty() {
+		return []string{}
+	}
+	args := sortedEntries(c.CMakeFlags)
+	for i := range args {
+		args[i] = "-D" + args[i]
+	}
+	return args
+}
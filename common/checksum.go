@@ -0,0 +1,224 @@
+package common
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// ArchiveChecksums is the SHA-256 manifest written next to an archive when it
+// is created, which the archive is verified against before it is shipped
+type ArchiveChecksums struct {
+	// The hex encoded SHA-256 digest and size of the archive itself
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+	// The hex encoded SHA-256 digests of the files in the archive, keyed by
+	// their path in the archive
+	Files map[string]string `json:"files"`
+	// The ed25519 signature over the raw digest of the archive, if archives
+	// are signed
+	Signature []byte `json:"signature,omitempty"`
+}
+
+// ChecksumsPath returns the path of the checksums manifest of the archive at
+// path
+func ChecksumsPath(path string) string {
+	return path + ".sha256.json"
+}
+
+// FileSHA256 returns the hex encoded SHA-256 digest and the size of the file
+// at path
+func FileSHA256(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// NewArchiveChecksums computes the checksums of the TAR(.GZ) archive at path
+// and of every file in it
+func NewArchiveChecksums(path string) (*ArchiveChecksums, error) {
+	digest, size, err := FileSHA256(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &ArchiveChecksums{
+		SHA256: digest,
+		Size:   size,
+		Files:  map[string]string{},
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var stream io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gzipStream, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer gzipStream.Close()
+		stream = gzipStream
+	}
+	tarReader := tar.NewReader(stream)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("NewArchiveChecksums: Next() failed: %v", err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		h := sha256.New()
+		if _, err := io.Copy(h, tarReader); err != nil {
+			return nil, err
+		}
+		c.Files[header.Name] = hex.EncodeToString(h.Sum(nil))
+	}
+	return c, nil
+}
+
+// WriteArchiveChecksums writes the checksums manifest next to the archive at
+// path
+func WriteArchiveChecksums(path string, c *ArchiveChecksums) error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(ChecksumsPath(path), b, 0644)
+}
+
+// ReadArchiveChecksums reads the checksums manifest of the archive at path
+func ReadArchiveChecksums(path string) (*ArchiveChecksums, error) {
+	b, err := ioutil.ReadFile(ChecksumsPath(path))
+	if err != nil {
+		return nil, err
+	}
+	c := &ArchiveChecksums{}
+	err = json.Unmarshal(b, c)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// VerifyFileSHA256 checks that the file at path has the given hex encoded
+// SHA-256 digest
+func VerifyFileSHA256(path, expected string) error {
+	digest, _, err := FileSHA256(path)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(digest, expected) {
+		return fmt.Errorf(
+			"checksum mismatch for %s: expected %s, got %s",
+			path,
+			expected,
+			digest,
+		)
+	}
+	return nil
+}
+
+// SignDigest signs the hex encoded SHA-256 digest of an archive
+func SignDigest(key ed25519.PrivateKey, digest string) ([]byte, error) {
+	raw, err := hex.DecodeString(digest)
+	if err != nil {
+		return nil, err
+	}
+	return ed25519.Sign(key, raw), nil
+}
+
+// VerifyDigestSignature checks the signature over the hex encoded SHA-256
+// digest of an archive
+func VerifyDigestSignature(
+	key ed25519.PublicKey,
+	digest string,
+	signature []byte,
+) error {
+	raw, err := hex.DecodeString(digest)
+	if err != nil {
+		return err
+	}
+	if len(signature) == 0 {
+		return errors.New("the archive is not signed")
+	}
+	if !ed25519.Verify(key, raw, signature) {
+		return errors.New("invalid archive signature")
+	}
+	return nil
+}
+
+// AgentUpdatePublicKey returns the key agent binaries must be signed with
+// before they can be rolled out, configured base64 encoded in
+// AGENT_UPDATE_PUBLIC_KEY. The private key is kept offline and is separate
+// from the key the coordinator signs binaries with, such that a compromised
+// coordinator can't roll out binaries of its own. Returns nil if no key is
+// configured
+func AgentUpdatePublicKey() (ed25519.PublicKey, error) {
+	v := os.Getenv("AGENT_UPDATE_PUBLIC_KEY")
+	if v == "" {
+		return nil, nil
+	}
+	b, err := base64.StdEncoding.DecodeString(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid AGENT_UPDATE_PUBLIC_KEY: %v", err)
+	}
+	if len(b) != ed25519.PublicKeySize {
+		return nil, errors.New("AGENT_UPDATE_PUBLIC_KEY is not an ed25519 key")
+	}
+	return ed25519.PublicKey(b), nil
+}
+
+// AgentUpdatePayload returns the message an agent binary is signed over. It
+// includes the version and architecture, such that a signed binary can't be
+// passed off as another version, for instance to roll agents back to an
+// earlier one
+func AgentUpdatePayload(version, arch, digest string) []byte {
+	return []byte(fmt.Sprintf(
+		"opencbdc-tctl agent update\n%s\n%s\n%s",
+		version,
+		arch,
+		strings.ToLower(digest),
+	))
+}
+
+// VerifyAgentUpdateSignature checks the signature over the version,
+// architecture and hex encoded SHA-256 digest of an agent binary
+func VerifyAgentUpdateSignature(
+	key ed25519.PublicKey,
+	version string,
+	arch string,
+	digest string,
+	signature []byte,
+) error {
+	if len(signature) == 0 {
+		return errors.New("the agent binary is not signed")
+	}
+	if !ed25519.Verify(key, AgentUpdatePayload(version, arch, digest), signature) {
+		return errors.New("invalid agent binary signature")
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// CloudAccessGrant is a set of cloud API actions the roles of a test run are
+// allowed to perform on a set of resources, using the temporary credentials
+// issued for the run
+type CloudAccessGrant struct {
+	// Actions in IAM notation, such as s3:GetObject
+	Actions []string `json:"actions"`
+	// ARNs of the resources the actions are allowed on, such as
+	// arn:aws:s3:::bucket/prefix/*
+	Resources []string `json:"resources"`
+}
+
+var validCloudAction = regexp.MustCompile(`^([a-z0-9-]+):[A-Za-z0-9*]+$`)
+
+// Validate checks that the grant names actions of the allowed services, and
+// that neither the actions nor the resources are unrestricted. Resources
+// can't use wildcards for the bucket or resource name, only below it
+func (g CloudAccessGrant) Validate(allowedServices []string) []error {
+	ret := []error{}
+	if len(g.Actions) == 0 || len(g.Resources) == 0 {
+		ret = append(ret, fmt.Errorf(
+			"Cloud access grants need at least one action and one resource",
+		))
+	}
+	for _, a := range g.Actions {
+		m := validCloudAction.FindStringSubmatch(a)
+		if m == nil || strings.HasPrefix(a, m[1]+":*") {
+			ret = append(ret, fmt.Errorf("Invalid cloud access action %q", a))
+			continue
+		}
+		allowed := false
+		for _, s := range allowedServices {
+			if m[1] == s {
+				allowed = true
+			}
+		}
+		if !allowed {
+			ret = append(ret, fmt.Errorf(
+				"Cloud access to service %s is not allowed",
+				m[1],
+			))
+		}
+	}
+	for _, r := range g.Resources {
+		// arn:partition:service:region:account:resource, where the resource
+		// (such as the bucket of an S3 ARN) must be named exactly. Only the
+		// path below it may contain wildcards
+		parts := strings.SplitN(r, ":", 6)
+		if len(parts) != 6 || parts[0] != "arn" ||
+			strings.ContainsAny(parts[1]+parts[2]+parts[3]+parts[4], "*?") ||
+			strings.ContainsAny(strings.SplitN(parts[5], "/", 2)[0], "*?") {
+			ret = append(ret, fmt.Errorf("Invalid cloud access resource %q", r))
+		}
+	}
+	return ret
+}
+
+// CloudAccessPolicy returns the IAM policy document that allows the actions
+// of the grants and nothing else
+func CloudAccessPolicy(grants []CloudAccessGrant) (string, error) {
+	type statement struct {
+		Effect   string   `json:"Effect"`
+		Action   []string `json:"Action"`
+		Resource []string `json:"Resource"`
+	}
+	doc := struct {
+		Version   string      `json:"Version"`
+		Statement []statement `json:"Statement"`
+	}{Version: "2012-10-17", Statement: []statement{}}
+	for _, g := range grants {
+		doc.Statement = append(doc.Statement, statement{
+			Effect:   "Allow",
+			Action:   g.Actions,
+			Resource: g.Resources,
+		})
+	}
+	b, err := json.Marshal(doc)
+	return string(b), err
+}
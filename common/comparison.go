@@ -0,0 +1,53 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// MaxComparisonRepeat is the maximum number of times a comparison run
+// repeats the test for each of the two commits
+const MaxComparisonRepeat = 50
+
+// ValidateComparisonRun checks that a comparison run names two different
+// commits to compare
+func ValidateComparisonRun(tr *TestRun) []error {
+	ret := []error{}
+	if strings.TrimSpace(tr.CommitHash) == "" {
+		ret = append(ret, errors.New("Comparison run has no baseline commit"))
+	}
+	if strings.TrimSpace(tr.CompareCommitHash) == "" {
+		ret = append(ret, errors.New("Comparison run has no commit to compare"))
+	}
+	if tr.CommitHash != "" && tr.CommitHash == tr.CompareCommitHash {
+		ret = append(ret, errors.New("Comparison run compares a commit to itself"))
+	}
+	if tr.Repeat > MaxComparisonRepeat {
+		ret = append(ret, fmt.Errorf(
+			"Comparison runs can repeat the test at most %d times per commit",
+			MaxComparisonRepeat,
+		))
+	}
+	return ret
+}
+
+// ComparisonCommits returns the commits the runs of a comparison run use in
+// the order they are executed: all runs of the baseline commit followed by
+// all runs of the compared commit, or alternating between the two when the
+// repetitions are interleaved
+func ComparisonCommits(tr *TestRun) []string {
+	ret := make([]string, 0, 2*tr.Repeat)
+	if tr.CompareInterleaved {
+		for repeat := 0; repeat < tr.Repeat; repeat++ {
+			ret = append(ret, tr.CommitHash, tr.CompareCommitHash)
+		}
+		return ret
+	}
+	for _, c := range []string{tr.CommitHash, tr.CompareCommitHash} {
+		for repeat := 0; repeat < tr.Repeat; repeat++ {
+			ret = append(ret, c)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,251 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DebugCommand is a diagnostic command admins can run on an agent through the
+// debug channel of the coordinator. Commands are run without a shell, so
+// pipes, redirection and expansion are not available
+type DebugCommand struct {
+	Name string `json:"name"`
+	// If set, the first argument that is not a flag must be one of these
+	Subcommands []string `json:"subcommands,omitempty"`
+	// If set, the arguments that are not flags are paths, starting from the
+	// one at PathsFrom, which the agent only allows within the directories
+	// the debug channel may read
+	Paths     bool `json:"paths,omitempty"`
+	PathsFrom int  `json:"pathsFrom,omitempty"`
+	// If set, the command can read the files below the directories it's
+	// given (or the directory it runs in, if it's given no paths)
+	Recursive bool `json:"recursive,omitempty"`
+	// Flags that change the system in stead of inspecting it, which are
+	// refused
+	ForbiddenFlags []string `json:"forbiddenFlags,omitempty"`
+	// Flags that read a file given as their value, attached (--file=x, -fx)
+	// or as the next argument. Their values are checked like paths
+	FileFlags []string `json:"fileFlags,omitempty"`
+	// Flags that give the pattern of the command as their value, such that
+	// all the arguments that are not flags are paths (like grep -e)
+	PatternFlags []string `json:"patternFlags,omitempty"`
+}
+
+// DebugCommands are the commands that can be run on agents through the debug
+// channel
+var DebugCommands = []DebugCommand{
+	{Name: "cat", Paths: true},
+	{Name: "df"},
+	{
+		Name: "dmesg",
+		ForbiddenFlags: []string{
+			"-c",
+			"-C",
+			"-D",
+			"-E",
+			"-n",
+			"--clear",
+			"--read-clear",
+			"--console-off",
+			"--console-on",
+			"--console-level",
+		},
+	},
+	{
+		Name:        "docker",
+		Subcommands: []string{"inspect", "logs", "ps", "stats", "top"},
+	},
+	{
+		Name:      "du",
+		Paths:     true,
+		FileFlags: []string{"-X", "--exclude-from", "--files0-from"},
+	},
+	{Name: "free"},
+	{
+		Name:         "grep",
+		Paths:        true,
+		PathsFrom:    1,
+		Recursive:    true,
+		FileFlags:    []string{"-f", "--file", "--exclude-from"},
+		PatternFlags: []string{"-e", "--regexp", "-f", "--file"},
+	},
+	{Name: "head", Paths: true},
+	{Name: "iostat"},
+	{
+		Name: "journalctl",
+		ForbiddenFlags: []string{
+			"--flush",
+			"--rotate",
+			"--relinquish-var",
+			"--sync",
+			"--vacuum-files",
+			"--vacuum-size",
+			"--vacuum-time",
+		},
+	},
+	{Name: "ls", Paths: true},
+	{Name: "lsof"},
+	{Name: "nproc"},
+	{Name: "pgrep"},
+	{Name: "ps"},
+	{Name: "ss"},
+	{Name: "stat", Paths: true},
+	{Name: "systemctl", Subcommands: []string{"status"}},
+	{Name: "tail", Paths: true},
+	{Name: "top"},
+	{Name: "uname"},
+	{Name: "uptime"},
+	{Name: "vmstat"},
+	{Name: "wc", Paths: true, FileFlags: []string{"--files0-from"}},
+}
+
+// FindDebugCommand returns the debug command with the given name
+func FindDebugCommand(name string) (DebugCommand, bool) {
+	for _, d := range DebugCommands {
+		if d.Name == name {
+			return d, true
+		}
+	}
+	return DebugCommand{}, false
+}
+
+// matchesFlag returns true if the flag given on the command line is the flag
+// or, for long flags, an abbreviation of it (which the commands accept as
+// long as it's unambiguous)
+func matchesFlag(given, flag string) bool {
+	if strings.HasPrefix(given, "--") {
+		return len(given) > 2 && strings.HasPrefix(flag, given)
+	}
+	return given == flag
+}
+
+// matchesAnyFlag returns true if the flag given on the command line matches
+// one of the flags
+func matchesAnyFlag(given string, flags []string) bool {
+	for _, f := range flags {
+		if matchesFlag(given, f) {
+			return true
+		}
+	}
+	return false
+}
+
+// valueFlag returns the value of the flag at args[i] if it's one of the given
+// flags that take a value, along with the number of arguments the flag and
+// its value take up. Short flags can be combined (-if x is -i -f x), in which
+// case the value is the remainder of the argument or the next argument
+func valueFlag(args []string, i int, flags []string) (string, int, bool) {
+	arg := args[i]
+	next := func() (string, int, bool) {
+		if i+1 < len(args) {
+			return args[i+1], 2, true
+		}
+		return "", 1, true
+	}
+	if strings.HasPrefix(arg, "--") {
+		parts := strings.SplitN(arg, "=", 2)
+		if !matchesAnyFlag(parts[0], flags) {
+			return "", 1, false
+		}
+		if len(parts) == 2 {
+			return parts[1], 1, true
+		}
+		return next()
+	}
+	for j := 1; j < len(arg); j++ {
+		if !matchesAnyFlag("-"+arg[j:j+1], flags) {
+			continue
+		}
+		if j+1 < len(arg) {
+			return arg[j+1:], 1, true
+		}
+		return next()
+	}
+	return "", 1, false
+}
+
+// CheckDebugCommand checks the command line (the command and its arguments)
+// can be run through the debug channel, and returns the arguments that are
+// paths and the values of the flags that read a file, such that neither can
+// be used to read files that are not allowed
+func CheckDebugCommand(args []string) (paths, files []string, err error) {
+	if len(args) == 0 {
+		return nil, nil, fmt.Errorf("no command given")
+	}
+	d, ok := FindDebugCommand(args[0])
+	if !ok {
+		return nil, nil, fmt.Errorf(
+			"%s can't be run through the debug channel",
+			args[0],
+		)
+	}
+
+	paths = []string{}
+	files = []string{}
+	positionals := []string{}
+	pathsFrom := d.PathsFrom
+	for i := 1; i < len(args); {
+		arg := args[i]
+		if arg == "--" {
+			positionals = append(positionals, args[i+1:]...)
+			break
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			positionals = append(positionals, arg)
+			i++
+			continue
+		}
+		flag := strings.SplitN(arg, "=", 2)[0]
+		for _, f := range d.ForbiddenFlags {
+			if matchesFlag(flag, f) {
+				return nil, nil, fmt.Errorf("%s %s is not allowed", d.Name, f)
+			}
+		}
+		value, n, isFile := valueFlag(args, i, d.FileFlags)
+		_, m, isPattern := valueFlag(args, i, d.PatternFlags)
+		if isFile {
+			files = append(files, value)
+		}
+		if isPattern {
+			pathsFrom = 0
+		}
+		if isFile || isPattern {
+			if m > n {
+				n = m
+			}
+			i += n
+			continue
+		}
+		// Flags can't smuggle in paths that are not checked
+		if d.Paths && strings.Contains(arg, "/") {
+			return nil, nil, fmt.Errorf(
+				"paths can't be given in flags (%s)",
+				arg,
+			)
+		}
+		i++
+	}
+
+	for n, arg := range positionals {
+		if n == 0 && len(d.Subcommands) > 0 {
+			allowed := false
+			for _, s := range d.Subcommands {
+				allowed = allowed || s == arg
+			}
+			if !allowed {
+				return nil, nil, fmt.Errorf("%s %s is not allowed", d.Name, arg)
+			}
+		}
+		if d.Paths && n >= pathsFrom {
+			paths = append(paths, arg)
+		}
+	}
+	if len(positionals) == 0 && len(d.Subcommands) > 0 {
+		return nil, nil, fmt.Errorf(
+			"%s needs one of the subcommands %s",
+			d.Name,
+			strings.Join(d.Subcommands, ", "),
+		)
+	}
+	return paths, files, nil
+}
@@ -0,0 +1,42 @@
+package common
+
+// EnrollmentMethodBootstrapToken is the enrollment method in which the agent
+// presents a one-time token that was issued by the coordinator
+const EnrollmentMethodBootstrapToken = "bootstrap-token"
+
+// EnrollmentMethodInstanceIdentity is the enrollment method in which the agent
+// presents the AWS EC2 instance identity document (and its signature) that it
+// retrieved from the instance metadata service
+const EnrollmentMethodInstanceIdentity = "aws-instance-identity"
+
+// EnrollmentMethodAgentCredential is the enrollment method in which the agent
+// presents a credential that the coordinator handed to it during an earlier
+// connection. These credentials are rotated fleet-wide by the coordinator
+const EnrollmentMethodAgentCredential = "agent-credential"
+
+// EnrollmentMethodJoinToken is the enrollment method in which a static agent,
+// running permanently on hardware outside of AWS, presents the join token of
+// the agent pool it joins. Unlike bootstrap tokens, join tokens can be used by
+// any number of agents until they are rotated
+const EnrollmentMethodJoinToken = "join-token"
+
+// InstanceIdentityCredential is the credential sent by the agent when using the
+// EnrollmentMethodInstanceIdentity method. It is sent JSON encoded as the
+// EnrollmentCredential of the HelloMsg
+type InstanceIdentityCredential struct {
+	// The raw instance identity document as returned by the instance metadata
+	// service
+	Document []byte `json:"document"`
+	// The base64 decoded signature over the document as returned by the
+	// instance metadata service
+	Signature []byte `json:"signature"`
+}
+
+// InstanceIdentityDocument contains the fields of the AWS EC2 instance
+// identity document that are relevant for verifying an agent's identity
+type InstanceIdentityDocument struct {
+	AccountID  string `json:"accountId"`
+	InstanceID string `json:"instanceId"`
+	Region     string `json:"region"`
+	PrivateIP  string `json:"privateIp"`
+}
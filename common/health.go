@@ -0,0 +1,27 @@
+package common
+
+import "time"
+
+// AgentHealthSample is the utilization of an agent's system, as periodically
+// reported by the agent
+type AgentHealthSample struct {
+	Time time.Time `json:"time"`
+	// The CPU utilization over all cores, in percent
+	CPUPercent float64 `json:"cpuPercent"`
+	// Memory and disk space, in kB
+	MemTotal      int64 `json:"memTotal"`
+	MemAvailable  int64 `json:"memAvailable"`
+	DiskAvailable int64 `json:"diskAvailable"`
+	// The throughput of the primary network interface, in bytes per second
+	NetRxBytesPerSec float64 `json:"netRxBytesPerSec"`
+	NetTxBytesPerSec float64 `json:"netTxBytesPerSec"`
+}
+
+// MemUsedPercent returns the percentage of the memory in use, or zero if the
+// total memory is unknown
+func (s AgentHealthSample) MemUsedPercent() float64 {
+	if s.MemTotal <= 0 {
+		return 0
+	}
+	return float64(s.MemTotal-s.MemAvailable) / float64(s.MemTotal) * 100
+}
@@ -60,6 +60,12 @@ type TestRunNormalizedConfig struct {
 	PreseedShards          bool    `json:"preseedShards"`
 	LoadGenAccounts        int     `json:"loadGenAccounts"`
 	ContentionRate         float64 `json:"contentionRate"`
+	ContainerImageDigest   string  `json:"containerImageDigest"`
+	FailoverRole           string  `json:"failoverRole,omitempty"`
+	FailoverCount          int     `json:"failoverCount,omitempty"`
+	// The values of the matrix sweep dimensions, which can include parameters
+	// that are otherwise not part of the normalized config
+	SweepCell SweepCellValues `json:"sweepCell,omitempty"`
 }
 
 // Calculates a hash over the normalized config by hashing the serialized JSON
@@ -112,6 +118,11 @@ func (tr *TestRun) NormalizedConfigWithAgentData(
 		trc.SnapshotDistance = 0
 	}
 
+	// The number of failovers is meaningless without a role to fail over
+	if trc.FailoverRole == "" {
+		trc.FailoverCount = 0
+	}
+
 	// Calculate the count and average CPU and RAM for each role type
 	// Also identify in which region all these roles run - used to determine
 	// if we run multi-region.
@@ -0,0 +1,145 @@
+package common
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// OutputSchema describes the expected format of a role output file. Each line
+// of an output file is a record of whitespace separated fields
+type OutputSchema struct {
+	// The minimum and maximum number of fields on each line
+	MinFields int
+	MaxFields int
+	// The fields that have to be numeric
+	NumericFields []int
+	// The field that holds the (unix nanosecond) timestamp of the record, or
+	// -1 if the records have no timestamp. Timestamps cannot decrease from
+	// one line to the next
+	TimestampField int
+	// The minimum number of records the file has to contain
+	MinRows int
+}
+
+// outputSchemas are the schemas of the role output files, keyed by the prefix
+// of their file name
+var outputSchemas = map[string]OutputSchema{
+	// `<unix timestamp in nanoseconds> <latency in nanoseconds>`
+	"tx_samples_": {
+		MinFields:      2,
+		MaxFields:      2,
+		NumericFields:  []int{0, 1},
+		TimestampField: 0,
+		MinRows:        1,
+	},
+	// `<latency in nanoseconds>`
+	"latency_samples_": {
+		MinFields:      1,
+		MaxFields:      1,
+		NumericFields:  []int{0},
+		TimestampField: -1,
+	},
+	// `<transactions in block>`
+	"tp_samples": {
+		MinFields:      1,
+		MaxFields:      1,
+		NumericFields:  []int{0},
+		TimestampField: -1,
+	},
+	// `<txid> <unix timestamp in nanoseconds> [event]`. Records are logged
+	// from several threads, so the timestamps are not ordered
+	"tx_trace_": {
+		MinFields:      2,
+		MaxFields:      3,
+		NumericFields:  []int{1},
+		TimestampField: -1,
+	},
+}
+
+// OutputSchemaFor returns the schema of the output file at path, or nil if
+// the format of the file is not known
+func OutputSchemaFor(path string) *OutputSchema {
+	base := filepath.Base(path)
+	if !strings.HasSuffix(base, ".txt") {
+		return nil
+	}
+	for prefix, schema := range outputSchemas {
+		if strings.HasPrefix(base, prefix) {
+			s := schema
+			return &s
+		}
+	}
+	return nil
+}
+
+// ValidateOutputFile checks the output file at path against the schema, and
+// returns an error describing the first violation found
+func ValidateOutputFile(path string, schema *OutputSchema) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	rows := 0
+	lastTimestamp := 0.0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		rows++
+		fields := strings.Fields(line)
+		if len(fields) < schema.MinFields || len(fields) > schema.MaxFields {
+			return fmt.Errorf(
+				"line %d has %d fields, expected %d to %d",
+				rows,
+				len(fields),
+				schema.MinFields,
+				schema.MaxFields,
+			)
+		}
+		for _, i := range schema.NumericFields {
+			if i >= len(fields) {
+				continue
+			}
+			_, err := strconv.ParseFloat(fields[i], 64)
+			if err != nil {
+				return fmt.Errorf(
+					"line %d: field %d is not numeric: %q",
+					rows,
+					i+1,
+					fields[i],
+				)
+			}
+		}
+		if schema.TimestampField >= 0 {
+			ts, _ := strconv.ParseFloat(fields[schema.TimestampField], 64)
+			if ts < lastTimestamp {
+				return fmt.Errorf(
+					"line %d: timestamp %s is before the previous record",
+					rows,
+					fields[schema.TimestampField],
+				)
+			}
+			lastTimestamp = ts
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if rows < schema.MinRows {
+		return fmt.Errorf(
+			"file has %d records, expected at least %d",
+			rows,
+			schema.MinRows,
+		)
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// MaxSweepMatrixRuns is the maximum number of test runs a matrix sweep can
+// expand into, including repetitions
+const MaxSweepMatrixRuns = 500
+
+// sweepMatrixRolePrefix prefixes the key of a dimension that varies the
+// number of roles of a kind in the sweep cell of a test run
+const sweepMatrixRolePrefix = "roles:"
+
+// SweepCellValues are the values of the dimensions of a matrix sweep for one
+// of its cells, keyed by the dimensions' keys
+type SweepCellValues map[string]interface{}
+
+// SweepDimension is one axis of a matrix sweep: either a test run parameter
+// (by its JSON name) or the number of roles of a kind, with the values it
+// takes in the sweep
+type SweepDimension struct {
+	Parameter string        `json:"parameter,omitempty"`
+	Role      SystemRole    `json:"role,omitempty"`
+	Values    []interface{} `json:"values"`
+}
+
+// Key returns the name under which the value of the dimension is recorded in
+// the sweep cell of a test run
+func (d SweepDimension) Key() string {
+	if d.Role != "" {
+		return sweepMatrixRolePrefix + string(d.Role)
+	}
+	return d.Parameter
+}
+
+// ValidateSweepMatrix checks that the dimensions of the matrix sweep are well
+// formed and that the test run expands into a reasonable number of runs
+func ValidateSweepMatrix(tr *TestRun) []error {
+	ret := []error{}
+	if len(tr.SweepMatrix) == 0 {
+		return append(ret, errors.New("Matrix sweep has no dimensions"))
+	}
+	runs := 1
+	keys := map[string]bool{}
+	for i, d := range tr.SweepMatrix {
+		where := fmt.Sprintf("Dimension %d", i+1)
+		if (d.Parameter == "") == (d.Role == "") {
+			ret = append(ret, fmt.Errorf(
+				"%s: set either a parameter or a role",
+				where,
+			))
+			continue
+		}
+		if keys[d.Key()] {
+			ret = append(ret, fmt.Errorf("%s: %s is swept twice", where, d.Key()))
+		}
+		keys[d.Key()] = true
+		if len(d.Values) == 0 {
+			ret = append(ret, fmt.Errorf("%s: no values", where))
+		}
+		for _, v := range d.Values {
+			if d.Role != "" {
+				n, ok := v.(float64)
+				if !ok || n < 1 || n != math.Trunc(n) {
+					ret = append(ret, fmt.Errorf(
+						"%s: %v is not a valid number of %s roles",
+						where,
+						v,
+						d.Role,
+					))
+				}
+				continue
+			}
+			b, err := json.Marshal(map[string]interface{}{d.Parameter: v})
+			if err == nil {
+				err = json.Unmarshal(b, &TestRun{})
+			}
+			if err != nil {
+				ret = append(ret, fmt.Errorf(
+					"%s: invalid value %v for %s: %v",
+					where,
+					v,
+					d.Parameter,
+					err,
+				))
+			}
+		}
+		if d.Role != "" && countRoles(tr, d.Role) == 0 {
+			ret = append(ret, fmt.Errorf(
+				"%s: the test run has no %s role to replicate",
+				where,
+				d.Role,
+			))
+		}
+		runs *= len(d.Values)
+	}
+	repeat := tr.Repeat
+	if repeat < 1 {
+		repeat = 1
+	}
+	if runs*repeat > MaxSweepMatrixRuns {
+		ret = append(ret, fmt.Errorf(
+			"Matrix sweep expands into %d runs, more than the maximum of %d",
+			runs*repeat,
+			MaxSweepMatrixRuns,
+		))
+	}
+	return ret
+}
+
+// SweepMatrixCells returns every combination of the values of the
+// dimensions
+func SweepMatrixCells(dims []SweepDimension) []SweepCellValues {
+	cells := []SweepCellValues{{}}
+	for _, d := range dims {
+		next := make([]SweepCellValues, 0, len(cells)*len(d.Values))
+		for _, c := range cells {
+			for _, v := range d.Values {
+				cell := make(SweepCellValues, len(c)+1)
+				for k, cv := range c {
+					cell[k] = cv
+				}
+				cell[d.Key()] = v
+				next = append(next, cell)
+			}
+		}
+		cells = next
+	}
+	return cells
+}
+
+// Key returns a string uniquely identifying the sweep cell
+func (cell SweepCellValues) Key() string {
+	// Maps are marshalled with sorted keys
+	b, _ := json.Marshal(cell)
+	return string(b)
+}
+
+// applySweepCell sets the parameters and role counts of the sweep cell on the
+// test run, given as its raw JSON representation
+func applySweepCell(
+	raw map[string]interface{},
+	dims []SweepDimension,
+	cell SweepCellValues,
+) (*TestRun, error) {
+	for _, d := range dims {
+		if d.Parameter != "" {
+			raw[d.Parameter] = cell[d.Key()]
+		}
+	}
+	b, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	var tr TestRun
+	err = json.Unmarshal(b, &tr)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range dims {
+		if d.Role != "" {
+			n, _ := cell[d.Key()].(float64)
+			setRoleCount(&tr, d.Role, int(n))
+		}
+	}
+	tr.SweepCell = cell
+	return &tr, nil
+}
+
+func countRoles(tr *TestRun, role SystemRole) int {
+	n := 0
+	for _, r := range tr.Roles {
+		if r.Role == role {
+			n++
+		}
+	}
+	return n
+}
+
+// setRoleCount removes or adds roles of the given kind until the test run has
+// n of them. Added roles are placed like the last existing role of the kind
+func setRoleCount(tr *TestRun, role SystemRole, n int) {
+	roles := make([]*TestRunRole, 0, len(tr.Roles))
+	var last *TestRunRole
+	count := 0
+	for _, r := range tr.Roles {
+		if r.Role != role {
+			roles = append(roles, r)
+			continue
+		}
+		last = r
+		if count < n {
+			roles = append(roles, r)
+			count++
+		}
+	}
+	for ; last != nil && count < n; count++ {
+		roles = append(roles, &TestRunRole{
+			Role:                role,
+			Index:               count,
+			AgentID:             -1,
+			AwsLaunchTemplateID: last.AwsLaunchTemplateID,
+			Accelerator:         last.Accelerator,
+			AcceleratorCount:    last.AcceleratorCount,
+		})
+	}
+	tr.Roles = roles
+}
@@ -307,6 +307,36 @@ func ExpandSweepRun(originalTr *TestRun, sweepID string) []*TestRun {
 				runs = append(runs, &sweeptr)
 			}
 		}
+	} else if tr.Sweep == "matrix" {
+		var raw map[string]interface{}
+		err = json.NewDecoder(bytes.NewReader(buf.Bytes())).Decode(&raw)
+		if err != nil {
+			logging.Errorf("Error deserializing testrun: %v", err)
+		}
+
+		for _, cell := range SweepMatrixCells(tr.SweepMatrix) {
+			for repeat := 0; repeat < tr.Repeat; repeat++ {
+				sweeptr, err := applySweepCell(raw, tr.SweepMatrix, cell)
+				if err != nil {
+					logging.Errorf("Error applying sweep cell: %v", err)
+					continue
+				}
+				sweeptr.SweepID = sweepID
+				runs = append(runs, sweeptr)
+			}
+		}
+	} else if tr.Sweep == "comparison" {
+		for _, commit := range ComparisonCommits(tr) {
+			var sweeptr TestRun
+			err = json.NewDecoder(bytes.NewReader(buf.Bytes())).Decode(&sweeptr)
+			if err != nil {
+				logging.Errorf("Error deserializing testrun: %v", err)
+			}
+
+			sweeptr.CommitHash = commit
+			sweeptr.SweepID = sweepID
+			runs = append(runs, &sweeptr)
+		}
 	} else if tr.Sweep == "roles" {
 		for i := 0; i < tr.SweepRoleRuns; i++ {
 			for repeat := 0; repeat < tr.Repeat; repeat++ {
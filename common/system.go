@@ -111,6 +111,7 @@ var AvailableArchitectures = []SystemArchitecture{
 			CoordinatorLogLevel:       "WARN",
 			AgentLogLevel:             "WARN",
 			TicketerLogLevel:          "WARN",
+			LoadGenLogLevel:           "WARN",
 			AtomizerTelemetryLevel:    "OFF",
 			SentinelTelemetryLevel:    "OFF",
 			ArchiverTelemetryLevel:    "OFF",
@@ -199,6 +200,7 @@ var AvailableArchitectures = []SystemArchitecture{
 			CoordinatorLogLevel:       "WARN",
 			AgentLogLevel:             "WARN",
 			TicketerLogLevel:          "WARN",
+			LoadGenLogLevel:           "WARN",
 			AtomizerTelemetryLevel:    "OFF",
 			SentinelTelemetryLevel:    "OFF",
 			ArchiverTelemetryLevel:    "OFF",
@@ -281,6 +283,7 @@ var AvailableArchitectures = []SystemArchitecture{
 			CoordinatorLogLevel:       "WARN",
 			AgentLogLevel:             "WARN",
 			TicketerLogLevel:          "WARN",
+			LoadGenLogLevel:           "WARN",
 			AtomizerTelemetryLevel:    "OFF",
 			SentinelTelemetryLevel:    "OFF",
 			ArchiverTelemetryLevel:    "OFF",
@@ -123,6 +123,42 @@ func TarExtractFlat(path string, flat bool, createNoDir bool) error {
 	return nil
 }
 
+// TarListFiles returns the names of all regular files contained in a tar(.gz)
+// archive, without extracting it
+func TarListFiles(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var stream io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gzipStream, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer gzipStream.Close()
+		stream = gzipStream
+	}
+
+	files := make([]string, 0)
+	tarReader := tar.NewReader(stream)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("TarListFiles: Next() failed: %s", err.Error())
+		}
+		if header.Typeflag == tar.TypeReg {
+			files = append(files, header.Name)
+		}
+	}
+	return files, nil
+}
+
 // tarAddFile adds a file to a tar archive
 func tarAddFile(tw *tar.Writer, path, relativePath string) error {
 	file, err := os.Open(path)
@@ -149,40 +185,93 @@ func tarAddFile(tw *tar.Writer, path, relativePath string) error {
 	return nil
 }
 
+// ArchiveProgressFunc is called while creating an archive, with the number of
+// bytes of the source files archived so far and their total size
+type ArchiveProgressFunc func(done, total int64)
+
 // CreateArchive creates a TAR.GZ archive of sourceFolder and writes it to
 // the target path
 func CreateArchive(sourceFolder, targetPath string) error {
+	return CreateArchiveWithProgress(sourceFolder, targetPath, nil)
+}
+
+// CreateArchiveWithProgress creates a TAR.GZ archive of sourceFolder and
+// writes it to the target path, calling progress after every file added to
+// it. The total size is determined before archiving, which takes an extra
+// pass over the directory tree
+func CreateArchiveWithProgress(
+	sourceFolder, targetPath string,
+	progress ArchiveProgressFunc,
+) error {
 	file, err := os.Create(targetPath)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
-	return CreateArchiveToStream(sourceFolder, file)
+	return createArchiveToStream(sourceFolder, file, progress)
 }
 
 // CreateArchiveToStream creates a TAR.GZ archive of sourceFolder and writes it
 // to the target stream
 func CreateArchiveToStream(sourceFolder string, target io.Writer) error {
+	return createArchiveToStream(sourceFolder, target, nil)
+}
+
+// walkArchiveFiles calls f for every file in sourceFolder that is included in
+// its archive
+func walkArchiveFiles(
+	sourceFolder string,
+	f func(path string, info os.FileInfo) error,
+) error {
+	return filepath.Walk(sourceFolder,
+		func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() || strings.Contains(path, "/.git/") {
+				return nil
+			}
+			return f(path, info)
+		})
+}
+
+func createArchiveToStream(
+	sourceFolder string,
+	target io.Writer,
+	progress ArchiveProgressFunc,
+) error {
+	total := int64(0)
+	if progress != nil {
+		err := walkArchiveFiles(sourceFolder,
+			func(_ string, info os.FileInfo) error {
+				total += info.Size()
+				return nil
+			})
+		if err != nil {
+			return err
+		}
+		progress(0, total)
+	}
+
 	gw := gzip.NewWriter(target)
 	defer gw.Close()
 	tw := tar.NewWriter(gw)
 	defer tw.Close()
-	return filepath.Walk(sourceFolder,
-		func(path string, info os.FileInfo, err error) error {
+	done := int64(0)
+	return walkArchiveFiles(sourceFolder,
+		func(path string, info os.FileInfo) error {
+			relativePath, err := filepath.Rel(sourceFolder, path)
 			if err != nil {
 				return err
 			}
-			if !info.IsDir() {
-				if strings.Contains(path, "/.git/") {
-					return nil
-				}
-				relativePath, err := filepath.Rel(sourceFolder, path)
-				if err != nil {
-					return err
-				}
-				return tarAddFile(tw, path, relativePath)
+			err = tarAddFile(tw, path, relativePath)
+			if err != nil {
+				return err
+			}
+			if progress != nil {
+				done += info.Size()
+				progress(done, total)
 			}
 			return nil
 		})
-
 }
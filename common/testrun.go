@@ -19,6 +19,7 @@ import (
 type TestRun struct {
 	ID                        string             `json:"id"`
 	CreatedByThumbprint       string             `json:"createdByuserThumbprint"`
+	ImpersonatedByThumbprint  string             `json:"impersonatedByThumbprint,omitempty"`
 	Created                   time.Time          `json:"created"`
 	Started                   time.Time          `json:"started"`
 	Completed                 time.Time          `json:"completed"`
@@ -61,6 +62,7 @@ type TestRun struct {
 	TicketerLogLevel          string             `json:"ticketerLogLevel"          feFieldTitle:"Ticketer Log Level"              feFieldType:"loglevel"`
 	CoordinatorLogLevel       string             `json:"coordinatorLogLevel"       feFieldTitle:"Coordinator Log Level"           feFieldType:"loglevel"`
 	WatchtowerLogLevel        string             `json:"watchtowerLogLevel"        feFieldTitle:"Watchtower Log Level"            feFieldType:"loglevel"`
+	LoadGenLogLevel           string             `json:"loadGenLogLevel"           feFieldTitle:"Load Generator Log Level"        feFieldType:"loglevel"`
 	AtomizerTelemetryLevel    string             `json:"atomizerTelemetryLevel"    feFieldTitle:"Atomizer Telemetry Level"        feFieldType:"tellevel"`
 	ArchiverTelemetryLevel    string             `json:"archiverTelemetryLevel"    feFieldTitle:"Archiver Telemetry Level"        feFieldType:"tellevel"`
 	SentinelTelemetryLevel    string             `json:"sentinelTelemetryLevel"    feFieldTitle:"Sentinel Telemetry Level"        feFieldType:"tellevel"`
@@ -79,6 +81,8 @@ type TestRun struct {
 	PreseedShards             bool               `json:"preseedShards"             feFieldTitle:"Preseed outputs on shards"       feFieldType:"bool"`
 	KeepTimedOutAgents        bool               `json:"keepTimedOutAgents"        feFieldTitle:"Keep timed out agents"           feFieldType:"bool"`
 	SkipCleanUp               bool               `json:"skipCleanup"               feFieldTitle:"Skip cleanup after test"         feFieldType:"bool"`
+	ForceCleanup              bool               `json:"forceCleanup"              feFieldTitle:"Force-clean residue after test"  feFieldType:"bool"`
+	ReuseEnvironment          bool               `json:"reuseEnvironment"          feFieldTitle:"Keep agents warm for next run"   feFieldType:"bool"`
 	RetryOnFailure            bool               `json:"retryOnFailure"            feFieldTitle:"Retry on failures"               feFieldType:"bool"`
 	MaxRetries                int                `json:"maxRetries"                feFieldTitle:"Maximum number of retries"       feFieldType:"int"`
 	Repeat                    int                `json:"repeat"                    feFieldTitle:"Repeat test X times"             feFieldType:"int"`
@@ -86,7 +90,16 @@ type TestRun struct {
 	SentinelAttestations      int                `json:"sentinelAttestations"      feFieldTitle:"Number of sentinel attestations" feFieldType:"int"`
 	AuditInterval             int                `json:"auditInterval"             feFieldTitle:"Audit Interval (blocks)"         feFieldType:"int"`
 	RecordNetworkTraffic      bool               `json:"recordNetworkTraffic"      feFieldTitle:"Record network traffic"          feFieldType:"bool"`
+	TxTraceSamples            int                `json:"txTraceSamples"            feFieldTitle:"Transaction traces to sample"    feFieldType:"int"`
 	AgentShutdownDelay        int                `json:"agentShutdownDelay"        feFieldTitle:"Agent Shutdown Delay (seconds)"  feFieldType:"int"`
+	SnapshotDataOnFailure     bool               `json:"snapshotDataOnFailure" feFieldTitle:"Snapshot agent data on failure" feFieldType:"bool"`
+	SnapshotVolumesOnFailure  bool               `json:"snapshotVolumesOnFailure" feFieldTitle:"Snapshot EBS volumes on failure" feFieldType:"bool"`
+	SnapshotRetentionDays     int                `json:"snapshotRetentionDays" feFieldTitle:"Snapshot retention (days)" feFieldType:"int"`
+	FailoverRole              SystemRole         `json:"failoverRole"`
+	FailoverAfter             int                `json:"failoverAfter" feFieldTitle:"First failover after (seconds)" feFieldType:"int"`
+	FailoverCount             int                `json:"failoverCount" feFieldTitle:"Number of failovers" feFieldType:"int"`
+	FailoverInterval          int                `json:"failoverInterval" feFieldTitle:"Seconds between failovers" feFieldType:"int"`
+	FailoverRecovery          float64            `json:"failoverRecovery" feFieldTitle:"Recovered at % of throughput" feFieldType:"float"`
 	ObservedPeak              float64            `json:"observedPeak"`
 	DontRunBefore             time.Time          `json:"notBefore"`
 	Sweep                     string             `json:"sweep"`
@@ -100,6 +113,13 @@ type TestRun struct {
 	SweepParameterIncrement   float64            `json:"sweepParameterIncrement"`
 	SweepOneAtATime           bool               `json:"sweepOneAtATime"`
 	SweepRoles                []*TestRunRole     `json:"sweepRoles"`
+	SweepMatrix               []SweepDimension   `json:"sweepMatrix,omitempty"`
+	SweepCell                 SweepCellValues    `json:"sweepCell,omitempty"`
+	SweepConcurrency          int                `json:"sweepConcurrency,omitempty"`
+	SweepBudget               *SweepBudget       `json:"sweepBudget,omitempty"`
+	SweepBudgetHold           bool               `json:"sweepBudgetHold,omitempty"`
+	CompareCommitHash         string             `json:"compareCommitHash,omitempty"`
+	CompareInterleaved        bool               `json:"compareInterleaved,omitempty"`
 	Priority                  int                `json:"priority"`
 	Roles                     []*TestRunRole     `json:"roles"`
 	Details                   string             `json:"details"`
@@ -110,15 +130,95 @@ type TestRun struct {
 	ControllerCommit          string             `json:"controllerCommitHash"`
 	Result                    *TestResult        `json:"result"`
 	SeederHash                string             `json:"seederHash"`
-	TerminateChan             chan bool          `json:"-"`
-	RetrySpawnChan            chan bool          `json:"-"`
-	PendingResultDownloads    []S3Download       `json:"-"`
-	executedCommandsLock      sync.Mutex         `json:"-"`
-	DeliberateFailures        []string           `json:"-"`
-	LogBuffer                 string             `json:"-"`
-	logLock                   sync.Mutex         `json:"-"`
-	Params                    []string           `json:"-"`
-	AWSInstancesStopped       bool
+	RoleBinaryOverrides       RoleBinaries       `json:"roleBinaryOverrides"`
+	AwaitingApproval          bool               `json:"awaitingApproval"`
+	ApprovedByThumbprint      string             `json:"approvedByThumbprint"`
+	ContainerImage            string             `json:"containerImage"`
+	ContainerImageDigest      string             `json:"containerImageDigest"`
+	RunFromBinariesImage      bool               `json:"runFromBinariesImage"`
+	SourceRef                 string             `json:"sourceRef"`
+	ShadowSnapshotID          string             `json:"shadowSnapshotID,omitempty"`
+	TemplateID                string             `json:"templateID,omitempty"`
+	TemplateVersion           int                `json:"templateVersion,omitempty"`
+	Components                []SUTComponent     `json:"components,omitempty"`
+	BuildConfig               *BuildConfig       `json:"buildConfig,omitempty"`
+	CloudAccess               []CloudAccessGrant `json:"cloudAccess,omitempty"`
+	Tags                      []string           `json:"tags,omitempty"`
+	FeatureFlags              []string           `json:"featureFlags,omitempty"`
+	PlacementChanges          []PlacementChange  `json:"placementChanges,omitempty"`
+	Summary                   *TestRunSummary    `json:"summary,omitempty"`
+	FailureSnapshots          []AgentSnapshot    `json:"failureSnapshots,omitempty"`
+	Failovers                 []FailoverEvent    `json:"failovers,omitempty"`
+	Preemptions               []Preemption       `json:"preemptions,omitempty"`
+	Pauses                    []PauseInterval    `json:"pauses,omitempty"`
+	Faults                    []FaultInjection   `json:"faults,omitempty"`
+	FaultTimeline             []FaultEvent       `json:"faultTimeline,omitempty"`
+	AbortConditions           *AbortConditions   `json:"abortConditions,omitempty"`
+	AbortTrigger              *AbortTrigger      `json:"abortTrigger,omitempty"`
+	CleanupResidue            []CleanupResidue   `json:"cleanupResidue,omitempty"`
+	WarmEnvironmentID         string             `json:"warmEnvironmentID,omitempty"`
+	RegressionGate            *RegressionGate    `json:"regressionGate,omitempty"`
+	Regression                *RegressionVerdict `json:"regression,omitempty"`
+	Soak                      *SoakConfig        `json:"soak,omitempty"`
+	SoakCheckpoints           []SoakCheckpoint   `json:"soakCheckpoints,omitempty"`
+	SoakState                 *SoakState         `json:"soakState,omitempty"`
+	Annotations               []Annotation       `json:"annotations,omitempty"`
+	LoadProfile               *LoadProfile       `json:"loadProfile,omitempty"`
+	// The time the load profile was started on the load generators
+	LoadProfileStarted time.Time `json:"loadProfileStarted,omitempty"`
+	// Places the roles of a kind in another AWS region than the launch
+	// template they were configured with
+	RegionPlacement []RegionPlacement `json:"regionPlacement,omitempty"`
+	// Transfers the binaries to the agents and the output files back over
+	// the connections of the agents to the coordinator, in stead of through
+	// S3. Meant for agents without access to S3, such as static agents on
+	// lab hardware
+	DirectTransfer bool `json:"directTransfer,omitempty"`
+	// Has the agents download the binaries from S3 with pre-signed URLs, such
+	// that they need no S3 credentials, without the coordinator sending the
+	// binaries to every agent itself
+	PresignedDownloads bool `json:"presignedDownloads,omitempty"`
+	// The reason the scheduler could not start the queued test run the last
+	// time it considered it
+	QueueBlocked string `json:"queueBlocked,omitempty"`
+	// The test runs that must end before the test run can start
+	DependsOn []TestRunDependency `json:"dependsOn,omitempty"`
+	// The category of the cause of an unsuccessful test run, and the reason
+	// it was classified as such
+	FailureClass       FailureClass `json:"failureClass,omitempty"`
+	FailureClassReason string       `json:"failureClassReason,omitempty"`
+	// The role output files that failed validation on the agent, with the
+	// reason they failed it
+	OutputValidationErrors []string         `json:"outputValidationErrors,omitempty"`
+	Environments           map[int32][]byte `json:"-"`
+	TerminateChan          chan bool        `json:"-"`
+	RetrySpawnChan         chan bool        `json:"-"`
+	PendingResultDownloads []S3Download     `json:"-"`
+	executedCommandsLock   sync.Mutex       `json:"-"`
+	DeliberateFailures     []string         `json:"-"`
+	LogBuffer              string           `json:"-"`
+	logLock                sync.Mutex       `json:"-"`
+	Params                 []string         `json:"-"`
+	AWSInstancesStopped    bool
+}
+
+// RoleBinaries maps a system role to the path (relative to the root of the
+// binaries archive) of the executable to launch for that role
+type RoleBinaries map[SystemRole]string
+
+// SUTComponent selects a commit of an additional repository of the system
+// under test, whose binaries are deployed to components/<Repo> on the agents
+// next to the ones of the transaction processor
+type SUTComponent struct {
+	Repo string `json:"repo"`
+	// Branch, tag or commit to use, the repository's configured branch if
+	// empty
+	Ref string `json:"ref,omitempty"`
+	// The commit Ref resolved to when the test run started
+	CommitHash string `json:"commitHash,omitempty"`
+	// Path in the binaries bucket of the archive deployed for each agent
+	// architecture
+	Binaries map[string]string `json:"binaries,omitempty"`
 }
 
 func (tr *TestRun) ReadLogTail() {
@@ -203,6 +303,117 @@ type TestRunRole struct {
 	AwsAgentInstanceId  string              `json:"awsInstanceId"`
 	Fail                bool                `json:"fail"`
 	Failure             *TestRunRoleFailure `json:"failure"`
+	// Set when the agent the role runs on was chosen manually rather than by
+	// the scheduler
+	ManualPlacement bool `json:"manualPlacement,omitempty"`
+	// When set, the role runs on the same agent as the referenced role rather
+	// than on an agent of its own
+	ColocateWith *TestRunRoleRef `json:"colocateWith,omitempty"`
+	// When set, the role runs on an idle static agent of this pool rather
+	// than on an agent launched from a launch template. The agent is chosen
+	// when the test run starts
+	AgentPool string `json:"agentPool,omitempty"`
+	// When set, the role can only run on an agent with at least
+	// AcceleratorCount (default one) accelerators of this kind
+	Accelerator      string `json:"accelerator,omitempty"`
+	AcceleratorCount int    `json:"acceleratorCount,omitempty"`
+	// The capabilities the agent of the role needs. Roles without a launch
+	// template or agent are placed on a launch template that meets them. If
+	// not set, the requirements configured for the kind of role apply
+	Requirements *RoleRequirements `json:"requirements,omitempty"`
+	// The cgroup limits the agent enforces on the process of the role
+	Limits *ResourceLimits `json:"limits,omitempty"`
+	// Extra command line arguments appended to the parameters of the role's
+	// binary, and extra environment variables (KEY=VALUE) to launch it with
+	ExtraArgs []string `json:"extraArgs,omitempty"`
+	ExtraEnv  []string `json:"extraEnv,omitempty"`
+}
+
+// AgentSnapshotKind identifies what an agent snapshot captured
+type AgentSnapshotKind string
+
+// AgentSnapshotData is a TAR.GZ archive in S3 of the environment directory of
+// the agent, holding the binaries, configuration and data of its roles
+const AgentSnapshotData AgentSnapshotKind = "data"
+
+// AgentSnapshotVolume is an EBS snapshot of a volume of the agent's instance
+const AgentSnapshotVolume AgentSnapshotKind = "volume"
+
+// AgentSnapshot is the state of an agent captured for postmortems when a test
+// run failed, before the agent was torn down
+type AgentSnapshot struct {
+	AgentID int32             `json:"agentID"`
+	Kind    AgentSnapshotKind `json:"kind"`
+	// The roles that ran on the agent
+	Roles  []TestRunRoleRef `json:"roles"`
+	Region string           `json:"region"`
+	// The location of data snapshots
+	Bucket string `json:"bucket,omitempty"`
+	Path   string `json:"path,omitempty"`
+	// The EBS snapshot of volume snapshots
+	InstanceID string    `json:"instanceID,omitempty"`
+	VolumeID   string    `json:"volumeID,omitempty"`
+	SnapshotID string    `json:"snapshotID,omitempty"`
+	Created    time.Time `json:"created"`
+	// The snapshot is deleted once it expires
+	Expires time.Time `json:"expires"`
+	Deleted bool      `json:"deleted"`
+}
+
+// RoleRequirements are the capabilities the agent of a role needs. Zero values
+// are not required
+type RoleRequirements struct {
+	MinVCPUs     int   `json:"minVCPUs,omitempty"`
+	MinMemoryMiB int64 `json:"minMemoryMiB,omitempty"`
+	// Local NVMe instance storage
+	NVMe bool `json:"nvme,omitempty"`
+	// amd64 or arm64
+	Architecture string `json:"architecture,omitempty"`
+	Region       string `json:"region,omitempty"`
+	// Launch templates don't determine the availability zone their instances
+	// are launched in, so only connected agents can meet this requirement
+	AvailabilityZone string `json:"availabilityZone,omitempty"`
+}
+
+// ResourceLimits are the limits the agent enforces on the process of a role
+// using cgroup v2, for instance to experiment with resource-constrained
+// deployments. Zero values are not limited
+type ResourceLimits struct {
+	// The CPU time the process may use, in (fractions of) vCPUs
+	CPUs float64 `json:"cpus,omitempty"`
+	// The memory the process may use before it is killed
+	MemoryMiB int64 `json:"memoryMiB,omitempty"`
+	// The weight of the process when competing for disk IO, from 1 to 10000.
+	// Processes without a limit have the default weight of 100
+	IOWeight int `json:"ioWeight,omitempty"`
+}
+
+// TestRunRoleRef refers to a role of a test run
+type TestRunRoleRef struct {
+	Role  SystemRole `json:"role"`
+	Index int        `json:"roleIdx"`
+}
+
+// RegionPlacement places the roles of a kind in an AWS region. Roles that
+// are placed manually or colocated with another role keep their placement
+type RegionPlacement struct {
+	Role   SystemRole `json:"role"`
+	Region string     `json:"region"`
+}
+
+// PlacementChange is a manual change of the agent a role runs on. Exactly
+// one of AgentID, AwsLaunchTemplateID and ColocateWith is set
+type PlacementChange struct {
+	Role  SystemRole `json:"role"`
+	Index int        `json:"roleIdx"`
+	// Run the role on an agent that is already connected
+	AgentID int32 `json:"agentID,omitempty"`
+	// Run the role on a new AWS agent spawned from the launch template
+	AwsLaunchTemplateID string `json:"awsLaunchTemplateID,omitempty"`
+	// Run the role on the agent of another role of the test run
+	ColocateWith   *TestRunRoleRef `json:"colocateWith,omitempty"`
+	UserThumbprint string          `json:"userThumbprint"`
+	Applied        time.Time       `json:"applied"`
 }
 
 type TestRunRoleFailure struct {
@@ -210,8 +421,125 @@ type TestRunRoleFailure struct {
 	Failed bool `json:"-"`
 }
 
+// Preemption records that a test run was aborted to free up capacity for a
+// test run of a higher priority, and the test run it was requeued as
+type Preemption struct {
+	PreemptedBy string    `json:"preemptedBy"`
+	Preempted   time.Time `json:"preempted"`
+	RequeuedAs  string    `json:"requeuedAs,omitempty"`
+}
+
+// PauseInterval is a period during which the load generators of a running
+// test run were suspended, for instance to attach a profiler to one of the
+// system roles
+type PauseInterval struct {
+	Paused time.Time `json:"paused"`
+	// Zero while the test run is paused
+	Resumed        time.Time `json:"resumed"`
+	UserThumbprint string    `json:"userThumbprint"`
+}
+
+// FaultKind is a type of fault the chaos injection of a test run injects
+type FaultKind string
+
+// FaultKindKill kills the processes of the role
+const FaultKindKill FaultKind = "kill"
+
+// FaultKindPartition drops all traffic between the agent of the role and the
+// agents of the peer role, or all other agents of the test run if no peer
+// role is set
+const FaultKindPartition FaultKind = "partition"
+
+// FaultKindNetem adds latency, jitter and/or packet loss to the network
+// interface of the agent of the role
+const FaultKindNetem FaultKind = "netem"
+
+// FaultKindDiskThrottle limits the disk bandwidth of the processes running
+// on the agent of the role
+const FaultKindDiskThrottle FaultKind = "diskThrottle"
+
+// FaultInjection is a fault injected into one of the roles of a test run at a
+// scheduled point during its load, for testing the resilience of the system
+type FaultInjection struct {
+	Kind  FaultKind  `json:"kind"`
+	Role  SystemRole `json:"role"`
+	Index int        `json:"roleIdx"`
+	// The role on the other side of a network partition
+	PeerRole  SystemRole `json:"peerRole,omitempty"`
+	PeerIndex int        `json:"peerRoleIdx,omitempty"`
+	// Seconds after the start of the load the fault is injected at, and for
+	// how long. Faults without a duration last until the end of the test run.
+	// Killed roles are not restarted
+	After    int `json:"after"`
+	Duration int `json:"duration"`
+	// Parameters of netem faults
+	LatencyMs   int     `json:"latencyMs,omitempty"`
+	JitterMs    int     `json:"jitterMs,omitempty"`
+	LossPercent float64 `json:"lossPercent,omitempty"`
+	// Read and write bandwidth of disk throttle faults
+	DiskBytesPerSecond int64 `json:"diskBytesPerSecond,omitempty"`
+}
+
+// FaultEvent records a fault injected into a test run
+type FaultEvent struct {
+	// Index of the fault in the faults of the test run
+	Fault    int        `json:"fault"`
+	Kind     FaultKind  `json:"kind"`
+	Role     SystemRole `json:"role"`
+	Index    int        `json:"roleIdx"`
+	AgentID  int32      `json:"agentID"`
+	Injected time.Time  `json:"injected"`
+	// Zero while the fault is active, or if it is permanent
+	Reverted time.Time `json:"reverted"`
+	// Set if the fault could not be injected or reverted
+	Error string `json:"error,omitempty"`
+}
+
+// FaultImpact is the system throughput before and during an injected fault
+type FaultImpact struct {
+	FaultEvent
+	Baseline float64 `json:"baseline"`
+	During   float64 `json:"during"`
+	Minimum  float64 `json:"minimum"`
+}
+
+// FailoverEvent is the kill of the leader of a RAFT cluster during a failover
+// test run
+type FailoverEvent struct {
+	Role    SystemRole `json:"role"`
+	Index   int        `json:"roleIdx"`
+	AgentID int32      `json:"agentID"`
+	// Set if the role was found to be the leader by its RPC endpoint
+	// responding. When no member of the cluster responded, for instance
+	// because an election was still in progress, the first remaining member
+	// was killed instead
+	LeaderDetected bool      `json:"leaderDetected"`
+	Killed         time.Time `json:"killed"`
+}
+
 type TestRunStatus string
 
+// The priority levels of test runs. Queued test runs of a higher priority are
+// started first, test runs of the same priority in the order they were
+// scheduled. Any other value is valid too
+const (
+	TestRunPriorityLow    = -10
+	TestRunPriorityNormal = 0
+	TestRunPriorityHigh   = 10
+	TestRunPriorityUrgent = 20
+)
+
+// TestRunTagNightly tags the test runs scheduled by the nightly benchmark
+// pipeline
+const TestRunTagNightly = "nightly"
+
+// TestRunTagRecurring tags the test runs scheduled by a recurring schedule
+const TestRunTagRecurring = "recurring"
+
+// TestRunTagMergeQueue tags the test runs benchmarking the merge candidates
+// of the GitHub merge queue
+const TestRunTagMergeQueue = "merge-queue"
+
 const TestRunStatusUnknown TestRunStatus = "Unknown"
 const TestRunStatusQueued TestRunStatus = "Queued"
 const TestRunStatusRunning TestRunStatus = "Running"
@@ -220,6 +548,281 @@ const TestRunStatusCompleted TestRunStatus = "Completed"
 const TestRunStatusAborted TestRunStatus = "Aborted"
 const TestRunStatusInterrupted TestRunStatus = "Interrupted"
 const TestRunStatusCanceled TestRunStatus = "Canceled"
+const TestRunStatusSkipped TestRunStatus = "Skipped"
+
+// TestRunDependency makes a queued test run wait until another test run ended.
+// If it ends with a different status than required, the test run is skipped
+type TestRunDependency struct {
+	TestRunID string `json:"testRunID"`
+	// The status the test run must end with, Completed if empty
+	Status TestRunStatus `json:"status,omitempty"`
+}
+
+// SweepBudget limits what the runs of a sweep may use together. Zero values
+// are not limited. Once the budget is reached, the queued runs of the sweep
+// are held (SweepBudgetHold) until the budget is extended
+type SweepBudget struct {
+	// The cost in US dollars, based on the configured hourly cost of the
+	// instance types of the roles
+	CostUSD float64 `json:"costUSD,omitempty"`
+	// The agent hours, which is the number of agents of a run multiplied by
+	// its duration in hours
+	FleetHours float64 `json:"fleetHours,omitempty"`
+}
+
+// RegressionGate compares the results of a test run against a named baseline
+// once it completed, and flags the test run as regressed if they are worse
+// than the thresholds allow. Thresholds set to zero are not checked
+type RegressionGate struct {
+	BaselineID string `json:"baselineID"`
+	// The maximum drop of the average throughput, in percent of the baseline
+	MaxThroughputDropPercent float64 `json:"maxThroughputDropPercent,omitempty"`
+	// The maximum rise of the p99 latency, in percent of the baseline
+	MaxTailLatencyRisePercent float64 `json:"maxTailLatencyRisePercent,omitempty"`
+}
+
+// RegressionVerdict is the outcome of the regression gate of a test run
+type RegressionVerdict struct {
+	BaselineID   string `json:"baselineID"`
+	BaselineName string `json:"baselineName"`
+	Regressed    bool   `json:"regressed"`
+	// The change of the metrics relative to the baseline, in percent
+	ThroughputChangePercent  float64 `json:"throughputChangePercent"`
+	TailLatencyChangePercent float64 `json:"tailLatencyChangePercent"`
+	// The thresholds that were exceeded
+	Reasons []string `json:"reasons,omitempty"`
+}
+
+// SoakConfig turns a test run into a soak test, which generates load for a
+// fixed duration of hours or days rather than for its sample count
+type SoakConfig struct {
+	DurationMinutes int `json:"durationMinutes"`
+	// The interval at which the metrics of the load generators are
+	// checkpointed into the test run
+	CheckpointMinutes int `json:"checkpointMinutes"`
+	// The standard output and error of the roles are rotated on the agents
+	// once they exceed this size, keeping LogRotateKeep rotated files. Zero
+	// disables rotation
+	LogRotateMB   int `json:"logRotateMB,omitempty"`
+	LogRotateKeep int `json:"logRotateKeep,omitempty"`
+}
+
+// SoakCheckpoint holds the metrics of the load generators of a soak test over
+// the interval since the previous checkpoint
+type SoakCheckpoint struct {
+	Time time.Time `json:"time"`
+	// The first and last second of samples covered by the checkpoint
+	From  int64 `json:"from"`
+	Until int64 `json:"until"`
+	// The number of transactions completed in the interval, and their average
+	// throughput (tx/s) and latency (s)
+	Transactions int64   `json:"transactions"`
+	Throughput   float64 `json:"throughput"`
+	LatencyAvg   float64 `json:"latencyAvg"`
+	LatencyMax   float64 `json:"latencyMax"`
+}
+
+// SoakState is what the coordinator needs to resume collecting the results of
+// a soak test if it is restarted while the soak test runs
+type SoakState struct {
+	// The time the load generation started
+	LoadStarted time.Time   `json:"loadStarted"`
+	Agents      []SoakAgent `json:"agents"`
+	Resumed     []time.Time `json:"resumed,omitempty"`
+}
+
+// SoakAgent is an agent running roles of a soak test, with the environment
+// and commands of the test run on it. Agents without a persistent identity get
+// a new ID when they reconnect, so they are found again by their EC2 instance
+// ID or host name
+type SoakAgent struct {
+	AgentID       int32    `json:"agentID"`
+	EC2InstanceID string   `json:"ec2InstanceID,omitempty"`
+	HostName      string   `json:"hostName"`
+	EnvironmentID string   `json:"environmentID"`
+	CommandIDs    []string `json:"commandIDs"`
+}
+
+// LoadProfileKind is the shape of the load a load profile generates
+type LoadProfileKind string
+
+// LoadProfileRamp increases the load linearly from StartPercent to EndPercent
+// over PeriodSeconds, and holds it at EndPercent after that
+const LoadProfileRamp LoadProfileKind = "ramp"
+
+// LoadProfileStep starts the load at StartPercent and increases it by
+// StepPercent every PeriodSeconds, until it reaches EndPercent
+const LoadProfileStep LoadProfileKind = "step"
+
+// LoadProfileSine varies the load between StartPercent and EndPercent as a
+// sine wave with a period of PeriodSeconds, starting halfway
+const LoadProfileSine LoadProfileKind = "sine"
+
+// LoadProfileBurst holds the load at StartPercent, with bursts at EndPercent
+// of BurstSeconds every PeriodSeconds
+const LoadProfileBurst LoadProfileKind = "burst"
+
+// LoadProfile shapes the load the load generators of a test run generate over
+// time, as percentages of LoadGenTPSTarget. Ramp and step profiles are
+// translated into the step parameters of the load generators, which generate
+// them themselves. For sine and burst profiles the load generators run at the
+// peak of the profile, and the agents throttle them to the rest of it
+type LoadProfile struct {
+	Kind         LoadProfileKind `json:"kind"`
+	StartPercent float64         `json:"startPercent"`
+	EndPercent   float64         `json:"endPercent"`
+	// The ramp time, step time, sine period or burst interval
+	PeriodSeconds float64 `json:"periodSeconds"`
+	StepPercent   float64 `json:"stepPercent,omitempty"`
+	BurstSeconds  float64 `json:"burstSeconds,omitempty"`
+}
+
+// AnnotationKind is the type of an annotation on a test run
+type AnnotationKind string
+
+// AnnotationKindComment is a short remark on a test run
+const AnnotationKindComment AnnotationKind = "comment"
+
+// AnnotationKindNote is a longer note on a test run in markdown
+const AnnotationKindNote AnnotationKind = "note"
+
+// AnnotationKindVerdict is a judgement of the result of a test run, with the
+// reasoning behind it in the text
+const AnnotationKindVerdict AnnotationKind = "verdict"
+
+// AnnotationVerdict is the judgement of a verdict annotation
+type AnnotationVerdict string
+
+// The judgements a verdict annotation can make
+const (
+	AnnotationVerdictExpected           AnnotationVerdict = "expected"
+	AnnotationVerdictExpectedRegression AnnotationVerdict = "expected-regression"
+	AnnotationVerdictRegression         AnnotationVerdict = "regression"
+	AnnotationVerdictImprovement        AnnotationVerdict = "improvement"
+	AnnotationVerdictInvalid            AnnotationVerdict = "invalid"
+)
+
+// Annotation is a comment, note or verdict a user attached to a completed
+// test run, or to one of its plots if Plot is set
+type Annotation struct {
+	ID   string         `json:"id"`
+	Kind AnnotationKind `json:"kind"`
+	// The plot the annotation is on, as named in the plot API of the test run
+	Plot    string            `json:"plot,omitempty"`
+	Verdict AnnotationVerdict `json:"verdict,omitempty"`
+	// The comment, or markdown of notes and verdicts
+	Text           string    `json:"text"`
+	UserThumbprint string    `json:"userThumbprint"`
+	Created        time.Time `json:"created"`
+	Updated        time.Time `json:"updated"`
+}
+
+// CleanupResidue is what the teardown of a test run left on one of its agents
+type CleanupResidue struct {
+	AgentID int32 `json:"agentID"`
+	// The processes running in the environment of the test run, as
+	// "<pid> <name>"
+	Processes []string `json:"processes,omitempty"`
+	// The ports of the roles that are still in use
+	Ports []int `json:"ports,omitempty"`
+	// The directories that were not removed
+	Dirs []string `json:"dirs,omitempty"`
+	// Set if the residue was force-cleaned succesfully
+	Cleaned bool `json:"cleaned"`
+	// Set if the cleanup could not be verified
+	Error string `json:"error,omitempty"`
+}
+
+// AbortConditions make a test run abort automatically once it's clearly
+// broken, rather than having it run to the end. Conditions with a zero value
+// are disabled
+type AbortConditions struct {
+	// Abort if the throughput stays below MinThroughput (tx/s) for
+	// MinThroughputSeconds after the load generators started producing
+	// samples
+	MinThroughput        float64 `json:"minThroughput,omitempty"`
+	MinThroughputSeconds int     `json:"minThroughputSeconds,omitempty"`
+	// The number of crashes of each role that are tolerated. Crashed roles
+	// are not restarted, so the first crash of a role always aborts the test
+	// run, and only zero is accepted
+	MaxRoleCrashes int `json:"maxRoleCrashes,omitempty"`
+	// Abort if an agent of the test run is disconnected for this many seconds
+	AgentUnreachableSeconds int `json:"agentUnreachableSeconds,omitempty"`
+}
+
+// AbortCondition identifies the abort condition that aborted a test run
+type AbortCondition string
+
+// AbortConditionThroughput means the throughput stayed below the minimum
+const AbortConditionThroughput AbortCondition = "throughput"
+
+// AbortConditionRoleCrashes means a role crashed
+const AbortConditionRoleCrashes AbortCondition = "roleCrashes"
+
+// AbortConditionAgentUnreachable means an agent was disconnected for too long
+const AbortConditionAgentUnreachable AbortCondition = "agentUnreachable"
+
+// AbortTrigger records the abort condition that aborted a test run
+type AbortTrigger struct {
+	Condition AbortCondition `json:"condition"`
+	Reason    string         `json:"reason"`
+	Triggered time.Time      `json:"triggered"`
+	// The role or agent that triggered the condition, if any
+	Role    SystemRole `json:"role,omitempty"`
+	Index   int        `json:"roleIdx,omitempty"`
+	AgentID int32      `json:"agentID,omitempty"`
+}
+
+// FailureClass is the category of the cause of an unsuccessful test run, used
+// to tell systemic problems with the test infrastructure apart from problems
+// with the system under test
+type FailureClass string
+
+// FailureClassProvisioning means the agents of the test run could not be
+// launched or did not come online
+const FailureClassProvisioning FailureClass = "provisioning"
+
+// FailureClassBuild means the binaries of the system under test could not be
+// compiled or uploaded
+const FailureClassBuild FailureClass = "build"
+
+// FailureClassSeeding means the preseed data could not be generated or
+// deployed to the shards
+const FailureClassSeeding FailureClass = "seeding"
+
+// FailureClassConfiguration means the parameters of the test run are invalid
+const FailureClassConfiguration FailureClass = "configuration"
+
+// FailureClassSUTCrash means a role of the system under test exited
+// unexpectedly
+const FailureClassSUTCrash FailureClass = "sut-crash"
+
+// FailureClassDegraded means the throughput of the system under test stayed
+// below the minimum of the abort conditions of the test run
+const FailureClassDegraded FailureClass = "degraded"
+
+// FailureClassTimeout means a step of the test run took too long
+const FailureClassTimeout FailureClass = "timeout"
+
+// FailureClassUserAbort means the test run was terminated or canceled by a
+// user
+const FailureClassUserAbort FailureClass = "user-abort"
+
+// FailureClassPreempted means the test run was aborted to make room for a
+// test run of a higher priority
+const FailureClassPreempted FailureClass = "preempted"
+
+// FailureClassInfrastructure means the test infrastructure failed, such as
+// lost agents, S3 transfers or a coordinator restart
+const FailureClassInfrastructure FailureClass = "infrastructure"
+
+// FailureClassDependency means a test run the test run depended on did not
+// end with the required status, so it was skipped
+const FailureClassDependency FailureClass = "dependency"
+
+// FailureClassUnknown means the cause of the failure did not match any of the
+// classification rules
+const FailureClassUnknown FailureClass = "unknown"
 
 type TestResultPercentile struct {
 	Bucket float64 `json:"bucket"`
@@ -246,6 +849,124 @@ type TestResult struct {
 	LatencyMin         float64                `json:"latencyMin"`
 	LatencyMax         float64                `json:"latencyMax"`
 	LatencyPercentiles []TestResultPercentile `json:"latencyPercentiles"`
+
+	Provenance *TestResultProvenance `json:"provenance,omitempty"`
+	Failover   *FailoverResult       `json:"failover,omitempty"`
+	Queues     *QueueResult          `json:"queues,omitempty"`
+	// The intervals the test run was paused, which are excluded from the
+	// throughput
+	Pauses []PauseInterval `json:"pauses,omitempty"`
+	// The throughput around the faults injected into the test run
+	Faults []FaultImpact `json:"faults,omitempty"`
+	// The transaction latencies by the region of the load generators, for
+	// test runs spanning multiple regions
+	Regions []RegionResult `json:"regions,omitempty"`
+}
+
+// RegionResult contains the latencies of the transactions sent by the load
+// generators in a single AWS region. Latencies are in seconds
+type RegionResult struct {
+	Region         string  `json:"region"`
+	LoadGenerators int     `json:"loadGenerators"`
+	Transactions   int     `json:"transactions"`
+	LatencyAvg     float64 `json:"latencyAvg"`
+	LatencyMin     float64 `json:"latencyMin"`
+	LatencyMax     float64 `json:"latencyMax"`
+	LatencyP50     float64 `json:"latencyP50"`
+	LatencyP99     float64 `json:"latencyP99"`
+}
+
+// QueueResult contains the queue depths and blocked times reported by the
+// roles of the system under test, correlated with the dips in the system
+// throughput
+type QueueResult struct {
+	// Number of seconds in which the system throughput was below
+	// DipThreshold (tx/s)
+	Dips         int               `json:"dips"`
+	DipThreshold float64           `json:"dipThreshold"`
+	Roles        []QueueRoleResult `json:"roles"`
+}
+
+// QueueRoleResult contains the queue metrics of a single role
+type QueueRoleResult struct {
+	Role     SystemRole `json:"role"`
+	Index    int        `json:"roleIdx"`
+	DepthAvg float64    `json:"depthAvg"`
+	DepthMax float64    `json:"depthMax"`
+	// Seconds the role was blocked on its queue, in total and as a
+	// percentage of the sampled time
+	BlockedTime float64 `json:"blockedTime"`
+	BlockedPct  float64 `json:"blockedPct"`
+	// Average queue depth in the seconds the throughput dipped, and in the
+	// other seconds
+	DipDepthAvg    float64 `json:"dipDepthAvg"`
+	NormalDepthAvg float64 `json:"normalDepthAvg"`
+	// Pearson correlation between the queue depth and the system throughput
+	// per second, negative if the queue grows as the throughput drops
+	ThroughputCorrelation float64 `json:"throughputCorrelation"`
+}
+
+// FailoverResult contains the recovery times of the failovers of a test run,
+// or of all repetitions of a failover test run in a result matrix
+type FailoverResult struct {
+	Recoveries []FailoverRecovery `json:"recoveries"`
+	// Statistics over the recovery times (seconds) of the failovers the
+	// system recovered from
+	RecoveryAvg float64 `json:"recoveryAvg"`
+	RecoveryStd float64 `json:"recoveryStd"`
+	RecoveryMin float64 `json:"recoveryMin"`
+	RecoveryMax float64 `json:"recoveryMax"`
+	// Number of failovers the system didn't recover from before the next
+	// failover or the end of the test run
+	Unrecovered int `json:"unrecovered"`
+}
+
+// FailoverRecovery is the effect of a single failover on the system
+// throughput
+type FailoverRecovery struct {
+	Role   SystemRole `json:"role"`
+	Index  int        `json:"roleIdx"`
+	Killed time.Time  `json:"killed"`
+	// Average system throughput (tx/s) before the failover
+	Baseline float64 `json:"baseline"`
+	// Lowest system throughput (tx/s) after the failover
+	Minimum   float64 `json:"minimum"`
+	Recovered bool    `json:"recovered"`
+	// Seconds from the failover until the throughput is back at the
+	// recovery percentage of the baseline
+	RecoveryTime float64 `json:"recoveryTime"`
+}
+
+// TestResultProvenance records which versions of the controller and the
+// results pipeline produced a test result
+type TestResultProvenance struct {
+	// The commit hash of the controller that calculated the result
+	ControllerVersion string `json:"controllerVersion"`
+	// The version of the results schema (TestResultVersion)
+	ResultSchemaVersion int `json:"resultSchemaVersion"`
+	// The version of the results processing pipeline
+	PipelineVersion int `json:"pipelineVersion"`
+	// SHA-256 hash of the result calculation script that was used
+	PipelineScriptHash string    `json:"pipelineScriptHash"`
+	Calculated         time.Time `json:"calculated"`
+	// The provenance of earlier calculations of this result, oldest first.
+	// These are preserved when a result is re-processed
+	History []TestResultProvenance `json:"history,omitempty"`
+}
+
+// TestRunSummary is a short human-readable account of a test run, produced
+// once its execution has ended
+type TestRunSummary struct {
+	// The summary text, either produced by an external summarizer or
+	// assembled from the facts below
+	Text string `json:"text"`
+	// The summarizer that produced the text
+	Summarizer string             `json:"summarizer"`
+	Metrics    map[string]float64 `json:"metrics"`
+	Anomalies  []string           `json:"anomalies"`
+	Faults     []string           `json:"faults"`
+	Errors     []string           `json:"errors"`
+	Generated  time.Time          `json:"generated"`
 }
 
 type MatrixResult struct {
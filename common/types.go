@@ -20,6 +20,31 @@ type AgentSystemInfo struct {
 	NumCPU             int      `json:"numCPU"`
 	AWS                bool     `json:"aws"`
 	EC2InstanceID      string   `json:"ec2InstanceId"`
+	// The GPUs and other accelerators installed in the agent's system
+	Accelerators []AgentAccelerator `json:"accelerators"`
+	// Whether the agent's system has local NVMe storage (other than EBS)
+	NVMe bool `json:"nvme"`
+	// The region and availability zone the agent runs in, if known
+	Region           string `json:"region,omitempty"`
+	AvailabilityZone string `json:"availabilityZone,omitempty"`
+}
+
+// AcceleratorGPU is an NVIDIA GPU
+const AcceleratorGPU = "gpu"
+
+// AcceleratorNeuron is an AWS Inferentia or Trainium (Neuron) device
+const AcceleratorNeuron = "neuron"
+
+// AcceleratorFPGA is an AWS EC2 F1 FPGA
+const AcceleratorFPGA = "fpga"
+
+// AgentAccelerator is a single accelerator device of an agent
+type AgentAccelerator struct {
+	// One of the Accelerator* kinds
+	Kind  string `json:"kind"`
+	Model string `json:"model"`
+	// Memory of the device in MiB, if known
+	Memory int64 `json:"memory"`
 }
 
 type File struct {
@@ -38,6 +63,14 @@ func (a AgentSystemInfo) ToString() string {
 	fmt.Fprintf(&buf, format, "Operating System", a.OperatingSystem)
 	fmt.Fprintf(&buf, format, "Architecture", a.Architecture)
 	fmt.Fprintf(&buf, format, "Number of CPUs", a.NumCPU)
+	for i, acc := range a.Accelerators {
+		fmt.Fprintf(
+			&buf,
+			format,
+			fmt.Sprintf("Accelerator %d", i),
+			fmt.Sprintf("%s (%s, %d MiB)", acc.Model, acc.Kind, acc.Memory),
+		)
+	}
 	if a.AWS {
 		fmt.Fprintf(&buf, format, "Running in AWS", "Yes")
 		fmt.Fprintf(&buf, format, "EC2 Instance ID", a.EC2InstanceID)
@@ -0,0 +1,235 @@
+package coordinator
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+var ErrAgentPoolNotFound = errors.New("agent pool not found")
+var ErrAgentPoolExists = errors.New("agent pool already exists")
+var ErrInvalidAgentPool = errors.New("invalid agent pool")
+
+// agentPoolNameRegex is the format of the names of agent pools
+var agentPoolNameRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// AgentPool is a named group of static agents: agents running permanently on
+// lab hardware, that register themselves with the join token of the pool in
+// stead of being launched through the AWS manager. Roles of a test run can be
+// placed on a pool, in which case they run on its idle agents
+type AgentPool struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Created     time.Time `json:"created"`
+	// The thumbprint of the user that created the pool
+	CreatedBy string `json:"createdBy"`
+	// When the join token was last rotated, agents that joined before keep
+	// their place in the pool
+	TokenRotated time.Time `json:"tokenRotated"`
+	// The SHA-256 hash of the join token
+	JoinTokenHash string `json:"joinTokenHash"`
+}
+
+// AgentPoolInfo is an agent pool along with its connected agents
+type AgentPoolInfo struct {
+	AgentPool
+	// The IDs of the connected agents in the pool
+	Agents []int32 `json:"agents"`
+}
+
+// JoinTokenAuthenticator is an EnrollmentAuthenticator that accepts the join
+// tokens of the agent pools. Only the SHA-256 hashes of the tokens are kept,
+// and the pools are persisted such that static agents can still join after
+// the coordinator restarts
+type JoinTokenAuthenticator struct {
+	pools     map[string]*AgentPool
+	poolsLock sync.Mutex
+}
+
+// agentPoolsPath returns the path of the file the agent pools are persisted
+// in
+func agentPoolsPath() string {
+	return filepath.Join(common.DataDir(), "agent-pools.json")
+}
+
+// NewJoinTokenAuthenticator creates a new JoinTokenAuthenticator and loads the
+// persisted agent pools
+func NewJoinTokenAuthenticator() *JoinTokenAuthenticator {
+	j := &JoinTokenAuthenticator{
+		pools:     map[string]*AgentPool{},
+		poolsLock: sync.Mutex{},
+	}
+	f, err := os.Open(agentPoolsPath())
+	if err == nil {
+		defer f.Close()
+		err = json.NewDecoder(f).Decode(&j.pools)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		logging.Warnf("Unable to load agent pools: %v", err)
+	}
+	return j
+}
+
+// Method implements EnrollmentAuthenticator
+func (j *JoinTokenAuthenticator) Method() string {
+	return common.EnrollmentMethodJoinToken
+}
+
+// Authenticate implements EnrollmentAuthenticator
+func (j *JoinTokenAuthenticator) Authenticate(
+	credential []byte,
+	remoteAddr net.Addr,
+) error {
+	_, err := j.poolForToken(credential)
+	return err
+}
+
+// poolForToken returns the name of the agent pool the join token belongs to
+func (j *JoinTokenAuthenticator) poolForToken(
+	credential []byte,
+) (string, error) {
+	j.poolsLock.Lock()
+	defer j.poolsLock.Unlock()
+	h := hashAgentCredential(credential)
+	for _, p := range j.pools {
+		if p.JoinTokenHash == h {
+			return p.Name, nil
+		}
+	}
+	return "", errors.New("unknown or rotated join token")
+}
+
+// persist writes the agent pools to disk. Expects the caller to hold poolsLock
+func (j *JoinTokenAuthenticator) persist() error {
+	f, err := os.OpenFile(
+		agentPoolsPath(),
+		os.O_CREATE|os.O_WRONLY|os.O_TRUNC,
+		0600,
+	)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(j.pools)
+}
+
+// newJoinToken generates a new join token for the pool, replacing its current
+// one. Expects the caller to hold poolsLock
+func (j *JoinTokenAuthenticator) newJoinToken(p *AgentPool) (string, error) {
+	token, err := common.RandomID(32)
+	if err != nil {
+		return "", err
+	}
+	p.JoinTokenHash = hashAgentCredential([]byte(token))
+	p.TokenRotated = time.Now()
+	return token, j.persist()
+}
+
+// AgentPools returns the agent pools, sorted by name, along with the agents
+// connected to each of them
+func (c *Coordinator) AgentPools() []AgentPoolInfo {
+	c.agentPools.poolsLock.Lock()
+	ret := make([]AgentPoolInfo, 0, len(c.agentPools.pools))
+	for _, p := range c.agentPools.pools {
+		info := AgentPoolInfo{AgentPool: *p, Agents: []int32{}}
+		info.JoinTokenHash = ""
+		ret = append(ret, info)
+	}
+	c.agentPools.poolsLock.Unlock()
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	c.identitiesLock.Lock()
+	defer c.identitiesLock.Unlock()
+	for _, a := range c.GetAgents() {
+		for i := range ret {
+			if a.Pool == ret[i].Name {
+				ret[i].Agents = append(ret[i].Agents, a.ID)
+			}
+		}
+	}
+	return ret
+}
+
+// AgentPoolExists returns whether an agent pool with the given name exists
+func (c *Coordinator) AgentPoolExists(name string) bool {
+	c.agentPools.poolsLock.Lock()
+	defer c.agentPools.poolsLock.Unlock()
+	_, ok := c.agentPools.pools[name]
+	return ok
+}
+
+// CreateAgentPool creates a new agent pool and returns it along with its join
+// token. The token is only returned here, the coordinator only keeps its
+// hash
+func (c *Coordinator) CreateAgentPool(p AgentPool) (AgentPool, string, error) {
+	if !agentPoolNameRegex.MatchString(p.Name) {
+		return p, "", ErrInvalidAgentPool
+	}
+	c.agentPools.poolsLock.Lock()
+	defer c.agentPools.poolsLock.Unlock()
+	if _, ok := c.agentPools.pools[p.Name]; ok {
+		return p, "", ErrAgentPoolExists
+	}
+	p.Created = time.Now()
+	c.agentPools.pools[p.Name] = &p
+	token, err := c.agentPools.newJoinToken(&p)
+	if err != nil {
+		delete(c.agentPools.pools, p.Name)
+		return p, "", err
+	}
+	ret := p
+	ret.JoinTokenHash = ""
+	return ret, token, nil
+}
+
+// RotateJoinToken replaces the join token of the agent pool and returns the
+// new one. Agents that already joined the pool keep their place in it, since
+// they resume their sessions with their persistent identity
+func (c *Coordinator) RotateJoinToken(name string) (string, error) {
+	c.agentPools.poolsLock.Lock()
+	defer c.agentPools.poolsLock.Unlock()
+	p, ok := c.agentPools.pools[name]
+	if !ok {
+		return "", ErrAgentPoolNotFound
+	}
+	return c.agentPools.newJoinToken(p)
+}
+
+// DeleteAgentPool removes the agent pool. Its agents stay connected, but are
+// no longer part of a pool and can't join again with its join token
+func (c *Coordinator) DeleteAgentPool(name string) error {
+	c.agentPools.poolsLock.Lock()
+	if _, ok := c.agentPools.pools[name]; !ok {
+		c.agentPools.poolsLock.Unlock()
+		return ErrAgentPoolNotFound
+	}
+	delete(c.agentPools.pools, name)
+	err := c.agentPools.persist()
+	c.agentPools.poolsLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// The pools of the agents are assigned along with their identities
+	c.identitiesLock.Lock()
+	defer c.identitiesLock.Unlock()
+	for _, a := range c.GetAgents() {
+		if a.Pool == name {
+			a.Pool = ""
+		}
+	}
+	for _, id := range c.identities {
+		if id.Pool == name {
+			id.Pool = ""
+		}
+	}
+	return c.persistAgentIdentities()
+}
@@ -15,6 +15,13 @@ type AgentsManager struct {
 	src            *sources.SourcesManager
 	ev             chan coordinator.Event
 	commandDetails sync.Map
+	// The chunked file transfers that are running or finished recently, by
+	// their ID
+	transfers     map[string]*FileTransfer
+	transfersLock sync.Mutex
+	// The debug sessions admins opened on agents, by their ID
+	debugSessions     map[string]*DebugSession
+	debugSessionsLock sync.Mutex
 }
 
 // NewAgentsManager creates a new AgentsManager
@@ -23,12 +30,19 @@ func NewAgentsManager(
 	src *sources.SourcesManager,
 	ev chan coordinator.Event,
 ) (*AgentsManager, error) {
-	return &AgentsManager{
+	am := &AgentsManager{
 		coord:          c,
 		src:            src,
 		commandDetails: sync.Map{},
 		ev:             ev,
-	}, nil
+		transfers:      map[string]*FileTransfer{},
+		debugSessions:  map[string]*DebugSession{},
+	}
+	err := am.loadDebugSessions()
+	if err != nil {
+		return nil, err
+	}
+	return am, nil
 }
 
 // QueryAgentWithTimeout is a utility function to do a single request-response
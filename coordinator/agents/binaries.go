@@ -1,56 +1,184 @@
 package agents
 
 import (
+	"crypto/rand"
+	"errors"
 	"fmt"
 	"os"
 	"time"
 
+	"github.com/mit-dci/opencbdc-tctl/common"
 	"github.com/mit-dci/opencbdc-tctl/wire"
 )
 
 // PrepareAgentWithBinariesForCommit is a convenience method that instructs
 // the given agent to create a new environment, and then download the binaries
-// specified by the binariesInS3 parameter into that environment and unpack it
+// specified by the binariesInS3 parameter into that environment and unpack it.
+// If presignedURL is set, the agent downloads the binaries with it in stead of
+// its own S3 credentials. If checksums are given, the agent verifies the
+// archive against them before unpacking it. If progress is not nil, it is
+// called with the progress updates the agent sends while downloading,
+// verifying and unpacking the binaries
 func (am *AgentsManager) PrepareAgentWithBinariesForCommit(
 	agentID int32,
 	binariesInS3 string,
+	presignedURL string,
+	checksums *common.ArchiveChecksums,
+	progress func(*wire.TransferProgressMsg),
 ) ([]byte, error) {
-	msg, err := am.QueryAgent(agentID, &wire.PrepareEnvironmentRequestMsg{})
+	envID, err := am.PrepareAgentEnvironment(agentID)
 	if err != nil {
 		return nil, err
 	}
-	rep, ok := msg.(*wire.PrepareEnvironmentReplyMsg)
+
+	req := &wire.DeployFileFromS3RequestMsg{
+		EnvironmentID: envID,
+		SourceRegion:  os.Getenv("AWS_DEFAULT_REGION"),
+		SourceBucket:  os.Getenv("BINARIES_S3_BUCKET"),
+		SourcePath:    binariesInS3,
+		TargetPath:    "sources/build.tar.gz",
+		Unpack:        true,
+		FlatUnpack:    false,
+		UnpackNoDir:   false,
+		PresignedURL:  presignedURL,
+	}
+	if checksums != nil {
+		req.SHA256 = checksums.SHA256
+		req.Signature = checksums.Signature
+	}
+	if progress != nil {
+		req.TransferID = make([]byte, 16)
+		_, err = rand.Read(req.TransferID)
+		if err != nil {
+			return nil, err
+		}
+		rc := make(chan wire.Msg, 100)
+		err = am.coord.RegisterTransferProgressCallback(
+			agentID,
+			req.TransferID,
+			rc,
+		)
+		if err != nil {
+			return nil, err
+		}
+		stop := make(chan bool)
+		defer close(stop)
+		go func() {
+			for {
+				select {
+				case <-stop:
+					return
+				case msg := <-rc:
+					p, ok := msg.(*wire.TransferProgressMsg)
+					if !ok {
+						continue
+					}
+					progress(p)
+					if p.Phase == wire.TransferPhaseDone ||
+						p.Phase == wire.TransferPhaseFailed {
+						return
+					}
+				}
+			}
+		}()
+	}
+	msg, err := am.QueryAgentWithTimeout(agentID, req, time.Minute*3)
+	if err != nil {
+		return nil, err
+	}
+	rep2, ok := msg.(*wire.DeployFileFromS3ResponseMsg)
 	if !ok {
 		return nil, fmt.Errorf(
-			"expected PrepareEnvironmentReplyMsg, got %T",
-			rep,
+			"expected DeployFileFromS3ResponseMsg, got %T",
+			rep2,
 		)
 	}
 
-	msg, err = am.QueryAgentWithTimeout(
+	return envID, err
+}
+
+// PrepareAgentWithBinariesOverWire does the same as
+// PrepareAgentWithBinariesForCommit, but sends the binaries archive at
+// localArchive to the agent over its connection to the coordinator in stead
+// of having the agent download it from S3
+func (am *AgentsManager) PrepareAgentWithBinariesOverWire(
+	agentID int32,
+	localArchive string,
+	checksums *common.ArchiveChecksums,
+	progress func(*wire.TransferProgressMsg),
+) ([]byte, error) {
+	envID, err := am.PrepareAgentEnvironment(agentID)
+	if err != nil {
+		return nil, err
+	}
+	err = am.SendFile(
 		agentID,
-		&wire.DeployFileFromS3RequestMsg{
-			EnvironmentID: rep.EnvironmentID,
-			SourceRegion:  os.Getenv("AWS_DEFAULT_REGION"),
-			SourceBucket:  os.Getenv("BINARIES_S3_BUCKET"),
-			SourcePath:    binariesInS3,
-			TargetPath:    "sources/build.tar.gz",
-			Unpack:        true,
-			FlatUnpack:    false,
-			UnpackNoDir:   false,
+		envID,
+		localArchive,
+		"sources/build.tar.gz",
+		SendFileOptions{
+			Unpack:    true,
+			Checksums: checksums,
+			Progress:  progress,
 		},
-		time.Minute*3,
 	)
 	if err != nil {
 		return nil, err
 	}
-	rep2, ok := msg.(*wire.DeployFileFromS3ResponseMsg)
+	return envID, nil
+}
+
+// PrepareAgentEnvironment creates an empty environment directory on the agent
+// and returns its ID
+func (am *AgentsManager) PrepareAgentEnvironment(agentID int32) ([]byte, error) {
+	msg, err := am.QueryAgent(agentID, &wire.PrepareEnvironmentRequestMsg{})
+	if err != nil {
+		return nil, err
+	}
+	rep, ok := msg.(*wire.PrepareEnvironmentReplyMsg)
 	if !ok {
 		return nil, fmt.Errorf(
-			"expected DeployFileFromS3ResponseMsg, got %T",
-			rep2,
+			"expected PrepareEnvironmentReplyMsg, got %T",
+			rep,
 		)
 	}
+	return rep.EnvironmentID, nil
+}
 
-	return rep.EnvironmentID, err
+// DestroyEnvironment removes the environment directory with the given ID from
+// the agent
+func (am *AgentsManager) DestroyEnvironment(
+	agentID int32,
+	environmentID []byte,
+) error {
+	msg, err := am.QueryAgent(agentID, &wire.DestroyEnvironmentMsg{
+		EnvironmentID: environmentID,
+	})
+	if err != nil {
+		return err
+	}
+	if _, ok := msg.(*wire.AckMsg); !ok {
+		return fmt.Errorf("expected AckMsg, got %T", msg)
+	}
+	return nil
+}
+
+// UpdateAgentBinary instructs the agent to replace its own binary with the
+// given version from S3, after which it restarts and reconnects as a new
+// agent. Returns once the agent acknowledged the update
+func (am *AgentsManager) UpdateAgentBinary(
+	agentID int32,
+	req *wire.AgentUpdateRequestMsg,
+) error {
+	msg, err := am.QueryAgentWithTimeout(agentID, req, time.Minute*3)
+	if err != nil {
+		return err
+	}
+	if errMsg, ok := msg.(*wire.ErrorMsg); ok {
+		return errors.New(errMsg.Error)
+	}
+	if _, ok := msg.(*wire.AckMsg); !ok {
+		return fmt.Errorf("expected AckMsg, got %T", msg)
+	}
+	return nil
 }
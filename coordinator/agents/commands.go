@@ -28,68 +28,103 @@ func (am *AgentsManager) RunningCommandsForAgent(
 	return retVal
 }
 
-// ExecuteCommand will execute a command on the agent specified by the agentID.
-// It will run the command specified in `command`, with the parameters and
-// environment variables specified by the `params` and `env` arguments. It will
-// execute the command in the environment specified by `environmentID`.
-// The working directory will be set to the `dir` parameter, which is relative
-// to the root of the enviroment's working directory. `timeout` indicates how
-// long the command should be allowed to run (in seconds). `wait` indicates if
-// the function call should block until the command is completed. `profile`
-// determines if we gather system performance metrics while running the command.
-// `perfProfile` determines if we run `perf` performance profiling on the
-// process and `perfSampleRate` the samples per second that we have `perf`
-// gather. `debug` determines if we run the command in gdb for debugging.
-// `commandResults` is a channel where we are supposed to report the command's
-// results once the agent has completed it.
+// CommandRunning returns true if the command has not been reported finished
+// by its agent yet
+func (am *AgentsManager) CommandRunning(commandID []byte) bool {
+	_, ok := am.commandDetails.Load(fmt.Sprintf("%x", commandID))
+	return ok
+}
+
+// ExecuteCommandOptions describe the command ExecuteCommand runs on an agent
+type ExecuteCommandOptions struct {
+	// The command to run, with its parameters and environment variables
+	Command string
+	Params  []string
+	Env     []string
+	// The environment to run the command in, and the working directory
+	// relative to the root of the environment's working directory
+	EnvironmentID []byte
+	Dir           string
+	// How long the command is allowed to run (in seconds)
+	Timeout int
+	// The channel the results of the command are reported on once the agent
+	// has completed it
+	Results chan *common.ExecutedCommand
+	// Block until the command is completed
+	Wait bool
+	// Gather system performance metrics while running the command
+	Profile bool
+	// Run `perf` performance profiling on the process, gathering
+	// PerfSampleRate samples per second
+	Perf           bool
+	PerfSampleRate int
+	// Run the command in gdb for debugging
+	Debug bool
+	// Record the network traffic of the command
+	RecordNetwork bool
+	// Run the command inside this container image, in which case the
+	// digest-pinned reference of the image the agent used is returned
+	// alongside the command ID
+	ContainerImage string
+	// Rotate the standard output and error of the command once they exceed
+	// LogRotateBytes, keeping LogRotateKeep rotated files
+	LogRotateBytes int64
+	LogRotateKeep  int
+	// The resource limits the agent enforces on the command, if set
+	Limits *common.ResourceLimits
+}
+
+// ExecuteCommand will execute a command on the agent specified by the agentID,
+// as described by the options. It returns the ID under which the agent runs
+// the command, and the digest-pinned reference of its container image if it
+// runs in one
 func (am *AgentsManager) ExecuteCommand(
 	agentID int32,
-	command string,
-	params, env []string,
-	environmentID []byte,
-	dir string,
-	timeout int,
-	commandResults chan *common.ExecutedCommand,
-	wait bool,
-	profile bool,
-	perf bool,
-	perfSampleRate int,
-	debug bool,
-	recordNetwork bool,
-) ([]byte, error) {
+	opts ExecuteCommandOptions,
+) ([]byte, string, error) {
+	limits := opts.Limits
+	if limits == nil {
+		limits = &common.ResourceLimits{}
+	}
 
 	// Send the ExecuteCommandRequestMsg to the agent and get its
 	// reply
 	msg, err := am.QueryAgent(agentID, &wire.ExecuteCommandRequestMsg{
-		EnvironmentID:        environmentID,
-		Dir:                  dir,
-		Env:                  env,
-		Command:              command,
-		Parameters:           params,
-		Profile:              profile,
-		PerfProfile:          perf,
-		PerfSampleRate:       perfSampleRate,
-		Debug:                debug,
+		EnvironmentID:        opts.EnvironmentID,
+		Dir:                  opts.Dir,
+		Env:                  opts.Env,
+		Command:              opts.Command,
+		Parameters:           opts.Params,
+		Profile:              opts.Profile,
+		PerfProfile:          opts.Perf,
+		PerfSampleRate:       opts.PerfSampleRate,
+		Debug:                opts.Debug,
 		S3OutputRegion:       os.Getenv("AWS_REGION"),
 		S3OutputBucket:       os.Getenv("OUTPUTS_S3_BUCKET"),
-		RecordNetworkTraffic: recordNetwork,
+		RecordNetworkTraffic: opts.RecordNetwork,
+		ContainerImage:       opts.ContainerImage,
+		LogRotateBytes:       opts.LogRotateBytes,
+		LogRotateKeep:        opts.LogRotateKeep,
+		CgroupCPUs:           limits.CPUs,
+		CgroupMemoryMiB:      limits.MemoryMiB,
+		CgroupIOWeight:       limits.IOWeight,
 	})
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	// Check if the reply is of the valid type and that it was successful
 	rep, ok := msg.(*wire.ExecuteCommandResponseMsg)
 	if !ok {
-		return nil, fmt.Errorf(
+		return nil, "", fmt.Errorf(
 			"expected ExecuteCommandResponseMsg, got %T",
 			rep,
 		)
 	}
 	if !rep.Success {
-		return nil, fmt.Errorf(
+		return nil, "", fmt.Errorf(
 			"error starting command %s script: %s",
-			command,
+			opts.Command,
 			rep.Error,
 		)
 	}
@@ -101,19 +136,19 @@ func (am *AgentsManager) ExecuteCommand(
 	details := coordinator.AgentCommandRunningPayload{
 		AgentID:     agentID,
 		CommandID:   cmdIDStr,
-		Command:     command,
-		Params:      params,
-		Environment: env,
+		Command:     opts.Command,
+		Params:      opts.Params,
+		Environment: opts.Env,
 		Started:     time.Now(),
 	}
 	am.commandDetails.Store(cmdIDStr, details)
 
-	if wait { // Wait inline for the command to complete
-		return rep.CommandID, am.waitForCommandFinish(
+	if opts.Wait { // Wait inline for the command to complete
+		return rep.CommandID, rep.ImageDigest, am.waitForCommandFinish(
 			agentID,
 			rep.CommandID,
-			timeout,
-			commandResults,
+			opts.Timeout,
+			opts.Results,
 		)
 	}
 
@@ -124,8 +159,8 @@ func (am *AgentsManager) ExecuteCommand(
 		err := am.waitForCommandFinish(
 			agentID,
 			rep.CommandID,
-			timeout,
-			commandResults,
+			opts.Timeout,
+			opts.Results,
 		)
 		if err != nil {
 			logging.Warnf(
@@ -136,7 +171,7 @@ func (am *AgentsManager) ExecuteCommand(
 			)
 		}
 	}()
-	return rep.CommandID, nil
+	return rep.CommandID, rep.ImageDigest, nil
 }
 
 // waitForCommandFinish will register a callback with the coordinator to receive
@@ -227,6 +262,70 @@ func (am *AgentsManager) BreakCommand(agentID int32, commandID []byte) error {
 	return nil
 }
 
+// SuspendCommand instructs the agent to suspend the command with the given ID,
+// or to resume it if resume is set
+func (am *AgentsManager) SuspendCommand(
+	agentID int32,
+	commandID []byte,
+	resume bool,
+) error {
+	msg, err := am.QueryAgentWithTimeout(
+		agentID,
+		&wire.SuspendCommandRequestMsg{
+			CommandID: commandID,
+			Resume:    resume,
+		},
+		time.Minute,
+	)
+	if err != nil {
+		return err
+	}
+	_, ok := msg.(*wire.AckMsg)
+	if !ok {
+		errMsg, ok := msg.(*wire.ErrorMsg)
+		if ok {
+			return errors.New(errMsg.Error)
+		}
+		return common.ErrWrongMessageType
+	}
+	return nil
+}
+
+// SetLoadProfile instructs the agent to throttle the command with the given
+// ID to a load profile, given as the fractions of its configured rate at the
+// offsets in milliseconds from the start of the profile. The profile is
+// continued from the elapsed time in milliseconds
+func (am *AgentsManager) SetLoadProfile(
+	agentID int32,
+	commandID []byte,
+	elapsedMs int64,
+	offsetsMs []int64,
+	fractions []float64,
+) error {
+	msg, err := am.QueryAgentWithTimeout(
+		agentID,
+		&wire.LoadProfileRequestMsg{
+			CommandID: commandID,
+			ElapsedMs: elapsedMs,
+			OffsetsMs: offsetsMs,
+			Fractions: fractions,
+		},
+		time.Minute,
+	)
+	if err != nil {
+		return err
+	}
+	_, ok := msg.(*wire.AckMsg)
+	if !ok {
+		errMsg, ok := msg.(*wire.ErrorMsg)
+		if ok {
+			return errors.New(errMsg.Error)
+		}
+		return common.ErrWrongMessageType
+	}
+	return nil
+}
+
 // TerminateCommand will instruct the agent to terminate the given command by
 // sending it a os.Kill signal
 func (am *AgentsManager) TerminateCommand(
@@ -253,3 +352,137 @@ func (am *AgentsManager) TerminateCommand(
 	}
 	return nil
 }
+
+// InjectFault instructs the agent to inject the fault described by msg into
+// its network or disk, or to revert it if msg.Revert is set
+func (am *AgentsManager) InjectFault(
+	agentID int32,
+	msg *wire.InjectFaultRequestMsg,
+) error {
+	reply, err := am.QueryAgentWithTimeout(agentID, msg, time.Minute)
+	if err != nil {
+		return err
+	}
+	_, ok := reply.(*wire.AckMsg)
+	if !ok {
+		errMsg, ok := reply.(*wire.ErrorMsg)
+		if ok {
+			return errors.New(errMsg.Error)
+		}
+		return common.ErrWrongMessageType
+	}
+	return nil
+}
+
+// MatchCommandOutput asks the agent whether a line of the standard output or
+// error of the command matches the regular expression
+func (am *AgentsManager) MatchCommandOutput(
+	agentID int32,
+	environmentID []byte,
+	commandID []byte,
+	pattern string,
+) (bool, error) {
+	msg, err := am.QueryAgent(agentID, &wire.MatchOutputRequestMsg{
+		EnvironmentID: environmentID,
+		CommandID:     commandID,
+		Pattern:       pattern,
+	})
+	if err != nil {
+		return false, err
+	}
+	rep, ok := msg.(*wire.MatchOutputResponseMsg)
+	if !ok {
+		errMsg, ok := msg.(*wire.ErrorMsg)
+		if ok {
+			return false, errors.New(errMsg.Error)
+		}
+		return false, common.ErrWrongMessageType
+	}
+	return rep.Matched, nil
+}
+
+// ReadLiveSamples asks the agent for the transaction samples appended to the
+// sample file since the given offset, aggregated per second. Returns the
+// offset to continue reading from
+func (am *AgentsManager) ReadLiveSamples(
+	agentID int32,
+	environmentID []byte,
+	sourcePath string,
+	offset int64,
+) ([]wire.SampleBucket, int64, error) {
+	msg, err := am.QueryAgent(agentID, &wire.LiveSamplesRequestMsg{
+		EnvironmentID: environmentID,
+		SourcePath:    sourcePath,
+		Offset:        offset,
+	})
+	if err != nil {
+		return nil, offset, err
+	}
+	rep, ok := msg.(*wire.LiveSamplesResponseMsg)
+	if !ok {
+		errMsg, ok := msg.(*wire.ErrorMsg)
+		if ok {
+			return nil, offset, errors.New(errMsg.Error)
+		}
+		return nil, offset, common.ErrWrongMessageType
+	}
+	return rep.Buckets, rep.Offset, nil
+}
+
+// VerifyCleanup asks the agent for the residue the teardown of a test run left
+// in the environment: processes, ports in use from the given list and the
+// environment directory. If force is set, the agent cleans the residue
+func (am *AgentsManager) VerifyCleanup(
+	agentID int32,
+	environmentID []byte,
+	ports []int,
+	force bool,
+) (*wire.VerifyCleanupResponseMsg, error) {
+	msg, err := am.QueryAgentWithTimeout(agentID, &wire.VerifyCleanupRequestMsg{
+		EnvironmentID: environmentID,
+		Ports:         ports,
+		Force:         force,
+	}, time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	rep, ok := msg.(*wire.VerifyCleanupResponseMsg)
+	if !ok {
+		errMsg, ok := msg.(*wire.ErrorMsg)
+		if ok {
+			return nil, errors.New(errMsg.Error)
+		}
+		return nil, common.ErrWrongMessageType
+	}
+	return rep, nil
+}
+
+// ResetEnvironment cleans the environment for the next test run to reuse it:
+// the agent kills the processes left in it, verifies the given ports are
+// released and removes the given paths (relative to the environment) from it
+func (am *AgentsManager) ResetEnvironment(
+	agentID int32,
+	environmentID []byte,
+	ports []int,
+	removePaths []string,
+) (*wire.VerifyCleanupResponseMsg, error) {
+	msg, err := am.QueryAgentWithTimeout(agentID, &wire.VerifyCleanupRequestMsg{
+		EnvironmentID: environmentID,
+		Ports:         ports,
+		Force:         true,
+		Keep:          true,
+		RemovePaths:   removePaths,
+	}, time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	rep, ok := msg.(*wire.VerifyCleanupResponseMsg)
+	if !ok {
+		errMsg, ok := msg.(*wire.ErrorMsg)
+		if ok {
+			return nil, errors.New(errMsg.Error)
+		}
+		return nil, common.ErrWrongMessageType
+	}
+	return rep, nil
+}
@@ -0,0 +1,375 @@
+package agents
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/coordinator"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+	"github.com/mit-dci/opencbdc-tctl/wire"
+)
+
+// debugSessionIdleTimeout is the time after which a debug session nobody ran
+// a command in is closed
+const debugSessionIdleTimeout = 30 * time.Minute
+
+// debugExecTimeout is the time a debug command may run on the agent
+const debugExecTimeout = time.Minute
+
+// ErrDebugSessionNotFound is returned when a debug session does not exist
+var ErrDebugSessionNotFound = errors.New("debug session not found")
+
+// ErrDebugSessionClosed is returned when running a command in a debug
+// session that was closed
+var ErrDebugSessionClosed = errors.New("debug session is closed")
+
+// DebugSession is an admin running diagnostic commands on an agent, for
+// instance to find out why a test run is stuck. All commands and their output
+// are recorded in the session, which is kept after it's closed
+type DebugSession struct {
+	ID      string `json:"id"`
+	AgentID int32  `json:"agentID"`
+	// The thumbprint of the admin that opened the session
+	Admin  string     `json:"admin"`
+	Reason string     `json:"reason"`
+	Opened time.Time  `json:"opened"`
+	Closed *time.Time `json:"closed,omitempty"`
+	// The directory commands are run in. Relative paths are relative to the
+	// data directory of the agent
+	Dir          string            `json:"dir"`
+	LastActivity time.Time         `json:"lastActivity"`
+	Commands     []DebugCommandRun `json:"commands"`
+}
+
+// DebugCommandRun is a command that was run in a debug session
+type DebugCommandRun struct {
+	Time time.Time `json:"time"`
+	// The thumbprint of the admin that ran the command
+	Admin     string `json:"admin"`
+	Command   string `json:"command"`
+	Dir       string `json:"dir"`
+	ExitCode  int    `json:"exitCode"`
+	Stdout    string `json:"stdout"`
+	Stderr    string `json:"stderr"`
+	Truncated bool   `json:"truncated,omitempty"`
+	TimedOut  bool   `json:"timedOut,omitempty"`
+	Error     string `json:"error,omitempty"`
+	// How long the command took, including the round trip to the agent
+	DurationMs int64 `json:"durationMs"`
+}
+
+// debugSessionsDir returns the directory debug sessions are persisted in
+func debugSessionsDir() string {
+	return filepath.Join(common.DataDir(), "debugsessions")
+}
+
+// loadDebugSessions reads the debug sessions from disk. Sessions that were
+// open when the coordinator stopped are closed, since the admin has to open a
+// new one anyway
+func (am *AgentsManager) loadDebugSessions() error {
+	files, err := ioutil.ReadDir(debugSessionsDir())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	am.debugSessionsLock.Lock()
+	defer am.debugSessionsLock.Unlock()
+	for _, f := range files {
+		if filepath.Ext(f.Name()) != ".json" {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(debugSessionsDir(), f.Name()))
+		if err != nil {
+			return err
+		}
+		s := &DebugSession{}
+		err = json.Unmarshal(b, s)
+		if err != nil {
+			return err
+		}
+		am.debugSessions[s.ID] = s
+		if s.Closed == nil {
+			closed := s.LastActivity
+			s.Closed = &closed
+			err = am.persistDebugSession(s)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// persistDebugSession writes the debug session to disk. Must be called with
+// debugSessionsLock held
+func (am *AgentsManager) persistDebugSession(s *DebugSession) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(debugSessionsDir(), 0700)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(
+		filepath.Join(debugSessionsDir(), fmt.Sprintf("%s.json", s.ID)),
+		b,
+		0600,
+	)
+}
+
+// copyDebugSession returns a copy of the session that can be used without
+// holding debugSessionsLock
+func copyDebugSession(s *DebugSession) DebugSession {
+	ret := *s
+	ret.Commands = append([]DebugCommandRun{}, s.Commands...)
+	return ret
+}
+
+// expireDebugSession closes the session if it was idle for too long. Must be
+// called with debugSessionsLock held
+func (am *AgentsManager) expireDebugSession(s *DebugSession) {
+	if s.Closed != nil ||
+		time.Since(s.LastActivity) < debugSessionIdleTimeout {
+		return
+	}
+	closed := s.LastActivity.Add(debugSessionIdleTimeout)
+	s.Closed = &closed
+	err := am.persistDebugSession(s)
+	if err != nil {
+		logging.Warnf("Unable to persist debug session %s: %v", s.ID, err)
+	}
+	am.coord.Audit(coordinator.AuditEntry{
+		Actor:   s.Admin,
+		Action:  "agent-debug-session-expired",
+		Details: fmt.Sprintf("agent %d, session %s", s.AgentID, s.ID),
+	})
+}
+
+// OpenDebugSession opens a debug session on the agent for the admin with the
+// given thumbprint. The reason is recorded in the audit log
+func (am *AgentsManager) OpenDebugSession(
+	agentID int32,
+	admin string,
+	reason string,
+) (DebugSession, error) {
+	if strings.TrimSpace(reason) == "" {
+		return DebugSession{}, errors.New(
+			"A reason for the debug session is required",
+		)
+	}
+	_, err := am.coord.GetAgent(agentID)
+	if err != nil {
+		return DebugSession{}, err
+	}
+	id, err := common.RandomID(16)
+	if err != nil {
+		return DebugSession{}, err
+	}
+	s := &DebugSession{
+		ID:           id,
+		AgentID:      agentID,
+		Admin:        admin,
+		Reason:       reason,
+		Opened:       time.Now(),
+		LastActivity: time.Now(),
+		Commands:     []DebugCommandRun{},
+	}
+	am.debugSessionsLock.Lock()
+	defer am.debugSessionsLock.Unlock()
+	am.debugSessions[id] = s
+	err = am.persistDebugSession(s)
+	if err != nil {
+		return DebugSession{}, err
+	}
+	am.coord.Audit(coordinator.AuditEntry{
+		Actor:  admin,
+		Action: "agent-debug-session-opened",
+		Details: fmt.Sprintf(
+			"agent %d, session %s: %s",
+			agentID,
+			id,
+			reason,
+		),
+	})
+	return copyDebugSession(s), nil
+}
+
+// CloseDebugSession closes the debug session
+func (am *AgentsManager) CloseDebugSession(sessionID, admin string) error {
+	am.debugSessionsLock.Lock()
+	defer am.debugSessionsLock.Unlock()
+	s, ok := am.debugSessions[sessionID]
+	if !ok {
+		return ErrDebugSessionNotFound
+	}
+	am.expireDebugSession(s)
+	if s.Closed != nil {
+		return nil
+	}
+	closed := time.Now()
+	s.Closed = &closed
+	am.coord.Audit(coordinator.AuditEntry{
+		Actor:   admin,
+		Action:  "agent-debug-session-closed",
+		Details: fmt.Sprintf("agent %d, session %s", s.AgentID, s.ID),
+	})
+	return am.persistDebugSession(s)
+}
+
+// DebugSessions returns all debug sessions, the most recently opened first.
+// The commands run in them are left out
+func (am *AgentsManager) DebugSessions() []DebugSession {
+	am.debugSessionsLock.Lock()
+	ret := make([]DebugSession, 0, len(am.debugSessions))
+	for _, s := range am.debugSessions {
+		am.expireDebugSession(s)
+		c := *s
+		c.Commands = nil
+		ret = append(ret, c)
+	}
+	am.debugSessionsLock.Unlock()
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Opened.After(ret[j].Opened)
+	})
+	return ret
+}
+
+// GetDebugSession returns the debug session with the given ID, including the
+// commands run in it
+func (am *AgentsManager) GetDebugSession(sessionID string) (DebugSession, error) {
+	am.debugSessionsLock.Lock()
+	defer am.debugSessionsLock.Unlock()
+	s, ok := am.debugSessions[sessionID]
+	if !ok {
+		return DebugSession{}, ErrDebugSessionNotFound
+	}
+	am.expireDebugSession(s)
+	return copyDebugSession(s), nil
+}
+
+// DebugExec runs the command line in the debug session on behalf of the admin
+// with the given thumbprint. The arguments are separated by whitespace, there
+// is no quoting. Besides the commands in common.DebugCommands, the session
+// understands cd to change the directory the next commands are run in. The
+// command and its output are recorded in the session and the audit log
+func (am *AgentsManager) DebugExec(
+	sessionID string,
+	admin string,
+	command string,
+) (DebugCommandRun, error) {
+	am.debugSessionsLock.Lock()
+	s, ok := am.debugSessions[sessionID]
+	if !ok {
+		am.debugSessionsLock.Unlock()
+		return DebugCommandRun{}, ErrDebugSessionNotFound
+	}
+	am.expireDebugSession(s)
+	if s.Closed != nil {
+		am.debugSessionsLock.Unlock()
+		return DebugCommandRun{}, ErrDebugSessionClosed
+	}
+	agentID := s.AgentID
+	dir := s.Dir
+	am.debugSessionsLock.Unlock()
+
+	run := DebugCommandRun{
+		Time:    time.Now(),
+		Admin:   admin,
+		Command: command,
+		Dir:     dir,
+	}
+	args := strings.Fields(command)
+	if len(args) > 0 && args[0] == "cd" {
+		// Check the directory exists and can be read by running ls on it
+		newDir := ""
+		if len(args) > 1 {
+			newDir = args[1]
+			if !path.IsAbs(newDir) && dir != "" {
+				newDir = path.Join(dir, newDir)
+			}
+		}
+		run = am.debugExec(agentID, []string{"ls", "-d", "."}, newDir, run)
+		if run.Error == "" && run.ExitCode == 0 {
+			dir = newDir
+		}
+	} else {
+		_, _, err := common.CheckDebugCommand(args)
+		if err != nil {
+			run.ExitCode = -1
+			run.Error = err.Error()
+		} else {
+			run = am.debugExec(agentID, args, dir, run)
+		}
+	}
+
+	am.debugSessionsLock.Lock()
+	defer am.debugSessionsLock.Unlock()
+	s.Dir = dir
+	s.LastActivity = time.Now()
+	s.Commands = append(s.Commands, run)
+	err := am.persistDebugSession(s)
+	if err != nil {
+		logging.Warnf("Unable to persist debug session %s: %v", s.ID, err)
+	}
+	am.coord.Audit(coordinator.AuditEntry{
+		Actor:  admin,
+		Action: "agent-debug-exec",
+		Details: fmt.Sprintf(
+			"agent %d, session %s: %s (exit %d)",
+			agentID,
+			sessionID,
+			command,
+			run.ExitCode,
+		),
+	})
+	return run, nil
+}
+
+// debugExec runs the command on the agent and records its result in run
+func (am *AgentsManager) debugExec(
+	agentID int32,
+	args []string,
+	dir string,
+	run DebugCommandRun,
+) DebugCommandRun {
+	run.ExitCode = -1
+	msg, err := am.QueryAgentWithTimeout(agentID, &wire.DebugExecRequestMsg{
+		Args:           args,
+		Dir:            dir,
+		TimeoutSeconds: int(debugExecTimeout.Seconds()),
+	}, debugExecTimeout+30*time.Second)
+	run.DurationMs = time.Since(run.Time).Milliseconds()
+	if err != nil {
+		run.Error = err.Error()
+		return run
+	}
+	rep, ok := msg.(*wire.DebugExecResponseMsg)
+	if !ok {
+		errMsg, ok := msg.(*wire.ErrorMsg)
+		if ok {
+			run.Error = errMsg.Error
+			return run
+		}
+		run.Error = common.ErrWrongMessageType.Error()
+		return run
+	}
+	run.ExitCode = rep.ExitCode
+	run.Stdout = string(rep.Stdout)
+	run.Stderr = string(rep.Stderr)
+	run.Truncated = rep.Truncated
+	run.TimedOut = rep.TimedOut
+	run.Error = rep.Error
+	return run
+}
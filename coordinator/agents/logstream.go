@@ -0,0 +1,32 @@
+package agents
+
+import (
+	"errors"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/wire"
+)
+
+// SetLogStream starts or stops the agent streaming the output of its running
+// commands, at most linesPerSecond lines per second. Streaming stops by itself
+// unless it's started again within 30 seconds
+func (am *AgentsManager) SetLogStream(
+	agentID int32,
+	enable bool,
+	linesPerSecond int,
+) error {
+	msg, err := am.QueryAgent(agentID, &wire.LogStreamRequestMsg{
+		Enable:            enable,
+		MaxLinesPerSecond: linesPerSecond,
+	})
+	if err != nil {
+		return err
+	}
+	if errMsg, ok := msg.(*wire.ErrorMsg); ok {
+		return errors.New(errMsg.Error)
+	}
+	if _, ok := msg.(*wire.AckMsg); !ok {
+		return common.ErrWrongMessageType
+	}
+	return nil
+}
@@ -0,0 +1,714 @@
+package agents
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+	"github.com/mit-dci/opencbdc-tctl/wire"
+)
+
+// transferChunkSize is the size of the chunks files are transferred in
+const transferChunkSize = 4 << 20
+
+// transferParallelism is the number of chunks of a single transfer that are
+// in flight at once
+const transferParallelism = 8
+
+// transferAttempts is the number of times a transfer is attempted before it
+// fails. Each attempt resumes with the chunks that were not yet transferred
+const transferAttempts = 3
+
+// transferRetryInterval is the time between the attempts of a transfer
+const transferRetryInterval = 5 * time.Second
+
+// transferChunkTimeout is the time to wait for the agent to acknowledge a
+// chunk
+const transferChunkTimeout = 2 * time.Minute
+
+// transferProgressInterval is the interval at which the progress of sending a
+// file is reported to the caller of SendFile
+const transferProgressInterval = 2 * time.Second
+
+// fetchStatePersistInterval is the number of chunks fetched after which the
+// state of a fetch is written to disk. Chunks fetched since are fetched again
+// when the fetch is resumed
+const fetchStatePersistInterval = 8
+
+// transferRetention is how long finished transfers are listed
+const transferRetention = time.Hour
+
+var ErrTransferNotFound = errors.New("transfer not found")
+
+// TransferDirection is the direction of a file transfer
+type TransferDirection string
+
+const (
+	// The coordinator sends the file to the agent
+	TransferDirectionSend TransferDirection = "send"
+	// The coordinator fetches the file from the agent
+	TransferDirectionFetch TransferDirection = "fetch"
+)
+
+// FileTransfer describes the progress of a chunked file transfer between the
+// coordinator and an agent
+type FileTransfer struct {
+	ID         string             `json:"id"`
+	AgentID    int32              `json:"agentID"`
+	Direction  TransferDirection  `json:"direction"`
+	LocalPath  string             `json:"localPath"`
+	RemotePath string             `json:"remotePath"`
+	Phase      wire.TransferPhase `json:"phase"`
+	Bytes      int64              `json:"bytes"`
+	TotalBytes int64              `json:"totalBytes"`
+	Chunks     int                `json:"chunks"`
+	ChunksDone int                `json:"chunksDone"`
+	// The chunks that were already transferred by an earlier, interrupted
+	// attempt of the transfer, and were not transferred again
+	ChunksResumed int        `json:"chunksResumed"`
+	Attempts      int        `json:"attempts"`
+	SHA256        string     `json:"sha256"`
+	Started       time.Time  `json:"started"`
+	Finished      *time.Time `json:"finished,omitempty"`
+	Error         string     `json:"error,omitempty"`
+}
+
+// SendFileOptions are the options of sending a file to an agent
+type SendFileOptions struct {
+	// Unpack the file if it is either a TAR or TAR.GZ
+	Unpack bool
+	// Ignore directory information in the archive
+	FlatUnpack bool
+	// Do not create a folder with the base name of the archive
+	UnpackNoDir bool
+	// The checksums of the file, if known. Otherwise they are computed
+	Checksums *common.ArchiveChecksums
+	// If not nil, called with the progress of the transfer, the same way
+	// the agent reports the progress of deploying a file from S3
+	Progress func(*wire.TransferProgressMsg)
+}
+
+// fetchState is the state of fetching a file from an agent, kept next to the
+// file being written such that the fetch can be resumed
+type fetchState struct {
+	SHA256    string `json:"sha256"`
+	ChunkSize int64  `json:"chunkSize"`
+	Received  []bool `json:"received"`
+}
+
+// numChunks returns the number of chunks of transferChunkSize a file of the
+// given size is transferred in
+func numChunks(size int64) int {
+	return int((size + transferChunkSize - 1) / transferChunkSize)
+}
+
+// chunkBounds returns the offset and length of the chunk with the given index
+// in a file of the given size
+func chunkBounds(index int, size int64) (int64, int64) {
+	offset := int64(index) * transferChunkSize
+	length := int64(transferChunkSize)
+	if offset+length > size {
+		length = size - offset
+	}
+	return offset, length
+}
+
+// expectAck checks the reply of the agent to a request is an AckMsg
+func expectAck(msg wire.Msg, err error) error {
+	if err != nil {
+		return err
+	}
+	if errMsg, ok := msg.(*wire.ErrorMsg); ok {
+		return errors.New(errMsg.Error)
+	}
+	if _, ok := msg.(*wire.AckMsg); !ok {
+		return fmt.Errorf("expected AckMsg, got %T", msg)
+	}
+	return nil
+}
+
+// trackTransfer adds the transfer to the list of transfers, and removes the
+// transfers that finished more than transferRetention ago
+func (am *AgentsManager) trackTransfer(ft *FileTransfer) {
+	am.transfersLock.Lock()
+	defer am.transfersLock.Unlock()
+	for id, t := range am.transfers {
+		if t.Finished != nil && time.Since(*t.Finished) > transferRetention {
+			delete(am.transfers, id)
+		}
+	}
+	am.transfers[ft.ID] = ft
+}
+
+// updateTransfer applies f to the transfer while holding transfersLock
+func (am *AgentsManager) updateTransfer(
+	ft *FileTransfer,
+	f func(*FileTransfer),
+) {
+	am.transfersLock.Lock()
+	defer am.transfersLock.Unlock()
+	f(ft)
+}
+
+// finishTransfer marks the transfer as finished with the given outcome
+func (am *AgentsManager) finishTransfer(ft *FileTransfer, err error) {
+	am.updateTransfer(ft, func(ft *FileTransfer) {
+		now := time.Now()
+		ft.Finished = &now
+		ft.Phase = wire.TransferPhaseDone
+		if err != nil {
+			ft.Phase = wire.TransferPhaseFailed
+			ft.Error = err.Error()
+		}
+	})
+}
+
+// Transfers returns the file transfers that are running or finished recently,
+// the most recently started first
+func (am *AgentsManager) Transfers() []FileTransfer {
+	am.transfersLock.Lock()
+	ret := make([]FileTransfer, 0, len(am.transfers))
+	for _, t := range am.transfers {
+		ret = append(ret, *t)
+	}
+	am.transfersLock.Unlock()
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Started.After(ret[j].Started)
+	})
+	return ret
+}
+
+// GetTransfer returns the file transfer with the given ID
+func (am *AgentsManager) GetTransfer(id string) (FileTransfer, error) {
+	am.transfersLock.Lock()
+	defer am.transfersLock.Unlock()
+	t, ok := am.transfers[id]
+	if !ok {
+		return FileTransfer{}, ErrTransferNotFound
+	}
+	return *t, nil
+}
+
+// SendFile sends the file at localPath to remotePath in the given environment
+// on the agent. The file is sent in chunks, of which several are in flight at
+// once, each checked against its checksum by the agent. The transfer ID is
+// derived from the file's checksum and target, such that if the transfer is
+// interrupted, the next attempt (or the next call to SendFile for the same
+// file) resumes with the chunks the agent did not receive yet. Once all chunks
+// are received, the agent verifies the whole file and optionally unpacks it
+func (am *AgentsManager) SendFile(
+	agentID int32,
+	environmentID []byte,
+	localPath string,
+	remotePath string,
+	opts SendFileOptions,
+) error {
+	checksums := opts.Checksums
+	if checksums == nil {
+		digest, size, err := common.FileSHA256(localPath)
+		if err != nil {
+			return err
+		}
+		checksums = &common.ArchiveChecksums{SHA256: digest, Size: size}
+	}
+	stat, err := os.Stat(localPath)
+	if err != nil {
+		return err
+	}
+
+	h := sha256.New()
+	h.Write(environmentID)
+	h.Write([]byte(remotePath))
+	h.Write([]byte(checksums.SHA256))
+	transferID := h.Sum(nil)[:16]
+
+	ft := &FileTransfer{
+		ID:         hex.EncodeToString(transferID),
+		AgentID:    agentID,
+		Direction:  TransferDirectionSend,
+		LocalPath:  localPath,
+		RemotePath: remotePath,
+		Phase:      wire.TransferPhaseDownload,
+		TotalBytes: stat.Size(),
+		Chunks:     numChunks(stat.Size()),
+		SHA256:     checksums.SHA256,
+		Started:    time.Now(),
+	}
+	am.trackTransfer(ft)
+	err = am.sendFile(ft, environmentID, transferID, checksums, opts)
+	am.finishTransfer(ft, err)
+	if opts.Progress != nil {
+		t, _ := am.GetTransfer(ft.ID)
+		opts.Progress(&wire.TransferProgressMsg{
+			TransferID: transferID,
+			Phase:      t.Phase,
+			Bytes:      t.Bytes,
+			TotalBytes: t.TotalBytes,
+		})
+	}
+	return err
+}
+
+// sendFile sends the chunks of the transfer in up to transferAttempts
+// attempts, then has the agent verify and unpack the file
+func (am *AgentsManager) sendFile(
+	ft *FileTransfer,
+	environmentID []byte,
+	transferID []byte,
+	checksums *common.ArchiveChecksums,
+	opts SendFileOptions,
+) error {
+	stop := make(chan bool)
+	if opts.Progress != nil {
+		go func() {
+			for {
+				select {
+				case <-stop:
+					return
+				case <-time.After(transferProgressInterval):
+					t, _ := am.GetTransfer(ft.ID)
+					opts.Progress(&wire.TransferProgressMsg{
+						TransferID: transferID,
+						Phase:      wire.TransferPhaseDownload,
+						Bytes:      t.Bytes,
+						TotalBytes: t.TotalBytes,
+					})
+				}
+			}
+		}()
+	}
+	var err error
+	for attempt := 1; attempt <= transferAttempts; attempt++ {
+		am.updateTransfer(ft, func(ft *FileTransfer) { ft.Attempts = attempt })
+		err = am.sendChunks(ft, environmentID, transferID)
+		if err == nil {
+			break
+		}
+		logging.Warnf(
+			"Attempt %d of sending %s to agent %d failed: %v",
+			attempt,
+			ft.LocalPath,
+			ft.AgentID,
+			err,
+		)
+		if attempt < transferAttempts {
+			time.Sleep(transferRetryInterval)
+		}
+	}
+	close(stop)
+	if err != nil {
+		return err
+	}
+
+	// Relay the progress of verifying and unpacking the file on the agent
+	rc := make(chan wire.Msg, 100)
+	err = am.coord.RegisterTransferProgressCallback(ft.AgentID, transferID, rc)
+	if err != nil {
+		return err
+	}
+	relayDone := make(chan bool)
+	defer close(relayDone)
+	go func() {
+		for {
+			select {
+			case <-relayDone:
+				return
+			case msg := <-rc:
+				p, ok := msg.(*wire.TransferProgressMsg)
+				if !ok {
+					continue
+				}
+				if p.Phase == wire.TransferPhaseVerify ||
+					p.Phase == wire.TransferPhaseUnpack {
+					am.updateTransfer(ft, func(ft *FileTransfer) {
+						ft.Phase = p.Phase
+					})
+					if opts.Progress != nil {
+						opts.Progress(p)
+					}
+				}
+				if p.Phase == wire.TransferPhaseDone ||
+					p.Phase == wire.TransferPhaseFailed {
+					return
+				}
+			}
+		}
+	}()
+	return expectAck(am.QueryAgentWithTimeout(
+		ft.AgentID,
+		&wire.FileTransferFinishRequestMsg{
+			EnvironmentID: environmentID,
+			TransferID:    transferID,
+			Path:          ft.RemotePath,
+			SHA256:        checksums.SHA256,
+			Signature:     checksums.Signature,
+			Unpack:        opts.Unpack,
+			FlatUnpack:    opts.FlatUnpack,
+			UnpackNoDir:   opts.UnpackNoDir,
+		},
+		time.Minute*3,
+	))
+}
+
+// sendChunks starts or resumes the transfer on the agent, and sends it the
+// chunks it did not receive yet, transferParallelism at a time
+func (am *AgentsManager) sendChunks(
+	ft *FileTransfer,
+	environmentID []byte,
+	transferID []byte,
+) error {
+	msg, err := am.QueryAgent(ft.AgentID, &wire.FileTransferStartRequestMsg{
+		EnvironmentID: environmentID,
+		TransferID:    transferID,
+		Path:          ft.RemotePath,
+		Size:          ft.TotalBytes,
+		ChunkSize:     transferChunkSize,
+	})
+	if err != nil {
+		return err
+	}
+	if errMsg, ok := msg.(*wire.ErrorMsg); ok {
+		return errors.New(errMsg.Error)
+	}
+	rep, ok := msg.(*wire.FileTransferStartResponseMsg)
+	if !ok {
+		return fmt.Errorf("expected FileTransferStartResponseMsg, got %T", msg)
+	}
+
+	received := make([]bool, ft.Chunks)
+	bytesReceived := int64(0)
+	for _, i := range rep.ReceivedChunks {
+		if i >= 0 && i < ft.Chunks && !received[i] {
+			received[i] = true
+			_, length := chunkBounds(i, ft.TotalBytes)
+			bytesReceived += length
+		}
+	}
+	am.updateTransfer(ft, func(ft *FileTransfer) {
+		if ft.Attempts == 1 {
+			ft.ChunksResumed = len(rep.ReceivedChunks)
+		}
+		ft.ChunksDone = len(rep.ReceivedChunks)
+		ft.Bytes = bytesReceived
+	})
+
+	f, err := os.Open(ft.LocalPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	chunks := make(chan int)
+	errs := make(chan error, transferParallelism)
+	failed := make(chan bool)
+	failOnce := sync.Once{}
+	wg := sync.WaitGroup{}
+	for w := 0; w < transferParallelism; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range chunks {
+				err := am.sendChunk(ft, f, environmentID, transferID, i)
+				if err != nil {
+					errs <- err
+					failOnce.Do(func() { close(failed) })
+					return
+				}
+			}
+		}()
+	}
+feed:
+	for i := 0; i < ft.Chunks; i++ {
+		if received[i] {
+			continue
+		}
+		select {
+		case chunks <- i:
+		case <-failed:
+			break feed
+		}
+	}
+	close(chunks)
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+// sendChunk reads the chunk with the given index from f and sends it to the
+// agent
+func (am *AgentsManager) sendChunk(
+	ft *FileTransfer,
+	f *os.File,
+	environmentID []byte,
+	transferID []byte,
+	index int,
+) error {
+	offset, length := chunkBounds(index, ft.TotalBytes)
+	contents := make([]byte, length)
+	_, err := f.ReadAt(contents, offset)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	digest := sha256.Sum256(contents)
+	err = expectAck(am.QueryAgentWithTimeout(
+		ft.AgentID,
+		&wire.FileChunkRequestMsg{
+			EnvironmentID: environmentID,
+			TransferID:    transferID,
+			Path:          ft.RemotePath,
+			Index:         index,
+			Contents:      contents,
+			SHA256:        digest[:],
+		},
+		transferChunkTimeout,
+	))
+	if err != nil {
+		return fmt.Errorf("chunk %d: %v", index, err)
+	}
+	am.updateTransfer(ft, func(ft *FileTransfer) {
+		ft.ChunksDone++
+		ft.Bytes += length
+	})
+	return nil
+}
+
+// FetchFile fetches the file at remotePath in the given environment from the
+// agent, and writes it to localPath. The file is fetched in chunks, of which
+// several are in flight at once, into a partial file that is verified against
+// the checksum of the file on the agent before it's moved into place. The
+// chunks fetched so far are recorded next to the partial file, such that an
+// interrupted fetch resumes where it was. If validate is set, the agent
+// validates the file against the schema of its output format, and the reason
+// it failed validation is returned; the file is fetched regardless
+func (am *AgentsManager) FetchFile(
+	agentID int32,
+	environmentID []byte,
+	remotePath string,
+	localPath string,
+	validate bool,
+) (string, error) {
+	msg, err := am.QueryAgentWithTimeout(agentID, &wire.FileReadRequestMsg{
+		EnvironmentID: environmentID,
+		Path:          remotePath,
+		Validate:      validate,
+	}, time.Minute*3)
+	if err != nil {
+		return "", err
+	}
+	if errMsg, ok := msg.(*wire.ErrorMsg); ok {
+		return "", errors.New(errMsg.Error)
+	}
+	info, ok := msg.(*wire.FileReadResponseMsg)
+	if !ok {
+		return "", fmt.Errorf("expected FileReadResponseMsg, got %T", msg)
+	}
+
+	id, err := common.RandomID(16)
+	if err != nil {
+		return "", err
+	}
+	ft := &FileTransfer{
+		ID:         id,
+		AgentID:    agentID,
+		Direction:  TransferDirectionFetch,
+		LocalPath:  localPath,
+		RemotePath: remotePath,
+		Phase:      wire.TransferPhaseDownload,
+		TotalBytes: info.Size,
+		Chunks:     numChunks(info.Size),
+		SHA256:     info.SHA256,
+		Started:    time.Now(),
+	}
+	am.trackTransfer(ft)
+	for attempt := 1; attempt <= transferAttempts; attempt++ {
+		am.updateTransfer(ft, func(ft *FileTransfer) { ft.Attempts = attempt })
+		err = am.fetchChunks(ft, environmentID)
+		if err == nil {
+			break
+		}
+		logging.Warnf(
+			"Attempt %d of fetching %s from agent %d failed: %v",
+			attempt,
+			remotePath,
+			agentID,
+			err,
+		)
+		if attempt < transferAttempts {
+			time.Sleep(transferRetryInterval)
+		}
+	}
+	if err == nil {
+		am.updateTransfer(ft, func(ft *FileTransfer) {
+			ft.Phase = wire.TransferPhaseVerify
+		})
+		err = common.VerifyFileSHA256(localPath+".part", info.SHA256)
+		os.Remove(localPath + ".part.json")
+		if err == nil {
+			err = os.Rename(localPath+".part", localPath)
+		}
+		if err != nil {
+			os.Remove(localPath + ".part")
+		}
+	}
+	am.finishTransfer(ft, err)
+	return info.ValidationError, err
+}
+
+// fetchChunks fetches the chunks of the file that were not fetched yet into
+// the partial file, transferParallelism at a time
+func (am *AgentsManager) fetchChunks(
+	ft *FileTransfer,
+	environmentID []byte,
+) error {
+	partPath := ft.LocalPath + ".part"
+	statePath := partPath + ".json"
+	err := os.MkdirAll(filepath.Dir(partPath), 0755)
+	if err != nil {
+		return err
+	}
+
+	state := fetchState{}
+	b, err := ioutil.ReadFile(statePath)
+	if err == nil {
+		err = json.Unmarshal(b, &state)
+	}
+	resume := err == nil && state.SHA256 == ft.SHA256 &&
+		state.ChunkSize == transferChunkSize &&
+		len(state.Received) == ft.Chunks
+	flags := os.O_WRONLY | os.O_CREATE
+	if !resume {
+		state = fetchState{
+			SHA256:    ft.SHA256,
+			ChunkSize: transferChunkSize,
+			Received:  make([]bool, ft.Chunks),
+		}
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(partPath, flags, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	done := 0
+	bytesDone := int64(0)
+	for i, received := range state.Received {
+		if received {
+			done++
+			_, length := chunkBounds(i, ft.TotalBytes)
+			bytesDone += length
+		}
+	}
+	am.updateTransfer(ft, func(ft *FileTransfer) {
+		if ft.Attempts == 1 {
+			ft.ChunksResumed = done
+		}
+		ft.ChunksDone = done
+		ft.Bytes = bytesDone
+	})
+
+	stateLock := sync.Mutex{}
+	unsaved := 0
+	markReceived := func(i int) error {
+		stateLock.Lock()
+		defer stateLock.Unlock()
+		state.Received[i] = true
+		unsaved++
+		if unsaved < fetchStatePersistInterval {
+			return nil
+		}
+		unsaved = 0
+		b, err := json.Marshal(state)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(statePath, b, 0644)
+	}
+	chunks := make(chan int)
+	errs := make(chan error, transferParallelism)
+	failed := make(chan bool)
+	failOnce := sync.Once{}
+	wg := sync.WaitGroup{}
+	for w := 0; w < transferParallelism; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range chunks {
+				err := am.fetchChunk(ft, f, environmentID, i)
+				if err == nil {
+					err = markReceived(i)
+				}
+				if err != nil {
+					errs <- err
+					failOnce.Do(func() { close(failed) })
+					return
+				}
+			}
+		}()
+	}
+feed:
+	for i := 0; i < ft.Chunks; i++ {
+		if state.Received[i] {
+			continue
+		}
+		select {
+		case chunks <- i:
+		case <-failed:
+			break feed
+		}
+	}
+	close(chunks)
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+// fetchChunk fetches the chunk with the given index from the agent and writes
+// it to f
+func (am *AgentsManager) fetchChunk(
+	ft *FileTransfer,
+	f *os.File,
+	environmentID []byte,
+	index int,
+) error {
+	offset, length := chunkBounds(index, ft.TotalBytes)
+	msg, err := am.QueryAgentWithTimeout(ft.AgentID, &wire.FileReadRequestMsg{
+		EnvironmentID: environmentID,
+		Path:          ft.RemotePath,
+		Offset:        offset,
+		Length:        length,
+	}, transferChunkTimeout)
+	if err != nil {
+		return fmt.Errorf("chunk %d: %v", index, err)
+	}
+	if errMsg, ok := msg.(*wire.ErrorMsg); ok {
+		return fmt.Errorf("chunk %d: %s", index, errMsg.Error)
+	}
+	rep, ok := msg.(*wire.FileReadResponseMsg)
+	if !ok {
+		return fmt.Errorf("expected FileReadResponseMsg, got %T", msg)
+	}
+	if int64(len(rep.Contents)) != length || rep.Size != ft.TotalBytes {
+		return fmt.Errorf("file %s changed while fetching it", ft.RemotePath)
+	}
+	_, err = f.WriteAt(rep.Contents, offset)
+	if err != nil {
+		return err
+	}
+	am.updateTransfer(ft, func(ft *FileTransfer) {
+		ft.ChunksDone++
+		ft.Bytes += length
+	})
+	return nil
+}
@@ -0,0 +1,186 @@
+package coordinator
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+var ErrAnnouncementNotFound = errors.New("announcement not found")
+var ErrInvalidAnnouncement = errors.New("invalid announcement")
+
+// AnnouncementSeverity indicates how prominently the frontend should show an
+// announcement
+type AnnouncementSeverity string
+
+const AnnouncementSeverityInfo AnnouncementSeverity = "info"
+const AnnouncementSeverityWarning AnnouncementSeverity = "warning"
+const AnnouncementSeverityCritical AnnouncementSeverity = "critical"
+
+// Announcement is a banner message that is shown to all users of the system,
+// for instance to warn about planned maintenance
+type Announcement struct {
+	ID        string               `json:"id"`
+	Message   string               `json:"message"`
+	Severity  AnnouncementSeverity `json:"severity"`
+	Created   time.Time            `json:"created"`
+	Expires   time.Time            `json:"expires"`
+	CreatedBy string               `json:"createdBy"`
+}
+
+// announcementsPath returns the path of the file the announcements are
+// persisted in
+func announcementsPath() string {
+	return filepath.Join(common.DataDir(), "announcements.json")
+}
+
+// loadAnnouncements reads the persisted announcements from disk
+func (c *Coordinator) loadAnnouncements() error {
+	c.announcementsLock.Lock()
+	defer c.announcementsLock.Unlock()
+	f, err := os.Open(announcementsPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	return json.NewDecoder(f).Decode(&c.announcements)
+}
+
+// persistAnnouncements writes the announcements to disk. Expects the caller to
+// hold announcementsLock
+func (c *Coordinator) persistAnnouncements() error {
+	f, err := os.OpenFile(
+		announcementsPath(),
+		os.O_CREATE|os.O_WRONLY|os.O_TRUNC,
+		0644,
+	)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(c.announcements)
+}
+
+// ActiveAnnouncements returns the announcements that have not expired yet
+func (c *Coordinator) ActiveAnnouncements() []Announcement {
+	c.announcementsLock.Lock()
+	defer c.announcementsLock.Unlock()
+	active := make([]Announcement, 0)
+	for _, a := range c.announcements {
+		if a.Expires.IsZero() || a.Expires.After(time.Now()) {
+			active = append(active, a)
+		}
+	}
+	return active
+}
+
+// AddAnnouncement validates and persists a new announcement and broadcasts the
+// updated set of active announcements to all connected users
+func (c *Coordinator) AddAnnouncement(a Announcement) (Announcement, error) {
+	if a.Message == "" {
+		return a, ErrInvalidAnnouncement
+	}
+	switch a.Severity {
+	case "":
+		a.Severity = AnnouncementSeverityInfo
+	case AnnouncementSeverityInfo,
+		AnnouncementSeverityWarning,
+		AnnouncementSeverityCritical:
+	default:
+		return a, ErrInvalidAnnouncement
+	}
+
+	var err error
+	a.ID, err = common.RandomID(12)
+	if err != nil {
+		return a, err
+	}
+	a.Created = time.Now()
+
+	c.announcementsLock.Lock()
+	// Drop expired announcements while we're at it
+	announcements := make([]Announcement, 0)
+	for _, e := range c.announcements {
+		if e.Expires.IsZero() || e.Expires.After(time.Now()) {
+			announcements = append(announcements, e)
+		}
+	}
+	c.announcements = append(announcements, a)
+	err = c.persistAnnouncements()
+	c.announcementsLock.Unlock()
+	if err != nil {
+		return a, err
+	}
+
+	c.scheduleAnnouncementExpiry(a)
+	c.sendAnnouncementsChanged()
+	return a, nil
+}
+
+// RemoveAnnouncement removes an announcement before it expires
+func (c *Coordinator) RemoveAnnouncement(id string) error {
+	c.announcementsLock.Lock()
+	found := false
+	announcements := make([]Announcement, 0)
+	for _, a := range c.announcements {
+		if a.ID == id {
+			found = true
+			continue
+		}
+		announcements = append(announcements, a)
+	}
+	if !found {
+		c.announcementsLock.Unlock()
+		return ErrAnnouncementNotFound
+	}
+	c.announcements = announcements
+	err := c.persistAnnouncements()
+	c.announcementsLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	c.sendAnnouncementsChanged()
+	return nil
+}
+
+// scheduleAnnouncementExpiry makes sure the connected users are notified when
+// the announcement expires, such that the banner disappears
+func (c *Coordinator) scheduleAnnouncementExpiry(a Announcement) {
+	if a.Expires.IsZero() || a.Expires.Before(time.Now()) {
+		return
+	}
+	time.AfterFunc(time.Until(a.Expires), c.sendAnnouncementsChanged)
+}
+
+// sendAnnouncementsChanged sends the currently active announcements to the
+// real-time channel
+func (c *Coordinator) sendAnnouncementsChanged() {
+	c.events <- Event{
+		Type: EventTypeAnnouncementsChanged,
+		Payload: AnnouncementsChangedPayload{
+			Announcements: c.ActiveAnnouncements(),
+		},
+	}
+}
+
+// initAnnouncements loads the persisted announcements and schedules the
+// notifications for their expiry
+func (c *Coordinator) initAnnouncements() {
+	err := c.loadAnnouncements()
+	if err != nil {
+		logging.Warnf("Unable to load announcements: %v", err)
+		return
+	}
+	for _, a := range c.ActiveAnnouncements() {
+		c.scheduleAnnouncementExpiry(a)
+	}
+}
@@ -0,0 +1,91 @@
+package coordinator
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// AuditEntry is an action recorded in the audit log
+type AuditEntry struct {
+	Time time.Time `json:"time"`
+	// The thumbprint of the user that performed the action
+	Actor string `json:"actor"`
+	// The thumbprint of the user the actor was impersonating, if any
+	ImpersonatedAs string `json:"impersonatedAs,omitempty"`
+	Action         string `json:"action"`
+	Details        string `json:"details,omitempty"`
+}
+
+// auditLogPath returns the path of the file the audit log is appended to
+func auditLogPath() string {
+	return filepath.Join(common.DataDir(), "audit.log")
+}
+
+// Audit appends the entry to the audit log, which is kept as a file of JSON
+// lines that is only ever appended to
+func (c *Coordinator) Audit(e AuditEntry) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		logging.Errorf("Unable to marshal audit entry: %v", err)
+		return
+	}
+	c.auditLock.Lock()
+	defer c.auditLock.Unlock()
+	f, err := os.OpenFile(
+		auditLogPath(),
+		os.O_CREATE|os.O_WRONLY|os.O_APPEND,
+		0600,
+	)
+	if err != nil {
+		logging.Errorf("Unable to open audit log: %v", err)
+		return
+	}
+	defer f.Close()
+	_, err = f.Write(append(b, '\n'))
+	if err != nil {
+		logging.Errorf("Unable to write audit log: %v", err)
+	}
+}
+
+// AuditLog returns the most recent entries of the audit log, most recent
+// first
+func (c *Coordinator) AuditLog(limit int) ([]AuditEntry, error) {
+	c.auditLock.Lock()
+	defer c.auditLock.Unlock()
+	ret := []AuditEntry{}
+	f, err := os.Open(auditLogPath())
+	if os.IsNotExist(err) {
+		return ret, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		ret = append(ret, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(ret)-1; i < j; i, j = i+1, j-1 {
+		ret[i], ret[j] = ret[j], ret[i]
+	}
+	if limit > 0 && len(ret) > limit {
+		ret = ret[:limit]
+	}
+	return ret, nil
+}
@@ -19,12 +19,17 @@ type AwsManager struct {
 	launchTemplates       []AwsLaunchTemplate
 	forceRefreshSubnets   chan bool
 	subnets               []AwsSubnet
+	vpcPeerings           map[string]bool
+	vpcPeeringsLock       sync.Mutex
 	vcpuLimit             map[string]int32
 	s3Clients             map[string]*s3.Client
 	s3ClientsLock         sync.Mutex
 	seeds                 []*ShardSeed
 	forceRefreshSeeds     chan bool
 	seedLock              sync.Mutex
+	seedCache             map[string]*SeedCacheEntry
+	seedCacheLock         sync.Mutex
+	retryPolicy           RetryPolicy
 }
 
 // NewAwsManager creates a new AwsManager instance
@@ -41,6 +46,7 @@ func NewAwsManager() *AwsManager {
 		forceRefreshSubnets:   make(chan bool, 1),
 		seeds:                 make([]*ShardSeed, 0),
 		forceRefreshSeeds:     make(chan bool, 1),
+		retryPolicy:           retryPolicyFromEnv(),
 	}
 	// Run initialization in a separate goroutine
 	go func() {
@@ -85,10 +91,11 @@ func NewAwsManager() *AwsManager {
 			}
 		}
 
-		// Load the launch templates, subnets, seeds and limits for the first
-		// time
+		// Load the launch templates, subnets, VPC peerings, seeds and limits
+		// for the first time
 		am.refreshLaunchTemplates()
 		am.refreshSubnets()
+		am.refreshVpcPeerings()
 		am.refreshLimits()
 		am.refreshSeeds()
 
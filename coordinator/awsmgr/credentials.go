@@ -0,0 +1,221 @@
+package awsmgr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/aws-sdk-go-v2/service/sts/types"
+)
+
+// minRunCredentialsDuration is the shortest session STS issues
+const minRunCredentialsDuration = 15 * time.Minute
+
+// defaultRunCredentialsDuration is how long run credentials are valid, unless
+// RUN_CREDENTIALS_DURATION_MINUTES is set
+const defaultRunCredentialsDuration = time.Hour
+
+// RunCredentials are temporary credentials issued for the roles of a single
+// test run
+type RunCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Expiration      time.Time
+}
+
+// Environ returns the environment variables that make the AWS SDKs and CLI
+// use the credentials, taking precedence over the agent's instance profile
+func (c *RunCredentials) Environ() []string {
+	return []string{
+		fmt.Sprintf("AWS_ACCESS_KEY_ID=%s", c.AccessKeyID),
+		fmt.Sprintf("AWS_SECRET_ACCESS_KEY=%s", c.SecretAccessKey),
+		fmt.Sprintf("AWS_SESSION_TOKEN=%s", c.SessionToken),
+	}
+}
+
+// runCredentialsRole returns the ARN of the role that run credentials are
+// sessions of, configured in RUN_CREDENTIALS_ROLE_ARN. The role's permissions
+// bound what any test run can be granted. Its maximum session duration must
+// be at least the duration run credentials are issued for
+func runCredentialsRole() string {
+	return os.Getenv("RUN_CREDENTIALS_ROLE_ARN")
+}
+
+// RunCredentialsEnabled returns true if a role to issue run credentials for
+// is configured
+func RunCredentialsEnabled() bool {
+	return runCredentialsRole() != ""
+}
+
+// RunCredentialsServices returns the services test runs can be granted access
+// to, configured as a comma separated list in RUN_CREDENTIALS_SERVICES.
+// Defaults to S3 only
+func RunCredentialsServices() []string {
+	s := os.Getenv("RUN_CREDENTIALS_SERVICES")
+	if s == "" {
+		return []string{"s3"}
+	}
+	ret := []string{}
+	for _, svc := range strings.Split(s, ",") {
+		if svc = strings.TrimSpace(svc); svc != "" {
+			ret = append(ret, svc)
+		}
+	}
+	return ret
+}
+
+// runCredentialsDuration returns how long run credentials are valid for
+func runCredentialsDuration() time.Duration {
+	d := defaultRunCredentialsDuration
+	if m, err := strconv.Atoi(
+		os.Getenv("RUN_CREDENTIALS_DURATION_MINUTES"),
+	); err == nil {
+		d = time.Duration(m) * time.Minute
+	}
+	if d < minRunCredentialsDuration {
+		d = minRunCredentialsDuration
+	}
+	return d
+}
+
+// IssueRunCredentials assumes the run credentials role for the test run with
+// the given ID, restricted by the session policy to the actions it was
+// granted. The session is named and tagged after the test run, such that its
+// use can be attributed in CloudTrail
+func (am *AwsManager) IssueRunCredentials(
+	runID string,
+	policy string,
+) (*RunCredentials, error) {
+	if !am.Enabled {
+		return nil, errors.New("AWS not enabled")
+	}
+	if !RunCredentialsEnabled() {
+		return nil, errors.New("RUN_CREDENTIALS_ROLE_ARN is not configured")
+	}
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+	cfg, err := config.LoadDefaultConfig(
+		context.Background(),
+		config.WithRegion(region),
+		defaultRetrier(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	out, err := sts.NewFromConfig(cfg).AssumeRole(
+		context.Background(),
+		&sts.AssumeRoleInput{
+			RoleArn:         aws.String(runCredentialsRole()),
+			RoleSessionName: aws.String(fmt.Sprintf("testrun-%s", runID)),
+			DurationSeconds: aws.Int32(
+				int32(runCredentialsDuration().Seconds()),
+			),
+			Policy: aws.String(policy),
+			Tags: []types.Tag{
+				{Key: aws.String("testrun"), Value: aws.String(runID)},
+			},
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if out.Credentials == nil {
+		return nil, errors.New("STS returned no credentials")
+	}
+	return &RunCredentials{
+		AccessKeyID:     aws.ToString(out.Credentials.AccessKeyId),
+		SecretAccessKey: aws.ToString(out.Credentials.SecretAccessKey),
+		SessionToken:    aws.ToString(out.Credentials.SessionToken),
+		Expiration:      aws.ToTime(out.Credentials.Expiration),
+	}, nil
+}
+
+// revokedRunPolicyPrefix prefixes the names of the inline policies of the run
+// credentials role that revoke the sessions of a test run. The names end in
+// the time the last session of the run expires, after which the policy is
+// no longer needed
+const revokedRunPolicyPrefix = "revoked-testrun-"
+
+// RevokeRunCredentials invalidates the sessions issued for the test run with
+// the given ID before now, which are valid until expiration at the latest.
+// STS sessions can't be ended, so an inline policy is put on the run
+// credentials role that denies everything to sessions tagged with the run
+// that were issued before now. The coordinator needs iam:PutRolePolicy,
+// iam:ListRolePolicies and iam:DeleteRolePolicy on the role. Revocation
+// policies of sessions that have expired by now are removed first, such that
+// they don't fill up the size limit of the inline policies of the role
+func (am *AwsManager) RevokeRunCredentials(
+	runID string,
+	expiration time.Time,
+) error {
+	if !am.Enabled {
+		return errors.New("AWS not enabled")
+	}
+	role := roleName(runCredentialsRole())
+	err := am.pruneRevokedRunPolicies(role)
+	if err != nil {
+		return err
+	}
+	doc, err := json.Marshal(map[string]interface{}{
+		"Version": "2012-10-17",
+		"Statement": []map[string]interface{}{
+			{
+				"Effect":   "Deny",
+				"Action":   "*",
+				"Resource": "*",
+				"Condition": map[string]interface{}{
+					"StringEquals": map[string]string{
+						"aws:PrincipalTag/testrun": runID,
+					},
+					"DateLessThan": map[string]string{
+						"aws:TokenIssueTime": time.Now().UTC().Format(
+							time.RFC3339,
+						),
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return am.putRolePolicy(
+		role,
+		fmt.Sprintf("%s%s-%d", revokedRunPolicyPrefix, runID, expiration.Unix()),
+		string(doc),
+	)
+}
+
+// pruneRevokedRunPolicies removes the revocation policies from the run
+// credentials role of which the sessions they revoke have expired
+func (am *AwsManager) pruneRevokedRunPolicies(role string) error {
+	names, err := am.listRolePolicies(role)
+	if err != nil {
+		return err
+	}
+	for _, n := range names {
+		if !strings.HasPrefix(n, revokedRunPolicyPrefix) {
+			continue
+		}
+		expires, err := strconv.ParseInt(n[strings.LastIndex(n, "-")+1:], 10, 64)
+		if err != nil || time.Now().Before(time.Unix(expires, 0)) {
+			continue
+		}
+		err = am.deleteRolePolicy(role, n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package awsmgr
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+)
+
+// ErrNoInstanceIdentityCert is returned when no certificate is configured to
+// verify instance identity documents with
+var ErrNoInstanceIdentityCert = errors.New(
+	"AWS_INSTANCE_IDENTITY_CERT is not set",
+)
+
+// InstanceIdentityAuthenticator verifies agents that enroll using the AWS EC2
+// instance identity document. It implements the EnrollmentAuthenticator
+// interface of the coordinator package
+type InstanceIdentityAuthenticator struct {
+	am *AwsManager
+	// The AWS public certificate used to verify the signature of the instance
+	// identity document
+	cert *x509.Certificate
+}
+
+// NewInstanceIdentityAuthenticator creates a new InstanceIdentityAuthenticator.
+// The AWS public certificate for verifying the document signatures is read from
+// the PEM file referenced by the AWS_INSTANCE_IDENTITY_CERT environment
+// variable. Without it, unsigned documents would be accepted, so it is
+// required and ErrNoInstanceIdentityCert is returned if it's not set
+func (am *AwsManager) NewInstanceIdentityAuthenticator() (*InstanceIdentityAuthenticator, error) {
+	a := &InstanceIdentityAuthenticator{am: am}
+	certFile := os.Getenv("AWS_INSTANCE_IDENTITY_CERT")
+	if certFile == "" {
+		return nil, ErrNoInstanceIdentityCert
+	}
+
+	b, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read instance identity cert: %v", err)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("Could not decode instance identity cert")
+	}
+	a.cert, err = x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse instance identity cert: %v", err)
+	}
+	return a, nil
+}
+
+// Method implements EnrollmentAuthenticator
+func (a *InstanceIdentityAuthenticator) Method() string {
+	return common.EnrollmentMethodInstanceIdentity
+}
+
+// Authenticate implements EnrollmentAuthenticator. It verifies the signature of
+// the instance identity document, then checks
+// that the instance is one of the instances we launched and that the agent
+// connects from the private IP listed in the document
+func (a *InstanceIdentityAuthenticator) Authenticate(
+	credential []byte,
+	remoteAddr net.Addr,
+) error {
+	if !a.am.Enabled {
+		return errors.New("AWS is not available")
+	}
+
+	var cred common.InstanceIdentityCredential
+	err := json.Unmarshal(credential, &cred)
+	if err != nil {
+		return fmt.Errorf("invalid credential: %v", err)
+	}
+
+	err = a.cert.CheckSignature(
+		x509.SHA256WithRSA,
+		cred.Document,
+		cred.Signature,
+	)
+	if err != nil {
+		return fmt.Errorf("invalid document signature: %v", err)
+	}
+
+	var doc common.InstanceIdentityDocument
+	err = json.Unmarshal(cred.Document, &doc)
+	if err != nil {
+		return fmt.Errorf("invalid document: %v", err)
+	}
+
+	// Check that the IP the agent connects from matches the one in the
+	// document
+	tcpAddr, ok := remoteAddr.(*net.TCPAddr)
+	if !ok || !tcpAddr.IP.Equal(net.ParseIP(doc.PrivateIP)) {
+		return fmt.Errorf(
+			"remote address %v does not match instance IP %s",
+			remoteAddr,
+			doc.PrivateIP,
+		)
+	}
+
+	// Since the coordinator is the only entity launching agents, the instance
+	// should be in our list of running instances
+	a.am.runningInstancesLock.Lock()
+	defer a.am.runningInstancesLock.Unlock()
+	for _, i := range a.am.runningInstances {
+		if i.Region == doc.Region && i.Instance.InstanceId != nil &&
+			*i.Instance.InstanceId == doc.InstanceID {
+			return nil
+		}
+	}
+	return fmt.Errorf("instance %s is not known", doc.InstanceID)
+}
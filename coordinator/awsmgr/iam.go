@@ -0,0 +1,144 @@
+package awsmgr
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/config"
+)
+
+// iamEndpoint is the global endpoint of the IAM query API, which signs
+// requests for us-east-1
+const iamEndpoint = "https://iam.amazonaws.com/"
+
+// iamQuery performs the IAM query API action with the given parameters using
+// the credentials of the coordinator, and returns the XML response body. The
+// coordinator only needs a few IAM actions, so they are called directly in
+// stead of through the IAM SDK
+func (am *AwsManager) iamQuery(
+	action string,
+	params url.Values,
+) ([]byte, error) {
+	cfg, err := config.LoadDefaultConfig(
+		context.Background(),
+		config.WithRegion("us-east-1"),
+		defaultRetrier(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	creds, err := cfg.Credentials.Retrieve(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	params.Set("Action", action)
+	params.Set("Version", "2010-05-08")
+	body := params.Encode()
+	req, err := http.NewRequest("POST", iamEndpoint, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(
+		"Content-Type",
+		"application/x-www-form-urlencoded; charset=utf-8",
+	)
+	hash := sha256.Sum256([]byte(body))
+	err = v4.NewSigner().SignHTTP(
+		context.Background(),
+		creds,
+		req,
+		hex.EncodeToString(hash[:]),
+		"iam",
+		"us-east-1",
+		time.Now(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Timeout: time.Second * 30}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		var e struct {
+			Code    string `xml:"Error>Code"`
+			Message string `xml:"Error>Message"`
+		}
+		if xml.Unmarshal(b, &e) == nil && e.Code != "" {
+			return nil, fmt.Errorf("IAM %s failed: %s: %s", action, e.Code, e.Message)
+		}
+		return nil, fmt.Errorf("IAM %s failed with status %d", action, res.StatusCode)
+	}
+	return b, nil
+}
+
+// roleName returns the name of the IAM role with the given ARN
+func roleName(roleArn string) string {
+	return roleArn[strings.LastIndex(roleArn, "/")+1:]
+}
+
+// putRolePolicy creates or replaces the inline policy of the role
+func (am *AwsManager) putRolePolicy(role, name, document string) error {
+	_, err := am.iamQuery("PutRolePolicy", url.Values{
+		"RoleName":       []string{role},
+		"PolicyName":     []string{name},
+		"PolicyDocument": []string{document},
+	})
+	return err
+}
+
+// deleteRolePolicy deletes the inline policy of the role
+func (am *AwsManager) deleteRolePolicy(role, name string) error {
+	_, err := am.iamQuery("DeleteRolePolicy", url.Values{
+		"RoleName":   []string{role},
+		"PolicyName": []string{name},
+	})
+	return err
+}
+
+// listRolePolicies returns the names of the inline policies of the role
+func (am *AwsManager) listRolePolicies(role string) ([]string, error) {
+	names := []string{}
+	marker := ""
+	for {
+		params := url.Values{"RoleName": []string{role}}
+		if marker != "" {
+			params.Set("Marker", marker)
+		}
+		b, err := am.iamQuery("ListRolePolicies", params)
+		if err != nil {
+			return nil, err
+		}
+		var res struct {
+			PolicyNames []string `xml:"ListRolePoliciesResult>PolicyNames>member"`
+			IsTruncated bool     `xml:"ListRolePoliciesResult>IsTruncated"`
+			Marker      string   `xml:"ListRolePoliciesResult>Marker"`
+		}
+		err = xml.Unmarshal(b, &res)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, res.PolicyNames...)
+		if !res.IsTruncated || res.Marker == "" {
+			return names, nil
+		}
+		marker = res.Marker
+	}
+}
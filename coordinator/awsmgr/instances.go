@@ -6,6 +6,7 @@ import (
 	"strings"
 	"sync"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
 	"github.com/mit-dci/opencbdc-tctl/logging"
@@ -35,9 +36,18 @@ func (am *AwsManager) refreshRunningInstances() ([]*AwsInstance, error) {
 	err := am.RunEC2ForAllRegions(func(e *ec2.Client, region string) error {
 		var nextToken *string
 		for {
-			res, err := e.DescribeInstances(
+			var res *ec2.DescribeInstancesOutput
+			err := am.withRetry(
 				context.Background(),
-				&ec2.DescribeInstancesInput{NextToken: nextToken},
+				"describing instances",
+				func(ctx context.Context) error {
+					var err error
+					res, err = e.DescribeInstances(
+						ctx,
+						&ec2.DescribeInstancesInput{NextToken: nextToken},
+					)
+					return err
+				},
 			)
 			if err != nil {
 				return err
@@ -131,6 +141,66 @@ func (am *AwsManager) StopAgentsByInstanceIds(ids []string) error {
 	return am.StopAgents(agents)
 }
 
+// InstancesRunning returns the instances of the given IDs that exist and have
+// not been terminated (or are shutting down), as reported by EC2 rather than
+// by the cached list of instances, which doesn't see instances that outlived
+// what the controller knows about
+func (am *AwsManager) InstancesRunning(ids []string) ([]string, error) {
+	ret := []string{}
+	if len(ids) == 0 {
+		return ret, nil
+	}
+	retLock := sync.Mutex{}
+	err := am.RunEC2ForAllRegions(func(e *ec2.Client, region string) error {
+		// Filter by instance ID in stead of asking for the IDs, since EC2
+		// fails the request for IDs that are unknown in the region
+		input := &ec2.DescribeInstancesInput{
+			Filters: []types.Filter{
+				{Name: aws.String("instance-id"), Values: ids},
+				{
+					Name: aws.String("instance-state-name"),
+					Values: []string{
+						"pending",
+						"running",
+						"stopping",
+						"stopped",
+					},
+				},
+			},
+		}
+		for {
+			var res *ec2.DescribeInstancesOutput
+			err := am.withRetry(
+				context.Background(),
+				"describing instances",
+				func(ctx context.Context) error {
+					var err error
+					res, err = e.DescribeInstances(ctx, input)
+					return err
+				},
+			)
+			if err != nil {
+				return err
+			}
+			retLock.Lock()
+			for _, r := range res.Reservations {
+				for _, i := range r.Instances {
+					ret = append(ret, aws.ToString(i.InstanceId))
+				}
+			}
+			retLock.Unlock()
+			if res.NextToken == nil {
+				return nil
+			}
+			input.NextToken = res.NextToken
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
 // StopAgents will terminate the EC2 instances by the instance objects passed
 func (am *AwsManager) StopAgents(a []*AwsInstance) error {
 	logging.Infof("Stopping %d instances...", len(a))
@@ -165,7 +235,14 @@ func (am *AwsManager) StopAgents(a []*AwsInstance) error {
 				InstanceIds: killIds,
 			}
 
-			_, err := e.TerminateInstances(context.Background(), input)
+			err := am.withRetry(
+				context.Background(),
+				"terminating instances",
+				func(ctx context.Context) error {
+					_, err := e.TerminateInstances(ctx, input)
+					return err
+				},
+			)
 			if err != nil {
 				log.Printf("Error terminating instances: %v", err)
 				return err
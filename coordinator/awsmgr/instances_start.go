@@ -231,10 +231,30 @@ func (am *AwsManager) StartNewAgents(
 									}
 								}
 
+								// Use the random ID as client token as well,
+								// which makes the RunInstances call idempotent
+								// such that we can safely retry it on
+								// transient errors (capacity errors are not
+								// retried, we move to the next AZ for those)
+								input.ClientToken = &spotRequestTag
+
 								launched := int32(0)
-								result, err := clt.RunInstances(
+								var result *ec2.RunInstancesOutput
+								err = am.withRetry(
 									context.Background(),
-									input,
+									fmt.Sprintf(
+										"launching template %s in region %s",
+										ag.TemplateID,
+										region,
+									),
+									func(ctx context.Context) error {
+										var err error
+										result, err = clt.RunInstances(
+											ctx,
+											input,
+										)
+										return err
+									},
 								)
 								if err != nil {
 									// Log the error, but continue the loop - we
@@ -3,14 +3,85 @@ package awsmgr
 import (
 	"context"
 	"fmt"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/mit-dci/opencbdc-tctl/common"
 )
 
+// gravitonInstanceTypeRegex matches the EC2 instance types with AWS Graviton
+// (ARM64) processors, which have a "g" in the attributes following the
+// generation number (c6g, m7gd, x2gd, im4gn, ...), and the first generation
+// a1 instances
+var gravitonInstanceTypeRegex = regexp.MustCompile(`^(a1|[a-z]+\d+[a-z]*g[a-z]*)\.`)
+
+// instanceTypeArchitecture returns the CPU architecture of the given EC2
+// instance type
+func instanceTypeArchitecture(instanceType string) string {
+	if gravitonInstanceTypeRegex.MatchString(instanceType) {
+		return "arm64"
+	}
+	return "amd64"
+}
+
+// acceleratorInstanceTypeRegexes match the EC2 instance type families with
+// accelerators: the P and G families have NVIDIA GPUs, Inferentia and
+// Trainium instances have Neuron devices and F1 instances have FPGAs
+var acceleratorInstanceTypeRegexes = map[string]*regexp.Regexp{
+	common.AcceleratorGPU:    regexp.MustCompile(`^(p|g)\d+[a-z]*\.`),
+	common.AcceleratorNeuron: regexp.MustCompile(`^(inf|trn)\d+[a-z]*\.`),
+	common.AcceleratorFPGA:   regexp.MustCompile(`^f\d+[a-z]*\.`),
+}
+
+// instanceTypeAccelerator returns the kind of accelerators of the given EC2
+// instance type, or an empty string if it has none
+func instanceTypeAccelerator(instanceType string) string {
+	for kind, re := range acceleratorInstanceTypeRegexes {
+		if re.MatchString(instanceType) {
+			return kind
+		}
+	}
+	return ""
+}
+
+// nvmeInstanceTypeRegex matches the EC2 instance type families with local
+// NVMe instance storage: the storage optimized I families, and the families
+// with the "d" attribute such as m5d, c6gd and r5dn
+var nvmeInstanceTypeRegex = regexp.MustCompile(
+	`^((i|im|is)\d+[a-z]*|[a-z]+\d+[a-z]*d[a-z]*)\.`,
+)
+
+// instanceTypeNVMe returns true if the given EC2 instance type has local NVMe
+// instance storage
+func instanceTypeNVMe(instanceType string) bool {
+	return nvmeInstanceTypeRegex.MatchString(instanceType)
+}
+
+// memoryRegex matches the memory in the description of a launch template,
+// such as "16 GiB" or "512MB"
+var memoryRegex = regexp.MustCompile(`(?i)([\d.]+)\s*([GM])i?B`)
+
+// parseMemoryMiB returns the memory in MiB described by s, or zero if it
+// can't be parsed
+func parseMemoryMiB(s string) int64 {
+	m := memoryRegex.FindStringSubmatch(s)
+	if m == nil {
+		return 0
+	}
+	v, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0
+	}
+	if strings.ToUpper(m[2]) == "G" {
+		v *= 1024
+	}
+	return int64(v)
+}
+
 // ForceRefreshLaunchTemplates is a method to force refreshing the launch
 // templates. This is currently unused but could be hooked up to a REST API to
 // allow refreshing this by force from the UI
@@ -38,9 +109,15 @@ func (am *AwsManager) refreshLaunchTemplates() {
 				NextToken: nextToken,
 			}
 
-			output, err := e.DescribeLaunchTemplates(
+			var output *ec2.DescribeLaunchTemplatesOutput
+			err := am.withRetry(
 				context.Background(),
-				input,
+				"describing launch templates",
+				func(ctx context.Context) error {
+					var err error
+					output, err = e.DescribeLaunchTemplates(ctx, input)
+					return err
+				},
 			)
 
 			if err != nil {
@@ -51,10 +128,25 @@ func (am *AwsManager) refreshLaunchTemplates() {
 					// Translate the resulting AWS objects into our own native
 					// AwsLaunchTemplate object
 					lt := AwsLaunchTemplate{TemplateID: *l.LaunchTemplateId, Region: r}
+					nvmeTagged := false
 					for _, t := range l.Tags {
 						if *t.Key == "Interface_Description" {
 							lt.Description = *t.Value
 						}
+						if *t.Key == "Architecture" {
+							lt.Architecture = *t.Value
+						}
+						if *t.Key == "Accelerator" {
+							lt.Accelerator = *t.Value
+						}
+						if *t.Key == "AcceleratorCount" {
+							lt.AcceleratorCount, _ = strconv.Atoi(*t.Value)
+						}
+						if *t.Key == "NVMe" {
+							nvme, _ := strconv.ParseBool(*t.Value)
+							lt.NVMe = nvme
+							nvmeTagged = true
+						}
 					}
 
 					// Parse the specs from the text of the launch template
@@ -70,6 +162,16 @@ func (am *AwsManager) refreshLaunchTemplates() {
 						lt.VCPUCount = int32(vcpuCnt)
 						lt.RAM = strings.TrimSpace(specs[1])
 						lt.Bandwidth = strings.TrimSpace(specs[2])
+						lt.MemoryMiB = parseMemoryMiB(lt.RAM)
+					}
+					if !nvmeTagged {
+						lt.NVMe = instanceTypeNVMe(lt.InstanceType)
+					}
+					if lt.Architecture == "" {
+						lt.Architecture = instanceTypeArchitecture(lt.InstanceType)
+					}
+					if lt.Accelerator == "" {
+						lt.Accelerator = instanceTypeAccelerator(lt.InstanceType)
 					}
 
 					// Insert the template into our array
@@ -0,0 +1,115 @@
+package awsmgr
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// vpcPeeringKey returns the key of the peering between two VPCs, which is the
+// same regardless of which of them requested it
+func vpcPeeringKey(a, b string) string {
+	if b < a {
+		a, b = b, a
+	}
+	return a + "/" + b
+}
+
+// refreshVpcPeerings loads the active VPC peering connections from EC2. Agents
+// in different regions address each other by their private IP, which only
+// works if the VPCs they run in are peered
+func (am *AwsManager) refreshVpcPeerings() {
+	newPeerings := map[string]bool{}
+	mtx := sync.Mutex{}
+	err := am.RunEC2ForAllRegions(func(e *ec2.Client, r string) error {
+		var nextToken *string
+		for {
+			input := &ec2.DescribeVpcPeeringConnectionsInput{
+				Filters: []types.Filter{
+					{
+						Name:   aws.String("status-code"),
+						Values: []string{"active"},
+					},
+				},
+				NextToken: nextToken,
+			}
+
+			var output *ec2.DescribeVpcPeeringConnectionsOutput
+			err := am.withRetry(
+				context.Background(),
+				"describing VPC peering connections",
+				func(ctx context.Context) error {
+					var err error
+					output, err = e.DescribeVpcPeeringConnections(ctx, input)
+					return err
+				},
+			)
+			if err != nil {
+				return err
+			}
+			for _, p := range output.VpcPeeringConnections {
+				if p.RequesterVpcInfo == nil || p.AccepterVpcInfo == nil {
+					continue
+				}
+				mtx.Lock()
+				newPeerings[vpcPeeringKey(
+					aws.ToString(p.RequesterVpcInfo.VpcId),
+					aws.ToString(p.AccepterVpcInfo.VpcId),
+				)] = true
+				mtx.Unlock()
+			}
+
+			nextToken = output.NextToken
+			if nextToken == nil {
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logging.Warnf("Could not refresh VPC peerings: %v", err)
+		return
+	}
+	am.vpcPeeringsLock.Lock()
+	am.vpcPeerings = newPeerings
+	am.vpcPeeringsLock.Unlock()
+}
+
+// RegionsPeered returns true if the VPCs the agents are launched in in both
+// regions are peered, such that the agents can reach each other by their
+// private IP. Returns an error if the VPC peerings weren't loaded (yet)
+func (am *AwsManager) RegionsPeered(a, b string) (bool, error) {
+	am.vpcPeeringsLock.Lock()
+	peerings := am.vpcPeerings
+	am.vpcPeeringsLock.Unlock()
+	if peerings == nil {
+		return false, errors.New("The VPC peerings are not loaded")
+	}
+
+	vpcs := func(region string) map[string]bool {
+		ret := map[string]bool{}
+		for _, sn := range am.GetSubnetsForRegion(region) {
+			if sn.VpcID != "" {
+				ret[sn.VpcID] = true
+			}
+		}
+		return ret
+	}
+	vpcsA, vpcsB := vpcs(a), vpcs(b)
+	if len(vpcsA) == 0 || len(vpcsB) == 0 {
+		return false, nil
+	}
+	for va := range vpcsA {
+		for vb := range vpcsB {
+			if !peerings[vpcPeeringKey(va, vb)] {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,141 @@
+package awsmgr
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/batch"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+)
+
+// PermissionCheck is the outcome of testing whether the coordinator is
+// allowed to perform an AWS API action it relies on
+type PermissionCheck struct {
+	// The IAM action, such as ec2:DescribeInstances
+	Action string
+	// The resource the action was tested on, if any
+	Resource string
+	// Nil if the action is allowed
+	Err error
+}
+
+// isDryRunSuccess returns true if the error is the response of EC2 to a dry
+// run of an action the caller is allowed to perform
+func isDryRunSuccess(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "DryRunOperation"
+}
+
+// CheckPermissions tests the AWS permissions the coordinator needs, without
+// changing anything: EC2 actions are dry-run, the buckets are written to and
+// read from with a small probe object that is deleted again, and the seeder
+// job queue is looked up if one is configured
+func (am *AwsManager) CheckPermissions() []PermissionCheck {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	ret := []PermissionCheck{}
+
+	e, err := am.getEC2(region)
+	if err != nil {
+		return append(ret, PermissionCheck{Action: "ec2", Err: err})
+	}
+	_, err = e.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
+		DryRun: aws.Bool(true),
+	})
+	ret = append(ret, dryRunCheck("ec2:DescribeInstances", region, err))
+	_, err = e.DescribeLaunchTemplates(ctx, &ec2.DescribeLaunchTemplatesInput{
+		DryRun: aws.Bool(true),
+	})
+	ret = append(ret, dryRunCheck("ec2:DescribeLaunchTemplates", region, err))
+	_, err = e.DescribeSnapshots(ctx, &ec2.DescribeSnapshotsInput{
+		DryRun:   aws.Bool(true),
+		OwnerIds: []string{"self"},
+	})
+	ret = append(ret, dryRunCheck("ec2:DescribeSnapshots", region, err))
+
+	s, err := am.getS3Default()
+	if err != nil {
+		return append(ret, PermissionCheck{Action: "s3", Err: err})
+	}
+	probe := fmt.Sprintf("preflight/%d", time.Now().UnixNano())
+	for _, bucket := range []string{
+		os.Getenv("OUTPUTS_S3_BUCKET"),
+		os.Getenv("BINARIES_S3_BUCKET"),
+	} {
+		if bucket == "" {
+			continue
+		}
+		_, err = s.PutObject(ctx, &s3.PutObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(probe),
+			Body:   bytes.NewReader([]byte("preflight")),
+		})
+		ret = append(ret, PermissionCheck{
+			Action:   "s3:PutObject",
+			Resource: bucket,
+			Err:      err,
+		})
+		if err != nil {
+			continue
+		}
+		obj, err := s.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(probe),
+		})
+		if err == nil {
+			obj.Body.Close()
+		}
+		ret = append(ret, PermissionCheck{
+			Action:   "s3:GetObject",
+			Resource: bucket,
+			Err:      err,
+		})
+		_, err = s.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(probe),
+		})
+		ret = append(ret, PermissionCheck{
+			Action:   "s3:DeleteObject",
+			Resource: bucket,
+			Err:      err,
+		})
+	}
+
+	if os.Getenv("UHS_SEEDER_BATCH_JOB") != "" {
+		b, err := am.getBatchDefault()
+		if err == nil {
+			_, err = b.DescribeJobQueues(ctx, &batch.DescribeJobQueuesInput{
+				MaxResults: 1,
+			})
+		}
+		ret = append(ret, PermissionCheck{
+			Action: "batch:DescribeJobQueues",
+			Err:    err,
+		})
+	}
+	return ret
+}
+
+// dryRunCheck converts the response to a dry run EC2 call into the outcome of
+// the permission check
+func dryRunCheck(action, region string, err error) PermissionCheck {
+	if err == nil || isDryRunSuccess(err) {
+		err = nil
+	}
+	return PermissionCheck{Action: action, Resource: region, Err: err}
+}
@@ -1,11 +1,20 @@
 package awsmgr
 
 import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/smithy-go"
+	"github.com/mit-dci/opencbdc-tctl/logging"
 )
 
 // retryableErrorCodes constains a customized list of error codes we are willing
@@ -57,3 +66,121 @@ func defaultRetrier() config.LoadOptionsFunc {
 		})
 	})
 }
+
+// RetryPolicy describes how operations against AWS are retried on top of the
+// retries the AWS client already performs natively. When the AWS client gives
+// up (for instance because the API throttled us for longer than its backoff
+// allows), we wait longer and try the entire operation again - as long as the
+// error is classified as transient by IsTransientError
+type RetryPolicy struct {
+	// The maximum number of times the operation is attempted
+	MaxAttempts int
+	// The backoff before the first retry, doubled for every next retry
+	InitialBackoff time.Duration
+	// The maximum backoff between two attempts
+	MaxBackoff time.Duration
+}
+
+// retryPolicyFromEnv returns the RetryPolicy configured using the environment
+// variables AWS_RETRY_MAX_ATTEMPTS, AWS_RETRY_INITIAL_BACKOFF_MS and
+// AWS_RETRY_MAX_BACKOFF_MS, falling back to defaults for the ones not set
+func retryPolicyFromEnv() RetryPolicy {
+	p := RetryPolicy{
+		MaxAttempts:    5,
+		InitialBackoff: time.Second * 2,
+		MaxBackoff:     time.Minute,
+	}
+	if i, err := strconv.Atoi(os.Getenv("AWS_RETRY_MAX_ATTEMPTS")); err == nil &&
+		i > 0 {
+		p.MaxAttempts = i
+	}
+	if i, err := strconv.Atoi(os.Getenv("AWS_RETRY_INITIAL_BACKOFF_MS")); err == nil &&
+		i > 0 {
+		p.InitialBackoff = time.Duration(i) * time.Millisecond
+	}
+	if i, err := strconv.Atoi(os.Getenv("AWS_RETRY_MAX_BACKOFF_MS")); err == nil &&
+		i > 0 {
+		p.MaxBackoff = time.Duration(i) * time.Millisecond
+	}
+	return p
+}
+
+// IsTransientError classifies an error returned by the AWS client as transient
+// (it makes sense to try again later) or permanent (retrying will yield the
+// same result, for instance invalid parameters or missing permissions)
+func IsTransientError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	// Throttling and timeouts reported by the API
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		if _, ok := retryableErrorCodes[apiErr.ErrorCode()]; ok {
+			return true
+		}
+	}
+
+	// Server side errors
+	var responseErr *awshttp.ResponseError
+	if errors.As(err, &responseErr) &&
+		responseErr.HTTPStatusCode() >= 500 {
+		return true
+	}
+
+	// Connection problems
+	if (retry.RetryableConnectionError{}).IsErrorRetryable(err) ==
+		aws.TrueTernary {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	return false
+}
+
+// withRetry executes f and retries it according to the AwsManager's
+// RetryPolicy when it returns a transient error. Permanent errors are returned
+// immediately. The backoff between attempts is aborted when ctx is done, in
+// which case the context's error is returned
+func (am *AwsManager) withRetry(
+	ctx context.Context,
+	description string,
+	f func(ctx context.Context) error,
+) error {
+	backoff := am.retryPolicy.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := f(ctx)
+		if err == nil || !IsTransientError(err) ||
+			attempt >= am.retryPolicy.MaxAttempts {
+			return err
+		}
+
+		// Add some jitter so that parallel operations that were throttled at
+		// the same time don't all retry at the same moment
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		logging.Warnf(
+			"[AWS Manager] Transient error during %s (attempt %d/%d), retrying in %v: %v",
+			description,
+			attempt,
+			am.retryPolicy.MaxAttempts,
+			wait,
+			err,
+		)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+
+		backoff *= 2
+		if backoff > am.retryPolicy.MaxBackoff {
+			backoff = am.retryPolicy.MaxBackoff
+		}
+	}
+}
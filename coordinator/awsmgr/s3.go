@@ -80,16 +80,25 @@ func (am *AwsManager) ReadFromS3(
 	if *byteRange == "bytes=--1" {
 		byteRange = nil
 	}
-	res, err := client.GetObject(context.Background(), &s3.GetObjectInput{
-		Bucket: aws.String(d.SourceBucket),
-		Key:    aws.String(d.SourcePath),
-		Range:  byteRange,
-	})
-	if err != nil {
-		return nil, err
-	}
-	defer res.Body.Close()
-	return io.ReadAll(res.Body)
+	var b []byte
+	err = am.withRetry(
+		context.Background(),
+		fmt.Sprintf("reading %s/%s", d.SourceBucket, d.SourcePath),
+		func(ctx context.Context) error {
+			res, err := client.GetObject(ctx, &s3.GetObjectInput{
+				Bucket: aws.String(d.SourceBucket),
+				Key:    aws.String(d.SourcePath),
+				Range:  byteRange,
+			})
+			if err != nil {
+				return err
+			}
+			defer res.Body.Close()
+			b, err = io.ReadAll(res.Body)
+			return err
+		},
+	)
+	return b, err
 }
 
 // DownloadFromS3 downloads an object from an S3 bucket
@@ -131,11 +140,18 @@ func (am *AwsManager) downloadFromS3UsingClient(
 	downloader.PartSize = 5000000
 	downloader.Concurrency = 10
 	downloader.PartBodyMaxRetries = 500
-	_, err = downloader.Download(context.Background(), f,
-		&s3.GetObjectInput{
-			Bucket: bucket,
-			Key:    key,
-		})
+	err = am.withRetry(
+		context.Background(),
+		fmt.Sprintf("downloading %s/%s", d.SourceBucket, d.SourcePath),
+		func(ctx context.Context) error {
+			_, err := downloader.Download(ctx, f,
+				&s3.GetObjectInput{
+					Bucket: bucket,
+					Key:    key,
+				})
+			return err
+		},
+	)
 	if err != nil {
 		logging.Warnf(
 			"Error downloading %s/%s to %s: %v",
@@ -159,10 +175,17 @@ func (am *AwsManager) FileExistsOnS3(
 	}
 	bkt := aws.String(bucket)
 	key := aws.String(path)
-	_, err = client.HeadObject(context.Background(), &s3.HeadObjectInput{
-		Bucket: bkt,
-		Key:    key,
-	})
+	err = am.withRetry(
+		context.Background(),
+		fmt.Sprintf("checking existence of %s/%s", bucket, path),
+		func(ctx context.Context) error {
+			_, err := client.HeadObject(ctx, &s3.HeadObjectInput{
+				Bucket: bkt,
+				Key:    key,
+			})
+			return err
+		},
+	)
 	if err != nil {
 		var responseError *awshttp.ResponseError
 		if errors.As(err, &responseError) &&
@@ -174,6 +197,31 @@ func (am *AwsManager) FileExistsOnS3(
 	return true, nil
 }
 
+// PresignDownloadURL returns a pre-signed URL to download the object in the
+// given region, bucket and path with, until it expires. Whoever holds the URL
+// needs no AWS credentials of their own
+func (am *AwsManager) PresignDownloadURL(
+	region, bucket, path string,
+	expires time.Duration,
+) (string, error) {
+	client, err := am.getS3(region)
+	if err != nil {
+		return "", err
+	}
+	req, err := s3.NewPresignClient(client).PresignGetObject(
+		context.Background(),
+		&s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(path),
+		},
+		s3.WithPresignExpires(expires),
+	)
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
+
 // UploadToS3IfNotExists will check a file's existence and skip uploading if the
 // file already exists
 func (am *AwsManager) UploadToS3IfNotExists(d common.S3Upload) error {
@@ -211,11 +259,23 @@ func (am *AwsManager) UploadToS3(d common.S3Upload) error {
 	bucket := aws.String(d.TargetBucket)
 	key := aws.String(d.TargetPath)
 	uploader := manager.NewUploader(client)
-	_, err = uploader.Upload(context.Background(), &s3.PutObjectInput{
-		Bucket: bucket,
-		Key:    key,
-		Body:   f,
-	})
+	err = am.withRetry(
+		context.Background(),
+		fmt.Sprintf("uploading %s", d.SourcePath),
+		func(ctx context.Context) error {
+			// Rewind the file in case a previous attempt read from it
+			_, err := f.Seek(0, io.SeekStart)
+			if err != nil {
+				return err
+			}
+			_, err = uploader.Upload(ctx, &s3.PutObjectInput{
+				Bucket: bucket,
+				Key:    key,
+				Body:   f,
+			})
+			return err
+		},
+	)
 	if err != nil {
 		return err
 	}
@@ -298,13 +358,22 @@ func (am *AwsManager) ListObjectsInS3(
 	response := make([]string, 0)
 
 	for {
-		res, err := client.ListObjectsV2(
+		var res *s3.ListObjectsV2Output
+		err := am.withRetry(
 			context.Background(),
-			&s3.ListObjectsV2Input{
-				Bucket:            bkt,
-				Prefix:            pfx,
-				MaxKeys:           1000,
-				ContinuationToken: continuationToken,
+			fmt.Sprintf("listing %s/%s", bucket, prefix),
+			func(ctx context.Context) error {
+				var err error
+				res, err = client.ListObjectsV2(
+					ctx,
+					&s3.ListObjectsV2Input{
+						Bucket:            bkt,
+						Prefix:            pfx,
+						MaxKeys:           1000,
+						ContinuationToken: continuationToken,
+					},
+				)
+				return err
 			},
 		)
 		if err != nil {
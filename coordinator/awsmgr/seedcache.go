@@ -0,0 +1,166 @@
+package awsmgr
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// DefaultSeedValue is the value of every preseeded output
+const DefaultSeedValue int64 = 1000000
+
+// SeedCacheKey identifies the seeds generated with the same seeder commit,
+// value distribution and number of outputs. Test runs that only differ in
+// other parameters reuse the seed for their number of shards and seed mode
+type SeedCacheKey struct {
+	CommitHash string `json:"commitHash"`
+	Value      int64  `json:"value"`
+	Outputs    int    `json:"outputs"`
+}
+
+func (k SeedCacheKey) String() string {
+	return fmt.Sprintf("%d_%d_%s", k.Outputs, k.Value, k.CommitHash)
+}
+
+// CacheKey returns the key the reuse of the seed is recorded under
+func (s *ShardSeed) CacheKey() SeedCacheKey {
+	value := s.Value
+	if value == 0 {
+		value = DefaultSeedValue
+	}
+	return SeedCacheKey{
+		CommitHash: s.CommitHash,
+		Value:      value,
+		Outputs:    s.Outputs,
+	}
+}
+
+// SeedLookup is the outcome of looking up the seed a test run needs
+type SeedLookup string
+
+const (
+	// The seed was available
+	SeedLookupHit SeedLookup = "hit"
+	// The seed was being generated for another test run
+	SeedLookupShared SeedLookup = "shared"
+	// The seed had to be generated
+	SeedLookupMiss SeedLookup = "miss"
+)
+
+// SeedCacheEntry holds the usage of the seeds with one cache key
+type SeedCacheEntry struct {
+	Key           SeedCacheKey `json:"key"`
+	Hits          int          `json:"hits"`
+	Shared        int          `json:"shared"`
+	Misses        int          `json:"misses"`
+	LastUsed      time.Time    `json:"lastUsed"`
+	LastTestRunID string       `json:"lastTestRunID"`
+}
+
+// SeedCacheStats summarizes how often test runs could reuse seeds
+type SeedCacheStats struct {
+	Entries []*SeedCacheEntry `json:"entries"`
+	Hits    int               `json:"hits"`
+	Shared  int               `json:"shared"`
+	Misses  int               `json:"misses"`
+	// The fraction of lookups that did not have to generate a seed
+	HitRate float64 `json:"hitRate"`
+}
+
+// seedCachePath returns the file the seed cache statistics are persisted in
+func seedCachePath() string {
+	return filepath.Join(common.DataDir(), "seed-cache.json")
+}
+
+// loadSeedCache reads the seed cache statistics from disk. Must be called
+// with the seedCacheLock held
+func (am *AwsManager) loadSeedCache() {
+	if am.seedCache != nil {
+		return
+	}
+	am.seedCache = map[string]*SeedCacheEntry{}
+	b, err := ioutil.ReadFile(seedCachePath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logging.Warnf("Unable to read seed cache: %v", err)
+		}
+		return
+	}
+	err = json.Unmarshal(b, &am.seedCache)
+	if err != nil {
+		logging.Warnf("Unable to parse seed cache: %v", err)
+		am.seedCache = map[string]*SeedCacheEntry{}
+	}
+}
+
+// saveSeedCache writes the seed cache statistics to disk. Must be called with
+// the seedCacheLock held
+func (am *AwsManager) saveSeedCache() error {
+	b, err := json.Marshal(am.seedCache)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(seedCachePath(), b, 0644)
+}
+
+// seedCacheEntry returns the entry for the key, creating it if needed. Must
+// be called with the seedCacheLock held
+func (am *AwsManager) seedCacheEntry(key SeedCacheKey) *SeedCacheEntry {
+	am.loadSeedCache()
+	e, ok := am.seedCache[key.String()]
+	if !ok {
+		e = &SeedCacheEntry{Key: key}
+		am.seedCache[key.String()] = e
+	}
+	return e
+}
+
+// RecordSeedLookup records whether the seed a test run needs could be reused
+func (am *AwsManager) RecordSeedLookup(seed ShardSeed, lookup SeedLookup) {
+	am.seedCacheLock.Lock()
+	defer am.seedCacheLock.Unlock()
+	e := am.seedCacheEntry(seed.CacheKey())
+	switch lookup {
+	case SeedLookupHit:
+		e.Hits++
+	case SeedLookupShared:
+		e.Shared++
+	case SeedLookupMiss:
+		e.Misses++
+	}
+	e.LastUsed = time.Now()
+	e.LastTestRunID = seed.TestRunID
+	if err := am.saveSeedCache(); err != nil {
+		logging.Warnf("Unable to save seed cache: %v", err)
+	}
+}
+
+// SeedCacheStats returns the usage of the seed cache, most recently used
+// entries first
+func (am *AwsManager) SeedCacheStats() SeedCacheStats {
+	am.seedCacheLock.Lock()
+	defer am.seedCacheLock.Unlock()
+	am.loadSeedCache()
+	stats := SeedCacheStats{Entries: make([]*SeedCacheEntry, 0)}
+	for _, e := range am.seedCache {
+		c := *e
+		stats.Entries = append(stats.Entries, &c)
+		stats.Hits += e.Hits
+		stats.Shared += e.Shared
+		stats.Misses += e.Misses
+	}
+	sort.Slice(stats.Entries, func(i, j int) bool {
+		return stats.Entries[i].LastUsed.After(stats.Entries[j].LastUsed)
+	})
+	if total := stats.Hits + stats.Shared + stats.Misses; total > 0 {
+		stats.HitRate = float64(stats.Hits+stats.Shared) / float64(total)
+	}
+	return stats
+}
@@ -30,6 +30,7 @@ type ShardSeed struct {
 	SeedMode   int    `json:"mode"`
 	Shards     int    `json:"shards"`
 	Outputs    int    `json:"outputs"`
+	Value      int64  `json:"value"`
 	TestRunID  string
 	batchJobID string
 }
@@ -53,6 +54,7 @@ func (am *AwsManager) GenerateSeed(seed ShardSeed, cfg []byte) error {
 		return err
 	}
 	if !alreadyHere {
+		key := seed.CacheKey()
 		f, err := os.CreateTemp("", "")
 		if err != nil {
 			return err
@@ -97,7 +99,7 @@ func (am *AwsManager) GenerateSeed(seed ShardSeed, cfg []byte) error {
 					},
 					{
 						Name:  aws.String("SEED_VALUE"),
-						Value: aws.String("1000000"), // Fixed
+						Value: aws.String(fmt.Sprintf("%d", key.Value)),
 					},
 					{
 						Name:  aws.String("SEED_WITCOMM"),
@@ -197,7 +199,16 @@ func (am *AwsManager) refreshSeeds() error {
 			return err
 		}
 
-		out, err := batchClient.DescribeJobs(context.Background(), input)
+		var out *batch.DescribeJobsOutput
+		err = am.withRetry(
+			context.Background(),
+			"describing batch jobs",
+			func(ctx context.Context) error {
+				var err error
+				out, err = batchClient.DescribeJobs(ctx, input)
+				return err
+			},
+		)
 		if err != nil {
 			return err
 		}
@@ -290,6 +301,9 @@ func (am *AwsManager) refreshSeeds() error {
 					Outputs:    numOutputs,
 					Shards:     numShards,
 					CommitHash: commitHash,
+					// Seeds are not named by value, all of them have the
+					// default value
+					Value: DefaultSeedValue,
 				})
 			}
 		}
@@ -306,8 +320,8 @@ func (s *ShardSeed) Equals(s2 *ShardSeed) bool {
 	if (s == nil && s2 != nil) || (s != nil && s2 == nil) {
 		return false
 	}
-	if s.Outputs == s2.Outputs && s.SeedMode == s2.SeedMode &&
-		s.Shards == s2.Shards && s.CommitHash == s2.CommitHash {
+	if s.SeedMode == s2.SeedMode && s.Shards == s2.Shards &&
+		s.CacheKey() == s2.CacheKey() {
 		return true
 	}
 	return false
@@ -58,7 +58,16 @@ func (am *AwsManager) refreshLimits() {
 					ServiceCode: aws.String("ec2"),
 					NextToken:   nextToken,
 				}
-				output, err := sq.ListServiceQuotas(context.Background(), input)
+				var output *servicequotas.ListServiceQuotasOutput
+				err := am.withRetry(
+					context.Background(),
+					"listing service quotas",
+					func(ctx context.Context) error {
+						var err error
+						output, err = sq.ListServiceQuotas(ctx, input)
+						return err
+					},
+				)
 
 				if err != nil {
 					logging.Errorf("Error fetching service quota: %v", err)
@@ -0,0 +1,168 @@
+package awsmgr
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// VolumeSnapshot is an EBS snapshot of a volume that was attached to an agent
+// instance
+type VolumeSnapshot struct {
+	Region     string
+	VolumeID   string
+	SnapshotID string
+}
+
+// instanceRegion returns the region of a running instance launched by the
+// controller
+func (am *AwsManager) instanceRegion(instanceID string) (string, error) {
+	for _, i := range am.runningInstances {
+		if *i.Instance.InstanceId == instanceID {
+			return i.Region, nil
+		}
+	}
+	return "", fmt.Errorf("Instance %s is not known", instanceID)
+}
+
+// SnapshotInstanceVolumes creates EBS snapshots of all volumes attached to the
+// instance. The snapshots are tagged with the test run ID and the time they
+// expire at, such that they can be found and cleaned up from the AWS console
+// as well. This only initiates the snapshots - EBS completes them in the
+// background, and the instance can be terminated right after
+func (am *AwsManager) SnapshotInstanceVolumes(
+	instanceID string,
+	testRunID string,
+	expires time.Time,
+) ([]VolumeSnapshot, error) {
+	if !am.Enabled {
+		return nil, fmt.Errorf("AWS not enabled")
+	}
+	region, err := am.instanceRegion(instanceID)
+	if err != nil {
+		return nil, err
+	}
+	e, err := am.getEC2(region)
+	if err != nil {
+		return nil, err
+	}
+
+	var vols *ec2.DescribeVolumesOutput
+	err = am.withRetry(
+		context.Background(),
+		"describing volumes",
+		func(ctx context.Context) error {
+			var err error
+			vols, err = e.DescribeVolumes(ctx, &ec2.DescribeVolumesInput{
+				Filters: []types.Filter{
+					{
+						Name:   aws.String("attachment.instance-id"),
+						Values: []string{instanceID},
+					},
+				},
+			})
+			return err
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []VolumeSnapshot{}
+	for _, v := range vols.Volumes {
+		var snap *ec2.CreateSnapshotOutput
+		err = am.withRetry(
+			context.Background(),
+			"creating snapshot",
+			func(ctx context.Context) error {
+				var err error
+				snap, err = e.CreateSnapshot(ctx, &ec2.CreateSnapshotInput{
+					VolumeId: v.VolumeId,
+					Description: aws.String(fmt.Sprintf(
+						"Postmortem snapshot of %s for test run %s",
+						instanceID,
+						testRunID,
+					)),
+					TagSpecifications: []types.TagSpecification{
+						{
+							ResourceType: types.ResourceTypeSnapshot,
+							Tags: []types.Tag{
+								{
+									Key:   aws.String("Name"),
+									Value: aws.String("test-postmortem-" + testRunID),
+								},
+								{
+									Key:   aws.String("TestRunID"),
+									Value: aws.String(testRunID),
+								},
+								{
+									Key:   aws.String("Expires"),
+									Value: aws.String(expires.UTC().Format(time.RFC3339)),
+								},
+							},
+						},
+					},
+				})
+				return err
+			},
+		)
+		if err != nil {
+			return ret, err
+		}
+		logging.Infof(
+			"[AWS Manager] Creating snapshot %s of volume %s (instance %s)",
+			*snap.SnapshotId,
+			*v.VolumeId,
+			instanceID,
+		)
+		ret = append(ret, VolumeSnapshot{
+			Region:     region,
+			VolumeID:   *v.VolumeId,
+			SnapshotID: *snap.SnapshotId,
+		})
+	}
+	return ret, nil
+}
+
+// DeleteVolumeSnapshot deletes an EBS snapshot
+func (am *AwsManager) DeleteVolumeSnapshot(region, snapshotID string) error {
+	e, err := am.getEC2(region)
+	if err != nil {
+		return err
+	}
+	return am.withRetry(
+		context.Background(),
+		"deleting snapshot",
+		func(ctx context.Context) error {
+			_, err := e.DeleteSnapshot(ctx, &ec2.DeleteSnapshotInput{
+				SnapshotId: aws.String(snapshotID),
+			})
+			return err
+		},
+	)
+}
+
+// DeleteFromS3 deletes an object from an S3 bucket
+func (am *AwsManager) DeleteFromS3(region, bucket, path string) error {
+	client, err := am.getS3(region)
+	if err != nil {
+		return err
+	}
+	return am.withRetry(
+		context.Background(),
+		fmt.Sprintf("deleting %s", path),
+		func(ctx context.Context) error {
+			_, err := client.DeleteObject(ctx, &s3.DeleteObjectInput{
+				Bucket: aws.String(bucket),
+				Key:    aws.String(path),
+			})
+			return err
+		},
+	)
+}
@@ -37,9 +37,15 @@ func (awsm *AwsManager) CancelSpotRequests(
 
 	for {
 		sirReq.NextToken = nextToken
-		sirResp, err := clt.DescribeSpotInstanceRequests(
+		var sirResp *ec2.DescribeSpotInstanceRequestsOutput
+		err := awsm.withRetry(
 			context.Background(),
-			sirReq,
+			"describing spot instance requests",
+			func(ctx context.Context) error {
+				var err error
+				sirResp, err = clt.DescribeSpotInstanceRequests(ctx, sirReq)
+				return err
+			},
 		)
 		if err == nil {
 			logging.Infof(
@@ -75,9 +81,15 @@ func (awsm *AwsManager) CancelSpotRequests(
 		cancelReq := &ec2.CancelSpotInstanceRequestsInput{
 			SpotInstanceRequestIds: cancelSpotRequests,
 		}
-		cancelResp, err := clt.CancelSpotInstanceRequests(
+		var cancelResp *ec2.CancelSpotInstanceRequestsOutput
+		err := awsm.withRetry(
 			context.Background(),
-			cancelReq,
+			"canceling spot instance requests",
+			func(ctx context.Context) error {
+				var err error
+				cancelResp, err = clt.CancelSpotInstanceRequests(ctx, cancelReq)
+				return err
+			},
 		)
 		if err == nil {
 			logging.Infof(
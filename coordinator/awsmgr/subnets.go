@@ -6,6 +6,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 )
 
@@ -30,14 +31,28 @@ func (am *AwsManager) refreshSubnets() {
 				NextToken: nextToken,
 			}
 
-			output, err := e.DescribeSubnets(context.Background(), input)
+			var output *ec2.DescribeSubnetsOutput
+			err := am.withRetry(
+				context.Background(),
+				"describing subnets",
+				func(ctx context.Context) error {
+					var err error
+					output, err = e.DescribeSubnets(ctx, input)
+					return err
+				},
+			)
 
 			if err != nil {
 				return err
 			} else {
 				nextToken = output.NextToken
 				for _, s := range output.Subnets {
-					sn := AwsSubnet{SubnetID: *s.SubnetId, Region: r, AZ: *s.AvailabilityZone}
+					sn := AwsSubnet{
+						SubnetID: *s.SubnetId,
+						Region:   r,
+						AZ:       *s.AvailabilityZone,
+						VpcID:    aws.ToString(s.VpcId),
+					}
 					for _, t := range s.Tags {
 						if *t.Key == "Name" {
 							sn.Name = *t.Value
@@ -65,7 +80,8 @@ func (am *AwsManager) refreshSubnets() {
 
 // refreshSubnetsLoop is launched in a separate goroutine when creating a new
 // AwsManager. It will refresh the available subnets either when the user forces
-// it through the forceRefreshSubnets channel, or after 15 minutes have passed
+// it through the forceRefreshSubnets channel, or after 15 minutes have passed.
+// The VPC peerings between the regions are refreshed along with them
 func (am *AwsManager) refreshSubnetsLoop() {
 	for {
 		select {
@@ -74,6 +90,7 @@ func (am *AwsManager) refreshSubnetsLoop() {
 		}
 
 		am.refreshSubnets()
+		am.refreshVpcPeerings()
 	}
 }
 
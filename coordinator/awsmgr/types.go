@@ -12,6 +12,16 @@ type AwsLaunchTemplate struct {
 	VCPUCount    int32
 	RAM          string `json:"ram"`
 	Bandwidth    string `json:"bandwidth"`
+	// The CPU architecture of the instance type (amd64 or arm64)
+	Architecture string `json:"architecture"`
+	// The kind of accelerators of the instance type (gpu, neuron or fpga),
+	// if any, and their number if known
+	Accelerator      string `json:"accelerator,omitempty"`
+	AcceleratorCount int    `json:"acceleratorCount,omitempty"`
+	// The memory of the instance type in MiB, parsed from RAM, and whether
+	// it has local NVMe instance storage
+	MemoryMiB int64 `json:"memoryMiB,omitempty"`
+	NVMe      bool  `json:"nvme,omitempty"`
 }
 
 // AwsSubnet describes an AWS EC2 subnet
@@ -20,6 +30,7 @@ type AwsSubnet struct {
 	SubnetID string `json:"id"`
 	AZ       string `json:"az"`
 	Name     string `json:"name"`
+	VpcID    string `json:"vpcId"`
 }
 
 // AwsInstance describes a running AWS EC2 instance
@@ -24,14 +24,72 @@ type Coordinator struct {
 	agentsLock  sync.Mutex        // Lock guarding the agents array
 	events      chan Event        // The channel for real-time (websocket)info
 	maintenance bool              // The current state of the maintenance mode
+	// The enrollment methods agents are allowed to use. If empty, enrollment
+	// is not enforced
+	enrollmentMethods []string
+	// The registered authenticators for agent enrollment, keyed by method
+	authenticators map[string]EnrollmentAuthenticator
+	// Lock guarding authenticators
+	authenticatorsLock sync.Mutex
+	// The authenticator for one-time bootstrap tokens, which is always
+	// registered
+	bootstrapTokens *BootstrapTokenAuthenticator
+	// The announcements shown to the users of the system
+	announcements []Announcement
+	// Lock guarding announcements
+	announcementsLock sync.Mutex
+	// The authenticator for the credentials handed out to agents by
+	// credential rotation, which is always registered
+	agentCredentials *AgentCredentialAuthenticator
+	// The credential rotations performed since startup
+	credentialRotations []*CredentialRotation
+	// Lock guarding credentialRotations
+	credentialRotationsLock sync.Mutex
+	// The experimental capabilities and their rollout, keyed by name
+	featureFlags map[string]FeatureFlag
+	// Lock guarding featureFlags
+	featureFlagsLock sync.Mutex
+	// Lock guarding the audit log file
+	auditLock sync.Mutex
+	// The func the health samples reported by the agents are passed to, if
+	// any
+	agentHealthFunc atomic.Value
+	// The func the output lines streamed by the agents are passed to, if any
+	agentLogLinesFunc atomic.Value
+	// The persistent identities of the agents
+	identities map[string]*agentIdentity
+	// Lock guarding identities
+	identitiesLock sync.Mutex
+	// The pools of static agents, which also authenticate the join tokens
+	// of their agents
+	agentPools *JoinTokenAuthenticator
 }
 
 // ConnectedAgent holds the information for a currently connected test agent
 type ConnectedAgent struct {
 	// The ID for the connected agent
 	ID int32 `json:"id"`
-	// The underlying wire connection to this agent
+	// The underlying wire connection to this agent. It is replaced when an
+	// agent with a persistent identity resumes its session
 	conn *wire.Conn
+	// Closed when the current connection is lost or replaced, to end the
+	// loops sending and pinging over it
+	done chan struct{}
+	// The persistent identity of the agent, if it has one
+	Identity string `json:"-"`
+	// The pool of static agents the agent joined, if any
+	Pool string `json:"pool,omitempty"`
+	// Set while the agent is disconnected and its session is kept for it to
+	// resume
+	Disconnected *time.Time `json:"disconnected,omitempty"`
+	// The number of times the agent resumed its session
+	Reconnects int `json:"reconnects"`
+	// The session an agent that connected resumed. The connection is handed
+	// over to that session once the agent is told
+	resumedInto *ConnectedAgent
+	// The messages that could not be sent over the previous connection, which
+	// are sent first once the agent resumes its session
+	unsent []wire.Msg
 	// The channel to send messages to the agent
 	outgoing chan wire.Msg
 	// Indicates if the agent has completed its handshake with the coordinator
@@ -42,6 +100,8 @@ type ConnectedAgent struct {
 	AgentVersion string `json:"agentVersion"`
 	// The current ping roundtrip time as measured from the coordinator
 	PingRTT float64 `json:"pingRTT"`
+	// The most recent utilization the agent reported
+	Health *common.AgentHealthSample `json:"health,omitempty"`
 	// The array of registered listeners that are expecting reply or update
 	// messages
 	listeners []*agentReplyListener
@@ -49,7 +109,7 @@ type ConnectedAgent struct {
 	listenersLock sync.Mutex
 	// Indicates if this connection is (being) closed
 	closed bool
-	// The lock guarding closed
+	// The lock guarding closed, conn, done, Disconnected and unsent
 	closeLock sync.Mutex
 }
 
@@ -57,7 +117,7 @@ type ConnectedAgent struct {
 // of the coordinator logic can require listening to updates from the agent,
 // which can either be reply messages to a specific message sent by us (matched
 // on ID) or it can be streaming updates for a particular running command
-// (matched on commandID)
+// (matched on commandID) or file transfer (matched on transferID)
 type agentReplyListener struct {
 	// The channel to which the subscriber is listening for update(s)
 	replyChan chan wire.Msg
@@ -67,6 +127,9 @@ type agentReplyListener struct {
 	// The command ID we are awaiting updates for (or nil if it is a
 	// listener for a reply message)
 	commandID []byte
+	// The transfer ID we are awaiting progress updates for (or nil if it is
+	// not a transfer listener)
+	transferID []byte
 }
 
 // NewCoordinator creates a new instance of the Coordinator type, listening on
@@ -78,12 +141,32 @@ func NewCoordinator(ev chan Event, port int) (*Coordinator, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Coordinator{
-		server:     srv,
-		agents:     []*ConnectedAgent{},
-		agentsLock: sync.Mutex{},
-		events:     ev,
-	}, nil
+	c := &Coordinator{
+		server:             srv,
+		agents:             []*ConnectedAgent{},
+		agentsLock:         sync.Mutex{},
+		events:             ev,
+		enrollmentMethods:  enrollmentMethodsFromEnv(),
+		authenticators:     map[string]EnrollmentAuthenticator{},
+		authenticatorsLock: sync.Mutex{},
+		bootstrapTokens:    NewBootstrapTokenAuthenticator(),
+		announcements:      []Announcement{},
+		announcementsLock:  sync.Mutex{},
+		agentCredentials:   NewAgentCredentialAuthenticator(),
+		featureFlags:       map[string]FeatureFlag{},
+		featureFlagsLock:   sync.Mutex{},
+		identities:         map[string]*agentIdentity{},
+		identitiesLock:     sync.Mutex{},
+		agentPools:         NewJoinTokenAuthenticator(),
+	}
+	c.loadAgentIdentities()
+	c.RegisterEnrollmentAuthenticator(c.bootstrapTokens)
+	c.RegisterEnrollmentAuthenticator(c.agentCredentials)
+	c.RegisterEnrollmentAuthenticator(c.agentPools)
+	go c.credentialRotationLoop()
+	c.initAnnouncements()
+	c.initFeatureFlags()
+	return c, nil
 }
 
 // RunServer is the main loop for the endpoint that agents connect to - it will
@@ -97,24 +180,19 @@ func (c *Coordinator) RunServer() error {
 		}
 
 		// Create a new ConnectedAgent struct and append it to the array
-		// of active connected agents
+		// of active connected agents. Agents with a persistent identity
+		// get the ID of their identity once they complete the handshake
 		connectedAgent := ConnectedAgent{
-			conn:          clt,
 			ID:            atomic.AddInt32(&c.nextAgentID, 1),
 			outgoing:      make(chan wire.Msg, 100),
 			listenersLock: sync.Mutex{},
 			listeners:     []*agentReplyListener{},
 		}
-		clt.Tag = fmt.Sprintf("Agent %d", connectedAgent.ID)
 		c.addAgent(&connectedAgent)
+		c.attachConnection(&connectedAgent, clt)
 
 		// Process the incoming messages (from the agent) in a new goroutine
-		go c.handleConn(&connectedAgent)
-		// Process sending outgoing messages (to the agent) in a new goroutine
-		go connectedAgent.sendLoop()
-		// Start a separate loop that pings the agent to see if the connection
-		// remains alive, and what the roundtrip time on the TCP connection is
-		go c.pingLoop(&connectedAgent)
+		go c.handleConn(&connectedAgent, clt)
 	}
 }
 
@@ -150,7 +228,7 @@ func (c *Coordinator) removeAgent(agent *ConnectedAgent) {
 	c.agentsLock.Lock()
 	newAgents := make([]*ConnectedAgent, 0)
 	for _, a := range c.agents {
-		if a.ID != agent.ID {
+		if a != agent {
 			newAgents = append(newAgents, a)
 		}
 	}
@@ -202,7 +280,7 @@ func (c *Coordinator) SendToAgent(
 		return err
 	}
 	if replyChan != nil {
-		a.conn.SetMessageID(msg)
+		a.connection().SetMessageID(msg)
 		l := agentReplyListener{
 			ourID:     wire.GetMessageHeaderID(msg, "ID"),
 			replyChan: replyChan,
@@ -250,25 +328,53 @@ func (c *Coordinator) RegisterCommandStatusCallback(
 	return nil
 }
 
-// handleConn is responsible for handling a single connected agent's incoming
+// RegisterTransferProgressCallback will register a listener for the progress
+// messages of the file transfer specified by transferID on the agent specified
+// by agentID and will deliver those updates to replyChan
+func (c *Coordinator) RegisterTransferProgressCallback(
+	agentID int32,
+	transferID []byte,
+	replyChan chan wire.Msg,
+) error {
+	a, err := c.GetAgent(agentID)
+	if err != nil {
+		return err
+	}
+	logging.Debugf(
+		"Registered transfer callback for agent %d, transfer %x with channel %v",
+		agentID,
+		transferID,
+		replyChan,
+	)
+	l := agentReplyListener{
+		ourID:      -1, /* will never match */
+		transferID: transferID,
+		replyChan:  replyChan,
+	}
+	a.listenersLock.Lock()
+	a.listeners = append(a.listeners, &l)
+	a.listenersLock.Unlock()
+	return nil
+}
+
+// handleConn is responsible for handling a single connection's incoming
 // messages, calling handleMsg() on them and send the result of handling the
-// message back to the agent using sendMsg()
-func (c *Coordinator) handleConn(agent *ConnectedAgent) {
+// message back to the agent using sendMsg(). If the agent resumes a session
+// over the connection, the messages are handled for that session from then on
+func (c *Coordinator) handleConn(agent *ConnectedAgent, conn *wire.Conn) {
 	for {
 		// Read the next message from the connection
-		msg, err := agent.conn.Recv()
+		msg, err := conn.Recv()
 		if err != nil {
-			// If something goes wrong, close the connection
-			// and remove the agent. If the error is not EOF
-			// (which indicates the remote site terminated the
+			// If something goes wrong, close the connection. If the error
+			// is not EOF (which indicates the remote site terminated the
 			// connection), log whatever went wrong as well
 			if err.Error() != "EOF" {
 				logging.Warnf("Agent %d: Error reading message: %v", agent.ID, err.Error())
 			} else {
 				logging.Infof("Agent %d disconnected", agent.ID)
 			}
-			agent.conn.Close()
-			c.removeAgent(agent)
+			c.connectionLost(agent, conn)
 			return
 		}
 		// Read the ID from the incoming message
@@ -290,16 +396,41 @@ func (c *Coordinator) handleConn(agent *ConnectedAgent) {
 			// Set the YourID on the message header to the ID of the incoming
 			// message to indicate that we are responding to that
 			wire.SetMessageHeaderID(returnMsg, "YourID", int(id))
-			// Send our reply or error back to the agent
-			err = agent.sendMsg(returnMsg)
-			if err != nil {
-				// if we were unable to send, remove the agent. The only
-				// error that can occur in sendMsg is that the agent was
-				// closed already - in which case we shouldn't call close()
-				// again
-				c.removeAgent(agent)
-				return
+			if agent.resumedInto != nil {
+				agent = c.completeResume(agent, returnMsg)
+				continue
 			}
+			if !agent.handshakeComplete {
+				// The agent is disconnected below, so write the error
+				// before closing the connection in stead of queueing it
+				err = conn.Send(returnMsg)
+				if err != nil {
+					logging.Warnf(
+						"Agent %d: Error sending handshake error: %v",
+						agent.ID,
+						err,
+					)
+				}
+			} else {
+				// Send our reply or error back to the agent
+				err = agent.sendMsg(returnMsg)
+				if err != nil {
+					// The only error that can occur in sendMsg is that the
+					// agent was closed already, in which case it is already
+					// removed
+					return
+				}
+			}
+		}
+		// If the agent failed to complete its handshake, it has not properly
+		// enrolled and we should not keep the connection around
+		if !agent.handshakeComplete {
+			logging.Warnf(
+				"Agent %d did not complete handshake, disconnecting",
+				agent.ID,
+			)
+			c.connectionLost(agent, conn)
+			return
 		}
 	}
 }
@@ -313,17 +444,32 @@ func (c *Coordinator) handleMsg(
 	var err error
 	var reply wire.Msg
 
+	// Until the agent has completed the handshake (which includes enrollment)
+	// we will not process any other message
+	_, isHello := msg.(*wire.HelloMsg)
+	if !agent.handshakeComplete && !isHello {
+		return nil, fmt.Errorf(
+			"agent has not completed handshake, cannot process message of type %T",
+			msg,
+		)
+	}
+
 	switch t := msg.(type) {
 	case *wire.HelloMsg:
 		reply, err = c.handleHello(agent, t)
 	case *wire.UpdateSystemInfoMsg:
 		reply, err = c.handleUpdateSystemInfo(agent, t)
+	case *wire.AgentHealthMsg:
+		reply, err = c.handleAgentHealth(agent, t)
+	case *wire.LogLinesMsg:
+		reply, err = c.handleLogLines(agent, t)
 	default:
 		// Check if someone's waiting for the reply
 		repliedToID := wire.GetMessageHeaderID(t, "YourID")
 		newListeners := make([]*agentReplyListener, 0)
 		sentReply := false
 		cmdStatus, isCmdStatus := msg.(*wire.ExecuteCommandStatusMsg)
+		transfer, isTransfer := msg.(*wire.TransferProgressMsg)
 		agent.listenersLock.Lock()
 		defer agent.listenersLock.Unlock()
 		for _, rl := range agent.listeners {
@@ -363,6 +509,20 @@ func (c *Coordinator) handleMsg(
 					// the next update message
 					newListeners = append(newListeners, rl)
 				}
+			} else if isTransfer && bytes.Equal(rl.transferID, transfer.TransferID) {
+				// This message is a progress update for a file transfer this
+				// listener is registered to listen to. Progress updates are
+				// informational, so they are dropped rather than blocking the
+				// connection if the channel is full
+				select {
+				case rl.replyChan <- msg:
+				default:
+				}
+				sentReply = true
+				if transfer.Phase != wire.TransferPhaseDone &&
+					transfer.Phase != wire.TransferPhaseFailed {
+					newListeners = append(newListeners, rl)
+				}
 			} else {
 				// This listener was irrelevant for this message, so we will
 				// need to continue using it for matching future messages
@@ -389,6 +549,13 @@ func (c *Coordinator) handleMsg(
 			return nil, nil
 		}
 
+		// Same for progress updates of transfers nobody is listening to (any
+		// more), and for updates of commands whose completion was already
+		// delivered when the agent resumed its session
+		if isTransfer || isCmdStatus {
+			return nil, nil
+		}
+
 		// If we received a message that is no reply, no hello or systemInfo
 		// update, no command status update and no ack, then we don't know how
 		// to process it - but it cannot just be ignored. We should return an
@@ -406,15 +573,53 @@ func (c *Coordinator) handleMsg(
 }
 
 // handleHello handles the initial handshake from the agent and sets some
-// additional metadata about the agent (system info and agent version)
+// additional metadata about the agent (system info and agent version). The
+// agent's enrollment credential is verified first - if that fails, the
+// handshake is rejected. Agents presenting a resume token for their
+// persistent identity resume their session in stead, and agents presenting a
+// new identity are handed the token to resume their session with. Static
+// agents presenting a join token are placed in the pool it belongs to
 func (c *Coordinator) handleHello(
 	agent *ConnectedAgent,
 	msg *wire.HelloMsg,
 ) (wire.Msg, error) {
+	if agent.handshakeComplete {
+		return nil, errors.New("handshake was already completed")
+	}
+	if msg.AgentIdentity != "" && len(msg.ResumeToken) > 0 {
+		return c.resumeAgent(agent, msg)
+	}
+	err := c.authenticateEnrollment(agent, msg)
+	if err != nil {
+		return nil, err
+	}
+	// Join tokens are checked even if enrollment is not enforced, since
+	// they determine the pool of the agent
+	if msg.EnrollmentMethod == common.EnrollmentMethodJoinToken {
+		pool, err := c.agentPools.poolForToken(msg.EnrollmentCredential)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrEnrollmentRejected, err)
+		}
+		c.identitiesLock.Lock()
+		agent.Pool = pool
+		c.identitiesLock.Unlock()
+	}
+	reply := &wire.HelloResponseMsg{}
+	if msg.AgentIdentity != "" {
+		reply.ResumeToken, err = c.registerAgentIdentity(
+			agent,
+			msg.AgentIdentity,
+			msg.EnrollmentCredential,
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
 	agent.SystemInfo = msg.SystemInfo
 	agent.AgentVersion = msg.AgentVersion
 	agent.handshakeComplete = true
-	return &wire.HelloResponseMsg{YourAgentID: agent.ID}, nil
+	reply.YourAgentID = agent.ID
+	return reply, nil
 }
 
 // handleUpdateSystemInfo will update the known system information for a
@@ -427,14 +632,87 @@ func (c *Coordinator) handleUpdateSystemInfo(
 	return nil, nil
 }
 
+// AgentHealthFunc is called with the health samples reported by the agents
+type AgentHealthFunc func(agentID int32, sample common.AgentHealthSample)
+
+// SetAgentHealthFunc sets the func the health samples reported by the agents
+// are passed to
+func (c *Coordinator) SetAgentHealthFunc(f AgentHealthFunc) {
+	c.agentHealthFunc.Store(f)
+}
+
+// handleAgentHealth records the utilization the agent reported when it sends
+// an AgentHealthMsg, and passes it on to the agent health func
+func (c *Coordinator) handleAgentHealth(
+	agent *ConnectedAgent,
+	msg *wire.AgentHealthMsg,
+) (wire.Msg, error) {
+	sample := common.AgentHealthSample{
+		Time:             time.Unix(0, msg.Time),
+		CPUPercent:       msg.CPUPercent,
+		MemTotal:         msg.MemTotal,
+		MemAvailable:     msg.MemAvailable,
+		DiskAvailable:    msg.DiskAvailable,
+		NetRxBytesPerSec: msg.NetRxBytesPerSec,
+		NetTxBytesPerSec: msg.NetTxBytesPerSec,
+	}
+	agent.Health = &sample
+	if f, ok := c.agentHealthFunc.Load().(AgentHealthFunc); ok {
+		f(agent.ID, sample)
+	}
+	return nil, nil
+}
+
+// AgentLogLinesFunc is called with the output lines streamed by the agents
+type AgentLogLinesFunc func(
+	agentID int32,
+	lines []RoleLogLine,
+	skippedBytes int64,
+)
+
+// SetAgentLogLinesFunc sets the func the output lines streamed by the agents
+// are passed to
+func (c *Coordinator) SetAgentLogLinesFunc(f AgentLogLinesFunc) {
+	c.agentLogLinesFunc.Store(f)
+}
+
+// handleLogLines passes the output lines the agent streams in a LogLinesMsg
+// on to the agent log lines func. The agent waits for the acknowledgement
+// before it sends more than a few messages, so it's only sent once the lines
+// were passed on
+func (c *Coordinator) handleLogLines(
+	agent *ConnectedAgent,
+	msg *wire.LogLinesMsg,
+) (wire.Msg, error) {
+	if f, ok := c.agentLogLinesFunc.Load().(AgentLogLinesFunc); ok {
+		lines := make([]RoleLogLine, len(msg.Lines))
+		for i, l := range msg.Lines {
+			lines[i] = RoleLogLine{
+				CommandID: fmt.Sprintf("%x", l.CommandID),
+				Stream:    "stdout",
+				Line:      l.Line,
+			}
+			if l.Stderr {
+				lines[i].Stream = "stderr"
+			}
+		}
+		f(agent.ID, lines, msg.SkippedBytes)
+	}
+	return &wire.LogLinesAckMsg{}, nil
+}
+
 // pingLoop send a PingMsg to the connected agent every 30 seconds and records
-// the time needed to get the Ack message back. If there is no reply for five
-// seconds, we record a no-reply. If this happens three times in a row, we
-// consider the agent dead and disconnect it.
-func (c *Coordinator) pingLoop(a *ConnectedAgent) {
+// the time needed to get the Ack message back, until done is closed. If there
+// is no reply for five seconds, we record a no-reply. If this happens three
+// times in a row, we consider the connection dead and close it.
+func (c *Coordinator) pingLoop(a *ConnectedAgent, done chan struct{}) {
 	noReplyCount := 0
 	for {
-		time.Sleep(time.Second * 30)
+		select {
+		case <-done:
+			return
+		case <-time.After(time.Second * 30):
+		}
 		rc := make(chan wire.Msg, 1)
 		start := time.Now()
 		err := c.SendToAgent(a.ID, &wire.PingMsg{}, rc)
@@ -444,8 +722,7 @@ func (c *Coordinator) pingLoop(a *ConnectedAgent) {
 				return
 			}
 			logging.Errorf("Error sending ping to agent: %v", err)
-			a.close()
-			c.removeAgent(a)
+			a.connection().Close()
 			return
 		}
 
@@ -458,11 +735,12 @@ func (c *Coordinator) pingLoop(a *ConnectedAgent) {
 			)
 			noReplyCount = 0
 			break
+		case <-done:
+			return
 		case <-time.After(5 * time.Second):
 			noReplyCount++
 			if noReplyCount > 3 { // Disconnect agent - no reply for 3 consecutive pings
-				a.close()
-				c.removeAgent(a)
+				a.connection().Close()
 				return
 			}
 			a.PingRTT = -1
@@ -470,15 +748,33 @@ func (c *Coordinator) pingLoop(a *ConnectedAgent) {
 	}
 }
 
+// connection returns the current connection to the agent
+func (a *ConnectedAgent) connection() *wire.Conn {
+	a.closeLock.Lock()
+	defer a.closeLock.Unlock()
+	return a.conn
+}
+
 // sendMsg places the msg argument in the queue for sending to the agent. First
 // the sendMsg method checks if the connection is not yet (being) closed and
-// returns an error if that is the case.
+// returns an error if that is the case. While the agent is disconnected, the
+// messages are kept in the queue until it resumes its session
 func (a *ConnectedAgent) sendMsg(msg wire.Msg) (err error) {
 	a.closeLock.Lock()
 	defer a.closeLock.Unlock()
 	if a.closed {
 		return errors.New("chan is closed")
 	}
+	if a.Disconnected != nil {
+		select {
+		case a.outgoing <- msg:
+		default:
+			// Nothing drains the queue until the agent resumes its session,
+			// so keep the message aside rather than blocking until then
+			a.unsent = append(a.unsent, msg)
+		}
+		return nil
+	}
 	a.outgoing <- msg
 	return nil
 }
@@ -495,20 +791,46 @@ func (a *ConnectedAgent) close() {
 	a.closeLock.Unlock()
 }
 
-// sendLoop is responsible for sending the messages in the outgoing channel to
-// the wire. It will exit when there have been no messages for 20 minutes.
-func (a *ConnectedAgent) sendLoop() {
+// sendLoop is responsible for queueing the messages in the outgoing channel on
+// the wire connection, which writes them by priority such that control
+// messages are not delayed by file transfers. It will exit when done is
+// closed, or close the connection when there have been no messages for 20
+// minutes. Messages that could not be sent are kept, and sent first once the
+// agent resumes its session
+func (a *ConnectedAgent) sendLoop(conn *wire.Conn, done chan struct{}) {
+	a.closeLock.Lock()
+	unsent := a.unsent
+	a.unsent = nil
+	a.closeLock.Unlock()
+	for i, msg := range unsent {
+		if err := conn.Queue(msg); err != nil {
+			a.closeLock.Lock()
+			a.unsent = append(unsent[i:], a.unsent...)
+			a.closeLock.Unlock()
+			conn.Close()
+			return
+		}
+	}
+
 	for {
 		select {
-		case msg := <-a.outgoing:
-			err := a.conn.Send(msg)
+		case <-done:
+			return
+		case msg, ok := <-a.outgoing:
+			if !ok {
+				return
+			}
+			err := conn.Queue(msg)
 			if err != nil {
 				logging.Infof(
 					"Could not send message to agent %d: %v",
 					a.ID,
 					err,
 				)
-				a.close()
+				a.closeLock.Lock()
+				a.unsent = append(a.unsent, msg)
+				a.closeLock.Unlock()
+				conn.Close()
 				return
 			}
 		case <-time.After(20 * time.Minute):
@@ -516,7 +838,7 @@ func (a *ConnectedAgent) sendLoop() {
 				"Did not receive message from agent %d for 20 minutes, closing",
 				a.ID,
 			)
-			a.close()
+			conn.Close()
 			return
 		}
 	}
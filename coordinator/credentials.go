@@ -0,0 +1,370 @@
+package coordinator
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+	"github.com/mit-dci/opencbdc-tctl/wire"
+)
+
+var ErrCredentialRotationInProgress = errors.New(
+	"a credential rotation is already in progress",
+)
+
+// credentialRotationAgentTimeout is the time an agent gets to acknowledge its
+// new credential before it is considered to have failed the rotation
+const credentialRotationAgentTimeout = time.Second * 30
+
+// AgentCredentialAuthenticator is an EnrollmentAuthenticator that accepts the
+// credentials the coordinator handed to agents during credential rotation.
+// Only the SHA-256 hashes of the credentials are kept, and they are persisted
+// such that agents can still enroll after the coordinator restarts
+type AgentCredentialAuthenticator struct {
+	// The time each (hashed) credential was issued
+	credentials     map[string]time.Time
+	credentialsLock sync.Mutex
+}
+
+// agentCredentialsPath returns the path of the file the agent credential
+// hashes are persisted in
+func agentCredentialsPath() string {
+	return filepath.Join(common.DataDir(), "agent-credentials.json")
+}
+
+// NewAgentCredentialAuthenticator creates a new AgentCredentialAuthenticator
+// and loads the persisted credentials
+func NewAgentCredentialAuthenticator() *AgentCredentialAuthenticator {
+	a := &AgentCredentialAuthenticator{
+		credentials:     map[string]time.Time{},
+		credentialsLock: sync.Mutex{},
+	}
+	f, err := os.Open(agentCredentialsPath())
+	if err == nil {
+		defer f.Close()
+		err = json.NewDecoder(f).Decode(&a.credentials)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		logging.Warnf("Unable to load agent credentials: %v", err)
+	}
+	return a
+}
+
+// Method implements EnrollmentAuthenticator
+func (a *AgentCredentialAuthenticator) Method() string {
+	return common.EnrollmentMethodAgentCredential
+}
+
+func hashAgentCredential(credential []byte) string {
+	h := sha256.Sum256(credential)
+	return hex.EncodeToString(h[:])
+}
+
+// Authenticate implements EnrollmentAuthenticator
+func (a *AgentCredentialAuthenticator) Authenticate(
+	credential []byte,
+	remoteAddr net.Addr,
+) error {
+	a.credentialsLock.Lock()
+	defer a.credentialsLock.Unlock()
+	if _, ok := a.credentials[hashAgentCredential(credential)]; !ok {
+		return errors.New("unknown or revoked agent credential")
+	}
+	return nil
+}
+
+// issue generates a new random credential and registers it as valid
+func (a *AgentCredentialAuthenticator) issue() ([]byte, error) {
+	credential, err := common.RandomIDBytes(32)
+	if err != nil {
+		return nil, err
+	}
+	a.credentialsLock.Lock()
+	defer a.credentialsLock.Unlock()
+	a.credentials[hashAgentCredential(credential)] = time.Now()
+	return credential, a.persist()
+}
+
+// revoke invalidates the given credential
+func (a *AgentCredentialAuthenticator) revoke(credential []byte) error {
+	a.credentialsLock.Lock()
+	defer a.credentialsLock.Unlock()
+	delete(a.credentials, hashAgentCredential(credential))
+	return a.persist()
+}
+
+// revokeIssuedBefore invalidates all credentials issued before the given time,
+// except the ones (by their hashes) to keep, and returns the hashes of the
+// credentials revoked
+func (a *AgentCredentialAuthenticator) revokeIssuedBefore(
+	t time.Time,
+	keep map[string]bool,
+) ([]string, error) {
+	a.credentialsLock.Lock()
+	defer a.credentialsLock.Unlock()
+	revoked := []string{}
+	for h, issued := range a.credentials {
+		if issued.Before(t) && !keep[h] {
+			delete(a.credentials, h)
+			revoked = append(revoked, h)
+		}
+	}
+	return revoked, a.persist()
+}
+
+// persist writes the credential hashes to disk. Expects the caller to hold
+// credentialsLock
+func (a *AgentCredentialAuthenticator) persist() error {
+	f, err := os.OpenFile(
+		agentCredentialsPath(),
+		os.O_CREATE|os.O_WRONLY|os.O_TRUNC,
+		0600,
+	)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(a.credentials)
+}
+
+// CredentialRotationAgentStatus is the state of a single agent within a
+// credential rotation
+type CredentialRotationAgentStatus string
+
+const CredentialRotationAgentPending CredentialRotationAgentStatus = "pending"
+const CredentialRotationAgentRotated CredentialRotationAgentStatus = "rotated"
+const CredentialRotationAgentFailed CredentialRotationAgentStatus = "failed"
+
+// CredentialRotationAgent tracks the progress of a single agent within a
+// credential rotation
+type CredentialRotationAgent struct {
+	AgentID int32                         `json:"agentID"`
+	Status  CredentialRotationAgentStatus `json:"status"`
+	Error   string                        `json:"error,omitempty"`
+}
+
+// CredentialRotation describes a fleet-wide rotation of the agent credentials.
+// Every connected agent is handed a new credential. Once all agents have
+// acknowledged (or failed to acknowledge) their new credential, all
+// credentials issued before the start of the rotation are revoked, except the
+// ones of the agents that failed to acknowledge theirs. These keep their old
+// credential until the next rotation, in stead of being locked out
+type CredentialRotation struct {
+	ID string `json:"id"`
+	// Either "manual" or "scheduled"
+	Trigger   string                     `json:"trigger"`
+	Started   time.Time                  `json:"started"`
+	Completed time.Time                  `json:"completed"`
+	Agents    []*CredentialRotationAgent `json:"agents"`
+	// The number of old credentials that were revoked at the end of the
+	// rotation
+	Revoked int `json:"revoked"`
+	// The number of old credentials that were kept since their agents
+	// failed the rotation
+	Kept int `json:"kept"`
+}
+
+// copy returns a deep copy of the rotation that is safe to serialize while
+// the rotation is in progress. Expects the caller to hold
+// credentialRotationsLock
+func (r *CredentialRotation) copy() CredentialRotation {
+	c := *r
+	c.Agents = make([]*CredentialRotationAgent, len(r.Agents))
+	for i, a := range r.Agents {
+		ac := *a
+		c.Agents[i] = &ac
+	}
+	return c
+}
+
+// CredentialRotations returns all credential rotations performed since the
+// coordinator started, most recent last
+func (c *Coordinator) CredentialRotations() []CredentialRotation {
+	c.credentialRotationsLock.Lock()
+	defer c.credentialRotationsLock.Unlock()
+	rotations := make([]CredentialRotation, len(c.credentialRotations))
+	for i, r := range c.credentialRotations {
+		rotations[i] = r.copy()
+	}
+	return rotations
+}
+
+// RotateAgentCredentials starts a fleet-wide credential rotation in the
+// background and returns it. Only one rotation can be in progress at a time
+func (c *Coordinator) RotateAgentCredentials(
+	trigger string,
+) (CredentialRotation, error) {
+	id, err := common.RandomID(12)
+	if err != nil {
+		return CredentialRotation{}, err
+	}
+
+	c.credentialRotationsLock.Lock()
+	for _, r := range c.credentialRotations {
+		if r.Completed.IsZero() {
+			c.credentialRotationsLock.Unlock()
+			return CredentialRotation{}, ErrCredentialRotationInProgress
+		}
+	}
+	rotation := &CredentialRotation{
+		ID:      id,
+		Trigger: trigger,
+		Started: time.Now(),
+		Agents:  []*CredentialRotationAgent{},
+	}
+	agents := make([]*ConnectedAgent, 0)
+	for _, a := range c.GetAgents() {
+		if a == nil || !a.handshakeComplete {
+			continue
+		}
+		agents = append(agents, a)
+		rotation.Agents = append(rotation.Agents, &CredentialRotationAgent{
+			AgentID: a.ID,
+			Status:  CredentialRotationAgentPending,
+		})
+	}
+	c.credentialRotations = append(c.credentialRotations, rotation)
+	result := rotation.copy()
+	c.credentialRotationsLock.Unlock()
+
+	go c.runCredentialRotation(rotation, agents)
+	return result, nil
+}
+
+// runCredentialRotation hands out the new credentials to the agents in
+// parallel, records the outcome per agent and revokes the old credentials
+func (c *Coordinator) runCredentialRotation(
+	rotation *CredentialRotation,
+	agents []*ConnectedAgent,
+) {
+	logging.Infof(
+		"[Credential rotation %s] Rotating credentials for %d agents",
+		rotation.ID,
+		len(agents),
+	)
+	var wg sync.WaitGroup
+	for i, a := range agents {
+		wg.Add(1)
+		go func(a *ConnectedAgent, status *CredentialRotationAgent) {
+			defer wg.Done()
+			err := c.rotateAgentCredential(a)
+			c.credentialRotationsLock.Lock()
+			defer c.credentialRotationsLock.Unlock()
+			if err != nil {
+				logging.Warnf(
+					"[Credential rotation %s] Agent %d failed: %v",
+					rotation.ID,
+					a.ID,
+					err,
+				)
+				status.Status = CredentialRotationAgentFailed
+				status.Error = err.Error()
+				return
+			}
+			status.Status = CredentialRotationAgentRotated
+		}(a, rotation.Agents[i])
+	}
+	wg.Wait()
+
+	keep := map[string]bool{}
+	c.credentialRotationsLock.Lock()
+	for i, a := range agents {
+		if rotation.Agents[i].Status == CredentialRotationAgentRotated {
+			continue
+		}
+		if h := c.agentCredentialHash(a); h != "" {
+			keep[h] = true
+		}
+	}
+	c.credentialRotationsLock.Unlock()
+
+	revoked, err := c.agentCredentials.revokeIssuedBefore(
+		rotation.Started,
+		keep,
+	)
+	if err != nil {
+		logging.Warnf(
+			"[Credential rotation %s] Unable to persist revocation: %v",
+			rotation.ID,
+			err,
+		)
+	}
+	c.dropRevokedIdentities(revoked)
+	c.credentialRotationsLock.Lock()
+	rotation.Revoked = len(revoked)
+	rotation.Kept = len(keep)
+	rotation.Completed = time.Now()
+	c.credentialRotationsLock.Unlock()
+	logging.Infof(
+		"[Credential rotation %s] Completed, revoked %d old credentials and kept %d of agents that failed",
+		rotation.ID,
+		len(revoked),
+		len(keep),
+	)
+}
+
+// rotateAgentCredential issues a new credential for the agent and sends it
+// over, waiting for the agent to acknowledge that it stored the credential
+func (c *Coordinator) rotateAgentCredential(a *ConnectedAgent) error {
+	credential, err := c.agentCredentials.issue()
+	if err != nil {
+		return err
+	}
+
+	replyChan := make(chan wire.Msg, 1)
+	err = c.SendToAgent(
+		a.ID,
+		&wire.RotateCredentialRequestMsg{Credential: credential},
+		replyChan,
+	)
+	if err == nil {
+		select {
+		case reply := <-replyChan:
+			switch t := reply.(type) {
+			case *wire.RotateCredentialResponseMsg:
+				if !t.Success {
+					err = errors.New("agent was unable to store the credential")
+				}
+			case *wire.ErrorMsg:
+				err = fmt.Errorf("agent returned error: %v", t.Error)
+			default:
+				err = fmt.Errorf("unexpected reply of type %T", t)
+			}
+		case <-time.After(credentialRotationAgentTimeout):
+			err = errors.New("timeout waiting for the agent to acknowledge")
+		}
+	}
+	if err != nil {
+		// The agent does not have this credential, so don't leave it valid
+		_ = c.agentCredentials.revoke(credential)
+		c.dropRevokedIdentities([]string{hashAgentCredential(credential)})
+		return err
+	}
+	return c.linkAgentCredential(a, credential)
+}
+
+// credentialRotationLoop rotates the agent credentials periodically when
+// AGENT_CREDENTIAL_ROTATION_HOURS is set to a positive number of hours
+func (c *Coordinator) credentialRotationLoop() {
+	hours, _ := strconv.Atoi(os.Getenv("AGENT_CREDENTIAL_ROTATION_HOURS"))
+	if hours <= 0 {
+		return
+	}
+	for {
+		time.Sleep(time.Duration(hours) * time.Hour)
+		_, err := c.RotateAgentCredentials("scheduled")
+		if err != nil {
+			logging.Warnf("Unable to start scheduled credential rotation: %v", err)
+		}
+	}
+}
@@ -0,0 +1,422 @@
+package depcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// immutableSuffixes are the URL suffixes of files that never change once
+// published, such as packages and release tarballs. These are served from the
+// cache without contacting the upstream server. Everything else (for instance
+// apt package indices) is fetched from upstream first, and only served from
+// the cache when upstream is unavailable
+var immutableSuffixes = []string{
+	".deb",
+	".tar.gz",
+	".tgz",
+	".tar.xz",
+	".tar.bz2",
+	".zip",
+}
+
+// defaultAllowedHosts are the upstream hosts the cache fetches from when
+// DEPENDENCY_CACHE_ALLOWED_HOSTS is not set. Subdomains of these hosts are
+// allowed as well
+var defaultAllowedHosts = []string{
+	"ubuntu.com",
+	"debian.org",
+	"github.com",
+	"githubusercontent.com",
+	"pypi.org",
+	"pythonhosted.org",
+}
+
+// privateNetworks are the address ranges of the VPC the agents reach the
+// coordinator on
+var privateNetworks = []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16"}
+
+// DependencyCache is a caching HTTP proxy for the third-party dependencies
+// that are downloaded while setting up the build environment and agents. It
+// acts as a forward proxy for plain HTTP requests (which is what apt uses when
+// http_proxy is set), and serves arbitrary URLs - including HTTPS ones - on
+// the /fetch?url= endpoint for scripts that download source tarballs. It only
+// listens on the loopback and private interfaces, and only fetches from the
+// allowed upstream hosts, such that it can't be used as an open proxy
+type DependencyCache struct {
+	port         int
+	allowedHosts []string
+	client       *http.Client
+	// Serializes writing entries into the cache
+	lock        sync.Mutex
+	hits        int64
+	misses      int64
+	staleServed int64
+}
+
+// DependencyCacheStats describes the state of the dependency cache
+type DependencyCacheStats struct {
+	Enabled     bool  `json:"enabled"`
+	Port        int   `json:"port"`
+	Entries     int   `json:"entries"`
+	SizeBytes   int64 `json:"sizeBytes"`
+	Hits        int64 `json:"hits"`
+	Misses      int64 `json:"misses"`
+	StaleServed int64 `json:"staleServed"`
+}
+
+// cacheEntryMeta is persisted alongside each cached file
+type cacheEntryMeta struct {
+	URL         string    `json:"url"`
+	ContentType string    `json:"contentType"`
+	Fetched     time.Time `json:"fetched"`
+}
+
+// PortFromEnv reads the port the dependency cache listens on from the
+// DEPENDENCY_CACHE_PORT environment variable. The cache is disabled when it
+// is not set
+func PortFromEnv() int {
+	port, _ := strconv.Atoi(os.Getenv("DEPENDENCY_CACHE_PORT"))
+	return port
+}
+
+// allowedHostsFromEnv reads the comma separated upstream hosts the cache may
+// fetch from in DEPENDENCY_CACHE_ALLOWED_HOSTS, or returns
+// defaultAllowedHosts if it is not set
+func allowedHostsFromEnv() []string {
+	v := os.Getenv("DEPENDENCY_CACHE_ALLOWED_HOSTS")
+	if v == "" {
+		return defaultAllowedHosts
+	}
+	hosts := []string{}
+	for _, h := range strings.Split(v, ",") {
+		h = strings.ToLower(strings.TrimSpace(h))
+		if h != "" {
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts
+}
+
+// NewDependencyCache creates a dependency cache listening on the given port.
+// A port of 0 disables the cache
+func NewDependencyCache(port int) *DependencyCache {
+	d := &DependencyCache{
+		port:         port,
+		allowedHosts: allowedHostsFromEnv(),
+		lock:         sync.Mutex{},
+	}
+	d.client = &http.Client{
+		Timeout: time.Minute * 30,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if !d.hostAllowed(req.URL) {
+				return fmt.Errorf("redirect to %s is not allowed", req.URL.Host)
+			}
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return nil
+		},
+	}
+	return d
+}
+
+// hostAllowed returns true if the cache may fetch the URL, which is the case
+// for http(s) URLs on the allowed hosts and their subdomains
+func (d *DependencyCache) hostAllowed(u *url.URL) bool {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, h := range d.allowedHosts {
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return true
+		}
+	}
+	return false
+}
+
+// Enabled returns true if the dependency cache is configured to run
+func (d *DependencyCache) Enabled() bool {
+	return d.port != 0
+}
+
+// ProxyURL returns the URL to set as http_proxy for processes running on the
+// coordinator, or an empty string if the cache is disabled
+func (d *DependencyCache) ProxyURL() string {
+	if !d.Enabled() {
+		return ""
+	}
+	return fmt.Sprintf("http://127.0.0.1:%d", d.port)
+}
+
+// cacheDir returns the directory the cached files are stored in
+func cacheDir() string {
+	return filepath.Join(common.DataDir(), "depcache", "http")
+}
+
+// listenAddresses returns the addresses the cache listens on: the loopback
+// address for the builds on the coordinator, and the private addresses of the
+// coordinator in the VPC for the agents
+func listenAddresses() ([]string, error) {
+	nets := []*net.IPNet{}
+	for _, n := range privateNetworks {
+		_, ipNet, err := net.ParseCIDR(n)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	ret := []string{"127.0.0.1"}
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok || ipNet.IP.To4() == nil {
+			continue
+		}
+		for _, n := range nets {
+			if n.Contains(ipNet.IP) {
+				ret = append(ret, ipNet.IP.String())
+				break
+			}
+		}
+	}
+	return ret, nil
+}
+
+// Run starts serving the cache. Returns immediately when the cache is
+// disabled
+func (d *DependencyCache) Run() error {
+	if !d.Enabled() {
+		return nil
+	}
+	err := os.MkdirAll(cacheDir(), 0755)
+	if err != nil {
+		return err
+	}
+	addrs, err := listenAddresses()
+	if err != nil {
+		return err
+	}
+	errs := make(chan error, len(addrs))
+	for _, a := range addrs {
+		addr := net.JoinHostPort(a, strconv.Itoa(d.port))
+		logging.Infof("Starting dependency cache on %s", addr)
+		go func() {
+			errs <- http.ListenAndServe(addr, d)
+		}()
+	}
+	return <-errs
+}
+
+// ServeHTTP implements http.Handler
+func (d *DependencyCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.URL.IsAbs() {
+		// Forward proxy request
+		if !d.hostAllowed(r.URL) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		d.serveCached(w, r, r.URL.String())
+		return
+	}
+	if r.URL.Path == "/fetch" {
+		u, err := url.Parse(r.URL.Query().Get("url"))
+		if err != nil || !u.IsAbs() {
+			http.Error(w, "Request format incorrect", http.StatusBadRequest)
+			return
+		}
+		if !d.hostAllowed(u) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		d.serveCached(w, r, u.String())
+		return
+	}
+	http.Error(w, "Not found", http.StatusNotFound)
+}
+
+func cacheKey(url string) string {
+	h := sha256.Sum256([]byte(url))
+	return hex.EncodeToString(h[:])
+}
+
+func isImmutable(url string) bool {
+	path := strings.SplitN(url, "?", 2)[0]
+	for _, s := range immutableSuffixes {
+		if strings.HasSuffix(path, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveCached serves the URL from the cache or from upstream, depending on
+// whether the URL is considered immutable and whether upstream is available
+func (d *DependencyCache) serveCached(
+	w http.ResponseWriter,
+	r *http.Request,
+	url string,
+) {
+	key := cacheKey(url)
+	dataPath := filepath.Join(cacheDir(), key)
+	_, err := os.Stat(dataPath)
+	cached := err == nil
+
+	if cached && isImmutable(url) {
+		atomic.AddInt64(&d.hits, 1)
+		d.serveFile(w, r, key)
+		return
+	}
+
+	resp, err := d.client.Get(url)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		if resp != nil {
+			defer resp.Body.Close()
+		}
+		if cached {
+			logging.Warnf(
+				"Dependency cache: upstream unavailable for %s, serving cached copy",
+				url,
+			)
+			atomic.AddInt64(&d.staleServed, 1)
+			d.serveFile(w, r, key)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(resp.StatusCode)
+		_, _ = io.Copy(w, resp.Body)
+		return
+	}
+	defer resp.Body.Close()
+	atomic.AddInt64(&d.misses, 1)
+
+	// Stream the response to the client while writing it into the cache
+	tmp, err := ioutil.TempFile(cacheDir(), "download-*")
+	if err != nil {
+		logging.Warnf("Dependency cache: unable to create temp file: %v", err)
+		w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+		_, _ = io.Copy(w, resp.Body)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+	if resp.ContentLength >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+	_, err = io.Copy(io.MultiWriter(w, tmp), resp.Body)
+	tmp.Close()
+	if err != nil {
+		logging.Warnf("Dependency cache: download of %s failed: %v", url, err)
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	err = os.Rename(tmp.Name(), dataPath)
+	if err != nil {
+		logging.Warnf("Dependency cache: unable to store %s: %v", url, err)
+		return
+	}
+	b, err := json.Marshal(cacheEntryMeta{
+		URL:         url,
+		ContentType: resp.Header.Get("Content-Type"),
+		Fetched:     time.Now(),
+	})
+	if err == nil {
+		err = ioutil.WriteFile(dataPath+".json", b, 0644)
+	}
+	if err != nil {
+		logging.Warnf("Dependency cache: unable to store metadata: %v", err)
+	}
+}
+
+// serveFile serves a cached entry
+func (d *DependencyCache) serveFile(
+	w http.ResponseWriter,
+	r *http.Request,
+	key string,
+) {
+	dataPath := filepath.Join(cacheDir(), key)
+	var meta cacheEntryMeta
+	b, err := ioutil.ReadFile(dataPath + ".json")
+	if err == nil {
+		_ = json.Unmarshal(b, &meta)
+	}
+	f, err := os.Open(dataPath)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	if meta.ContentType != "" {
+		w.Header().Set("Content-Type", meta.ContentType)
+	}
+	http.ServeContent(w, r, "", meta.Fetched, f)
+}
+
+// Stats returns the number of cached entries, their total size and the cache
+// hit counters since the coordinator started
+func (d *DependencyCache) Stats() DependencyCacheStats {
+	stats := DependencyCacheStats{
+		Enabled:     d.Enabled(),
+		Port:        d.port,
+		Hits:        atomic.LoadInt64(&d.hits),
+		Misses:      atomic.LoadInt64(&d.misses),
+		StaleServed: atomic.LoadInt64(&d.staleServed),
+	}
+	entries, err := ioutil.ReadDir(cacheDir())
+	if err != nil {
+		return stats
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		if !strings.HasSuffix(e.Name(), ".json") &&
+			!strings.HasPrefix(e.Name(), "download-") {
+			stats.Entries++
+		}
+		stats.SizeBytes += e.Size()
+	}
+	return stats
+}
+
+// Clear removes all cached files
+func (d *DependencyCache) Clear() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	logging.Infof("Clearing dependency cache")
+	err := os.RemoveAll(cacheDir())
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(cacheDir(), 0755)
+}
@@ -0,0 +1,184 @@
+package coordinator
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/wire"
+)
+
+var ErrEnrollmentRejected = errors.New("agent enrollment rejected")
+
+// EnrollmentAuthenticator is the interface that pluggable enrollment methods
+// implement. When an agent connects, it presents a credential in its HelloMsg
+// along with the method it used to obtain it. The coordinator then looks up the
+// authenticator for that method and asks it to verify the credential. This
+// allows adding new enrollment methods (for instance TPM attestation) without
+// modifying the handshake logic
+type EnrollmentAuthenticator interface {
+	// Method returns the name of the enrollment method this authenticator
+	// verifies, which is matched against HelloMsg.EnrollmentMethod
+	Method() string
+	// Authenticate verifies the credential presented by the agent connecting
+	// from remoteAddr, returning an error when the agent should not be allowed
+	// to join the fleet
+	Authenticate(credential []byte, remoteAddr net.Addr) error
+}
+
+// RegisterEnrollmentAuthenticator makes the given authenticator available for
+// verifying agents that enroll using its method
+func (c *Coordinator) RegisterEnrollmentAuthenticator(
+	a EnrollmentAuthenticator,
+) {
+	c.authenticatorsLock.Lock()
+	defer c.authenticatorsLock.Unlock()
+	c.authenticators[a.Method()] = a
+}
+
+// MaxBootstrapTokenValidity is the longest validity period a bootstrap token
+// can be issued with, such that tokens don't become long-lived secrets
+const MaxBootstrapTokenValidity = 24 * time.Hour
+
+// IssueBootstrapToken creates a new one-time bootstrap token that an agent can
+// use to enroll with the coordinator within the given validity period
+func (c *Coordinator) IssueBootstrapToken(
+	validity time.Duration,
+) (string, time.Time, error) {
+	if validity <= 0 || validity > MaxBootstrapTokenValidity {
+		return "", time.Time{}, fmt.Errorf(
+			"bootstrap tokens are valid for at most %v",
+			MaxBootstrapTokenValidity,
+		)
+	}
+	return c.bootstrapTokens.Issue(validity)
+}
+
+// authenticateEnrollment verifies the enrollment credential in the HelloMsg
+// against the authenticator registered for the method that the agent used. If
+// no enrollment methods are configured, every agent is accepted as before
+func (c *Coordinator) authenticateEnrollment(
+	agent *ConnectedAgent,
+	msg *wire.HelloMsg,
+) error {
+	if len(c.enrollmentMethods) == 0 {
+		return nil
+	}
+
+	allowed := false
+	for _, m := range c.enrollmentMethods {
+		if m == msg.EnrollmentMethod {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return fmt.Errorf(
+			"%w: method [%s] is not allowed",
+			ErrEnrollmentRejected,
+			msg.EnrollmentMethod,
+		)
+	}
+
+	c.authenticatorsLock.Lock()
+	a, ok := c.authenticators[msg.EnrollmentMethod]
+	c.authenticatorsLock.Unlock()
+	if !ok {
+		return fmt.Errorf(
+			"%w: method [%s] is not available",
+			ErrEnrollmentRejected,
+			msg.EnrollmentMethod,
+		)
+	}
+
+	err := a.Authenticate(msg.EnrollmentCredential, agent.conn.RemoteAddr())
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrEnrollmentRejected, err)
+	}
+	return nil
+}
+
+// enrollmentMethodsFromEnv reads the enrollment methods that agents are allowed
+// to use from the AGENT_ENROLLMENT_METHODS environment variable (comma
+// separated). When empty, enrollment is not enforced
+func enrollmentMethodsFromEnv() []string {
+	methods := make([]string, 0)
+	for _, m := range strings.Split(os.Getenv("AGENT_ENROLLMENT_METHODS"), ",") {
+		m = strings.TrimSpace(m)
+		if m != "" {
+			methods = append(methods, m)
+		}
+	}
+	return methods
+}
+
+// BootstrapTokenAuthenticator is an EnrollmentAuthenticator that accepts
+// one-time tokens issued by the coordinator. Each token can only be used once
+// and expires after its validity period. Tokens are only kept in memory, so
+// restarting the coordinator invalidates all outstanding tokens
+type BootstrapTokenAuthenticator struct {
+	tokens     map[string]time.Time
+	tokensLock sync.Mutex
+}
+
+// NewBootstrapTokenAuthenticator creates a new BootstrapTokenAuthenticator
+// without any tokens issued
+func NewBootstrapTokenAuthenticator() *BootstrapTokenAuthenticator {
+	return &BootstrapTokenAuthenticator{
+		tokens:     map[string]time.Time{},
+		tokensLock: sync.Mutex{},
+	}
+}
+
+// Method implements EnrollmentAuthenticator
+func (b *BootstrapTokenAuthenticator) Method() string {
+	return common.EnrollmentMethodBootstrapToken
+}
+
+// Issue generates a new random token that is valid for the given duration and
+// returns it together with its expiry time
+func (b *BootstrapTokenAuthenticator) Issue(
+	validity time.Duration,
+) (string, time.Time, error) {
+	token, err := common.RandomID(32)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expires := time.Now().Add(validity)
+
+	b.tokensLock.Lock()
+	defer b.tokensLock.Unlock()
+	// Clean up expired tokens while we're holding the lock anyway
+	for t, exp := range b.tokens {
+		if time.Now().After(exp) {
+			delete(b.tokens, t)
+		}
+	}
+	b.tokens[token] = expires
+	return token, expires, nil
+}
+
+// Authenticate implements EnrollmentAuthenticator. The token is consumed
+// regardless of whether it was still valid
+func (b *BootstrapTokenAuthenticator) Authenticate(
+	credential []byte,
+	remoteAddr net.Addr,
+) error {
+	b.tokensLock.Lock()
+	defer b.tokensLock.Unlock()
+	token := string(credential)
+	expires, ok := b.tokens[token]
+	if !ok {
+		return errors.New("unknown bootstrap token")
+	}
+	delete(b.tokens, token)
+	if time.Now().After(expires) {
+		return errors.New("bootstrap token expired")
+	}
+	return nil
+}
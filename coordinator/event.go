@@ -118,3 +118,144 @@ type RedownloadCompletePayload struct {
 	TestRunID string `json:"testRunID"`
 	Error     string `json:"error"`
 }
+
+// EventTypeAnnouncementsChanged is fired when an announcement is added,
+// removed or expires, and contains the currently active announcements
+const EventTypeAnnouncementsChanged EventType = "announcementsChanged"
+
+type AnnouncementsChangedPayload struct {
+	Announcements []Announcement `json:"announcements"`
+}
+
+// EventTypeCompileProgress is fired for every progress update while compiling
+// the binaries for a test run, including the build output, and while
+// distributing them to the agents - in which case AgentID identifies the agent
+// and Line describes its status. Like the test run log, it is only sent to the
+// users looking at the details of the given test
+const EventTypeCompileProgress EventType = "compileProgress"
+
+type CompileProgressPayload struct {
+	TestRunID  string  `json:"testRunID"`
+	Seeder     bool    `json:"seeder"`
+	Phase      string  `json:"phase"`
+	Percent    float64 `json:"percent"`
+	Line       string  `json:"line,omitempty"`
+	Bytes      int64   `json:"bytes,omitempty"`
+	TotalBytes int64   `json:"totalBytes,omitempty"`
+	AgentID    int32   `json:"agentID,omitempty"`
+}
+
+// EventTypeSweepBudgetReached is fired when the runs of a sweep used up its
+// budget and its remaining runs are held. The owner of the sweep is asked to
+// extend the budget or trim the remaining runs
+const EventTypeSweepBudgetReached EventType = "sweepBudgetReached"
+
+type SweepBudgetReachedPayload struct {
+	SweepID         string             `json:"sweepID"`
+	OwnerThumbprint string             `json:"ownerThumbprint"`
+	Budget          common.SweepBudget `json:"budget"`
+	Used            common.SweepBudget `json:"used"`
+	HeldRuns        int                `json:"heldRuns"`
+}
+
+// EventTypeLiveMetrics is fired periodically while a test run generates load,
+// with the throughput and latency of the seconds for which the load generators
+// reported new samples. Points for a second that was sent before replace the
+// earlier ones. Like the test run log, it is only sent to the users looking at
+// the details of the given test
+const EventTypeLiveMetrics EventType = "liveMetrics"
+
+type LiveMetricsPayload struct {
+	TestRunID string             `json:"testRunID"`
+	Points    []LiveMetricsPoint `json:"points"`
+}
+
+// LiveMetricsPoint is the throughput and latency of the transactions completed
+// by all load generators of a test run in a second
+type LiveMetricsPoint struct {
+	Time       int64   `json:"time"`
+	Throughput float64 `json:"throughput"`
+	LatencyAvg float64 `json:"latencyAvg"`
+	LatencyMax float64 `json:"latencyMax"`
+}
+
+// EventTypeAgentHealth is fired when an agent that is part of a running test
+// run reports the utilization of its system. Like the live metrics, it is only
+// sent to the users looking at the details of the given test
+const EventTypeAgentHealth EventType = "agentHealth"
+
+type AgentHealthPayload struct {
+	TestRunID string                   `json:"testRunID"`
+	AgentID   int32                    `json:"agentID"`
+	Sample    common.AgentHealthSample `json:"sample"`
+}
+
+// EventTypeRoleLogLines is fired when an agent that is part of a running test
+// run streams the lines its commands wrote to their output. It is only sent to
+// the users that subscribed to the logs of the roles, with a RoleLogFilter
+const EventTypeRoleLogLines EventType = "roleLogLines"
+
+type RoleLogLinesPayload struct {
+	TestRunID string `json:"testRunID"`
+	AgentID   int32  `json:"agentID"`
+	// The roles of the test run that run on the agent
+	Roles []common.TestRunRoleRef `json:"roles"`
+	Lines []RoleLogLine           `json:"lines"`
+	// The number of bytes of output the agent skipped since the previous
+	// lines, because the stream fell too far behind
+	SkippedBytes int64 `json:"skippedBytes,omitempty"`
+}
+
+// RoleLogLine is a line a command of a role wrote to its output
+type RoleLogLine struct {
+	CommandID string `json:"commandID"`
+	// The role the command was started for, empty if the command is not
+	// one of a role
+	Role  common.SystemRole `json:"role,omitempty"`
+	Index int               `json:"roleIdx"`
+	// Either "stdout" or "stderr"
+	Stream string `json:"stream"`
+	Line   string `json:"line"`
+}
+
+// RoleLogFilter selects the roles of a test run to stream the logs of. Roles
+// can be selected by their kind and optionally index, or by the agent they run
+// on
+type RoleLogFilter struct {
+	TestRunID string            `json:"testRunID"`
+	Role      common.SystemRole `json:"role,omitempty"`
+	Index     *int              `json:"roleIdx,omitempty"`
+	AgentID   int32             `json:"agentID,omitempty"`
+}
+
+// MatchesAgent returns whether the filter selects the agent running the given
+// roles
+func (f RoleLogFilter) MatchesAgent(
+	agentID int32,
+	roles []common.TestRunRoleRef,
+) bool {
+	if f.AgentID != 0 && f.AgentID != agentID {
+		return false
+	}
+	if f.Role == "" {
+		return true
+	}
+	for _, r := range roles {
+		if r.Role == f.Role && (f.Index == nil || r.Index == *f.Index) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchesLine returns whether the filter selects the role that wrote the line
+// on the agent
+func (f RoleLogFilter) MatchesLine(agentID int32, l RoleLogLine) bool {
+	if f.AgentID != 0 && f.AgentID != agentID {
+		return false
+	}
+	if f.Role == "" {
+		return true
+	}
+	return l.Role == f.Role && (f.Index == nil || l.Index == *f.Index)
+}
@@ -0,0 +1,220 @@
+package coordinator
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+var ErrFeatureFlagNotFound = errors.New("feature flag not found")
+var ErrInvalidFeatureFlag = errors.New("invalid feature flag")
+
+var validFeatureFlagName = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_.-]*$`)
+
+// FeatureFlag gates an experimental capability of the coordinator, such that
+// it can be rolled out to a subset of the users and test runs, and rolled
+// back, without redeploying the coordinator
+type FeatureFlag struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// Disabling the flag turns the capability off everywhere, including for
+	// test runs it was turned on for before
+	Enabled bool `json:"enabled"`
+	// Thumbprints of the users the capability is on for, and who get it in
+	// all the test runs they schedule
+	Users []string `json:"users"`
+	// Percentage (0-100) of the test runs the capability is on for, picked
+	// by test run ID
+	Percentage          int       `json:"percentage"`
+	Updated             time.Time `json:"updated"`
+	UpdatedByThumbprint string    `json:"updatedByThumbprint"`
+}
+
+// featureFlagsPath returns the path of the file the feature flags are
+// configured in
+func featureFlagsPath() string {
+	return filepath.Join(common.DataDir(), "feature-flags.json")
+}
+
+// loadFeatureFlags reads the feature flag configuration from disk
+func (c *Coordinator) loadFeatureFlags() error {
+	c.featureFlagsLock.Lock()
+	defer c.featureFlagsLock.Unlock()
+	f, err := os.Open(featureFlagsPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	return json.NewDecoder(f).Decode(&c.featureFlags)
+}
+
+// persistFeatureFlags writes the feature flags to disk. Expects the caller to
+// hold featureFlagsLock
+func (c *Coordinator) persistFeatureFlags() error {
+	f, err := os.OpenFile(
+		featureFlagsPath(),
+		os.O_CREATE|os.O_WRONLY|os.O_TRUNC,
+		0644,
+	)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(c.featureFlags)
+}
+
+// initFeatureFlags loads the feature flag configuration
+func (c *Coordinator) initFeatureFlags() {
+	err := c.loadFeatureFlags()
+	if err != nil {
+		logging.Warnf("Unable to load feature flags: %v", err)
+	}
+}
+
+// FeatureFlags returns the configured feature flags, sorted by name
+func (c *Coordinator) FeatureFlags() []FeatureFlag {
+	c.featureFlagsLock.Lock()
+	defer c.featureFlagsLock.Unlock()
+	ret := make([]FeatureFlag, 0, len(c.featureFlags))
+	for _, f := range c.featureFlags {
+		ret = append(ret, f)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret
+}
+
+// SetFeatureFlag validates and persists the configuration of a feature flag,
+// adding it if it doesn't exist yet
+func (c *Coordinator) SetFeatureFlag(
+	f FeatureFlag,
+	updatedByThumbprint string,
+) (FeatureFlag, error) {
+	if !validFeatureFlagName.MatchString(f.Name) ||
+		f.Percentage < 0 || f.Percentage > 100 {
+		return f, ErrInvalidFeatureFlag
+	}
+	if f.Users == nil {
+		f.Users = []string{}
+	}
+	f.Updated = time.Now()
+	f.UpdatedByThumbprint = updatedByThumbprint
+
+	c.featureFlagsLock.Lock()
+	defer c.featureFlagsLock.Unlock()
+	if c.featureFlags == nil {
+		c.featureFlags = map[string]FeatureFlag{}
+	}
+	prev, existed := c.featureFlags[f.Name]
+	c.featureFlags[f.Name] = f
+	err := c.persistFeatureFlags()
+	if err != nil {
+		if existed {
+			c.featureFlags[f.Name] = prev
+		} else {
+			delete(c.featureFlags, f.Name)
+		}
+		return f, err
+	}
+	logging.Infof(
+		"Feature flag %s changed by %s: enabled=%t, %d user(s), %d%% of runs",
+		f.Name,
+		updatedByThumbprint,
+		f.Enabled,
+		len(f.Users),
+		f.Percentage,
+	)
+	return f, nil
+}
+
+// RemoveFeatureFlag removes a feature flag, which turns the capability off
+// everywhere
+func (c *Coordinator) RemoveFeatureFlag(name string) error {
+	c.featureFlagsLock.Lock()
+	defer c.featureFlagsLock.Unlock()
+	f, ok := c.featureFlags[name]
+	if !ok {
+		return ErrFeatureFlagNotFound
+	}
+	delete(c.featureFlags, name)
+	err := c.persistFeatureFlags()
+	if err != nil {
+		c.featureFlags[name] = f
+	}
+	return err
+}
+
+// FeatureFlagEnabled returns true if the flag exists and is enabled. Test
+// runs have to check this in addition to the flags they were assigned, such
+// that disabling a flag rolls it back for runs that are already scheduled
+func (c *Coordinator) FeatureFlagEnabled(name string) bool {
+	c.featureFlagsLock.Lock()
+	defer c.featureFlagsLock.Unlock()
+	return c.featureFlags[name].Enabled
+}
+
+// forUser returns true if the capability is on for the user with the given
+// thumbprint
+func (f FeatureFlag) forUser(thumbprint string) bool {
+	if !f.Enabled {
+		return false
+	}
+	if f.Percentage >= 100 {
+		return true
+	}
+	for _, u := range f.Users {
+		if u == thumbprint {
+			return true
+		}
+	}
+	return false
+}
+
+// rolloutBucket deterministically maps the test run to a bucket in [0, 100)
+// for the flag, such that the percentage rollouts of different flags pick
+// independent sets of runs
+func rolloutBucket(flag, runID string) int {
+	h := sha256.Sum256([]byte(flag + "/" + runID))
+	return int(binary.BigEndian.Uint64(h[:8]) % 100)
+}
+
+// FeatureFlagsForUser returns the enabled flags that are on for the user with
+// the given thumbprint
+func (c *Coordinator) FeatureFlagsForUser(thumbprint string) []string {
+	ret := []string{}
+	for _, f := range c.FeatureFlags() {
+		if f.forUser(thumbprint) {
+			ret = append(ret, f.Name)
+		}
+	}
+	return ret
+}
+
+// FeatureFlagsForRun returns the enabled flags that are on for the test run
+// with the given ID, scheduled by the user with the given thumbprint. The
+// flags are assigned when the run is scheduled, such that the runs with and
+// without a capability can be compared afterwards
+func (c *Coordinator) FeatureFlagsForRun(
+	runID string,
+	thumbprint string,
+) []string {
+	ret := []string{}
+	for _, f := range c.FeatureFlags() {
+		if f.forUser(thumbprint) ||
+			(f.Enabled && rolloutBucket(f.Name, runID) < f.Percentage) {
+			ret = append(ret, f.Name)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,359 @@
+package http
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// defaultFederationPollInterval is the interval at which the secondary
+// coordinators are polled if the federation config doesn't specify one
+const defaultFederationPollInterval = time.Minute
+
+// FederationPeer is a secondary coordinator whose runs and agents are shown
+// by this (primary) coordinator. The primary authenticates to the peer with a
+// client certificate, which has to be added as a user on the peer
+type FederationPeer struct {
+	Name string `json:"name"`
+	// Base URL of the peer's HTTPS endpoint requiring client certificates,
+	// for instance https://tctl.eu-west-1.example.org
+	URL      string `json:"url"`
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+	// Optional CA to verify the peer's server certificate with, when it's
+	// not signed by a CA from the system roots
+	CAFile string `json:"caFile"`
+}
+
+// federationConfig is read from federation.json in the data directory. When
+// the file doesn't exist or lists no peers, federation is disabled
+type federationConfig struct {
+	// Name this coordinator's own runs are listed under
+	Name                string           `json:"name"`
+	PollIntervalSeconds int              `json:"pollIntervalSeconds"`
+	Peers               []FederationPeer `json:"peers"`
+	// Thumbprints of the client certificates of the primary coordinators
+	// that may act on behalf of their users on this coordinator
+	Primaries []string `json:"primaries"`
+}
+
+// FederationAgent is the status of an agent connected to a coordinator
+type FederationAgent struct {
+	ID           int32                  `json:"id"`
+	AgentVersion string                 `json:"agentVersion"`
+	PingRTT      float64                `json:"pingRTT"`
+	SystemInfo   common.AgentSystemInfo `json:"systemInfo"`
+}
+
+// FederationSummary is what a coordinator reports to the primary coordinator
+// of its federation
+type FederationSummary struct {
+	Version     string                     `json:"version"`
+	Generated   time.Time                  `json:"generated"`
+	Maintenance bool                       `json:"maintenance"`
+	Agents      []FederationAgent          `json:"agents"`
+	TestRuns    []FrontendTestRunListEntry `json:"testruns"`
+}
+
+// FederationPeerStatus describes the last synchronization with a peer
+type FederationPeerStatus struct {
+	Name         string    `json:"name"`
+	URL          string    `json:"url"`
+	LastAttempt  time.Time `json:"lastAttempt"`
+	LastSync     time.Time `json:"lastSync"`
+	Error        string    `json:"error,omitempty"`
+	Version      string    `json:"version"`
+	Maintenance  bool      `json:"maintenance"`
+	AgentCount   int       `json:"agentCount"`
+	TestRunCount int       `json:"testRunCount"`
+}
+
+// FederatedTestRun is a test run listing entry along with the coordinator
+// that owns the run
+type FederatedTestRun struct {
+	Peer string `json:"peer"`
+	FrontendTestRunListEntry
+}
+
+// FederatedAgent is an agent along with the coordinator it's connected to
+type FederatedAgent struct {
+	Peer string `json:"peer"`
+	FederationAgent
+}
+
+// federation polls the secondary coordinators and keeps their last reported
+// summaries, and tracks the runs submitted to them
+type federation struct {
+	config      federationConfig
+	clients     map[string]*http.Client
+	summaries   map[string]*FederationSummary
+	status      map[string]*FederationPeerStatus
+	submissions []*FederatedSubmission
+	lock        sync.Mutex
+}
+
+func federationConfigPath() string {
+	return filepath.Join(common.DataDir(), "federation.json")
+}
+
+// newFederation reads the federation config and prepares the clients for the
+// peers. Peers with an invalid configuration are reported in their status
+// rather than failing the startup of the coordinator
+func newFederation() *federation {
+	f := &federation{
+		config:      federationConfig{Name: "local", Peers: []FederationPeer{}},
+		clients:     map[string]*http.Client{},
+		summaries:   map[string]*FederationSummary{},
+		status:      map[string]*FederationPeerStatus{},
+		submissions: []*FederatedSubmission{},
+	}
+	f.loadSubmissions()
+	b, err := ioutil.ReadFile(federationConfigPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logging.Warnf("Unable to read federation config: %v", err)
+		}
+		return f
+	}
+	err = json.Unmarshal(b, &f.config)
+	if err != nil {
+		logging.Warnf("Unable to parse federation config: %v", err)
+		f.config.Peers = []FederationPeer{}
+		return f
+	}
+	for _, p := range f.config.Peers {
+		st := &FederationPeerStatus{Name: p.Name, URL: p.URL}
+		f.status[p.Name] = st
+		client, err := federationClient(p)
+		if err != nil {
+			st.Error = err.Error()
+			continue
+		}
+		f.clients[p.Name] = client
+	}
+	return f
+}
+
+// federationClient returns an HTTP client authenticating to the peer with its
+// configured client certificate
+func federationClient(p FederationPeer) (*http.Client, error) {
+	cert, err := tls.LoadX509KeyPair(p.CertFile, p.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load client certificate: %v", err)
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if p.CAFile != "" {
+		ca, err := ioutil.ReadFile(p.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read CA: %v", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("No certificates found in %s", p.CAFile)
+		}
+	}
+	return &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: cfg},
+	}, nil
+}
+
+// federationUserHeader is the header in which a primary coordinator forwards
+// the thumbprint of the user it acts on behalf of to a peer
+const federationUserHeader = "X-Federation-User"
+
+// federatedUser returns the user a primary coordinator acts on behalf of.
+// The caller has to be configured as a primary, and the user has to be known
+// on this coordinator, such that approvals, lint rules and quotas apply to
+// the user and not to the primary
+func (srv *HttpServer) federatedUser(
+	caller *SystemUser,
+	thumbprint string,
+) (*SystemUser, error) {
+	primary := false
+	for _, p := range srv.federation.config.Primaries {
+		primary = primary || p == caller.Thumbprint
+	}
+	if !primary {
+		return nil, fmt.Errorf(
+			"%s is not allowed to act on behalf of other users",
+			caller.Thumbprint,
+		)
+	}
+	usr := srv.UserFromThumbprint(thumbprint)
+	if usr == nil {
+		return nil, fmt.Errorf("User %s is not known", thumbprint)
+	}
+	target := *usr
+	target.ImpersonatedBy = caller.Thumbprint
+	return &target, nil
+}
+
+// enabled returns true if there are peers to federate with
+func (f *federation) enabled() bool {
+	return len(f.config.Peers) > 0
+}
+
+// peer returns the configured peer with the given name
+func (f *federation) peer(name string) (FederationPeer, *http.Client, bool) {
+	for _, p := range f.config.Peers {
+		if p.Name == name {
+			c, ok := f.clients[name]
+			return p, c, ok
+		}
+	}
+	return FederationPeer{}, nil, false
+}
+
+// get requests the given API path from the peer and decodes the JSON
+// response into v
+func (f *federation) get(name, path string, v interface{}) error {
+	p, client, ok := f.peer(name)
+	if !ok {
+		return fmt.Errorf("Federation peer %s is not available", name)
+	}
+	resp, err := client.Get(strings.TrimSuffix(p.URL, "/") + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("Peer %s returned status %d", name, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// sync fetches the summary of a single peer
+func (f *federation) sync(name string) {
+	summary := &FederationSummary{}
+	err := f.get(name, "/api/federation/summary", summary)
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	st := f.status[name]
+	st.LastAttempt = time.Now()
+	if err != nil {
+		logging.Warnf("Unable to synchronize with peer %s: %v", name, err)
+		st.Error = err.Error()
+		return
+	}
+	f.summaries[name] = summary
+	f.updateSubmissions(name, summary)
+	st.Error = ""
+	st.LastSync = st.LastAttempt
+	st.Version = summary.Version
+	st.Maintenance = summary.Maintenance
+	st.AgentCount = len(summary.Agents)
+	st.TestRunCount = len(summary.TestRuns)
+}
+
+// pollLoop synchronizes with all peers at the configured interval
+func (f *federation) pollLoop() {
+	if !f.enabled() {
+		return
+	}
+	interval := time.Duration(f.config.PollIntervalSeconds) * time.Second
+	if interval <= 0 {
+		interval = defaultFederationPollInterval
+	}
+	for {
+		wg := sync.WaitGroup{}
+		for name := range f.clients {
+			wg.Add(1)
+			go func(name string) {
+				f.sync(name)
+				wg.Done()
+			}(name)
+		}
+		wg.Wait()
+		time.Sleep(interval)
+	}
+}
+
+// peerStatus returns the synchronization status of all peers, sorted by name
+func (f *federation) peerStatus() []FederationPeerStatus {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	ret := make([]FederationPeerStatus, 0, len(f.status))
+	for _, st := range f.status {
+		ret = append(ret, *st)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return ret
+}
+
+// federationSummary returns the summary this coordinator reports to the
+// primary coordinator of its federation
+func (h *HttpServer) federationSummary() *FederationSummary {
+	agents := []FederationAgent{}
+	for _, a := range h.coord.GetAgents() {
+		agents = append(agents, FederationAgent{
+			ID:           a.ID,
+			AgentVersion: a.AgentVersion,
+			PingRTT:      a.PingRTT,
+			SystemInfo:   a.SystemInfo,
+		})
+	}
+	runs := h.frontendTestRunList()
+	if runs == nil {
+		runs = []FrontendTestRunListEntry{}
+	}
+	return &FederationSummary{
+		Version:     h.version,
+		Generated:   time.Now(),
+		Maintenance: h.coord.GetMaintenance(),
+		Agents:      agents,
+		TestRuns:    runs,
+	}
+}
+
+// federatedTestRuns returns the runs of this coordinator and the last known
+// runs of all peers, most recently created first
+func (h *HttpServer) federatedTestRuns() []FederatedTestRun {
+	ret := []FederatedTestRun{}
+	for _, tr := range h.frontendTestRunList() {
+		ret = append(ret, FederatedTestRun{h.federation.config.Name, tr})
+	}
+	h.federation.lock.Lock()
+	for name, s := range h.federation.summaries {
+		for _, tr := range s.TestRuns {
+			ret = append(ret, FederatedTestRun{name, tr})
+		}
+	}
+	h.federation.lock.Unlock()
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Created.After(ret[j].Created)
+	})
+	return ret
+}
+
+// federatedAgents returns the agents connected to this coordinator and the
+// last known agents of all peers
+func (h *HttpServer) federatedAgents() []FederatedAgent {
+	ret := []FederatedAgent{}
+	for _, a := range h.federationSummary().Agents {
+		ret = append(ret, FederatedAgent{h.federation.config.Name, a})
+	}
+	h.federation.lock.Lock()
+	defer h.federation.lock.Unlock()
+	for name, s := range h.federation.summaries {
+		for _, a := range s.Agents {
+			ret = append(ret, FederatedAgent{name, a})
+		}
+	}
+	return ret
+}
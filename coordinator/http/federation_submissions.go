@@ -0,0 +1,215 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// FederatedSubmission is a test run (or sweep) this coordinator submitted to
+// a peer, along with the last known state of its runs on the peer. The state
+// is refreshed every time the peer is polled
+type FederatedSubmission struct {
+	ID                    string    `json:"id"`
+	Peer                  string    `json:"peer"`
+	Submitted             time.Time `json:"submitted"`
+	SubmittedByThumbprint string    `json:"submittedByThumbprint"`
+	// The IDs of the runs on the peer, and the sweep they are part of if
+	// any. Runs of the sweep the peer schedules later are added as they show
+	// up in its summary
+	SweepID    string                     `json:"sweepID,omitempty"`
+	TestRunIDs []string                   `json:"testRunIDs"`
+	TestRuns   []FrontendTestRunListEntry `json:"testruns"`
+	LastUpdate time.Time                  `json:"lastUpdate"`
+}
+
+// federationScheduleResponse is the response of the schedule endpoint of a
+// peer
+type federationScheduleResponse struct {
+	OK         bool            `json:"ok"`
+	Error      string          `json:"error"`
+	Violations json.RawMessage `json:"violations"`
+	TestRunIDs []string        `json:"testRunIDs"`
+	SweepID    string          `json:"sweepID"`
+}
+
+// federationSubmitAttempts is the number of times submitting a test run to a
+// peer is attempted
+const federationSubmitAttempts = 3
+
+func federationSubmissionsPath() string {
+	return filepath.Join(common.DataDir(), "federation_submissions.json")
+}
+
+// loadSubmissions reads the submissions to peers from disk
+func (f *federation) loadSubmissions() {
+	b, err := ioutil.ReadFile(federationSubmissionsPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logging.Warnf("Unable to read federation submissions: %v", err)
+		}
+		return
+	}
+	err = json.Unmarshal(b, &f.submissions)
+	if err != nil {
+		logging.Warnf("Unable to parse federation submissions: %v", err)
+	}
+}
+
+// persistSubmissions writes the submissions to peers to disk. Must be called
+// with the lock held
+func (f *federation) persistSubmissions() {
+	b, err := json.Marshal(f.submissions)
+	if err == nil {
+		err = ioutil.WriteFile(federationSubmissionsPath(), b, 0644)
+	}
+	if err != nil {
+		logging.Warnf("Unable to persist federation submissions: %v", err)
+	}
+}
+
+// post sends the body with the given headers to the API path of the peer and
+// decodes the JSON response into v
+func (f *federation) post(
+	name, path string,
+	header http.Header,
+	body []byte,
+	v interface{},
+) error {
+	p, client, ok := f.peer(name)
+	if !ok {
+		return fmt.Errorf("Federation peer %s is not available", name)
+	}
+	req, err := http.NewRequest(
+		"POST",
+		strings.TrimSuffix(p.URL, "/")+path,
+		bytes.NewReader(body),
+	)
+	if err != nil {
+		return err
+	}
+	req.Header = header
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("Peer %s returned status %d", name, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// submit schedules the test run definition in body on the peer on behalf of
+// the submitter, and starts tracking the runs the peer scheduled for it.
+// Failed attempts are retried with the same idempotency key, such that the
+// peer schedules the runs only once. Returns the submission, or the response
+// of the peer if it did not schedule the runs
+func (f *federation) submit(
+	name string,
+	body []byte,
+	submittedByThumbprint string,
+) (*FederatedSubmission, *federationScheduleResponse, error) {
+	id, err := common.RandomID(12)
+	if err != nil {
+		return nil, nil, err
+	}
+	rep := &federationScheduleResponse{}
+	for attempt := 1; ; attempt++ {
+		header := http.Header{}
+		header.Set(federationUserHeader, submittedByThumbprint)
+		header.Set(idempotencyKeyHeader, id)
+		err = f.post(name, "/api/testruns/schedule", header, body, rep)
+		if err == nil || attempt == federationSubmitAttempts {
+			break
+		}
+		logging.Warnf(
+			"Submitting test run to peer %s failed (attempt %d): %v",
+			name,
+			attempt,
+			err,
+		)
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if !rep.OK {
+		return nil, rep, nil
+	}
+
+	s := &FederatedSubmission{
+		ID:                    id,
+		Peer:                  name,
+		Submitted:             time.Now(),
+		SubmittedByThumbprint: submittedByThumbprint,
+		SweepID:               rep.SweepID,
+		TestRunIDs:            rep.TestRunIDs,
+		TestRuns:              []FrontendTestRunListEntry{},
+	}
+	if s.TestRunIDs == nil {
+		s.TestRunIDs = []string{}
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.submissions = append(f.submissions, s)
+	f.persistSubmissions()
+	return s, rep, nil
+}
+
+// updateSubmissions refreshes the state of the runs submitted to the peer
+// from its summary. Must be called with the lock held
+func (f *federation) updateSubmissions(
+	name string,
+	summary *FederationSummary,
+) {
+	changed := false
+	for _, s := range f.submissions {
+		if s.Peer != name {
+			continue
+		}
+		known := map[string]bool{}
+		for _, id := range s.TestRunIDs {
+			known[id] = true
+		}
+		runs := []FrontendTestRunListEntry{}
+		for _, tr := range summary.TestRuns {
+			if s.SweepID != "" && tr.SweepID == s.SweepID && !known[tr.ID] {
+				s.TestRunIDs = append(s.TestRunIDs, tr.ID)
+				known[tr.ID] = true
+			}
+			if known[tr.ID] {
+				runs = append(runs, tr)
+			}
+		}
+		if len(runs) > 0 {
+			s.TestRuns = runs
+			s.LastUpdate = summary.Generated
+			changed = true
+		}
+	}
+	if changed {
+		f.persistSubmissions()
+	}
+}
+
+// submissionList returns the submissions to peers, most recent first
+func (f *federation) submissionList() []FederatedSubmission {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	ret := make([]FederatedSubmission, 0, len(f.submissions))
+	for i := len(f.submissions) - 1; i >= 0; i-- {
+		ret = append(ret, *f.submissions[i])
+	}
+	return ret
+}
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/coordinator/testruns"
 	"github.com/mit-dci/opencbdc-tctl/logging"
 )
 
@@ -63,6 +64,9 @@ func (h *HttpServer) makeFrontendRun(
 		logging.Warnf("Could not unmarshal testruns: %v", err)
 	}
 	res.RoleCounts = runRoleCounts
+	if v := testruns.TestRunVerdict(tr); v != nil {
+		res.Verdict = v.Verdict
+	}
 	if tr.Result != nil {
 		res.AvgThroughput = tr.Result.ThroughputAvg
 		for _, p := range tr.Result.LatencyPercentiles {
@@ -89,6 +93,7 @@ func (h *HttpServer) frontendTestRunList() []FrontendTestRunListEntry {
 type FrontendTestRunListEntry struct {
 	ID                       string                     `json:"id"`
 	CreatedByThumbprint      string                     `json:"createdByuserThumbprint"`
+	ImpersonatedByThumbprint string                     `json:"impersonatedByThumbprint,omitempty"`
 	Created                  time.Time                  `json:"created"`
 	Started                  time.Time                  `json:"started"`
 	Completed                time.Time                  `json:"completed"`
@@ -97,8 +102,15 @@ type FrontendTestRunListEntry struct {
 	Architecture             string                     `json:"architectureID"`
 	SweepID                  string                     `json:"sweepID"`
 	SweepOneAtATime          bool                       `json:"sweepOneAtATime"`
+	SweepBudgetHold          bool                       `json:"sweepBudgetHold,omitempty"`
+	DependsOn                []common.TestRunDependency `json:"dependsOn,omitempty"`
+	Tags                     []string                   `json:"tags,omitempty"`
 	RoleCounts               []FrontendTestRunRoleCount `json:"roleCounts"`
 	Details                  string                     `json:"details"`
+	QueueBlocked             string                     `json:"queueBlocked,omitempty"`
+	FailureClass             common.FailureClass        `json:"failureClass,omitempty"`
+	Regression               *common.RegressionVerdict  `json:"regression,omitempty"`
+	Verdict                  common.AnnotationVerdict   `json:"verdict,omitempty"`
 	AvgThroughput            float64                    `json:"avgThroughput"`
 	TailLatency              float64                    `json:"tailLatency"`
 	PerformanceDataAvailable bool                       `json:"performanceDataAvailable"`
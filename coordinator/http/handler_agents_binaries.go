@@ -0,0 +1,59 @@
+package http
+
+import (
+	"encoding/base64"
+	"net/http"
+
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// maxAgentBinarySize is the maximum size of an agent binary that can be
+// uploaded
+const maxAgentBinarySize = 256 << 20
+
+// agentBinariesHandler lists the agent binaries that can be rolled out, or
+// uploads a new one. The binary is posted as the request body, with its
+// version, architecture and base64 encoded offline signature in the query
+// string
+func (h *HttpServer) agentBinariesHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	usr, err := h.RealUserFromRequest(r)
+	if err != nil {
+		logging.Errorf("Error getting user from request: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	if !usr.Admin {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if r.Method == "GET" {
+		writeJson(w, h.tr.AgentBinaries())
+		return
+	}
+
+	defer r.Body.Close()
+	sig, err := base64.StdEncoding.DecodeString(r.URL.Query().Get("signature"))
+	if err != nil {
+		http.Error(w, "Request format incorrect", 500)
+		return
+	}
+	bin, err := h.tr.UploadAgentBinary(
+		r.URL.Query().Get("version"),
+		r.URL.Query().Get("arch"),
+		http.MaxBytesReader(w, r.Body, maxAgentBinarySize),
+		sig,
+		usr.Thumbprint,
+	)
+	if err != nil {
+		writeJson(w, map[string]interface{}{
+			"ok":    false,
+			"error": err.Error(),
+		})
+		return
+	}
+	writeJson(w, bin)
+}
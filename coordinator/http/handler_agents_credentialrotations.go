@@ -0,0 +1,33 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/mit-dci/opencbdc-tctl/coordinator"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+func (h *HttpServer) credentialRotationsHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	if r.Method == "GET" {
+		writeJson(w, h.coord.CredentialRotations())
+		return
+	}
+
+	rotation, err := h.coord.RotateAgentCredentials("manual")
+	if err == coordinator.ErrCredentialRotationInProgress {
+		writeJson(w, map[string]interface{}{
+			"ok":    false,
+			"error": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		logging.Errorf("Error starting credential rotation: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	writeJson(w, rotation)
+}
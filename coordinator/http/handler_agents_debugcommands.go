@@ -0,0 +1,25 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+func (h *HttpServer) debugCommandsHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	usr, err := h.RealUserFromRequest(r)
+	if err != nil {
+		logging.Errorf("Error getting user from request: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	if !usr.Admin {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	writeJson(w, common.DebugCommands)
+}
@@ -0,0 +1,80 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/mit-dci/opencbdc-tctl/coordinator"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+type oneOffDebugExecRequest struct {
+	Command string `json:"command"`
+	Reason  string `json:"reason"`
+}
+
+// oneOffDebugExecHandler runs a single diagnostic command on the agent, in a
+// debug session that is closed right after, such that it's recorded like the
+// commands run in sessions
+func (h *HttpServer) oneOffDebugExecHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	usr, err := h.RealUserFromRequest(r)
+	if err != nil {
+		logging.Errorf("Error getting user from request: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	if !usr.Admin {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	vars := mux.Vars(r)
+	agentID, err := strconv.Atoi(vars["agentID"])
+	if err != nil {
+		http.Error(w, "Request format incorrect", 500)
+		return
+	}
+	defer r.Body.Close()
+	var req oneOffDebugExecRequest
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logging.Errorf("Error parsing request: %s", err.Error())
+		http.Error(w, "Request format incorrect", 500)
+		return
+	}
+
+	s, err := h.am.OpenDebugSession(int32(agentID), usr.Thumbprint, req.Reason)
+	if err == coordinator.ErrAgentNotFound {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	if err != nil {
+		writeJson(w, map[string]interface{}{
+			"ok":    false,
+			"error": err.Error(),
+		})
+		return
+	}
+	run, err := h.am.DebugExec(s.ID, usr.Thumbprint, req.Command)
+	closeErr := h.am.CloseDebugSession(s.ID, usr.Thumbprint)
+	if closeErr != nil {
+		logging.Warnf("Error closing debug session %s: %v", s.ID, closeErr)
+	}
+	if err != nil {
+		writeJson(w, map[string]interface{}{
+			"ok":    false,
+			"error": err.Error(),
+		})
+		return
+	}
+	writeJson(w, map[string]interface{}{
+		"ok":        true,
+		"sessionID": s.ID,
+		"run":       run,
+	})
+}
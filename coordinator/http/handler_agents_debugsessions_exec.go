@@ -0,0 +1,57 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/mit-dci/opencbdc-tctl/coordinator/agents"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+type debugExecRequest struct {
+	Command string `json:"command"`
+}
+
+func (h *HttpServer) debugExecHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	usr, err := h.RealUserFromRequest(r)
+	if err != nil {
+		logging.Errorf("Error getting user from request: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	if !usr.Admin {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	defer r.Body.Close()
+	var req debugExecRequest
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logging.Errorf("Error parsing request: %s", err.Error())
+		http.Error(w, "Request format incorrect", 500)
+		return
+	}
+
+	vars := mux.Vars(r)
+	run, err := h.am.DebugExec(vars["sessionID"], usr.Thumbprint, req.Command)
+	if err == agents.ErrDebugSessionNotFound {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	if err != nil {
+		writeJson(w, map[string]interface{}{
+			"ok":    false,
+			"error": err.Error(),
+		})
+		return
+	}
+	writeJson(w, map[string]interface{}{
+		"ok":  true,
+		"run": run,
+	})
+}
@@ -0,0 +1,38 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/mit-dci/opencbdc-tctl/coordinator/agents"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+func (h *HttpServer) getDebugSessionHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	usr, err := h.RealUserFromRequest(r)
+	if err != nil {
+		logging.Errorf("Error getting user from request: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	if !usr.Admin {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	vars := mux.Vars(r)
+	s, err := h.am.GetDebugSession(vars["sessionID"])
+	if err == agents.ErrDebugSessionNotFound {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	if err != nil {
+		logging.Errorf("Error getting debug session: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	writeJson(w, s)
+}
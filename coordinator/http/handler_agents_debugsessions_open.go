@@ -0,0 +1,65 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/mit-dci/opencbdc-tctl/coordinator"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+type openDebugSessionRequest struct {
+	Reason string `json:"reason"`
+}
+
+func (h *HttpServer) openDebugSessionHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	// Debug sessions are opened by the admin themselves, even while
+	// impersonating another user
+	usr, err := h.RealUserFromRequest(r)
+	if err != nil {
+		logging.Errorf("Error getting user from request: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	if !usr.Admin {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	vars := mux.Vars(r)
+	agentID, err := strconv.Atoi(vars["agentID"])
+	if err != nil {
+		http.Error(w, "Request format incorrect", 500)
+		return
+	}
+	defer r.Body.Close()
+	var req openDebugSessionRequest
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logging.Errorf("Error parsing request: %s", err.Error())
+		http.Error(w, "Request format incorrect", 500)
+		return
+	}
+
+	s, err := h.am.OpenDebugSession(int32(agentID), usr.Thumbprint, req.Reason)
+	if err == coordinator.ErrAgentNotFound {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	if err != nil {
+		writeJson(w, map[string]interface{}{
+			"ok":    false,
+			"error": err.Error(),
+		})
+		return
+	}
+	writeJson(w, map[string]interface{}{
+		"ok":      true,
+		"session": s,
+	})
+}
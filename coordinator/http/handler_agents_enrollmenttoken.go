@@ -0,0 +1,49 @@
+package http
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/coordinator"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+func (h *HttpServer) issueEnrollmentTokenHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	usr, err := h.RealUserFromRequest(r)
+	if err != nil {
+		logging.Errorf("Error getting user from request: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	if !usr.Admin {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	// Tokens are valid for one hour by default, unless a different validity
+	// (in seconds, up to a day) is passed in the query string
+	validity := time.Hour
+	validityStr := r.URL.Query().Get("validity")
+	if validityStr != "" {
+		seconds, err := strconv.Atoi(validityStr)
+		if err != nil || seconds <= 0 ||
+			seconds > int(coordinator.MaxBootstrapTokenValidity/time.Second) {
+			http.Error(w, "Bad request", 400)
+			return
+		}
+		validity = time.Duration(seconds) * time.Second
+	}
+
+	token, expires, err := h.coord.IssueBootstrapToken(validity)
+	if err != nil {
+		logging.Errorf("Error issuing bootstrap token: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	writeJson(w, map[string]interface{}{"token": token, "expires": expires})
+}
@@ -0,0 +1,53 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/mit-dci/opencbdc-tctl/coordinator"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+func (h *HttpServer) createAgentPoolHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	usr, err := h.RealUserFromRequest(r)
+	if err != nil {
+		logging.Errorf("Error getting user from request: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	if !usr.Admin {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	defer r.Body.Close()
+	var p coordinator.AgentPool
+	err = json.NewDecoder(r.Body).Decode(&p)
+	if err != nil {
+		logging.Errorf("Error parsing request: %s", err.Error())
+		http.Error(w, "Request format incorrect", 500)
+		return
+	}
+	p.CreatedBy = usr.Thumbprint
+
+	// The join token is only returned here, static agents joining the pool
+	// are configured with it
+	p, token, err := h.coord.CreateAgentPool(p)
+	if err == coordinator.ErrInvalidAgentPool {
+		http.Error(w, "Request format incorrect", 500)
+		return
+	}
+	if err == coordinator.ErrAgentPoolExists {
+		http.Error(w, "Agent pool already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		logging.Errorf("Error creating agent pool: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	writeJson(w, map[string]interface{}{"pool": p, "joinToken": token})
+}
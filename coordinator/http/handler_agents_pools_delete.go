@@ -0,0 +1,38 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/mit-dci/opencbdc-tctl/coordinator"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+func (h *HttpServer) deleteAgentPoolHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	usr, err := h.RealUserFromRequest(r)
+	if err != nil {
+		logging.Errorf("Error getting user from request: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	if !usr.Admin {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	vars := mux.Vars(r)
+	err = h.coord.DeleteAgentPool(vars["poolName"])
+	if err == coordinator.ErrAgentPoolNotFound {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	if err != nil {
+		logging.Errorf("Error deleting agent pool: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	writeJsonOK(w)
+}
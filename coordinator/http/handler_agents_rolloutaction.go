@@ -0,0 +1,41 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/mit-dci/opencbdc-tctl/coordinator/testruns"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// agentRolloutActionHandler pauses, resumes or aborts an agent rollout
+func (h *HttpServer) agentRolloutActionHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	usr, err := h.RealUserFromRequest(r)
+	if err != nil {
+		logging.Errorf("Error getting user from request: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	if !usr.Admin {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	params := mux.Vars(r)
+	err = h.tr.SetAgentRolloutStatus(params["rolloutID"], params["action"])
+	if err == testruns.ErrAgentRolloutNotFound {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	if err != nil {
+		writeJson(w, map[string]interface{}{
+			"ok":    false,
+			"error": err.Error(),
+		})
+		return
+	}
+	writeJsonOK(w)
+}
@@ -0,0 +1,50 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/mit-dci/opencbdc-tctl/coordinator/testruns"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// agentRolloutsHandler lists the agent rollouts, or starts rolling out a new
+// agent version
+func (h *HttpServer) agentRolloutsHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	usr, err := h.RealUserFromRequest(r)
+	if err != nil {
+		logging.Errorf("Error getting user from request: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	if !usr.Admin {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if r.Method == "GET" {
+		writeJson(w, h.tr.AgentRollouts())
+		return
+	}
+
+	var cfg testruns.AgentRolloutConfig
+	err = json.NewDecoder(r.Body).Decode(&cfg)
+	if err != nil {
+		logging.Errorf("Error decoding rollout: %s", err.Error())
+		http.Error(w, "Request format incorrect", 500)
+		return
+	}
+
+	rollout, err := h.tr.StartAgentRollout(cfg, usr.Thumbprint)
+	if err != nil {
+		writeJson(w, map[string]interface{}{
+			"ok":    false,
+			"error": err.Error(),
+		})
+		return
+	}
+	writeJson(w, rollout)
+}
@@ -0,0 +1,47 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/mit-dci/opencbdc-tctl/coordinator"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+func (h *HttpServer) addAnnouncementHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	usr, err := h.RealUserFromRequest(r)
+	if err != nil {
+		logging.Errorf("Error getting user from request: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	if !usr.Admin {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	defer r.Body.Close()
+	var a coordinator.Announcement
+	err = json.NewDecoder(r.Body).Decode(&a)
+	if err != nil {
+		logging.Errorf("Error parsing request: %s", err.Error())
+		http.Error(w, "Request format incorrect", 500)
+		return
+	}
+	a.CreatedBy = usr.Email
+
+	a, err = h.coord.AddAnnouncement(a)
+	if err == coordinator.ErrInvalidAnnouncement {
+		http.Error(w, "Request format incorrect", 500)
+		return
+	}
+	if err != nil {
+		logging.Errorf("Error adding announcement: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	writeJson(w, a)
+}
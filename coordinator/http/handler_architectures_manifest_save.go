@@ -0,0 +1,53 @@
+package http
+
+import (
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// saveArchitectureManifestHandler defines a new architecture, or replaces the
+// definition of an existing one, from the manifest in the request body. The
+// manifest is parsed as YAML if the content type or the `format` query
+// parameter says so, and as JSON otherwise
+func (h *HttpServer) saveArchitectureManifestHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	usr, err := h.RealUserFromRequest(r)
+	if err != nil {
+		logging.Errorf("Error getting user from request: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	if !usr.Admin {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	defer r.Body.Close()
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Request format incorrect", 500)
+		return
+	}
+	isYAML := strings.Contains(r.Header.Get("Content-Type"), "yaml") ||
+		r.URL.Query().Get("format") == "yaml"
+
+	m, err := h.tr.SaveArchitectureManifest(b, isYAML)
+	if err != nil {
+		logging.Warnf("Error saving architecture manifest: %v", err)
+		writeJson(w, map[string]interface{}{
+			"ok":    false,
+			"error": err.Error(),
+		})
+		return
+	}
+	writeJson(w, map[string]interface{}{
+		"ok":            true,
+		"manifest":      m,
+		"architectures": h.tr.Architectures(),
+	})
+}
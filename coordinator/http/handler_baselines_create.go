@@ -0,0 +1,46 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+type createBaselineRequest struct {
+	TestRunID string `json:"testRunID"`
+	Name      string `json:"name"`
+}
+
+// createBaselineHandler saves the results of a completed test run as a named
+// baseline that regression gates of new test runs can compare against
+func (h *HttpServer) createBaselineHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	defer r.Body.Close()
+	var req createBaselineRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "Request format incorrect", 500)
+		return
+	}
+
+	usr, err := h.UserFromRequest(r)
+	if err != nil {
+		logging.Errorf("Error getting user from request: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	b, err := h.tr.CreateBaseline(req.TestRunID, req.Name, usr.Thumbprint)
+	if err != nil {
+		logging.Warnf("Error creating baseline: %v", err)
+		writeJson(w, map[string]interface{}{
+			"ok":    false,
+			"error": err.Error(),
+		})
+		return
+	}
+	writeJson(w, b)
+}
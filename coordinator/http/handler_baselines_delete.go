@@ -0,0 +1,27 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/mit-dci/opencbdc-tctl/coordinator/testruns"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+func (h *HttpServer) deleteBaselineHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	vars := mux.Vars(r)
+	err := h.tr.DeleteBaseline(vars["baselineID"])
+	if err == testruns.ErrBaselineNotFound {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	if err != nil {
+		logging.Errorf("Error removing baseline: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	writeJsonOK(w)
+}
@@ -0,0 +1,21 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/mit-dci/opencbdc-tctl/coordinator/testruns"
+)
+
+func (h *HttpServer) getDashboardHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	vars := mux.Vars(r)
+	d, err := h.tr.GetDashboard(vars["dashboardID"])
+	if err == testruns.ErrDashboardNotFound {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	writeJson(w, d)
+}
@@ -0,0 +1,52 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/mit-dci/opencbdc-tctl/coordinator/testruns"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// saveDashboardHandler creates a dashboard (POST), or replaces the definition
+// of an existing one (PUT with the dashboard ID in the path)
+func (h *HttpServer) saveDashboardHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	defer r.Body.Close()
+	var d testruns.Dashboard
+	err := json.NewDecoder(r.Body).Decode(&d)
+	if err != nil {
+		http.Error(w, "Request format incorrect", 500)
+		return
+	}
+
+	usr, err := h.UserFromRequest(r)
+	if err != nil {
+		logging.Errorf("Error getting user from request: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	var saved *testruns.Dashboard
+	if id, ok := mux.Vars(r)["dashboardID"]; ok {
+		saved, err = h.tr.UpdateDashboard(id, &d, usr.Thumbprint)
+		if err == testruns.ErrDashboardNotFound {
+			http.Error(w, "Not found", 404)
+			return
+		}
+	} else {
+		saved, err = h.tr.CreateDashboard(&d, usr.Thumbprint)
+	}
+	if err != nil {
+		logging.Warnf("Error saving dashboard: %v", err)
+		writeJson(w, map[string]interface{}{
+			"ok":    false,
+			"error": err.Error(),
+		})
+		return
+	}
+	writeJson(w, saved)
+}
@@ -0,0 +1,25 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// listFeatureFlagsHandler returns the configured feature flags, and the ones
+// that are on for the requesting user
+func (h *HttpServer) listFeatureFlagsHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	usr, err := h.UserFromRequest(r)
+	if err != nil {
+		logging.Errorf("Error getting user from request: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	writeJson(w, map[string]interface{}{
+		"flags":   h.coord.FeatureFlags(),
+		"enabled": h.coord.FeatureFlagsForUser(usr.Thumbprint),
+	})
+}
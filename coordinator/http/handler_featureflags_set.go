@@ -0,0 +1,48 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/mit-dci/opencbdc-tctl/coordinator"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+func (h *HttpServer) setFeatureFlagHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	defer r.Body.Close()
+	var f coordinator.FeatureFlag
+	err := json.NewDecoder(r.Body).Decode(&f)
+	if err != nil {
+		logging.Errorf("Error parsing request: %s", err.Error())
+		http.Error(w, "Request format incorrect", 500)
+		return
+	}
+	f.Name = mux.Vars(r)["flag"]
+
+	usr, err := h.RealUserFromRequest(r)
+	if err != nil {
+		logging.Errorf("Error getting user from request: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	if !usr.Admin {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	f, err = h.coord.SetFeatureFlag(f, usr.Thumbprint)
+	if err == coordinator.ErrInvalidFeatureFlag {
+		http.Error(w, "Request format incorrect", 500)
+		return
+	}
+	if err != nil {
+		logging.Errorf("Error saving feature flag: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	writeJson(w, f)
+}
@@ -0,0 +1,10 @@
+package http
+
+import "net/http"
+
+func (h *HttpServer) federationAgentsHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	writeJson(w, h.federatedAgents())
+}
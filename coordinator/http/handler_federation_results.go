@@ -0,0 +1,42 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// federationResultsHandler returns the results of a test run owned by any of
+// the coordinators in the federation. Results of runs on peers are fetched
+// from the peer on demand
+func (h *HttpServer) federationResultsHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	params := mux.Vars(r)
+	peer := params["peer"]
+	runID := params["runID"]
+
+	if peer == h.federation.config.Name {
+		h.testRunResultsHandler(w, r)
+		return
+	}
+	if _, _, ok := h.federation.peer(peer); !ok {
+		http.Error(w, "Not found", 404)
+		return
+	}
+
+	var results json.RawMessage
+	err := h.federation.get(
+		peer,
+		fmt.Sprintf("/api/testruns/%s/results", runID),
+		&results,
+	)
+	if err != nil {
+		writeJson(w, map[string]interface{}{"ok": false, "error": err.Error()})
+		return
+	}
+	writeJson(w, results)
+}
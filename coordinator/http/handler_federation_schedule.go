@@ -0,0 +1,60 @@
+package http
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// federationScheduleHandler schedules a test run on any of the coordinators
+// in the federation. Runs for peers are submitted to the peer's schedule
+// endpoint, authenticated with the client certificate configured for the
+// peer, and tracked as submissions
+func (h *HttpServer) federationScheduleHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	peer := mux.Vars(r)["peer"]
+	if peer == h.federation.config.Name {
+		h.scheduleTestRunHandler(w, r)
+		return
+	}
+	if _, _, ok := h.federation.peer(peer); !ok {
+		http.Error(w, "Not found", 404)
+		return
+	}
+
+	defer r.Body.Close()
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Request format incorrect", 500)
+		return
+	}
+	usr, err := h.UserFromRequest(r)
+	if err != nil {
+		logging.Errorf("Error determining user: %s", err.Error())
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	s, rep, err := h.federation.submit(peer, body, usr.Thumbprint)
+	if err != nil {
+		logging.Warnf("Error submitting test run to peer %s: %v", peer, err)
+		writeJson(w, map[string]interface{}{"ok": false, "error": err.Error()})
+		return
+	}
+	if s == nil {
+		writeJson(w, rep)
+		return
+	}
+	// Pick up the state of the runs on the peer without waiting for the next
+	// poll
+	go h.federation.sync(peer)
+	writeJson(w, map[string]interface{}{
+		"ok":         true,
+		"submission": s,
+		"violations": rep.Violations,
+	})
+}
@@ -0,0 +1,14 @@
+package http
+
+import "net/http"
+
+func (h *HttpServer) federationStatusHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	writeJson(w, map[string]interface{}{
+		"enabled": h.federation.enabled(),
+		"name":    h.federation.config.Name,
+		"peers":   h.federation.peerStatus(),
+	})
+}
@@ -0,0 +1,10 @@
+package http
+
+import "net/http"
+
+func (h *HttpServer) federationSubmissionsHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	writeJson(w, h.federation.submissionList())
+}
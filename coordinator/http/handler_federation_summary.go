@@ -0,0 +1,12 @@
+package http
+
+import "net/http"
+
+// federationSummaryHandler reports the runs and agents of this coordinator to
+// the primary coordinator of the federation
+func (h *HttpServer) federationSummaryHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	writeJson(w, h.federationSummary())
+}
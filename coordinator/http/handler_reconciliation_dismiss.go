@@ -0,0 +1,23 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/mit-dci/opencbdc-tctl/coordinator/testruns"
+)
+
+// dismissLeakHandler removes a leaked resource from the reconciliation list,
+// after it was cleaned up manually
+func (h *HttpServer) dismissLeakHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	vars := mux.Vars(r)
+	err := h.tr.DismissLeak(vars["leakID"])
+	if err == testruns.ErrLeakNotFound {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	writeJsonOK(w)
+}
@@ -0,0 +1,42 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/mit-dci/opencbdc-tctl/coordinator/testruns"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+func (h *HttpServer) deleteRecurringScheduleHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	usr, err := h.UserFromRequest(r)
+	if err != nil {
+		logging.Errorf("Error getting user from request: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	vars := mux.Vars(r)
+	err = h.tr.DeleteRecurringSchedule(
+		vars["scheduleID"],
+		usr.Thumbprint,
+		usr.Admin,
+	)
+	if err == testruns.ErrRecurringScheduleNotFound {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	if err == testruns.ErrRecurringScheduleForbidden {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		logging.Errorf("Error removing recurring schedule: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	writeJsonOK(w)
+}
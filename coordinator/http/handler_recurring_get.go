@@ -0,0 +1,21 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/mit-dci/opencbdc-tctl/coordinator/testruns"
+)
+
+func (h *HttpServer) getRecurringScheduleHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	vars := mux.Vars(r)
+	s, err := h.tr.GetRecurringSchedule(vars["scheduleID"])
+	if err == testruns.ErrRecurringScheduleNotFound {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	writeJson(w, s)
+}
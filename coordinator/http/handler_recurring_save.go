@@ -0,0 +1,71 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/mit-dci/opencbdc-tctl/coordinator/testruns"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// saveRecurringScheduleHandler creates a recurring schedule (POST), or
+// replaces the definition of an existing one (PUT with the schedule ID in the
+// path). The runs of the schedule are scheduled as the user that created it,
+// so only that user or an admin can replace it
+func (h *HttpServer) saveRecurringScheduleHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	defer r.Body.Close()
+	var s testruns.RecurringSchedule
+	err := json.NewDecoder(r.Body).Decode(&s)
+	if err != nil {
+		http.Error(w, "Request format incorrect", 500)
+		return
+	}
+
+	usr, err := h.UserFromRequest(r)
+	if err != nil {
+		logging.Errorf("Error getting user from request: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	if err := checkPriority(usr, h.tr.RecurringPriority(&s)); err != nil {
+		writeJson(w, map[string]interface{}{
+			"ok":    false,
+			"error": err.Error(),
+		})
+		return
+	}
+
+	var saved *testruns.RecurringSchedule
+	if id, ok := mux.Vars(r)["scheduleID"]; ok {
+		saved, err = h.tr.UpdateRecurringSchedule(
+			id,
+			&s,
+			usr.Thumbprint,
+			usr.Admin,
+		)
+		if err == testruns.ErrRecurringScheduleNotFound {
+			http.Error(w, "Not found", 404)
+			return
+		}
+		if err == testruns.ErrRecurringScheduleForbidden {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+	} else {
+		saved, err = h.tr.CreateRecurringSchedule(&s, usr.Thumbprint)
+	}
+	if err != nil {
+		logging.Warnf("Error saving recurring schedule: %v", err)
+		writeJson(w, map[string]interface{}{
+			"ok":    false,
+			"error": err.Error(),
+		})
+		return
+	}
+	writeJson(w, saved)
+}
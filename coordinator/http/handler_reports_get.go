@@ -0,0 +1,41 @@
+package http
+
+import (
+	"net/http"
+	"os"
+	"regexp"
+
+	"github.com/gorilla/mux"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// reportIDRegex matches the IDs of rendered reports
+var reportIDRegex = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// getReportHandler returns a previously rendered report, such as the ones
+// published by the weekly report job
+func (h *HttpServer) getReportHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	id := mux.Vars(r)["reportID"]
+	if !reportIDRegex.MatchString(id) {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	b, err := os.ReadFile(reportPath(id))
+	if os.IsNotExist(err) {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	if err != nil {
+		logging.Errorf("Error reading report %s: %v", id, err)
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+	w.Header().Add("Content-Type", "text/html")
+	_, err = w.Write(b)
+	if err != nil {
+		logging.Errorf("Error writing output: %v", err)
+	}
+}
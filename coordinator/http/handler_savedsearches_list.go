@@ -0,0 +1,12 @@
+package http
+
+import (
+	"net/http"
+)
+
+func (h *HttpServer) listSavedSearchesHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	writeJson(w, h.tr.SavedSearches())
+}
@@ -0,0 +1,50 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// importDeploymentSnapshotRequest holds the configuration file of the
+// deployment to import
+type importDeploymentSnapshotRequest struct {
+	Name   string `json:"name"`
+	Config string `json:"config"`
+}
+
+func (h *HttpServer) importDeploymentSnapshotHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	defer r.Body.Close()
+	var req importDeploymentSnapshotRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Config == "" {
+		http.Error(w, "Request format incorrect", 500)
+		return
+	}
+
+	usr, err := h.UserFromRequest(r)
+	if err != nil {
+		logging.Errorf("Error getting user from request: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	snap, err := h.tr.ImportDeploymentSnapshot(
+		req.Name,
+		req.Config,
+		usr.Thumbprint,
+	)
+	if err != nil {
+		logging.Warnf("Error importing deployment snapshot: %v", err)
+		writeJson(w, map[string]interface{}{
+			"ok":    false,
+			"error": err.Error(),
+		})
+		return
+	}
+	writeJson(w, snap)
+}
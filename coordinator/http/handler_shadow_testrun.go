@@ -0,0 +1,44 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/coordinator/testruns"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// shadowTestRunHandler turns the posted test run template into a shadow run
+// of the deployment snapshot. The shadow run is returned rather than
+// scheduled, such that it goes through the regular schedule endpoint (and its
+// lint rules) once the user reviewed it
+func (h *HttpServer) shadowTestRunHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	defer r.Body.Close()
+	var template common.TestRun
+	err := json.NewDecoder(r.Body).Decode(&template)
+	if err != nil {
+		logging.Errorf("Error parsing request: %s", err.Error())
+		http.Error(w, "Request format incorrect", 500)
+		return
+	}
+
+	vars := mux.Vars(r)
+	tr, err := h.tr.ShadowTestRun(vars["snapshotID"], &template)
+	if err == testruns.ErrDeploymentSnapshotNotFound {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	if err != nil {
+		writeJson(w, map[string]interface{}{
+			"ok":    false,
+			"error": err.Error(),
+		})
+		return
+	}
+	writeJson(w, tr)
+}
@@ -0,0 +1,39 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/mit-dci/opencbdc-tctl/coordinator/sources"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+func (h *HttpServer) sourcesArtifactsHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	writeJson(w, h.src.ArtifactsStatus())
+}
+
+// sourcesArtifactsGCHandler applies the retention policy to the build
+// artifacts. The request body optionally contains a policy to apply instead
+// of the configured one, and ?dryRun=true reports what would be removed
+// without removing anything
+func (h *HttpServer) sourcesArtifactsGCHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	defer r.Body.Close()
+	var policy *sources.RetentionPolicy
+	if r.ContentLength != 0 {
+		policy = &sources.RetentionPolicy{}
+		err := json.NewDecoder(r.Body).Decode(policy)
+		if err != nil {
+			logging.Errorf("Error parsing request: %s", err.Error())
+			http.Error(w, "Request format incorrect", 500)
+			return
+		}
+	}
+	dryRun := r.URL.Query().Get("dryRun") == "true"
+	writeJson(w, h.src.CollectArtifacts(policy, dryRun))
+}
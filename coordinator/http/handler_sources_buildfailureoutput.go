@@ -0,0 +1,33 @@
+package http
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// sourcesBuildFailureOutputHandler returns the full output of the build step
+// that failed
+func (h *HttpServer) sourcesBuildFailureOutputHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	params := mux.Vars(r)
+	id := params["failureID"]
+
+	out, err := h.src.BuildFailureOutput(id)
+	if err != nil {
+		http.Error(w, "Not found", 404)
+		return
+	}
+
+	w.Header().
+		Add("Content-Disposition", fmt.Sprintf("attachment; filename=buildfailure_%s.txt", id))
+	w.Header().Add("Content-Type", "text/plain")
+	_, err = w.Write(out)
+	if err != nil {
+		logging.Errorf("Error writing output: %v", err)
+	}
+}
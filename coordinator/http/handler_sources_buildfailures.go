@@ -0,0 +1,42 @@
+package http
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/mit-dci/opencbdc-tctl/coordinator/sources"
+)
+
+// sourcesBuildFailuresHandler returns the most recent build failures. They can
+// be filtered by `commit`, `arch` and `since`, and `excludeTransient=1` leaves
+// out failures of commits that compiled successfully afterwards
+func (h *HttpServer) sourcesBuildFailuresHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	q := r.URL.Query()
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	if limit <= 0 {
+		limit = 50
+	}
+	since, err := parseLogDate(q, "since", false)
+	if err != nil {
+		http.Error(w, "Request format incorrect", 500)
+		return
+	}
+	commit := q.Get("commit")
+	if commit != "" {
+		commit, _, err = h.src.ResolveRef(commit)
+		if err != nil {
+			http.Error(w, "Not found", 404)
+			return
+		}
+	}
+	writeJson(w, h.src.BuildFailures(sources.BuildFailureQuery{
+		CommitHash:       commit,
+		Arch:             q.Get("arch"),
+		Since:            since,
+		ExcludeTransient: q.Get("excludeTransient") == "1",
+		Limit:            limit,
+	}))
+}
@@ -0,0 +1,27 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+func (h *HttpServer) sourcesCompilerCacheHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	if r.Method == "DELETE" {
+		err := h.src.ClearCompilerCache()
+		if err != nil {
+			logging.Errorf("Error clearing compiler cache: %v", err)
+			http.Error(w, "Internal Server Error", 500)
+			return
+		}
+		writeJsonOK(w)
+		return
+	}
+	writeJson(w, map[string]interface{}{
+		"enabled":   h.src.CompilerCacheEnabled(),
+		"sizeBytes": h.src.CompilerCacheSize(),
+	})
+}
@@ -0,0 +1,44 @@
+package http
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/mit-dci/opencbdc-tctl/coordinator/sources"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// sourcesCompareHandler returns the files changed between the commits (or
+// refs) `from` and `to`, classified by the component of the system under test
+// they belong to
+func (h *HttpServer) sourcesCompareHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	q := r.URL.Query()
+	if q.Get("from") == "" || q.Get("to") == "" {
+		http.Error(w, "Request format incorrect", 500)
+		return
+	}
+	from, _, err := h.src.ResolveRef(q.Get("from"))
+	if err != nil {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	to, _, err := h.src.ResolveRef(q.Get("to"))
+	if err != nil {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	c, err := h.src.CompareCommits(from, to)
+	if errors.Is(err, sources.ErrCompareUnsupported) {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	if err != nil {
+		logging.Warnf("Unable to compare %s and %s: %v", from, to, err)
+		http.Error(w, "Request format incorrect", 500)
+		return
+	}
+	writeJson(w, c)
+}
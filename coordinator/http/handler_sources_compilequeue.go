@@ -0,0 +1,12 @@
+package http
+
+import (
+	"net/http"
+)
+
+func (h *HttpServer) sourcesCompileQueueHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	writeJson(w, h.src.CompileQueueStatus())
+}
@@ -0,0 +1,14 @@
+package http
+
+import (
+	"net/http"
+)
+
+// sourcesComponentsHandler lists the additional repositories of the system
+// under test that test runs can select components from
+func (h *HttpServer) sourcesComponentsHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	writeJson(w, h.src.Components())
+}
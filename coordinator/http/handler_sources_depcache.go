@@ -0,0 +1,27 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+func (h *HttpServer) sourcesDependencyCacheHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	if r.Method == "DELETE" {
+		err := h.src.DependencyCache().Clear()
+		if err == nil {
+			err = h.src.ClearSubmoduleMirrors()
+		}
+		if err != nil {
+			logging.Errorf("Error clearing dependency cache: %v", err)
+			http.Error(w, "Internal Server Error", 500)
+			return
+		}
+		writeJsonOK(w)
+		return
+	}
+	writeJson(w, h.src.DependencyCache().Stats())
+}
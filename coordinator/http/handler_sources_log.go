@@ -2,23 +2,82 @@ package http
 
 import (
 	"net/http"
+	"net/url"
 	"strconv"
+	"time"
 
-	"github.com/gorilla/mux"
+	"github.com/mit-dci/opencbdc-tctl/coordinator/sources"
 )
 
+// sourcesLogTotalHeader is the header the total number of commits matching
+// the filter of the commit history is returned in, since the body stays the
+// array of commits existing clients expect
+const sourcesLogTotalHeader = "X-Total-Count"
+
+// parseLogDate parses a date query parameter given either as RFC3339
+// timestamp or as date. If endOfDay is set, a date is taken to mean the end of
+// that day, such that until=2021-06-01 includes the commits of June 1st
+func parseLogDate(q url.Values, key string, endOfDay bool) (time.Time, error) {
+	v := q.Get(key)
+	if v == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err == nil {
+		return t, nil
+	}
+	t, err = time.Parse("2006-01-02", v)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if endOfDay {
+		t = t.Add(24 * time.Hour)
+	}
+	return t, nil
+}
+
+// sourcesLogHandler returns a page of the commit history. The history can be
+// filtered with the `author`, `subject`, `since` and `until` query parameters,
+// and limited to the pull requests or the main branch with `prs=1` or
+// `mainline=1`. The page is selected with `page` and `limit`, and the number
+// of commits on all pages is returned in the X-Total-Count header. Responses
+// carry the version of the commit history as ETag, such that clients can
+// revalidate cached pages with If-None-Match
 func (h *HttpServer) sourcesLogHandler(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
-	limit, _ := strconv.Atoi(params["limit"])
-	if limit == 0 {
+	q := r.URL.Query()
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	if limit <= 0 {
 		limit = 50
 	}
-	page, _ := strconv.Atoi(params["page"])
+	page, _ := strconv.Atoi(q.Get("page"))
+	if page < 0 {
+		page = 0
+	}
 
-	logs, err := h.src.GetGitLog(limit*page, limit*page+limit, false)
+	since, err := parseLogDate(q, "since", false)
+	if err != nil {
+		http.Error(w, "Request format incorrect", 500)
+		return
+	}
+	until, err := parseLogDate(q, "until", true)
+	if err != nil {
+		http.Error(w, "Request format incorrect", 500)
+		return
+	}
+
+	filter := sources.GitLogFilter{
+		Author:           q.Get("author"),
+		Subject:          q.Get("subject"),
+		Since:            since,
+		Until:            until,
+		PullRequestsOnly: q.Get("prs") == "1",
+		MainlineOnly:     q.Get("mainline") == "1",
+	}
+	logs, total, err := h.src.FilterGitLog(filter, limit*page, limit)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
+	w.Header().Set(sourcesLogTotalHeader, strconv.Itoa(total))
 	writeJson(w, logs)
 }
@@ -0,0 +1,19 @@
+package http
+
+import (
+	"net/http"
+)
+
+// sourcesRemoteHandler returns the remote the sources are fetched from, and
+// whether they are served from the local clone because the origin and all
+// mirrors are unreachable
+func (h *HttpServer) sourcesRemoteHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	remote, offline := h.src.RemoteStatus()
+	writeJson(w, map[string]interface{}{
+		"remote":  remote,
+		"offline": offline,
+	})
+}
@@ -0,0 +1,95 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/coordinator/testruns"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+func (h *HttpServer) sweepBudgetHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	sweepID := mux.Vars(r)["sweepID"]
+	if r.Method == "GET" {
+		s, err := h.tr.GetSweepBudget(sweepID)
+		if err == testruns.ErrSweepBudgetNotFound {
+			http.Error(w, "Not found", 404)
+			return
+		}
+		writeJson(w, map[string]interface{}{
+			"budget": s,
+			"used":   s.Used(),
+		})
+		return
+	}
+
+	defer r.Body.Close()
+	var budget common.SweepBudget
+	err := json.NewDecoder(r.Body).Decode(&budget)
+	if err != nil {
+		logging.Errorf("Error parsing request: %s", err.Error())
+		http.Error(w, "Request format incorrect", 500)
+		return
+	}
+	usr, err := h.UserFromRequest(r)
+	if err != nil {
+		logging.Errorf("Error determining user: %s", err.Error())
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+	s, err := h.tr.SetSweepBudget(sweepID, usr.Thumbprint, usr.Admin, budget)
+	if err == testruns.ErrSweepBudgetForbidden {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		writeJson(w, map[string]interface{}{
+			"ok":    false,
+			"error": err.Error(),
+		})
+		return
+	}
+	writeJson(w, map[string]interface{}{
+		"ok":     true,
+		"budget": s,
+		"used":   s.Used(),
+	})
+}
+
+func (h *HttpServer) trimSweepHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	sweepID := mux.Vars(r)["sweepID"]
+	usr, err := h.UserFromRequest(r)
+	if err != nil {
+		logging.Errorf("Error determining user: %s", err.Error())
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+	trimmed, err := h.tr.TrimSweep(sweepID, usr.Thumbprint, usr.Admin)
+	if err == testruns.ErrSweepBudgetNotFound {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	if err == testruns.ErrSweepBudgetForbidden {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		writeJson(w, map[string]interface{}{
+			"ok":    false,
+			"error": err.Error(),
+		})
+		return
+	}
+	writeJson(w, map[string]interface{}{
+		"ok":      true,
+		"trimmed": trimmed,
+	})
+}
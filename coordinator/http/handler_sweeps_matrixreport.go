@@ -0,0 +1,72 @@
+package http
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/mit-dci/opencbdc-tctl/coordinator/testruns"
+)
+
+// sweepMatrixPlotRequests returns the requests for the sweep plot endpoint
+// that compare the cells of a matrix sweep: for every dimension, throughput
+// and latency plotted against it, with a series per value of the next
+// dimension
+func sweepMatrixPlotRequests(
+	report *testruns.SweepMatrixReport,
+) []map[string]interface{} {
+	metrics := []struct {
+		eval, name, shortHand string
+	}{
+		{"r['result']['throughputAvg']", "Average throughput (TX/s)", "Throughput"},
+		{"r['result']['latencyAvg']*1000", "Average latency (ms)", "Latency"},
+	}
+	ret := []map[string]interface{}{}
+	for i, d := range report.Dimensions {
+		for _, m := range metrics {
+			req := map[string]interface{}{
+				"sweepID":             report.SweepID,
+				"type":                "line-err",
+				"title":               fmt.Sprintf("%s by %s", m.shortHand, d.Key()),
+				"xFieldEval":          fmt.Sprintf("r['config']['sweepCell'][%q]", d.Key()),
+				"xFieldName":          d.Key(),
+				"yFieldEval":          m.eval,
+				"yFieldName":          m.name,
+				"yFieldNameShorthand": m.shortHand,
+			}
+			if len(report.Dimensions) > 1 {
+				s := report.Dimensions[(i+1)%len(report.Dimensions)]
+				req["seriesFieldEval"] = fmt.Sprintf(
+					"r['config']['sweepCell'][%q]",
+					s.Key(),
+				)
+				req["seriesFieldName"] = s.Key()
+			}
+			ret = append(ret, req)
+		}
+	}
+	return ret
+}
+
+func (h *HttpServer) sweepMatrixReportHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	vars := mux.Vars(r)
+	report, err := h.tr.GenerateSweepMatrixReport(vars["sweepID"])
+	if err == testruns.ErrSweepNotFound {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	if err != nil {
+		writeJson(w, map[string]interface{}{
+			"ok":    false,
+			"error": err.Error(),
+		})
+		return
+	}
+	writeJson(w, map[string]interface{}{
+		"report": report,
+		"plots":  sweepMatrixPlotRequests(report),
+	})
+}
@@ -12,6 +12,13 @@ func (h *HttpServer) scheduleMissingSweepRuns(
 	w http.ResponseWriter,
 	r *http.Request,
 ) {
+	usr, err := h.UserFromRequest(r)
+	if err != nil {
+		logging.Errorf("Error determining user: %s", err.Error())
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
 	params := mux.Vars(r)
 	sweepID := params["sweepID"]
 	trs := h.tr.GetTestRuns()
@@ -27,6 +34,9 @@ func (h *HttpServer) scheduleMissingSweepRuns(
 			expectedRuns[i].Roles[j].AgentID = -1
 		}
 		expectedRuns[i].AWSInstancesStopped = false
+		// Runs re-scheduled by an admin impersonating the sweep's owner are
+		// attributed to the impersonation
+		expectedRuns[i].ImpersonatedByThumbprint = usr.ImpersonatedBy
 		h.tr.ScheduleTestRun(expectedRuns[i])
 	}
 	writeJsonOK(w)
@@ -0,0 +1,31 @@
+package http
+
+import (
+	"net/http"
+)
+
+// architectureManifestsHandler returns the loaded architecture manifests
+func (h *HttpServer) architectureManifestsHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	writeJson(w, h.tr.ArchitectureManifests())
+}
+
+// reloadArchitectureManifestsHandler reloads the architecture manifests from
+// disk, and returns the errors of the manifests that were skipped
+func (h *HttpServer) reloadArchitectureManifestsHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	errs := h.tr.LoadArchitectureManifests()
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	writeJson(w, map[string]interface{}{
+		"ok":            len(errs) == 0,
+		"errors":        msgs,
+		"architectures": h.tr.Architectures(),
+	})
+}
@@ -0,0 +1,40 @@
+package http
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+func (h *HttpServer) auditLogHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	usr, err := h.RealUserFromRequest(r)
+	if err != nil {
+		logging.Errorf("Error getting user from request: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	if !usr.Admin {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	limit := 500
+	if l := r.URL.Query().Get("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil {
+			http.Error(w, "Request format incorrect", 500)
+			return
+		}
+	}
+	entries, err := h.coord.AuditLog(limit)
+	if err != nil {
+		logging.Errorf("Error reading audit log: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	writeJson(w, entries)
+}
@@ -0,0 +1,58 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/mit-dci/opencbdc-tctl/coordinator/testruns"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+func (h *HttpServer) capacityPlannerHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	if r.Method == "GET" {
+		writeJson(w, map[string]interface{}{
+			"config": h.tr.Config().CapacityPlanner,
+			"plan":   h.tr.ScalePlan(),
+		})
+		return
+	}
+	if r.Method == "PUT" {
+		usr, err := h.RealUserFromRequest(r)
+		if err != nil {
+			logging.Errorf("Error getting user from request: %v", err)
+			http.Error(w, "Internal Server Error", 500)
+			return
+		}
+		if !usr.Admin {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		defer r.Body.Close()
+		var cfg testruns.CapacityPlannerConfig
+		err = json.NewDecoder(r.Body).Decode(&cfg)
+		if err != nil {
+			logging.Errorf("Error parsing request: %s", err.Error())
+			http.Error(w, "Request format incorrect", 500)
+			return
+		}
+		if cfg.MinAgents < 0 || cfg.BudgetMaxAgents < 0 ||
+			cfg.LookaheadMinutes < 0 ||
+			(cfg.BudgetMaxAgents > 0 && cfg.MinAgents > cfg.BudgetMaxAgents) {
+			http.Error(w, "Request format incorrect", 500)
+			return
+		}
+		err = h.tr.SetCapacityPlannerConfig(cfg)
+		if err != nil {
+			logging.Errorf("Error saving capacity planner config: %v", err)
+			http.Error(w, "Internal Server Error", 500)
+			return
+		}
+		writeJsonOK(w)
+		return
+	}
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+}
@@ -0,0 +1,14 @@
+package http
+
+import (
+	"net/http"
+)
+
+// distributedBinariesHandler returns the binaries archives the coordinator
+// uploaded to S3 to distribute them to the agents
+func (h *HttpServer) distributedBinariesHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	writeJson(w, h.tr.DistributedBinaries())
+}
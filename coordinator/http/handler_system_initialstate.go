@@ -3,7 +3,6 @@ package http
 import (
 	"net/http"
 
-	"github.com/mit-dci/opencbdc-tctl/common"
 	"github.com/mit-dci/opencbdc-tctl/logging"
 )
 
@@ -37,7 +36,7 @@ func (h *HttpServer) initialStateHandler(
 		"commits":         commits,
 		"agentCount":      h.coord.GetAgentCount(),
 		"launchTemplates": h.awsm.LaunchTemplates(),
-		"architectures":   common.AvailableArchitectures,
+		"architectures":   h.tr.Architectures(),
 		"version":         h.version,
 		"maintenance":     h.coord.GetMaintenance(),
 		"config":          h.tr.Config(),
@@ -51,5 +50,6 @@ func (h *HttpServer) initialStateHandler(
 		"testRunFields":   h.testRunFieldList(),
 		"perfGraphs":      h.performancePlotTypes(),
 		"shardSeeds":      h.awsm.GetAvailableSeeds(),
+		"announcements":   h.coord.ActiveAnnouncements(),
 	})
 }
@@ -0,0 +1,49 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+func (h *HttpServer) instanceCostsHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	if r.Method == "GET" {
+		writeJson(w, h.tr.Config().InstanceHourlyCosts)
+		return
+	}
+	usr, err := h.RealUserFromRequest(r)
+	if err != nil {
+		logging.Errorf("Error determining user: %s", err.Error())
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	if !usr.Admin {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	defer r.Body.Close()
+	costs := map[string]float64{}
+	err = json.NewDecoder(r.Body).Decode(&costs)
+	if err != nil {
+		logging.Errorf("Error parsing request: %s", err.Error())
+		http.Error(w, "Request format incorrect", 500)
+		return
+	}
+	for _, c := range costs {
+		if c < 0 {
+			http.Error(w, "Request format incorrect", 500)
+			return
+		}
+	}
+	err = h.tr.SetInstanceHourlyCosts(costs)
+	if err != nil {
+		logging.Errorf("Error saving instance costs: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	writeJsonOK(w)
+}
@@ -0,0 +1,75 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/coordinator/testruns"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+func (h *HttpServer) lintRulesHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	if r.Method == "GET" {
+		writeJson(w, h.tr.LintRules())
+		return
+	}
+	if r.Method == "PUT" {
+		usr, err := h.RealUserFromRequest(r)
+		if err != nil {
+			logging.Errorf("Error getting user from request: %v", err)
+			http.Error(w, "Internal Server Error", 500)
+			return
+		}
+		if !usr.Admin {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		defer r.Body.Close()
+		var rules []testruns.LintRule
+		err = json.NewDecoder(r.Body).Decode(&rules)
+		if err != nil {
+			logging.Errorf("Error parsing request: %s", err.Error())
+			http.Error(w, "Request format incorrect", 500)
+			return
+		}
+		err = h.tr.SetLintRules(rules)
+		if err != nil {
+			logging.Warnf("Error saving lint rules: %v", err)
+			writeJson(w, map[string]interface{}{
+				"ok":    false,
+				"error": err.Error(),
+			})
+			return
+		}
+		writeJsonOK(w)
+		return
+	}
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+}
+
+// lintTestRunHandler applies the lint rules to a test run configuration without
+// scheduling it, such that the frontend can show the violations before the
+// user submits the configuration
+func (h *HttpServer) lintTestRunHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	defer r.Body.Close()
+	var tr common.TestRun
+	err := json.NewDecoder(r.Body).Decode(&tr)
+	if err != nil {
+		logging.Errorf("Error parsing request: %s", err.Error())
+		http.Error(w, "Request format incorrect", 500)
+		return
+	}
+	if tr.Repeat == 0 {
+		tr.Repeat = 1
+	}
+	runs := common.ExpandSweepRun(&tr, "")
+	writeJson(w, h.tr.LintTestRuns(runs))
+}
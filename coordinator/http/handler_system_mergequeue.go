@@ -0,0 +1,59 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/mit-dci/opencbdc-tctl/coordinator/testruns"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+func (h *HttpServer) mergeQueueHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	if r.Method == "GET" {
+		writeJson(w, map[string]interface{}{
+			"config": h.tr.Config().MergeQueue,
+		})
+		return
+	}
+	if r.Method == "PUT" {
+		usr, err := h.RealUserFromRequest(r)
+		if err != nil {
+			logging.Errorf("Error getting user from request: %v", err)
+			http.Error(w, "Internal Server Error", 500)
+			return
+		}
+		if !usr.Admin {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		defer r.Body.Close()
+		var cfg testruns.MergeQueueConfig
+		err = json.NewDecoder(r.Body).Decode(&cfg)
+		if err != nil {
+			logging.Errorf("Error parsing request: %s", err.Error())
+			http.Error(w, "Request format incorrect", 500)
+			return
+		}
+		err = cfg.Validate()
+		if err != nil {
+			writeJson(w, map[string]interface{}{
+				"ok":    false,
+				"error": err.Error(),
+			})
+			return
+		}
+		err = h.tr.SetMergeQueueConfig(cfg)
+		if err != nil {
+			logging.Errorf("Error saving merge queue config: %v", err)
+			http.Error(w, "Internal Server Error", 500)
+			return
+		}
+		writeJsonOK(w)
+		return
+	}
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+}
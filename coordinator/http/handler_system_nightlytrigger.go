@@ -0,0 +1,31 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/mit-dci/opencbdc-tctl/coordinator/testruns"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// nightlyTriggerHandler runs the nightly pipeline now. Updating the sources
+// and compiling takes a while, so the pipeline runs in the background and its
+// outcome is recorded in the nightly history
+func (h *HttpServer) nightlyTriggerHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	if h.tr.NightlyRunning() {
+		writeJson(w, map[string]interface{}{
+			"ok":    false,
+			"error": testruns.ErrNightlyRunning.Error(),
+		})
+		return
+	}
+	go func() {
+		_, err := h.tr.TriggerNightly()
+		if err != nil {
+			logging.Errorf("Manually triggered nightly pipeline failed: %v", err)
+		}
+	}()
+	writeJsonOK(w)
+}
@@ -0,0 +1,50 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/mit-dci/opencbdc-tctl/coordinator/testruns"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// startupPlansHandler returns the startup plans in use by architecture (GET),
+// or replaces the configured ones (PUT). Architectures without a configured
+// plan use their built-in one
+func (h *HttpServer) startupPlansHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	if r.Method == "GET" {
+		writeJson(w, h.tr.StartupPlans())
+		return
+	}
+	usr, err := h.RealUserFromRequest(r)
+	if err != nil {
+		logging.Errorf("Error getting user from request: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	if !usr.Admin {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	defer r.Body.Close()
+	plans := map[string]testruns.StartupPlan{}
+	err = json.NewDecoder(r.Body).Decode(&plans)
+	if err != nil {
+		logging.Errorf("Error parsing request: %s", err.Error())
+		http.Error(w, "Request format incorrect", 500)
+		return
+	}
+	err = h.tr.SetStartupPlans(plans)
+	if err != nil {
+		logging.Warnf("Error saving startup plans: %v", err)
+		writeJson(w, map[string]interface{}{
+			"ok":    false,
+			"error": err.Error(),
+		})
+		return
+	}
+	writeJsonOK(w)
+}
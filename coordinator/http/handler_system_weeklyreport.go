@@ -0,0 +1,67 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/mit-dci/opencbdc-tctl/coordinator/testruns"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+func (h *HttpServer) weeklyReportHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	if r.Method == "GET" {
+		writeJson(w, map[string]interface{}{
+			"config":  h.tr.Config().WeeklyReport,
+			"next":    h.tr.NextWeeklyReport(),
+			"running": h.tr.WeeklyReportRunning(),
+			"history": h.tr.WeeklyReportHistory(),
+		})
+		return
+	}
+	if r.Method == "PUT" {
+		defer r.Body.Close()
+		var cfg testruns.WeeklyReportConfig
+		err := json.NewDecoder(r.Body).Decode(&cfg)
+		if err != nil {
+			logging.Errorf("Error parsing request: %s", err.Error())
+			http.Error(w, "Request format incorrect", 500)
+			return
+		}
+		// The coordinator POSTs to the webhooks from inside the network, so
+		// only admins may point them elsewhere
+		current := h.tr.Config().WeeklyReport.NotifyWebhooks
+		if strings.Join(cfg.NotifyWebhooks, "\n") != strings.Join(current, "\n") {
+			usr, err := h.RealUserFromRequest(r)
+			if err != nil {
+				logging.Errorf("Error determining user: %s", err.Error())
+				http.Error(w, "Internal Server Error", 500)
+				return
+			}
+			if !usr.Admin {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+		}
+		err = cfg.Validate()
+		if err != nil {
+			writeJson(w, map[string]interface{}{
+				"ok":    false,
+				"error": err.Error(),
+			})
+			return
+		}
+		err = h.tr.SetWeeklyReportConfig(cfg)
+		if err != nil {
+			logging.Errorf("Error saving weekly report config: %v", err)
+			http.Error(w, "Internal Server Error", 500)
+			return
+		}
+		writeJsonOK(w)
+		return
+	}
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+}
@@ -0,0 +1,31 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/mit-dci/opencbdc-tctl/coordinator/testruns"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// weeklyReportTriggerHandler runs the weekly report job now. Updating the
+// sources and resolving the release takes a while, so the job runs in the
+// background and its outcome is recorded in the weekly report history
+func (h *HttpServer) weeklyReportTriggerHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	if h.tr.WeeklyReportRunning() {
+		writeJson(w, map[string]interface{}{
+			"ok":    false,
+			"error": testruns.ErrWeeklyReportRunning.Error(),
+		})
+		return
+	}
+	go func() {
+		_, err := h.tr.TriggerWeeklyReport()
+		if err != nil {
+			logging.Errorf("Manually triggered weekly report failed: %v", err)
+		}
+	}()
+	writeJsonOK(w)
+}
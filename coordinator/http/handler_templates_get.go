@@ -0,0 +1,33 @@
+package http
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/mit-dci/opencbdc-tctl/coordinator/testruns"
+)
+
+// getTestRunTemplateHandler returns the latest version of the template, or
+// the version given in the query string
+func (h *HttpServer) getTestRunTemplateHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	vars := mux.Vars(r)
+	version := 0
+	if v := r.URL.Query().Get("version"); v != "" {
+		var err error
+		version, err = strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "Request format incorrect", 500)
+			return
+		}
+	}
+	tpl, err := h.tr.GetTestRunTemplate(vars["templateID"], version)
+	if err == testruns.ErrTestRunTemplateNotFound {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	writeJson(w, tpl)
+}
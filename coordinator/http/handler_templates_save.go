@@ -0,0 +1,48 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/mit-dci/opencbdc-tctl/coordinator/testruns"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// saveTestRunTemplateHandler creates a template (POST), or saves a new
+// version of an existing one (PUT with the template ID in the path)
+func (h *HttpServer) saveTestRunTemplateHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	defer r.Body.Close()
+	var tpl testruns.TestRunTemplate
+	err := json.NewDecoder(r.Body).Decode(&tpl)
+	if err != nil {
+		http.Error(w, "Request format incorrect", 500)
+		return
+	}
+
+	usr, err := h.UserFromRequest(r)
+	if err != nil {
+		logging.Errorf("Error getting user from request: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	id := mux.Vars(r)["templateID"]
+	saved, err := h.tr.SaveTestRunTemplate(id, &tpl, usr.Thumbprint)
+	if err == testruns.ErrTestRunTemplateNotFound {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	if err != nil {
+		logging.Warnf("Error saving test run template: %v", err)
+		writeJson(w, map[string]interface{}{
+			"ok":    false,
+			"error": err.Error(),
+		})
+		return
+	}
+	writeJson(w, saved)
+}
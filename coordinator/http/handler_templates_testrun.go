@@ -0,0 +1,53 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/mit-dci/opencbdc-tctl/coordinator/testruns"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// templateTestRunHandler returns the test run resulting from the template,
+// with the posted parameters as overrides. Like shadow runs, the test run is
+// returned rather than scheduled, such that the user can review it before
+// posting it to the regular schedule endpoint
+func (h *HttpServer) templateTestRunHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	defer r.Body.Close()
+	overrides := map[string]interface{}{}
+	err := json.NewDecoder(r.Body).Decode(&overrides)
+	if err != nil {
+		logging.Errorf("Error parsing request: %s", err.Error())
+		http.Error(w, "Request format incorrect", 500)
+		return
+	}
+
+	version := 0
+	if v := r.URL.Query().Get("version"); v != "" {
+		version, err = strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "Request format incorrect", 500)
+			return
+		}
+	}
+
+	vars := mux.Vars(r)
+	tr, err := h.tr.TestRunFromTemplate(vars["templateID"], version, overrides)
+	if err == testruns.ErrTestRunTemplateNotFound {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	if err != nil {
+		writeJson(w, map[string]interface{}{
+			"ok":    false,
+			"error": err.Error(),
+		})
+		return
+	}
+	writeJson(w, tr)
+}
@@ -0,0 +1,21 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/mit-dci/opencbdc-tctl/coordinator/testruns"
+)
+
+func (h *HttpServer) testRunTemplateVersionsHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	vars := mux.Vars(r)
+	versions, err := h.tr.TestRunTemplateVersions(vars["templateID"])
+	if err == testruns.ErrTestRunTemplateNotFound {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	writeJson(w, versions)
+}
@@ -0,0 +1,32 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// testRunAgentHealthHandler returns the utilization of the agents of the test
+// run, and which of them saturated their resources
+func (h *HttpServer) testRunAgentHealthHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	params := mux.Vars(r)
+	runID := params["runID"]
+
+	tr, ok := h.tr.GetTestRun(runID)
+	if !ok {
+		http.Error(w, "Not found", 404)
+		return
+	}
+
+	agents, err := h.tr.AgentHealth(tr)
+	if err != nil {
+		logging.Errorf("Error reading agent health: %v", err)
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+	writeJson(w, map[string]interface{}{"agents": agents})
+}
@@ -0,0 +1,51 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// testRunAnnotateHandler attaches a comment, note or verdict to a test run or
+// one of its plots
+func (h *HttpServer) testRunAnnotateHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	defer r.Body.Close()
+	var req common.Annotation
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "Request format incorrect", 500)
+		return
+	}
+
+	id := mux.Vars(r)["runID"]
+	if _, ok := h.tr.GetTestRun(id); !ok {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	usr, err := h.UserFromRequest(r)
+	if err != nil {
+		logging.Errorf("Error determining user: %s", err.Error())
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+	a, err := h.tr.AnnotateTestRun(id, req, usr.Thumbprint)
+	if err != nil {
+		writeJson(w, map[string]interface{}{
+			"ok":    false,
+			"error": err.Error(),
+		})
+		return
+	}
+	// The list entries of test runs that ended are cached
+	frontendRunCache.Delete(id)
+	writeJson(w, map[string]interface{}{
+		"ok":         true,
+		"annotation": a,
+	})
+}
@@ -0,0 +1,72 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/mit-dci/opencbdc-tctl/coordinator/testruns"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+func (h *HttpServer) testRunBenchmarkSubmissionHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	params := mux.Vars(r)
+	runID := params["runID"]
+
+	run, ok := h.tr.GetTestRun(runID)
+	if !ok {
+		http.Error(w, "Not found", 404)
+		return
+	}
+
+	sub, err := h.tr.BenchmarkSubmission(run)
+	if err != nil {
+		writeJson(w, map[string]interface{}{"ok": false, "error": err.Error()})
+		return
+	}
+	writeJson(w, sub)
+}
+
+// testRunsBenchmarkSubmissionsHandler exports the results of multiple test
+// runs (for instance all runs of a sweep) in the community benchmark registry
+// format. Runs that cannot be exported are reported in the errors
+func (h *HttpServer) testRunsBenchmarkSubmissionsHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	defer r.Body.Close()
+	var req struct {
+		RunIDs []string `json:"runIDs"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logging.Errorf("Error parsing request: %s", err.Error())
+		http.Error(w, "Request format incorrect", 500)
+		return
+	}
+
+	subs := []*testruns.BenchmarkSubmission{}
+	errs := map[string]string{}
+	for _, id := range req.RunIDs {
+		run, ok := h.tr.GetTestRun(id)
+		if !ok {
+			errs[id] = "Not found"
+			continue
+		}
+		sub, err := h.tr.BenchmarkSubmission(run)
+		if err != nil {
+			errs[id] = err.Error()
+			continue
+		}
+		subs = append(subs, sub)
+	}
+	writeJson(w, map[string]interface{}{
+		"schema":      testruns.BenchmarkSubmissionSchema,
+		"submissions": subs,
+		"errors":      errs,
+	})
+}
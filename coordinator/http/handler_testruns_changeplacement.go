@@ -0,0 +1,53 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// testRunChangePlacementHandler moves roles of a queued test run to another
+// agent. The body is a list of placement changes, each moving a role to a
+// connected agent, a new agent from a launch template, or the agent of
+// another role
+func (h *HttpServer) testRunChangePlacementHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	defer r.Body.Close()
+	params := mux.Vars(r)
+	runID := params["runID"]
+	tr, ok := h.tr.GetTestRun(runID)
+	if !ok {
+		http.Error(w, "Not found", 404)
+		return
+	}
+
+	var changes []common.PlacementChange
+	err := json.NewDecoder(r.Body).Decode(&changes)
+	if err != nil {
+		logging.Errorf("Error parsing request: %s", err.Error())
+		http.Error(w, "Request format incorrect", 500)
+		return
+	}
+
+	usr, err := h.UserFromRequest(r)
+	if err != nil {
+		logging.Errorf("Error determining user: %s", err.Error())
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	err = h.tr.ChangePlacement(tr, changes, usr.Thumbprint)
+	if err != nil {
+		writeJson(w, map[string]interface{}{
+			"ok":    false,
+			"error": err.Error(),
+		})
+		return
+	}
+	writeJson(w, h.tr.Placement(tr))
+}
@@ -46,7 +46,14 @@ func (h *HttpServer) testRunConfirmPeakHandler(
 			http.Error(w, "Internal Server Error", 500)
 			return
 		}
-		h.tr.ScheduleSweepRuns(trs)
+		err = h.tr.ScheduleSweepRuns(trs)
+		if err != nil {
+			writeJson(w, map[string]interface{}{
+				"ok":    false,
+				"error": err.Error(),
+			})
+			return
+		}
 	} else {
 		h.tr.ContinueSweep(run, run.SweepID)
 	}
@@ -0,0 +1,46 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/mit-dci/opencbdc-tctl/coordinator/testruns"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// testRunDeleteAnnotationHandler removes an annotation the user made from a
+// test run
+func (h *HttpServer) testRunDeleteAnnotationHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	vars := mux.Vars(r)
+	if _, ok := h.tr.GetTestRun(vars["runID"]); !ok {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	usr, err := h.UserFromRequest(r)
+	if err != nil {
+		logging.Errorf("Error determining user: %s", err.Error())
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+	err = h.tr.DeleteAnnotation(
+		vars["runID"],
+		vars["annotationID"],
+		usr.Thumbprint,
+	)
+	if err == testruns.ErrAnnotationNotFound {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	if err != nil {
+		writeJson(w, map[string]interface{}{
+			"ok":    false,
+			"error": err.Error(),
+		})
+		return
+	}
+	frontendRunCache.Delete(vars["runID"])
+	writeJsonOK(w)
+}
@@ -0,0 +1,37 @@
+package http
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// testRunExportBundleHandler downloads the bundle to reproduce the test run
+// on another controller. The bundle is built in memory first, such that
+// errors can be reported rather than ending up with a truncated download
+func (h *HttpServer) testRunExportBundleHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	params := mux.Vars(r)
+	runID := params["runID"]
+
+	run, ok := h.tr.GetTestRun(runID)
+	if !ok {
+		http.Error(w, "Not found", 404)
+		return
+	}
+
+	var buf bytes.Buffer
+	err := h.tr.ExportBundle(run, &buf)
+	if err != nil {
+		writeJson(w, map[string]interface{}{"ok": false, "error": err.Error()})
+		return
+	}
+	w.Header().Add("Content-Type", "application/zip")
+	w.Header().
+		Add("Content-Disposition", fmt.Sprintf("attachment; filename=\"testrun-bundle-%s.zip\"", runID))
+	_, _ = w.Write(buf.Bytes())
+}
@@ -0,0 +1,53 @@
+package http
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// failureRatePeriods are the bucket sizes the failure rates can be grouped by
+var failureRatePeriods = map[string]time.Duration{
+	"hour": time.Hour,
+	"day":  time.Hour * 24,
+	"week": time.Hour * 24 * 7,
+}
+
+func (h *HttpServer) failureRatesHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	q := r.URL.Query()
+	days := 30
+	if d := q.Get("days"); d != "" {
+		var err error
+		days, err = strconv.Atoi(d)
+		if err != nil || days <= 0 {
+			http.Error(w, "Request format incorrect", 500)
+			return
+		}
+	}
+	period := failureRatePeriods["day"]
+	if p := q.Get("period"); p != "" {
+		var ok bool
+		period, ok = failureRatePeriods[p]
+		if !ok {
+			http.Error(w, "Request format incorrect", 500)
+			return
+		}
+	}
+
+	buckets, err := h.tr.FailureRates(
+		time.Now().Add(-time.Duration(days)*time.Hour*24),
+		period,
+		q.Get("architecture"),
+	)
+	if err != nil {
+		logging.Errorf("Error calculating failure rates: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	writeJson(w, buckets)
+}
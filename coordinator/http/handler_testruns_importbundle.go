@@ -0,0 +1,38 @@
+package http
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// maxBundleSize is the maximum size of a test run bundle that can be imported
+const maxBundleSize = 512 << 20
+
+// testRunImportBundleHandler recreates the definition of a test run from a
+// bundle exported by (another) controller. Like template runs, the test run
+// is returned rather than scheduled, such that the user can review it before
+// posting it to the regular schedule endpoint
+func (h *HttpServer) testRunImportBundleHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	defer r.Body.Close()
+	bundle, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBundleSize))
+	if err != nil {
+		logging.Errorf("Error reading bundle: %s", err.Error())
+		http.Error(w, "Request format incorrect", 500)
+		return
+	}
+
+	imp, err := h.tr.ImportBundle(bundle)
+	if err != nil {
+		writeJson(w, map[string]interface{}{
+			"ok":    false,
+			"error": err.Error(),
+		})
+		return
+	}
+	writeJson(w, imp)
+}
@@ -0,0 +1,61 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+type testRunLabelsRequest struct {
+	Labels []string `json:"labels"`
+}
+
+// testRunLabelsHandler replaces the labels of a test run. Only the user that
+// scheduled the test run or an admin can relabel it
+func (h *HttpServer) testRunLabelsHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	defer r.Body.Close()
+	var req testRunLabelsRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "Request format incorrect", 500)
+		return
+	}
+
+	usr, err := h.UserFromRequest(r)
+	if err != nil {
+		logging.Errorf("Error getting user from request: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	id := mux.Vars(r)["runID"]
+	existing, ok := h.tr.GetTestRun(id)
+	if !ok {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	if existing.CreatedByThumbprint != usr.Thumbprint && !usr.Admin {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	tr, err := h.tr.SetTestRunLabels(id, req.Labels)
+	if err != nil {
+		logging.Warnf("Error setting test run labels: %v", err)
+		writeJson(w, map[string]interface{}{
+			"ok":    false,
+			"error": err.Error(),
+		})
+		return
+	}
+	// The list entries of test runs that ended are cached
+	frontendRunCache.Delete(tr.ID)
+	writeJson(w, map[string]interface{}{
+		"ok":   true,
+		"tags": tr.Tags,
+	})
+}
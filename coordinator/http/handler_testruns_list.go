@@ -0,0 +1,46 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/mit-dci/opencbdc-tctl/coordinator/testruns"
+)
+
+// testRunListHandler returns the test runs, filtered by the label expression
+// in the `labels` query parameter or the one of the saved search in the
+// `search` query parameter if given
+func (h *HttpServer) testRunListHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	q := r.URL.Query()
+	expr := q.Get("labels")
+	if id := q.Get("search"); id != "" {
+		s, err := h.tr.GetSavedSearch(id)
+		if err == testruns.ErrSavedSearchNotFound {
+			http.Error(w, "Not found", 404)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Internal Server Error", 500)
+			return
+		}
+		expr = s.Expression
+	}
+	le, err := testruns.ParseLabelExpression(expr)
+	if err != nil {
+		writeJson(w, map[string]interface{}{
+			"ok":    false,
+			"error": err.Error(),
+		})
+		return
+	}
+
+	res := []FrontendTestRunListEntry{}
+	for _, tr := range h.frontendTestRunList() {
+		if le.Matches(tr.Tags) {
+			res = append(res, tr)
+		}
+	}
+	writeJson(w, res)
+}
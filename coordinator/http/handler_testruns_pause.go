@@ -0,0 +1,63 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+func (h *HttpServer) pauseTestRunHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	h.suspendTestRun(w, r, false)
+}
+
+func (h *HttpServer) resumeTestRunHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	h.suspendTestRun(w, r, true)
+}
+
+// suspendTestRun pauses or resumes the load generators of the test run in the
+// request
+func (h *HttpServer) suspendTestRun(
+	w http.ResponseWriter,
+	r *http.Request,
+	resume bool,
+) {
+	params := mux.Vars(r)
+	runID := params["runID"]
+	tr, ok := h.tr.GetTestRun(runID)
+	if !ok {
+		http.Error(w, "Not found", 404)
+		return
+	}
+
+	usr, err := h.UserFromRequest(r)
+	if err != nil {
+		logging.Errorf("Error determining user: %s", err.Error())
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+	if tr.CreatedByThumbprint != usr.Thumbprint && !usr.Admin {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if resume {
+		err = h.tr.ResumeTestRun(tr, usr.Thumbprint)
+	} else {
+		err = h.tr.PauseTestRun(tr, usr.Thumbprint)
+	}
+	if err != nil {
+		writeJson(w, map[string]interface{}{
+			"ok":    false,
+			"error": err.Error(),
+		})
+		return
+	}
+	writeJsonOK(w)
+}
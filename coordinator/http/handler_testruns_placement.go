@@ -0,0 +1,23 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// testRunPlacementHandler returns the agents the roles of a test run are (to
+// be) placed on, and the manual changes made to the placement
+func (h *HttpServer) testRunPlacementHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	params := mux.Vars(r)
+	runID := params["runID"]
+	tr, ok := h.tr.GetTestRun(runID)
+	if !ok {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	writeJson(w, h.tr.Placement(tr))
+}
@@ -4,6 +4,7 @@ import (
 	"net/http"
 
 	"github.com/gorilla/mux"
+	"github.com/mit-dci/opencbdc-tctl/logging"
 )
 
 func (h *HttpServer) prioritizeTestRunHandler(
@@ -17,6 +18,16 @@ func (h *HttpServer) prioritizeTestRunHandler(
 		http.Error(w, "Not found", 404)
 		return
 	}
+	usr, err := h.UserFromRequest(r)
+	if err != nil {
+		logging.Errorf("Error getting user from request: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	if checkPriority(usr, tr.Priority+1) != nil {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
 	tr.Priority = tr.Priority + 1
 	h.tr.PersistTestRun(tr)
 	writeJsonOK(w)
@@ -0,0 +1,67 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+type reprocessBody struct {
+	TestRunIDs []string `json:"testRunIDs"`
+}
+
+func (h *HttpServer) reprocessOutdatedResultsHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	usr, err := h.UserFromRequest(r)
+	if err != nil {
+		logging.Errorf("Error determining user: %s", err.Error())
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	job, err := h.tr.ReprocessOutdatedResults(usr.Email)
+	if err != nil {
+		logging.Errorf("Error starting reprocess job: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	writeJson(w, &job)
+}
+
+func (h *HttpServer) reprocessJobsHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	if r.Method == "GET" {
+		writeJson(w, h.tr.ReprocessJobs())
+		return
+	}
+
+	defer r.Body.Close()
+	body := reprocessBody{}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil || len(body.TestRunIDs) == 0 {
+		http.Error(w, "Request format incorrect", 500)
+		return
+	}
+
+	usr, err := h.UserFromRequest(r)
+	if err != nil {
+		logging.Errorf("Error determining user: %s", err.Error())
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	job, err := h.tr.StartReprocessJob(body.TestRunIDs, usr.Email)
+	if err != nil {
+		writeJson(w, map[string]interface{}{
+			"ok":    false,
+			"error": err.Error(),
+		})
+		return
+	}
+	writeJson(w, &job)
+}
@@ -2,9 +2,15 @@ package http
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/coordinator/testruns"
 	"github.com/mit-dci/opencbdc-tctl/logging"
 )
 
@@ -13,14 +19,25 @@ func (h *HttpServer) scheduleTestRunHandler(
 	r *http.Request,
 ) {
 	defer r.Body.Close()
-	var tr common.TestRun
-
-	err := json.NewDecoder(r.Body).Decode(&tr)
+	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		logging.Errorf("Error parsing request: %s", err.Error())
 		http.Error(w, "Request format incorrect", 500)
 		return
 	}
+	tr, err := h.submittedTestRun(body)
+	if err == errRequestFormat {
+		logging.Errorf("Error parsing request: %s", err.Error())
+		http.Error(w, "Request format incorrect", 500)
+		return
+	}
+	if err != nil {
+		writeJson(w, map[string]interface{}{
+			"ok":    false,
+			"error": err.Error(),
+		})
+		return
+	}
 
 	usr, err := h.UserFromRequest(r)
 	if err != nil {
@@ -28,8 +45,21 @@ func (h *HttpServer) scheduleTestRunHandler(
 		http.Error(w, "Internal server error", 500)
 		return
 	}
+	if err := checkPriority(usr, tr.Priority); err != nil {
+		writeJson(w, map[string]interface{}{
+			"ok":    false,
+			"error": err.Error(),
+		})
+		return
+	}
 	tr.CreatedByThumbprint = usr.Thumbprint
+	tr.ImpersonatedByThumbprint = usr.ImpersonatedBy
 	tr.SweepID = ""
+	tr.AwaitingApproval = false
+	tr.ApprovedByThumbprint = ""
+	// Runs copied from an earlier run record the digest of the image they
+	// run in themselves
+	tr.ContainerImageDigest = ""
 
 	sweepID, err := common.RandomID(12)
 	if err != nil {
@@ -37,24 +67,175 @@ func (h *HttpServer) scheduleTestRunHandler(
 		http.Error(w, "Internal server error", 500)
 		return
 	}
-	if tr.Repeat == 0 {
-		tr.Repeat = 1
+	testruns.ApplySubmissionDefaults(tr)
+	testruns.StripSystemTags(tr)
+
+	errs := validateSweep(tr)
+	errs = append(errs, h.tr.ValidateDependencies(tr)...)
+	if len(errs) > 0 {
+		msgs := make([]string, len(errs))
+		for i, e := range errs {
+			msgs[i] = e.Error()
+		}
+		writeJson(w, map[string]interface{}{
+			"ok":    false,
+			"error": strings.Join(msgs, "; "),
+		})
+		return
+	}
+
+	runs := common.ExpandSweepRun(tr, sweepID)
+
+	commits := []string{tr.CommitHash}
+	if tr.Sweep == "comparison" {
+		commits = append(commits, tr.CompareCommitHash)
+	}
+	violations, rejected, requireApproval := h.lintSubmission(runs, commits)
+	if rejected {
+		writeJson(w, map[string]interface{}{
+			"ok":         false,
+			"violations": violations,
+		})
+		return
+	}
+
+	if tr.SweepBudget != nil {
+		_, err = h.tr.SetSweepBudget(
+			sweepID,
+			usr.Thumbprint,
+			usr.Admin,
+			*tr.SweepBudget,
+		)
+		if err != nil {
+			writeJson(w, map[string]interface{}{
+				"ok":    false,
+				"error": err.Error(),
+			})
+			return
+		}
+	}
+
+	// Sweeps run one at a time or with limited concurrency schedule the rest
+	// of their runs as these finish
+	ids := []string{}
+	runSweepID := ""
+	for _, run := range testruns.InitialSweepRuns(tr, runs) {
+		run.AwaitingApproval = requireApproval
+		h.tr.ScheduleTestRun(run)
+		ids = append(ids, run.ID)
+		runSweepID = run.SweepID
 	}
+	writeJson(w, map[string]interface{}{
+		"ok":         true,
+		"violations": violations,
+		"testRunIDs": ids,
+		"sweepID":    runSweepID,
+	})
+}
 
-	if tr.WatchtowerErrorCacheSize == 0 {
-		tr.WatchtowerErrorCacheSize = 10000000
+// lintSubmission applies the configured lint rules to the runs of a
+// submission. Rejections prevent the runs from being scheduled at all,
+// approval requirements hold the runs in the queue until someone else
+// approves them. Commits known not to compile are warned about, since the
+// runs would fail while building the binaries. Returns the violations, and
+// whether the runs are rejected or require approval
+func (h *HttpServer) lintSubmission(
+	runs []*common.TestRun,
+	commits []string,
+) ([]testruns.LintViolation, bool, bool) {
+	violations := h.tr.LintTestRuns(runs)
+	for _, c := range commits {
+		if f, broken := h.src.KnownBroken(c); broken {
+			violations = append(violations, testruns.LintViolation{
+				RuleID: "knownBrokenCommit",
+				Name:   "Known broken commit",
+				Message: fmt.Sprintf(
+					"%s of commit %s failed on %s (build failure %s)",
+					f.Step,
+					c,
+					f.Failed.Format(time.RFC3339),
+					f.ID,
+				),
+				Action: testruns.LintRuleActionWarn,
+			})
+		}
 	}
+	rejected := false
+	requireApproval := false
+	for _, v := range violations {
+		if v.Action == testruns.LintRuleActionReject {
+			rejected = true
+		}
+		if v.Action == testruns.LintRuleActionRequireApproval {
+			requireApproval = true
+		}
+	}
+	return violations, rejected, requireApproval
+}
+
+// errRequestFormat is returned by submittedTestRun if the request body is not
+// a test run
+var errRequestFormat = errors.New("Request format incorrect")
+
+// errPriorityForbidden is returned when a user that is not an admin submits a
+// test run with a priority above normal. Such runs can preempt the runs of
+// other users
+var errPriorityForbidden = errors.New(
+	"Only admins can schedule test runs with a priority above normal",
+)
 
-	if tr.Sweep == "peak" {
-		tr.SweepOneAtATime = true
+// checkPriority returns errPriorityForbidden if the user cannot schedule test
+// runs of the given priority
+func checkPriority(usr *SystemUser, priority int) error {
+	if priority > common.TestRunPriorityNormal && !usr.Admin {
+		return errPriorityForbidden
+	}
+	return nil
+}
+
+// submittedTestRun parses the test run submitted in the request body. Runs
+// referencing a template inherit its parameters, the parameters in the
+// request override them
+func (h *HttpServer) submittedTestRun(body []byte) (*common.TestRun, error) {
+	tr := &common.TestRun{}
+	err := json.Unmarshal(body, tr)
+	if err != nil {
+		return nil, errRequestFormat
+	}
+	if tr.TemplateID == "" {
+		return tr, nil
 	}
 
-	runs := common.ExpandSweepRun(&tr, sweepID)
-	for i := range runs {
-		h.tr.ScheduleTestRun(runs[i])
-		if tr.SweepOneAtATime {
-			break
+	overrides := map[string]interface{}{}
+	err = json.Unmarshal(body, &overrides)
+	if err != nil {
+		return nil, errRequestFormat
+	}
+	delete(overrides, "templateID")
+	delete(overrides, "templateVersion")
+	return h.tr.TestRunFromTemplate(
+		tr.TemplateID,
+		tr.TemplateVersion,
+		overrides,
+	)
+}
+
+// validateSweep checks the parameters of the sweep types that have their own
+// validation
+func validateSweep(tr *common.TestRun) []error {
+	errs := []error{}
+	switch tr.Sweep {
+	case "matrix":
+		errs = common.ValidateSweepMatrix(tr)
+	case "comparison":
+		errs = common.ValidateComparisonRun(tr)
+	}
+	if tr.SweepBudget != nil {
+		if tr.Sweep == "" && tr.Repeat <= 1 {
+			errs = append(errs, errors.New("Budgets only apply to sweeps"))
+		} else if err := testruns.ValidateSweepBudget(*tr.SweepBudget); err != nil {
+			errs = append(errs, err)
 		}
 	}
-	writeJsonOK(w)
+	return errs
 }
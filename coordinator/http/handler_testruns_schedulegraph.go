@@ -0,0 +1,168 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/coordinator/testruns"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// scheduleGraphStage is a test run submitted as part of a dependency graph.
+// Stages can only depend on the stages before them, or on test runs that
+// were scheduled before
+type scheduleGraphStage struct {
+	Key       string                    `json:"key"`
+	DependsOn []scheduleGraphDependency `json:"dependsOn"`
+	Run       json.RawMessage           `json:"run"`
+}
+
+// scheduleGraphDependency references either an earlier stage by its key, or
+// an existing test run by its ID
+type scheduleGraphDependency struct {
+	Key       string               `json:"key,omitempty"`
+	TestRunID string               `json:"testRunID,omitempty"`
+	Status    common.TestRunStatus `json:"status,omitempty"`
+}
+
+// scheduleTestRunGraphHandler schedules the stages of a multi-stage experiment
+// at once. Each stage is a single test run, queued until the stages it
+// depends on ended with the required status, and skipped if they didn't
+func (h *HttpServer) scheduleTestRunGraphHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	defer r.Body.Close()
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		logging.Errorf("Error parsing request: %s", err.Error())
+		http.Error(w, "Request format incorrect", 500)
+		return
+	}
+	var req struct {
+		Stages []scheduleGraphStage `json:"stages"`
+	}
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		logging.Errorf("Error parsing request: %s", err.Error())
+		http.Error(w, "Request format incorrect", 500)
+		return
+	}
+
+	usr, err := h.UserFromRequest(r)
+	if err != nil {
+		logging.Errorf("Error determining user: %s", err.Error())
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+
+	errs := []string{}
+	if len(req.Stages) == 0 {
+		errs = append(errs, "No stages submitted")
+	}
+	keys := map[string]bool{}
+	runs := make([]*common.TestRun, len(req.Stages))
+	commits := []string{}
+	for i, s := range req.Stages {
+		prefix := fmt.Sprintf("Stage %s", s.Key)
+		if s.Key == "" || keys[s.Key] {
+			errs = append(errs, fmt.Sprintf(
+				"Stage %d needs a unique key",
+				i+1,
+			))
+		}
+		for _, d := range s.DependsOn {
+			if d.Key != "" && !keys[d.Key] {
+				errs = append(errs, fmt.Sprintf(
+					"%s: can only depend on earlier stages, not %s",
+					prefix,
+					d.Key,
+				))
+			}
+		}
+		keys[s.Key] = true
+
+		tr, err := h.submittedTestRun(s.Run)
+		if err == errRequestFormat {
+			http.Error(w, "Request format incorrect", 500)
+			return
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", prefix, err))
+			continue
+		}
+		if err := checkPriority(usr, tr.Priority); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", prefix, err))
+		}
+		tr.CreatedByThumbprint = usr.Thumbprint
+		tr.ImpersonatedByThumbprint = usr.ImpersonatedBy
+		tr.SweepID = ""
+		tr.AwaitingApproval = false
+		tr.ApprovedByThumbprint = ""
+		testruns.ApplySubmissionDefaults(tr)
+		testruns.StripSystemTags(tr)
+		if tr.Sweep != "" || tr.Repeat > 1 {
+			errs = append(errs, fmt.Sprintf(
+				"%s: stages cannot be sweeps",
+				prefix,
+			))
+		}
+		tr.Repeat = 1
+		for _, d := range s.DependsOn {
+			if d.Key == "" {
+				tr.DependsOn = append(tr.DependsOn, common.TestRunDependency{
+					TestRunID: d.TestRunID,
+					Status:    d.Status,
+				})
+			}
+		}
+		for _, e := range h.tr.ValidateDependencies(tr) {
+			errs = append(errs, fmt.Sprintf("%s: %v", prefix, e))
+		}
+		runs[i] = tr
+		commits = append(commits, tr.CommitHash)
+	}
+	if len(errs) > 0 {
+		writeJson(w, map[string]interface{}{
+			"ok":    false,
+			"error": strings.Join(errs, "; "),
+		})
+		return
+	}
+
+	violations, rejected, requireApproval := h.lintSubmission(runs, commits)
+	if rejected {
+		writeJson(w, map[string]interface{}{
+			"ok":         false,
+			"violations": violations,
+		})
+		return
+	}
+
+	// Schedule the stages in order, such that the IDs of the stages they
+	// depend on are known
+	ids := map[string]string{}
+	for i, s := range req.Stages {
+		tr := runs[i]
+		for _, d := range s.DependsOn {
+			if d.Key != "" {
+				tr.DependsOn = append(tr.DependsOn, common.TestRunDependency{
+					TestRunID: ids[d.Key],
+					Status:    d.Status,
+				})
+			}
+		}
+		tr.AwaitingApproval = requireApproval
+		h.tr.ScheduleTestRun(tr)
+		ids[s.Key] = tr.ID
+	}
+	writeJson(w, map[string]interface{}{
+		"ok":         true,
+		"testRunIDs": ids,
+		"violations": violations,
+	})
+}
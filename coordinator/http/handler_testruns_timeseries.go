@@ -0,0 +1,28 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+func (h *HttpServer) testRunTimeSeriesHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	params := mux.Vars(r)
+	runID := params["runID"]
+
+	tr, ok := h.tr.GetTestRun(runID)
+	if !ok {
+		http.Error(w, "Not found", 404)
+		return
+	}
+
+	series, err := h.tr.TimeSeries(tr)
+	if err != nil {
+		writeJson(w, map[string]interface{}{"ok": false, "error": err.Error()})
+		return
+	}
+	writeJson(w, series)
+}
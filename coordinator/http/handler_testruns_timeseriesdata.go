@@ -0,0 +1,59 @@
+package http
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/mit-dci/opencbdc-tctl/coordinator/testruns"
+)
+
+// defaultTimeSeriesPoints is the number of points a time series is downsampled
+// to if the request doesn't specify it
+const defaultTimeSeriesPoints = 2000
+
+// testRunTimeSeriesDataHandler returns the points of a time series of a test
+// run, downsampled to the number of points given by the `points` query
+// parameter. Use `points=0` to get the full resolution series. The
+// `downsample` query parameter selects one of the aggregation levels (1s, 10s
+// or 1m) precomputed when the series was ingested
+func (h *HttpServer) testRunTimeSeriesDataHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	params := mux.Vars(r)
+	runID := params["runID"]
+	seriesID := params["seriesID"]
+
+	tr, ok := h.tr.GetTestRun(runID)
+	if !ok {
+		http.Error(w, "Not found", 404)
+		return
+	}
+
+	points := defaultTimeSeriesPoints
+	if p := r.URL.Query().Get("points"); p != "" {
+		var err error
+		points, err = strconv.Atoi(p)
+		if err != nil || points < 0 {
+			http.Error(w, "Request format incorrect", 500)
+			return
+		}
+	}
+
+	data, err := h.tr.TimeSeriesData(
+		tr,
+		seriesID,
+		r.URL.Query().Get("downsample"),
+		points,
+	)
+	if err == testruns.ErrTimeSeriesNotFound {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	if err != nil {
+		writeJson(w, map[string]interface{}{"ok": false, "error": err.Error()})
+		return
+	}
+	writeJson(w, data)
+}
@@ -0,0 +1,34 @@
+package http
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/gorilla/mux"
+	"github.com/mit-dci/opencbdc-tctl/coordinator/testruns"
+)
+
+func (h *HttpServer) testRunTxTracesHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	params := mux.Vars(r)
+	runID := params["runID"]
+
+	tr, ok := h.tr.GetTestRun(runID)
+	if !ok {
+		http.Error(w, "Not found", 404)
+		return
+	}
+
+	path := testruns.TxTracesPath(tr)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Header().
+		Add("Content-Disposition", fmt.Sprintf("attachment; filename=\"testrun-txtraces-%s.json\"", runID))
+	http.ServeFile(w, r, path)
+}
@@ -0,0 +1,66 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/coordinator/testruns"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+type updateAnnotationRequest struct {
+	Text    string                   `json:"text"`
+	Verdict common.AnnotationVerdict `json:"verdict"`
+}
+
+// testRunUpdateAnnotationHandler changes an annotation the user made on a
+// test run
+func (h *HttpServer) testRunUpdateAnnotationHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	defer r.Body.Close()
+	var req updateAnnotationRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "Request format incorrect", 500)
+		return
+	}
+
+	vars := mux.Vars(r)
+	if _, ok := h.tr.GetTestRun(vars["runID"]); !ok {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	usr, err := h.UserFromRequest(r)
+	if err != nil {
+		logging.Errorf("Error determining user: %s", err.Error())
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+	a, err := h.tr.UpdateAnnotation(
+		vars["runID"],
+		vars["annotationID"],
+		req.Text,
+		req.Verdict,
+		usr.Thumbprint,
+	)
+	if err == testruns.ErrAnnotationNotFound {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	if err != nil {
+		writeJson(w, map[string]interface{}{
+			"ok":    false,
+			"error": err.Error(),
+		})
+		return
+	}
+	frontendRunCache.Delete(vars["runID"])
+	writeJson(w, map[string]interface{}{
+		"ok":         true,
+		"annotation": a,
+	})
+}
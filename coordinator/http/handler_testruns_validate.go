@@ -0,0 +1,67 @@
+package http
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/coordinator/testruns"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// validateTestRunHandler performs a dry run of a test run submission: the
+// runs it would schedule are checked for the problems that would otherwise
+// only surface while executing them, without launching anything
+func (h *HttpServer) validateTestRunHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	defer r.Body.Close()
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		logging.Errorf("Error parsing request: %s", err.Error())
+		http.Error(w, "Request format incorrect", 500)
+		return
+	}
+	tr, err := h.submittedTestRun(body)
+	if err == errRequestFormat {
+		logging.Errorf("Error parsing request: %s", err.Error())
+		http.Error(w, "Request format incorrect", 500)
+		return
+	}
+	if err != nil {
+		writeJson(w, map[string]interface{}{
+			"ok":    false,
+			"error": err.Error(),
+		})
+		return
+	}
+	testruns.ApplySubmissionDefaults(tr)
+	testruns.StripSystemTags(tr)
+
+	// Errors in the sweep parameters apply to the submission as a whole
+	errs := validateSweep(tr)
+	if len(errs) > 0 {
+		res := testruns.DryRunResult{Issues: []testruns.DryRunIssue{}}
+		for _, e := range errs {
+			res.Issues = append(res.Issues, testruns.DryRunIssue{
+				Check:    testruns.DryRunCheckConfiguration,
+				Run:      -1,
+				Severity: "error",
+				Message:  e.Error(),
+			})
+		}
+		writeJson(w, map[string]interface{}{
+			"ok":     true,
+			"result": res,
+		})
+		return
+	}
+
+	runs := common.ExpandSweepRun(tr, "")
+	writeJson(w, map[string]interface{}{
+		"ok":         true,
+		"result":     h.tr.DryRun(runs),
+		"violations": h.tr.LintTestRuns(runs),
+	})
+}
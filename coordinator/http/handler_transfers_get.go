@@ -0,0 +1,22 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/mit-dci/opencbdc-tctl/coordinator/agents"
+)
+
+// getTransferHandler returns the progress of a single file transfer
+func (h *HttpServer) getTransferHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	params := mux.Vars(r)
+	t, err := h.am.GetTransfer(params["transferID"])
+	if err == agents.ErrTransferNotFound {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	writeJson(w, t)
+}
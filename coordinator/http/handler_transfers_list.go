@@ -0,0 +1,14 @@
+package http
+
+import (
+	"net/http"
+)
+
+// listTransfersHandler returns the progress of the file transfers between the
+// coordinator and the agents that are running or finished recently
+func (h *HttpServer) listTransfersHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	writeJson(w, h.am.Transfers())
+}
@@ -0,0 +1,73 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+type impersonationRequest struct {
+	Thumbprint string `json:"thumbprint"`
+	Reason     string `json:"reason"`
+	// Duration of the impersonation in minutes
+	Duration int `json:"duration"`
+}
+
+func (h *HttpServer) impersonationHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	admin, err := h.RealUserFromRequest(r)
+	if err != nil {
+		logging.Errorf("Error getting user from request: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	if !admin.Admin {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if r.Method == "GET" {
+		writeJson(w, map[string]interface{}{
+			"impersonation": h.activeImpersonation(admin.Thumbprint),
+		})
+		return
+	}
+	if r.Method == "POST" {
+		defer r.Body.Close()
+		var req impersonationRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			logging.Errorf("Error parsing request: %s", err.Error())
+			http.Error(w, "Request format incorrect", 500)
+			return
+		}
+		imp, err := h.startImpersonation(
+			admin,
+			req.Thumbprint,
+			req.Reason,
+			time.Duration(req.Duration)*time.Minute,
+		)
+		if err != nil {
+			writeJson(w, map[string]interface{}{
+				"ok":    false,
+				"error": err.Error(),
+			})
+			return
+		}
+		writeJson(w, map[string]interface{}{
+			"ok":            true,
+			"impersonation": imp,
+		})
+		return
+	}
+	if r.Method == "DELETE" {
+		h.stopImpersonation(admin)
+		writeJsonOK(w)
+		return
+	}
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+}
@@ -0,0 +1,29 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/mit-dci/opencbdc-tctl/coordinator/testruns"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// teardownWarmEnvironmentHandler tears down an idle warm environment before
+// it expires, terminating its agents
+func (h *HttpServer) teardownWarmEnvironmentHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	vars := mux.Vars(r)
+	err := h.tr.TeardownWarmEnvironment(vars["environmentID"])
+	if err == testruns.ErrWarmEnvironmentNotFound {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	if err != nil {
+		logging.Errorf("Error tearing down warm environment: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	writeJsonOK(w)
+}
@@ -0,0 +1,140 @@
+package http
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/mit-dci/opencbdc-tctl/coordinator/sources"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// githubWebhookHandler accepts push and pull_request webhooks from GitHub. It
+// is served without client certificate, so deliveries are authenticated by
+// their HMAC signature instead. The sources are updated in the background,
+// after which the head of the pushed branch or tag is optionally compiled
+// such that its binaries are available before a test run is scheduled for it
+func (h *HttpServer) githubWebhookHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	secret := githubWebhookSecret()
+	if secret == "" {
+		http.Error(w, "Not found", 404)
+		return
+	}
+
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Request format incorrect", 500)
+		return
+	}
+	if !verifyGithubSignature(
+		secret,
+		body,
+		r.Header.Get("X-Hub-Signature-256"),
+	) {
+		logging.Warnf(
+			"Rejected webhook delivery %s with invalid signature",
+			r.Header.Get("X-GitHub-Delivery"),
+		)
+		http.Error(w, "Unauthorized", 401)
+		return
+	}
+
+	event := r.Header.Get("X-GitHub-Event")
+	push := &githubPushEvent{}
+	pr := &githubPullRequestEvent{}
+	switch event {
+	case "ping":
+		writeJsonOK(w)
+		return
+	case "push":
+		err = json.Unmarshal(body, push)
+	case "pull_request":
+		err = json.Unmarshal(body, pr)
+	case "merge_group":
+		h.githubMergeGroup(w, body)
+		return
+	default:
+		writeJson(w, map[string]interface{}{"ok": true, "ignored": event})
+		return
+	}
+	if err != nil {
+		http.Error(w, "Request format incorrect", 500)
+		return
+	}
+
+	compileRef := ""
+	if githubWebhookAutoCompile() {
+		compileRef = githubCompileRef(event, push, pr)
+	}
+
+	// GitHub expects a response within ten seconds, so updating and
+	// compiling happens in the background
+	go func() {
+		err := h.src.EnsureSourcesUpdated()
+		if err != nil {
+			logging.Errorf("Unable to update sources after webhook: %v", err)
+			return
+		}
+		if compileRef == "" {
+			return
+		}
+		logging.Infof("Compiling %s after webhook %s", compileRef, event)
+		err = h.src.Compile(
+			compileRef,
+			false,
+			sources.DefaultTargetArch,
+			nil,
+			nil,
+		)
+		if err != nil {
+			logging.Errorf(
+				"Unable to compile %s after webhook: %v",
+				compileRef,
+				err,
+			)
+		}
+	}()
+	writeJson(w, map[string]interface{}{"ok": true, "compile": compileRef})
+}
+
+// githubMergeGroup handles merge_group webhooks of the GitHub merge queue:
+// merge candidates that are queued are benchmarked, and the benchmarks of
+// candidates that are removed from the queue are canceled. Deliveries are
+// ignored unless the merge queue mode is enabled
+func (h *HttpServer) githubMergeGroup(w http.ResponseWriter, body []byte) {
+	mg := &githubMergeGroupEvent{}
+	err := json.Unmarshal(body, mg)
+	if err != nil {
+		http.Error(w, "Request format incorrect", 500)
+		return
+	}
+	if !h.tr.Config().MergeQueue.Enabled {
+		writeJson(w, map[string]interface{}{"ok": true, "ignored": "merge_group"})
+		return
+	}
+	headRef := strings.TrimPrefix(mg.MergeGroup.HeadRef, "refs/heads/")
+	headSha := mg.MergeGroup.HeadSha
+	switch mg.Action {
+	case "checks_requested":
+		// Fetching the candidate takes longer than GitHub waits for a
+		// response
+		go func() {
+			_, err := h.tr.BenchmarkMergeCandidate(headRef, headSha)
+			if err != nil {
+				logging.Errorf(
+					"Unable to benchmark merge candidate %s: %v",
+					headSha,
+					err,
+				)
+			}
+		}()
+	case "destroyed":
+		h.tr.CancelMergeCandidate(headSha)
+	}
+	writeJsonOK(w)
+}
@@ -42,20 +42,17 @@ func (srv *HttpServer) wsWithTokenHandler(
 		log.Printf("upgrade: %v", err)
 		return
 	}
-	conn := &websocketConn{
-		conn:                               c,
-		outgoing:                           make(chan []byte, 100),
-		subscribedToTestRunLogForTestRunID: "",
-	}
+	conn := newWebsocketConn(c)
 	websocketsLock.Lock()
 	websockets = append(websockets, conn)
+	count := len(websockets)
+	websocketsLock.Unlock()
 	srv.events <- coordinator.Event{
 		Type: coordinator.EventTypeConnectedUsersChanged,
 		Payload: coordinator.ConnectedUsersChangedPayload{
-			Count: len(websockets),
+			Count: count,
 		},
 	}
-	websocketsLock.Unlock()
 
 	go conn.sendLoop()
 
@@ -66,17 +63,17 @@ func (srv *HttpServer) wsWithTokenHandler(
 		},
 	})
 	if err == nil {
-		conn.outgoing <- msg
+		conn.enqueue(msg, false)
 	}
 
 	msg, err = json.Marshal(srv.GetSystemStateEvent())
 	if err == nil {
-		conn.outgoing <- msg
+		conn.enqueue(msg, false)
 	} else {
 		logging.Errorf("Error marshalling system state: %v", err)
 	}
 
-	defer c.Close()
+	defer conn.close()
 	for {
 		mt, msg, err := c.ReadMessage()
 		if err != nil {
@@ -93,13 +90,26 @@ func (srv *HttpServer) wsWithTokenHandler(
 			}
 
 			switch m.Type {
+			case "unsubscribeRoleLogs":
+				conn.subscribeRoleLogs(nil, nil)
+			case "subscribeRoleLogs":
+				// The filter is in the message as is
+				var f coordinator.RoleLogFilter
+				b, err := json.Marshal(m.Msg)
+				if err == nil {
+					err = json.Unmarshal(b, &f)
+				}
+				if err != nil || f.TestRunID == "" {
+					logging.Warnf("invalid role log subscription: %v", m.Msg)
+					break
+				}
+				conn.subscribeRoleLogs(&f, srv.tr.SubscribeRoleLogs(f))
 			case "unsubscribeTestRunLog":
-				conn.subscribedToTestRunLogForTestRunID = ""
+				conn.subscribeTestRun("")
 			case "subscribeTestRunLog":
-				conn.subscribedToTestRunLogForTestRunID = m.Msg["id"].(string)
-				tr, ok := srv.tr.GetTestRun(
-					conn.subscribedToTestRunLogForTestRunID,
-				)
+				id, _ := m.Msg["id"].(string)
+				conn.subscribeTestRun(id)
+				tr, ok := srv.tr.GetTestRun(id)
 				if ok {
 					log := tr.LogTail()
 					ev := coordinator.Event{
@@ -111,7 +121,7 @@ func (srv *HttpServer) wsWithTokenHandler(
 					}
 					b, err := json.Marshal(ev)
 					if err == nil {
-						conn.outgoing <- b
+						conn.enqueue(b, true)
 					}
 				}
 			}
@@ -119,6 +129,8 @@ func (srv *HttpServer) wsWithTokenHandler(
 
 	}
 
+	conn.subscribeRoleLogs(nil, nil)
+
 	websocketsLock.Lock()
 	idx := -1
 	for i, ws := range websockets {
@@ -130,11 +142,12 @@ func (srv *HttpServer) wsWithTokenHandler(
 		websockets[len(websockets)-1], websockets[idx] = websockets[idx], websockets[len(websockets)-1]
 		websockets = websockets[:len(websockets)-1]
 	}
+	count = len(websockets)
+	websocketsLock.Unlock()
 	srv.events <- coordinator.Event{
 		Type: coordinator.EventTypeConnectedUsersChanged,
 		Payload: coordinator.ConnectedUsersChangedPayload{
-			Count: len(websockets),
+			Count: count,
 		},
 	}
-	websocketsLock.Unlock()
 }
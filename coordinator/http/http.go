@@ -43,6 +43,13 @@ type HttpServer struct {
 	certificate                tls.Certificate
 	wsTokens                   sync.Map
 	version                    string
+	federation                 *federation
+	impersonations             map[string]*impersonation
+	impersonationsLock         sync.Mutex
+	// The responses to requests with an idempotency key, by the thumbprint
+	// of the user and the key
+	idempotentResponses     map[string]*idempotentResponse
+	idempotentResponsesLock sync.Mutex
 }
 
 type SystemUser struct {
@@ -50,7 +57,11 @@ type SystemUser struct {
 	Email        string `json:"email"`
 	Organization string `json:"org"`
 	Thumbprint   string `json:"thumbPrint"`
-	certFile     string
+	Admin        bool   `json:"admin"`
+	// The thumbprint of the admin acting as this user, set on the users
+	// returned by UserFromRequest during an impersonation
+	ImpersonatedBy string `json:"impersonatedBy,omitempty"`
+	certFile       string
 }
 
 func NewHttpServer(
@@ -64,15 +75,18 @@ func NewHttpServer(
 	version string,
 ) (*HttpServer, error) {
 	httpSrv := HttpServer{
-		coord:    c,
-		src:      s,
-		am:       a,
-		tr:       t,
-		events:   ev,
-		users:    []*SystemUser{},
-		wsTokens: sync.Map{},
-		awsm:     awsm,
-		version:  version,
+		coord:               c,
+		src:                 s,
+		am:                  a,
+		tr:                  t,
+		events:              ev,
+		users:               []*SystemUser{},
+		wsTokens:            sync.Map{},
+		awsm:                awsm,
+		version:             version,
+		federation:          newFederation(),
+		impersonations:      map[string]*impersonation{},
+		idempotentResponses: map[string]*idempotentResponse{},
 	}
 	httpSrv.httpsWithoutClientCertPort, _ = strconv.Atoi(
 		os.Getenv("HTTPS_WITHOUT_CLIENT_CERT_PORT"),
@@ -86,6 +100,10 @@ func NewHttpServer(
 		httpSrv.httpsPort = 443
 	}
 
+	// Reports published by the test run manager are rendered with the
+	// report generator
+	t.SetReportGeneratorFunc(httpSrv.generateStoredReport)
+
 	r := mux.NewRouter()
 
 	// Websocket token
@@ -95,20 +113,157 @@ func NewHttpServer(
 	r.HandleFunc("/api/initialState", httpSrv.initialStateHandler).
 		Methods("GET")
 
+	// Requests made by admins while impersonating another user are audited
+	r.Use(httpSrv.auditImpersonationMiddleware)
+
 	// Users
 	r.HandleFunc("/api/users", httpSrv.usersHandler).Methods("GET")
 	r.HandleFunc("/api/users", httpSrv.addUserHandler).Methods("POST")
 	r.HandleFunc("/api/users/{thumb}", httpSrv.deleteUserHandler).
 		Methods("DELETE")
 
+	// Impersonation of users by admins
+	r.HandleFunc("/api/impersonation", NoCache(httpSrv.impersonationHandler)).
+		Methods("GET", "POST", "DELETE")
+	r.HandleFunc("/api/auditLog", NoCache(httpSrv.auditLogHandler)).
+		Methods("GET")
+
 	// Maintenance mode
 	r.HandleFunc("/api/maintenance", NoCache(httpSrv.systemMaintenanceHandler)).
 		Methods("GET", "PUT")
 
+	// Agent enrollment
+	r.HandleFunc("/api/agents/enrollmentToken", NoCache(httpSrv.issueEnrollmentTokenHandler)).
+		Methods("POST")
+	r.HandleFunc("/api/agents/credentialRotations", NoCache(httpSrv.credentialRotationsHandler)).
+		Methods("GET", "POST")
+
+	// Pools of static agents
+	r.HandleFunc("/api/agents/pools", NoCache(httpSrv.listAgentPoolsHandler)).
+		Methods("GET")
+	r.HandleFunc("/api/agents/pools", NoCache(httpSrv.createAgentPoolHandler)).
+		Methods("POST")
+	r.HandleFunc("/api/agents/pools/{poolName}", httpSrv.deleteAgentPoolHandler).
+		Methods("DELETE")
+	r.HandleFunc("/api/agents/pools/{poolName}/joinToken", NoCache(httpSrv.rotateJoinTokenHandler)).
+		Methods("POST")
+
+	// Diagnostic commands run by admins on agents
+	r.HandleFunc("/api/agents/debug/commands", NoCache(httpSrv.debugCommandsHandler)).
+		Methods("GET")
+	r.HandleFunc("/api/agents/debug/sessions", NoCache(httpSrv.listDebugSessionsHandler)).
+		Methods("GET")
+	r.HandleFunc("/api/agents/debug/sessions/{sessionID}", NoCache(httpSrv.getDebugSessionHandler)).
+		Methods("GET")
+	r.HandleFunc("/api/agents/debug/sessions/{sessionID}", httpSrv.closeDebugSessionHandler).
+		Methods("DELETE")
+	r.HandleFunc("/api/agents/debug/sessions/{sessionID}/exec", NoCache(httpSrv.debugExecHandler)).
+		Methods("POST")
+	r.HandleFunc("/api/agents/{agentID:[0-9]+}/debug/sessions", NoCache(httpSrv.openDebugSessionHandler)).
+		Methods("POST")
+	r.HandleFunc("/api/agents/{agentID:[0-9]+}/debug/exec", NoCache(httpSrv.oneOffDebugExecHandler)).
+		Methods("POST")
+
+	// Progress of file transfers between the coordinator and agents
+	r.HandleFunc("/api/transfers", NoCache(httpSrv.listTransfersHandler)).
+		Methods("GET")
+	r.HandleFunc("/api/transfers/{transferID}", NoCache(httpSrv.getTransferHandler)).
+		Methods("GET")
+
+	// Binaries archives uploaded to S3 for distribution to the agents
+	r.HandleFunc("/api/distributedBinaries", NoCache(httpSrv.distributedBinariesHandler)).
+		Methods("GET")
+
+	// Agent binary updates
+	r.HandleFunc("/api/agents/binaries", NoCache(httpSrv.agentBinariesHandler)).
+		Methods("GET", "POST")
+	r.HandleFunc("/api/agents/rollouts", NoCache(httpSrv.agentRolloutsHandler)).
+		Methods("GET", "POST")
+	r.HandleFunc("/api/agents/rollouts/{rolloutID}/{action}", httpSrv.agentRolloutActionHandler).
+		Methods("POST")
+
+	// Nightly benchmark pipeline
+	r.HandleFunc("/api/nightly", NoCache(httpSrv.nightlyHandler)).
+		Methods("GET", "PUT")
+	r.HandleFunc("/api/nightly/trigger", httpSrv.nightlyTriggerHandler).
+		Methods("POST")
+
+	// Preemption of lower priority test runs
+	r.HandleFunc("/api/preemption", NoCache(httpSrv.preemptionHandler)).
+		Methods("GET", "PUT")
+
+	// Concurrent test runs and vCPUs per user and team
+	r.HandleFunc("/api/quotas", NoCache(httpSrv.quotasHandler)).
+		Methods("GET", "PUT")
+
+	// Agent pools of the AWS regions
+	r.HandleFunc("/api/regionPools", NoCache(httpSrv.regionPoolsHandler)).
+		Methods("GET", "PUT")
+
+	// Default capabilities the agents of each kind of role require
+	r.HandleFunc(
+		"/api/roleRequirements",
+		NoCache(httpSrv.roleRequirementsHandler),
+	).Methods("GET", "PUT")
+
+	// Benchmarking merge candidates of the GitHub merge queue
+	r.HandleFunc("/api/mergeQueue", NoCache(httpSrv.mergeQueueHandler)).
+		Methods("GET", "PUT")
+
+	// Weekly performance report
+	r.HandleFunc("/api/weeklyReport", NoCache(httpSrv.weeklyReportHandler)).
+		Methods("GET", "PUT")
+	r.HandleFunc("/api/weeklyReport/trigger", httpSrv.weeklyReportTriggerHandler).
+		Methods("POST")
+
+	// Failure rates per failure class
+	r.HandleFunc("/api/failureRates", NoCache(httpSrv.failureRatesHandler)).
+		Methods("GET")
+
+	// Capacity planner
+	r.HandleFunc("/api/capacityPlanner", NoCache(httpSrv.capacityPlannerHandler)).
+		Methods("GET", "PUT")
+
+	// Startup plans
+	r.HandleFunc("/api/startupPlans", NoCache(httpSrv.startupPlansHandler)).
+		Methods("GET", "PUT")
+
+	// Architecture manifests
+	r.HandleFunc("/api/architectures/manifests", NoCache(httpSrv.architectureManifestsHandler)).
+		Methods("GET")
+	r.HandleFunc("/api/architectures/manifests/reload", httpSrv.reloadArchitectureManifestsHandler).
+		Methods("POST")
+	r.HandleFunc("/api/architectures/manifests", httpSrv.saveArchitectureManifestHandler).
+		Methods("POST")
+	r.HandleFunc("/api/architectures/manifests/{manifestID}", httpSrv.deleteArchitectureManifestHandler).
+		Methods("DELETE")
+
+	// Lint rules
+	r.HandleFunc("/api/lintRules", NoCache(httpSrv.lintRulesHandler)).
+		Methods("GET", "PUT")
+
+	// Federation
+	r.HandleFunc("/api/federation", NoCache(httpSrv.federationStatusHandler)).
+		Methods("GET")
+	r.HandleFunc("/api/federation/summary", NoCache(httpSrv.federationSummaryHandler)).
+		Methods("GET")
+	r.HandleFunc("/api/federation/testruns", NoCache(httpSrv.federationTestRunsHandler)).
+		Methods("GET")
+	r.HandleFunc("/api/federation/agents", NoCache(httpSrv.federationAgentsHandler)).
+		Methods("GET")
+	r.HandleFunc("/api/federation/peers/{peer}/testruns/{runID}/results", NoCache(httpSrv.federationResultsHandler)).
+		Methods("GET")
+	r.HandleFunc("/api/federation/peers/{peer}/testruns/schedule", httpSrv.federationScheduleHandler).
+		Methods("POST")
+	r.HandleFunc("/api/federation/submissions", NoCache(httpSrv.federationSubmissionsHandler)).
+		Methods("GET")
+
 	// Version
 	r.HandleFunc("/api/version", httpSrv.versionHandler).Methods("GET")
 
 	// Test runs
+	r.HandleFunc("/api/testruns", NoCache(httpSrv.testRunListHandler)).
+		Methods("GET")
 	r.HandleFunc("/api/testruns/sweeps", NoCache(httpSrv.sweepListHandler)).
 		Methods("GET")
 	r.HandleFunc("/api/testruns/matrix", NoCache(httpSrv.testRunMatrixHandler)).
@@ -121,10 +276,36 @@ func NewHttpServer(
 		Methods("GET")
 	r.HandleFunc("/api/testruns/maxagents/{max}", NoCache(httpSrv.reconfigureMaxAgentsHandler)).
 		Methods("PUT")
-	r.HandleFunc("/api/testruns/schedule", httpSrv.scheduleTestRunHandler).
+	r.HandleFunc("/api/testruns/schedule", httpSrv.idempotent(httpSrv.scheduleTestRunHandler)).
+		Methods("POST")
+	r.HandleFunc("/api/testruns/scheduleGraph", httpSrv.scheduleTestRunGraphHandler).
+		Methods("POST")
+	r.HandleFunc("/api/testruns/whatif", httpSrv.testRunWhatIfHandler).
+		Methods("POST")
+	r.HandleFunc("/api/testruns/forecast", NoCache(httpSrv.testRunQueueForecastHandler)).
+		Methods("GET")
+	r.HandleFunc("/api/testruns/benchmarkSubmissions", NoCache(httpSrv.testRunsBenchmarkSubmissionsHandler)).
+		Methods("POST")
+	r.HandleFunc("/api/testruns/importBundle", httpSrv.testRunImportBundleHandler).
 		Methods("POST")
 	r.HandleFunc("/api/testruns/estimate", httpSrv.estimateChargeForTestRunHandler).
 		Methods("POST")
+	r.HandleFunc("/api/testruns/lint", httpSrv.lintTestRunHandler).
+		Methods("POST")
+	r.HandleFunc("/api/testruns/validate", httpSrv.validateTestRunHandler).
+		Methods("POST")
+	r.HandleFunc("/api/testruns/reprocessOutdatedResults", httpSrv.reprocessOutdatedResultsHandler).
+		Methods("POST")
+	r.HandleFunc("/api/testruns/reprocessJobs", NoCache(httpSrv.reprocessJobsHandler)).
+		Methods("GET", "POST")
+	r.HandleFunc("/api/testruns/{runID}/labels", httpSrv.testRunLabelsHandler).
+		Methods("PUT")
+	r.HandleFunc("/api/testruns/{runID}/annotations", httpSrv.testRunAnnotateHandler).
+		Methods("POST")
+	r.HandleFunc("/api/testruns/{runID}/annotations/{annotationID}", httpSrv.testRunUpdateAnnotationHandler).
+		Methods("PUT")
+	r.HandleFunc("/api/testruns/{runID}/annotations/{annotationID}", httpSrv.testRunDeleteAnnotationHandler).
+		Methods("DELETE")
 	r.HandleFunc("/api/testruns/{runID}/prioritize", httpSrv.prioritizeTestRunHandler).
 		Methods("GET")
 	r.HandleFunc("/api/testruns/{runID}/redownloadOutputs", httpSrv.redownloadOutputsHandler).
@@ -139,18 +320,44 @@ func NewHttpServer(
 		Methods("GET")
 	r.HandleFunc("/api/testruns/{runID}/results/recalc", httpSrv.testRunRecalcResultsHandler).
 		Methods("POST")
+	r.HandleFunc("/api/testruns/{runID}/results/versions", NoCache(httpSrv.testRunResultVersionsHandler)).
+		Methods("GET")
 	r.HandleFunc("/api/testruns/{runID}/plot/{plot}", NoCache(httpSrv.testRunPlotHandler)).
 		Methods("GET")
+	r.HandleFunc("/api/testruns/{runID}/series", NoCache(httpSrv.testRunTimeSeriesHandler)).
+		Methods("GET")
+	r.HandleFunc("/api/testruns/{runID}/series/{seriesID}", NoCache(httpSrv.testRunTimeSeriesDataHandler)).
+		Methods("GET")
 	r.HandleFunc("/api/testruns/{runID}/outputs", NoCache(httpSrv.testRunOutputsHandler)).
 		Methods("GET")
+	r.HandleFunc("/api/testruns/{runID}/txtraces", NoCache(httpSrv.testRunTxTracesHandler)).
+		Methods("GET")
+	r.HandleFunc("/api/testruns/{runID}/liveMetrics", NoCache(httpSrv.testRunLiveMetricsHandler)).
+		Methods("GET")
+	r.HandleFunc("/api/testruns/{runID}/agentHealth", NoCache(httpSrv.testRunAgentHealthHandler)).
+		Methods("GET")
 	r.HandleFunc("/api/testruns/{runID}/terminate", httpSrv.terminateTestRunHandler).
 		Methods("PUT")
+	r.HandleFunc("/api/testruns/{runID}/pause", httpSrv.pauseTestRunHandler).
+		Methods("PUT")
+	r.HandleFunc("/api/testruns/{runID}/resume", httpSrv.resumeTestRunHandler).
+		Methods("PUT")
 	r.HandleFunc("/api/testruns/{runID}/retrySpawn", httpSrv.retrySpawnHandler).
 		Methods("PUT")
 	r.HandleFunc("/api/testruns/{runID}/bandwidth", httpSrv.testRunBandwidthData).
 		Methods("GET")
 	r.HandleFunc("/api/testruns/{runID}/confirmPeak", httpSrv.testRunConfirmPeakHandler).
 		Methods("POST")
+	r.HandleFunc("/api/testruns/{runID}/approve", httpSrv.approveTestRunHandler).
+		Methods("POST")
+	r.HandleFunc("/api/testruns/{runID}/placement", NoCache(httpSrv.testRunPlacementHandler)).
+		Methods("GET")
+	r.HandleFunc("/api/testruns/{runID}/placement", httpSrv.testRunChangePlacementHandler).
+		Methods("POST")
+	r.HandleFunc("/api/testruns/{runID}/benchmarkSubmission", NoCache(httpSrv.testRunBenchmarkSubmissionHandler)).
+		Methods("GET")
+	r.HandleFunc("/api/testruns/{runID}/bundle", NoCache(httpSrv.testRunExportBundleHandler)).
+		Methods("GET")
 
 	// Sweeps
 	r.HandleFunc("/api/sweeps/{sweepID}/fixMissing", httpSrv.scheduleMissingSweepRuns).
@@ -159,6 +366,16 @@ func NewHttpServer(
 		Methods("GET")
 	r.HandleFunc("/api/sweeps/{sweepID}/cancel", httpSrv.cancelSweepRuns).
 		Methods("GET")
+	r.HandleFunc("/api/sweeps/{sweepID}/matrixReport", NoCache(httpSrv.sweepMatrixReportHandler)).
+		Methods("GET")
+	r.HandleFunc("/api/sweeps/{sweepID}/comparison", NoCache(httpSrv.sweepComparisonHandler)).
+		Methods("GET")
+	r.HandleFunc("/api/sweeps/{sweepID}/budget", NoCache(httpSrv.sweepBudgetHandler)).
+		Methods("GET", "PUT")
+	r.HandleFunc("/api/sweeps/{sweepID}/budget/trim", httpSrv.trimSweepHandler).
+		Methods("POST")
+	r.HandleFunc("/api/instanceCosts", NoCache(httpSrv.instanceCostsHandler)).
+		Methods("GET", "PUT")
 
 	// Commands
 	r.HandleFunc("/api/commands/{cmdID}/output/{stream}", httpSrv.commandOutputHandler).
@@ -167,6 +384,8 @@ func NewHttpServer(
 		Methods("GET")
 
 	// Report
+	r.HandleFunc("/api/reports/{reportID}", httpSrv.getReportHandler).
+		Methods("GET")
 	r.HandleFunc("/api/generateReport", NoCache(httpSrv.generateReportHandler)).
 		Methods("POST")
 
@@ -180,10 +399,130 @@ func NewHttpServer(
 	r.HandleFunc("/api/sweepplot/saved/{sweepID}/{plotID}", httpSrv.deleteSavedSweepPlotHandler).
 		Methods("DELETE")
 
+	// Announcements
+	r.HandleFunc("/api/announcements", NoCache(httpSrv.listAnnouncementsHandler)).
+		Methods("GET")
+	r.HandleFunc("/api/announcements", httpSrv.addAnnouncementHandler).
+		Methods("POST")
+	r.HandleFunc("/api/announcements/{announcementID}", httpSrv.deleteAnnouncementHandler).
+		Methods("DELETE")
+
+	// Feature flags
+	r.HandleFunc("/api/featureFlags", NoCache(httpSrv.listFeatureFlagsHandler)).
+		Methods("GET")
+	r.HandleFunc("/api/featureFlags/{flag}", httpSrv.setFeatureFlagHandler).
+		Methods("PUT")
+	r.HandleFunc("/api/featureFlags/{flag}", httpSrv.deleteFeatureFlagHandler).
+		Methods("DELETE")
+
+	// Shard seeds
+	r.HandleFunc("/api/seeds/cache", NoCache(httpSrv.seedCacheHandler)).
+		Methods("GET")
+
+	// Dashboards
+	r.HandleFunc("/api/dashboards", NoCache(httpSrv.listDashboardsHandler)).
+		Methods("GET")
+	r.HandleFunc("/api/dashboards", httpSrv.saveDashboardHandler).
+		Methods("POST")
+	r.HandleFunc("/api/dashboards/{dashboardID}", NoCache(httpSrv.getDashboardHandler)).
+		Methods("GET")
+	r.HandleFunc("/api/dashboards/{dashboardID}", httpSrv.saveDashboardHandler).
+		Methods("PUT")
+	r.HandleFunc("/api/dashboards/{dashboardID}", httpSrv.deleteDashboardHandler).
+		Methods("DELETE")
+
+	// Result baselines
+	r.HandleFunc("/api/baselines", NoCache(httpSrv.listBaselinesHandler)).
+		Methods("GET")
+	r.HandleFunc("/api/baselines", httpSrv.createBaselineHandler).
+		Methods("POST")
+	r.HandleFunc("/api/baselines/{baselineID}", httpSrv.deleteBaselineHandler).
+		Methods("DELETE")
+
+	// Saved test run searches
+	r.HandleFunc("/api/savedSearches", NoCache(httpSrv.listSavedSearchesHandler)).
+		Methods("GET")
+	r.HandleFunc("/api/savedSearches", httpSrv.createSavedSearchHandler).
+		Methods("POST")
+	r.HandleFunc("/api/savedSearches/{searchID}", httpSrv.deleteSavedSearchHandler).
+		Methods("DELETE")
+
+	// Warm environments kept alive for the next test run
+	r.HandleFunc("/api/warmEnvironments", NoCache(httpSrv.listWarmEnvironmentsHandler)).
+		Methods("GET")
+	r.HandleFunc("/api/warmEnvironments/{environmentID}", httpSrv.teardownWarmEnvironmentHandler).
+		Methods("DELETE")
+
+	// Resources left behind by the teardown of test runs
+	r.HandleFunc("/api/reconciliation", NoCache(httpSrv.listReconciliationHandler)).
+		Methods("GET")
+	r.HandleFunc("/api/reconciliation/{leakID}", httpSrv.dismissLeakHandler).
+		Methods("DELETE")
+
+	// Recurring test run schedules
+	r.HandleFunc("/api/recurring", NoCache(httpSrv.listRecurringSchedulesHandler)).
+		Methods("GET")
+	r.HandleFunc("/api/recurring", httpSrv.saveRecurringScheduleHandler).
+		Methods("POST")
+	r.HandleFunc("/api/recurring/{scheduleID}", NoCache(httpSrv.getRecurringScheduleHandler)).
+		Methods("GET")
+	r.HandleFunc("/api/recurring/{scheduleID}", httpSrv.saveRecurringScheduleHandler).
+		Methods("PUT")
+	r.HandleFunc("/api/recurring/{scheduleID}", httpSrv.deleteRecurringScheduleHandler).
+		Methods("DELETE")
+
+	// Test run templates
+	r.HandleFunc("/api/templates", NoCache(httpSrv.listTestRunTemplatesHandler)).
+		Methods("GET")
+	r.HandleFunc("/api/templates", httpSrv.saveTestRunTemplateHandler).
+		Methods("POST")
+	r.HandleFunc("/api/templates/{templateID}", NoCache(httpSrv.getTestRunTemplateHandler)).
+		Methods("GET")
+	r.HandleFunc("/api/templates/{templateID}", httpSrv.saveTestRunTemplateHandler).
+		Methods("PUT")
+	r.HandleFunc("/api/templates/{templateID}", httpSrv.deleteTestRunTemplateHandler).
+		Methods("DELETE")
+	r.HandleFunc("/api/templates/{templateID}/versions", NoCache(httpSrv.testRunTemplateVersionsHandler)).
+		Methods("GET")
+	r.HandleFunc("/api/templates/{templateID}/testrun", httpSrv.templateTestRunHandler).
+		Methods("POST")
+
+	// Deployment snapshots for shadow test runs
+	r.HandleFunc("/api/shadow/snapshots", NoCache(httpSrv.listDeploymentSnapshotsHandler)).
+		Methods("GET")
+	r.HandleFunc("/api/shadow/snapshots", httpSrv.importDeploymentSnapshotHandler).
+		Methods("POST")
+	r.HandleFunc("/api/shadow/snapshots/{snapshotID}", httpSrv.deleteDeploymentSnapshotHandler).
+		Methods("DELETE")
+	r.HandleFunc("/api/shadow/snapshots/{snapshotID}/testrun", NoCache(httpSrv.shadowTestRunHandler)).
+		Methods("POST")
+
 	// Sources
-	r.HandleFunc("/api/sources/log", httpSrv.sourcesLogHandler).Methods("GET")
+	r.HandleFunc("/api/sources/log", Revalidate(s.GitLogVersion, httpSrv.sourcesLogHandler)).Methods("GET")
 	r.HandleFunc("/api/sources/update", httpSrv.sourcesUpdateHandler).
 		Methods("POST")
+	r.HandleFunc("/api/sources/ccache", NoCache(httpSrv.sourcesCompilerCacheHandler)).
+		Methods("GET", "DELETE")
+	r.HandleFunc("/api/sources/compileQueue", NoCache(httpSrv.sourcesCompileQueueHandler)).
+		Methods("GET")
+	r.HandleFunc("/api/sources/dependencyCache", NoCache(httpSrv.sourcesDependencyCacheHandler)).
+		Methods("GET", "DELETE")
+	r.HandleFunc("/api/sources/refs", NoCache(httpSrv.sourcesRefsHandler)).
+		Methods("GET")
+	r.HandleFunc("/api/sources/artifacts", NoCache(httpSrv.sourcesArtifactsHandler)).
+		Methods("GET")
+	r.HandleFunc("/api/sources/artifacts/gc", NoCache(httpSrv.sourcesArtifactsGCHandler)).
+		Methods("POST")
+	r.HandleFunc("/api/sources/buildFailures", NoCache(httpSrv.sourcesBuildFailuresHandler)).
+		Methods("GET")
+	r.HandleFunc("/api/sources/buildFailures/{failureID}/output", NoCache(httpSrv.sourcesBuildFailureOutputHandler)).
+		Methods("GET")
+	r.HandleFunc("/api/sources/components", NoCache(httpSrv.sourcesComponentsHandler)).
+		Methods("GET")
+	r.HandleFunc("/api/sources/remote", NoCache(httpSrv.sourcesRemoteHandler)).
+		Methods("GET")
+	r.HandleFunc("/api/sources/compare", NoCache(httpSrv.sourcesCompareHandler)).
+		Methods("GET")
 
 	spa := spaHandler{staticPath: "frontend", indexPath: "index.html"}
 	r.PathPrefix("/").Handler(spa)
@@ -431,11 +770,13 @@ func (srv *HttpServer) UserFromCert(cert *x509.Certificate) *SystemUser {
 		org = cert.Subject.Organization[0]
 	}
 
+	thumb := fmt.Sprintf("%x", md5.Sum(cert.Raw))
 	return &SystemUser{
 		CN:           cert.Subject.CommonName,
 		Email:        email,
 		Organization: org,
-		Thumbprint:   fmt.Sprintf("%x", md5.Sum(cert.Raw)),
+		Thumbprint:   thumb,
+		Admin:        isAdminThumbprint(thumb),
 	}
 }
 
@@ -482,6 +823,7 @@ func (srv *HttpServer) HealthHandler(w http.ResponseWriter, req *http.Request) {
 func (srv *HttpServer) Run() error {
 	go srv.publishToWebsocketsLoop()
 	go srv.tokenCleanupLoop()
+	go srv.federation.pollLoop()
 
 	r := mux.NewRouter()
 
@@ -491,6 +833,8 @@ func (srv *HttpServer) Run() error {
 	r.HandleFunc("/", srv.HttpsRedirect)
 	r.HandleFunc("/ws/{token}", srv.wsWithTokenHandler)
 	r.HandleFunc("/firstTimeAuth", srv.firstTimeAddUserHandler)
+	r.HandleFunc("/webhooks/github", srv.githubWebhookHandler).
+		Methods("POST")
 
 	go func() {
 		err := http.ListenAndServeTLS(
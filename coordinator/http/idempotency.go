@@ -0,0 +1,148 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// idempotencyKeyHeader is the header in which clients that retry requests,
+// such as the primary coordinator of a federation, send a key unique to the
+// request
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// idempotencyKeyLifetime is how long the response to a request with an
+// idempotency key is replayed to retries of the request
+const idempotencyKeyLifetime = 24 * time.Hour
+
+// idempotentResponse is the response to a request with an idempotency key
+type idempotentResponse struct {
+	created time.Time
+	// Closed once the response is recorded
+	done   chan bool
+	status int
+	header http.Header
+	body   []byte
+}
+
+// responseRecorder is a http.ResponseWriter that keeps the response, such
+// that it can be replayed
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rr *responseRecorder) Header() http.Header {
+	return rr.header
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	if rr.status == 0 {
+		rr.status = status
+	}
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	rr.WriteHeader(http.StatusOK)
+	return rr.body.Write(b)
+}
+
+// replayable returns true if the response is replayed to retries of the
+// request. Failed requests are handled again, which includes the ones that
+// report the failure in a successful response, like validation errors
+func (res *idempotentResponse) replayable() bool {
+	if res.status != http.StatusOK {
+		return false
+	}
+	var body struct {
+		OK *bool `json:"ok"`
+	}
+	err := json.Unmarshal(res.body, &body)
+	return err != nil || body.OK == nil || *body.OK
+}
+
+// writeIdempotentResponse writes the recorded response to w
+func writeIdempotentResponse(w http.ResponseWriter, res *idempotentResponse) {
+	for k, v := range res.header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(res.status)
+	_, err := w.Write(res.body)
+	if err != nil {
+		logging.Warnf("Error writing response: %v", err)
+	}
+}
+
+// idempotent wraps the handler such that a request retried with the same
+// idempotency key by the same user is answered with the response to the
+// first attempt, in stead of being handled again. Attempts that failed don't
+// count, the next attempt is handled in their place
+func (srv *HttpServer) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" {
+			next(w, r)
+			return
+		}
+		usr, err := srv.RealUserFromRequest(r)
+		if err != nil {
+			logging.Errorf("Error determining user: %s", err.Error())
+			http.Error(w, "Internal server error", 500)
+			return
+		}
+		id := usr.Thumbprint + "/" + key
+
+		for {
+			srv.idempotentResponsesLock.Lock()
+			for k, res := range srv.idempotentResponses {
+				if time.Since(res.created) < idempotencyKeyLifetime {
+					continue
+				}
+				select {
+				case <-res.done:
+					delete(srv.idempotentResponses, k)
+				default:
+				}
+			}
+			res, ok := srv.idempotentResponses[id]
+			if !ok {
+				res = &idempotentResponse{
+					created: time.Now(),
+					done:    make(chan bool),
+				}
+				srv.idempotentResponses[id] = res
+			}
+			srv.idempotentResponsesLock.Unlock()
+
+			if ok {
+				<-res.done
+				if res.replayable() {
+					writeIdempotentResponse(w, res)
+					return
+				}
+				continue
+			}
+
+			rec := &responseRecorder{header: http.Header{}}
+			next(rec, r)
+			if rec.status == 0 {
+				rec.status = http.StatusOK
+			}
+			res.status = rec.status
+			res.header = rec.header
+			res.body = rec.body.Bytes()
+			if !res.replayable() {
+				srv.idempotentResponsesLock.Lock()
+				delete(srv.idempotentResponses, id)
+				srv.idempotentResponsesLock.Unlock()
+			}
+			close(res.done)
+			writeIdempotentResponse(w, res)
+			return
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package http
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/coordinator"
+)
+
+// defaultImpersonationDuration is how long an impersonation lasts if the
+// admin does not specify a duration
+const defaultImpersonationDuration = time.Hour
+
+// maxImpersonationDuration is the longest an impersonation can last
+const maxImpersonationDuration = time.Hour * 8
+
+// impersonation is an admin temporarily acting as another user, for instance
+// to debug their templates or re-run their failed sweeps
+type impersonation struct {
+	Target  *SystemUser `json:"target"`
+	Reason  string      `json:"reason"`
+	Started time.Time   `json:"started"`
+	Expires time.Time   `json:"expires"`
+}
+
+// isAdminThumbprint returns true if the user with the given thumbprint is
+// configured as admin in the (comma separated) ADMIN_THUMBPRINTS environment
+// variable
+func isAdminThumbprint(thumbprint string) bool {
+	for _, a := range strings.Split(os.Getenv("ADMIN_THUMBPRINTS"), ",") {
+		if strings.TrimSpace(a) == thumbprint && thumbprint != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// activeImpersonation returns the impersonation the admin with the given
+// thumbprint is performing, if any. Expired impersonations are ended
+func (srv *HttpServer) activeImpersonation(adminThumb string) *impersonation {
+	srv.impersonationsLock.Lock()
+	imp, ok := srv.impersonations[adminThumb]
+	if ok && time.Now().After(imp.Expires) {
+		delete(srv.impersonations, adminThumb)
+		srv.impersonationsLock.Unlock()
+		srv.coord.Audit(coordinator.AuditEntry{
+			Actor:          adminThumb,
+			ImpersonatedAs: imp.Target.Thumbprint,
+			Action:         "impersonation-expired",
+		})
+		return nil
+	}
+	srv.impersonationsLock.Unlock()
+	if !ok {
+		return nil
+	}
+	return imp
+}
+
+// startImpersonation lets the admin act as the user with the given thumbprint
+// until the impersonation is stopped or expires
+func (srv *HttpServer) startImpersonation(
+	admin *SystemUser,
+	targetThumb string,
+	reason string,
+	duration time.Duration,
+) (*impersonation, error) {
+	if !admin.Admin {
+		return nil, fmt.Errorf("Only admins can impersonate users")
+	}
+	if strings.TrimSpace(reason) == "" {
+		return nil, fmt.Errorf("A reason for the impersonation is required")
+	}
+	target := srv.UserFromThumbprint(targetThumb)
+	if target == nil {
+		return nil, fmt.Errorf("User %s not found", targetThumb)
+	}
+	if target.Thumbprint == admin.Thumbprint || target.Admin {
+		return nil, fmt.Errorf("Admins cannot be impersonated")
+	}
+	if duration <= 0 {
+		duration = defaultImpersonationDuration
+	}
+	if duration > maxImpersonationDuration {
+		return nil, fmt.Errorf(
+			"Impersonations can last at most %s",
+			maxImpersonationDuration,
+		)
+	}
+
+	imp := &impersonation{
+		Target:  target,
+		Reason:  reason,
+		Started: time.Now(),
+		Expires: time.Now().Add(duration),
+	}
+	srv.impersonationsLock.Lock()
+	srv.impersonations[admin.Thumbprint] = imp
+	srv.impersonationsLock.Unlock()
+	srv.coord.Audit(coordinator.AuditEntry{
+		Actor:          admin.Thumbprint,
+		ImpersonatedAs: target.Thumbprint,
+		Action:         "impersonation-started",
+		Details: fmt.Sprintf(
+			"%s (until %s)",
+			reason,
+			imp.Expires.Format(time.RFC3339),
+		),
+	})
+	return imp, nil
+}
+
+// stopImpersonation ends the impersonation the admin is performing, if any
+func (srv *HttpServer) stopImpersonation(admin *SystemUser) {
+	srv.impersonationsLock.Lock()
+	imp, ok := srv.impersonations[admin.Thumbprint]
+	delete(srv.impersonations, admin.Thumbprint)
+	srv.impersonationsLock.Unlock()
+	if !ok {
+		return
+	}
+	srv.coord.Audit(coordinator.AuditEntry{
+		Actor:          admin.Thumbprint,
+		ImpersonatedAs: imp.Target.Thumbprint,
+		Action:         "impersonation-stopped",
+	})
+}
+
+// auditImpersonationMiddleware records the requests that change state made by
+// admins while impersonating another user in the audit log
+func (srv *HttpServer) auditImpersonationMiddleware(
+	next http.Handler,
+) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "OPTIONS" &&
+			r.URL.Path != "/api/impersonation" {
+			usr, err := srv.UserFromRequest(r)
+			if err == nil && usr.ImpersonatedBy != "" {
+				srv.coord.Audit(coordinator.AuditEntry{
+					Actor:          usr.ImpersonatedBy,
+					ImpersonatedAs: usr.Thumbprint,
+					Action:         "request",
+					Details:        fmt.Sprintf("%s %s", r.Method, r.URL.Path),
+				})
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
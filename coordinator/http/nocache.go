@@ -1,7 +1,9 @@
 package http
 
 import (
+	"fmt"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -40,3 +42,24 @@ func NoCache(h http.HandlerFunc) http.HandlerFunc {
 		h(w, r)
 	}
 }
+
+// Revalidate lets clients cache the response of the handler, but makes them
+// check with the server that it is still current before every use. The
+// version function identifies the current state of the resource: it is sent
+// as ETag, and requests whose If-None-Match matches it are answered with 304
+// Not Modified without calling the handler
+func Revalidate(version func() string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		etag := fmt.Sprintf("%q", version())
+		w.Header().Set("Cache-Control", "no-cache, private")
+		w.Header().Set("ETag", etag)
+		for _, t := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+			t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+			if t == etag || t == "*" {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		h(w, r)
+	}
+}
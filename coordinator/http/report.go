@@ -471,12 +471,38 @@ func (h *HttpServer) generateRunPlot(input string) string {
 //go:embed report-template.html
 var reportTemplate string
 
+// reportID returns the ID of the report rendered from the definition, which
+// is the name of the file it is stored in
+func reportID(def reportDefinition) string {
+	b, _ := json.Marshal(def)
+	return fmt.Sprintf("%x", sha256.Sum256(b))
+}
+
+// reportPath returns the path the rendered report with the given ID is stored
+// at
+func reportPath(id string) string {
+	return filepath.Join(
+		common.DataDir(),
+		fmt.Sprintf("testruns/reports/%s.html", id),
+	)
+}
+
+// generateStoredReport renders the report definition and returns the ID
+// under which it is stored
+func (h *HttpServer) generateStoredReport(
+	title, definition string,
+) (string, error) {
+	def := reportDefinition{Title: title, Definition: definition}
+	if h.generateReport(def) == "" {
+		return "", errors.New("Unable to render report")
+	}
+	return reportID(def), nil
+}
+
 func (h *HttpServer) generateReport(def reportDefinition) string {
 	result := ""
 	reportLock.Lock()
 	defer reportLock.Unlock()
-	b, _ := json.Marshal(def)
-	sha := sha256.Sum256(b)
 	err := os.MkdirAll(
 		filepath.Join(common.DataDir(), "testruns/reports"),
 		0755,
@@ -485,10 +511,7 @@ func (h *HttpServer) generateReport(def reportDefinition) string {
 		return ""
 	}
 
-	outputFile := filepath.Join(
-		common.DataDir(),
-		fmt.Sprintf("testruns/reports/%x.html", sha),
-	)
+	outputFile := reportPath(reportID(def))
 	if _, err := os.Stat(outputFile); os.IsNotExist(err) {
 		body := def.Definition
 		body = strings.ReplaceAll(body, "%TITLE%", def.Title)
@@ -16,12 +16,14 @@ type SweepData struct {
 	LastRun                 time.Time                `json:"lastRun"`
 	FirstRunData            FrontendTestRunListEntry `json:"firstRunData"`
 	FirstRunID              string
-	SweepRoleRuns           int                    `json:"sweepRoleRuns"`
-	SweepParameterStart     float64                `json:"sweepParameterStart"`
-	SweepParameterStop      float64                `json:"sweepParameterStop"`
-	SweepParameterIncrement float64                `json:"sweepParameterIncrement"`
-	SweepRoles              []*common.TestRunRole  `json:"sweepRoles"`
-	CommonParameters        map[string]interface{} `json:"commonParameters"`
+	SweepRoleRuns           int                     `json:"sweepRoleRuns"`
+	SweepParameterStart     float64                 `json:"sweepParameterStart"`
+	SweepParameterStop      float64                 `json:"sweepParameterStop"`
+	SweepParameterIncrement float64                 `json:"sweepParameterIncrement"`
+	SweepRoles              []*common.TestRunRole   `json:"sweepRoles"`
+	SweepMatrix             []common.SweepDimension `json:"sweepMatrix,omitempty"`
+	SweepConcurrency        int                     `json:"sweepConcurrency,omitempty"`
+	CommonParameters        map[string]interface{}  `json:"commonParameters"`
 }
 
 func (h *HttpServer) listSweeps() []*SweepData {
@@ -60,6 +62,8 @@ func (h *HttpServer) listSweeps() []*SweepData {
 					SweepParameterStop:      r.SweepParameterStop,
 					SweepParameterIncrement: r.SweepParameterIncrement,
 					SweepRoles:              r.SweepRoles,
+					SweepMatrix:             r.SweepMatrix,
+					SweepConcurrency:        r.SweepConcurrency,
 					ArchitectureID:          r.Architecture,
 				}
 				sweeps = append(sweeps, &sweep)
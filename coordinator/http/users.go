@@ -23,5 +23,32 @@ func (srv *HttpServer) UserFromRequest(r *http.Request) (*SystemUser, error) {
 		return nil, fmt.Errorf("Request contains no TLS peer certificate")
 	}
 
+	usr := srv.UserFromCert(r.TLS.PeerCertificates[0])
+	if imp := srv.activeImpersonation(usr.Thumbprint); imp != nil {
+		// The admin acts as the impersonated user for the duration of the
+		// impersonation
+		target := *imp.Target
+		target.ImpersonatedBy = usr.Thumbprint
+		return &target, nil
+	}
+	if thumb := r.Header.Get(federationUserHeader); thumb != "" {
+		return srv.federatedUser(usr, thumb)
+	}
+	return usr, nil
+}
+
+// RealUserFromRequest returns the user that authenticated the request,
+// regardless of the user they are impersonating
+func (srv *HttpServer) RealUserFromRequest(
+	r *http.Request,
+) (*SystemUser, error) {
+	if r.TLS == nil {
+		return nil, fmt.Errorf("Request contains no TLS info")
+	}
+
+	if len(r.TLS.PeerCertificates) == 0 {
+		return nil, fmt.Errorf("Request contains no TLS peer certificate")
+	}
+
 	return srv.UserFromCert(r.TLS.PeerCertificates[0]), nil
 }
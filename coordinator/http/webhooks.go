@@ -0,0 +1,131 @@
+package http
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"strings"
+)
+
+// githubWebhookSecret returns the secret shared with GitHub to sign webhook
+// deliveries. The webhook endpoint is disabled when it's not set
+func githubWebhookSecret() string {
+	return os.Getenv("GITHUB_WEBHOOK_SECRET")
+}
+
+// githubWebhookAutoCompile returns true if webhook deliveries should compile
+// the new head commit after updating the sources
+func githubWebhookAutoCompile() bool {
+	return os.Getenv("GITHUB_WEBHOOK_AUTO_COMPILE") == "1"
+}
+
+// githubWebhookCompileRefs returns the branches and tags that are compiled
+// when their head moves, from the comma separated
+// GITHUB_WEBHOOK_COMPILE_REFS environment variable. An empty list means all
+// branches and tags pushed to are compiled
+func githubWebhookCompileRefs() []string {
+	refs := []string{}
+	for _, r := range strings.Split(os.Getenv("GITHUB_WEBHOOK_COMPILE_REFS"), ",") {
+		r = strings.TrimSpace(r)
+		if r != "" {
+			refs = append(refs, r)
+		}
+	}
+	return refs
+}
+
+// verifyGithubSignature checks the X-Hub-Signature-256 header of a webhook
+// delivery, which is the hex encoded HMAC-SHA256 of the body prefixed with
+// `sha256=`
+func verifyGithubSignature(secret string, body []byte, signature string) bool {
+	if !strings.HasPrefix(signature, "sha256=") {
+		return false
+	}
+	sig, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write(body)
+	return hmac.Equal(sig, mac.Sum(nil))
+}
+
+// githubPushEvent contains the fields of a push webhook payload we need
+type githubPushEvent struct {
+	Ref     string `json:"ref"`
+	After   string `json:"after"`
+	Deleted bool   `json:"deleted"`
+}
+
+// githubPullRequestEvent contains the fields of a pull_request webhook payload
+// we need
+type githubPullRequestEvent struct {
+	Action      string `json:"action"`
+	Number      int    `json:"number"`
+	PullRequest struct {
+		Head struct {
+			Ref  string `json:"ref"`
+			Sha  string `json:"sha"`
+			Repo struct {
+				FullName string `json:"full_name"`
+			} `json:"repo"`
+		} `json:"head"`
+		Base struct {
+			Repo struct {
+				FullName string `json:"full_name"`
+			} `json:"repo"`
+		} `json:"base"`
+	} `json:"pull_request"`
+}
+
+// githubMergeGroupEvent contains the fields of a merge_group webhook payload
+// we need
+type githubMergeGroupEvent struct {
+	Action     string `json:"action"`
+	MergeGroup struct {
+		HeadSha string `json:"head_sha"`
+		HeadRef string `json:"head_ref"`
+	} `json:"merge_group"`
+}
+
+// githubCompileRef returns the branch or tag to compile for a webhook
+// delivery, or an empty string if there's nothing to compile
+func githubCompileRef(
+	event string,
+	push *githubPushEvent,
+	pr *githubPullRequestEvent,
+) string {
+	ref := ""
+	switch event {
+	case "push":
+		if push.Deleted {
+			return ""
+		}
+		ref = strings.TrimPrefix(push.Ref, "refs/heads/")
+		ref = strings.TrimPrefix(ref, "refs/tags/")
+	case "pull_request":
+		switch pr.Action {
+		case "opened", "reopened", "synchronize":
+		default:
+			return ""
+		}
+		// Branches of forks can't be fetched from the origin remote
+		head, base := pr.PullRequest.Head.Repo, pr.PullRequest.Base.Repo
+		if head.FullName != base.FullName {
+			return ""
+		}
+		ref = pr.PullRequest.Head.Ref
+	}
+
+	allowed := githubWebhookCompileRefs()
+	if len(allowed) == 0 {
+		return ref
+	}
+	for _, a := range allowed {
+		if a == ref {
+			return ref
+		}
+	}
+	return ""
+}
@@ -19,10 +19,46 @@ var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool { return true },
 } // use default options
 
+// websocketReliableQueueSize is the maximum number of low-frequency state
+// change messages that can be queued for a single client. These are never
+// dropped, so a client that falls this far behind is disconnected instead and
+// will reload the full state when it reconnects.
+const websocketReliableQueueSize = 1000
+
+// websocketLossyQueueSize is the maximum number of high-frequency messages
+// (logs, compile progress, live metrics) queued for a single client. When the
+// queue is full, the oldest message is dropped to make room for the new one.
+const websocketLossyQueueSize = 100
+
+// websocketWriteTimeout bounds how long a single write to a client may take
+// before the client is considered stalled and is disconnected
+const websocketWriteTimeout = 10 * time.Second
+
 type websocketConn struct {
 	conn                               *websocket.Conn
-	outgoing                           chan []byte
+	lock                               sync.Mutex
+	reliable                           [][]byte
+	lossy                              []lossyMessage
+	dropped                            uint64
+	closed                             bool
+	wake                               chan struct{}
 	subscribedToTestRunLogForTestRunID string
+	// The roles the client streams the logs of, and the func ending the
+	// subscription
+	roleLogFilter      *coordinator.RoleLogFilter
+	roleLogUnsubscribe func()
+	// The bytes of role output in dropped messages by agent, which are
+	// reported as skipped in the next role output sent for the agent
+	droppedLogBytes map[int32]int64
+}
+
+// lossyMessage is a queued message that is dropped when the client falls
+// behind
+type lossyMessage struct {
+	msg []byte
+	// The agent and number of bytes of role output the message carries
+	logAgentID int32
+	logBytes   int64
 }
 
 var testRunUpdate = sync.Map{}
@@ -35,11 +71,200 @@ type websocketMessage struct {
 	Msg  map[string]interface{} `json:"m"`
 }
 
+func newWebsocketConn(c *websocket.Conn) *websocketConn {
+	return &websocketConn{
+		conn:            c,
+		reliable:        make([][]byte, 0),
+		lossy:           make([]lossyMessage, 0),
+		wake:            make(chan struct{}, 1),
+		droppedLogBytes: map[int32]int64{},
+	}
+}
+
+// isHighFrequencyEvent returns true for the event types that can be sent at a
+// high rate and for which only the most recent messages are of interest to
+// the client. These are delivered on a best-effort basis.
+func isHighFrequencyEvent(t coordinator.EventType) bool {
+	switch t {
+	case coordinator.EventTypeTestRunLogAppended,
+		coordinator.EventTypeCompileProgress,
+		coordinator.EventTypeLiveMetrics,
+		coordinator.EventTypeAgentHealth,
+		coordinator.EventTypeRoleLogLines:
+		return true
+	}
+	return false
+}
+
+// enqueue queues a message for delivery to the client without blocking the
+// caller. Lossy messages drop the oldest queued lossy message when the queue
+// is full, reliable messages close the connection when the client has fallen
+// too far behind.
+func (c *websocketConn) enqueue(msg []byte, lossy bool) {
+	c.push(lossyMessage{msg: msg}, lossy)
+}
+
+// push queues a message like enqueue. Dropped lossy messages with role output
+// are remembered, such that the client can be told output is missing
+func (c *websocketConn) push(m lossyMessage, lossy bool) {
+	msg := m.msg
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return
+	}
+	if lossy {
+		if len(c.lossy) >= websocketLossyQueueSize {
+			if d := c.lossy[0]; d.logBytes > 0 {
+				c.droppedLogBytes[d.logAgentID] += d.logBytes
+			}
+			c.lossy = c.lossy[1:]
+			c.dropped++
+		}
+		c.lossy = append(c.lossy, m)
+	} else {
+		if len(c.reliable) >= websocketReliableQueueSize {
+			c.lock.Unlock()
+			logging.Warnf(
+				"Websocket client has %d undelivered state changes, disconnecting",
+				websocketReliableQueueSize,
+			)
+			c.close()
+			return
+		}
+		c.reliable = append(c.reliable, msg)
+	}
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	c.lock.Unlock()
+}
+
+// next pops the next message to send, preferring reliable messages over lossy
+// ones. Returns false when there is nothing to send.
+func (c *websocketConn) next() ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.reliable) > 0 {
+		msg := c.reliable[0]
+		c.reliable = c.reliable[1:]
+		return msg, true
+	}
+	if len(c.lossy) > 0 {
+		msg := c.lossy[0].msg
+		c.lossy = c.lossy[1:]
+		return msg, true
+	}
+	return nil, false
+}
+
+// close marks the connection as closed, discards the queued messages and
+// closes the underlying websocket, which also ends the read loop in the
+// handler
+func (c *websocketConn) close() {
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return
+	}
+	c.closed = true
+	c.reliable = nil
+	c.lossy = nil
+	if c.dropped > 0 {
+		logging.Debugf(
+			"Websocket client closed after dropping %d high-frequency messages",
+			c.dropped,
+		)
+	}
+	close(c.wake)
+	c.lock.Unlock()
+	c.conn.Close()
+}
+
+func (c *websocketConn) subscribedTestRun() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.subscribedToTestRunLogForTestRunID
+}
+
+func (c *websocketConn) subscribeTestRun(id string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.subscribedToTestRunLogForTestRunID = id
+}
+
+// enqueueRoleLogs queues the lines of role output the client is subscribed
+// to. The output of dropped messages for the agent since the previous lines
+// is added to the skipped bytes
+func (c *websocketConn) enqueueRoleLogs(pl coordinator.RoleLogLinesPayload) {
+	c.lock.Lock()
+	f := c.roleLogFilter
+	if f == nil || f.TestRunID != pl.TestRunID ||
+		!f.MatchesAgent(pl.AgentID, pl.Roles) {
+		c.lock.Unlock()
+		return
+	}
+	lines := []coordinator.RoleLogLine{}
+	size := int64(0)
+	for _, l := range pl.Lines {
+		if f.MatchesLine(pl.AgentID, l) {
+			lines = append(lines, l)
+			size += int64(len(l.Line)) + 1
+		}
+	}
+	skipped := pl.SkippedBytes + c.droppedLogBytes[pl.AgentID]
+	if len(lines) == 0 && skipped == 0 {
+		c.lock.Unlock()
+		return
+	}
+	delete(c.droppedLogBytes, pl.AgentID)
+	c.lock.Unlock()
+
+	pl.Lines = lines
+	pl.SkippedBytes = skipped
+	b, err := json.Marshal(coordinator.Event{
+		Type:    coordinator.EventTypeRoleLogLines,
+		Payload: pl,
+	})
+	if err != nil {
+		log.Printf("encode: %v\n", err)
+		return
+	}
+	c.push(lossyMessage{msg: b, logAgentID: pl.AgentID, logBytes: size}, true)
+}
+
+// subscribeRoleLogs makes the client stream the logs of the roles selected by
+// the filter, replacing its previous subscription. unsubscribe is called when
+// the subscription ends
+func (c *websocketConn) subscribeRoleLogs(
+	f *coordinator.RoleLogFilter,
+	unsubscribe func(),
+) {
+	c.lock.Lock()
+	previous := c.roleLogUnsubscribe
+	c.roleLogFilter = f
+	c.roleLogUnsubscribe = unsubscribe
+	c.lock.Unlock()
+	if previous != nil {
+		previous()
+	}
+}
+
 func (c *websocketConn) sendLoop() {
-	for msg := range c.outgoing {
-		err := c.conn.WriteMessage(websocket.TextMessage, msg)
-		if err != nil {
-			logging.Errorf("Error writing to websocket: %v", err)
+	for range c.wake {
+		for {
+			msg, ok := c.next()
+			if !ok {
+				break
+			}
+			_ = c.conn.SetWriteDeadline(time.Now().Add(websocketWriteTimeout))
+			err := c.conn.WriteMessage(websocket.TextMessage, msg)
+			if err != nil {
+				logging.Errorf("Error writing to websocket: %v", err)
+				c.close()
+				return
+			}
 		}
 	}
 }
@@ -113,21 +338,33 @@ func (srv *HttpServer) publishToWebsocketsLoop() {
 			}
 		}
 
-		for _, c := range websockets {
+		websocketsLock.Lock()
+		clients := make([]*websocketConn, len(websockets))
+		copy(clients, websockets)
+		websocketsLock.Unlock()
+
+		lossy := isHighFrequencyEvent(ev.Type)
+		for _, c := range clients {
 			if c != nil {
 				write := true
 
 				switch ev.Type {
 				case coordinator.EventTypeTestRunLogAppended:
-					write = c.subscribedToTestRunLogForTestRunID == ev.Payload.(coordinator.TestRunLogAppendedPayload).TestRunID
+					write = c.subscribedTestRun() == ev.Payload.(coordinator.TestRunLogAppendedPayload).TestRunID
+				case coordinator.EventTypeCompileProgress:
+					write = c.subscribedTestRun() == ev.Payload.(coordinator.CompileProgressPayload).TestRunID
+				case coordinator.EventTypeLiveMetrics:
+					write = c.subscribedTestRun() == ev.Payload.(coordinator.LiveMetricsPayload).TestRunID
+				case coordinator.EventTypeAgentHealth:
+					write = c.subscribedTestRun() == ev.Payload.(coordinator.AgentHealthPayload).TestRunID
+				case coordinator.EventTypeRoleLogLines:
+					// Filtered by line, so encoded per client
+					c.enqueueRoleLogs(ev.Payload.(coordinator.RoleLogLinesPayload))
+					write = false
 				}
 
 				if write {
-					// Make this non-blocking
-					select {
-					case c.outgoing <- b:
-					default:
-					}
+					c.enqueue(b, lossy)
 				}
 			}
 		}
@@ -0,0 +1,474 @@
+package coordinator
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+	"github.com/mit-dci/opencbdc-tctl/wire"
+)
+
+// agentResumeWindow is the time the session of an agent with a persistent
+// identity is kept after its connection was lost. If the agent reconnects
+// within this time, its session is resumed: the commands and file transfers
+// that were running on it are picked up where they were, and the messages
+// queued for it are delivered
+const agentResumeWindow = 2 * time.Minute
+
+// agentResumeTokenLifetime is the time a resume token can be used after it
+// was issued. Agents enroll again with their credential once it expired, such
+// that an agent can't keep resuming its session after its credential was
+// revoked
+const agentResumeTokenLifetime = 24 * time.Hour
+
+// agentIdentity is the persistent identity of an agent, which keeps the same
+// agent ID across reconnects and restarts of the coordinator. Only the
+// SHA-256 hash of the token to resume its session is kept
+type agentIdentity struct {
+	AgentID            int32     `json:"agentID"`
+	ResumeTokenHash    string    `json:"resumeTokenHash"`
+	ResumeTokenExpires time.Time `json:"resumeTokenExpires"`
+	Registered         time.Time `json:"registered"`
+	// The SHA-256 hash of the credential the agent last enrolled with, such
+	// that the identity is dropped when that credential is revoked
+	CredentialHash string `json:"credentialHash,omitempty"`
+	// The pool the agent joined with a join token, which it stays in when it
+	// enrolls again with another method, such as a rotated credential
+	Pool string `json:"pool,omitempty"`
+}
+
+// agentIdentitiesPath returns the path of the file the agent identities are
+// persisted in
+func agentIdentitiesPath() string {
+	return filepath.Join(common.DataDir(), "agent-identities.json")
+}
+
+// loadAgentIdentities reads the persisted agent identities, and makes sure
+// agents connecting without one don't get the ID of an agent that has one
+func (c *Coordinator) loadAgentIdentities() {
+	f, err := os.Open(agentIdentitiesPath())
+	if err == nil {
+		defer f.Close()
+		err = json.NewDecoder(f).Decode(&c.identities)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		logging.Warnf("Unable to load agent identities: %v", err)
+	}
+	for _, id := range c.identities {
+		if id.AgentID > c.nextAgentID {
+			c.nextAgentID = id.AgentID
+		}
+		// Identities persisted before resume tokens expired get a full
+		// lifetime from now
+		if id.ResumeTokenExpires.IsZero() {
+			id.ResumeTokenExpires = time.Now().Add(agentResumeTokenLifetime)
+		}
+	}
+}
+
+// issueResumeToken replaces the token the agent can resume the session of its
+// identity with by a new one, valid for agentResumeTokenLifetime. Expects the
+// caller to hold identitiesLock
+func issueResumeToken(id *agentIdentity) ([]byte, error) {
+	token, err := common.RandomIDBytes(32)
+	if err != nil {
+		return nil, err
+	}
+	id.ResumeTokenHash = hashAgentCredential(token)
+	id.ResumeTokenExpires = time.Now().Add(agentResumeTokenLifetime)
+	return token, nil
+}
+
+// persistAgentIdentities writes the agent identities to disk. Expects the
+// caller to hold identitiesLock
+func (c *Coordinator) persistAgentIdentities() error {
+	f, err := os.OpenFile(
+		agentIdentitiesPath(),
+		os.O_CREATE|os.O_WRONLY|os.O_TRUNC,
+		0600,
+	)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(c.identities)
+}
+
+// registerAgentIdentity registers the identity of an agent that enrolled, and
+// returns the token it can resume its session with. The identity is linked
+// to the credential the agent enrolled with. An identity that is already
+// known keeps its agent ID and pool, any session it still had is ended
+func (c *Coordinator) registerAgentIdentity(
+	agent *ConnectedAgent,
+	identity string,
+	credential []byte,
+) ([]byte, error) {
+	c.identitiesLock.Lock()
+	id, known := c.identities[identity]
+	if !known {
+		id = &agentIdentity{AgentID: agent.ID, Registered: time.Now()}
+	}
+	token, err := issueResumeToken(id)
+	if err != nil {
+		c.identitiesLock.Unlock()
+		return nil, err
+	}
+	c.identities[identity] = id
+	id.CredentialHash = ""
+	if len(credential) > 0 {
+		id.CredentialHash = hashAgentCredential(credential)
+	}
+	if agent.Pool != "" {
+		id.Pool = agent.Pool
+	}
+	agent.Pool = id.Pool
+	err = c.persistAgentIdentities()
+	c.identitiesLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if known {
+		if old := c.agentByIdentity(identity); old != nil {
+			logging.Infof(
+				"Agent %d enrolled again, ending its previous session",
+				id.AgentID,
+			)
+			c.resyncCommands(old, &wire.HelloMsg{})
+			old.close()
+			c.removeAgent(old)
+		}
+		c.setAgentID(agent, id.AgentID)
+	}
+	agent.Identity = identity
+	return token, nil
+}
+
+// resumeAgent handles the HelloMsg of an agent that presents the token to
+// resume the session of its identity. If the coordinator still has the
+// session, the connection is handed over to it, and the commands the agent
+// reports are resynced. Otherwise, for instance after the coordinator was
+// restarted, the agent starts a new session under its persistent agent ID.
+// The agent is handed a new resume token, such that agents that stay
+// connected don't lose the ability to resume once their token expires
+func (c *Coordinator) resumeAgent(
+	agent *ConnectedAgent,
+	msg *wire.HelloMsg,
+) (wire.Msg, error) {
+	// The token is checked and replaced under the lock, such that it can
+	// only be used once
+	c.identitiesLock.Lock()
+	id, ok := c.identities[msg.AgentIdentity]
+	if !ok || subtle.ConstantTimeCompare(
+		[]byte(id.ResumeTokenHash),
+		[]byte(hashAgentCredential(msg.ResumeToken)),
+	) != 1 {
+		c.identitiesLock.Unlock()
+		return nil, fmt.Errorf(
+			"%w: unknown agent identity or resume token",
+			ErrEnrollmentRejected,
+		)
+	}
+	if time.Now().After(id.ResumeTokenExpires) {
+		c.identitiesLock.Unlock()
+		return nil, fmt.Errorf(
+			"%w: resume token expired",
+			ErrEnrollmentRejected,
+		)
+	}
+	token, err := issueResumeToken(id)
+	if err == nil {
+		err = c.persistAgentIdentities()
+	}
+	c.identitiesLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	session := c.agentByIdentity(msg.AgentIdentity)
+	if session == nil {
+		c.setAgentID(agent, id.AgentID)
+		agent.Identity = msg.AgentIdentity
+		agent.Pool = id.Pool
+		agent.SystemInfo = msg.SystemInfo
+		agent.AgentVersion = msg.AgentVersion
+		agent.handshakeComplete = true
+		return &wire.HelloResponseMsg{
+			YourAgentID: agent.ID,
+			ResumeToken: token,
+		}, nil
+	}
+
+	session.SystemInfo = msg.SystemInfo
+	session.AgentVersion = msg.AgentVersion
+	session.Reconnects++
+	c.resyncCommands(session, msg)
+	agent.resumedInto = session
+	agent.handshakeComplete = true
+	c.removeAgent(agent)
+	logging.Infof("Agent %d resumed its session", session.ID)
+	return &wire.HelloResponseMsg{
+		YourAgentID: session.ID,
+		ResumeToken: token,
+		Resumed:     true,
+	}, nil
+}
+
+// linkAgentCredential links the identity of the agent to the credential it
+// was handed during a credential rotation, such that revoking the credentials
+// issued before the rotation doesn't drop it
+func (c *Coordinator) linkAgentCredential(
+	a *ConnectedAgent,
+	credential []byte,
+) error {
+	if a.Identity == "" {
+		return nil
+	}
+	c.identitiesLock.Lock()
+	defer c.identitiesLock.Unlock()
+	id, ok := c.identities[a.Identity]
+	if !ok {
+		return nil
+	}
+	id.CredentialHash = hashAgentCredential(credential)
+	return c.persistAgentIdentities()
+}
+
+// agentCredentialHash returns the hash of the credential the identity of the
+// agent is linked to, or an empty string if it has none
+func (c *Coordinator) agentCredentialHash(a *ConnectedAgent) string {
+	if a.Identity == "" {
+		return ""
+	}
+	c.identitiesLock.Lock()
+	defer c.identitiesLock.Unlock()
+	id, ok := c.identities[a.Identity]
+	if !ok {
+		return ""
+	}
+	return id.CredentialHash
+}
+
+// dropRevokedIdentities drops the identities that are linked to one of the
+// revoked credentials (by their hashes), along with their resume tokens, and
+// ends their sessions. The agents have to enroll again with a valid
+// credential
+func (c *Coordinator) dropRevokedIdentities(revoked []string) {
+	if len(revoked) == 0 {
+		return
+	}
+	isRevoked := map[string]bool{}
+	for _, h := range revoked {
+		isRevoked[h] = true
+	}
+	dropped := []string{}
+	c.identitiesLock.Lock()
+	for identity, id := range c.identities {
+		if id.CredentialHash != "" && isRevoked[id.CredentialHash] {
+			delete(c.identities, identity)
+			dropped = append(dropped, identity)
+		}
+	}
+	var err error
+	if len(dropped) > 0 {
+		err = c.persistAgentIdentities()
+	}
+	c.identitiesLock.Unlock()
+	if err != nil {
+		logging.Warnf("Unable to persist agent identities: %v", err)
+	}
+
+	for _, identity := range dropped {
+		a := c.agentByIdentity(identity)
+		if a == nil {
+			continue
+		}
+		logging.Infof(
+			"Credential of agent %d was revoked, ending its session",
+			a.ID,
+		)
+		c.resyncCommands(a, &wire.HelloMsg{})
+		a.close()
+		c.removeAgent(a)
+	}
+}
+
+// completeResume hands the connection of the agent that resumed a session
+// over to that session. The reply to the HelloMsg is written before the
+// messages that were queued for the session while it was disconnected, since
+// the agent expects it first. Returns the session
+func (c *Coordinator) completeResume(
+	agent *ConnectedAgent,
+	reply wire.Msg,
+) *ConnectedAgent {
+	session := agent.resumedInto
+	agent.closeLock.Lock()
+	conn := agent.conn
+	close(agent.done)
+	agent.closed = true
+	agent.closeLock.Unlock()
+
+	err := conn.Send(reply)
+	if err != nil {
+		logging.Warnf(
+			"Agent %d: Unable to complete resuming its session: %v",
+			session.ID,
+			err,
+		)
+	}
+	c.attachConnection(session, conn)
+	return session
+}
+
+// attachConnection makes the connection the current connection of the
+// agent, replacing the previous one, and starts sending and pinging over it
+func (c *Coordinator) attachConnection(a *ConnectedAgent, conn *wire.Conn) {
+	a.closeLock.Lock()
+	if a.conn != nil {
+		if a.Disconnected == nil {
+			// The agent reconnected before we noticed its previous
+			// connection was lost
+			close(a.done)
+			a.conn.Close()
+		}
+		conn.ContinueMessageIDs(a.conn)
+	}
+	conn.Tag = fmt.Sprintf("Agent %d", a.ID)
+	a.conn = conn
+	a.done = make(chan struct{})
+	a.Disconnected = nil
+	done := a.done
+	a.closeLock.Unlock()
+
+	// Process sending outgoing messages (to the agent) in a new goroutine
+	go a.sendLoop(conn, done)
+	// Start a separate loop that pings the agent to see if the connection
+	// remains alive, and what the roundtrip time on the TCP connection is
+	go c.pingLoop(a, done)
+}
+
+// connectionLost is called when the connection to the agent was lost. Agents
+// with a persistent identity keep their session for agentResumeWindow, after
+// which it is ended if they didn't reconnect. Other agents are removed right
+// away
+func (c *Coordinator) connectionLost(a *ConnectedAgent, conn *wire.Conn) {
+	conn.Close()
+	a.closeLock.Lock()
+	if a.conn != conn || a.closed || a.Disconnected != nil {
+		// The connection was replaced or the agent is already gone
+		a.closeLock.Unlock()
+		return
+	}
+	if !a.handshakeComplete || a.Identity == "" {
+		a.closeLock.Unlock()
+		a.close()
+		c.removeAgent(a)
+		return
+	}
+	close(a.done)
+	now := time.Now()
+	a.Disconnected = &now
+	a.closeLock.Unlock()
+
+	logging.Infof(
+		"Agent %d disconnected, keeping its session for %s",
+		a.ID,
+		agentResumeWindow,
+	)
+	go func() {
+		time.Sleep(agentResumeWindow)
+		a.closeLock.Lock()
+		expired := a.conn == conn && !a.closed
+		a.closeLock.Unlock()
+		if expired {
+			logging.Infof(
+				"Agent %d did not reconnect in time, ending its session",
+				a.ID,
+			)
+			c.resyncCommands(a, &wire.HelloMsg{})
+			a.close()
+			c.removeAgent(a)
+		}
+	}()
+}
+
+// resyncCommands delivers the completion of the commands the agent reports
+// in its HelloMsg to the listeners waiting for them, since the coordinator
+// may have missed it while the agent was disconnected. Commands the agent
+// neither runs nor recently finished were lost, and are reported as finished
+// with exit code -1 such that nothing waits for them forever
+func (c *Coordinator) resyncCommands(a *ConnectedAgent, msg *wire.HelloMsg) {
+	running := map[string]bool{}
+	for _, id := range msg.RunningCommands {
+		running[hex.EncodeToString(id)] = true
+	}
+	finished := map[string]int{}
+	for i, id := range msg.FinishedCommands {
+		if i < len(msg.FinishedExitCodes) {
+			finished[hex.EncodeToString(id)] = msg.FinishedExitCodes[i]
+		}
+	}
+
+	a.listenersLock.Lock()
+	defer a.listenersLock.Unlock()
+	newListeners := make([]*agentReplyListener, 0, len(a.listeners))
+	for _, rl := range a.listeners {
+		key := hex.EncodeToString(rl.commandID)
+		if rl.commandID == nil || running[key] {
+			newListeners = append(newListeners, rl)
+			continue
+		}
+		exitCode, ok := finished[key]
+		if !ok {
+			logging.Warnf(
+				"Agent %d lost track of command %x while disconnected",
+				a.ID,
+				rl.commandID,
+			)
+			exitCode = -1
+		}
+		select {
+		case rl.replyChan <- &wire.ExecuteCommandStatusMsg{
+			CommandID: rl.commandID,
+			Status:    wire.CommandStatusFinished,
+			ExitCode:  exitCode,
+		}:
+		case <-time.After(time.Second * 1):
+			logging.Warnf(
+				"Timeout delivering message to channel %v for command %x",
+				rl.replyChan,
+				rl.commandID,
+			)
+		}
+	}
+	a.listeners = newListeners
+}
+
+// agentByIdentity returns the session of the agent with the given persistent
+// identity, or nil if there is none
+func (c *Coordinator) agentByIdentity(identity string) *ConnectedAgent {
+	c.agentsLock.Lock()
+	defer c.agentsLock.Unlock()
+	for _, a := range c.agents {
+		if a.Identity == identity && a.handshakeComplete {
+			return a
+		}
+	}
+	return nil
+}
+
+// setAgentID changes the ID of an agent that is completing its handshake to
+// the persistent ID of its identity
+func (c *Coordinator) setAgentID(a *ConnectedAgent, id int32) {
+	c.agentsLock.Lock()
+	a.ID = id
+	c.agentsLock.Unlock()
+	a.closeLock.Lock()
+	a.conn.Tag = fmt.Sprintf("Agent %d", id)
+	a.closeLock.Unlock()
+}
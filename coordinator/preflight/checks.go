@@ -0,0 +1,353 @@
+package preflight
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/coordinator/awsmgr"
+	"github.com/mit-dci/opencbdc-tctl/coordinator/sources"
+)
+
+// requiredEnv are the environment variables the coordinator cannot work
+// without, along with what they configure
+var requiredEnv = map[string]string{
+	"AWS_REGION":        "the AWS region the coordinator runs in",
+	"OUTPUTS_S3_BUCKET": "the S3 bucket test run outputs are stored in",
+	"BINARIES_S3_BUCKET": "the S3 bucket compiled binaries are " +
+		"distributed through",
+}
+
+// recommendedEnv are the environment variables that have a fallback, which
+// may not be what is intended
+var recommendedEnv = map[string]string{
+	"AWS_DEFAULT_REGION": "S3 and AWS Batch fall back to us-east-1",
+	"UHS_SEEDER_BATCH_JOB": "shards cannot be seeded, test runs that " +
+		"require pre-seeding will fail",
+}
+
+// integerEnv are the environment variables that have to be integers if set
+var integerEnv = []string{
+	"PORT",
+	"HTTPS_PORT",
+	"HTTPS_WITHOUT_CLIENT_CERT_PORT",
+	"DEPENDENCY_CACHE_PORT",
+	"COMPILE_CONCURRENCY",
+	"TRANSACTION_PROCESSOR_CLONE_DEPTH",
+	"AWS_RETRY_MAX_ATTEMPTS",
+	"AWS_RETRY_INITIAL_BACKOFF_MS",
+	"AWS_RETRY_MAX_BACKOFF_MS",
+	"ARTIFACT_RETENTION_MAX_COUNT",
+	"ARTIFACT_RETENTION_MAX_AGE_DAYS",
+	"ARTIFACT_GC_INTERVAL_MINUTES",
+	"AGENT_CREDENTIAL_ROTATION_HOURS",
+	"SUMMARIZER_TIMEOUT_SECONDS",
+	"LIFECYCLE_HOOK_TIMEOUT_SECONDS",
+	"RUN_CREDENTIALS_DURATION_MINUTES",
+}
+
+// dataDirs are the directories the coordinator keeps in its data directory
+var dataDirs = []string{
+	"testruns",
+	"archives",
+	"binaries",
+	"build-failures",
+	"ccache",
+	"certs",
+	"depcache",
+	"snapshots",
+	"toolchains",
+	"components",
+}
+
+// dataFiles are the JSON files the coordinator keeps state in
+var dataFiles = []string{
+	"tracked-refs.json",
+	"announcements.json",
+	"feature-flags.json",
+	"federation.json",
+	"agent-credentials.json",
+	"seed-cache.json",
+	"components.json",
+	"build-failures/index.json",
+	"binaries/images.json",
+	"testruns/dashboards.json",
+	"testruns/templates.json",
+	"testruns/nightly-runs.json",
+	"testruns/weekly-reports.json",
+}
+
+// checkEnvironment checks that the required environment variables are set,
+// and that the ones that are set have valid values
+func checkEnvironment(r *Report) {
+	for name, desc := range requiredEnv {
+		if os.Getenv(name) == "" {
+			r.add(
+				"env."+name,
+				StatusFailed,
+				"Not set",
+				fmt.Sprintf("Set %s to %s", name, desc),
+			)
+		}
+	}
+	for name, fallback := range recommendedEnv {
+		if os.Getenv(name) == "" {
+			r.add("env."+name, StatusWarning, "Not set, "+fallback, "")
+		}
+	}
+	for _, name := range integerEnv {
+		v := os.Getenv(name)
+		if _, err := strconv.Atoi(v); v != "" && err != nil {
+			r.add(
+				"env."+name,
+				StatusWarning,
+				fmt.Sprintf("%q is not an integer, the default is used", v),
+				fmt.Sprintf("Set %s to an integer or unset it", name),
+			)
+		}
+	}
+
+	switch os.Getenv("SOURCE_PROVIDER") {
+	case "", "git":
+		repo := os.Getenv("TRANSACTION_PROCESSOR_REPO_URL")
+		if u, err := url.Parse(repo); repo == "" || err != nil ||
+			u.Host == "" {
+			r.add(
+				"env.TRANSACTION_PROCESSOR_REPO_URL",
+				StatusFailed,
+				fmt.Sprintf("%q is not a repository URL", repo),
+				"Set TRANSACTION_PROCESSOR_REPO_URL to the HTTPS URL of "+
+					"the repository of the system under test",
+			)
+		}
+		if os.Getenv("TRANSACTION_PROCESSOR_MAIN_BRANCH") == "" {
+			r.add(
+				"env.TRANSACTION_PROCESSOR_MAIN_BRANCH",
+				StatusFailed,
+				"Not set",
+				"Set TRANSACTION_PROCESSOR_MAIN_BRANCH to the branch the "+
+					"test runs default to, such as trunk",
+			)
+		}
+	case "tarball":
+		if os.Getenv("TARBALL_SOURCES_URL") == "" {
+			r.add(
+				"env.TARBALL_SOURCES_URL",
+				StatusFailed,
+				"Not set, but required by the tarball source provider",
+				"Set TARBALL_SOURCES_URL to the server publishing the "+
+					"source snapshots",
+			)
+		}
+	default:
+		r.add(
+			"env.SOURCE_PROVIDER",
+			StatusFailed,
+			fmt.Sprintf("Unsupported source provider %q", os.Getenv("SOURCE_PROVIDER")),
+			"Set SOURCE_PROVIDER to git or tarball, or unset it",
+		)
+	}
+
+	if key := os.Getenv("GITHUB_APP_PRIVATE_KEY"); key != "" {
+		if _, err := os.Stat(key); err != nil {
+			r.add(
+				"env.GITHUB_APP_PRIVATE_KEY",
+				StatusFailed,
+				fmt.Sprintf("Unable to read %s: %v", key, err),
+				"Point GITHUB_APP_PRIVATE_KEY to the PEM file of the key",
+			)
+		}
+	}
+
+	if !r.failed("env") {
+		r.add("env", StatusOK, "All required configuration is set", "")
+	}
+}
+
+// probeWrite checks that files can be created in dir by writing and removing
+// a probe file
+func probeWrite(dir string) error {
+	f, err := ioutil.TempFile(dir, ".preflight-")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write([]byte("preflight"))
+	if err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err2 := os.Remove(f.Name()); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// checkDataDir checks the layout of the data directory: it and the
+// directories in it have to be writable, and the state files have to be
+// valid JSON
+func checkDataDir(r *Report) {
+	dir := common.DataDir()
+	fi, err := os.Stat(dir)
+	if err != nil || !fi.IsDir() {
+		r.add(
+			"datadir",
+			StatusFailed,
+			fmt.Sprintf("%s is not a directory: %v", dir, err),
+			"Create the data directory next to the coordinator binary",
+		)
+		return
+	}
+	if err := probeWrite(dir); err != nil {
+		r.add(
+			"datadir",
+			StatusFailed,
+			fmt.Sprintf("Unable to write to %s: %v", dir, err),
+			"Make the data directory writable by the coordinator's user",
+		)
+		return
+	}
+
+	for _, d := range dataDirs {
+		path := filepath.Join(dir, d)
+		fi, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err == nil && !fi.IsDir() {
+			err = fmt.Errorf("not a directory")
+		}
+		if err == nil {
+			err = probeWrite(path)
+		}
+		if err != nil {
+			r.add(
+				"datadir."+d,
+				StatusFailed,
+				fmt.Sprintf("%s is unusable: %v", path, err),
+				fmt.Sprintf(
+					"Make %s a directory writable by the coordinator's user",
+					path,
+				),
+			)
+		}
+	}
+
+	for _, f := range dataFiles {
+		path := filepath.Join(dir, f)
+		b, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		var v interface{}
+		if err == nil {
+			err = json.Unmarshal(b, &v)
+		}
+		if err != nil {
+			r.add(
+				"datadir."+f,
+				StatusFailed,
+				fmt.Sprintf("%s is corrupt: %v", path, err),
+				fmt.Sprintf("Restore %s from a backup, or remove it", path),
+			)
+		}
+	}
+
+	crt := filepath.Join(dir, "certs", "server.crt")
+	key := filepath.Join(dir, "certs", "server.key")
+	if _, err := os.Stat(crt); err == nil {
+		if _, err := tls.LoadX509KeyPair(crt, key); err != nil {
+			r.add(
+				"datadir.certs",
+				StatusFailed,
+				fmt.Sprintf("Unable to load the HTTPS certificate: %v", err),
+				fmt.Sprintf(
+					"Fix the key pair, or remove %s and %s to generate a "+
+						"self-signed certificate",
+					crt,
+					key,
+				),
+			)
+		}
+	}
+
+	if !r.failed("datadir") {
+		r.add("datadir", StatusOK, fmt.Sprintf("%s is usable", dir), "")
+	}
+}
+
+// checkSources checks that the origin of the sources can be reached
+func checkSources(r *Report) {
+	if r.failed("env.SOURCE_PROVIDER") || r.failed("env.TRANSACTION") ||
+		r.failed("env.TARBALL") {
+		r.add(
+			"sources",
+			StatusSkipped,
+			"The source provider is not configured correctly",
+			"",
+		)
+		return
+	}
+	if err := sources.CheckConnectivity(); err != nil {
+		if sources.HasLocalClone() {
+			r.add(
+				"sources",
+				StatusWarning,
+				fmt.Sprintf("%v, serving the sources from the local clone", err),
+				"Check the network connectivity to the origin, or configure "+
+					"TRANSACTION_PROCESSOR_MIRROR_URLS",
+			)
+			return
+		}
+		r.add(
+			"sources",
+			StatusFailed,
+			err.Error(),
+			"Check the network connectivity to the origin and that "+
+				"TRANSACTION_PROCESSOR_ACCESS_TOKEN (or TARBALL_SOURCES_TOKEN) "+
+				"grants read access",
+		)
+		return
+	}
+	r.add("sources", StatusOK, "The origin of the sources is reachable", "")
+}
+
+// checkAWS checks the AWS permissions the coordinator relies on
+func checkAWS(r *Report, awsm *awsmgr.AwsManager) {
+	if r.failed("env.AWS_REGION") || r.failed("env.OUTPUTS_S3_BUCKET") ||
+		r.failed("env.BINARIES_S3_BUCKET") {
+		r.add("aws", StatusSkipped, "AWS is not configured correctly", "")
+		return
+	}
+	failed := false
+	for _, c := range awsm.CheckPermissions() {
+		if c.Err == nil {
+			continue
+		}
+		failed = true
+		resource := ""
+		if c.Resource != "" {
+			resource = " on " + c.Resource
+		}
+		r.add(
+			"aws."+c.Action,
+			StatusFailed,
+			fmt.Sprintf("Not permitted%s: %v", resource, c.Err),
+			fmt.Sprintf(
+				"Grant %s%s to the coordinator's IAM role",
+				c.Action,
+				resource,
+			),
+		)
+	}
+	if !failed {
+		r.add("aws", StatusOK, "All required AWS actions are permitted", "")
+	}
+}
@@ -0,0 +1,151 @@
+package preflight
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/coordinator/awsmgr"
+)
+
+// Status is the outcome of a preflight check
+type Status string
+
+const (
+	StatusOK      Status = "ok"
+	StatusWarning Status = "warning"
+	StatusFailed  Status = "failed"
+	StatusSkipped Status = "skipped"
+)
+
+// Result is the outcome of a single preflight check, along with what to do
+// about it if it didn't pass
+type Result struct {
+	Check   string `json:"check"`
+	Status  Status `json:"status"`
+	Message string `json:"message"`
+	Remedy  string `json:"remedy,omitempty"`
+}
+
+// Report is the consolidated outcome of all preflight checks
+type Report struct {
+	Results  []Result      `json:"results"`
+	Started  time.Time     `json:"started"`
+	Duration time.Duration `json:"duration"`
+}
+
+// Failed returns true if any of the checks failed
+func (r *Report) Failed() bool {
+	for _, res := range r.Results {
+		if res.Status == StatusFailed {
+			return true
+		}
+	}
+	return false
+}
+
+// String formats the report as the diagnostic logged on startup, with the
+// remedies of the checks that didn't pass
+func (r *Report) String() string {
+	var buf bytes.Buffer
+	counts := map[Status]int{}
+	for _, res := range r.Results {
+		counts[res.Status]++
+	}
+	fmt.Fprintf(
+		&buf,
+		"Preflight checks: %d ok, %d warning(s), %d failed, %d skipped (%v)\n",
+		counts[StatusOK],
+		counts[StatusWarning],
+		counts[StatusFailed],
+		counts[StatusSkipped],
+		r.Duration.Round(time.Millisecond),
+	)
+	for _, res := range r.Results {
+		fmt.Fprintf(
+			&buf,
+			"  [%-7s] %-28s %s\n",
+			strings.ToUpper(string(res.Status)),
+			res.Check,
+			res.Message,
+		)
+		if res.Remedy != "" && res.Status != StatusOK {
+			fmt.Fprintf(&buf, "  %-9s  %-28s -> %s\n", "", "", res.Remedy)
+		}
+	}
+	return buf.String()
+}
+
+// check is a named group of preflight checks. Checks can be skipped by
+// listing their names in PREFLIGHT_SKIP
+type check struct {
+	name string
+	run  func(r *Report)
+}
+
+func (r *Report) add(check string, status Status, message, remedy string) {
+	r.Results = append(r.Results, Result{
+		Check:   check,
+		Status:  status,
+		Message: message,
+		Remedy:  remedy,
+	})
+}
+
+// skippedChecks returns the names of the checks listed in the comma separated
+// PREFLIGHT_SKIP environment variable
+func skippedChecks() map[string]bool {
+	ret := map[string]bool{}
+	for _, c := range strings.Split(os.Getenv("PREFLIGHT_SKIP"), ",") {
+		c = strings.TrimSpace(c)
+		if c != "" {
+			ret[c] = true
+		}
+	}
+	return ret
+}
+
+// WarnOnly returns true if PREFLIGHT_WARN_ONLY is set, in which case the
+// coordinator starts even if preflight checks failed
+func WarnOnly() bool {
+	return os.Getenv("PREFLIGHT_WARN_ONLY") == "1"
+}
+
+// Run executes the preflight checks of the coordinator: the configuration in
+// the environment, the layout and write access of the data directory, the
+// connectivity to the origin of the sources and the AWS permissions. The
+// connectivity and AWS checks are only run if the configuration they depend
+// on passed. The checks run before the other components of the coordinator
+// are created, such that those don't fail on the configuration first
+func Run(awsm *awsmgr.AwsManager) *Report {
+	r := &Report{Results: []Result{}, Started: time.Now()}
+	skip := skippedChecks()
+	checks := []check{
+		{"env", checkEnvironment},
+		{"datadir", checkDataDir},
+		{"sources", checkSources},
+		{"aws", func(r *Report) { checkAWS(r, awsm) }},
+	}
+	for _, c := range checks {
+		if skip[c.name] {
+			r.add(c.name, StatusSkipped, "Skipped by PREFLIGHT_SKIP", "")
+			continue
+		}
+		c.run(r)
+	}
+	r.Duration = time.Since(r.Started)
+	return r
+}
+
+// failed returns true if any check whose name has the given prefix failed
+func (r *Report) failed(prefix string) bool {
+	for _, res := range r.Results {
+		if strings.HasPrefix(res.Check, prefix) &&
+			res.Status == StatusFailed {
+			return true
+		}
+	}
+	return false
+}
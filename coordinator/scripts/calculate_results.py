@@ -143,6 +143,55 @@ def process_lats(lats):
     pct = np.percentile(lats, [99,99.999])
     return [mean, pct[0], pct[1]]
 
+# The periods the load generators were paused, passed as comma separated
+# `<paused>:<resumed>` unix nanosecond pairs. These are left out of the
+# throughput and latency timelines
+pauses = []
+if 'PAUSES' in environ and environ['PAUSES'] != '':
+    for interval in environ['PAUSES'].split(','):
+        paused, resumed = interval.split(':')
+        pauses.append((np.datetime64(int(paused), 'ns').astype(datetime.datetime),
+                       np.datetime64(int(resumed), 'ns').astype(datetime.datetime)))
+
+def is_paused(dt):
+    for paused, resumed in pauses:
+        if paused <= dt < resumed:
+            return True
+    return False
+
+# The parsers for the sample files, passed as the JSON array of
+# `{"filePrefix": ..., "format": ...}` the architecture of the test run
+# declares in its manifest, followed by the built-in ones. The first parser
+# whose prefix the name of a file contains determines its format
+sample_parsers = [
+    {"filePrefix": "tx_samples_", "format": "tx"},
+    {"filePrefix": "tp_samples", "format": "blockThroughput"},
+    {"filePrefix": "latency_samples_", "format": "latency"},
+]
+if 'SAMPLE_FILES' in environ and environ['SAMPLE_FILES'] != '':
+    sample_parsers = json.loads(environ['SAMPLE_FILES'])
+
+def sample_parser(file):
+    if file.endswith('.hdf5'):
+        return None
+    for parser in sample_parsers:
+        if parser['filePrefix'] in file:
+            return parser
+    return None
+
+def sample_format(file):
+    parser = sample_parser(file)
+    if parser is None:
+        return None
+    return parser['format']
+
+def sample_title(file):
+    parser = sample_parser(file)
+    idx = file.find(parser['filePrefix'])
+    if idx > 0:
+        return file[:idx].rstrip('-_')
+    return file
+
 lats = []
 
 output_files = [f for f in listdir('outputs') if isfile(join("outputs", f))]
@@ -150,10 +199,10 @@ output_files = [f for f in listdir('outputs') if isfile(join("outputs", f))]
 archiver_based = False
 two_phase = False
 for output_file in output_files:
-    if 'tx_samples' in output_file:
+    if sample_format(output_file) == 'tx':
         two_phase = True
         archiver_based = False
-    if 'tp_samples' in output_file and not two_phase:
+    if sample_format(output_file) == 'blockThroughput' and not two_phase:
         archiver_based = True
 
 block_time_ms = 1000
@@ -182,14 +231,14 @@ elbow_lat99 = []
 elbow_lat99999 = []
 if two_phase:
     hdf5_files = ['outputs/' + x for x in listdir('outputs') \
-             if 'tx_samples' in x and 'hdf5' in x]
+             if x.endswith('.hdf5') and sample_format(x[:-5]) == 'tx']
 
     for hdf in hdf5_files:
         remove(hdf)
 
     files = ['outputs/' + x for x in listdir('outputs') \
-             if 'tx_samples' in x and 'hdf5' not in x]
-    exports = 0
+             if sample_format(x) == 'tx']
+    exported = []
     for f in files:
         p = pandas.read_csv(f, sep=' ', on_bad_lines='warn', names=['time', 'latency'], encoding="ISO-8859-1")
         if p.dtypes['time'] != np.int64:
@@ -199,12 +248,12 @@ if two_phase:
         if p.size > 0:
             v = vaex.from_pandas(p, copy_index=False)
             v.export_hdf5(f + '.hdf5')
-            exports += 1
+            exported.append(f + '.hdf5')
         else:
             print('{} has no rows', f)
 
-    if exports > 0:
-        df = vaex.open('outputs/*-tx_samples_*.txt.hdf5')
+    if len(exported) > 0:
+        df = vaex.open_many(exported)
         df['lats'] = df.latency // 10**6
         df['latsS'] = df.lats / 10**3
         df['pDate'] = df.time.values.astype('datetime64[ns]')
@@ -224,7 +273,10 @@ if two_phase:
         idx = 0
         while current < end:
             dt = tps_its[0][1][idx].astype(datetime.datetime)
-            if dt != current:
+            if is_paused(current):
+                if dt == current:
+                    idx += 1
+            elif dt != current:
                 tps.append(0)
                 lat_mean.append(0)
                 lat_99.append(0)
@@ -328,11 +380,14 @@ if two_phase:
                 elbow_lat99999.append(prev_lat99999)
 
 if archiver_based:
+    # The archiver samples have no timestamps, so pauses can't be excluded
+    # from them. Their blocks are empty while paused, which TRIM_ZEROES only
+    # removes at the start and end of the run
     for output_file in output_files:
-        if output_file.find('tp_samples') > -1:
+        if sample_format(output_file) == 'blockThroughput':
             filetps = read_throughput_sample_file(output_file)
-            tps_lines.append({"tps":filetps, "freq": (block_time_ms/1000), "title": output_file.replace("-tp_samples.txt","")})
-        elif not two_phase and output_file.find('latency_samples_') > -1:
+            tps_lines.append({"tps":filetps, "freq": (block_time_ms/1000), "title": sample_title(output_file)})
+        elif not two_phase and sample_format(output_file) == 'latency':
             filelats = read_latency_sample_file(output_file)
             lats.extend(filelats)
 
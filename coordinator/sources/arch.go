@@ -0,0 +1,122 @@
+package sources
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+)
+
+// DefaultTargetArch is the architecture binaries are built for unless
+// requested otherwise. Archives for this architecture carry no architecture
+// suffix, for compatibility with the archives built before cross-compilation
+// was supported
+const DefaultTargetArch = "amd64"
+
+// crossCompilers are the GNU toolchains used to cross-compile for the
+// supported architectures when the coordinator runs on a different one
+var crossCompilers = map[string]struct {
+	prefix    string
+	processor string
+}{
+	"amd64": {prefix: "x86_64-linux-gnu", processor: "x86_64"},
+	"arm64": {prefix: "aarch64-linux-gnu", processor: "aarch64"},
+}
+
+// NormalizeTargetArch maps the architecture names used by the various tools
+// (uname, Go, AWS) onto the Go names used for the binaries archives. An empty
+// architecture is the default architecture
+func NormalizeTargetArch(arch string) string {
+	switch strings.ToLower(arch) {
+	case "", "x86_64", "x86-64", "amd64":
+		return DefaultTargetArch
+	case "aarch64", "arm64":
+		return "arm64"
+	}
+	return strings.ToLower(arch)
+}
+
+// ValidateTargetArch returns an error if binaries cannot be built for the
+// given architecture
+func ValidateTargetArch(arch string) error {
+	if _, ok := crossCompilers[NormalizeTargetArch(arch)]; !ok {
+		return fmt.Errorf("Unsupported target architecture %s", arch)
+	}
+	return nil
+}
+
+// archSuffix returns the suffix of the archive names for the given
+// architecture
+func archSuffix(arch string) string {
+	arch = NormalizeTargetArch(arch)
+	if arch == DefaultTargetArch {
+		return ""
+	}
+	return "-" + arch
+}
+
+// toolchainsDir returns the directory the generated CMake toolchain files are
+// written to
+func toolchainsDir() string {
+	return filepath.Join(common.DataDir(), "toolchains")
+}
+
+// crossToolchainFile returns the CMake toolchain file to build for the given
+// architecture with, or an empty string if the coordinator builds for that
+// architecture natively. CROSS_TOOLCHAIN_FILE_<ARCH> (for instance
+// CROSS_TOOLCHAIN_FILE_ARM64) can point to a custom toolchain file, otherwise
+// one using the GNU cross-compilers from the distribution is generated
+func crossToolchainFile(arch string) (string, error) {
+	arch = NormalizeTargetArch(arch)
+	if arch == runtime.GOARCH {
+		return "", nil
+	}
+	if f := os.Getenv("CROSS_TOOLCHAIN_FILE_" + strings.ToUpper(arch)); f != "" {
+		return f, nil
+	}
+	cc, ok := crossCompilers[arch]
+	if !ok {
+		return "", fmt.Errorf("Unsupported target architecture %s", arch)
+	}
+
+	err := os.MkdirAll(toolchainsDir(), 0755)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(toolchainsDir(), fmt.Sprintf("%s.cmake", arch))
+	toolchain := fmt.Sprintf(`set(CMAKE_SYSTEM_NAME Linux)
+set(CMAKE_SYSTEM_PROCESSOR %[2]s)
+set(CMAKE_C_COMPILER %[1]s-gcc)
+set(CMAKE_CXX_COMPILER %[1]s-g++)
+set(CMAKE_FIND_ROOT_PATH /usr/%[1]s)
+set(CMAKE_FIND_ROOT_PATH_MODE_PROGRAM NEVER)
+set(CMAKE_FIND_ROOT_PATH_MODE_LIBRARY BOTH)
+set(CMAKE_FIND_ROOT_PATH_MODE_INCLUDE BOTH)
+set(CMAKE_FIND_ROOT_PATH_MODE_PACKAGE BOTH)
+`, cc.prefix, cc.processor)
+	err = ioutil.WriteFile(path, []byte(toolchain), 0644)
+	if err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// targetArchEnv returns the environment variables that make the setup and
+// build scripts target the given architecture. CMake picks up the toolchain
+// file from the environment, like the compiler launcher for ccache
+func targetArchEnv(arch string) ([]string, error) {
+	arch = NormalizeTargetArch(arch)
+	env := []string{"TARGET_ARCH=" + arch}
+	toolchain, err := crossToolchainFile(arch)
+	if err != nil {
+		return nil, err
+	}
+	if toolchain != "" {
+		env = append(env, "CMAKE_TOOLCHAIN_FILE="+toolchain)
+	}
+	return env, nil
+}
@@ -0,0 +1,120 @@
+package sources
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+)
+
+// unusedCMakeVariables is the warning CMake prints when variables set on the
+// command line are not used by the project
+const unusedCMakeVariables = "Manually-specified variables were not used"
+
+// configureBuild sets the CMake cache variables of the build configuration in
+// the build directory of the worktree. The build script configures the build
+// directory again with its own flags, which leaves the cache variables it
+// doesn't set untouched. Fails if the project doesn't use one of the
+// variables
+func configureBuild(
+	dir string,
+	env []string,
+	cfg *common.BuildConfig,
+) error {
+	if len(cfg.CMakeFlags) == 0 {
+		return nil
+	}
+	args := append(
+		[]string{"-S", dir, "-B", filepath.Join(dir, "build")},
+		cfg.CMakeArgs()...,
+	)
+	cmd := exec.Command("cmake", args...)
+	cmd.Dir = dir
+	cmd.Env = env
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return newBuildError("Configure", err, out)
+	}
+	unused := unusedCMakeVariableNames(out)
+	if len(unused) > 0 {
+		return fmt.Errorf(
+			"The build does not support CMake variable(s) %s",
+			strings.Join(unused, ", "),
+		)
+	}
+	return nil
+}
+
+// unusedCMakeVariableNames returns the variables CMake reported as not used by
+// the project in its output
+func unusedCMakeVariableNames(out []byte) []string {
+	ret := []string{}
+	idx := bytes.Index(out, []byte(unusedCMakeVariables))
+	if idx == -1 {
+		return ret
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(out[idx:]))
+	// Skip the line with the warning itself, the names follow it indented
+	// and are ended by the first line that isn't
+	scanner.Scan()
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			if len(ret) > 0 {
+				break
+			}
+			continue
+		}
+		if !strings.HasPrefix(line, " ") {
+			break
+		}
+		ret = append(ret, strings.TrimSpace(line))
+	}
+	return ret
+}
+
+// checkBuildConfig checks that the CMake cache of the build directory holds
+// the values of the build configuration's variables after the build, such
+// that binaries the build script compiled with different values are never
+// archived as the configuration's
+func checkBuildConfig(buildDir string, cfg *common.BuildConfig) error {
+	if cfg.Empty() || len(cfg.CMakeFlags) == 0 {
+		return nil
+	}
+	f, err := os.Open(filepath.Join(buildDir, "CMakeCache.txt"))
+	if err != nil {
+		return fmt.Errorf("Unable to read the CMake cache: %v", err)
+	}
+	defer f.Close()
+	cache := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Entries are formatted as <name>:<type>=<value>
+		line := scanner.Text()
+		eq := strings.Index(line, "=")
+		colon := strings.Index(line, ":")
+		if eq == -1 || colon == -1 || colon > eq {
+			continue
+		}
+		cache[line[:colon]] = line[eq+1:]
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("Unable to read the CMake cache: %v", err)
+	}
+	for name, value := range cfg.CMakeFlags {
+		if cached, ok := cache[name]; !ok || cached != value {
+			return fmt.Errorf(
+				"The build script did not compile with %s=%s (got %q)",
+				name,
+				value,
+				cached,
+			)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+package sources
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// maxBuildFailures is the number of build failures kept. When exceeded, the
+// oldest failures and their output are removed
+const maxBuildFailures = 1000
+
+// BuildError is returned by Compile when one of the build steps fails
+type BuildError struct {
+	// The step that failed, such as "Build" or "Dependency installation"
+	Step string
+	// The exit code of the step's script, or -1 if it didn't exit normally
+	ExitCode int
+	// The combined standard output and error of the step
+	Output []byte
+	Err    error
+}
+
+func (e *BuildError) Error() string {
+	return fmt.Sprintf("%s failed: %v\n\n%v", e.Step, e.Err, string(e.Output))
+}
+
+func newBuildError(step string, err error, out []byte) *BuildError {
+	exitCode := -1
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		exitCode = exitErr.ExitCode()
+	}
+	return &BuildError{Step: step, ExitCode: exitCode, Output: out, Err: err}
+}
+
+// BuildFailure is a failed compilation of a commit
+type BuildFailure struct {
+	ID         string    `json:"id"`
+	CommitHash string    `json:"commit"`
+	Profiling  bool      `json:"profiling"`
+	Arch       string    `json:"arch"`
+	Failed     time.Time `json:"failed"`
+	// Key of the test run's build configuration, empty for the default one
+	BuildConfig string `json:"buildConfig,omitempty"`
+	Step        string `json:"step"`
+	ExitCode    int    `json:"exitCode"`
+	Error       string `json:"error"`
+	OutputSize  int    `json:"outputSize"`
+	// Set when the same commit and variant compiled successfully after this
+	// failure, meaning the failure was transient
+	SucceededLater bool `json:"succeededLater"`
+}
+
+// BuildFailureQuery selects build failures. Zero values don't filter
+type BuildFailureQuery struct {
+	CommitHash string
+	Arch       string
+	Since      time.Time
+	// Leave out failures of commits that compiled successfully afterwards
+	ExcludeTransient bool
+	Limit            int
+}
+
+// buildFailuresDir returns the directory the build failures and their output
+// are persisted in
+func buildFailuresDir() string {
+	return filepath.Join(common.DataDir(), "build-failures")
+}
+
+func buildFailuresIndexPath() string {
+	return filepath.Join(buildFailuresDir(), "index.json")
+}
+
+func buildFailureOutputPath(id string) string {
+	return filepath.Join(buildFailuresDir(), fmt.Sprintf("%s.log", id))
+}
+
+// loadBuildFailures reads the build failures from disk. Must be called with
+// the buildFailuresLock held
+func (s *SourcesManager) loadBuildFailures() {
+	if s.buildFailures != nil {
+		return
+	}
+	s.buildFailures = []*BuildFailure{}
+	b, err := ioutil.ReadFile(buildFailuresIndexPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logging.Warnf("Unable to read build failures: %v", err)
+		}
+		return
+	}
+	err = json.Unmarshal(b, &s.buildFailures)
+	if err != nil {
+		logging.Warnf("Unable to parse build failures: %v", err)
+		s.buildFailures = []*BuildFailure{}
+	}
+}
+
+// saveBuildFailures writes the build failures to disk. Must be called with
+// the buildFailuresLock held
+func (s *SourcesManager) saveBuildFailures() error {
+	b, err := json.Marshal(s.buildFailures)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(buildFailuresIndexPath(), b, 0644)
+}
+
+// recordBuildResult records the outcome of a compilation. Failures are added
+// to the build failures with their full output, successes mark the earlier
+// failures of the same commit and variant as transient
+func (s *SourcesManager) recordBuildResult(
+	hash string,
+	profilingOrDebugging bool,
+	arch string,
+	buildConfig string,
+	buildErr error,
+) {
+	s.buildFailuresLock.Lock()
+	defer s.buildFailuresLock.Unlock()
+	s.loadBuildFailures()
+
+	if buildErr == nil {
+		changed := false
+		for _, f := range s.buildFailures {
+			if f.CommitHash == hash && f.Profiling == profilingOrDebugging &&
+				f.Arch == arch && f.BuildConfig == buildConfig &&
+				!f.SucceededLater {
+				f.SucceededLater = true
+				changed = true
+			}
+		}
+		if changed {
+			err := s.saveBuildFailures()
+			if err != nil {
+				logging.Warnf("Unable to save build failures: %v", err)
+			}
+		}
+		return
+	}
+
+	id, err := common.RandomID(12)
+	if err != nil {
+		logging.Warnf("Unable to record build failure: %v", err)
+		return
+	}
+	f := &BuildFailure{
+		ID:          id,
+		CommitHash:  hash,
+		Profiling:   profilingOrDebugging,
+		Arch:        arch,
+		BuildConfig: buildConfig,
+		Failed:      time.Now(),
+		Step:        "Compilation",
+		ExitCode:    -1,
+		Error:       buildErr.Error(),
+	}
+	output := []byte(buildErr.Error())
+	var be *BuildError
+	if errors.As(buildErr, &be) {
+		f.Step = be.Step
+		f.ExitCode = be.ExitCode
+		f.Error = be.Err.Error()
+		output = be.Output
+	}
+	f.OutputSize = len(output)
+
+	err = os.MkdirAll(buildFailuresDir(), 0755)
+	if err == nil {
+		err = ioutil.WriteFile(buildFailureOutputPath(id), output, 0644)
+	}
+	if err != nil {
+		logging.Warnf("Unable to write build failure output: %v", err)
+	}
+
+	// Most recent first
+	s.buildFailures = append([]*BuildFailure{f}, s.buildFailures...)
+	if len(s.buildFailures) > maxBuildFailures {
+		for _, old := range s.buildFailures[maxBuildFailures:] {
+			os.Remove(buildFailureOutputPath(old.ID))
+		}
+		s.buildFailures = s.buildFailures[:maxBuildFailures]
+	}
+	err = s.saveBuildFailures()
+	if err != nil {
+		logging.Warnf("Unable to save build failures: %v", err)
+	}
+}
+
+// BuildFailures returns the build failures matching the query, most recent
+// first
+func (s *SourcesManager) BuildFailures(q BuildFailureQuery) []BuildFailure {
+	s.buildFailuresLock.Lock()
+	defer s.buildFailuresLock.Unlock()
+	s.loadBuildFailures()
+	ret := []BuildFailure{}
+	for _, f := range s.buildFailures {
+		if q.CommitHash != "" && f.CommitHash != q.CommitHash {
+			continue
+		}
+		if q.Arch != "" && f.Arch != NormalizeTargetArch(q.Arch) {
+			continue
+		}
+		if !q.Since.IsZero() && f.Failed.Before(q.Since) {
+			continue
+		}
+		if q.ExcludeTransient && f.SucceededLater {
+			continue
+		}
+		ret = append(ret, *f)
+		if q.Limit > 0 && len(ret) == q.Limit {
+			break
+		}
+	}
+	return ret
+}
+
+// BuildFailureOutput returns the full output of the build step that failed
+func (s *SourcesManager) BuildFailureOutput(id string) ([]byte, error) {
+	s.buildFailuresLock.Lock()
+	defer s.buildFailuresLock.Unlock()
+	s.loadBuildFailures()
+	for _, f := range s.buildFailures {
+		if f.ID == id {
+			return ioutil.ReadFile(buildFailureOutputPath(id))
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+// KnownBroken returns the most recent failure of the commit that was not
+// followed by a successful compilation of the same variant. Failures with a
+// custom build configuration don't mean the commit itself is broken
+func (s *SourcesManager) KnownBroken(hash string) (BuildFailure, bool) {
+	for _, f := range s.BuildFailures(BuildFailureQuery{
+		CommitHash:       hash,
+		ExcludeTransient: true,
+	}) {
+		if f.BuildConfig == "" {
+			return f, true
+		}
+	}
+	return BuildFailure{}, false
+}
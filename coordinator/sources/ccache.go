@@ -0,0 +1,81 @@
+package sources
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// ccacheDir returns the directory in which the compiler cache is persisted
+// across builds
+func ccacheDir() string {
+	return filepath.Join(common.DataDir(), "ccache")
+}
+
+// ccacheEnabledFromEnv reads whether builds should use ccache. It is enabled by
+// default and can be turned off by setting DISABLE_CCACHE=1
+func ccacheEnabledFromEnv() bool {
+	return os.Getenv("DISABLE_CCACHE") != "1"
+}
+
+// CompilerCacheEnabled returns true if compilation uses ccache. This requires
+// ccache not to be disabled and the ccache executable to be available
+func (s *SourcesManager) CompilerCacheEnabled() bool {
+	if !s.ccacheEnabled {
+		return false
+	}
+	_, err := exec.LookPath("ccache")
+	return err == nil
+}
+
+// ccacheEnv returns the environment variables to pass into build.sh for it to
+// use ccache when building the sources checked out in baseDir. CMake picks up
+// the compiler launcher from the environment, and the base dir makes cached
+// objects reusable regardless of which worktree the sources are checked out in
+func (s *SourcesManager) ccacheEnv(baseDir string) []string {
+	if !s.CompilerCacheEnabled() {
+		return []string{}
+	}
+	err := os.MkdirAll(ccacheDir(), 0755)
+	if err != nil {
+		logging.Warnf("Unable to create ccache dir, not using ccache: %v", err)
+		return []string{}
+	}
+	env := []string{
+		"CCACHE_DIR=" + ccacheDir(),
+		"CCACHE_BASEDIR=" + baseDir,
+		"CMAKE_C_COMPILER_LAUNCHER=ccache",
+		"CMAKE_CXX_COMPILER_LAUNCHER=ccache",
+	}
+	if max := os.Getenv("CCACHE_MAXSIZE"); max != "" {
+		env = append(env, "CCACHE_MAXSIZE="+max)
+	}
+	return env
+}
+
+// CompilerCacheSize returns the size in bytes of the persisted compiler cache
+func (s *SourcesManager) CompilerCacheSize() int64 {
+	size := int64(0)
+	_ = filepath.Walk(
+		ccacheDir(),
+		func(_ string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				size += info.Size()
+			}
+			return nil
+		},
+	)
+	return size
+}
+
+// ClearCompilerCache removes the persisted compiler cache. It waits for any
+// running compilation to finish first
+func (s *SourcesManager) ClearCompilerCache() error {
+	release := s.compileQueue.acquireAll()
+	defer release()
+	logging.Infof("Clearing compiler cache")
+	return os.RemoveAll(ccacheDir())
+}
@@ -0,0 +1,210 @@
+package sources
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrCompareUnsupported is returned by CompareCommits if the source provider
+// cannot list the files changed between two revisions
+var ErrCompareUnsupported = errors.New(
+	"the source provider does not support comparing revisions",
+)
+
+// Components of the system under test that changes are classified into
+const (
+	ComponentShard       = "shard"
+	ComponentSentinel    = "sentinel"
+	ComponentCoordinator = "coordinator"
+	ComponentAtomizer    = "atomizer"
+	ComponentParsec      = "parsec"
+	ComponentSeeder      = "seeder"
+	// Code outside of the subdirectories of the components, shared by all
+	// of them
+	ComponentCommon = "common"
+	// Files that are not part of the sources, such as documentation
+	ComponentOther = "other"
+)
+
+// componentRule classifies the files under a path prefix of the sources
+type componentRule struct {
+	prefix    string
+	component string
+	// The architectures (IDs) test runs of the change should use
+	architectures []string
+}
+
+// componentRules are matched in order, so more specific prefixes go first
+var componentRules = []componentRule{
+	{"tools/shard-seeder/", ComponentSeeder, []string{"default", "2pc"}},
+	{"src/parsec/", ComponentParsec, []string{"parsec"}},
+	{"tools/bench/parsec/", ComponentParsec, []string{"parsec"}},
+	{"src/uhs/atomizer/shard/", ComponentShard, []string{"default"}},
+	{"src/uhs/twophase/locking_shard/", ComponentShard, []string{"2pc"}},
+	{"src/uhs/atomizer/sentinel/", ComponentSentinel, []string{"default"}},
+	{"src/uhs/twophase/sentinel_2pc/", ComponentSentinel, []string{"2pc"}},
+	{"src/uhs/sentinel/", ComponentSentinel, []string{"default", "2pc"}},
+	{"src/uhs/twophase/coordinator/", ComponentCoordinator, []string{"2pc"}},
+	{"src/uhs/atomizer/atomizer/", ComponentAtomizer, []string{"default"}},
+	{"src/uhs/atomizer/", ComponentAtomizer, []string{"default"}},
+	{"src/uhs/twophase/", ComponentCoordinator, []string{"2pc"}},
+	{"src/", ComponentCommon, []string{"default", "2pc", "parsec"}},
+	{"CMakeLists.txt", ComponentCommon, []string{"default", "2pc", "parsec"}},
+	{"3rdparty/", ComponentCommon, []string{"default", "2pc", "parsec"}},
+}
+
+// classifyPath returns the rule that applies to the file at path
+func classifyPath(path string) componentRule {
+	for _, r := range componentRules {
+		if strings.HasPrefix(path, r.prefix) {
+			return r
+		}
+	}
+	return componentRule{component: ComponentOther}
+}
+
+// FileChange is a file changed between two revisions
+type FileChange struct {
+	Path string `json:"path"`
+	// The previous path of renamed files
+	OldPath   string `json:"oldPath,omitempty"`
+	Additions int    `json:"additions"`
+	Deletions int    `json:"deletions"`
+	// Binary files have no line counts
+	Binary    bool   `json:"binary"`
+	Component string `json:"component"`
+}
+
+// ComponentChange is the diffstat of the files of a single component
+type ComponentChange struct {
+	Component string `json:"component"`
+	Files     int    `json:"files"`
+	Additions int    `json:"additions"`
+	Deletions int    `json:"deletions"`
+}
+
+// CommitComparison is the difference between two revisions of the sources,
+// and the test run settings suggested by it
+type CommitComparison struct {
+	From       string            `json:"from"`
+	To         string            `json:"to"`
+	Files      []FileChange      `json:"files"`
+	Additions  int               `json:"additions"`
+	Deletions  int               `json:"deletions"`
+	Components []ComponentChange `json:"components"`
+	// The architectures affected by the changed components, which test runs
+	// of the change should cover
+	SuggestedArchitectures []string `json:"suggestedArchitectures"`
+	// Set if the seeder changed, meaning the shards have to be seeded again
+	SeederChanged bool `json:"seederChanged"`
+}
+
+// CompareCommits returns the files changed between the two revisions,
+// classified by the component of the system under test they belong to
+func (s *SourcesManager) CompareCommits(
+	from, to string,
+) (*CommitComparison, error) {
+	d, ok := s.provider.(commitDiffer)
+	if !ok {
+		return nil, ErrCompareUnsupported
+	}
+	s.sourcesLock.Lock()
+	files, err := d.DiffStat(from, to)
+	s.sourcesLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &CommitComparison{
+		From:                   from,
+		To:                     to,
+		Files:                  files,
+		Components:             []ComponentChange{},
+		SuggestedArchitectures: []string{},
+	}
+	components := map[string]*ComponentChange{}
+	archs := map[string]bool{}
+	for i := range c.Files {
+		f := &c.Files[i]
+		rule := classifyPath(f.Path)
+		f.Component = rule.component
+		// Files moved out of a component change it as well
+		rules := []componentRule{rule}
+		if f.OldPath != "" {
+			rules = append(rules, classifyPath(f.OldPath))
+		}
+		for _, r := range rules {
+			for _, a := range r.architectures {
+				archs[a] = true
+			}
+			if r.component == ComponentSeeder {
+				c.SeederChanged = true
+			}
+		}
+		cc, ok := components[f.Component]
+		if !ok {
+			cc = &ComponentChange{Component: f.Component}
+			components[f.Component] = cc
+		}
+		cc.Files++
+		cc.Additions += f.Additions
+		cc.Deletions += f.Deletions
+		c.Additions += f.Additions
+		c.Deletions += f.Deletions
+	}
+	for _, cc := range components {
+		c.Components = append(c.Components, *cc)
+	}
+	sort.Slice(c.Components, func(i, j int) bool {
+		return c.Components[i].Component < c.Components[j].Component
+	})
+	for a := range archs {
+		c.SuggestedArchitectures = append(c.SuggestedArchitectures, a)
+	}
+	sort.Strings(c.SuggestedArchitectures)
+	return c, nil
+}
+
+// parseNumstat parses the output of git diff --numstat -z. Every file is
+// formatted as `<additions>\t<deletions>\t<path>\0`, or for renames as
+// `<additions>\t<deletions>\t\0<old path>\0<new path>\0`. Binary files have
+// dashes instead of line counts
+func parseNumstat(out string) ([]FileChange, error) {
+	files := []FileChange{}
+	fields := strings.Split(out, "\x00")
+	for i := 0; i < len(fields); i++ {
+		if fields[i] == "" {
+			continue
+		}
+		parts := strings.SplitN(fields[i], "\t", 3)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("Unexpected diffstat line: %s", fields[i])
+		}
+		f := FileChange{Path: parts[2]}
+		if parts[0] == "-" && parts[1] == "-" {
+			f.Binary = true
+		} else {
+			var err error
+			f.Additions, err = strconv.Atoi(parts[0])
+			if err != nil {
+				return nil, err
+			}
+			f.Deletions, err = strconv.Atoi(parts[1])
+			if err != nil {
+				return nil, err
+			}
+		}
+		if f.Path == "" {
+			if i+2 >= len(fields) {
+				return nil, fmt.Errorf("Truncated rename in diffstat")
+			}
+			f.OldPath, f.Path = fields[i+1], fields[i+2]
+			i += 2
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
@@ -0,0 +1,141 @@
+package sources
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+)
+
+// CompilePhase is the step of the compilation that is currently executing.
+// The checkout includes updating the submodules of the sources
+type CompilePhase string
+
+const CompilePhaseQueued CompilePhase = "queued"
+const CompilePhaseCheckout CompilePhase = "checkout"
+const CompilePhaseSetup CompilePhase = "setup"
+const CompilePhaseBuild CompilePhase = "build"
+const CompilePhasePackage CompilePhase = "package"
+const CompilePhaseArchive CompilePhase = "archive"
+const CompilePhaseDistribute CompilePhase = "distribute"
+const CompilePhaseDone CompilePhase = "done"
+
+// CompileProgress is reported while compiling a commit, archiving its sources
+// or distributing its binaries to the agents. Percent is the estimated overall
+// progress, and Line is the most recent line of output of the build scripts
+// (if any). Bytes and TotalBytes are reported for the phases that archive or
+// transfer files, and AgentID for the progress of a single agent
+type CompileProgress struct {
+	Phase      CompilePhase `json:"phase"`
+	Percent    float64      `json:"percent"`
+	Line       string       `json:"line,omitempty"`
+	Bytes      int64        `json:"bytes,omitempty"`
+	TotalBytes int64        `json:"totalBytes,omitempty"`
+	AgentID    int32        `json:"agentID,omitempty"`
+}
+
+// The range of the overall progress that is covered by the build script. The
+// progress within the build is estimated from the build tool's output
+const buildProgressStart = 50
+const buildProgressEnd = 90
+
+// packageProgressEnd is the overall progress once the binaries are archived.
+// The remainder covers writing their checksums
+const packageProgressEnd = 99
+
+// archiveProgressInterval is the minimum interval between progress reports
+// while archiving, which calls back for every file archived
+const archiveProgressInterval = time.Second
+
+// ninjaProgressRegex matches the status prefix ninja prints for every build
+// edge, for instance "[12/345] Building CXX object ..."
+var ninjaProgressRegex = regexp.MustCompile(`^\[(\d+)/(\d+)\]`)
+
+// makeProgressRegex matches the percentage prefix of CMake generated
+// makefiles, for instance "[ 45%] Building CXX object ..."
+var makeProgressRegex = regexp.MustCompile(`^\[\s*(\d+)%\]`)
+
+// buildOutputPercent estimates the progress of the build (0-100) from a line
+// of cmake/ninja/make output. Returns false if the line contains no progress
+// information
+func buildOutputPercent(line string) (float64, bool) {
+	if m := ninjaProgressRegex.FindStringSubmatch(line); m != nil {
+		done, err1 := strconv.Atoi(m[1])
+		total, err2 := strconv.Atoi(m[2])
+		if err1 != nil || err2 != nil || total == 0 {
+			return 0, false
+		}
+		return float64(done) * 100 / float64(total), true
+	}
+	if m := makeProgressRegex.FindStringSubmatch(line); m != nil {
+		pct, err := strconv.Atoi(m[1])
+		if err != nil {
+			return 0, false
+		}
+		return float64(pct), true
+	}
+	return 0, false
+}
+
+// runWithOutputLines runs the command and calls onLine for every line it
+// writes to stdout or stderr. The combined output is returned as well, like
+// exec.Cmd's CombinedOutput
+func runWithOutputLines(cmd *exec.Cmd, onLine func(string)) ([]byte, error) {
+	pr, pw := io.Pipe()
+	cmd.Stdout = pw
+	cmd.Stderr = pw
+	var out bytes.Buffer
+	scanDone := make(chan bool, 1)
+	go func() {
+		scanner := bufio.NewScanner(io.TeeReader(pr, &out))
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			onLine(scanner.Text())
+		}
+		// Keep draining the output if the scanner gave up on an overly long
+		// line, so the command doesn't block on writing
+		_, _ = io.Copy(ioutil.Discard, io.TeeReader(pr, &out))
+		scanDone <- true
+	}()
+
+	err := cmd.Start()
+	if err == nil {
+		err = cmd.Wait()
+	}
+	pw.Close()
+	<-scanDone
+	return out.Bytes(), err
+}
+
+// archiveProgress returns an ArchiveProgressFunc that reports the bytes
+// archived in the given phase, with the overall progress going from start to
+// end as the archive is created
+func archiveProgress(
+	phase CompilePhase,
+	start, end float64,
+	report func(CompileProgress),
+) common.ArchiveProgressFunc {
+	last := time.Time{}
+	return func(done, total int64) {
+		if done < total && time.Since(last) < archiveProgressInterval {
+			return
+		}
+		last = time.Now()
+		percent := end
+		if total > 0 {
+			percent = start + (end-start)*float64(done)/float64(total)
+		}
+		report(CompileProgress{
+			Phase:      phase,
+			Percent:    percent,
+			Bytes:      done,
+			TotalBytes: total,
+		})
+	}
+}
@@ -0,0 +1,205 @@
+package sources
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultCompileConcurrency is the number of commits that can be compiled at
+// the same time when COMPILE_CONCURRENCY is not set
+const defaultCompileConcurrency = 2
+
+// compileConcurrencyFromEnv reads the number of compile workers from the
+// COMPILE_CONCURRENCY environment variable
+func compileConcurrencyFromEnv() int {
+	n, err := strconv.Atoi(os.Getenv("COMPILE_CONCURRENCY"))
+	if err != nil || n <= 0 {
+		return defaultCompileConcurrency
+	}
+	return n
+}
+
+// worktreesDir returns the directory in which the git worktrees of the compile
+// workers are created
+func worktreesDir() string {
+	return filepath.Join(sourcesParentDir(), "worktrees")
+}
+
+// CompileJobStatus is the state of a compilation in the compile queue
+type CompileJobStatus string
+
+const CompileJobQueued CompileJobStatus = "queued"
+const CompileJobCompiling CompileJobStatus = "compiling"
+
+// CompileJob describes a compilation that is waiting for or being executed by
+// a compile worker
+type CompileJob struct {
+	Hash      string           `json:"hash"`
+	Profiling bool             `json:"profiling"`
+	Arch      string           `json:"arch"`
+	Status    CompileJobStatus `json:"status"`
+	// The worker compiling the commit, or -1 while the job is queued
+	Worker   int          `json:"worker"`
+	Enqueued time.Time    `json:"enqueued"`
+	Started  time.Time    `json:"started"`
+	Phase    CompilePhase `json:"phase"`
+	Progress float64      `json:"progress"`
+}
+
+// CompileQueueStatus describes the state of the compile queue
+type CompileQueueStatus struct {
+	Concurrency int          `json:"concurrency"`
+	Jobs        []CompileJob `json:"jobs"`
+}
+
+// compileWorker owns an isolated git worktree in which it checks out and
+// builds commits
+type compileWorker struct {
+	id  int
+	dir string
+}
+
+// inFlightCompile allows callers requesting a compilation that is already
+// queued or running to wait for its outcome
+type inFlightCompile struct {
+	done chan struct{}
+	err  error
+}
+
+// compileQueue hands out the compile workers to compilations in order of
+// arrival and keeps track of the jobs for reporting their status
+type compileQueue struct {
+	concurrency int
+	workers     chan *compileWorker
+	jobs        []*CompileJob
+	// In-flight compilations keyed by the path of their binaries archive
+	inFlight map[string]*inFlightCompile
+	lock     sync.Mutex
+	// Held while taking all workers from the pool, such that two callers
+	// can't each end up with part of the pool and wait for each other
+	acquireAllLock sync.Mutex
+}
+
+func newCompileQueue(concurrency int) *compileQueue {
+	q := &compileQueue{
+		concurrency: concurrency,
+		workers:     make(chan *compileWorker, concurrency),
+		jobs:        []*CompileJob{},
+		inFlight:    map[string]*inFlightCompile{},
+		lock:        sync.Mutex{},
+	}
+	for i := 0; i < concurrency; i++ {
+		q.workers <- &compileWorker{
+			id:  i,
+			dir: filepath.Join(worktreesDir(), fmt.Sprintf("worker-%d", i)),
+		}
+	}
+	return q
+}
+
+// enqueue adds a compilation to the queue. If a compilation producing the same
+// archive is already in flight, that one is returned and existing is true
+func (q *compileQueue) enqueue(
+	path, hash string,
+	profiling bool,
+	arch string,
+) (job *CompileJob, inFlight *inFlightCompile, existing bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if f, ok := q.inFlight[path]; ok {
+		return nil, f, true
+	}
+	job = &CompileJob{
+		Hash:      hash,
+		Profiling: profiling,
+		Arch:      arch,
+		Status:    CompileJobQueued,
+		Phase:     CompilePhaseQueued,
+		Worker:    -1,
+		Enqueued:  time.Now(),
+	}
+	q.jobs = append(q.jobs, job)
+	inFlight = &inFlightCompile{done: make(chan struct{})}
+	q.inFlight[path] = inFlight
+	return job, inFlight, false
+}
+
+// acquire blocks until a worker is available for the job and marks the job as
+// compiling
+func (q *compileQueue) acquire(job *CompileJob) *compileWorker {
+	w := <-q.workers
+	q.lock.Lock()
+	job.Status = CompileJobCompiling
+	job.Worker = w.id
+	job.Started = time.Now()
+	q.lock.Unlock()
+	return w
+}
+
+// setProgress updates the phase and progress of the job
+func (q *compileQueue) setProgress(job *CompileJob, p CompileProgress) {
+	q.lock.Lock()
+	job.Phase = p.Phase
+	job.Progress = p.Percent
+	q.lock.Unlock()
+}
+
+// finish removes the job from the queue, returns the worker to the pool and
+// releases the callers waiting for the same compilation
+func (q *compileQueue) finish(
+	path string,
+	job *CompileJob,
+	w *compileWorker,
+	err error,
+) {
+	q.lock.Lock()
+	for i, j := range q.jobs {
+		if j == job {
+			q.jobs = append(q.jobs[:i], q.jobs[i+1:]...)
+			break
+		}
+	}
+	f := q.inFlight[path]
+	delete(q.inFlight, path)
+	q.lock.Unlock()
+
+	q.workers <- w
+	if f != nil {
+		f.err = err
+		close(f.done)
+	}
+}
+
+// acquireAll takes all workers from the pool, which waits for the running
+// compilations to finish and prevents new ones from starting. The returned
+// function returns the workers to the pool
+func (q *compileQueue) acquireAll() func() {
+	q.acquireAllLock.Lock()
+	workers := make([]*compileWorker, q.concurrency)
+	for i := range workers {
+		workers[i] = <-q.workers
+	}
+	q.acquireAllLock.Unlock()
+	return func() {
+		for _, w := range workers {
+			q.workers <- w
+		}
+	}
+}
+
+// CompileQueueStatus returns the configured concurrency and the compilations
+// that are currently queued or running, in order of arrival
+func (s *SourcesManager) CompileQueueStatus() CompileQueueStatus {
+	q := s.compileQueue
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	jobs := make([]CompileJob, len(q.jobs))
+	for i, j := range q.jobs {
+		jobs[i] = *j
+	}
+	return CompileQueueStatus{Concurrency: q.concurrency, Jobs: jobs}
+}
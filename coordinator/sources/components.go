@@ -0,0 +1,270 @@
+package sources
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// ComponentRepo is an additional repository of the system under test (such as
+// an external smart contract runner) whose binaries test runs can deploy next
+// to the ones of the transaction processor. Component repositories are
+// configured in components.json in the data directory
+type ComponentRepo struct {
+	// Name the component is selected by, and the directory its binaries are
+	// extracted to on the agents (components/<name>)
+	Name string `json:"name"`
+	// URL the repository is cloned from. Credentials have to be embedded in
+	// the URL, the access token of the transaction processor isn't used
+	URL string `json:"url"`
+	// Branch test runs use when they don't select a ref
+	Branch string `json:"branch"`
+	// Script (relative to the root of the repository) that builds the
+	// component, scripts/build.sh by default
+	BuildScript string `json:"buildScript,omitempty"`
+	// Directory (relative to the root of the repository) the build script
+	// writes the binaries to, build by default
+	OutputDir string `json:"outputDir,omitempty"`
+}
+
+var validComponentName = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// componentsConfigPath returns the file the component repositories are
+// configured in
+func componentsConfigPath() string {
+	return filepath.Join(common.DataDir(), "components.json")
+}
+
+// componentsDir returns the directory the component repositories are cloned
+// into
+func componentsDir() string {
+	return filepath.Join(common.DataDir(), "components")
+}
+
+// componentDir returns the checkout of the given component repository
+func componentDir(name string) string {
+	return filepath.Join(componentsDir(), name)
+}
+
+// componentLocks serializes the checkouts and builds of each component
+var componentLocks = sync.Map{}
+
+func componentLock(name string) *sync.Mutex {
+	l, _ := componentLocks.LoadOrStore(name, &sync.Mutex{})
+	return l.(*sync.Mutex)
+}
+
+// Components returns the configured component repositories. Components with
+// an invalid configuration are left out, with a warning
+func (s *SourcesManager) Components() []ComponentRepo {
+	ret := []ComponentRepo{}
+	b, err := ioutil.ReadFile(componentsConfigPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logging.Warnf("Unable to read component repositories: %v", err)
+		}
+		return ret
+	}
+	repos := []ComponentRepo{}
+	err = json.Unmarshal(b, &repos)
+	if err != nil {
+		logging.Warnf("Unable to parse component repositories: %v", err)
+		return ret
+	}
+	seen := map[string]bool{}
+	for _, r := range repos {
+		if !validComponentName.MatchString(r.Name) || seen[r.Name] ||
+			r.URL == "" {
+			logging.Warnf("Ignoring invalid component repository %q", r.Name)
+			continue
+		}
+		seen[r.Name] = true
+		if r.BuildScript == "" {
+			r.BuildScript = filepath.Join("scripts", "build.sh")
+		}
+		if r.OutputDir == "" {
+			r.OutputDir = "build"
+		}
+		ret = append(ret, r)
+	}
+	return ret
+}
+
+// Component returns the configured component repository with the given name
+func (s *SourcesManager) Component(name string) (ComponentRepo, error) {
+	for _, r := range s.Components() {
+		if r.Name == name {
+			return r, nil
+		}
+	}
+	return ComponentRepo{}, fmt.Errorf("Unknown component repository %s", name)
+}
+
+// ComponentArchivePath returns the path of the binaries archive of the given
+// component commit and target architecture
+func ComponentArchivePath(name, commitHash, arch string) (string, error) {
+	dir := filepath.Join(binariesDir(), "components", name)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(
+		dir,
+		fmt.Sprintf("%s%s.tar.gz", commitHash, archSuffix(arch)),
+	), nil
+}
+
+// runComponentGit runs git in the checkout of the component
+func runComponentGit(name string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = componentDir(name)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf(
+			"git %s failed for component %s: %v\n\n%s",
+			args[0],
+			name,
+			err,
+			string(out),
+		)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// ResolveComponentRef clones the component repository if needed, fetches the
+// given branch, tag or commit (the configured branch if ref is empty) and
+// returns the commit hash it points to
+func (s *SourcesManager) ResolveComponentRef(name, ref string) (string, error) {
+	repo, err := s.Component(name)
+	if err != nil {
+		return "", err
+	}
+	if ref == "" {
+		ref = repo.Branch
+	}
+	if ref == "" {
+		return "", fmt.Errorf("Component %s has no branch configured", name)
+	}
+
+	l := componentLock(name)
+	l.Lock()
+	defer l.Unlock()
+
+	if _, err := os.Stat(filepath.Join(componentDir(name), ".git")); err != nil {
+		logging.Infof("Cloning component repository %s", name)
+		err = os.MkdirAll(componentsDir(), 0755)
+		if err != nil {
+			return "", err
+		}
+		os.RemoveAll(componentDir(name))
+		cmd := exec.Command("git", "clone", "--no-checkout", repo.URL, name)
+		cmd.Dir = componentsDir()
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return "", fmt.Errorf(
+				"Failed to clone component %s: %v\n\n%s",
+				name,
+				err,
+				string(out),
+			)
+		}
+	}
+
+	_, err = runComponentGit(name, "fetch", "--tags", "origin", ref)
+	if err != nil {
+		// Commits that were fetched before can be used without reaching the
+		// origin
+		if IsCommitHash(ref) {
+			if hash, err2 := runComponentGit(
+				name,
+				"rev-parse",
+				"--verify",
+				ref+"^{commit}",
+			); err2 == nil {
+				return hash, nil
+			}
+		}
+		return "", err
+	}
+	return runComponentGit(name, "rev-parse", "--verify", "FETCH_HEAD^{commit}")
+}
+
+// CompileComponent builds the given commit of the component for the target
+// architecture, unless its binaries archive exists already, and returns the
+// path of the archive
+func (s *SourcesManager) CompileComponent(
+	name, commitHash, arch string,
+) (string, error) {
+	repo, err := s.Component(name)
+	if err != nil {
+		return "", err
+	}
+	path, err := ComponentArchivePath(name, commitHash, arch)
+	if err != nil {
+		return "", err
+	}
+
+	l := componentLock(name)
+	l.Lock()
+	defer l.Unlock()
+
+	if _, err := os.Stat(path); err == nil {
+		touchArtifact(path)
+		return path, nil
+	}
+
+	archEnv, err := targetArchEnv(arch)
+	if err != nil {
+		return "", err
+	}
+	_, err = runComponentGit(name, "checkout", "--detach", "--force", commitHash)
+	if err != nil {
+		return "", err
+	}
+	_, err = runComponentGit(name, "submodule", "update", "--init", "--recursive")
+	if err != nil {
+		return "", err
+	}
+	outputDir := filepath.Join(componentDir(name), repo.OutputDir)
+	os.RemoveAll(outputDir)
+
+	logging.Infof("[Compile %s@%s]: Building component", name, commitHash)
+	cmd := exec.Command(
+		"bash",
+		filepath.Join(componentDir(name), repo.BuildScript),
+	)
+	cmd.Dir = componentDir(name)
+	env := append(os.Environ(), s.dependencyCacheEnv()...)
+	cmd.Env = append(append(env, archEnv...), "BUILD_RELEASE=1")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", newBuildError(fmt.Sprintf("Build of %s", name), err, out)
+	}
+	if _, err := os.Stat(outputDir); err != nil {
+		return "", fmt.Errorf(
+			"Build of component %s did not produce %s",
+			name,
+			repo.OutputDir,
+		)
+	}
+
+	err = common.CreateArchive(outputDir, path)
+	if err == nil {
+		err = s.writeBinariesChecksums(path)
+	}
+	if err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	logging.Infof("[Compile %s@%s]: Component archived", name, commitHash)
+	return path, nil
+}
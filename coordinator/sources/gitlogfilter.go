@@ -0,0 +1,75 @@
+package sources
+
+import (
+	"strings"
+	"time"
+)
+
+// GitLogFilter selects the records of the commit history returned by
+// FilterGitLog. Zero values don't filter
+type GitLogFilter struct {
+	// Case-insensitive substring of the author's name or e-mail address
+	Author string
+	// Only include commits committed at or after Since, and before Until
+	Since time.Time
+	Until time.Time
+	// Case-insensitive substring of the commit subject
+	Subject string
+	// Only include the head commits of pull requests
+	PullRequestsOnly bool
+	// Only include commits on the main branch
+	MainlineOnly bool
+}
+
+func (f GitLogFilter) matches(c GitLogRecord) bool {
+	if f.PullRequestsOnly && c.PullRequest == 0 {
+		return false
+	}
+	if f.MainlineOnly && c.PullRequest != 0 {
+		return false
+	}
+	if !f.Since.IsZero() && c.Committed.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !c.Committed.Before(f.Until) {
+		return false
+	}
+	if f.Subject != "" &&
+		!strings.Contains(
+			strings.ToLower(c.Subject),
+			strings.ToLower(f.Subject),
+		) {
+		return false
+	}
+	if f.Author != "" {
+		author := strings.ToLower(f.Author)
+		if !strings.Contains(strings.ToLower(c.Author.Name), author) &&
+			!strings.Contains(strings.ToLower(c.Author.Email), author) {
+			return false
+		}
+	}
+	return true
+}
+
+// FilterGitLog returns the page of limit records starting at offset of the
+// commit history matching the filter, along with the total number of matching
+// records
+func (s *SourcesManager) FilterGitLog(
+	filter GitLogFilter,
+	offset, limit int,
+) ([]GitLogRecord, int, error) {
+	matching := []GitLogRecord{}
+	for _, c := range s.gitLogSnapshot().records {
+		if filter.matches(c) {
+			matching = append(matching, c)
+		}
+	}
+	if offset > 0 && offset >= len(matching) {
+		return []GitLogRecord{}, len(matching), ErrGitLogOutOfBounds
+	}
+	end := offset + limit
+	if end > len(matching) {
+		end = len(matching)
+	}
+	return matching[offset:end], len(matching), nil
+}
@@ -0,0 +1,59 @@
+package sources
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// gitLogSnapshot is an immutable version of the commit history. Updates of
+// the history swap in a new snapshot rather than modifying the current one
+type gitLogSnapshot struct {
+	records []GitLogRecord
+	// Index of the records by commit hash
+	byHash map[string]struct{}
+	// Hash of the contents of the history, identifying the snapshot
+	version string
+}
+
+// newGitLogSnapshot creates a snapshot of the given commit history, which
+// must not be modified after
+func newGitLogSnapshot(records []GitLogRecord) *gitLogSnapshot {
+	byHash := make(map[string]struct{}, len(records))
+	for _, r := range records {
+		byHash[r.CommitHash] = struct{}{}
+	}
+	h := sha256.New()
+	err := json.NewEncoder(h).Encode(records)
+	if err != nil {
+		logging.Warnf("Unable to hash commit history: %v", err)
+	}
+	return &gitLogSnapshot{
+		records: records,
+		byHash:  byHash,
+		version: hex.EncodeToString(h.Sum(nil))[:16],
+	}
+}
+
+// gitLogSnapshot returns the current snapshot of the commit history
+func (s *SourcesManager) gitLogSnapshot() *gitLogSnapshot {
+	s.gitLogLock.RLock()
+	defer s.gitLogLock.RUnlock()
+	return s.gitLog
+}
+
+// swapGitLog replaces the commit history with the given records
+func (s *SourcesManager) swapGitLog(records []GitLogRecord) {
+	snap := newGitLogSnapshot(records)
+	s.gitLogLock.Lock()
+	defer s.gitLogLock.Unlock()
+	s.gitLog = snap
+}
+
+// GitLogVersion returns an identifier of the current commit history that
+// changes whenever the history does, such that clients can cache it
+func (s *SourcesManager) GitLogVersion() string {
+	return s.gitLogSnapshot().version
+}
@@ -0,0 +1,611 @@
+package sources
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// gitSourceProvider obtains the sources from the git repository at
+// TRANSACTION_PROCESSOR_REPO_URL, tracking TRANSACTION_PROCESSOR_MAIN_BRANCH
+// and the open pull requests
+type gitSourceProvider struct {
+	// The lock guarding the main checkout, which Checkout uses to create the
+	// worktrees of the compile workers
+	mainLock *sync.Mutex
+	// Returns the environment that makes submodule updates in dir use the
+	// local mirrors
+	submoduleEnv func(dir string) []string
+	// The remote sources are fetched from, empty when no remote is reachable
+	remote         string
+	remoteSelected bool
+	remoteLock     sync.Mutex
+}
+
+func (p *gitSourceProvider) Name() string {
+	return "git"
+}
+
+// CheckConnectivity lists the references of the origin repository and checks
+// that the main branch is among them. If the origin is unreachable, it is
+// enough for one of the mirrors to be reachable
+func (p *gitSourceProvider) CheckConnectivity() error {
+	if forcedOffline() {
+		return errors.New("Offline mode is forced by TRANSACTION_PROCESSOR_OFFLINE")
+	}
+	repoURL := os.Getenv("TRANSACTION_PROCESSOR_REPO_URL")
+	remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{
+		Name: "origin",
+		URLs: []string{repoURL},
+	})
+	refs, err := remote.List(&git.ListOptions{Auth: gitAuth()})
+	if err != nil {
+		for i, u := range mirrorURLs() {
+			if probeRemote(mirrorRemoteName(i), u) == nil {
+				logging.Warnf(
+					"Origin %s is unreachable, mirror %d is used: %v",
+					repoURL,
+					i,
+					err,
+				)
+				return nil
+			}
+		}
+		return fmt.Errorf("Unable to list the references of %s: %v", repoURL, err)
+	}
+	branch := plumbing.NewBranchReferenceName(
+		os.Getenv("TRANSACTION_PROCESSOR_MAIN_BRANCH"),
+	)
+	for _, r := range refs {
+		if r.Name() == branch {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s has no branch %s", repoURL, branch.Short())
+}
+
+func (p *gitSourceProvider) Clone() error {
+	gitUrl, err := url.Parse(os.Getenv("TRANSACTION_PROCESSOR_REPO_URL"))
+	if err != nil {
+		return err
+	}
+	if os.Getenv("TRANSACTION_PROCESSOR_ACCESS_TOKEN") != "" {
+		gitUrl.User = url.UserPassword(
+			os.Getenv("TRANSACTION_PROCESSOR_ACCESS_TOKEN"),
+			"x-oauth-basic",
+		)
+	}
+
+	// Shallow clones fetch the tips of all branches, such that the main
+	// branch can be checked out regardless of the default branch
+	args := []string{"clone"}
+	if depth := cloneDepth(); depth > 0 {
+		args = append(
+			args,
+			fmt.Sprintf("--depth=%d", depth),
+			"--no-single-branch",
+		)
+	}
+	if len(sparsePaths()) > 0 {
+		args = append(args, "--sparse")
+	}
+	// Clone from the first mirror that works if the origin is unreachable,
+	// and point the origin remote back at the origin afterwards
+	urls := append([]string{gitUrl.String()}, mirrorURLs()...)
+	for i, u := range urls {
+		os.RemoveAll(sourcesDir())
+		cmd := exec.Command("git", append(args, u, sourcesDirName())...)
+		cmd.Dir = sourcesParentDir()
+		err = cmd.Run()
+		if err == nil {
+			if i > 0 {
+				logging.Warnf("Cloned sources from mirror %d", i-1)
+			}
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf(
+			"Failed to clone sources. Do you have the right token configured? %v",
+			err,
+		)
+	}
+	cmd := exec.Command("git", "remote", "set-url", "origin", gitUrl.String())
+	cmd.Dir = sourcesDir()
+	err = cmd.Run()
+	if err != nil {
+		return err
+	}
+	err = configureMirrorRemotes()
+	if err != nil {
+		return err
+	}
+
+	err = applySparseCheckout(sourcesDir())
+	if err != nil {
+		return err
+	}
+
+	cmd = exec.Command("git", "submodule", "sync")
+	cmd.Dir = sourcesDir()
+	err = cmd.Run()
+	if err != nil {
+		return err
+	}
+
+	cmd = exec.Command("git", "submodule", "update", "--init", "--recursive")
+	cmd.Dir = sourcesDir()
+	err = cmd.Run()
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Update pulls the main branch from the origin, or from the first reachable
+// mirror if the origin is unreachable. If no remote is reachable, the local
+// clone is used as-is
+func (p *gitSourceProvider) Update() error {
+	err := configureMirrorRemotes()
+	if err != nil {
+		return err
+	}
+	p.selectRemote()
+	remote := p.activeRemote()
+
+	cmd := exec.Command(
+		"git",
+		"checkout",
+		os.Getenv("TRANSACTION_PROCESSOR_MAIN_BRANCH"),
+	)
+	cmd.Dir = sourcesDir()
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		logging.Errorf("Error on git checkout: %v", string(out))
+		return err
+	}
+	if remote == "" {
+		return nil
+	}
+	cmd = exec.Command(
+		"git",
+		"pull",
+		remote,
+		os.Getenv("TRANSACTION_PROCESSOR_MAIN_BRANCH"),
+	)
+	cmd.Dir = sourcesDir()
+	out, err = cmd.CombinedOutput()
+	if err != nil {
+		logging.Errorf("Error on git pull: %v", string(out))
+		return err
+	}
+	return nil
+}
+
+// Log returns the history of the main branch, with the head commits of the
+// recent and mergeable pull requests right after the three most recent
+// commits
+func (p *gitSourceProvider) Log() ([]GitLogRecord, error) {
+	repo, err := openSourcesRepo()
+	if err != nil {
+		return nil, fmt.Errorf("error opening sources repository: %v", err)
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return nil, fmt.Errorf("error resolving HEAD: %v", err)
+	}
+	commits, err := repo.Log(&git.LogOptions{
+		From:  head.Hash(),
+		Order: git.LogOrderCommitterTime,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error updating commit history: %v", err)
+	}
+	newGitLog := []GitLogRecord{}
+	err = commits.ForEach(func(c *object.Commit) error {
+		newGitLog = append(newGitLog, gitLogRecordFromCommit(c))
+		return nil
+	})
+	// The history of a shallow clone ends at commits whose parents are
+	// missing, which go-git reports as an error
+	if errors.Is(err, plumbing.ErrObjectNotFound) && len(shallowCommits()) > 0 {
+		err = nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error updating commit history: %v", err)
+	}
+
+	// Offline, the pull requests fetched before are listed. Mirrors do not
+	// necessarily carry the pull request refs, so failing to fetch them from
+	// a mirror is not fatal
+	remote := p.activeRemote()
+	var prHeadCommits map[int]string
+	var prs map[int]bool
+	if remote != "" {
+		err = repo.Fetch(&git.FetchOptions{
+			RemoteName: remote,
+			RefSpecs: []config.RefSpec{
+				"+refs/pull/*/head:refs/remotes/origin/pr-head/*",
+			},
+			Auth: remoteAuth(remote),
+		})
+		if err == nil || err == git.NoErrAlreadyUpToDate {
+			prHeadCommits, prs, err = remotePullRequests(repo, remote)
+		}
+		if err != nil && err != git.NoErrAlreadyUpToDate {
+			if remote == "origin" {
+				return nil, fmt.Errorf("Failed to fetch PRs: %v", err)
+			}
+			logging.Warnf("Failed to fetch PRs from %s: %v", remote, err)
+			prHeadCommits = nil
+		}
+	}
+	if prHeadCommits == nil {
+		prHeadCommits, err = localPullRequests(repo)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read fetched PRs: %v", err)
+		}
+		prs = map[int]bool{}
+	}
+	for pr := range prs {
+		logging.Infof("Detected (at one point) mergeable PR #%d", pr)
+	}
+
+	prGitLogs := make([]GitLogRecord, 0)
+	for pr := range prHeadCommits {
+		mergeable := prs[pr]
+		c, err := repo.CommitObject(plumbing.NewHash(prHeadCommits[pr]))
+		if err != nil {
+			logging.Warnf("Reading head commit for PR %d failed: %v", pr, err)
+			continue
+		}
+		authored := c.Author.When
+		// Include non-mergeable (or already merged) PRs that are less than
+		// 48 hours old, and mergeable PRs that are less than 90 days old
+		if authored.After(time.Now().Add(-2*24*time.Hour)) ||
+			(mergeable && authored.After(time.Now().Add(-90*24*time.Hour))) {
+			// Yes we want this one!
+			prGitLogs = append(prGitLogs, GitLogRecord{
+				Authored:   authored,
+				Committed:  authored,
+				Subject:    fmt.Sprintf("PR #%d - %s", pr, commitSubject(c)),
+				CommitHash: prHeadCommits[pr],
+				Author: GitLogPerson{
+					Name:  c.Author.Name,
+					Email: c.Author.Email,
+				},
+				PullRequest: pr,
+			})
+		}
+	}
+
+	sort.Slice(prGitLogs, func(i, j int) bool {
+		return prGitLogs[j].Authored.Before(prGitLogs[i].Authored)
+	})
+	// Show the open PRs right after the three most recent commits
+	split := 3
+	if len(newGitLog) < split {
+		split = len(newGitLog)
+	}
+	return append(
+		append(append([]GitLogRecord{}, newGitLog[:split]...), prGitLogs...),
+		newGitLog[split:]...), nil
+}
+
+// Checkout checks out the given commit in a git worktree at dir, creating the
+// worktree from the main sources checkout if it does not exist yet, and
+// updates its submodules. The main checkout is locked while manipulating the
+// worktree, since git worktree manipulates its repository metadata
+func (p *gitSourceProvider) Checkout(dir, revision string) error {
+	err := p.checkoutWorktree(dir, revision)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command("git", "submodule", "sync")
+	cmd.Dir = dir
+	err = cmd.Run()
+	if err != nil {
+		return err
+	}
+
+	cmd = exec.Command("git", "submodule", "update", "--init", "--recursive")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), p.submoduleEnv(dir)...)
+	return cmd.Run()
+}
+
+func (p *gitSourceProvider) checkoutWorktree(dir, revision string) error {
+	p.mainLock.Lock()
+	defer p.mainLock.Unlock()
+
+	err := ensureCommit(p.activeRemote(), revision)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+		cmd := exec.Command("git", "checkout", "--detach", "--force", revision)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("Checkout failed: %v\n\n%v", err, string(out))
+		}
+		return nil
+	}
+
+	logging.Infof("Creating worktree %s", dir)
+	err = os.MkdirAll(filepath.Dir(dir), 0755)
+	if err != nil {
+		return err
+	}
+	// Clean up the metadata of worktrees whose directory was removed
+	cmd := exec.Command("git", "worktree", "prune")
+	cmd.Dir = sourcesDir()
+	err = cmd.Run()
+	if err != nil {
+		return err
+	}
+	os.RemoveAll(dir)
+	if len(sparsePaths()) == 0 {
+		cmd = exec.Command("git", "worktree", "add", "--detach", dir, revision)
+		cmd.Dir = sourcesDir()
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("Creating worktree failed: %v\n\n%v", err, string(out))
+		}
+		return nil
+	}
+
+	// Configure the sparse checkout before populating the worktree, such that
+	// the paths outside of it are never written
+	cmd = exec.Command(
+		"git",
+		"worktree",
+		"add",
+		"--no-checkout",
+		"--detach",
+		dir,
+		revision,
+	)
+	cmd.Dir = sourcesDir()
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Creating worktree failed: %v\n\n%v", err, string(out))
+	}
+	err = applySparseCheckout(dir)
+	if err != nil {
+		return err
+	}
+	cmd = exec.Command("git", "checkout", "--detach", "--force", revision)
+	cmd.Dir = dir
+	out, err = cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Checkout failed: %v\n\n%v", err, string(out))
+	}
+	return nil
+}
+
+// Archive checks out the given commit in the main sources checkout and
+// archives it, including its submodules
+func (p *gitSourceProvider) Archive(
+	revision, path string,
+	progress common.ArchiveProgressFunc,
+) error {
+	err := ensureCommit(p.activeRemote(), revision)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command("git", "checkout", revision)
+	cmd.Dir = sourcesDir()
+	err = cmd.Run()
+	if err != nil {
+		return err
+	}
+
+	cmd = exec.Command("git", "submodule", "sync")
+	cmd.Dir = sourcesDir()
+	err = cmd.Run()
+	if err != nil {
+		return err
+	}
+
+	cmd = exec.Command("git", "submodule", "update", "--recursive")
+	cmd.Dir = sourcesDir()
+	cmd.Env = append(os.Environ(), p.submoduleEnv(sourcesDir())...)
+	err = cmd.Run()
+	if err != nil {
+		return err
+	}
+
+	return common.CreateArchiveWithProgress(sourcesDir(), path, progress)
+}
+
+// FetchRef fetches the given branch or tag from the origin remote (or the
+// mirror used in its stead) into the main sources checkout, and returns the
+// commit it points to. Annotated tags are peeled to the commit they tag.
+// Offline, the branch or tag as fetched before is used
+func (p *gitSourceProvider) FetchRef(ref string) (string, bool, error) {
+	repo, err := openSourcesRepo()
+	if err != nil {
+		return "", false, err
+	}
+	remoteName := p.activeRemote()
+	if remoteName == "" {
+		return localRef(repo, ref)
+	}
+	remote, err := repo.Remote(remoteName)
+	if err != nil {
+		return "", false, err
+	}
+	refs, err := remote.List(&git.ListOptions{Auth: remoteAuth(remoteName)})
+	if err != nil {
+		return "", false, fmt.Errorf("Unable to list remote refs: %v", err)
+	}
+
+	branch := plumbing.NewBranchReferenceName(ref)
+	tag := plumbing.NewTagReferenceName(ref)
+	var remoteRef, localName plumbing.ReferenceName
+	isTag := false
+	for _, r := range refs {
+		if r.Name() == branch {
+			remoteRef = branch
+			localName = plumbing.NewRemoteReferenceName("origin", ref)
+			break
+		}
+		if r.Name() == tag {
+			remoteRef = tag
+			localName = tag
+			isTag = true
+		}
+	}
+	if remoteRef == "" {
+		return "", false, fmt.Errorf("No branch or tag named %s exists", ref)
+	}
+
+	// Fetched with the git CLI rather than go-git, since go-git refuses to
+	// update refs that were packed by git
+	args := []string{"fetch", "--no-tags"}
+	if depth := cloneDepth(); depth > 0 {
+		args = append(args, fmt.Sprintf("--depth=%d", depth))
+	}
+	args = append(
+		args,
+		remoteName,
+		fmt.Sprintf("+%s:%s", remoteRef, localName),
+	)
+	cmd := exec.Command("git", args...)
+	cmd.Dir = sourcesDir()
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", false, fmt.Errorf(
+			"Unable to fetch %s: %v\n\n%s",
+			ref,
+			err,
+			string(out),
+		)
+	}
+
+	h, err := repo.ResolveRevision(plumbing.Revision(localName))
+	if err != nil {
+		return "", false, fmt.Errorf("Unable to resolve %s: %v", ref, err)
+	}
+	return h.String(), isTag, nil
+}
+
+// ListTags lists the tags of the origin remote (or the mirror used in its
+// stead). Offline, the tags fetched before are listed
+func (p *gitSourceProvider) ListTags() ([]string, error) {
+	repo, err := openSourcesRepo()
+	if err != nil {
+		return nil, err
+	}
+	ret := []string{}
+	remoteName := p.activeRemote()
+	if remoteName == "" {
+		iter, err := repo.Tags()
+		if err != nil {
+			return nil, err
+		}
+		err = iter.ForEach(func(r *plumbing.Reference) error {
+			ret = append(ret, r.Name().Short())
+			return nil
+		})
+		return ret, err
+	}
+	remote, err := repo.Remote(remoteName)
+	if err != nil {
+		return nil, err
+	}
+	refs, err := remote.List(&git.ListOptions{Auth: remoteAuth(remoteName)})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list remote refs: %v", err)
+	}
+	for _, r := range refs {
+		if r.Name().IsTag() {
+			ret = append(ret, r.Name().Short())
+		}
+	}
+	return ret, nil
+}
+
+// LastChange finds the most recent commit in the history of the given commit
+// that changed any of the paths using git log, without checking it out. If
+// none of them were ever changed, the given commit is returned
+func (p *gitSourceProvider) LastChange(
+	revision string,
+	paths []string,
+) (string, error) {
+	err := ensureCommit(p.activeRemote(), revision)
+	if err != nil {
+		return "", err
+	}
+
+	for {
+		args := []string{"log", "-1", "--pretty=format:%H", revision, "--"}
+		cmd := exec.Command("git", append(args, paths...)...)
+		cmd.Dir = sourcesDir()
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return "", fmt.Errorf(
+				"Failed to find the last change of %s - failed to execute git log: %v\n\n%s",
+				strings.Join(paths, ", "),
+				err,
+				string(out),
+			)
+		}
+		last := strings.TrimSpace(string(out))
+		if last == "" {
+			logging.Warnf(
+				"No commit of or before %s changes %s",
+				revision,
+				strings.Join(paths, ", "),
+			)
+			return revision, nil
+		}
+		// In a shallow clone, git log reports the oldest fetched commit as
+		// changing every path it contains, so the actual change can only be
+		// found in the full history
+		if !shallowCommits()[last] {
+			return last, nil
+		}
+		err = unshallow(p.activeRemote())
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+// DiffStat lists the files changed between the two commits using git diff,
+// detecting renames
+func (p *gitSourceProvider) DiffStat(from, to string) ([]FileChange, error) {
+	for _, rev := range []string{from, to} {
+		err := ensureCommit(p.activeRemote(), rev)
+		if err != nil {
+			return nil, err
+		}
+	}
+	cmd := exec.Command("git", "diff", "--numstat", "-z", "-M", from, to)
+	cmd.Dir = sourcesDir()
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to execute git diff: %v", err)
+	}
+	return parseNumstat(string(out))
+}
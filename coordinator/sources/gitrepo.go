@@ -0,0 +1,146 @@
+package sources
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+)
+
+// openSourcesRepo opens the git repository of the main sources checkout
+func openSourcesRepo() (*git.Repository, error) {
+	return git.PlainOpen(sourcesDir())
+}
+
+// gitAuth returns the credentials to use for talking to the origin remote. If
+// no access token is configured, nil is returned and the credentials embedded
+// in the remote URL (if any) are used
+func gitAuth() transport.AuthMethod {
+	token := os.Getenv("TRANSACTION_PROCESSOR_ACCESS_TOKEN")
+	if token == "" {
+		return nil
+	}
+	return &githttp.BasicAuth{Username: token, Password: "x-oauth-basic"}
+}
+
+// commitSubject returns the first line of the commit message, like git's %s
+// format placeholder
+func commitSubject(c *object.Commit) string {
+	return strings.TrimSpace(strings.SplitN(c.Message, "\n", 2)[0])
+}
+
+// gitLogRecordFromCommit converts a go-git commit into a GitLogRecord
+func gitLogRecordFromCommit(c *object.Commit) GitLogRecord {
+	parents := make([]string, len(c.ParentHashes))
+	for i, p := range c.ParentHashes {
+		parents[i] = p.String()
+	}
+	return GitLogRecord{
+		CommitHash:       c.Hash.String(),
+		ParentCommitHash: strings.Join(parents, " "),
+		Subject:          commitSubject(c),
+		Author: GitLogPerson{
+			Name:  c.Author.Name,
+			Email: c.Author.Email,
+		},
+		Authored: c.Author.When,
+		Committer: GitLogPerson{
+			Name:  c.Committer.Name,
+			Email: c.Committer.Email,
+		},
+		Committed: c.Committer.When,
+	}
+}
+
+// remotePullRequests lists the pull request refs on the given remote. It
+// returns the head commit of each pull request, and the set of pull requests
+// for which GitHub has (at one point) computed a merge ref, which means they
+// were mergeable
+func remotePullRequests(
+	repo *git.Repository,
+	remoteName string,
+) (map[int]string, map[int]bool, error) {
+	remote, err := repo.Remote(remoteName)
+	if err != nil {
+		return nil, nil, err
+	}
+	refs, err := remote.List(&git.ListOptions{Auth: remoteAuth(remoteName)})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	heads := map[int]string{}
+	mergeable := map[int]bool{}
+	for _, ref := range refs {
+		name := ref.Name().String()
+		if !strings.HasPrefix(name, "refs/pull/") {
+			continue
+		}
+		parts := strings.Split(strings.TrimPrefix(name, "refs/pull/"), "/")
+		if len(parts) != 2 {
+			continue
+		}
+		pr, err := strconv.Atoi(parts[0])
+		if err != nil {
+			continue
+		}
+		switch parts[1] {
+		case "merge":
+			mergeable[pr] = true
+		case "head":
+			heads[pr] = ref.Hash().String()
+		}
+	}
+	return heads, mergeable, nil
+}
+
+// localPullRequests returns the head commit of each pull request fetched into
+// the main sources checkout before, for use when no remote is reachable
+func localPullRequests(repo *git.Repository) (map[int]string, error) {
+	refs, err := repo.References()
+	if err != nil {
+		return nil, err
+	}
+	heads := map[int]string{}
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		name := ref.Name().String()
+		if !strings.HasPrefix(name, "refs/remotes/origin/pr-head/") {
+			return nil
+		}
+		pr, err := strconv.Atoi(
+			strings.TrimPrefix(name, "refs/remotes/origin/pr-head/"),
+		)
+		if err == nil {
+			heads[pr] = ref.Hash().String()
+		}
+		return nil
+	})
+	return heads, err
+}
+
+// localRef resolves a branch or tag as it was fetched into the main sources
+// checkout before, for use when no remote is reachable
+func localRef(repo *git.Repository, ref string) (string, bool, error) {
+	for _, n := range []struct {
+		name plumbing.ReferenceName
+		tag  bool
+	}{
+		{plumbing.NewRemoteReferenceName("origin", ref), false},
+		{plumbing.NewTagReferenceName(ref), true},
+	} {
+		h, err := repo.ResolveRevision(plumbing.Revision(n.name))
+		if err == nil {
+			return h.String(), n.tag, nil
+		}
+	}
+	return "", false, fmt.Errorf(
+		"No remote is reachable and branch or tag %s was not fetched before",
+		ref,
+	)
+}
@@ -0,0 +1,283 @@
+package sources
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// BinariesImageDir is the directory of the binaries images the binaries
+// archive is extracted into, such that the role binaries are at the same path
+// relative to it as they are relative to an agent's environment directory
+const BinariesImageDir = "/opt/opencbdc"
+
+// defaultBinariesImageBase is the image binaries images are built on, unless
+// BINARIES_IMAGE_BASE is set
+const defaultBinariesImageBase = "ubuntu:20.04"
+
+// binariesImageRepository returns the repository binaries images are pushed
+// to, such as 123456789012.dkr.ecr.us-east-1.amazonaws.com/opencbdc-tx,
+// configured in BINARIES_IMAGE_REPOSITORY. The credentials for the registry
+// have to be configured for the container builder (docker login or a
+// credential helper)
+func binariesImageRepository() string {
+	return os.Getenv("BINARIES_IMAGE_REPOSITORY")
+}
+
+// BinariesImagesEnabled returns true if a repository to push binaries images
+// to is configured
+func BinariesImagesEnabled() bool {
+	return binariesImageRepository() != ""
+}
+
+// IsBinariesImage returns true if the image reference points to the
+// repository binaries images are pushed to
+func IsBinariesImage(ref string) bool {
+	return BinariesImagesEnabled() &&
+		strings.HasPrefix(ref, binariesImageRepository()+"@")
+}
+
+// binariesImagesOnCompile returns true if BINARIES_IMAGE_ON_COMPILE=1 is set,
+// in which case every compilation also builds and pushes the binaries image,
+// rather than only the ones for test runs that run from an image
+func binariesImagesOnCompile() bool {
+	return BinariesImagesEnabled() &&
+		os.Getenv("BINARIES_IMAGE_ON_COMPILE") == "1"
+}
+
+// containerBuilder returns the tool binaries images are built and pushed
+// with: docker (the default) or buildah, configured in CONTAINER_BUILDER
+func containerBuilder() (string, error) {
+	b := os.Getenv("CONTAINER_BUILDER")
+	switch b {
+	case "":
+		return "docker", nil
+	case "docker", "buildah":
+		return b, nil
+	}
+	return "", fmt.Errorf("Unsupported container builder %s", b)
+}
+
+// binariesImagesIndexPath returns the file the references of the pushed
+// binaries images are recorded in
+func binariesImagesIndexPath() string {
+	return filepath.Join(binariesDir(), "images.json")
+}
+
+// loadBinariesImages reads the pushed binaries images, keyed by tag. Must be
+// called with the imagesLock held
+func loadBinariesImages() map[string]string {
+	ret := map[string]string{}
+	b, err := ioutil.ReadFile(binariesImagesIndexPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logging.Warnf("Unable to read binaries images: %v", err)
+		}
+		return ret
+	}
+	err = json.Unmarshal(b, &ret)
+	if err != nil {
+		logging.Warnf("Unable to parse binaries images: %v", err)
+	}
+	return ret
+}
+
+// saveBinariesImages writes the pushed binaries images. Must be called with
+// the imagesLock held
+func saveBinariesImages(images map[string]string) error {
+	b, err := json.Marshal(images)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(binariesImagesIndexPath(), b, 0644)
+}
+
+// binariesImageTag returns the tag of the binaries image for the given
+// commit, build type, target architecture and build configuration, which is
+// named like the binaries archive
+func binariesImageTag(
+	hash string,
+	profilingOrDebugging bool,
+	arch string,
+	cfg *common.BuildConfig,
+) (string, error) {
+	path, err := BinariesArchivePath(hash, profilingOrDebugging, arch, cfg)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(filepath.Base(path), ".tar.gz"), nil
+}
+
+// BinariesImage returns the digest-pinned reference of the binaries image for
+// the given commit, build type, target architecture and build configuration,
+// if it was pushed
+func (s *SourcesManager) BinariesImage(
+	hash string,
+	profilingOrDebugging bool,
+	arch string,
+	cfg *common.BuildConfig,
+) (string, bool) {
+	tag, err := binariesImageTag(hash, profilingOrDebugging, arch, cfg)
+	if err != nil {
+		return "", false
+	}
+	s.imagesLock.Lock()
+	defer s.imagesLock.Unlock()
+	ref, ok := loadBinariesImages()[tag]
+	return ref, ok
+}
+
+// BuildBinariesImage builds an OCI image with the binaries archive of the
+// given commit, build type, target architecture and build configuration
+// extracted into BinariesImageDir, pushes it to the configured repository and
+// returns its digest-pinned reference. The binaries have to be compiled
+// already. Images that were pushed before are not built again
+func (s *SourcesManager) BuildBinariesImage(
+	hash string,
+	profilingOrDebugging bool,
+	arch string,
+	cfg *common.BuildConfig,
+) (string, error) {
+	if !BinariesImagesEnabled() {
+		return "", fmt.Errorf("BINARIES_IMAGE_REPOSITORY is not configured")
+	}
+	builder, err := containerBuilder()
+	if err != nil {
+		return "", err
+	}
+	archive, err := BinariesArchivePath(hash, profilingOrDebugging, arch, cfg)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(archive); err != nil {
+		return "", fmt.Errorf("Binaries of %s are not compiled: %v", hash, err)
+	}
+	tag, err := binariesImageTag(hash, profilingOrDebugging, arch, cfg)
+	if err != nil {
+		return "", err
+	}
+
+	// Serializes the builds, and keeps concurrent test runs from building
+	// the same image twice
+	s.imagesLock.Lock()
+	defer s.imagesLock.Unlock()
+	images := loadBinariesImages()
+	if ref, ok := images[tag]; ok {
+		return ref, nil
+	}
+
+	// The build context is created next to the archive, such that the
+	// archive can be hard linked into it
+	dir, err := ioutil.TempDir(binariesDir(), "image-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+	err = os.Link(archive, filepath.Join(dir, "binaries.tar.gz"))
+	if err != nil {
+		return "", err
+	}
+	base := os.Getenv("BINARIES_IMAGE_BASE")
+	if base == "" {
+		base = defaultBinariesImageBase
+	}
+	// ADD extracts the archive into the target directory
+	containerfile := fmt.Sprintf(
+		"FROM %s\nADD binaries.tar.gz %s/sources/build/\nWORKDIR %s\n",
+		base,
+		BinariesImageDir,
+		BinariesImageDir,
+	)
+	err = ioutil.WriteFile(
+		filepath.Join(dir, "Containerfile"),
+		[]byte(containerfile),
+		0644,
+	)
+	if err != nil {
+		return "", err
+	}
+
+	repo := binariesImageRepository()
+	image := fmt.Sprintf("%s:%s", repo, tag)
+	platform := "linux/" + NormalizeTargetArch(arch)
+	logging.Infof("[Image %s]: Building with %s", tag, builder)
+	run := func(step string, args ...string) error {
+		cmd := exec.Command(builder, args...)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return newBuildError(step, err, out)
+		}
+		return nil
+	}
+	buildCmd := "build"
+	if builder == "buildah" {
+		buildCmd = "bud"
+	}
+	err = run(
+		"Image build",
+		buildCmd,
+		"--platform", platform,
+		"-f", "Containerfile",
+		"-t", image,
+		".",
+	)
+	if err != nil {
+		return "", err
+	}
+
+	logging.Infof("[Image %s]: Pushing to %s", tag, repo)
+	digest := ""
+	if builder == "buildah" {
+		digestFile := filepath.Join(dir, "digest")
+		err = run("Image push", "push", "--digestfile", digestFile, image)
+		if err != nil {
+			return "", err
+		}
+		b, err := ioutil.ReadFile(digestFile)
+		if err != nil {
+			return "", err
+		}
+		digest = strings.TrimSpace(string(b))
+	} else {
+		err = run("Image push", "push", image)
+		if err != nil {
+			return "", err
+		}
+		out, err := exec.Command(
+			"docker",
+			"image",
+			"inspect",
+			"--format",
+			"{{range .RepoDigests}}{{println .}}{{end}}",
+			image,
+		).Output()
+		if err != nil {
+			return "", fmt.Errorf("Unable to inspect image %s: %v", image, err)
+		}
+		for _, d := range strings.Fields(string(out)) {
+			if strings.HasPrefix(d, repo+"@") {
+				digest = strings.TrimPrefix(d, repo+"@")
+			}
+		}
+	}
+	if !strings.HasPrefix(digest, "sha256:") {
+		return "", fmt.Errorf("Unable to determine the digest of %s", image)
+	}
+
+	ref := fmt.Sprintf("%s@%s", repo, digest)
+	images[tag] = ref
+	err = saveBinariesImages(images)
+	if err != nil {
+		return "", err
+	}
+	logging.Infof("[Image %s]: Pushed %s", tag, ref)
+	return ref, nil
+}
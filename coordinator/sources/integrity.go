@@ -0,0 +1,167 @@
+package sources
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// binarySigningEnabled reads whether binaries archives are signed, which is
+// enabled by setting BINARY_SIGNING=1. Agents configured with the public key
+// refuse to extract archives that are not signed with it
+func binarySigningEnabled() bool {
+	return os.Getenv("BINARY_SIGNING") == "1"
+}
+
+// signingKeyPath returns the path of the key binaries archives are signed with
+func signingKeyPath() string {
+	return filepath.Join(common.DataDir(), "certs", "binaries-signing.key")
+}
+
+// loadOrCreateSigningKey reads the key binaries archives are signed with, and
+// generates it if it does not exist yet
+func loadOrCreateSigningKey() (ed25519.PrivateKey, error) {
+	b, err := ioutil.ReadFile(signingKeyPath())
+	if os.IsNotExist(err) {
+		logging.Infof("Generating binaries signing key")
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		err = os.MkdirAll(filepath.Dir(signingKeyPath()), 0755)
+		if err != nil {
+			return nil, err
+		}
+		err = ioutil.WriteFile(
+			signingKeyPath(),
+			pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}),
+			0600,
+		)
+		if err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not PEM encoded", signingKeyPath())
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := k.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ed25519 key", signingKeyPath())
+	}
+	return key, nil
+}
+
+// SigningPublicKey returns the public key agents verify the signatures of
+// binaries archives with, or nil if archives are not signed
+func (s *SourcesManager) SigningPublicKey() ed25519.PublicKey {
+	if s.signingKey == nil {
+		return nil
+	}
+	return s.signingKey.Public().(ed25519.PublicKey)
+}
+
+// writeBinariesChecksums writes the SHA-256 manifest of the binaries archive
+// at path, signed if signing is enabled
+func (s *SourcesManager) writeBinariesChecksums(path string) error {
+	c, err := common.NewArchiveChecksums(path)
+	if err != nil {
+		return fmt.Errorf("Unable to compute checksums: %v", err)
+	}
+	if s.signingKey != nil {
+		c.Signature, err = common.SignDigest(s.signingKey, c.SHA256)
+		if err != nil {
+			return err
+		}
+	}
+	return common.WriteArchiveChecksums(path, c)
+}
+
+// VerifyBinaries checks the binaries archive for the given commit (and build
+// configuration) against its SHA-256 manifest, and returns the manifest.
+// Archives created before manifests were introduced get one now. Archives
+// whose manifest is not signed are signed if signing got enabled since
+func (s *SourcesManager) VerifyBinaries(
+	commitHash string,
+	profilingOrDebugging bool,
+	arch string,
+	cfg *common.BuildConfig,
+) (*common.ArchiveChecksums, error) {
+	path, err := BinariesArchivePath(commitHash, profilingOrDebugging, arch, cfg)
+	if err != nil {
+		return nil, err
+	}
+	c, err := common.ReadArchiveChecksums(path)
+	if os.IsNotExist(err) {
+		logging.Infof("Generating missing checksums for %s", path)
+		err = s.writeBinariesChecksums(path)
+		if err != nil {
+			return nil, err
+		}
+		return common.ReadArchiveChecksums(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read checksums: %v", err)
+	}
+
+	digest, size, err := common.FileSHA256(path)
+	if err != nil {
+		return nil, err
+	}
+	if digest != c.SHA256 || size != c.Size {
+		return nil, fmt.Errorf(
+			"Binaries archive %s is corrupt: expected %s (%d bytes), got %s "+
+				"(%d bytes)",
+			path,
+			c.SHA256,
+			c.Size,
+			digest,
+			size,
+		)
+	}
+
+	if s.signingKey != nil {
+		if len(c.Signature) == 0 {
+			c.Signature, err = common.SignDigest(s.signingKey, c.SHA256)
+			if err == nil {
+				err = common.WriteArchiveChecksums(path, c)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		err = common.VerifyDigestSignature(
+			s.SigningPublicKey(),
+			c.SHA256,
+			c.Signature,
+		)
+		if err != nil {
+			return nil, errors.New(
+				"Binaries archive signature does not match the signing key, " +
+					"was the key replaced? Remove the archive to rebuild it",
+			)
+		}
+	}
+	return c, nil
+}
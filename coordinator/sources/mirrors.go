@@ -0,0 +1,162 @@
+package sources
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// remoteProbeTimeout is how long a remote gets to list its references before
+// it is considered unreachable
+const remoteProbeTimeout = 30 * time.Second
+
+// mirrorURLs returns the URLs of the mirrors of the origin repository,
+// configured as a comma separated list in TRANSACTION_PROCESSOR_MIRROR_URLS.
+// The mirrors are used in the given order when the origin is unreachable
+func mirrorURLs() []string {
+	urls := []string{}
+	for _, u := range strings.Split(
+		os.Getenv("TRANSACTION_PROCESSOR_MIRROR_URLS"),
+		",",
+	) {
+		u = strings.TrimSpace(u)
+		if u != "" {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// forcedOffline returns true if TRANSACTION_PROCESSOR_OFFLINE=1 is set, in
+// which case the remotes are never contacted and the sources are served from
+// the local clone only
+func forcedOffline() bool {
+	return os.Getenv("TRANSACTION_PROCESSOR_OFFLINE") == "1"
+}
+
+// mirrorRemoteName returns the name of the remote the i-th mirror is
+// configured as in the main sources checkout
+func mirrorRemoteName(i int) string {
+	return fmt.Sprintf("mirror-%d", i)
+}
+
+// remoteAuth returns the credentials for the remote. The access token is only
+// sent to the origin, mirrors use the credentials embedded in their URL
+func remoteAuth(remote string) transport.AuthMethod {
+	if remote != "origin" {
+		return nil
+	}
+	return gitAuth()
+}
+
+// configureMirrorRemotes adds (or updates the URL of) a remote for each of
+// the configured mirrors to the main sources checkout
+func configureMirrorRemotes() error {
+	for i, u := range mirrorURLs() {
+		name := mirrorRemoteName(i)
+		cmd := exec.Command("git", "remote", "set-url", name, u)
+		cmd.Dir = sourcesDir()
+		if cmd.Run() == nil {
+			continue
+		}
+		cmd = exec.Command("git", "remote", "add", name, u)
+		cmd.Dir = sourcesDir()
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf(
+				"Unable to add mirror remote %s: %v\n\n%s",
+				name,
+				err,
+				string(out),
+			)
+		}
+	}
+	return nil
+}
+
+// probeRemote checks that the repository at url can be reached by listing its
+// references
+func probeRemote(remote, url string) error {
+	r := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{
+		Name: remote,
+		URLs: []string{url},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), remoteProbeTimeout)
+	defer cancel()
+	_, err := r.ListContext(ctx, &git.ListOptions{Auth: remoteAuth(remote)})
+	return err
+}
+
+// selectRemote determines the remote to fetch from: the origin if it is
+// reachable, otherwise the first reachable mirror. If none of them can be
+// reached, the provider goes offline and serves the history and compiles
+// from the local clone until a remote is reachable again
+func (p *gitSourceProvider) selectRemote() {
+	remote := ""
+	if !forcedOffline() {
+		candidates := []string{"origin"}
+		urls := []string{os.Getenv("TRANSACTION_PROCESSOR_REPO_URL")}
+		for i, u := range mirrorURLs() {
+			candidates = append(candidates, mirrorRemoteName(i))
+			urls = append(urls, u)
+		}
+		for i, c := range candidates {
+			err := probeRemote(c, urls[i])
+			if err == nil {
+				remote = c
+				break
+			}
+			logging.Warnf("Remote %s is unreachable: %v", c, err)
+		}
+	}
+
+	p.remoteLock.Lock()
+	defer p.remoteLock.Unlock()
+	if remote != p.remote || !p.remoteSelected {
+		switch {
+		case remote == "":
+			logging.Warnf(
+				"No remote is reachable, serving the sources from the " +
+					"local clone",
+			)
+		case p.remote == "" && p.remoteSelected:
+			logging.Infof("Remote %s is reachable, going back online", remote)
+		default:
+			logging.Infof("Fetching sources from remote %s", remote)
+		}
+	}
+	p.remote = remote
+	p.remoteSelected = true
+}
+
+// activeRemote returns the remote to fetch from, or an empty string if the
+// provider is offline. The remote is selected on first use, and reselected on
+// every update
+func (p *gitSourceProvider) activeRemote() string {
+	p.remoteLock.Lock()
+	selected := p.remoteSelected
+	p.remoteLock.Unlock()
+	if !selected {
+		p.selectRemote()
+	}
+	p.remoteLock.Lock()
+	defer p.remoteLock.Unlock()
+	return p.remote
+}
+
+// RemoteStatus returns the remote the sources are currently fetched from, and
+// whether the provider is offline because no remote is reachable
+func (p *gitSourceProvider) RemoteStatus() (string, bool) {
+	p.remoteLock.Lock()
+	defer p.remoteLock.Unlock()
+	return p.remote, p.remoteSelected && p.remote == ""
+}
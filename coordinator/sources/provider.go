@@ -0,0 +1,130 @@
+package sources
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+)
+
+// SourceProvider obtains the sources of the system under test. The main
+// checkout lives in sourcesDir(), and revisions are identified by the
+// CommitHash of the GitLogRecords returned by Log - for providers other than
+// git these don't have to be commit hashes. Except for Checkout, the methods
+// are called with the sources lock held
+type SourceProvider interface {
+	// Name identifies the provider in the logs
+	Name() string
+	// Clone obtains the sources into sourcesDir() for the first time
+	Clone() error
+	// Update brings the main checkout up to date with the latest revision
+	Update() error
+	// Log returns the revisions available for testing, most recent first
+	Log() ([]GitLogRecord, error)
+	// Checkout places the sources of the given revision, including any
+	// dependencies included with them, in the (compile worker) directory dir.
+	// It is called concurrently by the compile workers, so it has to lock
+	// the main checkout itself if it uses it
+	Checkout(dir, revision string) error
+	// Archive writes a tar.gz archive of the sources of the given revision to
+	// path, reporting the bytes archived to progress if it's not nil
+	Archive(revision, path string, progress common.ArchiveProgressFunc) error
+}
+
+// refResolver is implemented by providers that support compiling a branch or
+// tag by name
+type refResolver interface {
+	// FetchRef fetches the given branch or tag, and returns the revision it
+	// points to and whether it is a tag
+	FetchRef(ref string) (string, bool, error)
+}
+
+// tagLister is implemented by providers that can list the tags of the
+// sources
+type tagLister interface {
+	// ListTags returns the names of all tags
+	ListTags() ([]string, error)
+}
+
+// pathHistory is implemented by providers that can tell which revision last
+// changed a set of files
+type pathHistory interface {
+	// LastChange returns the most recent revision of or before the given
+	// revision that changed any of the files or directories at paths
+	LastChange(revision string, paths []string) (string, error)
+}
+
+// commitDiffer is implemented by providers that can list the files changed
+// between two revisions
+type commitDiffer interface {
+	// DiffStat returns the files changed between the revisions, along with
+	// the number of lines added and removed
+	DiffStat(from, to string) ([]FileChange, error)
+}
+
+// connectivityChecker is implemented by providers that can check that the
+// origin of the sources can be reached with the configured credentials
+type connectivityChecker interface {
+	// CheckConnectivity contacts the origin without fetching any sources
+	CheckConnectivity() error
+}
+
+// remoteSelector is implemented by providers that fall back to mirrors, or to
+// the local clone, when the origin is unreachable
+type remoteSelector interface {
+	// RemoteStatus returns the name of the remote the sources are fetched
+	// from, and whether no remote is reachable
+	RemoteStatus() (string, bool)
+}
+
+// RemoteStatus returns the remote the sources are fetched from, and whether
+// the sources are served from the local clone because no remote is reachable.
+// The remote is empty for providers without remotes
+func (s *SourcesManager) RemoteStatus() (string, bool) {
+	r, ok := s.provider.(remoteSelector)
+	if !ok {
+		return "", false
+	}
+	return r.RemoteStatus()
+}
+
+// HasLocalClone returns true if the sources were obtained before, such that
+// they can be served without reaching the origin
+func HasLocalClone() bool {
+	_, err := os.Stat(sourcesDir())
+	return err == nil
+}
+
+// CheckConnectivity checks that the source provider configured in the
+// environment can reach the origin of the sources. It doesn't need a
+// SourcesManager, such that it can be checked before one is created.
+// Providers that cannot check this are assumed to be reachable
+func CheckConnectivity() error {
+	p, err := (&SourcesManager{}).sourceProviderFromEnv()
+	if err != nil {
+		return err
+	}
+	c, ok := p.(connectivityChecker)
+	if !ok {
+		return nil
+	}
+	return c.CheckConnectivity()
+}
+
+// sourceProviderFromEnv returns the provider configured by the
+// SOURCE_PROVIDER environment variable, which is git unless set otherwise
+func (s *SourcesManager) sourceProviderFromEnv() (SourceProvider, error) {
+	switch os.Getenv("SOURCE_PROVIDER") {
+	case "", "git":
+		return &gitSourceProvider{
+			mainLock:     &s.sourcesLock,
+			submoduleEnv: s.updateSubmoduleMirrors,
+		}, nil
+	case "tarball":
+		return newTarballSourceProvider()
+	}
+	return nil, fmt.Errorf(
+		"Unsupported source provider %s",
+		os.Getenv("SOURCE_PROVIDER"),
+	)
+}
@@ -0,0 +1,210 @@
+package sources
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// commitHashRegex matches a full (SHA-1) commit hash
+var commitHashRegex = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// IsCommitHash returns true if ref is a full commit hash rather than the name
+// of a branch or tag
+func IsCommitHash(ref string) bool {
+	return commitHashRegex.MatchString(ref)
+}
+
+// RefHead is a head commit a branch or tag was resolved to
+type RefHead struct {
+	Commit   string    `json:"commit"`
+	Resolved time.Time `json:"resolved"`
+}
+
+// TrackedRef is a branch or tag that was compiled, along with the head
+// commits it resolved to over time
+type TrackedRef struct {
+	Ref          string    `json:"ref"`
+	Tag          bool      `json:"tag"`
+	Commit       string    `json:"commit"`
+	LastResolved time.Time `json:"lastResolved"`
+	// Previous head commits, most recent first. Only contains an entry when
+	// the head moved
+	History []RefHead `json:"history"`
+}
+
+// maxRefHistory is the number of previous heads kept for each tracked ref
+const maxRefHistory = 50
+
+// trackedRefsPath returns the file the tracked refs are persisted in
+func trackedRefsPath() string {
+	return filepath.Join(common.DataDir(), "tracked-refs.json")
+}
+
+// loadTrackedRefs reads the tracked refs from disk. Must be called with the
+// refsLock held
+func (s *SourcesManager) loadTrackedRefs() {
+	if s.trackedRefs != nil {
+		return
+	}
+	s.trackedRefs = map[string]*TrackedRef{}
+	b, err := ioutil.ReadFile(trackedRefsPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logging.Warnf("Unable to read tracked refs: %v", err)
+		}
+		return
+	}
+	err = json.Unmarshal(b, &s.trackedRefs)
+	if err != nil {
+		logging.Warnf("Unable to parse tracked refs: %v", err)
+		s.trackedRefs = map[string]*TrackedRef{}
+	}
+}
+
+// saveTrackedRefs writes the tracked refs to disk. Must be called with the
+// refsLock held
+func (s *SourcesManager) saveTrackedRefs() error {
+	b, err := json.Marshal(s.trackedRefs)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(trackedRefsPath(), b, 0644)
+}
+
+// ResolveRef resolves a branch name, tag or commit hash to the commit hash it
+// currently points to. Branches and tags are fetched from the origin remote
+// first, such that the commit is available for compilation even if it is not
+// part of the main branch's history. The head of every resolved branch and tag
+// is tracked, and moved is returned true when it differs from the head the
+// ref resolved to the last time - meaning the binaries for the ref have to be
+// rebuilt
+func (s *SourcesManager) ResolveRef(
+	ref string,
+) (hash string, moved bool, err error) {
+	// Providers without branches and tags identify revisions by ID only
+	if _, ok := s.provider.(refResolver); IsCommitHash(ref) || !ok {
+		return ref, false, nil
+	}
+
+	hash, tag, err := s.fetchRef(ref)
+	if err != nil {
+		return "", false, err
+	}
+
+	s.refsLock.Lock()
+	defer s.refsLock.Unlock()
+	s.loadTrackedRefs()
+	now := time.Now()
+	tr, ok := s.trackedRefs[ref]
+	if !ok {
+		tr = &TrackedRef{Ref: ref, History: []RefHead{}}
+		s.trackedRefs[ref] = tr
+	} else if tr.Commit != hash {
+		logging.Infof(
+			"Head of %s moved from %s to %s",
+			ref,
+			tr.Commit,
+			hash,
+		)
+		tr.History = append(
+			[]RefHead{{Commit: tr.Commit, Resolved: tr.LastResolved}},
+			tr.History...,
+		)
+		if len(tr.History) > maxRefHistory {
+			tr.History = tr.History[:maxRefHistory]
+		}
+		moved = true
+	}
+	tr.Tag = tag
+	tr.Commit = hash
+	tr.LastResolved = now
+	err = s.saveTrackedRefs()
+	if err != nil {
+		logging.Warnf("Unable to persist tracked refs: %v", err)
+	}
+	return hash, moved, nil
+}
+
+// fetchRef fetches the given branch or tag using the source provider, and
+// returns the revision it points to
+func (s *SourcesManager) fetchRef(ref string) (string, bool, error) {
+	s.sourcesLock.Lock()
+	defer s.sourcesLock.Unlock()
+	return s.provider.(refResolver).FetchRef(ref)
+}
+
+// TrackedRefs returns the branches and tags that were resolved for
+// compilation, most recently resolved first
+func (s *SourcesManager) TrackedRefs() []TrackedRef {
+	s.refsLock.Lock()
+	defer s.refsLock.Unlock()
+	s.loadTrackedRefs()
+	ret := make([]TrackedRef, 0, len(s.trackedRefs))
+	for _, tr := range s.trackedRefs {
+		ret = append(ret, *tr)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].LastResolved.After(ret[j].LastResolved)
+	})
+	return ret
+}
+
+// releaseTagRegex matches the tags of releases, which are named after their
+// semantic version. Pre-release tags are not matched
+var releaseTagRegex = regexp.MustCompile(`^v?(\d+)\.(\d+)\.(\d+)$`)
+
+// LatestReleaseTag returns the tag of the most recent release, being the
+// release tag with the highest version
+func (s *SourcesManager) LatestReleaseTag() (string, error) {
+	lister, ok := s.provider.(tagLister)
+	if !ok {
+		return "", fmt.Errorf(
+			"The %s source provider does not support tags",
+			s.provider.Name(),
+		)
+	}
+	s.sourcesLock.Lock()
+	tags, err := lister.ListTags()
+	s.sourcesLock.Unlock()
+	if err != nil {
+		return "", err
+	}
+
+	latest := ""
+	var latestVersion [3]int
+	for _, t := range tags {
+		m := releaseTagRegex.FindStringSubmatch(t)
+		if m == nil {
+			continue
+		}
+		var v [3]int
+		for i := range v {
+			v[i], _ = strconv.Atoi(m[i+1])
+		}
+		newer := latest == ""
+		for i := 0; !newer && i < len(v); i++ {
+			if v[i] != latestVersion[i] {
+				newer = v[i] > latestVersion[i]
+				break
+			}
+		}
+		if newer {
+			latest, latestVersion = t, v
+		}
+	}
+	if latest == "" {
+		return "", errors.New("No release tags found")
+	}
+	return latest, nil
+}
@@ -0,0 +1,305 @@
+package sources
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// defaultArtifactGCInterval is the interval at which the retention policy is
+// applied when ARTIFACT_GC_INTERVAL_MINUTES is not set
+const defaultArtifactGCInterval = time.Hour
+
+// artifactGracePeriod protects artifacts that were created or used very
+// recently from being collected, since they are likely about to be used (for
+// instance uploaded to S3 right after compiling)
+const artifactGracePeriod = time.Hour
+
+// ArtifactKind is the type of build artifact
+type ArtifactKind string
+
+const ArtifactKindBinaries ArtifactKind = "binaries"
+const ArtifactKindSourceArchive ArtifactKind = "archive"
+
+// RetentionPolicy limits the build artifacts kept on the coordinator. The
+// limits are applied to the binaries and the source archives separately, and
+// the least recently used artifacts are removed first. A limit of zero means
+// no limit
+type RetentionPolicy struct {
+	MaxAgeDays int     `json:"maxAgeDays"`
+	MaxSizeGB  float64 `json:"maxSizeGB"`
+	MaxCount   int     `json:"maxCount"`
+}
+
+// Enabled returns true if any of the limits is set
+func (p RetentionPolicy) Enabled() bool {
+	return p.MaxAgeDays > 0 || p.MaxSizeGB > 0 || p.MaxCount > 0
+}
+
+// retentionPolicyFromEnv reads the retention policy from the
+// ARTIFACT_RETENTION_MAX_AGE_DAYS, ARTIFACT_RETENTION_MAX_SIZE_GB and
+// ARTIFACT_RETENTION_MAX_COUNT environment variables
+func retentionPolicyFromEnv() RetentionPolicy {
+	p := RetentionPolicy{}
+	p.MaxAgeDays, _ = strconv.Atoi(os.Getenv("ARTIFACT_RETENTION_MAX_AGE_DAYS"))
+	p.MaxSizeGB, _ = strconv.ParseFloat(
+		os.Getenv("ARTIFACT_RETENTION_MAX_SIZE_GB"),
+		64,
+	)
+	p.MaxCount, _ = strconv.Atoi(os.Getenv("ARTIFACT_RETENTION_MAX_COUNT"))
+	return p
+}
+
+// artifactGCIntervalFromEnv reads the interval of the background garbage
+// collection from the ARTIFACT_GC_INTERVAL_MINUTES environment variable
+func artifactGCIntervalFromEnv() time.Duration {
+	m, err := strconv.Atoi(os.Getenv("ARTIFACT_GC_INTERVAL_MINUTES"))
+	if err != nil || m <= 0 {
+		return defaultArtifactGCInterval
+	}
+	return time.Duration(m) * time.Minute
+}
+
+// Artifact is a binaries archive or source archive stored on the coordinator
+type Artifact struct {
+	Kind      ArtifactKind `json:"kind"`
+	Commit    string       `json:"commit"`
+	Profiling bool         `json:"profiling"`
+	Arch      string       `json:"arch"`
+	// Key of the build configuration, empty for the default one
+	BuildConfig string    `json:"buildConfig,omitempty"`
+	SizeBytes   int64     `json:"sizeBytes"`
+	LastUsed    time.Time `json:"lastUsed"`
+	InUse       bool      `json:"inUse"`
+	path        string
+}
+
+// RemovedArtifact is an artifact removed (or, in a dry run, that would be
+// removed) by the garbage collection, along with the limit it exceeded
+type RemovedArtifact struct {
+	Artifact
+	Reason string `json:"reason"`
+}
+
+// ArtifactGCReport describes the outcome of a garbage collection
+type ArtifactGCReport struct {
+	DryRun         bool              `json:"dryRun"`
+	Started        time.Time         `json:"started"`
+	Finished       time.Time         `json:"finished"`
+	Policy         RetentionPolicy   `json:"policy"`
+	Removed        []RemovedArtifact `json:"removed"`
+	KeptCount      int               `json:"keptCount"`
+	FreedBytes     int64             `json:"freedBytes"`
+	RemainingBytes int64             `json:"remainingBytes"`
+	Errors         []string          `json:"errors"`
+}
+
+// ArtifactsStatus describes the stored artifacts and the retention policy
+type ArtifactsStatus struct {
+	Policy    RetentionPolicy   `json:"policy"`
+	Interval  string            `json:"interval"`
+	Artifacts []Artifact        `json:"artifacts"`
+	LastGC    *ArtifactGCReport `json:"lastGC"`
+}
+
+// SetArtifactUsageFunc registers the function returning the commits whose
+// artifacts are needed by queued and running test runs. These artifacts are
+// never collected
+func (s *SourcesManager) SetArtifactUsageFunc(f func() []string) {
+	s.gcLock.Lock()
+	defer s.gcLock.Unlock()
+	s.artifactsInUse = f
+}
+
+// touchArtifact marks the artifact at path as used, which postpones its
+// collection under the retention policy
+func touchArtifact(path string) {
+	now := time.Now()
+	err := os.Chtimes(path, now, now)
+	if err != nil {
+		logging.Warnf("Unable to update last use of %s: %v", path, err)
+	}
+}
+
+// buildConfigSuffix matches the key of a custom build configuration at the end
+// of the name of a binaries archive
+var buildConfigSuffix = regexp.MustCompile(`-(cfg[0-9a-f]{12})$`)
+
+// listArtifacts returns the artifacts of the given kind, most recently used
+// first. Must be called with the gcLock held
+func (s *SourcesManager) listArtifacts(kind ArtifactKind) []Artifact {
+	dir := binariesDir()
+	if kind == ArtifactKindSourceArchive {
+		dir = filepath.Join(common.DataDir(), "archives")
+	}
+	inUse := map[string]bool{}
+	if s.artifactsInUse != nil {
+		for _, h := range s.artifactsInUse() {
+			inUse[h] = true
+		}
+	}
+
+	artifacts := []Artifact{}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return artifacts
+	}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".tar.gz") {
+			continue
+		}
+		commit := strings.TrimSuffix(f.Name(), ".tar.gz")
+		buildConfig := ""
+		if m := buildConfigSuffix.FindStringSubmatch(commit); m != nil {
+			buildConfig = m[1]
+			commit = strings.TrimSuffix(commit, m[0])
+		}
+		arch := DefaultTargetArch
+		for a := range crossCompilers {
+			if a != DefaultTargetArch && strings.HasSuffix(commit, archSuffix(a)) {
+				arch = a
+				commit = strings.TrimSuffix(commit, archSuffix(a))
+				break
+			}
+		}
+		profiling := strings.HasSuffix(commit, "-profiling")
+		commit = strings.TrimSuffix(commit, "-profiling")
+		artifacts = append(artifacts, Artifact{
+			Kind:        kind,
+			Commit:      commit,
+			Profiling:   profiling,
+			Arch:        arch,
+			BuildConfig: buildConfig,
+			SizeBytes:   f.Size(),
+			LastUsed:    f.ModTime(),
+			InUse:       inUse[commit],
+			path:        filepath.Join(dir, f.Name()),
+		})
+	}
+	sort.Slice(artifacts, func(i, j int) bool {
+		return artifacts[i].LastUsed.After(artifacts[j].LastUsed)
+	})
+	return artifacts
+}
+
+// ArtifactsStatus returns the stored artifacts, the retention policy and the
+// report of the last garbage collection
+func (s *SourcesManager) ArtifactsStatus() ArtifactsStatus {
+	s.gcLock.Lock()
+	defer s.gcLock.Unlock()
+	return ArtifactsStatus{
+		Policy:   s.retention,
+		Interval: artifactGCIntervalFromEnv().String(),
+		Artifacts: append(
+			s.listArtifacts(ArtifactKindBinaries),
+			s.listArtifacts(ArtifactKindSourceArchive)...,
+		),
+		LastGC: s.lastGCReport,
+	}
+}
+
+// CollectArtifacts applies the retention policy to the stored artifacts. If
+// policy is nil, the configured policy is used. When dryRun is set, nothing is
+// removed and the report lists the artifacts that would have been removed
+func (s *SourcesManager) CollectArtifacts(
+	policy *RetentionPolicy,
+	dryRun bool,
+) *ArtifactGCReport {
+	s.gcLock.Lock()
+	defer s.gcLock.Unlock()
+
+	p := s.retention
+	if policy != nil {
+		p = *policy
+	}
+	report := &ArtifactGCReport{
+		DryRun:  dryRun,
+		Started: time.Now(),
+		Policy:  p,
+		Removed: []RemovedArtifact{},
+		Errors:  []string{},
+	}
+	maxSize := int64(p.MaxSizeGB * 1024 * 1024 * 1024)
+	maxAge := time.Duration(p.MaxAgeDays) * 24 * time.Hour
+
+	for _, kind := range []ArtifactKind{
+		ArtifactKindBinaries,
+		ArtifactKindSourceArchive,
+	} {
+		count := 0
+		var size int64
+		for _, a := range s.listArtifacts(kind) {
+			reason := ""
+			age := report.Started.Sub(a.LastUsed)
+			if !a.InUse && age > artifactGracePeriod {
+				if maxAge > 0 && age > maxAge {
+					reason = fmt.Sprintf("not used in %d days", p.MaxAgeDays)
+				} else if p.MaxCount > 0 && count+1 > p.MaxCount {
+					reason = fmt.Sprintf("more than %d artifacts", p.MaxCount)
+				} else if maxSize > 0 && size+a.SizeBytes > maxSize {
+					reason = fmt.Sprintf("more than %.1f GB", p.MaxSizeGB)
+				}
+			}
+			if reason == "" {
+				count++
+				size += a.SizeBytes
+				continue
+			}
+			if !dryRun {
+				err := os.Remove(a.path)
+				if err != nil {
+					report.Errors = append(report.Errors, err.Error())
+					count++
+					size += a.SizeBytes
+					continue
+				}
+				os.Remove(common.ChecksumsPath(a.path))
+			}
+			report.Removed = append(
+				report.Removed,
+				RemovedArtifact{Artifact: a, Reason: reason},
+			)
+			report.FreedBytes += a.SizeBytes
+		}
+		report.KeptCount += count
+		report.RemainingBytes += size
+	}
+	report.Finished = time.Now()
+
+	if !dryRun {
+		s.lastGCReport = report
+		if len(report.Removed) > 0 {
+			logging.Infof(
+				"Artifact GC removed %d artifacts, freeing %d bytes",
+				len(report.Removed),
+				report.FreedBytes,
+			)
+		}
+	}
+	return report
+}
+
+// artifactGCLoop periodically applies the configured retention policy, if
+// any
+func (s *SourcesManager) artifactGCLoop() {
+	if !s.retention.Enabled() {
+		return
+	}
+	interval := artifactGCIntervalFromEnv()
+	for {
+		time.Sleep(interval)
+		report := s.CollectArtifacts(nil, false)
+		for _, e := range report.Errors {
+			logging.Warnf("Artifact GC: %s", e)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package sources
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// cloneDepth returns the number of commits of history the sources are cloned
+// with, configured by TRANSACTION_PROCESSOR_CLONE_DEPTH. Zero (the default)
+// clones the full history
+func cloneDepth() int {
+	depth, err := strconv.Atoi(os.Getenv("TRANSACTION_PROCESSOR_CLONE_DEPTH"))
+	if err != nil || depth < 0 {
+		return 0
+	}
+	return depth
+}
+
+// sparsePaths returns the paths checked out of the sources, configured as a
+// comma separated list in TRANSACTION_PROCESSOR_SPARSE_PATHS. When empty (the
+// default) the entire tree is checked out. Submodules outside these paths are
+// not initialized
+func sparsePaths() []string {
+	paths := []string{}
+	for _, p := range strings.Split(
+		os.Getenv("TRANSACTION_PROCESSOR_SPARSE_PATHS"),
+		",",
+	) {
+		p = strings.TrimSpace(p)
+		if p != "" {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// applySparseCheckout restricts the checkout in dir to the configured sparse
+// paths. Worktrees have their own sparse checkout configuration, so this is
+// applied to each of them as well as to the main checkout
+func applySparseCheckout(dir string) error {
+	paths := sparsePaths()
+	if len(paths) == 0 {
+		return nil
+	}
+	cmd := exec.Command(
+		"git",
+		append([]string{"sparse-checkout", "set", "--"}, paths...)...,
+	)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf(
+			"Sparse checkout failed: %v\n\n%v",
+			err,
+			string(out),
+		)
+	}
+	return nil
+}
+
+// shallowCommits returns the commits at the boundary of the history of a
+// shallow clone: the commits whose parents were not fetched. Returns nothing
+// if the main sources checkout has the full history
+func shallowCommits() map[string]bool {
+	ret := map[string]bool{}
+	b, err := ioutil.ReadFile(filepath.Join(sourcesDir(), ".git", "shallow"))
+	if err != nil {
+		return ret
+	}
+	for _, l := range strings.Split(string(b), "\n") {
+		l = strings.TrimSpace(l)
+		if l != "" {
+			ret[l] = true
+		}
+	}
+	return ret
+}
+
+// hasCommit returns true if the commit is present in the main sources
+// checkout
+func hasCommit(revision string) bool {
+	cmd := exec.Command(
+		"git",
+		"cat-file",
+		"-e",
+		fmt.Sprintf("%s^{commit}", revision),
+	)
+	cmd.Dir = sourcesDir()
+	return cmd.Run() == nil
+}
+
+// unshallow fetches the rest of the history of a shallow clone from the given
+// remote
+func unshallow(remote string) error {
+	if remote == "" {
+		return errors.New(
+			"No remote is reachable to fetch the full history of the sources from",
+		)
+	}
+	logging.Infof("Fetching the full history of the sources")
+	cmd := exec.Command("git", "fetch", "--unshallow", remote)
+	cmd.Dir = sourcesDir()
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Unshallowing failed: %v\n\n%v", err, string(out))
+	}
+	return nil
+}
+
+// ensureCommit makes sure the commit can be checked out of a shallow clone.
+// Commits older than the fetched history are fetched directly first, which
+// the origin can refuse, in which case the clone is unshallowed. Does nothing
+// for full clones, in which case the checkout itself reports unknown commits.
+// The commit is fetched from the given remote, and has to be present already
+// if remote is empty because no remote is reachable
+func ensureCommit(remote, revision string) error {
+	if len(shallowCommits()) == 0 || hasCommit(revision) {
+		return nil
+	}
+	if remote == "" {
+		return fmt.Errorf(
+			"Commit %s was not fetched before and no remote is reachable",
+			revision,
+		)
+	}
+	logging.Infof("Commit %s is not in the shallow clone, fetching it", revision)
+	depth := cloneDepth()
+	if depth == 0 {
+		depth = 1
+	}
+	cmd := exec.Command(
+		"git",
+		"fetch",
+		fmt.Sprintf("--depth=%d", depth),
+		remote,
+		revision,
+	)
+	cmd.Dir = sourcesDir()
+	out, err := cmd.CombinedOutput()
+	if err == nil && hasCommit(revision) {
+		return nil
+	}
+	logging.Infof(
+		"Fetching commit %s failed, unshallowing: %v\n\n%v",
+		revision,
+		err,
+		string(out),
+	)
+	return unshallow(remote)
+}
@@ -1,21 +1,21 @@
 package sources
 
 import (
-	"encoding/json"
+	"crypto/ed25519"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"sort"
-	"strconv"
+	"runtime/debug"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/coordinator/depcache"
 	"github.com/mit-dci/opencbdc-tctl/logging"
 )
 
@@ -31,6 +31,9 @@ type GitLogRecord struct {
 	Committer        GitLogPerson `json:"committer"`
 	CommittedString  string       `json:"committed_date,omitempty"`
 	Committed        time.Time    `json:"committed"`
+	// Number of the pull request this is the head commit of, or 0 for commits
+	// on the main branch
+	PullRequest int `json:"pullRequest,omitempty"`
 }
 
 type GitLogPerson struct {
@@ -39,13 +42,70 @@ type GitLogPerson struct {
 }
 
 type SourcesManager struct {
-	gitLog      []GitLogRecord
-	sourcesLock sync.Mutex
+	provider      SourceProvider
+	sourcesLock   sync.Mutex
+	ccacheEnabled bool
+	compileQueue  *compileQueue
+	// Commit history, replaced as a whole on every update such that readers
+	// can use it after releasing gitLogLock
+	gitLog     *gitLogSnapshot
+	gitLogLock sync.RWMutex
+	// Lock serializing the build environment setup of concurrent compilations
+	compileSetupLock     sync.Mutex
+	depCache             *depcache.DependencyCache
+	submoduleMirrorsLock sync.Mutex
+	// Branches and tags resolved for compilation, keyed by name
+	trackedRefs map[string]*TrackedRef
+	refsLock    sync.Mutex
+	// Build artifact retention
+	retention      RetentionPolicy
+	artifactsInUse func() []string
+	lastGCReport   *ArtifactGCReport
+	gcLock         sync.Mutex
+	// Failed compilations, most recent first
+	buildFailures     []*BuildFailure
+	buildFailuresLock sync.Mutex
+	// Key binaries archives are signed with, nil if signing is disabled
+	signingKey ed25519.PrivateKey
+	// Lock serializing the builds of binaries images and guarding their index
+	imagesLock sync.Mutex
 }
 
-func NewSourcesManager() *SourcesManager {
-	s := &SourcesManager{gitLog: []GitLogRecord{}, sourcesLock: sync.Mutex{}}
-	return s
+func NewSourcesManager() (*SourcesManager, error) {
+	s := &SourcesManager{
+		sourcesLock:      sync.Mutex{},
+		gitLog:           newGitLogSnapshot([]GitLogRecord{}),
+		gitLogLock:       sync.RWMutex{},
+		ccacheEnabled:    ccacheEnabledFromEnv(),
+		compileQueue:     newCompileQueue(compileConcurrencyFromEnv()),
+		compileSetupLock: sync.Mutex{},
+		depCache: depcache.NewDependencyCache(
+			depcache.PortFromEnv(),
+		),
+		submoduleMirrorsLock: sync.Mutex{},
+		refsLock:             sync.Mutex{},
+		retention:            retentionPolicyFromEnv(),
+		gcLock:               sync.Mutex{},
+		buildFailuresLock:    sync.Mutex{},
+	}
+	var err error
+	s.provider, err = s.sourceProviderFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if binarySigningEnabled() {
+		s.signingKey, err = loadOrCreateSigningKey()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load signing key: %v", err)
+		}
+		logging.Infof(
+			"Signing binaries, agents verify them with "+
+				"BINARIES_SIGNING_PUBLIC_KEY=%s",
+			base64.StdEncoding.EncodeToString(s.SigningPublicKey()),
+		)
+	}
+	go s.artifactGCLoop()
+	return s, nil
 }
 
 func sourcesParentDir() string {
@@ -63,9 +123,13 @@ func archivePath(commitHash string) (string, error) {
 	return filepath.Join(archiveDir, fmt.Sprintf("%s.tar.gz", commitHash)), nil
 }
 
+// BinariesArchivePath returns the path of the binaries archive for the given
+// commit, build type, target architecture and build configuration
 func BinariesArchivePath(
 	commitHash string,
 	profilingOrDebugging bool,
+	arch string,
+	cfg *common.BuildConfig,
 ) (string, error) {
 	if _, err := os.Stat(binariesDir()); os.IsNotExist(err) {
 		err = os.Mkdir(binariesDir(), 0755)
@@ -76,12 +140,39 @@ func BinariesArchivePath(
 	if profilingOrDebugging {
 		commitHash = fmt.Sprintf("%s-profiling", commitHash)
 	}
+	commitHash += archSuffix(arch)
+	if key := cfg.Key(); key != "" {
+		commitHash += "-" + key
+	}
 	return filepath.Join(
 		binariesDir(),
 		fmt.Sprintf("%s.tar.gz", commitHash),
 	), nil
 }
 
+// BinariesManifest returns the paths of all files in the binaries archive for
+// the given commit, relative to the directory agents run the binaries from
+// (the archive is extracted into sources/build on the agent)
+func BinariesManifest(
+	commitHash string,
+	profilingOrDebugging bool,
+	arch string,
+	cfg *common.BuildConfig,
+) ([]string, error) {
+	path, err := BinariesArchivePath(commitHash, profilingOrDebugging, arch, cfg)
+	if err != nil {
+		return nil, err
+	}
+	files, err := common.TarListFiles(path)
+	if err != nil {
+		return nil, err
+	}
+	for i := range files {
+		files[i] = filepath.Join("sources", "build", files[i])
+	}
+	return files, nil
+}
+
 func sourcesDirName() string {
 	return "sources"
 }
@@ -98,123 +189,356 @@ func binariesDir() string {
 
 func (s *SourcesManager) EnsureSourcesUpdated() error {
 	var err error
+	s.sourcesLock.Lock()
 	if _, err = os.Stat(sourcesDir()); os.IsNotExist(err) {
-		err = s.cloneSources()
+		err = s.provider.Clone()
 		if err != nil {
 			err = fmt.Errorf("Error cloning sources: %v", err)
 		}
 	} else {
-		err = s.updateSources()
+		err = s.provider.Update()
 		if err != nil {
 			err = fmt.Errorf("Error updating sources: %v", err)
 		}
 	}
+	s.sourcesLock.Unlock()
 	if err != nil {
 		return err
 	}
 	return s.updateCommitHistory()
 }
 
+// Compile builds the binaries for the given commit (or the head of the given
+// branch or tag), target architecture and build configuration, and stores
+// them in the binaries archive. Compilations are queued and executed by a
+// pool of workers that each have their own git worktree, such that multiple
+// commits can be compiled concurrently. If the same commit (and build type) is already being
+// compiled, Compile waits for that compilation to finish instead of starting
+// another one
 func (s *SourcesManager) Compile(
 	hash string,
 	profilingOrDebugging bool,
-	progress chan float64,
+	arch string,
+	cfg *common.BuildConfig,
+	progress chan CompileProgress,
 ) error {
 	defer func() {
 		if progress != nil {
-			progress <- 100
+			progress <- CompileProgress{Phase: CompilePhaseDone, Percent: 100}
 			close(progress)
 		}
 	}()
 
-	binariesPath := filepath.Join(sourcesDir(), "build")
-	path, err := BinariesArchivePath(hash, profilingOrDebugging)
+	hash, _, err := s.ResolveRef(hash)
 	if err != nil {
 		return err
 	}
 
-	if progress != nil {
-		progress <- 1
+	arch = NormalizeTargetArch(arch)
+	err = ValidateTargetArch(arch)
+	if err != nil {
+		return err
 	}
 
-	s.sourcesLock.Lock()
-	defer s.sourcesLock.Unlock()
+	if errs := cfg.Validate(); len(errs) > 0 {
+		return errs[0]
+	}
+
+	path, err := BinariesArchivePath(hash, profilingOrDebugging, arch, cfg)
+	if err != nil {
+		return err
+	}
 
 	if progress != nil {
-		progress <- 2
+		progress <- CompileProgress{Phase: CompilePhaseQueued, Percent: 1}
 	}
 
 	if _, err := os.Stat(path); !os.IsNotExist(err) {
 		// Already exists
-		return nil
+		touchArtifact(path)
+		return s.compileImage(hash, profilingOrDebugging, arch, cfg)
 	}
 
-	cmd := exec.Command("git", "checkout", hash)
-	cmd.Dir = sourcesDir()
-	err = cmd.Run()
-	if err != nil {
-		return err
-	}
-	logging.Infof(
-		"[Compile %s-%t]: Checkout complete",
+	job, inFlight, existing := s.compileQueue.enqueue(
+		path,
 		hash,
 		profilingOrDebugging,
+		arch,
 	)
+	if existing {
+		logging.Infof(
+			"[Compile %s-%t]: Waiting for in-flight compilation",
+			hash,
+			profilingOrDebugging,
+		)
+		<-inFlight.done
+		return inFlight.err
+	}
 
-	if progress != nil {
-		progress <- 5
+	w := s.compileQueue.acquire(job)
+	report := func(p CompileProgress) {
+		s.compileQueue.setProgress(job, p)
+		if progress != nil {
+			progress <- p
+		}
 	}
+	report(CompileProgress{Phase: CompilePhaseCheckout, Percent: 2})
 
-	cmd = exec.Command("git", "submodule", "sync")
-	cmd.Dir = sourcesDir()
-	err = cmd.Run()
+	err = func() (err error) {
+		// Return the worker to the pool even if the compilation panics,
+		// such that the queue doesn't lose a worker
+		defer func() {
+			if r := recover(); r != nil {
+				logging.Errorf(
+					"[Compile %s-%t]: Panic in worker %d: %v\n%s",
+					hash,
+					profilingOrDebugging,
+					w.id,
+					r,
+					debug.Stack(),
+				)
+				err = fmt.Errorf("compilation panicked: %v", r)
+			}
+			s.recordBuildResult(hash, profilingOrDebugging, arch, cfg.Key(), err)
+			s.compileQueue.finish(path, job, w, err)
+		}()
+		return s.compileInWorktree(
+			w,
+			hash,
+			profilingOrDebugging,
+			arch,
+			cfg,
+			path,
+			report,
+		)
+	}()
 	if err != nil {
 		return err
 	}
+	return s.compileImage(hash, profilingOrDebugging, arch, cfg)
+}
+
+// compileImage builds and pushes the binaries image after compiling, if
+// BINARIES_IMAGE_ON_COMPILE is set
+func (s *SourcesManager) compileImage(
+	hash string,
+	profilingOrDebugging bool,
+	arch string,
+	cfg *common.BuildConfig,
+) error {
+	if !binariesImagesOnCompile() {
+		return nil
+	}
+	_, err := s.BuildBinariesImage(hash, profilingOrDebugging, arch, cfg)
+	return err
+}
 
-	cmd = exec.Command("git", "submodule", "update", "--recursive")
-	cmd.Dir = sourcesDir()
-	err = cmd.Run()
+// compileInWorktree checks out the given commit in the worker's worktree,
+// builds it for the target architecture with the build configuration and
+// writes the binaries archive to path
+func (s *SourcesManager) compileInWorktree(
+	w *compileWorker,
+	hash string,
+	profilingOrDebugging bool,
+	arch string,
+	cfg *common.BuildConfig,
+	path string,
+	report func(CompileProgress),
+) error {
+	dir := w.dir
+	binariesPath := filepath.Join(dir, "build")
+
+	archEnv, err := targetArchEnv(arch)
+	if err != nil {
+		return err
+	}
+
+	err = s.provider.Checkout(dir, hash)
 	if err != nil {
 		return err
 	}
 	logging.Infof(
-		"[Compile %s-%t]: Update submodules complete",
+		"[Compile %s-%t]: Checkout complete in worker %d",
 		hash,
 		profilingOrDebugging,
+		w.id,
 	)
 
-	if progress != nil {
-		progress <- 10
-	}
+	report(CompileProgress{Phase: CompilePhaseSetup, Percent: 10})
 
-	os.RemoveAll(filepath.Join(sourcesDir(), "build"))
+	os.RemoveAll(filepath.Join(dir, "build"))
 	logging.Infof(
 		"[Compile %s-%t]: Cleaned build directory",
 		hash,
 		profilingOrDebugging,
 	)
 
+	// The build environment and dependency setup scripts install packages
+	// system-wide, so they cannot safely run concurrently
+	err = func() error {
+		s.compileSetupLock.Lock()
+		defer s.compileSetupLock.Unlock()
+		return s.setupBuildEnvironment(
+			dir,
+			hash,
+			profilingOrDebugging,
+			archEnv,
+			func(line string) {
+				report(CompileProgress{
+					Phase:   CompilePhaseSetup,
+					Percent: 10,
+					Line:    line,
+				})
+			},
+		)
+	}()
+	if err != nil {
+		return err
+	}
+
+	report(CompileProgress{Phase: CompilePhaseBuild, Percent: buildProgressStart})
+
+	cmd := exec.Command(
+		"bash",
+		filepath.Join(dir, "scripts", "build.sh"),
+	)
+	cmd.Dir = dir
+	env := append(os.Environ(), s.dependencyCacheEnv()...)
+	env = append(env, archEnv...)
+	if profilingOrDebugging {
+		env = append(env, "BUILD_PROFILING=1")
+	} else {
+		env = append(env, "BUILD_RELEASE=1")
+	}
+	// The build directory is wiped for every commit, so use ccache to avoid
+	// recompiling translation units that did not change
+	ccacheEnv := s.ccacheEnv(dir)
+	if len(ccacheEnv) > 0 {
+		env = append(env, ccacheEnv...)
+		logging.Infof(
+			"[Compile %s-%t]: Using compiler cache in %s",
+			hash,
+			profilingOrDebugging,
+			ccacheDir(),
+		)
+	}
+	if !cfg.Empty() {
+		logging.Infof(
+			"[Compile %s-%t]: Using build configuration %s: %s",
+			hash,
+			profilingOrDebugging,
+			cfg.Key(),
+			strings.Join(append(cfg.CMakeArgs(), cfg.Environ()...), " "),
+		)
+		env = append(env, cfg.Environ()...)
+		err = configureBuild(dir, env, cfg)
+		if err != nil {
+			return err
+		}
+	}
+	cmd.Env = env
+	buildPercent := float64(0)
+	out, err := runWithOutputLines(cmd, func(line string) {
+		// Builds consist of multiple targets, so never let the reported
+		// progress go backwards
+		if pct, ok := buildOutputPercent(line); ok && pct > buildPercent {
+			buildPercent = pct
+		}
+		report(CompileProgress{
+			Phase: CompilePhaseBuild,
+			Percent: buildProgressStart +
+				buildPercent*(buildProgressEnd-buildProgressStart)/100,
+			Line: line,
+		})
+	})
+	if err != nil {
+		return newBuildError("Build", err, out)
+	}
+
+	logging.Infof(
+		"[Compile %s-%t]: Build script complete",
+		hash,
+		profilingOrDebugging,
+	)
+	err = checkBuildConfig(binariesPath, cfg)
+	if err != nil {
+		return err
+	}
+	report(CompileProgress{Phase: CompilePhasePackage, Percent: buildProgressEnd})
+
+	proxy_path := filepath.Join(
+		dir,
+		"src",
+		"parsec",
+		"agent",
+		"runners",
+		"evm",
+		"rpc_proxy",
+	)
+	if _, err := os.Stat(proxy_path); !os.IsNotExist(err) {
+		logging.Infof(
+			"[Compile %s-%t]: Copying parsec/EVM RPC proxy",
+			hash,
+			profilingOrDebugging,
+		)
+		dest_proxy_path := filepath.Join(
+			binariesPath,
+			"src",
+			"parsec",
+			"agent",
+			"runners",
+			"evm",
+		)
+		common.CopyDir(proxy_path, dest_proxy_path)
+	}
+
+	err = common.CreateArchiveWithProgress(
+		binariesPath,
+		path,
+		archiveProgress(
+			CompilePhasePackage,
+			buildProgressEnd,
+			packageProgressEnd,
+			report,
+		),
+	)
+	if err != nil {
+		return err
+	}
+	return s.writeBinariesChecksums(path)
+}
+
+// setupBuildEnvironment runs the scripts that install the build tools and
+// dependencies from the sources checked out in dir, falling back to the legacy
+// configuration script for older commits that do not have them. Every line of
+// output of the scripts is passed to onLine
+func (s *SourcesManager) setupBuildEnvironment(
+	dir string,
+	hash string,
+	profilingOrDebugging bool,
+	archEnv []string,
+	onLine func(string),
+) error {
 	avoid_legacy_setup := true
 	var out []byte
-	var env []string
-	scriptsDir := filepath.Join(sourcesDir(), "scripts")
+	scriptsDir := filepath.Join(dir, "scripts")
 	{
 		fp := filepath.Join(scriptsDir, "install-build-tools.sh")
 		_, err := os.Stat(fp)
 		if err == nil {
-			cmd = exec.Command("bash", fp)
+			cmd := exec.Command("bash", fp)
 
-			cmd.Dir = sourcesDir()
-			env := os.Environ()
+			cmd.Dir = dir
+			env := append(os.Environ(), s.dependencyCacheEnv()...)
+			env = append(env, archEnv...)
 			if !profilingOrDebugging {
 				env = append(env, "BUILD_RELEASE=1")
 			}
 			cmd.Env = env
-			out, err := cmd.CombinedOutput()
+			out, err := runWithOutputLines(cmd, onLine)
 			if err != nil {
 				avoid_legacy_setup = false
-				return fmt.Errorf("Build-environment setup failed: %v\n\n%v", err, string(out))
+				return newBuildError("Build-environment setup", err, out)
 			} else {
 				logging.Infof(
 					"[Compile %s-%t]: Build-environment setup complete",
@@ -231,18 +555,19 @@ func (s *SourcesManager) Compile(
 		fp := filepath.Join(scriptsDir, "setup-dependencies.sh")
 		_, err := os.Stat(fp)
 		if err == nil {
-			cmd = exec.Command("bash", fp)
+			cmd := exec.Command("bash", fp)
 
-			cmd.Dir = sourcesDir()
-			env := os.Environ()
+			cmd.Dir = dir
+			env := append(os.Environ(), s.dependencyCacheEnv()...)
+			env = append(env, archEnv...)
 			if !profilingOrDebugging {
 				env = append(env, "BUILD_RELEASE=1")
 			}
 			cmd.Env = env
-			out, err := cmd.CombinedOutput()
+			out, err := runWithOutputLines(cmd, onLine)
 			if err != nil {
 				avoid_legacy_setup = false
-				return fmt.Errorf("Dependency installation failed: %v\n\n%v", err, string(out))
+				return newBuildError("Dependency installation", err, out)
 			} else {
 				logging.Infof(
 					"[Compile %s-%t]: Dependency installation complete",
@@ -264,20 +589,21 @@ func (s *SourcesManager) Compile(
 		fp := filepath.Join(scriptsDir, "configure.sh")
 		_, err := os.Stat(fp)
 		if err != nil {
-			return fmt.Errorf("Legacy configuration failed: %v\n\n%v", err, string(out))
+			return newBuildError("Legacy configuration", err, out)
 		}
 
-		cmd = exec.Command("bash", fp)
+		cmd := exec.Command("bash", fp)
 
-		cmd.Dir = sourcesDir()
-		env := os.Environ()
+		cmd.Dir = dir
+		env := append(os.Environ(), s.dependencyCacheEnv()...)
+		env = append(env, archEnv...)
 		if !profilingOrDebugging {
 			env = append(env, "BUILD_RELEASE=1")
 		}
 		cmd.Env = env
-		out, err := cmd.CombinedOutput()
+		out, err := runWithOutputLines(cmd, onLine)
 		if err != nil {
-			return fmt.Errorf("Legacy configuration failed: %v\n\n%v", err, string(out))
+			return newBuildError("Legacy configuration", err, out)
 		} else {
 			logging.Infof(
 				"[Compile %s-%t]: Legacy configuration complete",
@@ -286,387 +612,129 @@ func (s *SourcesManager) Compile(
 			)
 		}
 	}
-
-	if progress != nil {
-		progress <- 50
-	}
-
-	cmd = exec.Command(
-		"bash",
-		filepath.Join(sourcesDir(), "scripts", "build.sh"),
-	)
-	cmd.Dir = sourcesDir()
-	env = os.Environ()
-	if profilingOrDebugging {
-		env = append(env, "BUILD_PROFILING=1")
-	} else {
-		env = append(env, "BUILD_RELEASE=1")
-	}
-	cmd.Env = env
-	out, err = cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("Build failed: %v\n\n%v", err, string(out))
-	}
-
-	logging.Infof(
-		"[Compile %s-%t]: Build script complete",
-		hash,
-		profilingOrDebugging,
-	)
-	if progress != nil {
-		progress <- 90
-	}
-
-	proxy_path := filepath.Join(
-		sourcesDir(),
-		"src",
-		"parsec",
-		"agent",
-		"runners",
-		"evm",
-		"rpc_proxy",
-	)
-	if _, err := os.Stat(proxy_path); !os.IsNotExist(err) {
-		logging.Infof(
-			"[Compile %s-%t]: Copying parsec/EVM RPC proxy",
-			hash,
-			profilingOrDebugging,
-		)
-		dest_proxy_path := filepath.Join(
-			binariesPath,
-			"src",
-			"parsec",
-			"agent",
-			"runners",
-			"evm",
-		)
-		common.CopyDir(proxy_path, dest_proxy_path)
-	}
-
-	return common.CreateArchive(binariesPath, path)
-}
-
-type PRData struct {
-	Subject        string `json:"subject"`
-	AuthoredString string `json:"authored_date"`
+	return nil
 }
 
+// updateCommitHistory refreshes the revisions available for testing from the
+// source provider
 func (s *SourcesManager) updateCommitHistory() error {
 	s.sourcesLock.Lock()
-	defer s.sourcesLock.Unlock()
-	cmd := exec.Command(
-		"git",
-		"log",
-		`--pretty=format:{%n  $$$commit$$$: $$$%H$$$,%n  $$$parent$$$: $$$%P$$$,%n  $$$subject$$$: $$$%s$$$, %n  $$$author$$$: {%n    $$$name$$$: $$$%aN$$$,%n    $$$email$$$: $$$%aE$$$ },%n  $$$authored_date$$$: $$$%aD$$$%n ,%n  $$$committer$$$: {%n    $$$name$$$: $$$%cN$$$,%n    $$$email$$$: $$$%cE$$$},%n    $$$committed_date$$$: $$$%cD$$$%n%n},`,
-	)
-	cmd.Dir = sourcesDir()
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf(
-			"error updating commit history: %v\n%s",
-			err,
-			string(out),
-		)
-	}
-	outString := string(out[:len(out)-1])
-	outString = strings.ReplaceAll(outString, "\"", "\\\"")
-	outString = strings.ReplaceAll(outString, "$$$", "\"")
-	out = []byte(fmt.Sprintf("[%s]", outString))
-	newGitLog := []GitLogRecord{}
-	err = json.Unmarshal(out, &newGitLog)
+	log, err := s.provider.Log()
+	s.sourcesLock.Unlock()
 	if err != nil {
 		return err
 	}
+	s.swapGitLog(log)
+	return nil
+}
 
-	for i := range newGitLog {
-		newGitLog[i].Committed, _ = time.Parse(
-			"Mon, 2 Jan 2006 15:04:05 -0700",
-			newGitLog[i].CommittedString,
-		)
-		newGitLog[i].Authored, _ = time.Parse(
-			"Mon, 2 Jan 2006 15:04:05 -0700",
-			newGitLog[i].AuthoredString,
-		)
-		newGitLog[i].AuthoredString = ""
-		newGitLog[i].CommittedString = ""
-	}
-
-	cmd = exec.Command(
-		"git",
-		"fetch",
-		"origin",
-		"+refs/pull/*/head:refs/remotes/origin/pr-head/*",
-		"--no-recurse-submodules",
-	)
-	cmd.Dir = sourcesDir()
-	out, err = cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("Failed to fetch PRs: %v\n\n%s", err, string(out))
-	}
-
-	cmd = exec.Command(
-		"git",
-		"ls-remote",
-		"origin",
-	)
-	cmd.Dir = sourcesDir()
-	out, err = cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf(
-			"Failed to fetch remote PRs: %v\n\n%s",
-			err,
-			string(out),
-		)
-	}
-	logging.Infof("ls-remote:\n\n%s", string(out))
-	prs := map[int]bool{}
-	prHeadCommits := map[int]string{}
-	lines := strings.Split(string(out), "\n")
-	for _, line := range lines {
-		parts := strings.Split(line, "\t")
-		if len(parts) == 2 {
-			if strings.HasPrefix(parts[1], "refs/pull/") {
-				prString := strings.Replace(parts[1], "refs/pull/", "", 1)
-				prString = strings.Split(prString, "/")[0]
-				pr, err := strconv.Atoi(prString)
-				if err == nil {
-					if strings.HasSuffix(parts[1], "/merge") {
-						prs[pr] = true
-						logging.Infof(
-							"Detected (at one point) mergeable PR #%d",
-							pr,
-						)
-					} else if strings.HasSuffix(parts[1], "/head") {
-						prHeadCommits[pr] = parts[0]
-					}
-				}
-			}
+// defaultSeederPaths are the paths whose changes invalidate seeded shard data
+// unless configured otherwise
+var defaultSeederPaths = []string{"tools/shard-seeder/shard-seeder.cpp"}
+
+// seederPathsFromEnv returns the paths whose changes invalidate seeded shard
+// data, configured as a comma separated list in SEEDER_INVALIDATION_PATHS.
+// Directories invalidate the seeds if any file in them changes
+func seederPathsFromEnv() []string {
+	ret := []string{}
+	for _, p := range strings.Split(os.Getenv("SEEDER_INVALIDATION_PATHS"), ",") {
+		p = strings.TrimSpace(p)
+		if p != "" {
+			ret = append(ret, p)
 		}
 	}
-
-	prGitLogs := make([]GitLogRecord, 0)
-	for pr := range prHeadCommits {
-		mergeable := prs[pr]
-		cmd = exec.Command(
-			"git",
-			"log",
-			"-n",
-			"1",
-			`--pretty=format:{%n  $$$subject$$$: $$$%s$$$, $$$authored_date$$$: $$$%aD$$$%n }`,
-			prHeadCommits[pr],
-		)
-		cmd.Dir = sourcesDir()
-		out, err = cmd.CombinedOutput()
-		if err != nil {
-			logging.Warnf("git log for PR %d failed: %v", pr, err)
-			continue
-		}
-		outString := strings.ReplaceAll(string(out), "\"", "\\\"")
-		outString = strings.ReplaceAll(outString, "$$$", "\"")
-		out = []byte(outString)
-		var prData PRData
-		err = json.Unmarshal(out, &prData)
-		if err != nil {
-			logging.Warnf(
-				"Unmarshal JSON from log for PR %d failed: %v",
-				pr,
-				err,
-			)
-			continue
-		}
-		authored, err := time.Parse(
-			"Mon, 2 Jan 2006 15:04:05 -0700",
-			prData.AuthoredString,
-		)
-		if err == nil {
-			// Include non-mergeable (or already merged) PRs that are less than
-			// 48 hours old, and mergeable PRs that are less than 90 days old
-			if authored.After(time.Now().Add(-2*24*time.Hour)) ||
-				(mergeable && authored.After(time.Now().Add(-90*24*time.Hour))) {
-				// Yes we want this one!
-				prGitLogs = append(prGitLogs, GitLogRecord{
-					Authored:   authored,
-					Committed:  authored,
-					Subject:    fmt.Sprintf("PR #%d - %s", pr, prData.Subject),
-					CommitHash: prHeadCommits[pr],
-				})
-			}
-		} else {
-			logging.Warnf("Authored date for PR %d could not be parsed: %v", pr, err)
-		}
+	if len(ret) == 0 {
+		return defaultSeederPaths
 	}
-
-	sort.Slice(prGitLogs, func(i, j int) bool {
-		return prGitLogs[j].Authored.Before(prGitLogs[i].Authored)
-	})
-	s.gitLog = append(
-		append(append([]GitLogRecord{}, newGitLog[:3]...), prGitLogs...),
-		newGitLog[3:]...)
-
-	return nil
+	return ret
 }
 
-// FindMostRecentCommitChangingSeeder finds the most recent commit of or before
-// the given commit hash that changes the seeder logic. Used to not have to re-
-// seed the shards with every commit if the seeder logic hasn't changed.
-func (s *SourcesManager) FindMostRecentCommitChangingSeeder(
+// FindMostRecentCommitChangingPaths finds the most recent commit of or before
+// the given commit hash that changes any of the given files or directories. If
+// the source provider cannot tell which revision changed a file, the given
+// revision is returned
+func (s *SourcesManager) FindMostRecentCommitChangingPaths(
 	commitHash string,
+	paths []string,
 ) (string, error) {
-	s.sourcesLock.Lock()
-	defer s.sourcesLock.Unlock()
-	cmd := exec.Command(
-		"git",
-		"checkout",
-		commitHash,
-	)
-	cmd.Dir = sourcesDir()
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return "", fmt.Errorf(
-			"Failed to find seeder change commit - [git checkout %s] failed: %v\n\n%s",
-			commitHash,
-			err,
-			string(out),
-		)
+	ph, ok := s.provider.(pathHistory)
+	if !ok || len(paths) == 0 {
+		return commitHash, nil
 	}
-
-	cmd = exec.Command(
-		"git",
-		"log",
-		"-1",
-		"--pretty=format:%H",
-		"tools/shard-seeder/shard-seeder.cpp",
-	)
-	cmd.Dir = sourcesDir()
-	out, err = cmd.CombinedOutput()
-	if err != nil {
-		return "", fmt.Errorf(
-			"Failed to find seeder change commit - failed to execute git log: %v\n\n%s",
-			err,
-			string(out),
-		)
-	}
-	commitHash = strings.TrimSpace(string(out))
-
-	cmd = exec.Command(
-		"git",
-		"checkout",
-		os.Getenv("TRANSACTION_PROCESSOR_MAIN_BRANCH"),
-	)
-	cmd.Dir = sourcesDir()
-	out, err = cmd.CombinedOutput()
-	if err != nil {
-		return "", fmt.Errorf(
-			"Failed to find seeder change commit - [git checkout %s] failed: %v\n\n%s",
-			os.Getenv("TRANSACTION_PROCESSOR_MAIN_BRANCH"),
-			err,
-			string(out),
-		)
-	}
-	return commitHash, err
-}
-
-func (s *SourcesManager) cloneSources() error {
 	s.sourcesLock.Lock()
 	defer s.sourcesLock.Unlock()
-
-	gitUrl, err := url.Parse(os.Getenv("TRANSACTION_PROCESSOR_REPO_URL"))
-	if err != nil {
-		return err
-	}
-	if os.Getenv("TRANSACTION_PROCESSOR_ACCESS_TOKEN") != "" {
-		gitUrl.User = url.UserPassword(
-			os.Getenv("TRANSACTION_PROCESSOR_ACCESS_TOKEN"),
-			"x-oauth-basic",
-		)
-	}
-
-	cmd := exec.Command(
-		"git",
-		"clone",
-		gitUrl.String(),
-		sourcesDirName(),
-	)
-	cmd.Dir = sourcesParentDir()
-	err = cmd.Run()
-	if err != nil {
-		return fmt.Errorf(
-			"Failed to clone sources. Do you have the right token configured? %v",
-			err,
-		)
-	}
-
-	cmd = exec.Command("git", "submodule", "sync")
-	cmd.Dir = sourcesDir()
-	err = cmd.Run()
-	if err != nil {
-		return err
-	}
-
-	cmd = exec.Command("git", "submodule", "update", "--init", "--recursive")
-	cmd.Dir = sourcesDir()
-	err = cmd.Run()
-	if err != nil {
-		return err
-	}
-	return nil
+	return ph.LastChange(commitHash, paths)
 }
 
-func (s *SourcesManager) updateSources() error {
-	s.sourcesLock.Lock()
-	defer s.sourcesLock.Unlock()
-	cmd := exec.Command(
-		"git",
-		"checkout",
-		os.Getenv("TRANSACTION_PROCESSOR_MAIN_BRANCH"),
+// FindMostRecentCommitChangingSeeder finds the most recent commit of or before
+// the given commit hash that changes the seeder logic. Used to not have to re-
+// seed the shards with every commit if the seeder logic hasn't changed. If the
+// source provider cannot tell which revision changed a file, the given
+// revision is returned, meaning the shards are seeded for every revision
+func (s *SourcesManager) FindMostRecentCommitChangingSeeder(
+	commitHash string,
+) (string, error) {
+	return s.FindMostRecentCommitChangingPaths(
+		commitHash,
+		seederPathsFromEnv(),
 	)
-	cmd.Dir = sourcesDir()
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		logging.Errorf("Error on git checkout: %v", string(out))
-		return err
-	}
-	cmd = exec.Command("git", "pull")
-	cmd.Dir = sourcesDir()
-	out, err = cmd.CombinedOutput()
-	if err != nil {
-		logging.Errorf("Error on git pull: %v", string(out))
-		return err
-	}
-	return nil
 }
 
 func (s *SourcesManager) GetGitLog(
 	offset, limit int,
 	alwaysIncludeInitial bool,
 ) ([]GitLogRecord, error) {
-	if len(s.gitLog) == 0 {
+	log := s.gitLogSnapshot().records
+	if len(log) == 0 {
 		return []GitLogRecord{}, nil
 	}
-	if offset >= len(s.gitLog) {
+	if offset >= len(log) {
 		return []GitLogRecord{}, ErrGitLogOutOfBounds
 	}
 	end := offset + limit
-	if end > len(s.gitLog) {
-		end = len(s.gitLog)
+	if end > len(log) {
+		end = len(log)
 	}
 
-	ret := s.gitLog[offset:end]
+	// Copy the page, appending to a slice of the snapshot would overwrite
+	// the record following it
+	ret := make([]GitLogRecord, end-offset, end-offset+1)
+	copy(ret, log[offset:end])
 	if alwaysIncludeInitial {
-		ret = append(ret, s.gitLog[len(s.gitLog)-1])
+		ret = append(ret, log[len(log)-1])
 	}
 
 	return ret, nil
 }
 
 func (s *SourcesManager) CommitExists(hash string) bool {
-	for _, c := range s.gitLog {
-		if c.CommitHash == hash {
-			return true
+	_, ok := s.gitLogSnapshot().byHash[hash]
+	return ok
+}
+
+// MainlineHead returns the most recent commit of the main branch in the
+// commit history
+func (s *SourcesManager) MainlineHead() (string, error) {
+	for _, c := range s.gitLogSnapshot().records {
+		if c.PullRequest == 0 {
+			return c.CommitHash, nil
 		}
 	}
-	return false
+	return "", errors.New("The commit history is empty")
 }
+
+// PullRequestForCommit returns the number of the pull request the commit is
+// the head of, or zero if it isn't the head of any pull request in the
+// commit history
+func (s *SourcesManager) PullRequestForCommit(hash string) int {
+	for _, c := range s.gitLogSnapshot().records {
+		if c.CommitHash == hash && c.PullRequest > 0 {
+			return c.PullRequest
+		}
+	}
+	return 0
+}
+
 func (s *SourcesManager) ReadCommitArchive(hash string) ([]byte, error) {
 	path, err := archivePath(hash)
 	if err != nil {
@@ -677,10 +745,23 @@ func (s *SourcesManager) ReadCommitArchive(hash string) ([]byte, error) {
 			"source archive does not exist. Call MakeCommitArchive first!",
 		)
 	}
+	touchArtifact(path)
 	return ioutil.ReadFile(path)
 }
 
-func (s *SourcesManager) MakeCommitArchive(hash string) error {
+// MakeCommitArchive creates the source archive of the commit if it doesn't
+// exist yet. If progress is not nil, the bytes archived are reported to it
+// while the archive is created, and it is closed when done
+func (s *SourcesManager) MakeCommitArchive(
+	hash string,
+	progress chan CompileProgress,
+) error {
+	defer func() {
+		if progress != nil {
+			progress <- CompileProgress{Phase: CompilePhaseDone, Percent: 100}
+			close(progress)
+		}
+	}()
 	s.sourcesLock.Lock()
 	defer s.sourcesLock.Unlock()
 	path, err := archivePath(hash)
@@ -689,29 +770,20 @@ func (s *SourcesManager) MakeCommitArchive(hash string) error {
 	}
 	if _, err = os.Stat(path); !os.IsNotExist(err) {
 		// Already exists
+		touchArtifact(path)
 		return nil
 	}
 
-	cmd := exec.Command("git", "checkout", hash)
-	cmd.Dir = sourcesDir()
-	err = cmd.Run()
-	if err != nil {
-		return err
-	}
-
-	cmd = exec.Command("git", "submodule", "sync")
-	cmd.Dir = sourcesDir()
-	err = cmd.Run()
-	if err != nil {
-		return err
-	}
-
-	cmd = exec.Command("git", "submodule", "update", "--recursive")
-	cmd.Dir = sourcesDir()
-	err = cmd.Run()
-	if err != nil {
-		return err
+	var onProgress common.ArchiveProgressFunc
+	if progress != nil {
+		onProgress = archiveProgress(
+			CompilePhaseArchive,
+			0,
+			100,
+			func(p CompileProgress) {
+				progress <- p
+			},
+		)
 	}
-
-	return common.CreateArchive(sourcesDir(), path)
+	return s.provider.Archive(hash, path, onProgress)
 }
@@ -0,0 +1,150 @@
+package sources
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/coordinator/depcache"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// submoduleMirrorsDir returns the directory that holds the local mirrors of
+// the submodule repositories
+func submoduleMirrorsDir() string {
+	return filepath.Join(common.DataDir(), "depcache", "git")
+}
+
+var unsafeMirrorPathChars = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+// submoduleMirrorPath returns the path of the local mirror for the given
+// submodule URL
+func submoduleMirrorPath(url string) string {
+	name := strings.TrimSuffix(url, ".git")
+	name = unsafeMirrorPathChars.ReplaceAllString(name, "_")
+	return filepath.Join(submoduleMirrorsDir(), name+".git")
+}
+
+// DependencyCache returns the caching proxy for third-party dependencies
+func (s *SourcesManager) DependencyCache() *depcache.DependencyCache {
+	return s.depCache
+}
+
+// dependencyCacheEnv returns the environment variables that point the build
+// scripts at the dependency cache, or nothing if the cache is disabled
+func (s *SourcesManager) dependencyCacheEnv() []string {
+	proxy := s.depCache.ProxyURL()
+	if proxy == "" {
+		return []string{}
+	}
+	return []string{
+		"http_proxy=" + proxy,
+		"HTTP_PROXY=" + proxy,
+		"no_proxy=localhost,127.0.0.1",
+		"NO_PROXY=localhost,127.0.0.1",
+		"DEPENDENCY_CACHE_URL=" + proxy + "/fetch?url=",
+	}
+}
+
+// updateSubmoduleMirrors makes sure there is an up-to-date local mirror for
+// every submodule declared in the .gitmodules of the sources checked out in
+// dir. If a mirror cannot be updated because the upstream is unavailable, the
+// existing mirror is used as-is. Returns the git configuration (as
+// environment variables) that redirects the submodule fetches to the mirrors
+func (s *SourcesManager) updateSubmoduleMirrors(dir string) []string {
+	if !s.depCache.Enabled() {
+		return []string{}
+	}
+
+	cmd := exec.Command(
+		"git",
+		"config",
+		"-f",
+		".gitmodules",
+		"--get-regexp",
+		`^submodule\..*\.url$`,
+	)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		// No submodules
+		return []string{}
+	}
+
+	s.submoduleMirrorsLock.Lock()
+	defer s.submoduleMirrorsLock.Unlock()
+
+	mirrors := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		parts := strings.Fields(line)
+		if len(parts) != 2 {
+			continue
+		}
+		url := parts[1]
+		if !strings.Contains(url, "://") && !strings.Contains(url, "@") {
+			// Relative submodule URLs resolve against the main repository
+			continue
+		}
+		path := submoduleMirrorPath(url)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			logging.Infof("Creating submodule mirror for %s", url)
+			err = os.MkdirAll(submoduleMirrorsDir(), 0755)
+			if err == nil {
+				cmd = exec.Command("git", "clone", "--mirror", url, path)
+				out, err = cmd.CombinedOutput()
+			}
+			if err != nil {
+				logging.Warnf(
+					"Unable to mirror submodule %s: %v\n%s",
+					url,
+					err,
+					string(out),
+				)
+				os.RemoveAll(path)
+				continue
+			}
+		} else {
+			cmd = exec.Command("git", "remote", "update", "--prune")
+			cmd.Dir = path
+			out, err = cmd.CombinedOutput()
+			if err != nil {
+				logging.Warnf(
+					"Unable to update submodule mirror %s, using cached copy: %v\n%s",
+					url,
+					err,
+					string(out),
+				)
+			}
+		}
+		mirrors[url] = path
+	}
+
+	// Allow cloning the submodules from the local mirrors, which newer git
+	// versions refuse by default, and rewrite the submodule URLs to them
+	env := []string{
+		"GIT_CONFIG_KEY_0=protocol.file.allow",
+		"GIT_CONFIG_VALUE_0=always",
+	}
+	i := 1
+	for url, path := range mirrors {
+		env = append(
+			env,
+			fmt.Sprintf("GIT_CONFIG_KEY_%d=url.%s.insteadOf", i, path),
+			fmt.Sprintf("GIT_CONFIG_VALUE_%d=%s", i, url),
+		)
+		i++
+	}
+	return append(env, fmt.Sprintf("GIT_CONFIG_COUNT=%d", i))
+}
+
+// ClearSubmoduleMirrors removes the local mirrors of the submodules
+func (s *SourcesManager) ClearSubmoduleMirrors() error {
+	s.submoduleMirrorsLock.Lock()
+	defer s.submoduleMirrorsLock.Unlock()
+	logging.Infof("Clearing submodule mirrors")
+	return os.RemoveAll(submoduleMirrorsDir())
+}
@@ -0,0 +1,219 @@
+package sources
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// tarballSnapshot is a revision of the sources published on a tarball server
+type tarballSnapshot struct {
+	ID        string       `json:"id"`
+	Parent    string       `json:"parent"`
+	Subject   string       `json:"subject"`
+	Author    GitLogPerson `json:"author"`
+	Committed time.Time    `json:"date"`
+}
+
+// tarballSourceProvider obtains the sources from a (read-only) HTTP server
+// publishing snapshots of the sources as tarballs. The server at
+// TARBALL_SOURCES_URL must serve an index.json listing the snapshots, and
+// the snapshots themselves as <id>.tar.gz with the repository root (including
+// the sources of all dependencies) at the root of the archive. If
+// TARBALL_SOURCES_TOKEN is set, it's sent as bearer token
+type tarballSourceProvider struct {
+	baseURL string
+	token   string
+	client  *http.Client
+	// Lock serializing the downloads of snapshots, such that concurrent
+	// compilations of the same snapshot only download it once
+	downloadLock sync.Mutex
+}
+
+func newTarballSourceProvider() (*tarballSourceProvider, error) {
+	base := os.Getenv("TARBALL_SOURCES_URL")
+	if base == "" {
+		return nil, fmt.Errorf(
+			"TARBALL_SOURCES_URL is required for the tarball source provider",
+		)
+	}
+	return &tarballSourceProvider{
+		baseURL: strings.TrimSuffix(base, "/"),
+		token:   os.Getenv("TARBALL_SOURCES_TOKEN"),
+		client:  &http.Client{Timeout: 30 * time.Minute},
+	}, nil
+}
+
+func (p *tarballSourceProvider) Name() string {
+	return "tarball"
+}
+
+// snapshotsDir returns the directory downloaded snapshots are cached in
+func snapshotsDir() string {
+	return filepath.Join(common.DataDir(), "snapshots")
+}
+
+// tarballIndexPath returns the path the last fetched index is stored at, from
+// which Log reads the available snapshots
+func tarballIndexPath() string {
+	return filepath.Join(sourcesDir(), "index.json")
+}
+
+// get downloads the given file from the tarball server to the writer
+func (p *tarballSourceProvider) get(name string, w io.Writer) error {
+	req, err := http.NewRequest("GET", p.baseURL+"/"+name, nil)
+	if err != nil {
+		return err
+	}
+	if p.token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("Downloading %s returned status %d", name, resp.StatusCode)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// CheckConnectivity downloads the index of the tarball server
+func (p *tarballSourceProvider) CheckConnectivity() error {
+	return p.get("index.json", ioutil.Discard)
+}
+
+func (p *tarballSourceProvider) Clone() error {
+	err := os.MkdirAll(sourcesDir(), 0755)
+	if err != nil {
+		return err
+	}
+	return p.Update()
+}
+
+// Update fetches the index of the available snapshots
+func (p *tarballSourceProvider) Update() error {
+	f, err := os.Create(tarballIndexPath() + ".tmp")
+	if err != nil {
+		return err
+	}
+	err = p.get("index.json", f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("Unable to fetch snapshot index: %v", err)
+	}
+	return os.Rename(tarballIndexPath()+".tmp", tarballIndexPath())
+}
+
+func (p *tarballSourceProvider) Log() ([]GitLogRecord, error) {
+	b, err := ioutil.ReadFile(tarballIndexPath())
+	if err != nil {
+		return nil, err
+	}
+	snapshots := []tarballSnapshot{}
+	err = json.Unmarshal(b, &snapshots)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse snapshot index: %v", err)
+	}
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		return snapshots[i].Committed.After(snapshots[j].Committed)
+	})
+	log := make([]GitLogRecord, len(snapshots))
+	for i, sn := range snapshots {
+		log[i] = GitLogRecord{
+			CommitHash:       sn.ID,
+			ParentCommitHash: sn.Parent,
+			Subject:          sn.Subject,
+			Author:           sn.Author,
+			Authored:         sn.Committed,
+			Committer:        sn.Author,
+			Committed:        sn.Committed,
+		}
+	}
+	return log, nil
+}
+
+// snapshot returns the path of the downloaded tarball of the given snapshot,
+// downloading it first if it's not cached yet
+func (p *tarballSourceProvider) snapshot(revision string) (string, error) {
+	if strings.ContainsAny(revision, "/\\") || strings.HasPrefix(revision, ".") {
+		return "", fmt.Errorf("Invalid snapshot %s", revision)
+	}
+	p.downloadLock.Lock()
+	defer p.downloadLock.Unlock()
+
+	path := filepath.Join(snapshotsDir(), fmt.Sprintf("%s.tar.gz", revision))
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+	err := os.MkdirAll(snapshotsDir(), 0755)
+	if err != nil {
+		return "", err
+	}
+	logging.Infof("Downloading source snapshot %s", revision)
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return "", err
+	}
+	err = p.get(fmt.Sprintf("%s.tar.gz", revision), f)
+	f.Close()
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return "", err
+	}
+	return path, os.Rename(path+".tmp", path)
+}
+
+// extract replaces the contents of dir with the sources of the snapshot
+func (p *tarballSourceProvider) extract(dir, revision string) error {
+	path, err := p.snapshot(revision)
+	if err != nil {
+		return err
+	}
+	err = os.RemoveAll(dir)
+	if err != nil {
+		return err
+	}
+	// TarExtract extracts into a folder named like the archive
+	archive := dir + ".tar.gz"
+	err = common.CopyFile(path, archive)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(archive)
+	return common.TarExtract(archive)
+}
+
+func (p *tarballSourceProvider) Checkout(dir, revision string) error {
+	return p.extract(dir, revision)
+}
+
+func (p *tarballSourceProvider) Archive(
+	revision, path string,
+	progress common.ArchiveProgressFunc,
+) error {
+	tmp, err := ioutil.TempDir(snapshotsDir(), "archive-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	dir := filepath.Join(tmp, "sources")
+	err = p.extract(dir, revision)
+	if err != nil {
+		return err
+	}
+	return common.CreateArchiveWithProgress(dir, path, progress)
+}
@@ -0,0 +1,220 @@
+package testruns
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+)
+
+// abortCheckInterval is the interval at which the abort conditions of a
+// running test run are evaluated
+const abortCheckInterval = 5 * time.Second
+
+// abortThroughputWindow is the number of seconds of live metrics the
+// throughput is averaged over when evaluating the minimum throughput. The
+// window ends liveMetricsInterval ago, since the live metrics lag behind
+const abortThroughputWindow = 10
+
+// validateAbortConditions checks that the abort conditions of the test run
+// are complete and not negative
+func (t *TestRunManager) validateAbortConditions(tr *common.TestRun) []error {
+	ret := []error{}
+	ac := tr.AbortConditions
+	if ac == nil {
+		return ret
+	}
+	if ac.MinThroughput < 0 || ac.MinThroughputSeconds < 0 ||
+		ac.MaxRoleCrashes < 0 || ac.AgentUnreachableSeconds < 0 {
+		ret = append(ret, fmt.Errorf("Abort conditions cannot be negative"))
+	}
+	if ac.MaxRoleCrashes > 0 {
+		ret = append(ret, fmt.Errorf(
+			"Crashed roles are not restarted, so role crashes cannot be"+
+				" tolerated",
+		))
+	}
+	if (ac.MinThroughput > 0) != (ac.MinThroughputSeconds > 0) {
+		ret = append(ret, fmt.Errorf(
+			"The minimum throughput abort condition needs both a throughput"+
+				" and a number of seconds",
+		))
+	}
+	return ret
+}
+
+// recordAbortTrigger records the abort condition that aborts the test run.
+// Returns false if the test run was already aborted by another condition
+func (t *TestRunManager) recordAbortTrigger(
+	tr *common.TestRun,
+	trigger *common.AbortTrigger,
+) bool {
+	t.abortTriggerLock.Lock()
+	defer t.abortTriggerLock.Unlock()
+	if tr.AbortTrigger != nil {
+		return false
+	}
+	trigger.Triggered = time.Now()
+	tr.AbortTrigger = trigger
+	t.WriteLog(
+		tr,
+		"Abort condition %s triggered: %s",
+		trigger.Condition,
+		trigger.Reason,
+	)
+	return true
+}
+
+// recordRoleCrash is called for every command of the test run that failed,
+// except the ones failed on purpose. It records the crash of the role the
+// command was started for as the abort trigger of the test run. Crashed roles are not restarted, so the test run can't continue
+// without them and every crash aborts it
+func (t *TestRunManager) recordRoleCrash(
+	tr *common.TestRun,
+	c *common.ExecutedCommand,
+) {
+	ref, ok := t.commandRole(c.CommandID)
+	if !ok {
+		// Not a command of a role, such as a command run during setup
+		return
+	}
+	t.recordAbortTrigger(tr, &common.AbortTrigger{
+		Condition: common.AbortConditionRoleCrashes,
+		Reason: fmt.Sprintf(
+			"%s %d crashed: command %s [%s] exited with code %d",
+			ref.Role,
+			ref.Index,
+			c.CommandID,
+			c.Description,
+			c.ExitCode,
+		),
+		Role:    ref.Role,
+		Index:   ref.Index,
+		AgentID: c.AgentID,
+	})
+}
+
+// WatchAbortConditions is run in a goroutine while the roles of the test run
+// execute, to evaluate the throughput and agent abort conditions of the test
+// run. When one of them triggers, it is recorded and a failure is sent to
+// `failures` such that RunBinaries aborts the test run and collects the logs
+// and outputs as it does for a crashed role. When `cancel` is closed, the
+// watching stops
+func (t *TestRunManager) WatchAbortConditions(
+	tr *common.TestRun,
+	failures chan *common.ExecutedCommand,
+	cancel chan bool,
+) {
+	ac := tr.AbortConditions
+	if ac == nil || (ac.MinThroughput <= 0 && ac.AgentUnreachableSeconds <= 0) {
+		return
+	}
+
+	agents := map[int32]bool{}
+	for _, r := range tr.Roles {
+		agents[r.AgentID] = true
+	}
+	unreachableSince := map[int32]time.Time{}
+	belowSince := time.Time{}
+	for {
+		select {
+		case <-cancel:
+			return
+		case <-time.After(abortCheckInterval):
+		}
+
+		var trigger *common.AbortTrigger
+		if ac.AgentUnreachableSeconds > 0 {
+			limit := time.Duration(ac.AgentUnreachableSeconds) * time.Second
+			for agentID := range agents {
+				if _, err := t.coord.GetAgent(agentID); err == nil {
+					delete(unreachableSince, agentID)
+					continue
+				}
+				since, ok := unreachableSince[agentID]
+				if !ok {
+					unreachableSince[agentID] = time.Now()
+					continue
+				}
+				if time.Since(since) >= limit {
+					trigger = &common.AbortTrigger{
+						Condition: common.AbortConditionAgentUnreachable,
+						Reason: fmt.Sprintf(
+							"agent %d was unreachable for %v",
+							agentID,
+							time.Since(since).Round(time.Second),
+						),
+						AgentID: agentID,
+					}
+					break
+				}
+			}
+		}
+
+		if trigger == nil && ac.MinThroughput > 0 {
+			throughput, ok := t.recentThroughput(tr)
+			if !ok || t.IsPaused(tr) || throughput >= ac.MinThroughput {
+				belowSince = time.Time{}
+			} else if belowSince.IsZero() {
+				belowSince = time.Now()
+			} else if time.Since(belowSince) >=
+				time.Duration(ac.MinThroughputSeconds)*time.Second {
+				trigger = &common.AbortTrigger{
+					Condition: common.AbortConditionThroughput,
+					Reason: fmt.Sprintf(
+						"throughput stayed below %.1f tx/s for %v (%.1f tx/s)",
+						ac.MinThroughput,
+						time.Since(belowSince).Round(time.Second),
+						throughput,
+					),
+				}
+			}
+		}
+
+		if trigger == nil {
+			continue
+		}
+		if t.recordAbortTrigger(tr, trigger) {
+			select {
+			case failures <- &common.ExecutedCommand{
+				AgentID:     trigger.AgentID,
+				Description: fmt.Sprintf("Abort condition %s", trigger.Condition),
+				ExitCode:    -1,
+				Completed:   time.Now(),
+			}:
+			default:
+			}
+		}
+		return
+	}
+}
+
+// recentThroughput returns the average throughput of the test run over the
+// abortThroughputWindow of live metrics. Returns false if the load generators
+// have not produced any samples yet
+func (t *TestRunManager) recentThroughput(tr *common.TestRun) (float64, bool) {
+	points, ok := t.LiveMetrics(tr)
+	if !ok || len(points) == 0 {
+		return 0, false
+	}
+	end := time.Now().Add(-liveMetricsInterval).Unix()
+	count := float64(0)
+	for _, p := range points {
+		if p.Time > end-abortThroughputWindow && p.Time <= end {
+			count += p.Throughput
+		}
+	}
+	return count / abortThroughputWindow, true
+}
+
+// abortFailureClass returns the failure class of a test run aborted by the
+// given condition
+func abortFailureClass(c common.AbortCondition) common.FailureClass {
+	switch c {
+	case common.AbortConditionThroughput:
+		return common.FailureClassDegraded
+	case common.AbortConditionAgentUnreachable:
+		return common.FailureClassInfrastructure
+	}
+	return common.FailureClassSUTCrash
+}
@@ -0,0 +1,94 @@
+package testruns
+
+import (
+	"fmt"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+)
+
+// acceleratorKinds are the kinds of accelerators roles can require
+var acceleratorKinds = map[string]bool{
+	common.AcceleratorGPU:    true,
+	common.AcceleratorNeuron: true,
+	common.AcceleratorFPGA:   true,
+}
+
+// agentAccelerators returns the number of accelerators of each kind the agent
+// the role runs on has. For connected agents these are the accelerators the
+// agent reported, for agents that are yet to be spawned the ones of their
+// launch template. A count of -1 means the template has accelerators of that
+// kind, but not how many
+func (t *TestRunManager) agentAccelerators(
+	r *common.TestRunRole,
+) map[string]int {
+	ret := map[string]int{}
+	if r.AgentID > 0 {
+		a, err := t.coord.GetAgent(r.AgentID)
+		if err == nil {
+			for _, acc := range a.SystemInfo.Accelerators {
+				ret[acc.Kind]++
+			}
+			return ret
+		}
+	}
+	if r.AwsLaunchTemplateID != "" {
+		lt, err := t.awsm.GetLaunchTemplate(r.AwsLaunchTemplateID)
+		if err == nil && lt.Accelerator != "" {
+			ret[lt.Accelerator] = -1
+			if lt.AcceleratorCount > 0 {
+				ret[lt.Accelerator] = lt.AcceleratorCount
+			}
+		}
+	}
+	return ret
+}
+
+// validateAccelerators checks that the roles requiring accelerators are
+// placed on agents, or launch templates, that have them. Colocated roles
+// require them from the agent of their host role. Since spawned agents only
+// report their accelerators once they are online, this is checked again
+// after they have connected
+func (t *TestRunManager) validateAccelerators(
+	roles []*common.TestRunRole,
+) []error {
+	ret := []error{}
+	for _, r := range roles {
+		if r.Accelerator == "" {
+			continue
+		}
+		if !acceleratorKinds[r.Accelerator] {
+			ret = append(ret, fmt.Errorf(
+				"%s %d requires unknown accelerator kind %s",
+				r.Role,
+				r.Index,
+				r.Accelerator,
+			))
+			continue
+		}
+		host, err := hostRole(roles, r)
+		if err != nil {
+			ret = append(ret, err)
+			continue
+		}
+		// Reported by validateAgentPools until an agent is chosen
+		if unassignedPoolRole(host) {
+			continue
+		}
+		required := r.AcceleratorCount
+		if required <= 0 {
+			required = 1
+		}
+		available := t.agentAccelerators(host)[r.Accelerator]
+		if available == 0 || (available > 0 && available < required) {
+			ret = append(ret, fmt.Errorf(
+				"%s %d requires %d %s accelerator(s), but its agent has %d",
+				r.Role,
+				r.Index,
+				required,
+				r.Accelerator,
+				available,
+			))
+		}
+	}
+	return ret
+}
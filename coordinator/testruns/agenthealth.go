@@ -0,0 +1,351 @@
+package testruns
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/coordinator"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// The thresholds above which an agent is considered saturated. The CPU is
+// saturated if it is above the threshold for at least the given fraction of
+// the samples, such that a short spike during startup doesn't count
+const (
+	saturatedCPUPercent     = 90
+	saturatedCPUFraction    = 0.25
+	saturatedMemUsedPercent = 95
+	// In kB
+	saturatedDiskAvailable = 1 << 20
+)
+
+// agentHealthFields is the number of fields on each line of an agent health
+// file: the unix timestamp in nanoseconds, the CPU utilization, the total and
+// available memory, the available disk space and the network throughput
+// received and sent
+const agentHealthFields = 7
+
+// AgentHealthSummary is the utilization of an agent over the part of a test
+// run it reported its health for
+type AgentHealthSummary struct {
+	AgentID int32                    `json:"agentID"`
+	Roles   []common.TestRunRoleRef  `json:"roles"`
+	Samples int                      `json:"samples"`
+	Latest  common.AgentHealthSample `json:"latest"`
+	CPUAvg  float64                  `json:"cpuAvg"`
+	CPUMax  float64                  `json:"cpuMax"`
+	// The highest percentage of memory in use
+	MemUsedMax float64 `json:"memUsedMax"`
+	// The lowest available disk space, in kB
+	DiskAvailableMin int64   `json:"diskAvailableMin"`
+	NetRxMax         float64 `json:"netRxMax"`
+	NetTxMax         float64 `json:"netTxMax"`
+	// The resources the agent saturated: "cpu", "memory" and/or "disk"
+	Saturated []string `json:"saturated"`
+}
+
+// agentHealthDir returns the directory the health samples of the agents of
+// the test run are recorded in, one file per agent
+func agentHealthDir(tr *common.TestRun) string {
+	return filepath.Join(
+		common.DataDir(),
+		fmt.Sprintf("testruns/%s/health", tr.ID),
+	)
+}
+
+// recordAgentHealth is set as the agent health func of the coordinator. If
+// the agent is part of a running test run, the sample is appended to the
+// health file of the agent in that test run, and streamed to the users
+// following the test run
+func (t *TestRunManager) recordAgentHealth(
+	agentID int32,
+	s common.AgentHealthSample,
+) {
+	tr := t.agentInUse(nil, agentID)
+	if tr == nil {
+		return
+	}
+	line := fmt.Sprintf(
+		"%d %f %d %d %d %f %f\n",
+		s.Time.UnixNano(),
+		s.CPUPercent,
+		s.MemTotal,
+		s.MemAvailable,
+		s.DiskAvailable,
+		s.NetRxBytesPerSec,
+		s.NetTxBytesPerSec,
+	)
+	err := t.appendAgentHealth(tr, agentID, line)
+	if err != nil {
+		logging.Warnf(
+			"Unable to record health of agent %d for test run %s: %v",
+			agentID,
+			tr.ID,
+			err,
+		)
+	}
+	t.ev <- coordinator.Event{
+		Type: coordinator.EventTypeAgentHealth,
+		Payload: coordinator.AgentHealthPayload{
+			TestRunID: tr.ID,
+			AgentID:   agentID,
+			Sample:    s,
+		},
+	}
+}
+
+// appendAgentHealth appends the line to the health file of the agent in the
+// test run
+func (t *TestRunManager) appendAgentHealth(
+	tr *common.TestRun,
+	agentID int32,
+	line string,
+) error {
+	t.agentHealthLock.Lock()
+	defer t.agentHealthLock.Unlock()
+	err := os.MkdirAll(agentHealthDir(tr), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(
+		filepath.Join(agentHealthDir(tr), fmt.Sprintf("%d.txt", agentID)),
+		os.O_WRONLY|os.O_CREATE|os.O_APPEND,
+		0644,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(line)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// agentHealthFiles returns the IDs of the agents that have health samples
+// recorded for the test run, and the paths of their health files
+func agentHealthFiles(tr *common.TestRun) (map[int32]string, error) {
+	entries, err := ioutil.ReadDir(agentHealthDir(tr))
+	if os.IsNotExist(err) {
+		return map[int32]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ret := map[int32]string{}
+	for _, e := range entries {
+		id, err := strconv.ParseInt(strings.TrimSuffix(e.Name(), ".txt"), 10, 32)
+		if err != nil || e.IsDir() {
+			continue
+		}
+		ret[int32(id)] = filepath.Join(agentHealthDir(tr), e.Name())
+	}
+	return ret, nil
+}
+
+// readAgentHealth calls f for each sample in the health file at path
+func readAgentHealth(
+	path string,
+	f func(common.AgentHealthSample) error,
+) error {
+	return readSampleFile(path, agentHealthFields, func(v []float64) error {
+		return f(common.AgentHealthSample{
+			Time:             time.Unix(0, int64(v[0])),
+			CPUPercent:       v[1],
+			MemTotal:         int64(v[2]),
+			MemAvailable:     int64(v[3]),
+			DiskAvailable:    int64(v[4]),
+			NetRxBytesPerSec: v[5],
+			NetTxBytesPerSec: v[6],
+		})
+	})
+}
+
+// agentRoles returns the roles of the test run that run on the agent
+func agentRoles(tr *common.TestRun, agentID int32) []common.TestRunRoleRef {
+	ret := []common.TestRunRoleRef{}
+	for _, r := range tr.Roles {
+		if r.AgentID == agentID {
+			ret = append(ret, common.TestRunRoleRef{Role: r.Role, Index: r.Index})
+		}
+	}
+	return ret
+}
+
+// AgentHealth summarizes the utilization of the agents of the test run from
+// the health samples they reported while it ran, and marks the agents that
+// saturated their CPU, memory or disk. Available while the test run is
+// running, as well as after
+func (t *TestRunManager) AgentHealth(
+	tr *common.TestRun,
+) ([]AgentHealthSummary, error) {
+	files, err := agentHealthFiles(tr)
+	if err != nil {
+		return nil, err
+	}
+	ret := []AgentHealthSummary{}
+	for agentID, path := range files {
+		sum := AgentHealthSummary{
+			AgentID:   agentID,
+			Roles:     agentRoles(tr, agentID),
+			Saturated: []string{},
+		}
+		cpuSaturated := 0
+		err = readAgentHealth(path, func(s common.AgentHealthSample) error {
+			if sum.Samples == 0 || s.DiskAvailable < sum.DiskAvailableMin {
+				sum.DiskAvailableMin = s.DiskAvailable
+			}
+			sum.Samples++
+			sum.Latest = s
+			sum.CPUAvg += s.CPUPercent
+			if s.CPUPercent > sum.CPUMax {
+				sum.CPUMax = s.CPUPercent
+			}
+			if s.CPUPercent >= saturatedCPUPercent {
+				cpuSaturated++
+			}
+			if s.MemUsedPercent() > sum.MemUsedMax {
+				sum.MemUsedMax = s.MemUsedPercent()
+			}
+			if s.NetRxBytesPerSec > sum.NetRxMax {
+				sum.NetRxMax = s.NetRxBytesPerSec
+			}
+			if s.NetTxBytesPerSec > sum.NetTxMax {
+				sum.NetTxMax = s.NetTxBytesPerSec
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Error reading %s: %v", path, err)
+		}
+		if sum.Samples == 0 {
+			continue
+		}
+		sum.CPUAvg /= float64(sum.Samples)
+		if float64(cpuSaturated) >= saturatedCPUFraction*float64(sum.Samples) {
+			sum.Saturated = append(sum.Saturated, "cpu")
+		}
+		if sum.MemUsedMax >= saturatedMemUsedPercent {
+			sum.Saturated = append(sum.Saturated, "memory")
+		}
+		// Agents that could not determine their disk space report -1
+		if sum.DiskAvailableMin >= 0 &&
+			sum.DiskAvailableMin < saturatedDiskAvailable {
+			sum.Saturated = append(sum.Saturated, "disk")
+		}
+		ret = append(ret, sum)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].AgentID < ret[j].AgentID
+	})
+	return ret, nil
+}
+
+// writeAgentHealthSeries writes the utilization of each agent of the test run
+// to the series directory. The CPU utilization is overlaid with the system
+// throughput and its dips, such that saturated agents can be correlated with
+// the throughput they caused
+func (t *TestRunManager) writeAgentHealthSeries(
+	tr *common.TestRun,
+	dir string,
+	idx *timeSeriesIndex,
+) error {
+	files, err := agentHealthFiles(tr)
+	if err != nil {
+		return err
+	}
+	ids := make([]int32, 0, len(files))
+	for id := range files {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	var overlay []string
+	for _, s := range idx.Series {
+		if s.ID == "throughput" {
+			overlay = []string{"throughput", "throughput-dips"}
+		}
+	}
+	for _, id := range ids {
+		roles := []string{}
+		for _, r := range agentRoles(tr, id) {
+			roles = append(roles, fmt.Sprintf("%s %d", r.Role, r.Index))
+		}
+		agent := fmt.Sprintf("agent %d", id)
+		if len(roles) > 0 {
+			agent = fmt.Sprintf("%s: %s", agent, strings.Join(roles, ", "))
+		}
+		infos := []TimeSeriesInfo{{
+			ID:      fmt.Sprintf("agent-cpu-%d", id),
+			Name:    fmt.Sprintf("CPU utilization (%s)", agent),
+			XUnit:   "unix time (s)",
+			YUnit:   "%",
+			Overlay: overlay,
+		}, {
+			ID:    fmt.Sprintf("agent-memory-%d", id),
+			Name:  fmt.Sprintf("Memory used (%s)", agent),
+			XUnit: "unix time (s)",
+			YUnit: "%",
+		}, {
+			ID:    fmt.Sprintf("agent-disk-%d", id),
+			Name:  fmt.Sprintf("Disk space available (%s)", agent),
+			XUnit: "unix time (s)",
+			YUnit: "kB",
+		}, {
+			ID:    fmt.Sprintf("agent-net-rx-%d", id),
+			Name:  fmt.Sprintf("Network received (%s)", agent),
+			XUnit: "unix time (s)",
+			YUnit: "B/s",
+		}, {
+			ID:    fmt.Sprintf("agent-net-tx-%d", id),
+			Name:  fmt.Sprintf("Network sent (%s)", agent),
+			XUnit: "unix time (s)",
+			YUnit: "B/s",
+		}}
+		series := make([]*timeSeriesWriter, 0, len(infos))
+		for _, info := range infos {
+			s, err := createTimeSeries(dir, info, true)
+			if err != nil {
+				for _, s := range series {
+					s.close()
+				}
+				return err
+			}
+			series = append(series, s)
+		}
+		err = readAgentHealth(files[id], func(s common.AgentHealthSample) error {
+			x := float64(s.Time.UnixNano()) / 1e9
+			ys := []float64{
+				s.CPUPercent,
+				s.MemUsedPercent(),
+				float64(s.DiskAvailable),
+				s.NetRxBytesPerSec,
+				s.NetTxBytesPerSec,
+			}
+			for i, y := range ys {
+				if err := series[i].add(x, y); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		for _, s := range series {
+			if err2 := s.close(); err == nil {
+				err = err2
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("Error ingesting health of agent %d: %v", id, err)
+		}
+		for _, s := range series {
+			idx.Series = append(idx.Series, s.info)
+		}
+	}
+	return nil
+}
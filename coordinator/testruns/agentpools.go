@@ -0,0 +1,215 @@
+package testruns
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/coordinator"
+)
+
+// placePoolRoles makes the roles that run on a pool of static agents wait for
+// an agent of that pool to be chosen, in stead of being spawned from a launch
+// template
+func placePoolRoles(tr *common.TestRun) {
+	for _, r := range tr.Roles {
+		if r.AgentPool == "" || r.ColocateWith != nil {
+			continue
+		}
+		r.AwsLaunchTemplateID = ""
+		r.AwsAgentInstanceId = ""
+		if r.AgentID == 0 {
+			r.AgentID = -1
+		}
+	}
+	syncColocatedRoles(tr.Roles)
+}
+
+// unassignedPoolRole returns whether the role runs on a pool of static agents
+// and its agent is yet to be chosen
+func unassignedPoolRole(r *common.TestRunRole) bool {
+	return r.AgentPool != "" && r.ColocateWith == nil && r.AgentID <= 0
+}
+
+// poolAgentUnmet returns what the static agent lacks to run the roles that
+// run on the agent of the host role: their requirements and accelerators
+func (t *TestRunManager) poolAgentUnmet(
+	roles []*common.TestRunRole,
+	host *common.TestRunRole,
+	a *coordinator.ConnectedAgent,
+) []string {
+	ret := []string{}
+	req, err := t.hostRequirements(roles, host)
+	if err == nil && req != nil {
+		ret = append(ret, agentUnmet(a.SystemInfo, *req)...)
+	}
+	accelerators := map[string]int{}
+	for _, acc := range a.SystemInfo.Accelerators {
+		accelerators[acc.Kind]++
+	}
+	for _, r := range roles {
+		if h, err := hostRole(roles, r); err != nil || h != host ||
+			r.Accelerator == "" {
+			continue
+		}
+		required := r.AcceleratorCount
+		if required <= 0 {
+			required = 1
+		}
+		if accelerators[r.Accelerator] < required {
+			ret = append(ret, fmt.Sprintf(
+				"%d %s accelerator(s)",
+				required,
+				r.Accelerator,
+			))
+		}
+	}
+	return ret
+}
+
+// poolAgents returns the connected agents of each pool, sorted by ID
+func (t *TestRunManager) poolAgents() map[string][]*coordinator.ConnectedAgent {
+	ret := map[string][]*coordinator.ConnectedAgent{}
+	for _, a := range t.coord.GetAgents() {
+		if a.Pool != "" && a.Disconnected == nil {
+			ret[a.Pool] = append(ret[a.Pool], a)
+		}
+	}
+	for _, agents := range ret {
+		sort.Slice(agents, func(i, j int) bool {
+			return agents[i].ID < agents[j].ID
+		})
+	}
+	return ret
+}
+
+// assignPoolAgents chooses an idle static agent of its pool for each role of
+// the test run that runs on one, such that it meets the requirements of the
+// roles that will run on it. Agents running another test run, or in taken,
+// are not idle. Either all roles get an agent or none do, in which case the
+// reason the test run has to wait is returned. The chosen agents are added to
+// taken
+func (t *TestRunManager) assignPoolAgents(
+	tr *common.TestRun,
+	taken map[int32]bool,
+) string {
+	idle := map[string][]*coordinator.ConnectedAgent{}
+	for pool, agents := range t.poolAgents() {
+		for _, a := range agents {
+			if !taken[a.ID] && t.agentInUse(tr, a.ID) == nil &&
+				len(agentRoles(tr, a.ID)) == 0 {
+				idle[pool] = append(idle[pool], a)
+			}
+		}
+	}
+
+	assigned := map[*common.TestRunRole]int32{}
+	for _, r := range tr.Roles {
+		if !unassignedPoolRole(r) {
+			continue
+		}
+		found := false
+		for i, a := range idle[r.AgentPool] {
+			if len(t.poolAgentUnmet(tr.Roles, r, a)) > 0 {
+				continue
+			}
+			assigned[r] = a.ID
+			idle[r.AgentPool] = append(
+				idle[r.AgentPool][:i],
+				idle[r.AgentPool][i+1:]...,
+			)
+			found = true
+			break
+		}
+		if !found {
+			return fmt.Sprintf(
+				"Waiting for an idle agent in pool %s for %s %d",
+				r.AgentPool,
+				r.Role,
+				r.Index,
+			)
+		}
+	}
+
+	for _, r := range tr.Roles {
+		id, ok := assigned[r]
+		if !ok {
+			continue
+		}
+		r.AgentID = id
+		taken[id] = true
+		t.WriteLog(
+			tr,
+			"Placed %s %d on agent %d of pool %s",
+			r.Role,
+			r.Index,
+			id,
+			r.AgentPool,
+		)
+	}
+	syncColocatedRoles(tr.Roles)
+	return ""
+}
+
+// validateAgentPools checks that the pools the roles run on exist, and have
+// enough agents that meet the requirements of the roles. Idle agents are only
+// chosen when the test run starts, so the agents running other test runs
+// count too
+func (t *TestRunManager) validateAgentPools(tr *common.TestRun) []error {
+	ret := []error{}
+	needed := map[string]int{}
+	pools := t.poolAgents()
+	for _, r := range tr.Roles {
+		if r.AgentPool == "" || r.ColocateWith != nil {
+			continue
+		}
+		if !t.coord.AgentPoolExists(r.AgentPool) {
+			ret = append(ret, fmt.Errorf(
+				"Agent pool %s of %s %d does not exist",
+				r.AgentPool,
+				r.Role,
+				r.Index,
+			))
+			continue
+		}
+		needed[r.AgentPool]++
+		if !unassignedPoolRole(r) {
+			continue
+		}
+		var unmet []string
+		suitable := false
+		for _, a := range pools[r.AgentPool] {
+			unmet = t.poolAgentUnmet(tr.Roles, r, a)
+			if len(unmet) == 0 {
+				suitable = true
+				break
+			}
+		}
+		if !suitable && len(pools[r.AgentPool]) > 0 {
+			ret = append(ret, fmt.Errorf(
+				"No agent in pool %s meets the requirements of %s %d: %s",
+				r.AgentPool,
+				r.Role,
+				r.Index,
+				strings.Join(unmet, ", "),
+			))
+		}
+	}
+	names := make([]string, 0, len(needed))
+	for pool := range needed {
+		names = append(names, pool)
+	}
+	sort.Strings(names)
+	for _, pool := range names {
+		if len(pools[pool]) < needed[pool] {
+			ret = append(ret, fmt.Errorf(
+				"Agent pool %s has %d connected agent(s), but the test run needs %d",
+				pool,
+				len(pools[pool]),
+				needed[pool],
+			))
+		}
+	}
+	return ret
+}
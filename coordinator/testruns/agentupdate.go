@@ -0,0 +1,597 @@
+package testruns
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+	"github.com/mit-dci/opencbdc-tctl/wire"
+)
+
+// ErrAgentRolloutNotFound is returned when no agent rollout with the
+// requested ID exists
+var ErrAgentRolloutNotFound = errors.New("Agent rollout not found")
+
+// ErrAgentRolloutInProgress is returned when starting an agent rollout while
+// another one is running or paused
+var ErrAgentRolloutInProgress = errors.New(
+	"An agent rollout is already in progress",
+)
+
+// agentRolloutPoll is the interval at which a rollout checks whether it was
+// resumed, agents became idle or updated agents reconnected
+const agentRolloutPoll = 5 * time.Second
+
+// defaultAgentReconnectTimeout is the time an updated agent has to reconnect
+// with its new version if the rollout doesn't specify it
+const defaultAgentReconnectTimeout = 5 * time.Minute
+
+// agentBinaryName matches the versions and architectures that can be used in
+// the S3 path of an agent binary
+var agentBinaryName = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// AgentBinary is a version of the agent binary for a single architecture that
+// was uploaded to S3, along with the offline signature agents verify it with
+type AgentBinary struct {
+	// The version the binary reports to the coordinator when connecting
+	Version      string    `json:"version"`
+	Architecture string    `json:"arch"`
+	SHA256       string    `json:"sha256"`
+	Size         int64     `json:"size"`
+	Signature    []byte    `json:"signature"`
+	S3Region     string    `json:"s3Region"`
+	S3Bucket     string    `json:"s3Bucket"`
+	S3Path       string    `json:"s3Path"`
+	Uploaded     time.Time `json:"uploaded"`
+	// The thumbprint of the user that uploaded the binary
+	UploadedByThumbprint string `json:"uploadedByThumbprint"`
+}
+
+// AgentRolloutConfig controls how fast an agent rollout proceeds through the
+// connected agents
+type AgentRolloutConfig struct {
+	// The version of the agent binary to roll out
+	Version string `json:"version"`
+	// The number of agents updated in the first batch. Zero means the first
+	// batch is a regular batch
+	CanarySize int `json:"canarySize"`
+	// The number of agents updated at the same time
+	BatchSize int `json:"batchSize"`
+	// The time to wait after each batch before updating the next one
+	BatchIntervalSeconds int `json:"batchIntervalSeconds"`
+	// The number of agents that can fail to update before the rollout is
+	// halted
+	MaxFailures int `json:"maxFailures"`
+	// The time an updated agent has to reconnect with the new version before
+	// it is considered failed
+	ReconnectTimeoutSeconds int `json:"reconnectTimeoutSeconds"`
+}
+
+// Validate checks that the rollout updates at least one agent per batch and
+// that none of its limits are negative
+func (cfg AgentRolloutConfig) Validate() error {
+	if cfg.Version == "" {
+		return errors.New("The rollout needs a version")
+	}
+	if cfg.BatchSize < 1 {
+		return errors.New("The batch size must be at least 1")
+	}
+	if cfg.CanarySize < 0 || cfg.BatchIntervalSeconds < 0 ||
+		cfg.MaxFailures < 0 || cfg.ReconnectTimeoutSeconds < 0 {
+		return errors.New("Rollout limits cannot be negative")
+	}
+	return nil
+}
+
+// reconnectTimeout returns the time an updated agent has to reconnect
+func (cfg AgentRolloutConfig) reconnectTimeout() time.Duration {
+	if cfg.ReconnectTimeoutSeconds == 0 {
+		return defaultAgentReconnectTimeout
+	}
+	return time.Duration(cfg.ReconnectTimeoutSeconds) * time.Second
+}
+
+type AgentRolloutStatus string
+
+const AgentRolloutRunning AgentRolloutStatus = "running"
+const AgentRolloutPaused AgentRolloutStatus = "paused"
+const AgentRolloutCompleted AgentRolloutStatus = "completed"
+const AgentRolloutHalted AgentRolloutStatus = "halted"
+const AgentRolloutAborted AgentRolloutStatus = "aborted"
+
+type AgentRolloutAgentStatus string
+
+const AgentRolloutAgentPending AgentRolloutAgentStatus = "pending"
+const AgentRolloutAgentUpdating AgentRolloutAgentStatus = "updating"
+const AgentRolloutAgentUpdated AgentRolloutAgentStatus = "updated"
+const AgentRolloutAgentFailed AgentRolloutAgentStatus = "failed"
+const AgentRolloutAgentSkipped AgentRolloutAgentStatus = "skipped"
+
+// AgentRolloutAgent tracks the progress of a single agent within an agent
+// rollout. Agents without a persistent identity reconnect with a new ID after
+// updating, so they are recognized by their host name and EC2 instance ID
+type AgentRolloutAgent struct {
+	AgentID       int32                   `json:"agentID"`
+	HostName      string                  `json:"hostname"`
+	EC2InstanceID string                  `json:"ec2InstanceId"`
+	Architecture  string                  `json:"arch"`
+	FromVersion   string                  `json:"fromVersion"`
+	Status        AgentRolloutAgentStatus `json:"status"`
+	// The ID the agent reconnected with on the new version
+	NewAgentID int32  `json:"newAgentID,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// AgentRollout describes the staged update of the connected agents to a new
+// version of the agent binary. Agents are updated in batches, starting with
+// the canary batch, and only while they are not part of a running test run.
+// The rollout halts once more agents failed than it allows. Like credential
+// rotations, rollouts are kept in memory and don't survive a restart of the
+// coordinator
+type AgentRollout struct {
+	ID                  string               `json:"id"`
+	Config              AgentRolloutConfig   `json:"config"`
+	Status              AgentRolloutStatus   `json:"status"`
+	Started             time.Time            `json:"started"`
+	Completed           time.Time            `json:"completed"`
+	Agents              []*AgentRolloutAgent `json:"agents"`
+	Failures            int                  `json:"failures"`
+	Error               string               `json:"error,omitempty"`
+	CreatedByThumbprint string               `json:"createdByThumbprint"`
+}
+
+// copy returns a deep copy of the rollout that is safe to serialize while the
+// rollout is in progress. Expects the caller to hold agentRolloutsLock
+func (r *AgentRollout) copy() AgentRollout {
+	c := *r
+	c.Agents = make([]*AgentRolloutAgent, len(r.Agents))
+	for i, a := range r.Agents {
+		ac := *a
+		c.Agents[i] = &ac
+	}
+	return c
+}
+
+// agentBinariesPath returns the path of the file the uploaded agent binaries
+// are persisted in
+func agentBinariesPath() string {
+	return filepath.Join(common.DataDir(), "testruns", "agentbinaries.json")
+}
+
+// loadAgentBinaries reads the uploaded agent binaries from disk
+func (t *TestRunManager) loadAgentBinaries() error {
+	b, err := os.ReadFile(agentBinariesPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	t.agentBinariesLock.Lock()
+	defer t.agentBinariesLock.Unlock()
+	return json.Unmarshal(b, &t.agentBinaries)
+}
+
+// persistAgentBinaries writes the uploaded agent binaries to disk. Must be
+// called with agentBinariesLock held
+func (t *TestRunManager) persistAgentBinaries() error {
+	b, err := json.Marshal(t.agentBinaries)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(agentBinariesPath()), 0755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(agentBinariesPath(), b, 0644)
+}
+
+// AgentBinaries returns the uploaded agent binaries
+func (t *TestRunManager) AgentBinaries() []AgentBinary {
+	t.agentBinariesLock.Lock()
+	defer t.agentBinariesLock.Unlock()
+	ret := make([]AgentBinary, len(t.agentBinaries))
+	for i, b := range t.agentBinaries {
+		ret[i] = *b
+	}
+	return ret
+}
+
+// agentBinary returns the uploaded binary of the version for the
+// architecture, if any
+func (t *TestRunManager) agentBinary(version, arch string) (AgentBinary, bool) {
+	t.agentBinariesLock.Lock()
+	defer t.agentBinariesLock.Unlock()
+	for _, b := range t.agentBinaries {
+		if b.Version == version && b.Architecture == arch {
+			return *b, true
+		}
+	}
+	return AgentBinary{}, false
+}
+
+// UploadAgentBinary verifies the agent binary read from r against its
+// signature and uploads it to the binaries bucket, such that it can be rolled
+// out to the agents. The binary must be signed offline with the agent update
+// key over its version, architecture and digest (see
+// common.AgentUpdatePayload); the coordinator never signs agent binaries
+// itself. The version must be the version the binary reports when
+// connecting, which is how the rollout recognizes updated agents. An earlier
+// upload of the same version and architecture is replaced
+func (t *TestRunManager) UploadAgentBinary(
+	version string,
+	arch string,
+	r io.Reader,
+	signature []byte,
+	uploadedByThumbprint string,
+) (*AgentBinary, error) {
+	if !agentBinaryName.MatchString(version) ||
+		!agentBinaryName.MatchString(arch) {
+		return nil, errors.New("Invalid version or architecture")
+	}
+	key, err := common.AgentUpdatePublicKey()
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, errors.New(
+			"AGENT_UPDATE_PUBLIC_KEY is not configured, agent binaries " +
+				"can't be verified",
+		)
+	}
+
+	f, err := ioutil.TempFile("", "agent-binary-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	_, err = io.Copy(f, r)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	digest, size, err := common.FileSHA256(f.Name())
+	if err != nil {
+		return nil, err
+	}
+	err = common.VerifyAgentUpdateSignature(
+		key,
+		version,
+		arch,
+		digest,
+		signature,
+	)
+	if err != nil {
+		return nil, err
+	}
+	bin := &AgentBinary{
+		Version:              version,
+		Architecture:         arch,
+		SHA256:               digest,
+		Size:                 size,
+		Signature:            signature,
+		S3Region:             os.Getenv("AWS_DEFAULT_REGION"),
+		S3Bucket:             os.Getenv("BINARIES_S3_BUCKET"),
+		S3Path:               fmt.Sprintf("agent-binaries/%s/%s/agent", version, arch),
+		Uploaded:             time.Now(),
+		UploadedByThumbprint: uploadedByThumbprint,
+	}
+	err = t.awsm.UploadToS3(common.S3Upload{
+		SourcePath:   f.Name(),
+		TargetRegion: bin.S3Region,
+		TargetBucket: bin.S3Bucket,
+		TargetPath:   bin.S3Path,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	t.agentBinariesLock.Lock()
+	defer t.agentBinariesLock.Unlock()
+	binaries := []*AgentBinary{}
+	for _, b := range t.agentBinaries {
+		if b.Version != version || b.Architecture != arch {
+			binaries = append(binaries, b)
+		}
+	}
+	t.agentBinaries = append(binaries, bin)
+	return bin, t.persistAgentBinaries()
+}
+
+// AgentRollouts returns all agent rollouts started since the coordinator
+// started, most recent last
+func (t *TestRunManager) AgentRollouts() []AgentRollout {
+	t.agentRolloutsLock.Lock()
+	defer t.agentRolloutsLock.Unlock()
+	ret := make([]AgentRollout, len(t.agentRollouts))
+	for i, r := range t.agentRollouts {
+		ret[i] = r.copy()
+	}
+	return ret
+}
+
+// StartAgentRollout starts updating the connected agents that don't run the
+// version yet in the background. Agents of an architecture the version was
+// not uploaded for are skipped. Only one rollout can be in progress at a time
+func (t *TestRunManager) StartAgentRollout(
+	cfg AgentRolloutConfig,
+	createdByThumbprint string,
+) (AgentRollout, error) {
+	err := cfg.Validate()
+	if err != nil {
+		return AgentRollout{}, err
+	}
+	found := false
+	for _, b := range t.AgentBinaries() {
+		found = found || b.Version == cfg.Version
+	}
+	if !found {
+		return AgentRollout{}, fmt.Errorf(
+			"Agent version %s was not uploaded",
+			cfg.Version,
+		)
+	}
+	id, err := common.RandomID(12)
+	if err != nil {
+		return AgentRollout{}, err
+	}
+
+	t.agentRolloutsLock.Lock()
+	defer t.agentRolloutsLock.Unlock()
+	for _, r := range t.agentRollouts {
+		if r.Status == AgentRolloutRunning || r.Status == AgentRolloutPaused {
+			return AgentRollout{}, ErrAgentRolloutInProgress
+		}
+	}
+	rollout := &AgentRollout{
+		ID:                  id,
+		Config:              cfg,
+		Status:              AgentRolloutRunning,
+		Started:             time.Now(),
+		Agents:              []*AgentRolloutAgent{},
+		CreatedByThumbprint: createdByThumbprint,
+	}
+	for _, a := range t.coord.GetAgents() {
+		if a == nil || a.AgentVersion == "" || a.AgentVersion == cfg.Version {
+			continue
+		}
+		ra := &AgentRolloutAgent{
+			AgentID:       a.ID,
+			HostName:      a.SystemInfo.HostName,
+			EC2InstanceID: a.SystemInfo.EC2InstanceID,
+			Architecture:  a.SystemInfo.Architecture,
+			FromVersion:   a.AgentVersion,
+			Status:        AgentRolloutAgentPending,
+		}
+		if _, ok := t.agentBinary(cfg.Version, ra.Architecture); !ok {
+			ra.Status = AgentRolloutAgentSkipped
+			ra.Error = fmt.Sprintf(
+				"Version %s was not uploaded for %s",
+				cfg.Version,
+				ra.Architecture,
+			)
+		}
+		rollout.Agents = append(rollout.Agents, ra)
+	}
+	t.agentRollouts = append(t.agentRollouts, rollout)
+	go t.runAgentRollout(rollout)
+	return rollout.copy(), nil
+}
+
+// SetAgentRolloutStatus pauses, resumes or aborts the agent rollout. Agents
+// that are being updated when the rollout is paused or aborted finish their
+// update
+func (t *TestRunManager) SetAgentRolloutStatus(
+	id string,
+	action string,
+) error {
+	t.agentRolloutsLock.Lock()
+	defer t.agentRolloutsLock.Unlock()
+	var rollout *AgentRollout
+	for _, r := range t.agentRollouts {
+		if r.ID == id {
+			rollout = r
+		}
+	}
+	if rollout == nil {
+		return ErrAgentRolloutNotFound
+	}
+	switch action {
+	case "pause":
+		if rollout.Status != AgentRolloutRunning {
+			return fmt.Errorf("The rollout is %s", rollout.Status)
+		}
+		rollout.Status = AgentRolloutPaused
+	case "resume":
+		if rollout.Status != AgentRolloutPaused {
+			return fmt.Errorf("The rollout is %s", rollout.Status)
+		}
+		rollout.Status = AgentRolloutRunning
+	case "abort":
+		if rollout.Status != AgentRolloutRunning &&
+			rollout.Status != AgentRolloutPaused {
+			return fmt.Errorf("The rollout is %s", rollout.Status)
+		}
+		rollout.Status = AgentRolloutAborted
+		rollout.Completed = time.Now()
+	default:
+		return fmt.Errorf("Unknown action %s", action)
+	}
+	logging.Infof("[Agent rollout %s] %s", rollout.ID, rollout.Status)
+	return nil
+}
+
+// nextAgentRolloutBatch returns the pending agents of the rollout to update
+// next, which are the connected agents not part of a running test run.
+// Pending agents that disconnected are skipped. Must be called with
+// agentRolloutsLock held
+func (t *TestRunManager) nextAgentRolloutBatch(
+	rollout *AgentRollout,
+	size int,
+) (batch []*AgentRolloutAgent, pending int) {
+	batch = []*AgentRolloutAgent{}
+	for _, ra := range rollout.Agents {
+		if ra.Status != AgentRolloutAgentPending {
+			continue
+		}
+		if _, err := t.coord.GetAgent(ra.AgentID); err != nil {
+			ra.Status = AgentRolloutAgentSkipped
+			ra.Error = "Agent disconnected before it was updated"
+			continue
+		}
+		pending++
+		if len(batch) < size && t.agentInUse(nil, ra.AgentID) == nil {
+			batch = append(batch, ra)
+		}
+	}
+	return batch, pending
+}
+
+// runAgentRollout updates the agents of the rollout batch by batch until all
+// of them are updated, too many failed or the rollout is aborted
+func (t *TestRunManager) runAgentRollout(rollout *AgentRollout) {
+	logging.Infof(
+		"[Agent rollout %s] Rolling out version %s to %d agents",
+		rollout.ID,
+		rollout.Config.Version,
+		len(rollout.Agents),
+	)
+	cfg := rollout.Config
+	batches := 0
+	for {
+		t.agentRolloutsLock.Lock()
+		if rollout.Status != AgentRolloutRunning {
+			status := rollout.Status
+			t.agentRolloutsLock.Unlock()
+			if status == AgentRolloutPaused {
+				time.Sleep(agentRolloutPoll)
+				continue
+			}
+			return
+		}
+		size := cfg.BatchSize
+		if batches == 0 && cfg.CanarySize > 0 {
+			size = cfg.CanarySize
+		}
+		batch, pending := t.nextAgentRolloutBatch(rollout, size)
+		if pending == 0 {
+			rollout.Status = AgentRolloutCompleted
+			rollout.Completed = time.Now()
+			t.agentRolloutsLock.Unlock()
+			logging.Infof("[Agent rollout %s] Completed", rollout.ID)
+			return
+		}
+		for _, ra := range batch {
+			ra.Status = AgentRolloutAgentUpdating
+		}
+		t.agentRolloutsLock.Unlock()
+
+		// All pending agents are busy with test runs
+		if len(batch) == 0 {
+			time.Sleep(agentRolloutPoll)
+			continue
+		}
+
+		var wg sync.WaitGroup
+		for _, ra := range batch {
+			wg.Add(1)
+			go func(ra *AgentRolloutAgent) {
+				defer wg.Done()
+				newID, err := t.updateRolloutAgent(rollout, ra)
+				t.agentRolloutsLock.Lock()
+				defer t.agentRolloutsLock.Unlock()
+				if err != nil {
+					logging.Warnf(
+						"[Agent rollout %s] Agent %d failed: %v",
+						rollout.ID,
+						ra.AgentID,
+						err,
+					)
+					ra.Status = AgentRolloutAgentFailed
+					ra.Error = err.Error()
+					rollout.Failures++
+					return
+				}
+				ra.Status = AgentRolloutAgentUpdated
+				ra.NewAgentID = newID
+			}(ra)
+		}
+		wg.Wait()
+		batches++
+
+		t.agentRolloutsLock.Lock()
+		if rollout.Failures > cfg.MaxFailures &&
+			(rollout.Status == AgentRolloutRunning ||
+				rollout.Status == AgentRolloutPaused) {
+			rollout.Status = AgentRolloutHalted
+			rollout.Error = fmt.Sprintf(
+				"%d agents failed to update, more than the %d allowed",
+				rollout.Failures,
+				cfg.MaxFailures,
+			)
+			rollout.Completed = time.Now()
+			logging.Warnf("[Agent rollout %s] %s", rollout.ID, rollout.Error)
+		}
+		t.agentRolloutsLock.Unlock()
+		time.Sleep(time.Duration(cfg.BatchIntervalSeconds) * time.Second)
+	}
+}
+
+// updateRolloutAgent sends the agent the binary for its architecture and
+// waits for it to reconnect with the new version. Returns the ID the agent
+// reconnected with
+func (t *TestRunManager) updateRolloutAgent(
+	rollout *AgentRollout,
+	ra *AgentRolloutAgent,
+) (int32, error) {
+	version := rollout.Config.Version
+	bin, ok := t.agentBinary(version, ra.Architecture)
+	if !ok {
+		return 0, fmt.Errorf(
+			"Version %s was not uploaded for %s",
+			version,
+			ra.Architecture,
+		)
+	}
+	err := t.am.UpdateAgentBinary(ra.AgentID, &wire.AgentUpdateRequestMsg{
+		Version:      bin.Version,
+		Architecture: bin.Architecture,
+		SourceRegion: bin.S3Region,
+		SourceBucket: bin.S3Bucket,
+		SourcePath:   bin.S3Path,
+		SHA256:       bin.SHA256,
+		Signature:    bin.Signature,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	deadline := time.Now().Add(rollout.Config.reconnectTimeout())
+	for time.Now().Before(deadline) {
+		time.Sleep(agentRolloutPoll)
+		for _, a := range t.coord.GetAgents() {
+			if a != nil &&
+				a.Disconnected == nil &&
+				a.AgentVersion == version &&
+				a.SystemInfo.HostName == ra.HostName &&
+				a.SystemInfo.EC2InstanceID == ra.EC2InstanceID {
+				return a.ID, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf(
+		"Agent did not reconnect with version %s within %s",
+		version,
+		rollout.Config.reconnectTimeout(),
+	)
+}
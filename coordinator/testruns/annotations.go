@@ -0,0 +1,193 @@
+package testruns
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+)
+
+// ErrAnnotationNotFound is returned when the test run has no annotation with
+// the requested ID
+var ErrAnnotationNotFound = errors.New("Annotation not found")
+
+// ErrAnnotationNotAuthor is returned when a user tries to change an
+// annotation another user made
+var ErrAnnotationNotAuthor = errors.New(
+	"Annotations can only be changed by their author",
+)
+
+// maxCommentLength is the maximum length of a comment
+const maxCommentLength = 1000
+
+// maxNoteLength is the maximum length of the markdown of a note or verdict
+const maxNoteLength = 20000
+
+// annotationPlot matches the names of plots annotations can be attached to
+var annotationPlot = regexp.MustCompile(`^[A-Za-z0-9._-]{1,200}$`)
+
+// validateAnnotation checks the kind, verdict, plot and text of an annotation
+func validateAnnotation(a *common.Annotation) error {
+	switch a.Kind {
+	case common.AnnotationKindComment:
+		if a.Text == "" || len(a.Text) > maxCommentLength {
+			return fmt.Errorf(
+				"Comments should be between 1 and %d characters",
+				maxCommentLength,
+			)
+		}
+	case common.AnnotationKindNote:
+		if a.Text == "" || len(a.Text) > maxNoteLength {
+			return fmt.Errorf(
+				"Notes should be between 1 and %d characters",
+				maxNoteLength,
+			)
+		}
+	case common.AnnotationKindVerdict:
+		switch a.Verdict {
+		case common.AnnotationVerdictExpected,
+			common.AnnotationVerdictExpectedRegression,
+			common.AnnotationVerdictRegression,
+			common.AnnotationVerdictImprovement,
+			common.AnnotationVerdictInvalid:
+		default:
+			return fmt.Errorf("Unknown verdict %s", a.Verdict)
+		}
+		if len(a.Text) > maxNoteLength {
+			return fmt.Errorf(
+				"The reasoning of a verdict can be at most %d characters",
+				maxNoteLength,
+			)
+		}
+	default:
+		return fmt.Errorf("Unknown kind of annotation %s", a.Kind)
+	}
+	if a.Kind != common.AnnotationKindVerdict && a.Verdict != "" {
+		return errors.New("Only verdicts can have a verdict")
+	}
+	if a.Plot != "" && !annotationPlot.MatchString(a.Plot) {
+		return fmt.Errorf("Invalid plot name %s", a.Plot)
+	}
+	return nil
+}
+
+// AnnotateTestRun attaches a comment, note or verdict to a test run that has
+// ended, or to one of its plots
+func (t *TestRunManager) AnnotateTestRun(
+	testRunID string,
+	a common.Annotation,
+	userThumbprint string,
+) (*common.Annotation, error) {
+	err := validateAnnotation(&a)
+	if err != nil {
+		return nil, err
+	}
+	tr, ok := t.GetTestRun(testRunID)
+	if !ok {
+		return nil, fmt.Errorf("Unknown test run %s", testRunID)
+	}
+	if tr.Status == common.TestRunStatusQueued ||
+		tr.Status == common.TestRunStatusRunning {
+		return nil, fmt.Errorf("Test run %s has not ended yet", tr.ID)
+	}
+	a.ID, err = common.RandomID(12)
+	if err != nil {
+		return nil, err
+	}
+	a.UserThumbprint = userThumbprint
+	a.Created = time.Now()
+	a.Updated = a.Created
+
+	t.annotationsLock.Lock()
+	defer t.annotationsLock.Unlock()
+	tr.Annotations = append(tr.Annotations, a)
+	t.PersistTestRun(tr)
+	return &a, nil
+}
+
+// UpdateAnnotation changes the text, and the verdict of verdicts, of an
+// annotation on a test run. Only the author of the annotation can change it
+func (t *TestRunManager) UpdateAnnotation(
+	testRunID string,
+	annotationID string,
+	text string,
+	verdict common.AnnotationVerdict,
+	userThumbprint string,
+) (*common.Annotation, error) {
+	tr, ok := t.GetTestRun(testRunID)
+	if !ok {
+		return nil, fmt.Errorf("Unknown test run %s", testRunID)
+	}
+	t.annotationsLock.Lock()
+	defer t.annotationsLock.Unlock()
+	for i := range tr.Annotations {
+		a := &tr.Annotations[i]
+		if a.ID != annotationID {
+			continue
+		}
+		if a.UserThumbprint != userThumbprint {
+			return nil, ErrAnnotationNotAuthor
+		}
+		upd := *a
+		upd.Text = text
+		if upd.Kind == common.AnnotationKindVerdict {
+			upd.Verdict = verdict
+		}
+		err := validateAnnotation(&upd)
+		if err != nil {
+			return nil, err
+		}
+		upd.Updated = time.Now()
+		*a = upd
+		t.PersistTestRun(tr)
+		return &upd, nil
+	}
+	return nil, ErrAnnotationNotFound
+}
+
+// DeleteAnnotation removes an annotation from a test run. Only the author of
+// the annotation can remove it
+func (t *TestRunManager) DeleteAnnotation(
+	testRunID string,
+	annotationID string,
+	userThumbprint string,
+) error {
+	tr, ok := t.GetTestRun(testRunID)
+	if !ok {
+		return fmt.Errorf("Unknown test run %s", testRunID)
+	}
+	t.annotationsLock.Lock()
+	defer t.annotationsLock.Unlock()
+	for i, a := range tr.Annotations {
+		if a.ID != annotationID {
+			continue
+		}
+		if a.UserThumbprint != userThumbprint {
+			return ErrAnnotationNotAuthor
+		}
+		tr.Annotations = append(
+			tr.Annotations[:i],
+			tr.Annotations[i+1:]...,
+		)
+		t.PersistTestRun(tr)
+		return nil
+	}
+	return ErrAnnotationNotFound
+}
+
+// TestRunVerdict returns the most recent verdict on the test run as a whole,
+// or nil if nobody judged its result
+func TestRunVerdict(tr *common.TestRun) *common.Annotation {
+	var ret *common.Annotation
+	for i, a := range tr.Annotations {
+		if a.Kind != common.AnnotationKindVerdict || a.Plot != "" {
+			continue
+		}
+		if ret == nil || a.Updated.After(ret.Updated) {
+			ret = &tr.Annotations[i]
+		}
+	}
+	return ret
+}
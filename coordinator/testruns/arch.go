@@ -0,0 +1,77 @@
+package testruns
+
+import (
+	"sort"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/coordinator/sources"
+)
+
+// roleArchitecture returns the CPU architecture of the agent the role runs
+// on. For roles that run on AWS agents this is determined from the launch
+// template, such that it is known before the agents are launched. For other
+// roles the architecture reported by the agent is used
+func (t *TestRunManager) roleArchitecture(r *common.TestRunRole) string {
+	if r.AwsLaunchTemplateID != "" {
+		lt, err := t.awsm.GetLaunchTemplate(r.AwsLaunchTemplateID)
+		if err == nil && lt.Architecture != "" {
+			return sources.NormalizeTargetArch(lt.Architecture)
+		}
+	}
+	a, err := t.coord.GetAgent(r.AgentID)
+	if err == nil {
+		return sources.NormalizeTargetArch(a.SystemInfo.Architecture)
+	}
+	return sources.DefaultTargetArch
+}
+
+// testRunArchitectures returns the CPU architectures binaries have to be built
+// for to run the test run, with the default architecture first
+func (t *TestRunManager) testRunArchitectures(tr *common.TestRun) []string {
+	archs := map[string]bool{}
+	for _, r := range tr.Roles {
+		archs[t.roleArchitecture(r)] = true
+	}
+	ret := []string{}
+	for a := range archs {
+		ret = append(ret, a)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i] == sources.DefaultTargetArch {
+			return true
+		}
+		if ret[j] == sources.DefaultTargetArch {
+			return false
+		}
+		return ret[i] < ret[j]
+	})
+	if len(ret) == 0 {
+		ret = append(ret, sources.DefaultTargetArch)
+	}
+	return ret
+}
+
+// binariesS3Path returns the path in S3 of the binaries archive for the given
+// commit, build type, architecture and build configuration
+func binariesS3Path(
+	hash string,
+	debug bool,
+	arch string,
+	cfg *common.BuildConfig,
+) string {
+	name := hash
+	if debug {
+		// We need a separate archive for debug binaries since they perform
+		// much worse. We can't run debugging or perf on a binary set with
+		// optimizations because the stacktraces won't make much sense.
+		name += "-debug"
+	}
+	arch = sources.NormalizeTargetArch(arch)
+	if arch != sources.DefaultTargetArch {
+		name += "-" + arch
+	}
+	if key := cfg.Key(); key != "" {
+		name += "-" + key
+	}
+	return "binaries/" + name + ".tar.gz"
+}
@@ -27,15 +27,14 @@ func (t *TestRunManager) RunBinariesTwoPhase(
 	failures chan *common.ExecutedCommand,
 ) error {
 
-	// Build the sequence of commands to start
-	startSequence := t.CreateStartSequenceTwoPhase(tr)
-	// Execute the sequence of commands to start
-	allCmds, terminated, err := t.executeStartSequence(
+	// Start the roles following the startup plan of the architecture
+	allCmds, terminated, err := t.startRoles(
 		tr,
-		startSequence,
 		envs,
 		cmd,
 		failures,
+		nil,
+		nil,
 	)
 	if err != nil {
 		cuerr := t.CleanupCommands(tr, allCmds, envs)
@@ -49,7 +48,7 @@ func (t *TestRunManager) RunBinariesTwoPhase(
 	}
 	// allCmds now holds all of the running commands for this test run.
 
-	testDuration := time.Second * time.Duration(tr.SampleCount)
+	testDuration := t.loadDuration(tr)
 
 	t.UpdateStatus(
 		tr,
@@ -63,19 +62,27 @@ func (t *TestRunManager) RunBinariesTwoPhase(
 	// scheduled failures are no longer executed.
 	cancelFailures := make(chan bool, 1)
 	go t.FailRoles(tr, cancelFailures)
+	go t.FailoverLeaders(tr, cancelFailures)
+	go t.InjectFaults(tr, cancelFailures)
+	go t.StreamLiveMetrics(tr, cancelFailures)
 	defer func() {
-		cancelFailures <- true
+		// Closing the channel signals FailRoles, FailoverLeaders,
+		// InjectFaults and StreamLiveMetrics
+		close(cancelFailures)
 	}()
 
 	// This section waits for either one of the roles to fail (case 1), or the
 	// user to manually terminate the run (case 2), or five minutes elapsing
 	// (case 3 - success case)
+	t.trackCommands(tr, allCmds)
 	select {
 	case fail := <-failures:
+		t.untrackCommands(tr)
 		return t.HandleCommandFailure(tr, allCmds, envs, fail)
 	case <-tr.TerminateChan:
-	case <-time.After(testDuration):
+	case <-t.loadTimer(tr, testDuration):
 	}
+	t.untrackCommands(tr)
 
 	err = t.CleanupCommands2PC(tr, allCmds, envs)
 	if err != nil {
@@ -406,69 +413,6 @@ func (t *TestRunManager) writeShardConfigTwoPhase(
 	return nil
 }
 
-// CreateStartSequenceTwoPhase uses the test run configuration to determine in
-// which sequence the agent roles should be started, and returns an array of
-// startSequenceEntry elements that are ordered in the sequence in which they
-// should be started up.
-func (t *TestRunManager) CreateStartSequenceTwoPhase(
-	tr *common.TestRun,
-) []startSequenceEntry {
-	// Determine the start sequence
-	startSequence := make([]startSequenceEntry, 0)
-
-	roleStartTimeout := time.Minute * 1
-	// Shard timeout is dependent on preseeding, large preseeds can take a while
-	// to load into RAM
-	shardTimeout := roleStartTimeout
-	if tr.PreseedShards {
-		shardTimeout = time.Minute * 15
-	}
-
-	// Start RAFT replicated components all at once now. A random leader is
-	// elected so we monitor for all components to have their RAFT endpoint up,
-	// but only one of each cluster needs to be responding to the RPC endpoint
-	shards := t.GetAllRolesSorted(tr, common.SystemRoleShardTwoPhase)
-	startSequence = append(startSequence, startSequenceEntry{
-		roles:   shards,
-		timeout: shardTimeout,
-		waitForPort: []PortIncrement{
-			PortIncrementRaftPort,
-			PortIncrementClientPort,
-		},
-		waitForPortCount: []int{0, len(shards) / tr.ShardReplicationFactor},
-	})
-
-	coordinators := t.GetAllRolesSorted(tr, common.SystemRoleCoordinator)
-	startSequence = append(startSequence, startSequenceEntry{
-		roles:   coordinators,
-		timeout: roleStartTimeout,
-		waitForPort: []PortIncrement{
-			PortIncrementRaftPort,
-			PortIncrementDefaultPort,
-		},
-		waitForPortCount: []int{
-			0,
-			len(coordinators) / tr.ShardReplicationFactor,
-		},
-	})
-
-	// Start all sentinels
-	startSequence = append(startSequence, startSequenceEntry{
-		roles:       t.GetAllRolesSorted(tr, common.SystemRoleSentinelTwoPhase),
-		timeout:     roleStartTimeout,
-		waitForPort: []PortIncrement{PortIncrementDefaultPort},
-	})
-
-	// Start all load generators
-	startSequence = append(startSequence, startSequenceEntry{
-		waitBefore:  time.Second * 10,
-		roles:       t.GetAllRolesSorted(tr, common.SystemRoleTwoPhaseGen),
-		timeout:     roleStartTimeout,
-		waitForPort: []PortIncrement{}, // Don't wait for anything - loadgens don't accept incoming
-	})
-	return startSequence
-}
-
 // ValidateTestRunTwoPhase validates the role composition of the test run for a
 // twophase commit system. Reports all errors back as an array
 func (t *TestRunManager) ValidateTestRunTwoPhase(
@@ -7,7 +7,6 @@ import (
 	"fmt"
 	"io"
 	"strings"
-	"time"
 
 	"github.com/btcsuite/btcd/btcec"
 	"github.com/mit-dci/opencbdc-tctl/common"
@@ -26,15 +25,16 @@ func (t *TestRunManager) RunBinariesAtomizer(
 	archiverDone := make(chan []runningCommand, 1)
 	errChan := make(chan error, 100)
 
-	// Build the sequence of commands to start
-	startSequence := t.CreateStartSequenceAtomizer(tr, archiverDone, errChan)
-	// Execute the sequence of commands to start
-	allCmds, terminated, err := t.executeStartSequence(
+	// Start the roles following the startup plan of the architecture. The
+	// archiver runs to completion, and its commands are sent to archiverDone
+	// once it exits
+	allCmds, terminated, err := t.startRoles(
 		tr,
-		startSequence,
 		envs,
 		cmd,
 		failures,
+		archiverDone,
+		errChan,
 	)
 
 	if terminated { // Terminated yields true if the user aborted the testrun
@@ -54,14 +54,18 @@ func (t *TestRunManager) RunBinariesAtomizer(
 	// This starts the failure scenario execution in a subroutine. This logic
 	// will terminate the agents as defined in the failure settings of the
 	// test run. If the system run fails for whatever reason, the defer
-	// statement, executed when this method exits, will ensure a boolean is sent
-	// to the cancelFailures channel, which will make the FailRoles() subroutine
+	// statement, executed when this method exits, will ensure the
+	// cancelFailures channel is closed, which will make the FailRoles(),
+	// FailoverLeaders(), InjectFaults() and StreamLiveMetrics() subroutines
 	// exit further execution
 	cancelFailures := make(chan bool, 1)
 	defer func() {
-		cancelFailures <- true
+		close(cancelFailures)
 	}()
 	go t.FailRoles(tr, cancelFailures)
+	go t.FailoverLeaders(tr, cancelFailures)
+	go t.InjectFaults(tr, cancelFailures)
+	go t.StreamLiveMetrics(tr, cancelFailures)
 
 	// Now wait for any of these three ocurrences: (1 - happy case) the archiver
 	// completed after five minutes, which concludes the test. (2) a failure
@@ -73,13 +77,20 @@ func (t *TestRunManager) RunBinariesAtomizer(
 		common.TestRunStatusRunning,
 		"Waiting for archiver to complete",
 	)
+	// The archiver completes after a fixed number of blocks rather than a
+	// fixed time, so pausing the load generators delays its completion. Soak
+	// tests end after their duration instead
+	t.trackCommands(tr, allCmds)
 	select {
+	case <-t.soakTimer(tr):
 	case fail := <-failures:
+		t.untrackCommands(tr)
 		return t.HandleCommandFailure(tr, allCmds, envs, fail)
 	case waitCmds := <-archiverDone:
 		allCmds = append(allCmds, waitCmds...)
 	case <-tr.TerminateChan:
 	}
+	t.untrackCommands(tr)
 
 	err = t.CleanupCommands(tr, allCmds, envs)
 	if err != nil {
@@ -230,88 +241,6 @@ func (t *TestRunManager) writeShardConfigAtomizer(
 	return nil
 }
 
-// CreateStartSequenceAtomizer uses the test run configuration to determine in
-// which sequence the agent roles should be started, and returns an array of
-// startSequenceEntry elements that are ordered in the sequence in which they
-// should be started up.
-func (t *TestRunManager) CreateStartSequenceAtomizer(
-	tr *common.TestRun,
-	archiverDone chan []runningCommand,
-	errChan chan error,
-) []startSequenceEntry {
-	// Determine the start sequence
-	startSequence := make([]startSequenceEntry, 0)
-
-	roleStartTimeout := time.Minute * 1
-	// Shard timeout is dependent on preseeding, large preseeds can take a while
-	// to load into RAM
-	// commit 0688510eef7a16669786a8c6510d82b9a99a93cd rebased
-	shardTimeout := roleStartTimeout * 15
-	if tr.PreseedShards {
-		shardTimeout = time.Minute * 15
-	}
-
-	// First start the watchtowers
-	startSequence = append(startSequence, startSequenceEntry{
-		roles:   t.GetAllRolesSorted(tr, common.SystemRoleWatchtower),
-		timeout: roleStartTimeout,
-		waitForPort: []PortIncrement{
-			PortIncrementDefaultPort,
-			PortIncrementClientPort,
-		},
-	})
-
-	// Next, start the atomizers - all at once. Raft elects a random leader
-	// now, so we start all and wait for all RAFT ports to respond, but
-	// wait for online 1 to respond to actual rpc
-	startSequence = append(startSequence, startSequenceEntry{
-		roles: t.GetAllRolesSorted(
-			tr,
-			common.SystemRoleRaftAtomizer,
-		),
-		timeout: roleStartTimeout,
-		waitForPort: []PortIncrement{
-			PortIncrementRaftPort,
-			PortIncrementDefaultPort,
-		},
-		waitForPortCount: []int{0, 1},
-	})
-
-	// Next, start the archivers
-	startSequence = append(startSequence, startSequenceEntry{
-		roles:       t.GetAllRolesSorted(tr, common.SystemRoleArchiver),
-		timeout:     roleStartTimeout,
-		waitForPort: []PortIncrement{PortIncrementDefaultPort},
-		doneChan:    archiverDone,
-	})
-
-	// Start all shards
-	startSequence = append(startSequence, startSequenceEntry{
-		roles:       t.GetAllRolesSorted(tr, common.SystemRoleShard),
-		timeout:     shardTimeout, // Use the separate shard timeout
-		waitForPort: []PortIncrement{PortIncrementDefaultPort},
-	})
-
-	// Start all sentinels
-	startSequence = append(startSequence, startSequenceEntry{
-		roles:       t.GetAllRolesSorted(tr, common.SystemRoleSentinel),
-		timeout:     roleStartTimeout,
-		waitForPort: []PortIncrement{PortIncrementDefaultPort},
-	})
-
-	// Start all load generators
-	startSequence = append(startSequence, startSequenceEntry{
-		roles: t.GetAllRolesSorted(
-			tr,
-			common.SystemRoleAtomizerCliWatchtower,
-		),
-		timeout:     roleStartTimeout,
-		waitForPort: []PortIncrement{}, // Don't wait for anything - loadgens don't accept incoming
-	})
-
-	return startSequence
-}
-
 // ValidateTestRunAtomizer validates the role composition of the test run for an
 // atomizer commit system. Reports all errors back as an array
 func (t *TestRunManager) ValidateTestRunAtomizer(
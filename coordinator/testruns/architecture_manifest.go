@@ -0,0 +1,114 @@
+package testruns
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+)
+
+// RunBinariesManifest will orchestrate the running of all roles for a full
+// cycle test with an architecture defined by a manifest. The test run ends
+// when the role that runs to completion exits, or after its sample count in
+// seconds if the startup plan has no such role
+func (t *TestRunManager) RunBinariesManifest(
+	tr *common.TestRun,
+	m *ArchitectureManifest,
+	envs map[int32][]byte,
+	cmd chan *common.ExecutedCommand,
+	failures chan *common.ExecutedCommand,
+) error {
+	runToCompletion := false
+	for _, r := range m.Startup.Roles {
+		runToCompletion = runToCompletion || r.RunToCompletion
+	}
+	completed := make(chan []runningCommand, 1)
+	errChan := make(chan error, 1)
+
+	// Start the roles following the startup plan of the manifest
+	allCmds, terminated, err := t.startRoles(
+		tr,
+		envs,
+		cmd,
+		failures,
+		completed,
+		errChan,
+	)
+	if err != nil {
+		cuerr := t.CleanupCommands(tr, allCmds, envs)
+		if cuerr != nil {
+			return cuerr
+		}
+		return err
+	}
+	if terminated { // Terminated yields true if the user aborted the testrun
+		return nil
+	}
+	// allCmds now holds all of the running commands for this test run.
+
+	// Without a role that runs to completion, the load timer ends the test
+	// run. Otherwise only the completion of that role does, unless the test
+	// run is a soak test
+	var timer <-chan time.Time
+	if runToCompletion && tr.Soak == nil {
+		t.UpdateStatus(
+			tr,
+			common.TestRunStatusRunning,
+			"Waiting for manual termination or completion",
+		)
+	} else {
+		timeout := t.loadDuration(tr)
+		t.UpdateStatus(
+			tr,
+			common.TestRunStatusRunning,
+			fmt.Sprintf(
+				"Waiting for manual termination or timeout (%.1f minutes)",
+				timeout.Minutes(),
+			),
+		)
+		timer = t.loadTimer(tr, timeout)
+	}
+
+	// Run the failure scenario in a separate goroutine. Pass it a channel
+	// that will get a true sent to it when we exit the test - such that if
+	// the test fails for whatever reason (or is manually terminated) the
+	// scheduled failures are no longer executed.
+	cancelFailures := make(chan bool, 1)
+	go t.FailRoles(tr, cancelFailures)
+	go t.FailoverLeaders(tr, cancelFailures)
+	go t.InjectFaults(tr, cancelFailures)
+	go t.StreamLiveMetrics(tr, cancelFailures)
+	defer func() {
+		// Closing the channel signals FailRoles, FailoverLeaders,
+		// InjectFaults and StreamLiveMetrics
+		close(cancelFailures)
+	}()
+
+	t.trackCommands(tr, allCmds)
+	select {
+	case fail := <-failures:
+		t.untrackCommands(tr)
+		return t.HandleCommandFailure(tr, allCmds, envs, fail)
+	case waitCmds := <-completed:
+		allCmds = append(allCmds, waitCmds...)
+	case <-tr.TerminateChan:
+	case <-timer:
+	}
+	t.untrackCommands(tr)
+
+	err = t.CleanupCommands(tr, allCmds, envs)
+	if err != nil {
+		return err
+	}
+
+	// Report the error running the role that runs to completion, if any
+	select {
+	case e := <-errChan:
+		return e
+	default:
+	}
+
+	// Persist the test run to disk
+	t.PersistTestRun(tr)
+	return nil
+}
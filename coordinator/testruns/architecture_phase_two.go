@@ -20,16 +20,14 @@ func (t *TestRunManager) RunBinariesParsec(
 	cmd chan *common.ExecutedCommand,
 	failures chan *common.ExecutedCommand,
 ) error {
-	// Build the sequence of commands to start
-	startSequence := t.CreateStartSequenceParsec(tr)
-
-	// Execute the sequence of commands to start
-	allCmds, terminated, err := t.executeStartSequence(
+	// Start the roles following the startup plan of the architecture
+	allCmds, terminated, err := t.startRoles(
 		tr,
-		startSequence,
 		envs,
 		cmd,
 		failures,
+		nil,
+		nil,
 	)
 	if err != nil {
 		cuerr := t.CleanupCommands(tr, allCmds, envs)
@@ -43,7 +41,7 @@ func (t *TestRunManager) RunBinariesParsec(
 	}
 	// allCmds now holds all of the running commands for this test run.
 
-	timeout := time.Duration(tr.SampleCount) * time.Second
+	timeout := t.loadDuration(tr)
 
 	t.UpdateStatus(
 		tr,
@@ -60,8 +58,13 @@ func (t *TestRunManager) RunBinariesParsec(
 	// scheduled failures are no longer executed.
 	cancelFailures := make(chan bool, 1)
 	go t.FailRoles(tr, cancelFailures)
+	go t.FailoverLeaders(tr, cancelFailures)
+	go t.InjectFaults(tr, cancelFailures)
+	go t.StreamLiveMetrics(tr, cancelFailures)
 	defer func() {
-		cancelFailures <- true
+		// Closing the channel signals FailRoles, FailoverLeaders,
+		// InjectFaults and StreamLiveMetrics
+		close(cancelFailures)
 	}()
 
 	// This section waits for either one of the roles to fail (case 1), or the
@@ -69,12 +72,15 @@ func (t *TestRunManager) RunBinariesParsec(
 	// successfully
 	// (case 2 - success case)
 
+	t.trackCommands(tr, allCmds)
 	select {
 	case fail := <-failures:
+		t.untrackCommands(tr)
 		return t.HandleCommandFailure(tr, allCmds, envs, fail)
 	case <-tr.TerminateChan:
-	case <-time.After(timeout):
+	case <-t.loadTimer(tr, timeout):
 	}
+	t.untrackCommands(tr)
 
 	err = t.CleanupCommandsParsec(tr, allCmds, envs)
 	if err != nil {
@@ -183,66 +189,6 @@ func (t *TestRunManager) CleanupCommandsParsec(
 	return nil
 }
 
-// CreateStartSequenceParsec uses the test run configuration to determine in
-// which sequence the agent roles should be started, and returns an array of
-// startSequenceEntry elements that are ordered in the sequence in which they
-// should be started up.
-func (t *TestRunManager) CreateStartSequenceParsec(
-	tr *common.TestRun,
-) []startSequenceEntry {
-	// Determine the start sequence
-	startSequence := make([]startSequenceEntry, 0)
-
-	roleStartTimeout := time.Minute * 4
-
-	// Raft clusters now elect a random leader so we start them all at once
-	ticketMachines := t.GetAllRolesSorted(tr, common.SystemRoleTicketMachine)
-
-	// Start all nodes at once, wait for each node to have their RAFT port
-	// available - and for 1 in {rep factor} to have the actual RPC port
-	// available.
-	startSequence = append(startSequence, startSequenceEntry{
-		roles:   ticketMachines,
-		timeout: roleStartTimeout,
-		waitForPort: []PortIncrement{
-			PortIncrementRaftPort,
-			PortIncrementDefaultPort,
-		},
-		waitForPortCount: []int{
-			0,
-			len(ticketMachines) / tr.ShardReplicationFactor,
-		},
-	})
-
-	shards := t.GetAllRolesSorted(tr, common.SystemRoleRuntimeLockingShard)
-
-	// Start the shards
-	startSequence = append(startSequence, startSequenceEntry{
-		roles:   shards,
-		timeout: roleStartTimeout,
-		waitForPort: []PortIncrement{
-			PortIncrementRaftPort,
-			PortIncrementDefaultPort,
-		},
-		waitForPortCount: []int{0, len(shards) / tr.ShardReplicationFactor},
-	})
-
-	// Start the agents
-	startSequence = append(startSequence, startSequenceEntry{
-		roles:       t.GetAllRolesSorted(tr, common.SystemRoleAgent),
-		timeout:     roleStartTimeout,
-		waitForPort: []PortIncrement{PortIncrementDefaultPort},
-	})
-
-	// Start all load generators
-	startSequence = append(startSequence, startSequenceEntry{
-		roles:       t.GetAllRolesSorted(tr, common.SystemRoleParsecGen),
-		timeout:     roleStartTimeout,
-		waitForPort: []PortIncrement{}, // Don't wait for anything - loadgens don't accept incoming
-	})
-	return startSequence
-}
-
 func (t *TestRunManager) GenerateParams(tr *common.TestRun) ([]string, error) {
 	ret := make([]string, 0)
 
@@ -0,0 +1,25 @@
+package testruns
+
+import (
+	"github.com/mit-dci/opencbdc-tctl/common"
+)
+
+// commitsInUse returns the commits whose binaries and source archives are
+// needed by the queued and running test runs, which protects them from the
+// artifact garbage collection
+func (t *TestRunManager) commitsInUse() []string {
+	t.testRunsLock.Lock()
+	defer t.testRunsLock.Unlock()
+	hashes := []string{}
+	for _, tr := range t.testRuns {
+		if tr.Status != common.TestRunStatusQueued &&
+			tr.Status != common.TestRunStatusRunning {
+			continue
+		}
+		hashes = append(hashes, tr.CommitHash)
+		if tr.SeederHash != "" {
+			hashes = append(hashes, tr.SeederHash)
+		}
+	}
+	return hashes
+}
@@ -36,7 +36,25 @@ func (t *TestRunManager) KillAwsAgents(tr *common.TestRun) error {
 		}
 	}
 	t.WriteLog(tr, "Killing %d agents", len(ids))
-	return t.awsm.StopAgentsByInstanceIds(ids)
+	err := t.awsm.StopAgentsByInstanceIds(ids)
+
+	// Verify the instances were terminated, and record the ones that were
+	// not on the reconciliation list such that they don't keep running
+	leaked := ids
+	if err == nil {
+		running, rerr := t.awsm.InstancesRunning(ids)
+		if rerr == nil {
+			leaked = running
+		}
+	}
+	for _, id := range leaked {
+		t.recordLeak(tr, &LeakedResource{
+			Kind:       LeakedInstance,
+			InstanceID: id,
+			Detail:     fmt.Sprintf("EC2 instance %s", id),
+		})
+	}
+	return err
 }
 
 // HasAWSRoles will return true if the test run has roles that (are supposed to)
@@ -81,7 +99,8 @@ func (t *TestRunManager) SpawnAWSInstances(tr *common.TestRun) bool {
 	// instances that we are waiting for - and we kill them to spawn new
 	// instances for these roles.
 	for i, r := range tr.Roles {
-		if r.AgentID == -1 {
+		// Colocated roles run on the agent spawned for their host role
+		if r.AgentID == -1 && r.ColocateWith == nil {
 			// This agent is not connected to the controller yet
 			if tr.Roles[i].AwsAgentInstanceId != "" {
 				// We are already waiting for this agent to connect from a
@@ -209,6 +228,7 @@ func (t *TestRunManager) WaitForAWSInstances(
 				}
 			}
 		}
+		syncColocatedRoles(tr.Roles)
 
 		// Count the number of roles we're still waiting for. If we have been
 		// waiting for longer than two minutes, print out the instance IDs we're
@@ -217,7 +237,7 @@ func (t *TestRunManager) WaitForAWSInstances(
 		waiting := 0
 		for _, r := range tr.Roles {
 			if r.AgentID == -1 {
-				if time.Since(start).Minutes() > 2 {
+				if time.Since(start).Minutes() > 2 && r.ColocateWith == nil {
 					t.WriteLog(
 						tr,
 						"Role %s %d still waits for AWS agent %s",
@@ -0,0 +1,258 @@
+package testruns
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+)
+
+// ErrBaselineNotFound is returned when no baseline with the requested ID was
+// saved
+var ErrBaselineNotFound = errors.New("Baseline not found")
+
+// ResultBaseline is a snapshot of the results of a completed test run under a
+// name, such as "v1.0 8-shard baseline", that new test runs can be compared
+// against by their regression gate. The metrics are copied such that the
+// baseline survives recalculation or removal of the test run's results
+type ResultBaseline struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	TestRunID    string `json:"testRunID"`
+	Architecture string `json:"architectureID"`
+	CommitHash   string `json:"commitHash"`
+	// The metrics of the test run the regression gate compares against
+	ThroughputAvg       float64   `json:"throughputAvg"`
+	LatencyAvg          float64   `json:"latencyAvg"`
+	LatencyP99          float64   `json:"latencyP99"`
+	Created             time.Time `json:"created"`
+	CreatedByThumbprint string    `json:"createdByThumbprint"`
+}
+
+// latencyP99 returns the 99th percentile latency of the test result, or zero
+// if it was not calculated
+func latencyP99(res *common.TestResult) float64 {
+	for _, p := range res.LatencyPercentiles {
+		if p.Bucket == 99 {
+			return p.Value
+		}
+	}
+	return 0
+}
+
+// baselinesPath returns the path of the file the baselines are persisted in
+func baselinesPath() string {
+	return filepath.Join(common.DataDir(), "testruns", "baselines.json")
+}
+
+// loadBaselines reads the saved baselines from disk
+func (t *TestRunManager) loadBaselines() error {
+	b, err := os.ReadFile(baselinesPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	t.baselinesLock.Lock()
+	defer t.baselinesLock.Unlock()
+	return json.Unmarshal(b, &t.baselines)
+}
+
+// persistBaselines writes the saved baselines to disk. Must be called with
+// baselinesLock held
+func (t *TestRunManager) persistBaselines() error {
+	b, err := json.Marshal(t.baselines)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(baselinesPath()), 0755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(baselinesPath(), b, 0644)
+}
+
+// CreateBaseline saves the results of a completed test run as a baseline
+// under the given name. Names must be unique, such that users can pick the
+// baseline to compare against by name
+func (t *TestRunManager) CreateBaseline(
+	testRunID string,
+	name string,
+	createdByThumbprint string,
+) (*ResultBaseline, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, errors.New("Baseline has no name")
+	}
+	tr, ok := t.GetTestRun(testRunID)
+	if !ok {
+		return nil, fmt.Errorf("Unknown test run %s", testRunID)
+	}
+	if tr.Status != common.TestRunStatusCompleted || tr.Result == nil {
+		return nil, fmt.Errorf(
+			"Test run %s has not completed with results",
+			testRunID,
+		)
+	}
+
+	id, err := common.RandomID(12)
+	if err != nil {
+		return nil, err
+	}
+	b := &ResultBaseline{
+		ID:                  id,
+		Name:                name,
+		TestRunID:           tr.ID,
+		Architecture:        tr.Architecture,
+		CommitHash:          tr.CommitHash,
+		ThroughputAvg:       tr.Result.ThroughputAvg,
+		LatencyAvg:          tr.Result.LatencyAvg,
+		LatencyP99:          latencyP99(tr.Result),
+		Created:             time.Now(),
+		CreatedByThumbprint: createdByThumbprint,
+	}
+
+	t.baselinesLock.Lock()
+	defer t.baselinesLock.Unlock()
+	for _, e := range t.baselines {
+		if strings.EqualFold(e.Name, name) {
+			return nil, fmt.Errorf("A baseline named %q already exists", name)
+		}
+	}
+	t.baselines = append(t.baselines, b)
+	err = t.persistBaselines()
+	if err != nil {
+		t.baselines = t.baselines[:len(t.baselines)-1]
+		return nil, err
+	}
+	return b, nil
+}
+
+// Baselines returns the saved baselines
+func (t *TestRunManager) Baselines() []*ResultBaseline {
+	t.baselinesLock.Lock()
+	defer t.baselinesLock.Unlock()
+	return append([]*ResultBaseline{}, t.baselines...)
+}
+
+// GetBaseline returns the saved baseline with the given ID
+func (t *TestRunManager) GetBaseline(id string) (*ResultBaseline, error) {
+	t.baselinesLock.Lock()
+	defer t.baselinesLock.Unlock()
+	for _, b := range t.baselines {
+		if b.ID == id {
+			return b, nil
+		}
+	}
+	return nil, ErrBaselineNotFound
+}
+
+// DeleteBaseline removes a saved baseline. Test runs that were compared
+// against it keep their verdict
+func (t *TestRunManager) DeleteBaseline(id string) error {
+	t.baselinesLock.Lock()
+	defer t.baselinesLock.Unlock()
+	for i, b := range t.baselines {
+		if b.ID == id {
+			t.baselines = append(t.baselines[:i], t.baselines[i+1:]...)
+			return t.persistBaselines()
+		}
+	}
+	return ErrBaselineNotFound
+}
+
+// validateRegressionGate checks that the baseline of the regression gate
+// exists and that its thresholds are sensible
+func (t *TestRunManager) validateRegressionGate(tr *common.TestRun) []error {
+	ret := []error{}
+	g := tr.RegressionGate
+	if g == nil {
+		return ret
+	}
+	if _, err := t.GetBaseline(g.BaselineID); err != nil {
+		ret = append(ret, fmt.Errorf(
+			"Regression gate: unknown baseline %s",
+			g.BaselineID,
+		))
+	}
+	if g.MaxThroughputDropPercent < 0 || g.MaxTailLatencyRisePercent < 0 {
+		ret = append(ret, errors.New(
+			"Regression gate: thresholds cannot be negative",
+		))
+	}
+	if g.MaxThroughputDropPercent == 0 && g.MaxTailLatencyRisePercent == 0 {
+		ret = append(ret, errors.New(
+			"Regression gate: set a throughput or tail latency threshold",
+		))
+	}
+	return ret
+}
+
+// percentChange returns the change from base to v in percent of base, or zero
+// if there is no base to compare against
+func percentChange(base, v float64) float64 {
+	if base == 0 {
+		return 0
+	}
+	return (v - base) / base * 100
+}
+
+// EvaluateRegressionGate compares the results of a test run against the
+// baseline of its regression gate, and records the verdict on the test run.
+// Returns the verdict, or nil if the test run has no regression gate or no
+// results to compare
+func (t *TestRunManager) EvaluateRegressionGate(
+	tr *common.TestRun,
+) (*common.RegressionVerdict, error) {
+	g := tr.RegressionGate
+	if g == nil || tr.Result == nil {
+		return nil, nil
+	}
+	b, err := t.GetBaseline(g.BaselineID)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &common.RegressionVerdict{
+		BaselineID:   b.ID,
+		BaselineName: b.Name,
+		Reasons:      []string{},
+		ThroughputChangePercent: percentChange(
+			b.ThroughputAvg,
+			tr.Result.ThroughputAvg,
+		),
+		TailLatencyChangePercent: percentChange(
+			b.LatencyP99,
+			latencyP99(tr.Result),
+		),
+	}
+	if g.MaxThroughputDropPercent > 0 &&
+		-v.ThroughputChangePercent > g.MaxThroughputDropPercent {
+		v.Reasons = append(v.Reasons, fmt.Sprintf(
+			"throughput dropped %.1f%% (%.2f tx/s vs %.2f tx/s) > %.1f%%",
+			-v.ThroughputChangePercent,
+			tr.Result.ThroughputAvg,
+			b.ThroughputAvg,
+			g.MaxThroughputDropPercent,
+		))
+	}
+	if g.MaxTailLatencyRisePercent > 0 &&
+		v.TailLatencyChangePercent > g.MaxTailLatencyRisePercent {
+		v.Reasons = append(v.Reasons, fmt.Sprintf(
+			"p99 latency rose %.1f%% (%.3fs vs %.3fs) > %.1f%%",
+			v.TailLatencyChangePercent,
+			latencyP99(tr.Result),
+			b.LatencyP99,
+			g.MaxTailLatencyRisePercent,
+		))
+	}
+	v.Regressed = len(v.Reasons) > 0
+	tr.Regression = v
+	return v, nil
+}
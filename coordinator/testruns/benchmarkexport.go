@@ -0,0 +1,225 @@
+package testruns
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+)
+
+// BenchmarkSubmissionSchema identifies the version of the community benchmark
+// registry format produced by BenchmarkSubmission
+const BenchmarkSubmissionSchema = "opencbdc-benchmark/v1"
+
+// BenchmarkSubmission is a test run result in the format of the OpenCBDC
+// community benchmark registry. It only contains information that is safe to
+// publish: hostnames, IP addresses, instance IDs and users are left out
+type BenchmarkSubmission struct {
+	Schema string `json:"schema"`
+	// Stable identifier of the submission, derived from the test run and its
+	// result, such that re-exporting the same result yields the same ID
+	SubmissionID string                          `json:"submissionID"`
+	Generated    time.Time                       `json:"generated"`
+	Config       *common.TestRunNormalizedConfig `json:"config"`
+	ConfigHash   string                          `json:"configHash"`
+	Environment  BenchmarkEnvironment            `json:"environment"`
+	Metrics      BenchmarkMetrics                `json:"metrics"`
+	Provenance   BenchmarkProvenance             `json:"provenance"`
+	// The comments, notes and verdicts on the test run, without their
+	// authors
+	Annotations []BenchmarkAnnotation `json:"annotations,omitempty"`
+}
+
+// BenchmarkAnnotation is an annotation on the test run of a submission
+type BenchmarkAnnotation struct {
+	Kind    common.AnnotationKind    `json:"kind"`
+	Plot    string                   `json:"plot,omitempty"`
+	Verdict common.AnnotationVerdict `json:"verdict,omitempty"`
+	Text    string                   `json:"text"`
+	Updated time.Time                `json:"updated"`
+}
+
+// BenchmarkEnvironment describes the hardware the test run was executed on
+type BenchmarkEnvironment struct {
+	Roles       []BenchmarkRoleEnvironment `json:"roles"`
+	Regions     []string                   `json:"regions"`
+	MultiRegion bool                       `json:"multiRegion"`
+	PingRTTAvg  float64                    `json:"pingRTTAvg"`
+}
+
+// BenchmarkRoleEnvironment summarizes the agents running one type of role
+type BenchmarkRoleEnvironment struct {
+	Role            common.SystemRole `json:"role"`
+	Count           int               `json:"count"`
+	NumCPU          int               `json:"numCPU"`
+	MemoryBytes     int64             `json:"memoryBytes"`
+	Architecture    string            `json:"arch"`
+	OperatingSystem string            `json:"os"`
+}
+
+// BenchmarkMetrics are the measured results. Throughput is in transactions per
+// second and latency in seconds
+type BenchmarkMetrics struct {
+	ThroughputUnit        string                        `json:"throughputUnit"`
+	ThroughputAvg         float64                       `json:"throughputAvg"`
+	ThroughputStd         float64                       `json:"throughputStd"`
+	ThroughputMin         float64                       `json:"throughputMin"`
+	ThroughputMax         float64                       `json:"throughputMax"`
+	ThroughputPercentiles []common.TestResultPercentile `json:"throughputPercentiles"`
+	LatencyUnit           string                        `json:"latencyUnit"`
+	LatencyAvg            float64                       `json:"latencyAvg"`
+	LatencyStd            float64                       `json:"latencyStd"`
+	LatencyMin            float64                       `json:"latencyMin"`
+	LatencyMax            float64                       `json:"latencyMax"`
+	LatencyPercentiles    []common.TestResultPercentile `json:"latencyPercentiles"`
+}
+
+// BenchmarkProvenance identifies the code, tooling and run that produced the
+// result
+type BenchmarkProvenance struct {
+	CodeCommit           string                       `json:"codeCommit"`
+	SeederCommit         string                       `json:"seederCommit"`
+	ControllerCommit     string                       `json:"controllerCommit"`
+	ContainerImageDigest string                       `json:"containerImageDigest,omitempty"`
+	TestRunID            string                       `json:"testRunID"`
+	SampleCount          int                          `json:"sampleCount"`
+	Started              time.Time                    `json:"started"`
+	Completed            time.Time                    `json:"completed"`
+	Result               *common.TestResultProvenance `json:"result,omitempty"`
+}
+
+// BenchmarkSubmission converts the result of a completed test run into the
+// community benchmark registry format
+func (t *TestRunManager) BenchmarkSubmission(
+	tr *common.TestRun,
+) (*BenchmarkSubmission, error) {
+	if tr.Status != common.TestRunStatusCompleted {
+		return nil, fmt.Errorf("test run %s has not completed", tr.ID)
+	}
+	res, err := t.CalculateResults(tr, false)
+	if err != nil {
+		return nil, err
+	}
+	if res == nil {
+		return nil, fmt.Errorf("test run %s has no result", tr.ID)
+	}
+
+	cfg := tr.NormalizedConfig()
+	sub := &BenchmarkSubmission{
+		Schema:      BenchmarkSubmissionSchema,
+		Generated:   time.Now(),
+		Config:      cfg,
+		ConfigHash:  hex.EncodeToString(cfg.Hash()),
+		Environment: benchmarkEnvironment(tr),
+		Metrics: BenchmarkMetrics{
+			ThroughputUnit:        "tx/s",
+			ThroughputAvg:         res.ThroughputAvg,
+			ThroughputStd:         res.ThroughputStd,
+			ThroughputMin:         res.ThroughputMin,
+			ThroughputMax:         res.ThroughputMax,
+			ThroughputPercentiles: res.ThroughputPercentiles,
+			LatencyUnit:           "s",
+			LatencyAvg:            res.LatencyAvg,
+			LatencyStd:            res.LatencyStd,
+			LatencyMin:            res.LatencyMin,
+			LatencyMax:            res.LatencyMax,
+			LatencyPercentiles:    res.LatencyPercentiles,
+		},
+		Provenance: BenchmarkProvenance{
+			CodeCommit:           tr.CommitHash,
+			SeederCommit:         tr.SeederHash,
+			ControllerCommit:     tr.ControllerCommit,
+			ContainerImageDigest: tr.ContainerImageDigest,
+			TestRunID:            tr.ID,
+			SampleCount:          tr.SampleCount,
+			Started:              tr.Started,
+			Completed:            tr.Completed,
+			Result:               res.Provenance,
+		},
+	}
+	for _, a := range tr.Annotations {
+		sub.Annotations = append(sub.Annotations, BenchmarkAnnotation{
+			Kind:    a.Kind,
+			Plot:    a.Plot,
+			Verdict: a.Verdict,
+			Text:    a.Text,
+			Updated: a.Updated,
+		})
+	}
+
+	b, err := json.Marshal(struct {
+		Metrics BenchmarkMetrics
+		Run     string
+	}{sub.Metrics, tr.ID})
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.Sum256(b)
+	sub.SubmissionID = hex.EncodeToString(h[:16])
+	return sub, nil
+}
+
+// benchmarkEnvironment summarizes the agents the test run was executed on per
+// role, based on the agent data collected at the start of the run
+func benchmarkEnvironment(tr *common.TestRun) BenchmarkEnvironment {
+	agents := map[int32]common.TestRunAgentData{}
+	for _, a := range tr.AgentDataAtStart {
+		agents[a.AgentID] = a
+	}
+
+	env := BenchmarkEnvironment{
+		Roles:   []BenchmarkRoleEnvironment{},
+		Regions: []string{},
+	}
+	byRole := map[common.SystemRole]*BenchmarkRoleEnvironment{}
+	order := []common.SystemRole{}
+	regions := map[string]bool{}
+	var rttSum float64
+	rttCount := 0
+	for _, r := range tr.Roles {
+		re, ok := byRole[r.Role]
+		if !ok {
+			re = &BenchmarkRoleEnvironment{Role: r.Role}
+			byRole[r.Role] = re
+			order = append(order, r.Role)
+		}
+		re.Count++
+		a, ok := agents[r.AgentID]
+		if !ok {
+			continue
+		}
+		// Roles of the same type normally run on identical instances - report
+		// the largest in case they don't
+		if a.SystemInfo.NumCPU > re.NumCPU {
+			re.NumCPU = a.SystemInfo.NumCPU
+		}
+		if a.SystemInfo.TotalMemory > re.MemoryBytes {
+			re.MemoryBytes = a.SystemInfo.TotalMemory
+		}
+		re.Architecture = a.SystemInfo.Architecture
+		re.OperatingSystem = a.SystemInfo.OperatingSystem
+		if a.AwsRegion != "" {
+			regions[a.AwsRegion] = true
+		}
+		if a.PingRTT > 0 {
+			rttSum += a.PingRTT
+			rttCount++
+		}
+	}
+	for _, role := range order {
+		env.Roles = append(env.Roles, *byRole[role])
+	}
+	for r := range regions {
+		env.Regions = append(env.Regions, r)
+	}
+	sort.Strings(env.Regions)
+	env.MultiRegion = len(env.Regions) > 1
+	if rttCount > 0 {
+		env.PingRTTAvg = rttSum / float64(rttCount)
+	}
+	return env
+}
@@ -0,0 +1,382 @@
+package testruns
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/coordinator/awsmgr"
+)
+
+// BundleSchema identifies the version of the format of test run bundles
+const BundleSchema = "opencbdc-tctl-bundle/v1"
+
+// bundleSeriesLevel is the aggregation level the time series of a test run
+// are exported at, if they can be aggregated over time. Raw transaction
+// latencies can run into the millions of points
+const bundleSeriesLevel = "1s"
+
+// bundleConfigFiles are the files the coordinator generated for the roles of
+// a test run, which are copied from its outputs into the bundle
+var bundleConfigFiles = []string{"config.cfg", roleOverridesFile}
+
+// BundleManifest describes the contents of a test run bundle
+type BundleManifest struct {
+	Schema           string    `json:"schema"`
+	Exported         time.Time `json:"exported"`
+	TestRunID        string    `json:"testRunID"`
+	Status           string    `json:"status"`
+	Architecture     string    `json:"architectureID"`
+	CommitHash       string    `json:"commitHash"`
+	SeederHash       string    `json:"seederHash"`
+	ControllerCommit string    `json:"controllerCommit"`
+	Files            []string  `json:"files"`
+}
+
+// BundleSeed contains the parameters the shards of a test run were preseeded
+// with
+type BundleSeed struct {
+	SeederCommit  string `json:"seederCommit"`
+	PreseedShards bool   `json:"preseedShards"`
+	PreseedCount  int64  `json:"preseedCount"`
+	SeedValue     int64  `json:"seedValue"`
+	SeedPrivKey   string `json:"seedPrivKey"`
+}
+
+// BundleImport is a test run definition recreated from a bundle, along with
+// the parts of the original run that could not be carried over
+type BundleImport struct {
+	TestRun  *common.TestRun `json:"testRun"`
+	Warnings []string        `json:"warnings"`
+}
+
+// testRunDefinition returns a copy of the test run stripped of everything
+// that happened when it ran, such that it can be scheduled again. The
+// annotations are kept, since the knowledge about the test run should travel
+// with it, and are dropped once the imported run is scheduled
+func testRunDefinition(tr *common.TestRun) (*common.TestRun, error) {
+	var def common.TestRun
+	b, err := json.Marshal(tr)
+	if err == nil {
+		err = json.Unmarshal(b, &def)
+	}
+	if err != nil {
+		return nil, err
+	}
+	def.ID = ""
+	def.Status = ""
+	def.Details = ""
+	def.CreatedByThumbprint = ""
+	def.ImpersonatedByThumbprint = ""
+	def.ApprovedByThumbprint = ""
+	def.AwaitingApproval = false
+	def.SweepID = ""
+	def.ExecutedCommands = nil
+	def.AgentDataAtStart = nil
+	def.AgentDataAtEnd = nil
+	def.PerformanceDataAvailable = false
+	def.Result = nil
+	def.Summary = nil
+	def.FailureSnapshots = nil
+	def.Failovers = nil
+	def.Preemptions = nil
+	def.FaultTimeline = nil
+	def.AbortTrigger = nil
+	def.CleanupResidue = nil
+	def.WarmEnvironmentID = ""
+	def.Regression = nil
+	def.OutputValidationErrors = nil
+	for _, r := range def.Roles {
+		r.AwsAgentInstanceId = ""
+		r.Failure = nil
+		if r.AwsLaunchTemplateID != "" {
+			r.AgentID = -1
+		}
+	}
+	return &def, nil
+}
+
+// bundleJSON adds a JSON document to the bundle
+func bundleJSON(zw *zip.Writer, name string, v interface{}) error {
+	f, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// bundleSeriesCSV adds a time series of the test run to the bundle as CSV,
+// aggregated at bundleSeriesLevel if possible
+func bundleSeriesCSV(
+	zw *zip.Writer,
+	tr *common.TestRun,
+	info TimeSeriesInfo,
+) (string, error) {
+	columnsID := info.ID
+	if _, ok := info.Levels[bundleSeriesLevel]; ok {
+		l, err := findTimeSeriesLevel(bundleSeriesLevel)
+		if err != nil {
+			return "", err
+		}
+		columnsID = timeSeriesLevelID(info.ID, l)
+	}
+	r, err := openTimeSeries(timeSeriesDir(tr), columnsID)
+	if err != nil {
+		return "", err
+	}
+	defer r.close()
+
+	name := fmt.Sprintf("results/%s.csv", info.ID)
+	f, err := zw.Create(name)
+	if err != nil {
+		return "", err
+	}
+	cw := csv.NewWriter(f)
+	err = cw.Write([]string{
+		fmt.Sprintf("x (%s)", info.XUnit),
+		fmt.Sprintf("y (%s)", info.YUnit),
+	})
+	if err != nil {
+		return "", err
+	}
+	err = r.scan(0, r.len(), func(x, y float64) {
+		// Errors are sticky, and checked after flushing
+		_ = cw.Write([]string{
+			strconv.FormatFloat(x, 'f', -1, 64),
+			strconv.FormatFloat(y, 'f', -1, 64),
+		})
+	})
+	if err != nil {
+		return "", err
+	}
+	cw.Flush()
+	return name, cw.Error()
+}
+
+// ExportBundle writes a ZIP archive with everything needed to reproduce the
+// test run elsewhere: its definition, the configuration files generated for
+// its roles, the layout of its agents, the seed parameters and its results.
+// The definition can be recreated on another controller with ImportBundle
+func (t *TestRunManager) ExportBundle(
+	tr *common.TestRun,
+	w io.Writer,
+) error {
+	if tr.Status == common.TestRunStatusQueued ||
+		tr.Status == common.TestRunStatusRunning {
+		return fmt.Errorf("Test run %s has not ended yet", tr.ID)
+	}
+	t.annotationsLock.Lock()
+	def, err := testRunDefinition(tr)
+	t.annotationsLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	zw := zip.NewWriter(w)
+	files := []string{}
+	add := func(name string, v interface{}) {
+		if err == nil {
+			err = bundleJSON(zw, name, v)
+			files = append(files, name)
+		}
+	}
+	add("testrun.json", def)
+	add("layout.json", t.Placement(tr))
+	add("seed.json", BundleSeed{
+		SeederCommit:  tr.SeederHash,
+		PreseedShards: tr.PreseedShards,
+		PreseedCount:  tr.PreseedCount,
+		SeedValue:     awsmgr.DefaultSeedValue,
+		SeedPrivKey:   seed_privkey,
+	})
+	if err != nil {
+		return err
+	}
+
+	outputsDir := filepath.Join(
+		common.DataDir(),
+		fmt.Sprintf("testruns/%s/outputs", tr.ID),
+	)
+	for _, name := range bundleConfigFiles {
+		b, err := ioutil.ReadFile(filepath.Join(outputsDir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		f, err := zw.Create("config/" + name)
+		if err != nil {
+			return err
+		}
+		if _, err = f.Write(b); err != nil {
+			return err
+		}
+		files = append(files, "config/"+name)
+	}
+
+	// Results are only available for completed test runs, the definition of
+	// the others is still worth reproducing
+	if tr.Result != nil {
+		add("results/result.json", tr.Result)
+		if err != nil {
+			return err
+		}
+	}
+	if tr.Status == common.TestRunStatusCompleted {
+		series, err := t.TimeSeries(tr)
+		if err != nil {
+			return err
+		}
+		for _, s := range series {
+			name, err := bundleSeriesCSV(zw, tr, s)
+			if err != nil {
+				return fmt.Errorf("Error exporting series %s: %v", s.ID, err)
+			}
+			files = append(files, name)
+		}
+	}
+
+	err = bundleJSON(zw, "manifest.json", BundleManifest{
+		Schema:           BundleSchema,
+		Exported:         time.Now(),
+		TestRunID:        tr.ID,
+		Status:           string(tr.Status),
+		Architecture:     tr.Architecture,
+		CommitHash:       tr.CommitHash,
+		SeederHash:       tr.SeederHash,
+		ControllerCommit: tr.ControllerCommit,
+		Files:            files,
+	})
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// readBundleJSON decodes a JSON document from the bundle
+func readBundleJSON(zr *zip.Reader, name string, v interface{}) error {
+	for _, f := range zr.File {
+		if f.Name != name {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		return json.NewDecoder(rc).Decode(v)
+	}
+	return fmt.Errorf("The bundle has no %s", name)
+}
+
+// ImportBundle recreates the definition of the test run exported to the
+// bundle. Launch templates that don't exist on this controller are replaced
+// by one launching the same instance type, preferably in the same region.
+// Like test runs from templates, the definition is returned rather than
+// scheduled, such that the user can review it before scheduling it. The
+// system tags are stripped, since imported runs were not scheduled by this
+// coordinator
+func (t *TestRunManager) ImportBundle(bundle []byte) (*BundleImport, error) {
+	zr, err := zip.NewReader(bytes.NewReader(bundle), int64(len(bundle)))
+	if err != nil {
+		return nil, errors.New("The bundle is not a ZIP archive")
+	}
+	var manifest BundleManifest
+	err = readBundleJSON(zr, "manifest.json", &manifest)
+	if err != nil {
+		return nil, err
+	}
+	if manifest.Schema != BundleSchema {
+		return nil, fmt.Errorf("Unsupported bundle format %s", manifest.Schema)
+	}
+	tr := &common.TestRun{}
+	err = readBundleJSON(zr, "testrun.json", tr)
+	if err != nil {
+		return nil, err
+	}
+	var layout TestRunPlacement
+	err = readBundleJSON(zr, "layout.json", &layout)
+	if err != nil {
+		return nil, err
+	}
+
+	StripSystemTags(tr)
+
+	ret := &BundleImport{TestRun: tr, Warnings: []string{}}
+	exported := map[string]awsmgr.AwsLaunchTemplate{}
+	for _, s := range layout.Slots {
+		exported[s.AwsLaunchTemplateID] = awsmgr.AwsLaunchTemplate{
+			TemplateID:   s.AwsLaunchTemplateID,
+			InstanceType: s.InstanceType,
+			Region:       s.Region,
+			Architecture: s.Architecture,
+		}
+	}
+	for _, r := range tr.Roles {
+		if r.ColocateWith != nil {
+			continue
+		}
+		if r.AwsLaunchTemplateID == "" {
+			ret.Warnings = append(ret.Warnings, fmt.Sprintf(
+				"%s %d ran on agent %d of the exporting controller, place it manually",
+				r.Role,
+				r.Index,
+				r.AgentID,
+			))
+			r.AgentID = -1
+			r.ManualPlacement = false
+			continue
+		}
+		if _, err := t.awsm.GetLaunchTemplate(r.AwsLaunchTemplateID); err == nil {
+			continue
+		}
+		lt := exported[r.AwsLaunchTemplateID]
+		id := t.equivalentTemplate(lt)
+		if id == "" {
+			ret.Warnings = append(ret.Warnings, fmt.Sprintf(
+				"No launch template for %s (%s) to run %s %d on",
+				lt.InstanceType,
+				lt.Architecture,
+				r.Role,
+				r.Index,
+			))
+			continue
+		}
+		r.AwsLaunchTemplateID = id
+	}
+	syncColocatedRoles(tr.Roles)
+	return ret, nil
+}
+
+// equivalentTemplate returns the ID of a launch template launching the same
+// instance type as the given one, in its region if possible, or an empty
+// string if there is none
+func (t *TestRunManager) equivalentTemplate(lt awsmgr.AwsLaunchTemplate) string {
+	ret := ""
+	for _, other := range t.awsm.LaunchTemplates() {
+		if other.InstanceType != lt.InstanceType ||
+			other.Architecture != lt.Architecture {
+			continue
+		}
+		if other.Region == lt.Region {
+			return other.TemplateID
+		}
+		if ret == "" {
+			ret = other.TemplateID
+		}
+	}
+	return ret
+}
@@ -0,0 +1,169 @@
+package testruns
+
+import (
+	"sort"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// CapacityPlannerConfig configures the capacity planner, which adjusts the
+// maximum number of agents the scheduler is allowed to run in parallel based
+// on the demand in the queue, in stead of having to size the fleet manually
+// before each big sweep
+type CapacityPlannerConfig struct {
+	// Enables the capacity planner. When disabled, MaxAgents is only changed
+	// manually
+	Enabled bool `json:"enabled"`
+	// The minimum number of agents to allow, even when there is no demand
+	// (warm-pool minimum)
+	MinAgents int `json:"minAgents"`
+	// The maximum number of agents the planner will ever scale to (budget
+	// cap)
+	BudgetMaxAgents int `json:"budgetMaxAgents"`
+	// How far ahead (in minutes) the planner looks at queued runs that are
+	// not allowed to run yet, to scale up ahead of demand
+	LookaheadMinutes int `json:"lookaheadMinutes"`
+}
+
+// ScalePlanStep is a single step in the scale plan: from the given time on,
+// the fleet should be sized to the given number of agents
+type ScalePlanStep struct {
+	At     time.Time `json:"at"`
+	Agents int       `json:"agents"`
+	// The sweeps that contribute to the demand in this step
+	SweepIDs []string `json:"sweepIDs"`
+}
+
+// SetCapacityPlannerConfig changes the capacity planner's configuration and
+// persists it
+func (t *TestRunManager) SetCapacityPlannerConfig(
+	cfg CapacityPlannerConfig,
+) error {
+	t.configLock.Lock()
+	t.config.CapacityPlanner = cfg
+	t.configLock.Unlock()
+	return t.PersistConfig()
+}
+
+// clampAgents limits the number of agents to the warm-pool minimum and budget
+// cap of the capacity planner
+func (cfg CapacityPlannerConfig) clampAgents(agents int) int {
+	if agents < cfg.MinAgents {
+		agents = cfg.MinAgents
+	}
+	if cfg.BudgetMaxAgents > 0 && agents > cfg.BudgetMaxAgents {
+		agents = cfg.BudgetMaxAgents
+	}
+	return agents
+}
+
+// ScalePlan calculates the fleet size over time based on the test runs that
+// are currently running and queued. Queued runs that can't run before a
+// certain time (such as the runs of a time sweep) are added to the demand from
+// the moment they become eligible, provided that moment falls within the
+// lookahead window. The returned steps are sorted by time, and the first step
+// is always the current demand
+func (t *TestRunManager) ScalePlan() []ScalePlanStep {
+	cfg := t.Config().CapacityPlanner
+	now := time.Now()
+	horizon := now.Add(time.Duration(cfg.LookaheadMinutes) * time.Minute)
+
+	t.testRunsLock.Lock()
+	runs := make([]*common.TestRun, len(t.testRuns))
+	copy(runs, t.testRuns)
+	t.testRunsLock.Unlock()
+
+	// Collect the moments at which the demand changes
+	running := 0
+	moments := []time.Time{now}
+	for _, tr := range runs {
+		if tr.Status == common.TestRunStatusRunning && !tr.AWSInstancesStopped {
+			running += len(tr.Roles)
+		}
+		if tr.Status == common.TestRunStatusQueued &&
+			tr.DontRunBefore.After(now) && tr.DontRunBefore.Before(horizon) {
+			moments = append(moments, tr.DontRunBefore)
+		}
+	}
+	sort.Slice(moments, func(i, j int) bool {
+		return moments[i].Before(moments[j])
+	})
+
+	steps := make([]ScalePlanStep, 0)
+	for _, m := range moments {
+		demand := running
+		sweeps := map[string]bool{}
+		for _, tr := range runs {
+			if tr.Status != common.TestRunStatusQueued || tr.AwaitingApproval ||
+				tr.SweepBudgetHold {
+				continue
+			}
+			if !tr.DontRunBefore.IsZero() && tr.DontRunBefore.After(m) {
+				continue
+			}
+			demand += len(tr.Roles)
+			if tr.SweepID != "" {
+				sweeps[tr.SweepID] = true
+			}
+		}
+		step := ScalePlanStep{
+			At:       m,
+			Agents:   cfg.clampAgents(demand),
+			SweepIDs: []string{},
+		}
+		for s := range sweeps {
+			step.SweepIDs = append(step.SweepIDs, s)
+		}
+		sort.Strings(step.SweepIDs)
+
+		// Only add a step if it changes the fleet size
+		if len(steps) > 0 && steps[len(steps)-1].Agents == step.Agents {
+			continue
+		}
+		steps = append(steps, step)
+	}
+	return steps
+}
+
+// CapacityPlanner is the loop that periodically applies the scale plan to the
+// scheduler's MaxAgents limit when the capacity planner is enabled. Scaling up
+// happens as soon as demand is queued (or about to become eligible), scaling
+// down happens once the demand (running and queued runs) has gone away
+func (t *TestRunManager) CapacityPlanner() {
+	for {
+		time.Sleep(time.Second * 30)
+		if !t.loadComplete || !t.Config().CapacityPlanner.Enabled {
+			continue
+		}
+
+		// Size the fleet to the peak demand within the lookahead window, such
+		// that capacity is available by the time the queued runs become
+		// eligible
+		plan := t.ScalePlan()
+		if len(plan) == 0 {
+			continue
+		}
+		agents := plan[0].Agents
+		for _, step := range plan {
+			if step.Agents > agents {
+				agents = step.Agents
+			}
+		}
+		current := t.Config().MaxAgents
+		if agents == current {
+			continue
+		}
+
+		logging.Infof(
+			"[Capacity planner] Scaling max agents from %d to %d",
+			current,
+			agents,
+		)
+		err := t.SetMaxAgents(agents)
+		if err != nil {
+			logging.Warnf("[Capacity planner] Unable to scale: %v", err)
+		}
+	}
+}
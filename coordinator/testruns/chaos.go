@@ -0,0 +1,386 @@
+package testruns
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/wire"
+)
+
+// faultBaselineSeconds is the number of seconds before a fault over which the
+// baseline throughput is averaged
+const faultBaselineSeconds = 30
+
+// faultAction is the injection or revert of a fault at a point in the load of
+// a test run
+type faultAction struct {
+	at     time.Duration
+	fault  int
+	revert bool
+}
+
+// activeInjection is a fault that was injected on an agent and can be
+// reverted
+type activeInjection struct {
+	event   int
+	faultID []byte
+}
+
+// validateFaults checks that the faults configured for the test run refer to
+// roles of the test run, have the parameters their kind requires, and are
+// injected before the test run ends
+func (t *TestRunManager) validateFaults(tr *common.TestRun) []error {
+	ret := []error{}
+	for i, f := range tr.Faults {
+		prefix := fmt.Sprintf("Fault %d (%s)", i+1, f.Kind)
+		if findRole(tr.Roles, common.TestRunRoleRef{
+			Role:  f.Role,
+			Index: f.Index,
+		}) == nil {
+			ret = append(ret, fmt.Errorf(
+				"%s: the test run has no %s %d",
+				prefix,
+				f.Role,
+				f.Index,
+			))
+		}
+		switch f.Kind {
+		case common.FaultKindKill:
+		case common.FaultKindPartition:
+			if f.PeerRole != "" && findRole(tr.Roles, common.TestRunRoleRef{
+				Role:  f.PeerRole,
+				Index: f.PeerIndex,
+			}) == nil {
+				ret = append(ret, fmt.Errorf(
+					"%s: the test run has no %s %d to partition from",
+					prefix,
+					f.PeerRole,
+					f.PeerIndex,
+				))
+			}
+		case common.FaultKindNetem:
+			if f.LatencyMs <= 0 && f.LossPercent <= 0 {
+				ret = append(ret, fmt.Errorf(
+					"%s: needs latency or packet loss",
+					prefix,
+				))
+			}
+			if f.LatencyMs < 0 || f.JitterMs < 0 || f.LossPercent < 0 ||
+				f.LossPercent > 100 {
+				ret = append(ret, fmt.Errorf(
+					"%s: invalid latency, jitter or packet loss",
+					prefix,
+				))
+			}
+		case common.FaultKindDiskThrottle:
+			if f.DiskBytesPerSecond <= 0 {
+				ret = append(ret, fmt.Errorf(
+					"%s: needs a positive disk bandwidth",
+					prefix,
+				))
+			}
+		default:
+			ret = append(ret, fmt.Errorf("%s: unknown kind of fault", prefix))
+		}
+		if f.After < 0 || f.Duration < 0 {
+			ret = append(ret, fmt.Errorf(
+				"%s: negative start or duration",
+				prefix,
+			))
+		}
+		if f.After >= tr.SampleCount {
+			ret = append(ret, fmt.Errorf(
+				"%s: injected after %d seconds, but the test run only takes %d",
+				prefix,
+				f.After,
+				tr.SampleCount,
+			))
+		}
+		// An agent has a single netem queueing discipline
+		for j := 0; j < i; j++ {
+			o := tr.Faults[j]
+			if f.Kind == common.FaultKindNetem &&
+				o.Kind == common.FaultKindNetem &&
+				o.Role == f.Role && o.Index == f.Index &&
+				faultsOverlap(f, o, tr.SampleCount) {
+				ret = append(ret, fmt.Errorf(
+					"%s: overlaps with netem fault %d on the same role",
+					prefix,
+					j+1,
+				))
+			}
+		}
+	}
+	return ret
+}
+
+// faultsOverlap returns true if the faults are active at the same time
+func faultsOverlap(a, b common.FaultInjection, sampleCount int) bool {
+	end := func(f common.FaultInjection) int {
+		if f.Duration == 0 {
+			return sampleCount
+		}
+		return f.After + f.Duration
+	}
+	return a.After < end(b) && b.After < end(a)
+}
+
+// faultActions returns the injections and reverts of the faults of the test
+// run in the order they happen
+func faultActions(tr *common.TestRun) []faultAction {
+	actions := []faultAction{}
+	for i, f := range tr.Faults {
+		actions = append(actions, faultAction{
+			at:    time.Duration(f.After) * time.Second,
+			fault: i,
+		})
+		if f.Duration > 0 && f.Kind != common.FaultKindKill {
+			actions = append(actions, faultAction{
+				at:     time.Duration(f.After+f.Duration) * time.Second,
+				fault:  i,
+				revert: true,
+			})
+		}
+	}
+	// Reverts go first, such that a fault ending when another starts on the
+	// same agent is out of the way
+	sort.SliceStable(actions, func(i, j int) bool {
+		if actions[i].at == actions[j].at {
+			return actions[i].revert && !actions[j].revert
+		}
+		return actions[i].at < actions[j].at
+	})
+	return actions
+}
+
+// InjectFaults is run in a goroutine by RunBinaries to inject the faults of
+// the test run at their scheduled points in its load, and revert them after
+// their duration. Every fault is recorded in the fault timeline of the test
+// run, such that its impact can be read from the system throughput. The time
+// the test run is paused does not count towards the schedule. When `cancel`
+// is closed, the faults that are still active are reverted
+func (t *TestRunManager) InjectFaults(
+	tr *common.TestRun,
+	cancel chan bool,
+) {
+	if len(tr.Faults) == 0 {
+		return
+	}
+	started := time.Now()
+	active := map[int]activeInjection{}
+	defer func() {
+		for i, a := range active {
+			t.revertFault(tr, i, a)
+		}
+	}()
+
+	for _, a := range faultActions(tr) {
+		for time.Until(started.Add(a.at+t.pausedDuration(tr))) > 0 {
+			select {
+			case <-cancel:
+				return
+			case <-time.After(1 * time.Second):
+			}
+		}
+		if a.revert {
+			if inj, ok := active[a.fault]; ok {
+				t.revertFault(tr, a.fault, inj)
+				delete(active, a.fault)
+			}
+			continue
+		}
+		inj, ok := t.injectFault(tr, a.fault)
+		if ok {
+			active[a.fault] = inj
+		}
+	}
+
+	// Faults without a duration last until the test run ends
+	<-cancel
+}
+
+// injectFault injects the fault with the given index into the test run and
+// records it in its timeline. Returns false if the fault was not injected or
+// cannot be reverted
+func (t *TestRunManager) injectFault(
+	tr *common.TestRun,
+	i int,
+) (activeInjection, bool) {
+	f := tr.Faults[i]
+	role := findRole(tr.Roles, common.TestRunRoleRef{
+		Role:  f.Role,
+		Index: f.Index,
+	})
+	ev := common.FaultEvent{
+		Fault:    i,
+		Kind:     f.Kind,
+		Role:     f.Role,
+		Index:    f.Index,
+		AgentID:  role.AgentID,
+		Injected: time.Now(),
+	}
+	t.WriteLog(
+		tr,
+		"Injecting %s fault into %s %d (Agent %d)",
+		f.Kind,
+		f.Role,
+		f.Index,
+		role.AgentID,
+	)
+
+	var faultID []byte
+	var err error
+	if f.Kind == common.FaultKindKill {
+		t.killRoleCommands(tr, role)
+	} else {
+		faultID, err = common.RandomIDBytes(12)
+		if err == nil {
+			msg := &wire.InjectFaultRequestMsg{
+				FaultID:            faultID,
+				EnvironmentID:      tr.Environments[role.AgentID],
+				Kind:               string(f.Kind),
+				LatencyMs:          f.LatencyMs,
+				JitterMs:           f.JitterMs,
+				LossPercent:        f.LossPercent,
+				DiskBytesPerSecond: f.DiskBytesPerSecond,
+			}
+			if f.Kind == common.FaultKindPartition {
+				msg.PeerIPs, err = t.partitionPeerIPs(tr, f, role)
+			}
+			if err == nil {
+				err = t.am.InjectFault(role.AgentID, msg)
+			}
+		}
+	}
+	if err != nil {
+		ev.Error = err.Error()
+		t.WriteLog(tr, "Could not inject fault %d: %v", i+1, err)
+	}
+	tr.FaultTimeline = append(tr.FaultTimeline, ev)
+	t.PersistTestRun(tr)
+	return activeInjection{
+		event:   len(tr.FaultTimeline) - 1,
+		faultID: faultID,
+	}, err == nil && faultID != nil
+}
+
+// partitionPeerIPs returns the IPs of the agents the role is partitioned from
+// by the fault: the agent of its peer role, or all other agents of the test
+// run if the fault has no peer role
+func (t *TestRunManager) partitionPeerIPs(
+	tr *common.TestRun,
+	f common.FaultInjection,
+	role *common.TestRunRole,
+) ([]string, error) {
+	peers := tr.Roles
+	if f.PeerRole != "" {
+		peers = []*common.TestRunRole{findRole(tr.Roles, common.TestRunRoleRef{
+			Role:  f.PeerRole,
+			Index: f.PeerIndex,
+		})}
+	}
+	seen := map[int32]bool{role.AgentID: true}
+	ips := []string{}
+	for _, p := range peers {
+		if seen[p.AgentID] {
+			continue
+		}
+		seen[p.AgentID] = true
+		a, err := t.coord.GetAgent(p.AgentID)
+		if err != nil {
+			return nil, err
+		}
+		if len(a.SystemInfo.PrivateIPs) == 0 {
+			return nil, fmt.Errorf("agent %d has no private IP", p.AgentID)
+		}
+		ips = append(ips, a.SystemInfo.PrivateIPs[0].String())
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf(
+			"%s %d shares its agent with the roles to partition it from",
+			role.Role,
+			role.Index,
+		)
+	}
+	return ips, nil
+}
+
+// revertFault reverts an injected fault and records the time it was reverted
+// in the timeline of the test run
+func (t *TestRunManager) revertFault(
+	tr *common.TestRun,
+	i int,
+	inj activeInjection,
+) {
+	ev := &tr.FaultTimeline[inj.event]
+	t.WriteLog(
+		tr,
+		"Reverting %s fault on %s %d (Agent %d)",
+		ev.Kind,
+		ev.Role,
+		ev.Index,
+		ev.AgentID,
+	)
+	err := t.am.InjectFault(ev.AgentID, &wire.InjectFaultRequestMsg{
+		FaultID: inj.faultID,
+		Revert:  true,
+	})
+	if err != nil {
+		ev.Error = fmt.Sprintf("Revert failed: %v", err)
+		t.WriteLog(tr, "Could not revert fault %d: %v", i+1, err)
+	}
+	ev.Reverted = time.Now()
+	t.PersistTestRun(tr)
+}
+
+// faultImpacts determines the system throughput before and during each of
+// the faults injected into the test run. Returns nil if no faults were
+// injected
+func (t *TestRunManager) faultImpacts(
+	tr *common.TestRun,
+) ([]common.FaultImpact, error) {
+	if len(tr.FaultTimeline) == 0 {
+		return nil, nil
+	}
+	tps, first, last, err := systemThroughput(tr)
+	if err != nil {
+		return nil, err
+	}
+	ret := []common.FaultImpact{}
+	for _, ev := range tr.FaultTimeline {
+		imp := common.FaultImpact{FaultEvent: ev, Minimum: math.MaxFloat64}
+		injected := ev.Injected.Unix()
+		from := injected - faultBaselineSeconds
+		if from < first {
+			from = first
+		}
+		for sec := from; sec < injected; sec++ {
+			imp.Baseline += tps[sec]
+		}
+		if injected > from {
+			imp.Baseline /= float64(injected - from)
+		}
+
+		until := last
+		if !ev.Reverted.IsZero() && ev.Reverted.Unix() < until {
+			until = ev.Reverted.Unix()
+		}
+		for sec := injected; sec <= until; sec++ {
+			imp.During += tps[sec]
+			if tps[sec] < imp.Minimum {
+				imp.Minimum = tps[sec]
+			}
+		}
+		if until >= injected {
+			imp.During /= float64(until - injected + 1)
+		}
+		if imp.Minimum == math.MaxFloat64 {
+			imp.Minimum = 0
+		}
+		ret = append(ret, imp)
+	}
+	return ret, nil
+}
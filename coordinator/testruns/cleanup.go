@@ -0,0 +1,165 @@
+package testruns
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+)
+
+// VerifyCleanup is called after the teardown of a test run to remove the
+// environments of the test run from its agents, and verify that no processes
+// are left running in them and the ports of the roles are released, such that
+// leftovers can't contaminate the results of the next test run on the agents.
+// The residue found is logged and recorded on the test run, and cleaned by
+// the agents if the test run asks to force the cleanup. Agents launched in AWS
+// for the test run are terminated, so only the other agents are verified.
+// Nothing is done if the test run skips its cleanup
+func (t *TestRunManager) VerifyCleanup(
+	tr *common.TestRun,
+	envs map[int32][]byte,
+) {
+	t.verifyCleanup(tr, envs, tr.ForceCleanup)
+}
+
+// verifyCleanup removes the environments of the test run from its agents and
+// verifies their cleanup. If force is set, the agents clean the residue, and
+// residue they could not clean is recorded on the reconciliation list
+func (t *TestRunManager) verifyCleanup(
+	tr *common.TestRun,
+	envs map[int32][]byte,
+	force bool,
+) {
+	if tr.SkipCleanUp {
+		return
+	}
+	ports := map[int32][]int{}
+	for _, r := range tr.Roles {
+		if r.AwsLaunchTemplateID != "" {
+			continue
+		}
+		if _, ok := ports[r.AgentID]; !ok {
+			ports[r.AgentID] = []int{}
+		}
+		if p := t.rolePort(tr, r.Role); p > 0 {
+			ports[r.AgentID] = append(
+				ports[r.AgentID],
+				p+int(PortIncrementDefaultPort),
+				p+int(PortIncrementRaftPort),
+				p+int(PortIncrementClientPort),
+			)
+		}
+	}
+	if len(ports) == 0 {
+		return
+	}
+
+	t.WriteLog(tr, "Verifying the cleanup of %d agents", len(ports))
+	residue := []common.CleanupResidue{}
+	residueLock := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for agentID, agentPorts := range ports {
+		wg.Add(1)
+		go func(agentID int32, agentPorts []int) {
+			defer wg.Done()
+			res := t.verifyAgentCleanup(
+				tr,
+				agentID,
+				envs[agentID],
+				agentPorts,
+				force,
+			)
+			if res == nil {
+				return
+			}
+			residueLock.Lock()
+			residue = append(residue, *res)
+			residueLock.Unlock()
+		}(agentID, agentPorts)
+	}
+	wg.Wait()
+
+	if len(residue) == 0 {
+		t.WriteLog(tr, "All agents were cleaned up")
+		return
+	}
+	tr.CleanupResidue = residue
+	t.PersistTestRun(tr)
+}
+
+// verifyAgentCleanup removes the environment from the agent and verifies its
+// cleanup. Returns the residue found, or nil if there is none
+func (t *TestRunManager) verifyAgentCleanup(
+	tr *common.TestRun,
+	agentID int32,
+	envID []byte,
+	ports []int,
+	force bool,
+) *common.CleanupResidue {
+	err := t.am.DestroyEnvironment(agentID, envID)
+	if err != nil {
+		t.WriteLog(
+			tr,
+			"Unable to remove the environment from agent %d: %v",
+			agentID,
+			err,
+		)
+	}
+	rep, err := t.am.VerifyCleanup(agentID, envID, ports, force)
+	if err != nil {
+		t.WriteLog(
+			tr,
+			"Unable to verify the cleanup of agent %d: %v",
+			agentID,
+			err,
+		)
+		if force {
+			t.recordLeakedEnvironment(
+				tr,
+				agentID,
+				envID,
+				ports,
+				fmt.Sprintf("unverified cleanup on agent %d", agentID),
+			)
+		}
+		return &common.CleanupResidue{AgentID: agentID, Error: err.Error()}
+	}
+	if len(rep.Processes) == 0 && len(rep.Ports) == 0 && len(rep.Dirs) == 0 {
+		return nil
+	}
+	outcome := "left in place"
+	if force && rep.Cleaned {
+		outcome = "force-cleaned"
+	} else if force {
+		outcome = "could not be force-cleaned"
+		t.recordLeakedEnvironment(
+			tr,
+			agentID,
+			envID,
+			ports,
+			fmt.Sprintf(
+				"agent %d: processes %v, ports in use %v, directories %v",
+				agentID,
+				rep.Processes,
+				rep.Ports,
+				rep.Dirs,
+			),
+		)
+	}
+	t.WriteLog(
+		tr,
+		"Teardown left residue on agent %d (%s): processes %v, ports in use %v, directories %v",
+		agentID,
+		outcome,
+		rep.Processes,
+		rep.Ports,
+		rep.Dirs,
+	)
+	return &common.CleanupResidue{
+		AgentID:   agentID,
+		Processes: rep.Processes,
+		Ports:     rep.Ports,
+		Dirs:      rep.Dirs,
+		Cleaned:   rep.Cleaned,
+	}
+}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/mit-dci/opencbdc-tctl/common"
 	"github.com/mit-dci/opencbdc-tctl/coordinator"
+	"github.com/mit-dci/opencbdc-tctl/coordinator/agents"
 )
 
 // runningCommand is used to store a reference to all active commands' IDs and
@@ -115,44 +116,78 @@ func (t *TestRunManager) StartRoleBinaries(
 	// multiple goroutines at once
 	cmdLock := sync.Mutex{}
 
+	// The digest-pinned container image each agent ran its role in, if the
+	// test run uses a container image
+	imageDigests := map[int32]string{}
+
+	// Soak tests rotate the logs of the roles on the agents
+	logRotateBytes, logRotateKeep := soakLogRotation(tr)
+
 	for _, rl := range roles {
 		go func(r *common.TestRunRole) {
 			// Use SubstituteParameters to replace the placeholders in the
 			// roleParameters with the values based on the testrun and role
 			params := make([]string, 0)
+			bin := t.RoleBinary(tr, r.Role)
 			params = append(params, tr.Params...)
 			params = append(
 				params,
-				t.SubstituteParameters(roleParameters[r.Role], r, tr)...)
+				t.SubstituteParameters(t.roleParams(tr, r.Role), r, tr)...)
+			params = append(params, r.ExtraArgs...)
 
 			t.WriteLog(
 				tr,
 				"Starting %s on agent %d with parameters %v",
-				roleBinaries[r.Role],
+				bin,
 				r.AgentID,
 				params,
 			)
+			if r.Limits != nil {
+				t.WriteLog(
+					tr,
+					"Limiting %s %d to %v vCPUs, %d MiB of memory and IO weight %d (zero is unlimited)",
+					r.Role,
+					r.Index,
+					r.Limits.CPUs,
+					r.Limits.MemoryMiB,
+					r.Limits.IOWeight,
+				)
+			}
+			if len(r.ExtraEnv) > 0 {
+				t.WriteLog(
+					tr,
+					"Starting %s %d with extra environment %v",
+					r.Role,
+					r.Index,
+					r.ExtraEnv,
+				)
+			}
 
 			// Instruct the agent to run the actual command, and get the ID
 			// under which the command is running.
-			cmdID, err := t.am.ExecuteCommand(
+			cmdID, imageDigest, err := t.am.ExecuteCommand(
 				r.AgentID,
-				roleBinaries[r.Role],
-				params,
-				[]string{
-					fmt.Sprintf("TESTRUN_ID=%s", tr.ID),
-					fmt.Sprintf("TESTRUN_ROLE=%s-%d", r.Role, r.Index),
+				agents.ExecuteCommandOptions{
+					Command: bin,
+					Params:  params,
+					Env: append(append([]string{
+						fmt.Sprintf("TESTRUN_ID=%s", tr.ID),
+						fmt.Sprintf("TESTRUN_ROLE=%s-%d", r.Role, r.Index),
+					}, t.runCredentialsEnv(tr)...), r.ExtraEnv...),
+					EnvironmentID:  envs[r.AgentID],
+					Timeout:        roleCommandTimeout(tr),
+					Results:        cmd,
+					Wait:           wait,
+					Profile:        true,
+					Perf:           tr.RunPerf,
+					PerfSampleRate: tr.PerfSampleRate,
+					Debug:          tr.Debug,
+					RecordNetwork:  tr.RecordNetworkTraffic,
+					ContainerImage: tr.ContainerImage,
+					LogRotateBytes: logRotateBytes,
+					LogRotateKeep:  logRotateKeep,
+					Limits:         r.Limits,
 				},
-				envs[r.AgentID],
-				"",
-				15000,
-				cmd,
-				wait,
-				true,
-				tr.RunPerf,
-				tr.PerfSampleRate,
-				tr.Debug,
-				tr.RecordNetworkTraffic,
 			)
 			cmdLock.Lock()
 			if err != nil {
@@ -161,7 +196,7 @@ func (t *TestRunManager) StartRoleBinaries(
 				t.WriteLog(
 					tr,
 					"Error occurred starting %s on agent %d: %s",
-					roleBinaries[r.Role],
+					bin,
 					r.AgentID,
 					err,
 				)
@@ -174,6 +209,10 @@ func (t *TestRunManager) StartRoleBinaries(
 					agentID:   r.AgentID,
 					commandID: cmdID,
 				}}, cmds...)
+				t.recordRoleCommand(tr, r, cmdID)
+				if imageDigest != "" {
+					imageDigests[r.AgentID] = imageDigest
+				}
 			}
 			cmdLock.Unlock()
 
@@ -185,6 +224,11 @@ func (t *TestRunManager) StartRoleBinaries(
 	// Wait for all goroutines to complete - which means all commands were
 	// either started or yielded an error
 	wg.Wait()
+
+	err := t.recordContainerImageDigest(tr, imageDigests)
+	if err != nil {
+		errs = append(errs, err)
+	}
 	if len(errs) > 0 {
 		// There were errors starting the commands, so we have to abort the
 		// test run here. We have written the individual errors to the testrun
@@ -206,6 +250,35 @@ func (t *TestRunManager) StartRoleBinaries(
 	return cmds, nil
 }
 
+// recordContainerImageDigest stores the digest of the container image the
+// roles ran in in the test run's metadata. Agents resolve a tagged image
+// themselves, so this fails if they did not all end up with the same image or
+// if the image differs from the one recorded when starting earlier roles
+func (t *TestRunManager) recordContainerImageDigest(
+	tr *common.TestRun,
+	imageDigests map[int32]string,
+) error {
+	for agentID, digest := range imageDigests {
+		if tr.ContainerImageDigest == "" {
+			tr.ContainerImageDigest = digest
+			t.WriteLog(tr, "Running roles in container image %s", digest)
+		}
+		if digest != tr.ContainerImageDigest {
+			t.WriteLog(
+				tr,
+				"Agent %d runs container image %s instead of %s",
+				agentID,
+				digest,
+				tr.ContainerImageDigest,
+			)
+			return fmt.Errorf(
+				"Agents are not running the same container image",
+			)
+		}
+	}
+	return nil
+}
+
 // FilterCommandsByRole filters the allCmds array by only including commands
 // running on agents that have a particular system role
 func (t *TestRunManager) FilterCommandsByRole(
@@ -226,19 +299,64 @@ func (t *TestRunManager) FilterCommandsByRole(
 	return filteredCommands
 }
 
-// BreakAndTerminateAllCmds will instruct the agent runnning a command to send a
-// os.Interrupt signal followed by an os.Kill signal to it, for each of the
-// commands in the runningCommands array.
+// BreakAndTerminateAllCmds stops the commands in the runningCommands array in
+// two phases. First the agents are instructed to send an os.Interrupt signal
+// to all of them, and the commands are given teardownGracePeriod to exit.
+// The commands that are still running after that are sent an os.Kill signal,
+// after which the agents should report them stopped within
+// teardownKillTimeout. The kill is sent even if interrupting some of the
+// commands failed, such that no commands are left running
 func (t *TestRunManager) BreakAndTerminateAllCmds(
 	tr *common.TestRun,
 	cmds []runningCommand,
 ) error {
-	err := t.BreakAllCmds(tr, cmds)
+	breakErr := t.BreakAllCmds(tr, cmds)
+	remaining := t.awaitCommandsStopped(cmds, teardownGracePeriod)
+	if len(remaining) == 0 {
+		return breakErr
+	}
+	t.WriteLog(
+		tr,
+		"%d commands did not stop within %.0f seconds, killing them",
+		len(remaining),
+		teardownGracePeriod.Seconds(),
+	)
+	err := t.TerminateAllCmds(tr, remaining)
 	if err != nil {
 		return err
 	}
-	time.Sleep(time.Second * 5)
-	return t.TerminateAllCmds(tr, cmds)
+	remaining = t.awaitCommandsStopped(remaining, teardownKillTimeout)
+	if len(remaining) > 0 {
+		// The processes are killed by the forced cleanup of the environments
+		// or recorded as leaked, so the teardown can carry on
+		t.WriteLog(
+			tr,
+			"%d commands were not reported stopped after killing them",
+			len(remaining),
+		)
+	}
+	return breakErr
+}
+
+// awaitCommandsStopped waits until the agents reported all commands finished
+// or the timeout expired, and returns the commands that are still running
+func (t *TestRunManager) awaitCommandsStopped(
+	cmds []runningCommand,
+	timeout time.Duration,
+) []runningCommand {
+	deadline := time.Now().Add(timeout)
+	for {
+		remaining := []runningCommand{}
+		for _, c := range cmds {
+			if t.am.CommandRunning(c.commandID) {
+				remaining = append(remaining, c)
+			}
+		}
+		if len(remaining) == 0 || time.Now().After(deadline) {
+			return remaining
+		}
+		time.Sleep(time.Second)
+	}
 }
 
 // TerminateAllCmds will instruct the agent runnning a command to send a
@@ -347,16 +465,34 @@ func (t *TestRunManager) HandleCommandFailure(
 		t.WriteLog(tr, "Error copying outputs: %v", err)
 	}
 
-	t.FailTestRun(
-		tr,
-		fmt.Errorf(
-			"command %s [%s] on agent %d failed with exit code %d",
-			fail.CommandID,
-			fail.Description,
-			fail.AgentID,
-			fail.ExitCode,
-		),
-	)
+	// If one of the abort conditions of the test run triggered, the test
+	// run failed because of it rather than the command
+	if trigger := tr.AbortTrigger; trigger != nil {
+		t.FailTestRun(
+			tr,
+			withFailureClass(abortFailureClass(trigger.Condition), fmt.Errorf(
+				"abort condition %s triggered: %s",
+				trigger.Condition,
+				trigger.Reason,
+			)),
+		)
+	} else {
+		t.FailTestRun(
+			tr,
+			withFailureClass(common.FailureClassSUTCrash, fmt.Errorf(
+				"command %s [%s] on agent %d failed with exit code %d",
+				fail.CommandID,
+				fail.Description,
+				fail.AgentID,
+				fail.ExitCode,
+			)),
+		)
+	}
+
+	// Failed roles are the most likely to leave processes behind. The agents
+	// have been snapshotted by FailTestRun if requested, so their
+	// environments can be removed
+	t.VerifyCleanup(tr, envs)
 	return nil
 }
 
@@ -369,7 +505,9 @@ func (t *TestRunManager) RunBinaries(
 	cmd chan *common.ExecutedCommand,
 	failures chan *common.ExecutedCommand,
 ) error {
-	if t.IsAtomizer(tr.Architecture) {
+	if m := t.architectureManifest(tr.Architecture); m != nil {
+		return t.RunBinariesManifest(tr, m, envs, cmd, failures)
+	} else if t.IsAtomizer(tr.Architecture) {
 		return t.RunBinariesAtomizer(tr, envs, cmd, failures)
 	} else if t.Is2PC(tr.Architecture) {
 		return t.RunBinariesTwoPhase(tr, envs, cmd, failures)
@@ -0,0 +1,271 @@
+package testruns
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// tCritical95 holds the two-sided 95% critical values of Student's t
+// distribution for 1 to 30 degrees of freedom
+var tCritical95 = []float64{
+	12.706, 4.303, 3.182, 2.776, 2.571, 2.447, 2.365, 2.306, 2.262, 2.228,
+	2.201, 2.179, 2.160, 2.145, 2.131, 2.120, 2.110, 2.101, 2.093, 2.086,
+	2.080, 2.074, 2.069, 2.064, 2.060, 2.056, 2.052, 2.048, 2.045, 2.042,
+}
+
+// ComparisonSample describes the values of a metric over the completed runs
+// of one of the commits in a comparison
+type ComparisonSample struct {
+	Count  int     `json:"count"`
+	Mean   float64 `json:"mean"`
+	StdDev float64 `json:"stdDev"`
+}
+
+// ComparisonMetric is the difference of a metric between the baseline commit
+// (A) and the compared commit (B). The confidence interval is the 95%
+// interval of the difference of the means (B - A) using Welch's t-test, and
+// is only available when both commits have at least two results
+type ComparisonMetric struct {
+	Name         string           `json:"name"`
+	A            ComparisonSample `json:"a"`
+	B            ComparisonSample `json:"b"`
+	Delta        float64          `json:"delta"`
+	DeltaPercent float64          `json:"deltaPercent"`
+	CIAvailable  bool             `json:"ciAvailable"`
+	CILow        float64          `json:"ciLow"`
+	CIHigh       float64          `json:"ciHigh"`
+	// Significant is set when the confidence interval does not include zero
+	Significant bool `json:"significant"`
+}
+
+// ComparisonReport is the statistical comparison of the results of a
+// comparison run between two commits
+type ComparisonReport struct {
+	SweepID     string              `json:"sweepID"`
+	CommitA     string              `json:"commitA"`
+	CommitB     string              `json:"commitB"`
+	Interleaved bool                `json:"interleaved"`
+	Complete    bool                `json:"complete"`
+	RunIDsA     []string            `json:"runIDsA"`
+	RunIDsB     []string            `json:"runIDsB"`
+	Failed      int                 `json:"failed"`
+	Metrics     []*ComparisonMetric `json:"metrics"`
+	Generated   time.Time           `json:"generated"`
+}
+
+// comparisonReportPath returns the path the final comparison report of a
+// comparison run is stored at
+func comparisonReportPath(sweepID string) string {
+	return filepath.Join(
+		common.DataDir(),
+		"testruns",
+		"comparisons",
+		fmt.Sprintf("%s.json", sweepID),
+	)
+}
+
+// sampleOf returns the count, mean and sample standard deviation of the
+// values
+func sampleOf(values []float64) ComparisonSample {
+	s := ComparisonSample{Count: len(values)}
+	if s.Count == 0 {
+		return s
+	}
+	for _, v := range values {
+		s.Mean += v
+	}
+	s.Mean /= float64(s.Count)
+	if s.Count < 2 {
+		return s
+	}
+	for _, v := range values {
+		s.StdDev += (v - s.Mean) * (v - s.Mean)
+	}
+	s.StdDev = math.Sqrt(s.StdDev / float64(s.Count-1))
+	return s
+}
+
+// tCritical returns the two-sided 95% critical value of Student's t
+// distribution for the (fractional) degrees of freedom, rounded down to stay
+// conservative
+func tCritical(df float64) float64 {
+	i := int(math.Floor(df))
+	if i < 1 {
+		i = 1
+	}
+	if i <= len(tCritical95) {
+		return tCritical95[i-1]
+	}
+	return 1.96 + 2.4/float64(i)
+}
+
+// compareSamples computes the difference of a metric between the values of
+// the two commits
+func compareSamples(name string, a, b []float64) *ComparisonMetric {
+	m := &ComparisonMetric{Name: name, A: sampleOf(a), B: sampleOf(b)}
+	if m.A.Count == 0 || m.B.Count == 0 {
+		return m
+	}
+	m.Delta = m.B.Mean - m.A.Mean
+	if m.A.Mean != 0 {
+		m.DeltaPercent = m.Delta / m.A.Mean * 100
+	}
+	if m.A.Count < 2 || m.B.Count < 2 {
+		return m
+	}
+	va := m.A.StdDev * m.A.StdDev / float64(m.A.Count)
+	vb := m.B.StdDev * m.B.StdDev / float64(m.B.Count)
+	se := math.Sqrt(va + vb)
+	m.CIAvailable = true
+	if se == 0 {
+		m.CILow, m.CIHigh = m.Delta, m.Delta
+		m.Significant = m.Delta != 0
+		return m
+	}
+	// Welch-Satterthwaite degrees of freedom
+	df := (va + vb) * (va + vb) /
+		(va*va/float64(m.A.Count-1) + vb*vb/float64(m.B.Count-1))
+	margin := tCritical(df) * se
+	m.CILow = m.Delta - margin
+	m.CIHigh = m.Delta + margin
+	m.Significant = m.CILow > 0 || m.CIHigh < 0
+	return m
+}
+
+// GenerateComparisonReport compares the results of the runs of both commits
+// of a comparison run. Once all its runs are done, the report stored when
+// the comparison finished is returned
+func (t *TestRunManager) GenerateComparisonReport(
+	sweepID string,
+) (*ComparisonReport, error) {
+	b, err := os.ReadFile(comparisonReportPath(sweepID))
+	if err == nil {
+		var report ComparisonReport
+		err = json.Unmarshal(b, &report)
+		if err == nil {
+			return &report, nil
+		}
+	}
+	return t.compareSweepRuns(sweepID)
+}
+
+// compareSweepRuns computes the comparison report from the current state of
+// the runs of a comparison run
+func (t *TestRunManager) compareSweepRuns(
+	sweepID string,
+) (*ComparisonReport, error) {
+	runs := t.sweepRuns(sweepID)
+	if len(runs) == 0 {
+		return nil, ErrSweepNotFound
+	}
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].Created.Before(runs[j].Created)
+	})
+	first := runs[0]
+	if first.Sweep != "comparison" {
+		return nil, fmt.Errorf("Sweep %s is not a comparison run", sweepID)
+	}
+
+	report := &ComparisonReport{
+		SweepID:     sweepID,
+		CommitA:     first.CommitHash,
+		CommitB:     first.CompareCommitHash,
+		Interleaved: first.CompareInterleaved,
+		RunIDsA:     []string{},
+		RunIDsB:     []string{},
+		Metrics:     []*ComparisonMetric{},
+		Generated:   time.Now(),
+	}
+	// The first run is always of the baseline commit, the commit to compare
+	// is recorded on every run
+	values := map[string]map[string][]float64{
+		report.CommitA: {},
+		report.CommitB: {},
+	}
+	names := []string{"throughputAvg", "latencyAvg"}
+	seen := map[string]bool{}
+	pending := 0
+	for _, r := range runs {
+		switch r.CommitHash {
+		case report.CommitA:
+			report.RunIDsA = append(report.RunIDsA, r.ID)
+		case report.CommitB:
+			report.RunIDsB = append(report.RunIDsB, r.ID)
+		default:
+			continue
+		}
+		switch r.Status {
+		case common.TestRunStatusQueued, common.TestRunStatusRunning:
+			pending++
+			continue
+		case common.TestRunStatusCompleted:
+		default:
+			report.Failed++
+			continue
+		}
+		if r.Result == nil {
+			continue
+		}
+		v := values[r.CommitHash]
+		v["throughputAvg"] = append(v["throughputAvg"], r.Result.ThroughputAvg)
+		v["latencyAvg"] = append(v["latencyAvg"], r.Result.LatencyAvg)
+		for _, p := range r.Result.LatencyPercentiles {
+			name := fmt.Sprintf("latencyP%v", p.Bucket)
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+			v[name] = append(v[name], p.Value)
+		}
+	}
+	report.Complete = pending == 0 &&
+		len(unscheduledSweepRuns(runs)) == 0
+
+	for _, n := range names {
+		report.Metrics = append(report.Metrics, compareSamples(
+			n,
+			values[report.CommitA][n],
+			values[report.CommitB][n],
+		))
+	}
+	return report, nil
+}
+
+// storeComparisonReport generates the final report of a comparison run once
+// all its runs are done, and stores it as the result of the comparison
+func (t *TestRunManager) storeComparisonReport(tr *common.TestRun) {
+	report, err := t.compareSweepRuns(tr.SweepID)
+	if err != nil {
+		logging.Warnf("Unable to compare runs of sweep %s: %v", tr.SweepID, err)
+		return
+	}
+	if !report.Complete {
+		return
+	}
+	b, err := json.Marshal(report)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(comparisonReportPath(tr.SweepID)), 0755)
+	}
+	if err == nil {
+		err = os.WriteFile(comparisonReportPath(tr.SweepID), b, 0644)
+	}
+	if err != nil {
+		logging.Errorf("Unable to store comparison report: %v", err)
+		return
+	}
+	t.WriteLog(
+		tr,
+		"Stored comparison report of %s against %s",
+		report.CommitB,
+		report.CommitA,
+	)
+	t.publishWeeklyReport(report)
+}
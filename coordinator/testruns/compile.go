@@ -4,45 +4,78 @@ import (
 	"fmt"
 
 	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/coordinator"
+	"github.com/mit-dci/opencbdc-tctl/coordinator/sources"
 )
 
 func (t *TestRunManager) CompileBinaries(
 	tr *common.TestRun,
 	seeder bool,
+	arch string,
 ) error {
 	// Compile the binaries if needed. Needed means: the binaries for the test
-	// run's requested commit hash do not exist in our binaries archive.
+	// run's requested commit hash and architecture do not exist in our
+	// binaries archive.
 	seederTitle := "seeder "
 	if !seeder {
 		seederTitle = ""
 	}
+	if arch != sources.DefaultTargetArch {
+		seederTitle += arch + " "
+	}
 	t.UpdateStatus(
 		tr,
 		common.TestRunStatusRunning,
 		fmt.Sprintf("Compiling %sbinaries", seederTitle),
 	)
-	compileProgress := make(chan float64, 1)
+	compileProgress := make(chan sources.CompileProgress, 1)
 	done := make(chan bool, 1)
 	go func() {
+		status := ""
 		for p := range compileProgress {
+			t.ev <- coordinator.Event{
+				Type: coordinator.EventTypeCompileProgress,
+				Payload: coordinator.CompileProgressPayload{
+					TestRunID:  tr.ID,
+					Seeder:     seeder,
+					Phase:      string(p.Phase),
+					Percent:    p.Percent,
+					Line:       p.Line,
+					Bytes:      p.Bytes,
+					TotalBytes: p.TotalBytes,
+				},
+			}
 
-			t.UpdateStatus(
-				tr,
-				common.TestRunStatusRunning,
-				fmt.Sprintf("Compiling %sbinaries (%.1f%%)", seederTitle, p),
+			// Only update the status when it changes, not for every line of
+			// build output
+			newStatus := fmt.Sprintf(
+				"Compiling %sbinaries: %s (%.1f%%)",
+				seederTitle,
+				p.Phase,
+				p.Percent,
 			)
+			if newStatus != status {
+				status = newStatus
+				t.UpdateStatus(tr, common.TestRunStatusRunning, status)
+			}
 		}
 		done <- true
 	}()
 
+	// The seeder only generates the seeds, so it is always built with the
+	// default configuration
 	hash := tr.CommitHash
+	cfg := tr.BuildConfig
 	if seeder {
 		hash = tr.SeederHash
+		cfg = nil
 	}
 
 	err := t.src.Compile(
 		hash,
 		(tr.RunPerf || tr.Debug) && !seeder,
+		arch,
+		cfg,
 		compileProgress,
 	)
 	<-done
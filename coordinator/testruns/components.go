@@ -0,0 +1,241 @@
+package testruns
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/coordinator/sources"
+	"github.com/mit-dci/opencbdc-tctl/wire"
+)
+
+// componentS3Path returns the path in the binaries bucket of the archive of
+// the given component commit and architecture
+func componentS3Path(name, hash, arch string) string {
+	arch = sources.NormalizeTargetArch(arch)
+	if arch != sources.DefaultTargetArch {
+		hash += "-" + arch
+	}
+	return fmt.Sprintf("binaries/components/%s/%s.tar.gz", name, hash)
+}
+
+// componentBinariesDir returns the directory (relative to the environment on
+// the agent) the binaries of the component are extracted to
+func componentBinariesDir(name string) string {
+	return filepath.Join("components", name)
+}
+
+// validateComponents checks that the component repositories selected in the
+// test run are configured, and are selected only once
+func (t *TestRunManager) validateComponents(tr *common.TestRun) []error {
+	ret := []error{}
+	seen := map[string]bool{}
+	for _, c := range tr.Components {
+		if seen[c.Repo] {
+			ret = append(ret, fmt.Errorf(
+				"Component %s is selected more than once",
+				c.Repo,
+			))
+			continue
+		}
+		seen[c.Repo] = true
+		if _, err := t.src.Component(c.Repo); err != nil {
+			ret = append(ret, err)
+		}
+	}
+	return ret
+}
+
+// resolveComponents resolves the refs of the component repositories selected
+// in the test run to commits, which are recorded in the test run
+func (t *TestRunManager) resolveComponents(tr *common.TestRun) error {
+	for i, c := range tr.Components {
+		if c.CommitHash != "" {
+			continue
+		}
+		hash, err := t.src.ResolveComponentRef(c.Repo, c.Ref)
+		if err != nil {
+			return fmt.Errorf("Failed to resolve component %s: %v", c.Repo, err)
+		}
+		t.WriteLog(tr, "Resolved component %s to commit %s", c.Repo, hash)
+		tr.Components[i].CommitHash = hash
+	}
+	t.PersistTestRun(tr)
+	return nil
+}
+
+// PrepareComponents makes sure the binaries of each component selected in the
+// test run are available in S3 for each of the given architectures, building
+// and uploading them if needed
+func (t *TestRunManager) PrepareComponents(
+	tr *common.TestRun,
+	archs []string,
+) error {
+	if len(tr.Components) == 0 {
+		return nil
+	}
+	err := t.resolveComponents(tr)
+	if err != nil {
+		return err
+	}
+	region := os.Getenv("AWS_REGION")
+	bucket := os.Getenv("BINARIES_S3_BUCKET")
+	for i, c := range tr.Components {
+		tr.Components[i].Binaries = map[string]string{}
+		for _, arch := range archs {
+			binariesInS3 := componentS3Path(c.Repo, c.CommitHash, arch)
+			exists, err := t.awsm.FileExistsOnS3(region, bucket, binariesInS3)
+			if err != nil {
+				return fmt.Errorf("Checking component binary existence failed: %v", err)
+			}
+			if !exists {
+				t.UpdateStatus(
+					tr,
+					common.TestRunStatusRunning,
+					fmt.Sprintf("Compiling component %s (%s)", c.Repo, arch),
+				)
+				path, err := t.src.CompileComponent(c.Repo, c.CommitHash, arch)
+				if err != nil {
+					return fmt.Errorf(
+						"Compilation of component %s failed: %v",
+						c.Repo,
+						err,
+					)
+				}
+				for _, u := range []common.S3Upload{
+					{SourcePath: path, TargetPath: binariesInS3},
+					{
+						SourcePath: common.ChecksumsPath(path),
+						TargetPath: common.ChecksumsPath(binariesInS3),
+					},
+				} {
+					u.TargetRegion = region
+					u.TargetBucket = bucket
+					err = t.awsm.UploadToS3(u)
+					if err != nil {
+						return fmt.Errorf(
+							"Failed to upload binaries of component %s to S3: %v",
+							c.Repo,
+							err,
+						)
+					}
+				}
+			}
+			tr.Components[i].Binaries[arch] = binariesInS3
+		}
+	}
+	t.PersistTestRun(tr)
+	return nil
+}
+
+// componentChecksums returns the SHA-256 manifest of the component archive,
+// read locally if the archive was built here and from S3 otherwise
+func (t *TestRunManager) componentChecksums(
+	c common.SUTComponent,
+	arch string,
+) (*common.ArchiveChecksums, error) {
+	path, err := sources.ComponentArchivePath(c.Repo, c.CommitHash, arch)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(common.ChecksumsPath(path)); err != nil {
+		err = t.awsm.DownloadFromS3(common.S3Download{
+			SourceRegion: os.Getenv("AWS_REGION"),
+			SourceBucket: os.Getenv("BINARIES_S3_BUCKET"),
+			SourcePath:   common.ChecksumsPath(c.Binaries[arch]),
+			TargetPath:   common.ChecksumsPath(path),
+			Retries:      10,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return common.ReadArchiveChecksums(path)
+}
+
+// DeployComponents deploys the binaries of the components selected in the
+// test run into the environments created by DeployBinaries
+func (t *TestRunManager) DeployComponents(
+	tr *common.TestRun,
+	envs map[int32][]byte,
+) error {
+	if len(tr.Components) == 0 {
+		return nil
+	}
+	checksums := map[string]*common.ArchiveChecksums{}
+	for _, c := range tr.Components {
+		for arch := range c.Binaries {
+			sums, err := t.componentChecksums(c, arch)
+			if err != nil {
+				return fmt.Errorf(
+					"Unable to verify binaries of component %s: %v",
+					c.Repo,
+					err,
+				)
+			}
+			checksums[c.Repo+"/"+arch] = sums
+		}
+	}
+
+	f := func(role *common.TestRunRole) error {
+		arch := t.roleArchitecture(role)
+		for _, c := range tr.Components {
+			binariesInS3, ok := c.Binaries[arch]
+			if !ok {
+				return fmt.Errorf(
+					"Component %s was not built for architecture %s of agent %d",
+					c.Repo,
+					arch,
+					role.AgentID,
+				)
+			}
+			req := &wire.DeployFileFromS3RequestMsg{
+				EnvironmentID: envs[role.AgentID],
+				SourceRegion:  os.Getenv("AWS_DEFAULT_REGION"),
+				SourceBucket:  os.Getenv("BINARIES_S3_BUCKET"),
+				SourcePath:    binariesInS3,
+				TargetPath:    componentBinariesDir(c.Repo) + ".tar.gz",
+				Unpack:        true,
+			}
+			if sums := checksums[c.Repo+"/"+arch]; sums != nil {
+				req.SHA256 = sums.SHA256
+				req.Signature = sums.Signature
+			}
+			msg, err := t.am.QueryAgentWithTimeout(
+				role.AgentID,
+				req,
+				time.Minute*3,
+			)
+			if err != nil {
+				return err
+			}
+			if _, ok := msg.(*wire.DeployFileFromS3ResponseMsg); !ok {
+				return fmt.Errorf(
+					"expected DeployFileFromS3ResponseMsg, got %T",
+					msg,
+				)
+			}
+		}
+		return nil
+	}
+	return t.RunForAllAgents(
+		f,
+		tr,
+		"Deploying component binaries to agents",
+		time.Minute*10,
+	)
+}
+
+// isComponentBinary returns true if bin is a path into the binaries of one of
+// the components selected in the test run
+func isComponentBinary(tr *common.TestRun, bin string) bool {
+	for _, c := range tr.Components {
+		if strings.HasPrefix(bin, componentBinariesDir(c.Repo)+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -12,19 +12,41 @@ import (
 // TestManagerConfig is the main type in which parameters for the controller can
 // be persisted
 type TestManagerConfig struct {
-	MaxAgents int `json:"maxAgents"`
+	MaxAgents       int                   `json:"maxAgents"`
+	CapacityPlanner CapacityPlannerConfig `json:"capacityPlanner"`
+	LintRules       []LintRule            `json:"lintRules"`
+	Nightly         NightlyConfig         `json:"nightly"`
+	WeeklyReport    WeeklyReportConfig    `json:"weeklyReport"`
+	MergeQueue      MergeQueueConfig      `json:"mergeQueue"`
+	Preemption      PreemptionConfig      `json:"preemption"`
+	// The maximum number of running agents per AWS region
+	RegionPools RegionPoolsConfig `json:"regionPools"`
+	// The concurrent test runs and vCPUs per user and team
+	Quotas QuotaConfig `json:"quotas"`
+	// The hourly cost in US dollars per instance type, used to calculate the
+	// cost of sweeps with a budget
+	InstanceHourlyCosts map[string]float64 `json:"instanceHourlyCosts"`
+	// The startup plans replacing the built-in ones, by architecture ID
+	// (prefix)
+	StartupPlans map[string]StartupPlan `json:"startupPlans"`
+	// The requirements of the roles of each kind that don't declare their own
+	RoleRequirements RoleRequirementsConfig `json:"roleRequirements"`
 }
 
 // SetMaxAgents changes the maximum number of parallel running agents which is
 // used by the scheduler. The scheduler will not run testruns from the queue
 // that would exceed this number of agents active
 func (t *TestRunManager) SetMaxAgents(max int) error {
+	t.configLock.Lock()
 	t.config.MaxAgents = max
+	t.configLock.Unlock()
 	return t.PersistConfig()
 }
 
 // Config returns the entire config of the TestRunManager
 func (t *TestRunManager) Config() TestManagerConfig {
+	t.configLock.Lock()
+	defer t.configLock.Unlock()
 	return *t.config
 }
 
@@ -54,18 +76,21 @@ func (t *TestRunManager) LoadConfig() error {
 }
 
 // PersistConfig saves the configuration variables to persistence (file).It also
-// sends a real-time update for the frontend to know what the current value is
+// sends a real-time update for the frontend to know what the current value is.
+// Must be called without configLock held
 func (t *TestRunManager) PersistConfig() error {
 	f, err := os.OpenFile(
 		filepath.Join(common.DataDir(), "testruns", "manager.config.json"),
-		os.O_CREATE|os.O_WRONLY,
+		os.O_CREATE|os.O_WRONLY|os.O_TRUNC,
 		0644,
 	)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
+	t.configLock.Lock()
 	err = json.NewEncoder(f).Encode(t.config)
+	t.configLock.Unlock()
 	if err != nil {
 		return err
 	}
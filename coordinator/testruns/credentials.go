@@ -0,0 +1,217 @@
+package testruns
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/coordinator/awsmgr"
+	"github.com/mit-dci/opencbdc-tctl/wire"
+)
+
+// validateCloudAccess checks that run credentials can be issued for the
+// cloud access the test run requests, and that it is minimally scoped
+func (t *TestRunManager) validateCloudAccess(tr *common.TestRun) []error {
+	ret := []error{}
+	if len(tr.CloudAccess) == 0 {
+		return ret
+	}
+	if !awsmgr.RunCredentialsEnabled() {
+		ret = append(ret, errors.New(
+			"Cloud access requires RUN_CREDENTIALS_ROLE_ARN to be configured",
+		))
+	}
+	services := awsmgr.RunCredentialsServices()
+	for _, g := range tr.CloudAccess {
+		ret = append(ret, g.Validate(services)...)
+	}
+	return ret
+}
+
+// runCredentialsFile is the file in the environments of the test run that
+// holds its credentials, in the format of the AWS credential_process
+const runCredentialsFile = "run-credentials.json"
+
+// runCredentialsConfigFile is the AWS config file in the environments of the
+// test run that makes the AWS SDKs and CLI read the run credentials from
+// runCredentialsFile. The SDKs run the credential process again once the
+// credentials expire, which picks up the refreshed credentials
+const runCredentialsConfigFile = "run-aws-config"
+
+// runCredentialsRefreshMargin is the time before the run credentials expire
+// at which they are replaced with new ones
+const runCredentialsRefreshMargin = 10 * time.Minute
+
+// issueRunCredentials issues the temporary credentials the roles of the test
+// run use for the cloud access it was granted. The credentials are only kept
+// in memory until they are deployed into the environments of the run by
+// deployRunCredentials
+func (t *TestRunManager) issueRunCredentials(tr *common.TestRun) error {
+	if len(tr.CloudAccess) == 0 {
+		return nil
+	}
+	policy, err := common.CloudAccessPolicy(tr.CloudAccess)
+	if err != nil {
+		return err
+	}
+	creds, err := t.awsm.IssueRunCredentials(tr.ID, policy)
+	if err != nil {
+		return fmt.Errorf("Unable to issue run credentials: %v", err)
+	}
+	t.runCredentials.Store(tr.ID, creds)
+	t.WriteLog(
+		tr,
+		"Issued run credentials for %d cloud access grant(s), valid until %s",
+		len(tr.CloudAccess),
+		creds.Expiration.Format(time.RFC3339),
+	)
+	return nil
+}
+
+// deployRunCredentials writes the test run's credentials and the AWS config
+// file that refers to them into its environments, and keeps refreshing them
+// until they are revoked, such that runs outlasting the credentials keep
+// their cloud access
+func (t *TestRunManager) deployRunCredentials(
+	tr *common.TestRun,
+	envs map[int32][]byte,
+) error {
+	v, ok := t.runCredentials.Load(tr.ID)
+	if !ok {
+		return nil
+	}
+	err := t.writeRunCredentials(envs, v.(*awsmgr.RunCredentials))
+	if err != nil {
+		return fmt.Errorf("Unable to deploy run credentials: %v", err)
+	}
+	go t.refreshRunCredentials(tr, envs)
+	return nil
+}
+
+// writeRunCredentials writes the credentials and the AWS config file into
+// the environments
+func (t *TestRunManager) writeRunCredentials(
+	envs map[int32][]byte,
+	creds *awsmgr.RunCredentials,
+) error {
+	b, err := json.Marshal(map[string]interface{}{
+		"Version":         1,
+		"AccessKeyId":     creds.AccessKeyID,
+		"SecretAccessKey": creds.SecretAccessKey,
+		"SessionToken":    creds.SessionToken,
+		"Expiration":      creds.Expiration.UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return err
+	}
+	files := []common.File{
+		{FilePath: runCredentialsFile, Contents: b},
+		{
+			FilePath: runCredentialsConfigFile,
+			Contents: []byte(fmt.Sprintf(
+				"[default]\ncredential_process = cat %s\n",
+				runCredentialsFile,
+			)),
+		},
+	}
+	for agentID, envID := range envs {
+		for _, f := range files {
+			msg, err := t.am.QueryAgent(agentID, &wire.DeployFileRequestMsg{
+				EnvironmentID: envID,
+				File:          f,
+			})
+			if err != nil {
+				return err
+			}
+			if _, ok := msg.(*wire.DeployFileResponseMsg); !ok {
+				return fmt.Errorf("expected DeployFileResponseMsg, got %T", msg)
+			}
+		}
+	}
+	return nil
+}
+
+// refreshRunCredentials issues new credentials for the test run shortly
+// before the current ones expire and deploys them, until the credentials are
+// revoked
+func (t *TestRunManager) refreshRunCredentials(
+	tr *common.TestRun,
+	envs map[int32][]byte,
+) {
+	for {
+		time.Sleep(time.Minute)
+		v, ok := t.runCredentials.Load(tr.ID)
+		if !ok {
+			return
+		}
+		creds := v.(*awsmgr.RunCredentials)
+		if time.Until(creds.Expiration) > runCredentialsRefreshMargin {
+			continue
+		}
+		policy, err := common.CloudAccessPolicy(tr.CloudAccess)
+		if err == nil {
+			creds, err = t.awsm.IssueRunCredentials(tr.ID, policy)
+		}
+		if err == nil {
+			// Revoking the credentials in between would otherwise leave
+			// credentials behind for a run that ended
+			t.runCredentialsLock.Lock()
+			_, ok = t.runCredentials.Load(tr.ID)
+			if ok {
+				t.runCredentials.Store(tr.ID, creds)
+			}
+			t.runCredentialsLock.Unlock()
+			if !ok {
+				return
+			}
+			err = t.writeRunCredentials(envs, creds)
+		}
+		if err != nil {
+			t.WriteLog(tr, "Unable to refresh run credentials: %v", err)
+			continue
+		}
+		t.WriteLog(
+			tr,
+			"Refreshed run credentials, valid until %s",
+			creds.Expiration.Format(time.RFC3339),
+		)
+	}
+}
+
+// runCredentialsEnv returns the environment variables that make the roles
+// use the test run's credentials, if it was issued any. The paths are
+// relative to the environment the roles run in
+func (t *TestRunManager) runCredentialsEnv(tr *common.TestRun) []string {
+	if _, ok := t.runCredentials.Load(tr.ID); !ok {
+		return []string{}
+	}
+	return []string{
+		fmt.Sprintf("AWS_CONFIG_FILE=%s", runCredentialsConfigFile),
+		"AWS_SDK_LOAD_CONFIG=1",
+	}
+}
+
+// revokeRunCredentials discards the test run's credentials once it has
+// ended, and revokes the sessions issued for it, such that neither roles that
+// are still running nor ones started afterwards (like the ones of a retried
+// run) can use them
+func (t *TestRunManager) revokeRunCredentials(tr *common.TestRun) {
+	t.runCredentialsLock.Lock()
+	v, ok := t.runCredentials.Load(tr.ID)
+	t.runCredentials.Delete(tr.ID)
+	t.runCredentialsLock.Unlock()
+	if !ok {
+		return
+	}
+	err := t.awsm.RevokeRunCredentials(
+		tr.ID,
+		v.(*awsmgr.RunCredentials).Expiration,
+	)
+	if err != nil {
+		t.WriteLog(tr, "Unable to revoke run credentials: %v", err)
+		return
+	}
+	t.WriteLog(tr, "Revoked run credentials")
+}
@@ -0,0 +1,171 @@
+package testruns
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronField is the set of values a field of a cron expression matches, as a
+// bit per value
+type cronField uint64
+
+// cronFieldBounds are the lowest and highest values of the minute, hour, day
+// of month, month and day of week fields
+var cronFieldBounds = [5][2]int{
+	{0, 59},
+	{0, 23},
+	{1, 31},
+	{1, 12},
+	{0, 6},
+}
+
+// cronMacros are the shorthands for common schedules
+var cronMacros = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+	"@yearly":  "0 0 1 1 *",
+}
+
+// CronSchedule is a parsed cron expression with the standard five fields
+// (minute, hour, day of month, month and day of week). Times are matched in
+// UTC
+type CronSchedule struct {
+	minute, hour, dom, month, dow cronField
+	// Like in cron, if both the day of month and day of week are restricted,
+	// a day matching either of them matches
+	domRestricted, dowRestricted bool
+}
+
+// ParseCron parses a cron expression. Fields are a `*`, a value, a range
+// (`1-5`) or a comma separated list of these, optionally followed by a step
+// (`*/15`). Day of week 7 is Sunday like 0. The macros @hourly, @daily,
+// @weekly, @monthly and @yearly are supported as well
+func ParseCron(expr string) (*CronSchedule, error) {
+	expr = strings.TrimSpace(expr)
+	if m, ok := cronMacros[expr]; ok {
+		expr = m
+	}
+	parts := strings.Fields(expr)
+	if len(parts) != 5 {
+		return nil, fmt.Errorf(
+			"Cron expression %q has %d fields, expected 5",
+			expr,
+			len(parts),
+		)
+	}
+	fields := [5]cronField{}
+	for i, p := range parts {
+		b := cronFieldBounds[i]
+		hi := b[1]
+		if i == 4 {
+			// Allow 7 for Sunday
+			hi = 7
+		}
+		f, err := parseCronField(p, b[0], hi)
+		if err != nil {
+			return nil, fmt.Errorf("Cron field %d (%q): %v", i+1, p, err)
+		}
+		fields[i] = f
+	}
+	if fields[4]&(1<<7) != 0 {
+		fields[4] |= 1
+	}
+	return &CronSchedule{
+		minute:        fields[0],
+		hour:          fields[1],
+		dom:           fields[2],
+		month:         fields[3],
+		dow:           fields[4],
+		domRestricted: parts[2] != "*",
+		dowRestricted: parts[4] != "*",
+	}, nil
+}
+
+// parseCronField parses a single field of a cron expression with values from
+// lo to hi
+func parseCronField(s string, lo, hi int) (cronField, error) {
+	var f cronField
+	for _, item := range strings.Split(s, ",") {
+		step := 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(item[i+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q", item[i+1:])
+			}
+			item = item[:i]
+		}
+		from, to := lo, hi
+		if item != "*" {
+			r := strings.SplitN(item, "-", 2)
+			var err error
+			from, err = strconv.Atoi(r[0])
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %q", r[0])
+			}
+			to = from
+			if len(r) == 2 {
+				to, err = strconv.Atoi(r[1])
+				if err != nil {
+					return 0, fmt.Errorf("invalid value %q", r[1])
+				}
+			} else if step > 1 {
+				// `5/15` means from 5 to the end in steps of 15
+				to = hi
+			}
+		}
+		if from < lo || to > hi || from > to {
+			return 0, fmt.Errorf("%d-%d is out of range %d-%d", from, to, lo, hi)
+		}
+		for v := from; v <= to; v += step {
+			f |= 1 << uint(v)
+		}
+	}
+	return f, nil
+}
+
+func (f cronField) has(v int) bool {
+	return f&(1<<uint(v)) != 0
+}
+
+// matchesDay returns true if the day of t matches the day of month and day
+// of week fields
+func (c *CronSchedule) matchesDay(t time.Time) bool {
+	dom := c.dom.has(t.Day())
+	dow := c.dow.has(int(t.Weekday()))
+	if c.domRestricted && c.dowRestricted {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// Next returns the first time after t the schedule matches, or the zero time
+// if it doesn't match within five years (such as for February 30th)
+func (c *CronSchedule) Next(t time.Time) time.Time {
+	t = t.UTC().Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if !c.month.has(int(t.Month())) {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !c.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !c.hour.has(t.Hour()) {
+			t = t.Truncate(time.Hour).Add(time.Hour)
+			continue
+		}
+		if !c.minute.has(t.Minute()) {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
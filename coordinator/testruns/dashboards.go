@@ -0,0 +1,301 @@
+package testruns
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+)
+
+// ErrDashboardNotFound is returned when no dashboard with the requested ID
+// was saved
+var ErrDashboardNotFound = errors.New("Dashboard not found")
+
+// dashboardGridColumns is the number of columns of the grid dashboard panels
+// are laid out on
+const dashboardGridColumns = 12
+
+// DashboardChartType is the kind of chart a dashboard panel shows
+type DashboardChartType string
+
+const DashboardChartLine DashboardChartType = "line"
+const DashboardChartBar DashboardChartType = "bar"
+const DashboardChartScatter DashboardChartType = "scatter"
+const DashboardChartTable DashboardChartType = "table"
+
+// DashboardLayout is the position and size of a panel on the dashboard grid
+type DashboardLayout struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// DashboardPanel is a single chart on a dashboard
+type DashboardPanel struct {
+	Title string             `json:"title"`
+	Chart DashboardChartType `json:"chart"`
+	// The test result metrics shown, by their JSON name
+	Metrics []string `json:"metrics"`
+	// The test run parameter (by its JSON name) on the x axis. If empty, the
+	// test runs are shown in the order they completed
+	XAxis string `json:"xAxis,omitempty"`
+	// Test runs and sweeps shown in this panel only, in addition to the ones
+	// selected for the whole dashboard
+	TestRunIDs []string        `json:"testRunIDs,omitempty"`
+	SweepIDs   []string        `json:"sweepIDs,omitempty"`
+	Layout     DashboardLayout `json:"layout"`
+}
+
+// Dashboard is a saved selection of test runs and charts, such that recurring
+// analyses don't have to be assembled again every time
+type Dashboard struct {
+	ID          string `json:"id"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	// The test runs and sweeps shown in every panel
+	TestRunIDs          []string         `json:"testRunIDs"`
+	SweepIDs            []string         `json:"sweepIDs"`
+	Panels              []DashboardPanel `json:"panels"`
+	Created             time.Time        `json:"created"`
+	CreatedByThumbprint string           `json:"createdByThumbprint"`
+	Updated             time.Time        `json:"updated"`
+	UpdatedByThumbprint string           `json:"updatedByThumbprint"`
+}
+
+// jsonFieldKinds returns the kinds of the fields of the struct type t, keyed
+// by their JSON name
+func jsonFieldKinds(t reflect.Type) map[string]reflect.Kind {
+	ret := map[string]reflect.Kind{}
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			ret[name] = t.Field(i).Type.Kind()
+		}
+	}
+	return ret
+}
+
+var dashboardMetrics = jsonFieldKinds(reflect.TypeOf(common.TestResult{}))
+var dashboardParameters = jsonFieldKinds(reflect.TypeOf(common.TestRun{}))
+
+// validateDashboard checks that the test runs and sweeps selected on the
+// dashboard exist, that the panels show numeric metrics and that they fit on
+// the grid
+func (t *TestRunManager) validateDashboard(d *Dashboard) []error {
+	ret := []error{}
+	if strings.TrimSpace(d.Title) == "" {
+		ret = append(ret, errors.New("Dashboard has no title"))
+	}
+	checkSelection := func(where string, runIDs, sweepIDs []string) {
+		for _, id := range runIDs {
+			if _, ok := t.GetTestRun(id); !ok {
+				ret = append(ret, fmt.Errorf("%s: unknown test run %s", where, id))
+			}
+		}
+		for _, id := range sweepIDs {
+			if !t.sweepExists(id) {
+				ret = append(ret, fmt.Errorf("%s: unknown sweep %s", where, id))
+			}
+		}
+	}
+	checkSelection("Dashboard", d.TestRunIDs, d.SweepIDs)
+
+	for i, p := range d.Panels {
+		where := fmt.Sprintf("Panel %d", i+1)
+		checkSelection(where, p.TestRunIDs, p.SweepIDs)
+		switch p.Chart {
+		case DashboardChartLine,
+			DashboardChartBar,
+			DashboardChartScatter,
+			DashboardChartTable:
+		default:
+			ret = append(ret, fmt.Errorf(
+				"%s: unsupported chart type %q",
+				where,
+				p.Chart,
+			))
+		}
+		if len(p.Metrics) == 0 {
+			ret = append(ret, fmt.Errorf("%s: no metrics selected", where))
+		}
+		for _, m := range p.Metrics {
+			if dashboardMetrics[m] != reflect.Float64 {
+				ret = append(ret, fmt.Errorf(
+					"%s: %s is not a numeric test result metric",
+					where,
+					m,
+				))
+			}
+		}
+		if _, ok := dashboardParameters[p.XAxis]; p.XAxis != "" && !ok {
+			ret = append(ret, fmt.Errorf(
+				"%s: unknown test run parameter %s",
+				where,
+				p.XAxis,
+			))
+		}
+		l := p.Layout
+		if l.X < 0 || l.Y < 0 || l.Width <= 0 || l.Height <= 0 ||
+			l.X+l.Width > dashboardGridColumns {
+			ret = append(ret, fmt.Errorf(
+				"%s: does not fit on the %d column grid",
+				where,
+				dashboardGridColumns,
+			))
+		}
+	}
+	return ret
+}
+
+// sweepExists returns true if any test run is part of the given sweep
+func (t *TestRunManager) sweepExists(sweepID string) bool {
+	for _, tr := range t.GetTestRuns() {
+		if tr.SweepID == sweepID {
+			return true
+		}
+	}
+	return false
+}
+
+// dashboardsPath returns the path of the file the dashboards are persisted in
+func dashboardsPath() string {
+	return filepath.Join(common.DataDir(), "testruns", "dashboards.json")
+}
+
+// loadDashboards reads the saved dashboards from disk
+func (t *TestRunManager) loadDashboards() error {
+	b, err := os.ReadFile(dashboardsPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	t.dashboardsLock.Lock()
+	defer t.dashboardsLock.Unlock()
+	return json.Unmarshal(b, &t.dashboards)
+}
+
+// persistDashboards writes the saved dashboards to disk. Must be called with
+// dashboardsLock held
+func (t *TestRunManager) persistDashboards() error {
+	b, err := json.Marshal(t.dashboards)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(dashboardsPath()), 0755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dashboardsPath(), b, 0644)
+}
+
+// dashboardValidationError combines the errors found validating a dashboard
+func dashboardValidationError(errs []error) error {
+	msgs := make([]string, len(errs))
+	for i, e := range errs {
+		msgs[i] = e.Error()
+	}
+	return errors.New(strings.Join(msgs, "; "))
+}
+
+// CreateDashboard validates and saves a new dashboard
+func (t *TestRunManager) CreateDashboard(
+	d *Dashboard,
+	createdByThumbprint string,
+) (*Dashboard, error) {
+	if errs := t.validateDashboard(d); len(errs) > 0 {
+		return nil, dashboardValidationError(errs)
+	}
+	var err error
+	d.ID, err = common.RandomID(12)
+	if err != nil {
+		return nil, err
+	}
+	d.Created = time.Now()
+	d.CreatedByThumbprint = createdByThumbprint
+	d.Updated = d.Created
+	d.UpdatedByThumbprint = createdByThumbprint
+
+	t.dashboardsLock.Lock()
+	defer t.dashboardsLock.Unlock()
+	t.dashboards = append(t.dashboards, d)
+	err = t.persistDashboards()
+	if err != nil {
+		t.dashboards = t.dashboards[:len(t.dashboards)-1]
+		return nil, err
+	}
+	return d, nil
+}
+
+// UpdateDashboard validates and replaces the definition of the saved
+// dashboard with the given ID
+func (t *TestRunManager) UpdateDashboard(
+	id string,
+	d *Dashboard,
+	updatedByThumbprint string,
+) (*Dashboard, error) {
+	if errs := t.validateDashboard(d); len(errs) > 0 {
+		return nil, dashboardValidationError(errs)
+	}
+
+	t.dashboardsLock.Lock()
+	defer t.dashboardsLock.Unlock()
+	for i, e := range t.dashboards {
+		if e.ID != id {
+			continue
+		}
+		d.ID = id
+		d.Created = e.Created
+		d.CreatedByThumbprint = e.CreatedByThumbprint
+		d.Updated = time.Now()
+		d.UpdatedByThumbprint = updatedByThumbprint
+		t.dashboards[i] = d
+		err := t.persistDashboards()
+		if err != nil {
+			t.dashboards[i] = e
+			return nil, err
+		}
+		return d, nil
+	}
+	return nil, ErrDashboardNotFound
+}
+
+// Dashboards returns the saved dashboards
+func (t *TestRunManager) Dashboards() []*Dashboard {
+	t.dashboardsLock.Lock()
+	defer t.dashboardsLock.Unlock()
+	return append([]*Dashboard{}, t.dashboards...)
+}
+
+// GetDashboard returns the saved dashboard with the given ID
+func (t *TestRunManager) GetDashboard(id string) (*Dashboard, error) {
+	t.dashboardsLock.Lock()
+	defer t.dashboardsLock.Unlock()
+	for _, d := range t.dashboards {
+		if d.ID == id {
+			return d, nil
+		}
+	}
+	return nil, ErrDashboardNotFound
+}
+
+// DeleteDashboard removes a saved dashboard
+func (t *TestRunManager) DeleteDashboard(id string) error {
+	t.dashboardsLock.Lock()
+	defer t.dashboardsLock.Unlock()
+	for i, d := range t.dashboards {
+		if d.ID == id {
+			t.dashboards = append(t.dashboards[:i], t.dashboards[i+1:]...)
+			return t.persistDashboards()
+		}
+	}
+	return ErrDashboardNotFound
+}
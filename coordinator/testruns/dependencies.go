@@ -0,0 +1,98 @@
+package testruns
+
+import (
+	"fmt"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+)
+
+// ValidateDependencies checks that the test runs the test run depends on
+// exist, and that the statuses they must end with are ones test runs end with
+func (t *TestRunManager) ValidateDependencies(tr *common.TestRun) []error {
+	ret := []error{}
+	for _, d := range tr.DependsOn {
+		if _, ok := t.GetTestRun(d.TestRunID); !ok {
+			ret = append(ret, fmt.Errorf(
+				"Dependency %s does not exist",
+				d.TestRunID,
+			))
+		}
+		if d.Status != "" && !isTerminalStatus(d.Status) {
+			ret = append(ret, fmt.Errorf(
+				"Dependency %s: test runs don't end with status %s",
+				d.TestRunID,
+				d.Status,
+			))
+		}
+	}
+	return ret
+}
+
+// dependencyState returns whether all test runs the test run depends on have
+// ended with the required status. If one of them ended with another status,
+// the reason the test run should be skipped is returned. Failed test runs
+// that will be retried are waited for, Reschedule makes the test run depend
+// on the retry instead
+func (t *TestRunManager) dependencyState(
+	tr *common.TestRun,
+) (bool, string) {
+	ready := true
+	for _, d := range tr.DependsOn {
+		dep, ok := t.GetTestRun(d.TestRunID)
+		if !ok {
+			return false, fmt.Sprintf(
+				"Skipped: dependency %s does not exist",
+				d.TestRunID,
+			)
+		}
+		required := d.Status
+		if required == "" {
+			required = common.TestRunStatusCompleted
+		}
+		if !isTerminalStatus(dep.Status) || dep.Status == required {
+			ready = ready && dep.Status == required
+			continue
+		}
+		if willRetry(dep) {
+			ready = false
+			continue
+		}
+		return false, fmt.Sprintf(
+			"Skipped: dependency %s ended as %s rather than %s",
+			dep.ID,
+			dep.Status,
+			required,
+		)
+	}
+	return ready, ""
+}
+
+// willRetry returns true if the unsuccessful test run is rescheduled
+func willRetry(tr *common.TestRun) bool {
+	return (tr.Status == common.TestRunStatusFailed ||
+		tr.Status == common.TestRunStatusInterrupted) &&
+		tr.RetryOnFailure && tr.MaxRetries > 1
+}
+
+// redirectDependencies makes the queued test runs depending on a test run
+// that was rescheduled depend on its retry instead. Must be called with the
+// testRunsLock held
+func (t *TestRunManager) redirectDependencies(oldID, newID string) {
+	for _, tr := range t.testRuns {
+		if tr.Status != common.TestRunStatusQueued {
+			continue
+		}
+		for i := range tr.DependsOn {
+			if tr.DependsOn[i].TestRunID == oldID {
+				tr.DependsOn[i].TestRunID = newID
+				t.WriteLog(
+					tr,
+					"Dependency %s was rescheduled as %s",
+					oldID,
+					newID,
+				)
+				t.PersistTestRun(tr)
+			}
+		}
+	}
+}
@@ -2,13 +2,20 @@ package testruns
 
 import (
 	"fmt"
+	"os"
 	"sync"
 	"time"
 
 	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/coordinator"
+	"github.com/mit-dci/opencbdc-tctl/coordinator/sources"
 	"github.com/mit-dci/opencbdc-tctl/wire"
 )
 
+// distributionStallTimeout is the time after which a download of the binaries
+// that makes no progress is reported in the test run log as stalled
+const distributionStallTimeout = time.Minute
+
 // DeployConfig is a convenience method to send a DeployFileRequestMsg to all
 // agents that are part of a testrun with the contents of the system-wide
 // configuration file. It will be deployed at a location relative to the
@@ -50,10 +57,11 @@ func (t *TestRunManager) DeployConfig(
 // DeployBinaries deploys the prebuilt binaries to all involved agents, and
 // returns a map of agentID => environmentID for all environments created on the
 // test agents. It calls PrepareAgentWithBinariesForCommit for each role in the
-// testrun
+// testrun, with the binaries (from binariesInS3Paths, keyed by architecture)
+// matching the architecture of the role's agent
 func (t *TestRunManager) DeployBinaries(
 	tr *common.TestRun,
-	binariesInS3Path string,
+	binariesInS3Paths map[string]string,
 ) (map[int32][]byte, error) {
 	t.UpdateStatus(
 		tr,
@@ -61,14 +69,77 @@ func (t *TestRunManager) DeployBinaries(
 		"Deploying binaries to agents (0%)",
 	)
 
+	checksums := map[string]*common.ArchiveChecksums{}
+	for arch, binariesInS3Path := range binariesInS3Paths {
+		c, err := t.binariesChecksums(tr, arch, binariesInS3Path)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to verify binaries: %v", err)
+		}
+		checksums[arch] = c
+	}
+
+	presignedURLs := map[string]string{}
+	if tr.PresignedDownloads {
+		for arch, binariesInS3Path := range binariesInS3Paths {
+			url, err := t.presignedBinariesURL(binariesInS3Path)
+			if err != nil {
+				return nil, fmt.Errorf(
+					"Unable to sign the URL to download binaries with: %v",
+					err,
+				)
+			}
+			presignedURLs[arch] = url
+		}
+	}
+
+	localArchives := map[string]string{}
+	if tr.DirectTransfer {
+		for arch, binariesInS3Path := range binariesInS3Paths {
+			p, err := t.localBinariesArchive(tr, arch, binariesInS3Path)
+			if err != nil {
+				return nil, fmt.Errorf(
+					"Unable to fetch binaries to transfer to agents: %v",
+					err,
+				)
+			}
+			localArchives[arch] = p
+		}
+	}
+
 	ret := map[int32][]byte{}
 	retLck := sync.Mutex{}
 
 	f := func(role *common.TestRunRole) error {
-		envID, err := t.am.PrepareAgentWithBinariesForCommit(
-			role.AgentID,
-			binariesInS3Path,
-		)
+		arch := t.roleArchitecture(role)
+		binariesInS3Path, ok := binariesInS3Paths[arch]
+		if !ok {
+			return fmt.Errorf(
+				"No binaries were built for architecture %s of agent %d",
+				arch,
+				role.AgentID,
+			)
+		}
+		var envID []byte
+		var err error
+		if tr.RunFromBinariesImage {
+			// The roles run the binaries from the image
+			envID, err = t.am.PrepareAgentEnvironment(role.AgentID)
+		} else if tr.DirectTransfer {
+			envID, err = t.am.PrepareAgentWithBinariesOverWire(
+				role.AgentID,
+				localArchives[arch],
+				checksums[arch],
+				t.distributionProgress(tr, role),
+			)
+		} else {
+			envID, err = t.am.PrepareAgentWithBinariesForCommit(
+				role.AgentID,
+				binariesInS3Path,
+				presignedURLs[arch],
+				checksums[arch],
+				t.distributionProgress(tr, role),
+			)
+		}
 		if err != nil {
 			return err
 		}
@@ -85,3 +156,103 @@ func (t *TestRunManager) DeployBinaries(
 	)
 	return ret, err
 }
+
+// localBinariesArchive returns the path of the binaries archive for the
+// architecture on the coordinator, to transfer to the agents directly. If the
+// coordinator doesn't have it, for instance because it was built before the
+// coordinator was replaced, it's downloaded from S3 first
+func (t *TestRunManager) localBinariesArchive(
+	tr *common.TestRun,
+	arch string,
+	binariesInS3Path string,
+) (string, error) {
+	path, err := sources.BinariesArchivePath(
+		tr.CommitHash,
+		tr.RunPerf || tr.Debug,
+		arch,
+		tr.BuildConfig,
+	)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+	t.WriteLog(
+		tr,
+		"Downloading %s from S3 to transfer it to the agents",
+		binariesInS3Path,
+	)
+	err = t.awsm.DownloadFromS3(common.S3Download{
+		SourceRegion: os.Getenv("AWS_REGION"),
+		SourceBucket: os.Getenv("BINARIES_S3_BUCKET"),
+		SourcePath:   binariesInS3Path,
+		TargetPath:   path,
+	})
+	if err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	return path, nil
+}
+
+// distributionProgress returns a callback for the progress of distributing the
+// binaries to the agent of the given role, which sends it to the frontend as
+// compile progress in the distribute phase. A download that makes no progress
+// for distributionStallTimeout is reported in the test run log, such that it
+// can be told apart from one that is merely slow
+func (t *TestRunManager) distributionProgress(
+	tr *common.TestRun,
+	role *common.TestRunRole,
+) func(*wire.TransferProgressMsg) {
+	lastBytes := int64(-1)
+	lastChange := time.Now()
+	stalled := false
+	return func(p *wire.TransferProgressMsg) {
+		if p.Bytes != lastBytes {
+			lastBytes = p.Bytes
+			lastChange = time.Now()
+			stalled = false
+		} else if p.Phase == wire.TransferPhaseDownload && !stalled &&
+			time.Since(lastChange) > distributionStallTimeout {
+			stalled = true
+			t.WriteLog(
+				tr,
+				"Download of binaries to agent %d made no progress for %v (%d of %d bytes)",
+				role.AgentID,
+				time.Since(lastChange).Round(time.Second),
+				p.Bytes,
+				p.TotalBytes,
+			)
+		}
+
+		percent := float64(100)
+		line := string(p.Phase)
+		if p.Phase == wire.TransferPhaseDownload {
+			percent = 0
+			if p.TotalBytes > 0 {
+				percent = float64(p.Bytes) / float64(p.TotalBytes) * 100
+			}
+			line = fmt.Sprintf(
+				"download %.1f / %.1f MB",
+				float64(p.Bytes)/1e6,
+				float64(p.TotalBytes)/1e6,
+			)
+			if stalled {
+				line += " (stalled)"
+			}
+		}
+		t.ev <- coordinator.Event{
+			Type: coordinator.EventTypeCompileProgress,
+			Payload: coordinator.CompileProgressPayload{
+				TestRunID:  tr.ID,
+				Phase:      string(sources.CompilePhaseDistribute),
+				Percent:    percent,
+				Line:       line,
+				Bytes:      p.Bytes,
+				TotalBytes: p.TotalBytes,
+				AgentID:    role.AgentID,
+			},
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package testruns
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+)
+
+// distributionRecheck is the time after which the coordinator checks again
+// that a binaries archive it uploaded is still in S3, since lifecycle rules of
+// the bucket may have removed it
+const distributionRecheck = 24 * time.Hour
+
+// presignedURLExpiry is how long the pre-signed URLs agents download the
+// binaries with are valid
+const presignedURLExpiry = 2 * time.Hour
+
+// presignedURLMinValidity is how long a pre-signed URL must still be valid to
+// hand it to another agent, in stead of signing a new one
+const presignedURLMinValidity = time.Hour
+
+// DistributedBinaries records a binaries archive the coordinator uploaded to
+// S3 to distribute it to the agents, such that it doesn't upload the same
+// archive again, nor check whether it's in S3 for every test run
+type DistributedBinaries struct {
+	// The path in the binaries bucket
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+	// When the archive was last uploaded, and when it was last confirmed to
+	// be in S3
+	Uploaded time.Time `json:"uploaded"`
+	Verified time.Time `json:"verified"`
+	// The number of times the archive was uploaded, and the number of times
+	// an upload was skipped because the archive was already in S3
+	Uploads        int `json:"uploads"`
+	SkippedUploads int `json:"skippedUploads"`
+	// The number of pre-signed URLs that were handed to agents to download
+	// the archive with
+	PresignedDownloads int `json:"presignedDownloads"`
+	// The last pre-signed URL to download the archive with, and when it
+	// expires
+	presignedURL     string
+	presignedExpires time.Time
+}
+
+// distributedBinariesPath returns the path of the file the distributed
+// binaries are persisted in
+func distributedBinariesPath() string {
+	return filepath.Join(
+		common.DataDir(),
+		"testruns",
+		"distributedbinaries.json",
+	)
+}
+
+// loadDistributedBinaries reads the distributed binaries from disk
+func (t *TestRunManager) loadDistributedBinaries() error {
+	b, err := os.ReadFile(distributedBinariesPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	t.distributedBinariesLock.Lock()
+	defer t.distributedBinariesLock.Unlock()
+	return json.Unmarshal(b, &t.distributedBinaries)
+}
+
+// persistDistributedBinaries writes the distributed binaries to disk. Must be
+// called with distributedBinariesLock held
+func (t *TestRunManager) persistDistributedBinaries() error {
+	b, err := json.Marshal(t.distributedBinaries)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(distributedBinariesPath()), 0755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(distributedBinariesPath(), b, 0644)
+}
+
+// DistributedBinaries returns the binaries archives the coordinator uploaded
+// to S3, the most recently uploaded first
+func (t *TestRunManager) DistributedBinaries() []DistributedBinaries {
+	t.distributedBinariesLock.Lock()
+	ret := make([]DistributedBinaries, 0, len(t.distributedBinaries))
+	for _, d := range t.distributedBinaries {
+		ret = append(ret, *d)
+	}
+	t.distributedBinariesLock.Unlock()
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Uploaded.After(ret[j].Uploaded)
+	})
+	return ret
+}
+
+// binariesDistributed returns whether the archive with the given checksum was
+// uploaded to the path in the binaries bucket, and confirmed to be there
+// recently. If so, the skipped upload is counted
+func (t *TestRunManager) binariesDistributed(path, digest string) bool {
+	t.distributedBinariesLock.Lock()
+	defer t.distributedBinariesLock.Unlock()
+	d, ok := t.distributedBinaries[path]
+	if !ok || d.SHA256 != digest ||
+		time.Since(d.Verified) > distributionRecheck {
+		return false
+	}
+	d.SkippedUploads++
+	err := t.persistDistributedBinaries()
+	if err != nil {
+		return false
+	}
+	return true
+}
+
+// binariesStale returns whether a different archive than the one with the
+// given checksum was uploaded to the path in the binaries bucket, for
+// instance because the binaries were rebuilt
+func (t *TestRunManager) binariesStale(path, digest string) bool {
+	t.distributedBinariesLock.Lock()
+	defer t.distributedBinariesLock.Unlock()
+	d, ok := t.distributedBinaries[path]
+	return ok && d.SHA256 != "" && d.SHA256 != digest
+}
+
+// recordDistributedBinaries records the archive with the given checksums is
+// in the binaries bucket at path. If uploaded is false, it was already there
+func (t *TestRunManager) recordDistributedBinaries(
+	path string,
+	checksums *common.ArchiveChecksums,
+	uploaded bool,
+) error {
+	t.distributedBinariesLock.Lock()
+	defer t.distributedBinariesLock.Unlock()
+	d, ok := t.distributedBinaries[path]
+	if !ok || d.SHA256 != checksums.SHA256 {
+		d = &DistributedBinaries{Path: path}
+		t.distributedBinaries[path] = d
+	}
+	d.SHA256 = checksums.SHA256
+	d.Size = checksums.Size
+	d.Verified = time.Now()
+	if uploaded {
+		d.Uploaded = d.Verified
+		d.Uploads++
+	} else {
+		d.SkippedUploads++
+	}
+	return t.persistDistributedBinaries()
+}
+
+// presignedBinariesURL returns a pre-signed URL for the agents to download
+// the binaries archive at path in the binaries bucket with. The URL is reused
+// for the agents of all test runs until it is about to expire
+func (t *TestRunManager) presignedBinariesURL(path string) (string, error) {
+	t.distributedBinariesLock.Lock()
+	defer t.distributedBinariesLock.Unlock()
+	d, ok := t.distributedBinaries[path]
+	if !ok {
+		// Uploaded by another coordinator, or before uploads were recorded
+		d = &DistributedBinaries{Path: path}
+		t.distributedBinaries[path] = d
+	}
+	if time.Until(d.presignedExpires) < presignedURLMinValidity {
+		url, err := t.awsm.PresignDownloadURL(
+			os.Getenv("AWS_REGION"),
+			os.Getenv("BINARIES_S3_BUCKET"),
+			path,
+			presignedURLExpiry,
+		)
+		if err != nil {
+			return "", err
+		}
+		d.presignedURL = url
+		d.presignedExpires = time.Now().Add(presignedURLExpiry)
+	}
+	d.PresignedDownloads++
+	return d.presignedURL, t.persistDistributedBinaries()
+}
+
+// validateDistribution checks the test run picks at most one way to
+// distribute the binaries to the agents
+func validateDistribution(tr *common.TestRun) []error {
+	if tr.DirectTransfer && tr.PresignedDownloads {
+		return []error{errors.New(
+			"Binaries can't be both transferred directly and downloaded " +
+				"with pre-signed URLs",
+		)}
+	}
+	return []error{}
+}
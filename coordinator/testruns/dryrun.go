@@ -0,0 +1,328 @@
+package testruns
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+)
+
+// DryRunCheck identifies the check of a dry run that reported an issue
+type DryRunCheck string
+
+// DryRunCheckBinaries checks that the binaries for the commit of the test run
+// exist or can be compiled
+const DryRunCheckBinaries DryRunCheck = "binaries"
+
+// DryRunCheckCapacity checks that the agents and instances the test run needs
+// are available within the configured limits
+const DryRunCheckCapacity DryRunCheck = "capacity"
+
+// DryRunCheckPlacement checks that roles sharing an agent don't listen on the
+// same ports
+const DryRunCheckPlacement DryRunCheck = "placement"
+
+// DryRunCheckConfiguration checks the role counts and parameters of the test
+// run against its architecture
+const DryRunCheckConfiguration DryRunCheck = "configuration"
+
+// DryRunCheckConfigFile checks that the configuration file for the system
+// under test can be generated
+const DryRunCheckConfigFile DryRunCheck = "configFile"
+
+// DryRunIssue is a problem a dry run found with one of the test runs of a
+// submission. Errors would make the test run fail, warnings don't
+type DryRunIssue struct {
+	Check DryRunCheck `json:"check"`
+	// The index of the test run in the expanded sweep, -1 for issues with the
+	// submission as a whole
+	Run      int    `json:"run"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+// DryRunResult is the outcome of validating the test runs of a submission
+// without launching anything
+type DryRunResult struct {
+	Valid  bool          `json:"valid"`
+	Runs   int           `json:"runs"`
+	Issues []DryRunIssue `json:"issues"`
+}
+
+// DryRun checks the test runs of a submission (the runs its sweep expands
+// into) for the problems that would otherwise only surface once they are
+// executing. The test runs are not modified or scheduled
+func (t *TestRunManager) DryRun(runs []*common.TestRun) DryRunResult {
+	res := DryRunResult{Valid: true, Runs: len(runs), Issues: []DryRunIssue{}}
+	add := func(check DryRunCheck, run int, severity string, msg string) {
+		if severity == "error" {
+			res.Valid = false
+		}
+		res.Issues = append(res.Issues, DryRunIssue{
+			Check:    check,
+			Run:      run,
+			Severity: severity,
+			Message:  msg,
+		})
+	}
+
+	// The runs of a sweep mostly share their binaries, so each is only
+	// checked once
+	checkedBinaries := map[string]bool{}
+	for i, orig := range runs {
+		tr, err := dryRunCopy(orig)
+		if err != nil {
+			add(DryRunCheckConfiguration, i, "error", err.Error())
+			continue
+		}
+
+		for _, e := range t.ValidateTestRun(tr) {
+			add(DryRunCheckConfiguration, i, "error", e.Error())
+		}
+
+		for _, issue := range t.dryRunBinaries(tr, checkedBinaries) {
+			add(DryRunCheckBinaries, i, issue.Severity, issue.Message)
+		}
+
+		for _, issue := range t.dryRunCapacity(tr) {
+			add(DryRunCheckCapacity, i, issue.Severity, issue.Message)
+		}
+
+		syncColocatedRoles(tr.Roles)
+		if err := validatePlacement(tr.Roles); err != nil {
+			add(DryRunCheckPlacement, i, "error", err.Error())
+		}
+
+		if !t.IsParsec(tr.Architecture) {
+			if _, err := t.generateConfig(tr, true); err != nil {
+				add(
+					DryRunCheckConfigFile,
+					i,
+					"error",
+					fmt.Sprintf("Unable to generate config: %v", err),
+				)
+			}
+		}
+	}
+	return res
+}
+
+// dryRunCopy returns a deep copy of the test run that the checks can modify,
+// keeping the agents the roles are placed on
+func dryRunCopy(tr *common.TestRun) (*common.TestRun, error) {
+	var cp common.TestRun
+	b, err := json.Marshal(tr)
+	if err == nil {
+		err = json.Unmarshal(b, &cp)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to copy test run: %v", err)
+	}
+	return &cp, nil
+}
+
+// dryRunBinaries checks that the binaries of the test run are available in S3
+// for all architectures it runs on, or that its commit can be compiled
+func (t *TestRunManager) dryRunBinaries(
+	tr *common.TestRun,
+	checked map[string]bool,
+) []DryRunIssue {
+	ret := []DryRunIssue{}
+	if tr.CommitHash == "" {
+		if tr.SourceRef == "" {
+			return append(ret, DryRunIssue{
+				Severity: "error",
+				Message:  "No commit or ref to test",
+			})
+		}
+		return append(ret, DryRunIssue{
+			Severity: "warning",
+			Message: fmt.Sprintf(
+				"%s is resolved to a commit when the test run starts, its binaries are not checked",
+				tr.SourceRef,
+			),
+		})
+	}
+	for _, arch := range t.testRunArchitectures(tr) {
+		key := binariesS3Path(
+			tr.CommitHash,
+			tr.RunPerf || tr.Debug,
+			arch,
+			tr.BuildConfig,
+		)
+		if checked[key] {
+			continue
+		}
+		checked[key] = true
+		path, err := t.BinariesExistInS3(tr, false, arch)
+		if err != nil {
+			ret = append(ret, DryRunIssue{
+				Severity: "warning",
+				Message: fmt.Sprintf(
+					"Unable to check %s binaries in S3: %v",
+					arch,
+					err,
+				),
+			})
+			continue
+		}
+		if path != "" {
+			continue
+		}
+		switch f, broken := t.src.KnownBroken(tr.CommitHash); {
+		case !t.src.CommitExists(tr.CommitHash):
+			ret = append(ret, DryRunIssue{
+				Severity: "error",
+				Message: fmt.Sprintf(
+					"Commit %s does not exist",
+					tr.CommitHash,
+				),
+			})
+		case broken:
+			ret = append(ret, DryRunIssue{
+				Severity: "error",
+				Message: fmt.Sprintf(
+					"No %s binaries for commit %s, and its %s failed (build failure %s)",
+					arch,
+					tr.CommitHash,
+					f.Step,
+					f.ID,
+				),
+			})
+		default:
+			ret = append(ret, DryRunIssue{
+				Severity: "warning",
+				Message: fmt.Sprintf(
+					"No %s binaries for commit %s yet, they will be compiled",
+					arch,
+					tr.CommitHash,
+				),
+			})
+		}
+	}
+	return ret
+}
+
+// dryRunCapacity checks that the test run fits within the agent and vCPU
+// limits at all, that the launch templates of its roles exist and that the
+// agents roles are placed on are connected and available. Test runs that fit
+// but would have to wait for capacity are reported as warning
+func (t *TestRunManager) dryRunCapacity(tr *common.TestRun) []DryRunIssue {
+	ret := []DryRunIssue{}
+	cfg := t.Config()
+
+	if len(tr.Roles) > cfg.MaxAgents {
+		ret = append(ret, DryRunIssue{
+			Severity: "error",
+			Message: fmt.Sprintf(
+				"The test run needs %d agents, the limit is %d",
+				len(tr.Roles),
+				cfg.MaxAgents,
+			),
+		})
+	}
+
+	for _, r := range tr.Roles {
+		if r.ColocateWith != nil {
+			continue
+		}
+		if r.AgentID > 0 {
+			if _, err := t.coord.GetAgent(r.AgentID); err != nil {
+				ret = append(ret, DryRunIssue{
+					Severity: "error",
+					Message: fmt.Sprintf(
+						"%s %d is placed on agent %d, which is not connected",
+						r.Role,
+						r.Index,
+						r.AgentID,
+					),
+				})
+			} else if other := t.agentInUse(tr, r.AgentID); other != nil {
+				ret = append(ret, DryRunIssue{
+					Severity: "warning",
+					Message: fmt.Sprintf(
+						"Agent %d of %s %d is in use by test run %s",
+						r.AgentID,
+						r.Role,
+						r.Index,
+						other.ID,
+					),
+				})
+			}
+			continue
+		}
+		// The agents of pools are checked by validateAgentPools
+		if r.AgentPool != "" {
+			continue
+		}
+		if _, err := t.awsm.GetLaunchTemplate(r.AwsLaunchTemplateID); err != nil {
+			ret = append(ret, DryRunIssue{
+				Severity: "error",
+				Message: fmt.Sprintf(
+					"Launch template %s of %s %d does not exist",
+					r.AwsLaunchTemplateID,
+					r.Role,
+					r.Index,
+				),
+			})
+		}
+	}
+
+	// Tally what the running test runs use, like the scheduler does
+	inUse := map[string]int32{}
+	agentsInUse := 0
+	for _, other := range t.GetTestRuns() {
+		if other.Status != common.TestRunStatusRunning ||
+			other.AWSInstancesStopped {
+			continue
+		}
+		for k, v := range t.GetRequiredVCPUs(other) {
+			inUse[k] += v
+		}
+		agentsInUse += len(other.Roles)
+	}
+
+	required := t.GetRequiredVCPUs(tr)
+	regions := make([]string, 0, len(required))
+	for k := range required {
+		regions = append(regions, k)
+	}
+	sort.Strings(regions)
+	for _, k := range regions {
+		limit := t.awsm.GetVCPULimit(k)
+		if required[k] > limit {
+			ret = append(ret, DryRunIssue{
+				Severity: "error",
+				Message: fmt.Sprintf(
+					"The test run needs %d vCPUs in %s, the limit is %d",
+					required[k],
+					k,
+					limit,
+				),
+			})
+		} else if inUse[k]+required[k] > limit {
+			ret = append(ret, DryRunIssue{
+				Severity: "warning",
+				Message: fmt.Sprintf(
+					"Only %d of the %d vCPUs needed in %s are available now, the test run would be queued",
+					limit-inUse[k],
+					required[k],
+					k,
+				),
+			})
+		}
+	}
+	if len(tr.Roles) <= cfg.MaxAgents &&
+		agentsInUse+len(tr.Roles) > cfg.MaxAgents {
+		ret = append(ret, DryRunIssue{
+			Severity: "warning",
+			Message: fmt.Sprintf(
+				"Only %d of the %d agents needed are available now, the test run would be queued",
+				cfg.MaxAgents-agentsInUse,
+				len(tr.Roles),
+			),
+		})
+	}
+	return ret
+}
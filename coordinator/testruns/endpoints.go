@@ -54,7 +54,7 @@ var portNums = map[common.SystemRole]int{
 
 // GetRoleEndpoint will return the IP and port at which a particular role in our
 // test is / should be listening. This endpoint is derived from the IP address
-// reported by the agent and the port number based on the default for that role,
+// reported by the agent and the port number based on the port of that role,
 // and the specified increment (Default, RAFT or Client)
 func (t *TestRunManager) GetRoleEndpoint(
 	tr *common.TestRun,
@@ -68,7 +68,7 @@ func (t *TestRunManager) GetRoleEndpoint(
 	}
 	// Calculate the port number from the base in the portNums map and the
 	// increment specified
-	portnum := portNums[role.Role] + int(portIncrement)
+	portnum := t.rolePort(tr, role.Role) + int(portIncrement)
 
 	// Return the endpoint based on the agent's IP information and the
 	// calculated port number
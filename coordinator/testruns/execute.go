@@ -3,9 +3,11 @@ package testruns
 import (
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/coordinator/sources"
 )
 
 // ExecuteTestRun is the main function that executes a test run
@@ -19,6 +21,42 @@ func (t *TestRunManager) ExecuteTestRun(tr *common.TestRun) {
 	tr.ControllerCommit = t.commitHash
 	t.PersistTestRun(tr)
 
+	// Summarize the run and fire the post-run hooks once execution has ended,
+	// whatever the outcome. The summary is produced first so the hooks can
+	// include it in their notifications. External summarizers can take a
+	// while, so this doesn't hold up the end of the execution
+	defer func() {
+		t.failureSteps.Delete(tr.ID)
+		t.forgetRoleCommands(tr)
+		go func() {
+			t.SummarizeTestRun(tr)
+			_ = t.runLifecycleHooks(LifecycleHookPostRun, tr)
+		}()
+	}()
+
+	if tr.SourceRef != "" {
+		hash, moved, err := t.src.ResolveRef(tr.SourceRef)
+		if err != nil {
+			t.FailTestRun(
+				tr,
+				fmt.Errorf("Failed to resolve %s: %v", tr.SourceRef, err),
+			)
+			return
+		}
+		t.WriteLog(tr, "Resolved %s to commit %s", tr.SourceRef, hash)
+		if moved {
+			t.WriteLog(
+				tr,
+				"Head of %s moved since it was last used, binaries will be rebuilt",
+				tr.SourceRef,
+			)
+		}
+		tr.CommitHash = hash
+		t.PersistTestRun(tr)
+	}
+
+	t.enterFailureStep(tr, common.FailureClassConfiguration)
+	t.UpdateStatus(tr, common.TestRunStatusRunning, "Validating test run")
 	errs := t.ValidateTestRun(tr)
 	if len(errs) > 0 {
 		for _, err := range errs {
@@ -29,38 +67,90 @@ func (t *TestRunManager) ExecuteTestRun(tr *common.TestRun) {
 				" - see test run log for details", len(errs)))
 		return
 	}
+	if msg := t.verboseLoggingWarning(tr); msg != "" {
+		t.WriteLog(tr, "Warning: %s", msg)
+	}
 
-	var binariesInS3 string
-	binariesInS3, err := t.BinariesExistInS3(tr, false)
+	err := t.runLifecycleHooks(LifecycleHookPreLaunch, tr)
 	if err != nil {
-		t.FailTestRun(
-			tr,
-			fmt.Errorf("Checking binary existence failed: %v", err),
-		)
+		t.FailTestRun(tr, err)
 		return
 	}
-	if binariesInS3 == "" {
-		err := t.CompileBinaries(tr, false)
-		if err != nil {
-			t.FailTestRun(tr, fmt.Errorf("Compilation failed: %v", err))
-			return
-		}
 
-		binariesInS3, err = t.UploadBinaries(tr, false)
+	// Agents with different CPU architectures (such as AWS Graviton
+	// instances) need their own binaries
+	t.enterFailureStep(tr, common.FailureClassBuild)
+	archs := t.testRunArchitectures(tr)
+	binariesInS3 := map[string]string{}
+	for _, arch := range archs {
+		archBinariesInS3, err := t.BinariesExistInS3(tr, false, arch)
 		if err != nil {
 			t.FailTestRun(
 				tr,
-				fmt.Errorf("Failed to upload binaries to S3: %v", err),
+				fmt.Errorf("Checking binary existence failed: %v", err),
 			)
 			return
 		}
+		if archBinariesInS3 == "" {
+			err := t.CompileBinaries(tr, false, arch)
+			if err != nil {
+				t.FailTestRun(tr, fmt.Errorf("Compilation failed: %v", err))
+				return
+			}
+
+			archBinariesInS3, err = t.UploadBinaries(tr, false, arch)
+			if err != nil {
+				t.FailTestRun(
+					tr,
+					fmt.Errorf("Failed to upload binaries to S3: %v", err),
+				)
+				return
+			}
+		}
+		binariesInS3[arch] = archBinariesInS3
+	}
+
+	// Binaries of the additional repositories of the system under test
+	err = t.PrepareComponents(tr, archs)
+	if err != nil {
+		t.FailTestRun(tr, err)
+		return
+	}
+
+	// Check that custom binaries selected for roles are part of the binaries
+	// we just compiled or found
+	err = t.ValidateRoleBinaryOverrides(tr, archs[0], binariesInS3[archs[0]])
+	if err != nil {
+		t.FailTestRun(tr, err)
+		return
+	}
+
+	err = t.PrepareBinariesImage(tr, archs, binariesInS3)
+	if err != nil {
+		t.FailTestRun(tr, err)
+		return
+	}
+
+	// The credentials for the cloud access of the system under test are only
+	// valid while the run is executing
+	err = t.issueRunCredentials(tr)
+	if err != nil {
+		t.FailTestRun(tr, err)
+		return
 	}
+	defer t.revokeRunCredentials(tr)
 
 	tr.SeederHash, err = t.src.FindMostRecentCommitChangingSeeder(tr.CommitHash)
 	if err != nil {
 		t.FailTestRun(tr, fmt.Errorf("Failed determining seeder hash: %v", err))
 	}
-	seederBinariesInS3, err := t.BinariesExistInS3(tr, true)
+	// The seeder runs in AWS Batch, so it is always built for the default
+	// architecture
+	seederBinariesInS3, err := t.BinariesExistInS3(
+		tr,
+		true,
+		sources.DefaultTargetArch,
+	)
 	if err != nil {
 		t.FailTestRun(
 			tr,
@@ -69,13 +159,13 @@ func (t *TestRunManager) ExecuteTestRun(tr *common.TestRun) {
 		return
 	}
 	if seederBinariesInS3 == "" {
-		err = t.CompileBinaries(tr, true)
+		err = t.CompileBinaries(tr, true, sources.DefaultTargetArch)
 		if err != nil {
 			t.FailTestRun(tr, fmt.Errorf("Seeder compilation failed: %v", err))
 			return
 		}
 
-		_, err = t.UploadBinaries(tr, true)
+		_, err = t.UploadBinaries(tr, true, sources.DefaultTargetArch)
 		if err != nil {
 			t.FailTestRun(
 				tr,
@@ -95,6 +185,7 @@ func (t *TestRunManager) ExecuteTestRun(tr *common.TestRun) {
 			return
 		}
 
+		t.enterFailureStep(tr, common.FailureClassSeeding)
 		err = t.CheckPreseed(tr, dummyCfg)
 		if err != nil {
 			if err != errAbortedWhilePreseeding {
@@ -104,7 +195,18 @@ func (t *TestRunManager) ExecuteTestRun(tr *common.TestRun) {
 		}
 	}
 
-	if t.HasAWSRoles(tr) {
+	err = t.runLifecycleHooks(LifecycleHookPostSeed, tr)
+	if err != nil {
+		t.FailTestRun(tr, err)
+		return
+	}
+
+	// Reuse the agents, binaries and seeded data of a warm environment kept
+	// alive by an earlier test run if possible
+	warmEnvs := t.acquireWarmEnvironment(tr)
+
+	t.enterFailureStep(tr, common.FailureClassProvisioning)
+	if t.HasAWSRoles(tr) && warmEnvs == nil {
 		// Spawn AWS Agents
 		t.UpdateStatus(
 			tr,
@@ -172,6 +274,33 @@ func (t *TestRunManager) ExecuteTestRun(tr *common.TestRun) {
 		}
 	}
 
+	// Spawned agents report their accelerators once they are online, so
+	// check again that they have the ones their roles require
+	if errs := t.validateAccelerators(tr.Roles); len(errs) > 0 {
+		for _, err := range errs {
+			t.WriteLog(tr, "Error in agent placement: %v", err)
+		}
+		t.FailTestRun(tr, fmt.Errorf(
+			"%d role(s) are missing the accelerators they require"+
+				" - see test run log for details",
+			len(errs),
+		))
+		return
+	}
+
+	// The same goes for the capabilities the roles require
+	if errs := t.validateRoleRequirements(tr); len(errs) > 0 {
+		for _, err := range errs {
+			t.WriteLog(tr, "Error in agent placement: %v", err)
+		}
+		t.FailTestRun(tr, fmt.Errorf(
+			"%d role(s) run on agents that don't meet their requirements"+
+				" - see test run log for details",
+			len(errs),
+		))
+		return
+	}
+
 	// Make a channel to receive completion of commands
 	cmd := make(chan *common.ExecutedCommand, 10)
 
@@ -194,6 +323,7 @@ func (t *TestRunManager) ExecuteTestRun(tr *common.TestRun) {
 					}
 				}
 				if !deliberate {
+					t.recordRoleCrash(tr, c)
 					// For non-deliberate failures, we send the command with
 					// the non-zero exit code to the failures channel. We listen
 					// on this channel in RunBinaries and exit that function
@@ -216,12 +346,21 @@ func (t *TestRunManager) ExecuteTestRun(tr *common.TestRun) {
 
 	// Create environment folders on each agent and deploy the binaries into
 	// them
-	var envs map[int32][]byte
-	envs, err = t.DeployBinaries(tr, binariesInS3)
+	t.enterFailureStep(tr, common.FailureClassInfrastructure)
+	envs := warmEnvs
+	if envs == nil {
+		envs, err = t.DeployBinaries(tr, binariesInS3)
+		if err != nil {
+			t.FailTestRun(tr, err)
+			return
+		}
+	}
+	err = t.DeployComponents(tr, envs)
 	if err != nil {
 		t.FailTestRun(tr, err)
 		return
 	}
+	tr.Environments = envs
 
 	// Generate the configuration file the system needs based on the configured
 	// parameters in the UI
@@ -240,6 +379,11 @@ func (t *TestRunManager) ExecuteTestRun(tr *common.TestRun) {
 		t.FailTestRun(tr, err)
 		return
 	}
+	err = t.UploadRoleOverrides(tr)
+	if err != nil {
+		t.FailTestRun(tr, err)
+		return
+	}
 
 	// Write the configuration file to all agents, placing it in the environment
 	// folders created by DeployBinaries above
@@ -248,9 +392,16 @@ func (t *TestRunManager) ExecuteTestRun(tr *common.TestRun) {
 		t.FailTestRun(tr, err)
 		return
 	}
+	err = t.deployRunCredentials(tr, envs)
+	if err != nil {
+		t.FailTestRun(tr, err)
+		return
+	}
 
 	// Instruct the agents that will run the shards to download the preseed data
-	// for the shards from S3
+	// for the shards from S3. Warm environments are seeded again as well,
+	// since the previous test run changed the shard databases
+	t.enterFailureStep(tr, common.FailureClassSeeding)
 	err = t.PreseedShards(tr, envs)
 	if err != nil {
 		t.FailTestRun(tr, err)
@@ -263,7 +414,11 @@ func (t *TestRunManager) ExecuteTestRun(tr *common.TestRun) {
 	// performance profiling data to S3 and update the `PendingResultDownloads`
 	// member of the test run with all of the performance profiles available for
 	// download
+	t.enterFailureStep(tr, common.FailureClassSUTCrash)
+	stopWatching := make(chan bool)
+	go t.WatchAbortConditions(tr, failures, stopWatching)
 	err = t.RunBinaries(tr, envs, cmd, failures)
+	close(stopWatching)
 	if err != nil {
 		t.FailTestRun(tr, err)
 		return
@@ -275,20 +430,40 @@ func (t *TestRunManager) ExecuteTestRun(tr *common.TestRun) {
 		return
 	}
 
+	t.completeTestRun(tr, envs)
+}
+
+// completeTestRun collects the outputs of a test run that is done executing
+// its load, tears down or releases its environment, and calculates its
+// results
+func (t *TestRunManager) completeTestRun(
+	tr *common.TestRun,
+	envs map[int32][]byte,
+) {
 	// Instruct the agents to upload all their outputs to S3 and update the
 	// `PendingResultDownloads` member of the test run with all of the output
 	// files available for download.
-	err = t.CopyOutputs(tr, envs, false)
+	t.enterFailureStep(tr, common.FailureClassInfrastructure)
+	err := t.CopyOutputs(tr, envs, false)
 	if err != nil {
 		t.FailTestRun(tr, err)
 		return
 	}
 
+	// The outputs are safe, so the environments can be cleaned for the next
+	// test run if the test run keeps them warm, or removed from the agents
+	// otherwise. Verify nothing is left behind on agents that outlive the
+	// test run
+	warm := t.releaseWarmEnvironment(tr, envs)
+	if !warm {
+		t.VerifyCleanup(tr, envs)
+	}
+
 	// Now that the agents have copied all of their test result files and
 	// performance profiles to S3 we can safely kill all the agents without
 	// losing anything valuable
 	var killErr error
-	if t.HasAWSRoles(tr) {
+	if t.HasAWSRoles(tr) && !warm {
 		t.UpdateStatus(
 			tr,
 			common.TestRunStatusRunning,
@@ -314,6 +489,13 @@ func (t *TestRunManager) ExecuteTestRun(tr *common.TestRun) {
 		return
 	}
 
+	// Correlate the per-transaction records of the roles into end-to-end
+	// traces if requested. A failure here should not fail the test run
+	err = t.CorrelateTransactionTraces(tr)
+	if err != nil {
+		t.WriteLog(tr, "Transaction trace correlation failed: %v", err)
+	}
+
 	// Calculate the test results
 	t.UpdateStatus(tr, common.TestRunStatusRunning, "Calculating test results")
 	_, err = t.CalculateResults(tr, false)
@@ -321,6 +503,25 @@ func (t *TestRunManager) ExecuteTestRun(tr *common.TestRun) {
 		t.WriteLog(tr, "Test result calculation failed: %v", err)
 	}
 
+	// Compare the results against the baseline of the regression gate. A
+	// regression does not fail the test run, it flags it instead
+	details := "Completed"
+	verdict, err := t.EvaluateRegressionGate(tr)
+	if err != nil {
+		t.WriteLog(tr, "Regression gate could not be evaluated: %v", err)
+	} else if verdict != nil && verdict.Regressed {
+		t.WriteLog(
+			tr,
+			"Regressed against baseline %s: %s",
+			verdict.BaselineName,
+			strings.Join(verdict.Reasons, ", "),
+		)
+		details = fmt.Sprintf(
+			"Completed - REGRESSED against baseline %s",
+			verdict.BaselineName,
+		)
+	}
+
 	if killErr != nil {
 		t.UpdateStatus(
 			tr,
@@ -331,11 +532,14 @@ func (t *TestRunManager) ExecuteTestRun(tr *common.TestRun) {
 	}
 
 	// Done!
-	t.UpdateStatus(tr, common.TestRunStatusCompleted, "Completed")
+	t.UpdateStatus(tr, common.TestRunStatusCompleted, details)
 
-	// Complete - run the next run of the sweep if doing a one-at-a-time sweep
+	// Complete - run the next run of the sweep if doing a one-at-a-time sweep,
+	// or the next runs up to the concurrency limit of the sweep
 	if tr.SweepOneAtATime {
 		t.ContinueSweep(tr, tr.SweepID)
+	} else if tr.SweepConcurrency > 0 {
+		t.ContinueConcurrentSweep(tr)
 	}
 }
 
@@ -0,0 +1,357 @@
+package testruns
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+)
+
+// failoverBaselineSeconds is the number of seconds before a failover over
+// which the baseline throughput is averaged
+const failoverBaselineSeconds = 30
+
+// failoverRecoveryWindow is the number of consecutive seconds the throughput
+// has to stay at the recovery percentage of the baseline for the system to be
+// considered recovered, such that a single busy second doesn't count
+const failoverRecoveryWindow = 3
+
+// failoverTarget describes how the leader of a RAFT replicated role is found
+type failoverTarget struct {
+	// The port only the leader of the cluster responds on
+	leaderPort PortIncrement
+	// Set if the role is split into clusters of ShardReplicationFactor
+	// members, rather than forming one cluster
+	replicated bool
+}
+
+// failoverTargets are the roles a failover test run can kill the leader of
+var failoverTargets = map[common.SystemRole]failoverTarget{
+	common.SystemRoleRaftAtomizer:        {PortIncrementDefaultPort, false},
+	common.SystemRoleShardTwoPhase:       {PortIncrementClientPort, true},
+	common.SystemRoleCoordinator:         {PortIncrementDefaultPort, true},
+	common.SystemRoleTicketMachine:       {PortIncrementDefaultPort, true},
+	common.SystemRoleRuntimeLockingShard: {PortIncrementDefaultPort, true},
+}
+
+// failoverCluster returns the members of the first cluster of the role the
+// test run fails over
+func (t *TestRunManager) failoverCluster(
+	tr *common.TestRun,
+) []*common.TestRunRole {
+	roles := t.GetAllRolesSorted(tr, tr.FailoverRole)
+	if failoverTargets[tr.FailoverRole].replicated &&
+		tr.ShardReplicationFactor < len(roles) {
+		roles = roles[:tr.ShardReplicationFactor]
+	}
+	return roles
+}
+
+// validateFailover checks that the failovers configured for the test run can
+// be executed: the role has to be RAFT replicated, enough members have to
+// remain for the cluster to keep its quorum, and all failovers have to happen
+// before the test run ends
+func (t *TestRunManager) validateFailover(tr *common.TestRun) []error {
+	if tr.FailoverRole == "" {
+		return []error{}
+	}
+	if _, ok := failoverTargets[tr.FailoverRole]; !ok {
+		return []error{fmt.Errorf(
+			"Role %s is not RAFT replicated and cannot be failed over",
+			tr.FailoverRole,
+		)}
+	}
+	ret := []error{}
+	members := len(t.failoverCluster(tr))
+	if tr.FailoverCount > (members-1)/2 {
+		ret = append(ret, fmt.Errorf(
+			"A cluster of %d %s(s) loses its quorum after %d failovers",
+			members,
+			tr.FailoverRole,
+			tr.FailoverCount,
+		))
+	}
+	last := tr.FailoverAfter + (tr.FailoverCount-1)*tr.FailoverInterval
+	if last >= tr.SampleCount {
+		ret = append(ret, fmt.Errorf(
+			"The last failover happens after %d seconds, but the test run only takes %d",
+			last,
+			tr.SampleCount,
+		))
+	}
+	return ret
+}
+
+// findLeader returns the member of the cluster that responds on the leader
+// port of its role. If none of them respond, the first member is returned,
+// and detected is false
+func (t *TestRunManager) findLeader(
+	tr *common.TestRun,
+	members []*common.TestRunRole,
+) (leader *common.TestRunRole, detected bool) {
+	port := failoverTargets[tr.FailoverRole].leaderPort
+	for _, r := range members {
+		endpoint, err := t.GetRoleEndpoint(tr, r, port)
+		if err != nil {
+			continue
+		}
+		conn, err := net.DialTimeout("tcp", endpoint, time.Second*2)
+		if err == nil {
+			conn.Close()
+			return r, true
+		}
+	}
+	return members[0], false
+}
+
+// FailoverLeaders is run in a goroutine by RunBinaries to kill the leader of
+// the first cluster of the failover role at the configured points in the test
+// run. The killed leaders are recorded in the test run, such that the time it
+// takes the system to recover from each failover can be determined from its
+// throughput. The `cancel` channel is monitored like in FailRoles
+func (t *TestRunManager) FailoverLeaders(
+	tr *common.TestRun,
+	cancel chan bool,
+) {
+	if tr.FailoverRole == "" || tr.FailoverCount <= 0 {
+		return
+	}
+	started := time.Now()
+	members := t.failoverCluster(tr)
+
+	for i := 0; i < tr.FailoverCount && len(members) > 0; i++ {
+		failoverTime := started.Add(time.Second * time.Duration(
+			tr.FailoverAfter+i*tr.FailoverInterval,
+		))
+		t.WriteLog(
+			tr,
+			"Waiting until %s for failover %d/%d of the %s leader",
+			failoverTime.String(),
+			i+1,
+			tr.FailoverCount,
+			tr.FailoverRole,
+		)
+		for time.Until(failoverTime) > 0 {
+			select {
+			case <-cancel:
+				return
+			case <-time.After(1 * time.Second):
+			}
+		}
+
+		leader, detected := t.findLeader(tr, members)
+		if detected {
+			t.WriteLog(
+				tr,
+				"Failing over leader %s %d (Agent %d)",
+				leader.Role,
+				leader.Index,
+				leader.AgentID,
+			)
+		} else {
+			t.WriteLog(
+				tr,
+				"No %s responded as leader, failing over %s %d (Agent %d)",
+				tr.FailoverRole,
+				leader.Role,
+				leader.Index,
+				leader.AgentID,
+			)
+		}
+		killed := time.Now()
+		t.killRoleCommands(tr, leader)
+		tr.Failovers = append(tr.Failovers, common.FailoverEvent{
+			Role:           leader.Role,
+			Index:          leader.Index,
+			AgentID:        leader.AgentID,
+			LeaderDetected: detected,
+			Killed:         killed,
+		})
+		t.PersistTestRun(tr)
+
+		remaining := []*common.TestRunRole{}
+		for _, r := range members {
+			if r != leader {
+				remaining = append(remaining, r)
+			}
+		}
+		members = remaining
+	}
+}
+
+// systemThroughput returns the number of transactions completed by all load
+// generators in each second of the test run, read from the transaction
+// samples in its outputs, along with the first and last second
+func systemThroughput(
+	tr *common.TestRun,
+) (tps map[int64]float64, first, last int64, err error) {
+	outputsDir := filepath.Join(
+		common.DataDir(),
+		fmt.Sprintf("testruns/%s/outputs", tr.ID),
+	)
+	entries, err := ioutil.ReadDir(outputsDir)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	tps = map[int64]float64{}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".txt") ||
+			!strings.Contains(e.Name(), "tx_samples_") {
+			continue
+		}
+		err = readSampleFile(
+			filepath.Join(outputsDir, e.Name()),
+			2,
+			func(fields []float64) error {
+				if fields[0] > minTxSampleTime {
+					tps[int64(fields[0]/1e9)]++
+				}
+				return nil
+			},
+		)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+	}
+	if len(tps) == 0 {
+		return nil, 0, 0, fmt.Errorf("no transaction samples found")
+	}
+	first, last = math.MaxInt64, math.MinInt64
+	for sec := range tps {
+		if sec < first {
+			first = sec
+		}
+		if sec > last {
+			last = sec
+		}
+	}
+	return tps, first, last, nil
+}
+
+// failoverResult determines how long the system took to recover from each of
+// the failovers of the test run. A failover is recovered from once the system
+// throughput is back at the recovery percentage of the throughput before the
+// failover for failoverRecoveryWindow consecutive seconds. Returns nil if the
+// test run has no failovers
+func (t *TestRunManager) failoverResult(
+	tr *common.TestRun,
+) (*common.FailoverResult, error) {
+	if len(tr.Failovers) == 0 {
+		return nil, nil
+	}
+	tps, first, last, err := systemThroughput(tr)
+	if err != nil {
+		return nil, err
+	}
+	pct := tr.FailoverRecovery
+	if pct <= 0 {
+		pct = 90
+	}
+
+	events := make([]common.FailoverEvent, len(tr.Failovers))
+	copy(events, tr.Failovers)
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Killed.Before(events[j].Killed)
+	})
+
+	recoveries := []common.FailoverRecovery{}
+	for i, ev := range events {
+		killed := ev.Killed.Unix()
+		// The baseline ends at the failover and starts no earlier than the
+		// previous one
+		from := killed - failoverBaselineSeconds
+		if from < first {
+			from = first
+		}
+		if i > 0 && from < events[i-1].Killed.Unix() {
+			from = events[i-1].Killed.Unix()
+		}
+		// The recovery has to happen before the next failover
+		until := last
+		if i < len(events)-1 && events[i+1].Killed.Unix()-1 < until {
+			until = events[i+1].Killed.Unix() - 1
+		}
+
+		rec := common.FailoverRecovery{
+			Role:    ev.Role,
+			Index:   ev.Index,
+			Killed:  ev.Killed,
+			Minimum: math.MaxFloat64,
+		}
+		for sec := from; sec < killed; sec++ {
+			rec.Baseline += tps[sec]
+		}
+		if killed > from {
+			rec.Baseline /= float64(killed - from)
+		}
+		threshold := rec.Baseline * pct / 100
+
+		streak := 0
+		for sec := killed; sec <= until; sec++ {
+			if tps[sec] < rec.Minimum {
+				rec.Minimum = tps[sec]
+			}
+			if rec.Recovered {
+				continue
+			}
+			if tps[sec] < threshold {
+				streak = 0
+				continue
+			}
+			streak++
+			if streak == failoverRecoveryWindow {
+				recoveredAt := time.Unix(sec-failoverRecoveryWindow+1, 0)
+				rec.Recovered = true
+				rec.RecoveryTime = math.Max(
+					recoveredAt.Sub(ev.Killed).Seconds(),
+					0,
+				)
+			}
+		}
+		if rec.Minimum == math.MaxFloat64 {
+			rec.Minimum = 0
+		}
+		recoveries = append(recoveries, rec)
+	}
+	return summarizeFailoverRecoveries(recoveries), nil
+}
+
+// summarizeFailoverRecoveries calculates the statistics over the recovery
+// times of the given failovers
+func summarizeFailoverRecoveries(
+	recoveries []common.FailoverRecovery,
+) *common.FailoverResult {
+	res := &common.FailoverResult{Recoveries: recoveries}
+	n := 0
+	for _, r := range recoveries {
+		if !r.Recovered {
+			res.Unrecovered++
+			continue
+		}
+		if n == 0 || r.RecoveryTime < res.RecoveryMin {
+			res.RecoveryMin = r.RecoveryTime
+		}
+		if r.RecoveryTime > res.RecoveryMax {
+			res.RecoveryMax = r.RecoveryTime
+		}
+		res.RecoveryAvg += r.RecoveryTime
+		n++
+	}
+	if n == 0 {
+		return res
+	}
+	res.RecoveryAvg /= float64(n)
+	for _, r := range recoveries {
+		if r.Recovered {
+			res.RecoveryStd += math.Pow(r.RecoveryTime-res.RecoveryAvg, 2)
+		}
+	}
+	res.RecoveryStd = math.Sqrt(res.RecoveryStd / float64(n))
+	return res
+}
@@ -67,34 +67,45 @@ func (t *TestRunManager) FailRoles(tr *common.TestRun, cancel chan bool) {
 			nextFailureRole.AgentID,
 		)
 
-		// Get all running commands on the role we need to fail
-		running := t.am.RunningCommandsForAgent(nextFailureRole.AgentID)
-		t.WriteLog(
-			tr,
-			"Killing %d commands on agent %d",
-			len(running),
-			nextFailureRole.AgentID,
-		)
-		for _, cmd := range running {
-			// Append this command as being failed on purpose - such that the
-			// test run is not aborted because of this command's failure.
-			tr.DeliberateFailures = append(tr.DeliberateFailures, cmd.CommandID)
-			cmdID, _ := hex.DecodeString(cmd.CommandID)
-			t.WriteLog(
-				tr,
-				"Killing command %s (id %x) on agent %d",
-				cmd.Command,
-				cmdID,
-				cmd.AgentID,
-			)
-			err := t.am.TerminateCommand(cmd.AgentID, cmdID)
-			if err != nil {
-				t.WriteLog(tr, "Could not kill command %x: %v", cmdID, err)
-			}
-		}
+		t.killRoleCommands(tr, nextFailureRole)
+
 		// Set the failure as having executed succesfully, so that it's not
 		// being considered as the next failure anymore.
 		nextFailureRole.Failure.Failed = true
 
 	}
 }
+
+// killRoleCommands terminates the commands running on the agent of the role,
+// and marks them as failed on purpose such that the test run is not aborted
+// because of their failure
+func (t *TestRunManager) killRoleCommands(
+	tr *common.TestRun,
+	role *common.TestRunRole,
+) {
+	// Get all running commands on the role we need to fail
+	running := t.am.RunningCommandsForAgent(role.AgentID)
+	t.WriteLog(
+		tr,
+		"Killing %d commands on agent %d",
+		len(running),
+		role.AgentID,
+	)
+	for _, cmd := range running {
+		// Append this command as being failed on purpose - such that the
+		// test run is not aborted because of this command's failure.
+		tr.DeliberateFailures = append(tr.DeliberateFailures, cmd.CommandID)
+		cmdID, _ := hex.DecodeString(cmd.CommandID)
+		t.WriteLog(
+			tr,
+			"Killing command %s (id %x) on agent %d",
+			cmd.Command,
+			cmdID,
+			cmd.AgentID,
+		)
+		err := t.am.TerminateCommand(cmd.AgentID, cmdID)
+		if err != nil {
+			t.WriteLog(tr, "Could not kill command %x: %v", cmdID, err)
+		}
+	}
+}
@@ -0,0 +1,345 @@
+package testruns
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// classifiedError is an error of which the failure class is known where it
+// occurs, such that it doesn't have to be derived from its message
+type classifiedError struct {
+	class common.FailureClass
+	err   error
+}
+
+func (e *classifiedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *classifiedError) Unwrap() error {
+	return e.err
+}
+
+// withFailureClass attaches the failure class to the error
+func withFailureClass(class common.FailureClass, err error) error {
+	return &classifiedError{class: class, err: err}
+}
+
+// failureClassRule classifies failures of which the reason contains one of
+// the patterns (case insensitive)
+type failureClassRule struct {
+	class    common.FailureClass
+	patterns []string
+}
+
+// failureClassRules are matched in order against the reason of failures that
+// were not classified where they occurred. They take precedence over the step
+// the test run failed in, since a timeout or lost agent can happen in any step
+var failureClassRules = []failureClassRule{
+	{
+		class: common.FailureClassTimeout,
+		patterns: []string{
+			"timed out",
+			"timeout",
+			"took too long",
+			"deadline exceeded",
+		},
+	},
+	{
+		class: common.FailureClassInfrastructure,
+		patterns: []string{
+			"not connected",
+			"disconnected",
+			"connection reset",
+			"broken pipe",
+			"spot instance",
+			"spot request",
+			"insufficientinstancecapacity",
+			"to s3",
+			"from s3",
+			"in s3",
+			"s3 bucket",
+			"nosuchbucket",
+			"unable to kill",
+		},
+	},
+}
+
+// enterFailureStep records the step the test run is executing, which
+// classifies the failures that don't match any of the rules
+func (t *TestRunManager) enterFailureStep(
+	tr *common.TestRun,
+	class common.FailureClass,
+) {
+	t.failureSteps.Store(tr.ID, class)
+}
+
+// classifyFailure determines the failure class of a test run that ends with
+// the given (unsuccessful) status and reason. err is the error that failed the
+// test run, if any
+func (t *TestRunManager) classifyFailure(
+	tr *common.TestRun,
+	status common.TestRunStatus,
+	reason string,
+	err error,
+) (common.FailureClass, string) {
+	var ce *classifiedError
+	if errors.As(err, &ce) {
+		return ce.class, "Classified where it occurred"
+	}
+
+	switch status {
+	case common.TestRunStatusAborted:
+		if strings.HasPrefix(reason, "Preempted") {
+			return common.FailureClassPreempted, "Aborted by preemption"
+		}
+		return common.FailureClassUserAbort, "Aborted"
+	case common.TestRunStatusCanceled:
+		return common.FailureClassUserAbort, "Canceled"
+	case common.TestRunStatusSkipped:
+		return common.FailureClassDependency, "Skipped"
+	case common.TestRunStatusInterrupted:
+		return common.FailureClassInfrastructure,
+			"Interrupted by a restart of the coordinator"
+	}
+
+	lower := strings.ToLower(reason)
+	for _, r := range failureClassRules {
+		for _, p := range r.patterns {
+			if strings.Contains(lower, p) {
+				return r.class, fmt.Sprintf("Reason mentions %q", p)
+			}
+		}
+	}
+
+	if v, ok := t.failureSteps.Load(tr.ID); ok {
+		return v.(common.FailureClass), "Failed in this step"
+	}
+	return common.FailureClassUnknown, "No rule matched"
+}
+
+// isTerminalStatus returns true if test runs with this status are done
+// executing
+func isTerminalStatus(status common.TestRunStatus) bool {
+	switch status {
+	case common.TestRunStatusCompleted,
+		common.TestRunStatusFailed,
+		common.TestRunStatusAborted,
+		common.TestRunStatusInterrupted,
+		common.TestRunStatusCanceled,
+		common.TestRunStatusSkipped:
+		return true
+	}
+	return false
+}
+
+// RunOutcome is the record of how a test run ended. These are kept
+// separately from the test runs, since unsuccessful test runs are not loaded
+// for long
+type RunOutcome struct {
+	TestRunID    string               `json:"testRunID"`
+	Time         time.Time            `json:"time"`
+	Status       common.TestRunStatus `json:"status"`
+	Architecture string               `json:"architectureID"`
+	SweepID      string               `json:"sweepID,omitempty"`
+	FailureClass common.FailureClass  `json:"failureClass,omitempty"`
+}
+
+// runOutcomeRetention is how long the outcomes of test runs are kept
+const runOutcomeRetention = 400 * 24 * time.Hour
+
+// runOutcomeCompaction is how long outcomes are kept beyond their retention,
+// such that the file of run outcomes is rewritten once in a while rather than
+// every time a test run ends
+const runOutcomeCompaction = 30 * 24 * time.Hour
+
+// runOutcomesPath returns the path of the file the run outcomes are appended
+// to
+func runOutcomesPath() string {
+	return filepath.Join(common.DataDir(), "run-outcomes.log")
+}
+
+// loadRunOutcomes reads the run outcomes into memory the first time they are
+// needed, such that they are not read from disk on every request. Expects the
+// caller to hold runOutcomesLock
+func (t *TestRunManager) loadRunOutcomes() error {
+	if t.runOutcomesLoaded {
+		return nil
+	}
+	f, err := os.Open(runOutcomesPath())
+	if os.IsNotExist(err) {
+		t.runOutcomesLoaded = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	outcomes := []RunOutcome{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var o RunOutcome
+		if err := json.Unmarshal(scanner.Bytes(), &o); err != nil {
+			continue
+		}
+		outcomes = append(outcomes, o)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	t.runOutcomes = outcomes
+	t.runOutcomesLoaded = true
+	return t.compactRunOutcomes()
+}
+
+// compactRunOutcomes drops the outcomes older than their retention and
+// rewrites the file without them, once the oldest outcome is past its
+// retention by runOutcomeCompaction. Expects the caller to hold
+// runOutcomesLock
+func (t *TestRunManager) compactRunOutcomes() error {
+	if len(t.runOutcomes) == 0 || time.Since(t.runOutcomes[0].Time) <
+		runOutcomeRetention+runOutcomeCompaction {
+		return nil
+	}
+	cutoff := time.Now().Add(-runOutcomeRetention)
+	kept := []RunOutcome{}
+	for _, o := range t.runOutcomes {
+		if !o.Time.Before(cutoff) {
+			kept = append(kept, o)
+		}
+	}
+	t.runOutcomes = kept
+
+	tmp := runOutcomesPath() + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, o := range kept {
+		b, err := json.Marshal(o)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w.Write(append(b, '\n'))
+	}
+	err = w.Flush()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, runOutcomesPath())
+}
+
+// recordOutcome appends how the test run ended to the run outcomes
+func (t *TestRunManager) recordOutcome(tr *common.TestRun) {
+	o := RunOutcome{
+		TestRunID:    tr.ID,
+		Time:         time.Now(),
+		Status:       tr.Status,
+		Architecture: tr.Architecture,
+		SweepID:      tr.SweepID,
+		FailureClass: tr.FailureClass,
+	}
+	b, err := json.Marshal(o)
+	if err != nil {
+		logging.Errorf("Unable to marshal run outcome: %v", err)
+		return
+	}
+	t.runOutcomesLock.Lock()
+	defer t.runOutcomesLock.Unlock()
+	if err := t.loadRunOutcomes(); err != nil {
+		logging.Errorf("Unable to load run outcomes: %v", err)
+	}
+	t.runOutcomes = append(t.runOutcomes, o)
+	f, err := os.OpenFile(
+		runOutcomesPath(),
+		os.O_CREATE|os.O_WRONLY|os.O_APPEND,
+		0644,
+	)
+	if err != nil {
+		logging.Errorf("Unable to open run outcomes: %v", err)
+		return
+	}
+	_, err = f.Write(append(b, '\n'))
+	f.Close()
+	if err != nil {
+		logging.Errorf("Unable to write run outcome: %v", err)
+		return
+	}
+	if err := t.compactRunOutcomes(); err != nil {
+		logging.Errorf("Unable to compact run outcomes: %v", err)
+	}
+}
+
+// FailureRateBucket is the number of test runs that ended within a period,
+// and how many of those were unsuccessful per failure class
+type FailureRateBucket struct {
+	Start   time.Time                   `json:"start"`
+	Runs    int                         `json:"runs"`
+	Failed  int                         `json:"failed"`
+	Rate    float64                     `json:"rate"`
+	ByClass map[common.FailureClass]int `json:"byClass"`
+}
+
+// FailureRates returns the failure rates of the test runs that ended since
+// the given time, in buckets of the given period. Buckets without runs are
+// included, such that rising failure rates of a class show as a trend.
+// Architecture optionally limits the rates to test runs of one architecture
+func (t *TestRunManager) FailureRates(
+	since time.Time,
+	period time.Duration,
+	architecture string,
+) ([]FailureRateBucket, error) {
+	if period <= 0 {
+		return nil, errors.New("The period of the buckets has to be positive")
+	}
+	since = since.Truncate(period)
+	buckets := []FailureRateBucket{}
+	for s := since; s.Before(time.Now()); s = s.Add(period) {
+		buckets = append(buckets, FailureRateBucket{
+			Start:   s,
+			ByClass: map[common.FailureClass]int{},
+		})
+	}
+
+	t.runOutcomesLock.Lock()
+	defer t.runOutcomesLock.Unlock()
+	if err := t.loadRunOutcomes(); err != nil {
+		return nil, err
+	}
+	for _, o := range t.runOutcomes {
+		if o.Time.Before(since) ||
+			(architecture != "" && o.Architecture != architecture) {
+			continue
+		}
+		i := int(o.Time.Sub(since) / period)
+		if i >= len(buckets) {
+			continue
+		}
+		buckets[i].Runs++
+		if o.Status != common.TestRunStatusCompleted {
+			buckets[i].Failed++
+			buckets[i].ByClass[o.FailureClass]++
+		}
+	}
+	for i := range buckets {
+		if buckets[i].Runs > 0 {
+			buckets[i].Rate = float64(buckets[i].Failed) /
+				float64(buckets[i].Runs)
+		}
+	}
+	return buckets, nil
+}
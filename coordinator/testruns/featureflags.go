@@ -0,0 +1,20 @@
+package testruns
+
+import "github.com/mit-dci/opencbdc-tctl/common"
+
+// FeatureQueueCorrelation is the feature flag of the correlation of the queue
+// metrics reported by the system under test with the throughput dips, which
+// the results pipeline only calculates for the runs the flag is on for
+const FeatureQueueCorrelation = "queueCorrelation"
+
+// FeatureEnabled returns true if the experimental capability behind the
+// feature flag is on for the test run: the flag was assigned to the run when
+// it was scheduled, and has not been disabled since
+func (t *TestRunManager) FeatureEnabled(tr *common.TestRun, flag string) bool {
+	for _, f := range tr.FeatureFlags {
+		if f == flag {
+			return t.coord.FeatureFlagEnabled(flag)
+		}
+	}
+	return false
+}
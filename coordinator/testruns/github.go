@@ -0,0 +1,487 @@
+package testruns
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// githubReportPercentiles are the latency percentiles included in the
+// comments posted to pull requests
+var githubReportPercentiles = []float64{50, 99, 99.9, 99.99}
+
+// GitHubReporter is a LifecycleHook that reports test runs of pull request
+// head commits back to the pull request: a pending commit status when the
+// test run launches, and the final status with a comment summarizing the
+// results once it has ended. Test runs of other commits are ignored. It
+// authenticates with either a token or a GitHub App installation
+type GitHubReporter struct {
+	// The API endpoint, https://api.github.com unless using GitHub Enterprise
+	APIURL string
+	// The repository the pull requests are in, as owner/name
+	Repository string
+	// The context of the commit statuses, which distinguishes them from the
+	// statuses posted by other systems
+	Context string
+	// The base URL of the controller's web interface, used to link to the
+	// test run from the status and comment. Links are left out if empty
+	DetailsURL string
+	// Static token (personal access token or similar) to authenticate with
+	Token string
+	// GitHub App to authenticate as, used if Token is empty
+	AppID             string
+	AppInstallationID string
+	AppPrivateKey     *rsa.PrivateKey
+	// Returns the pull request the commit is the head of, or zero
+	PullRequestForCommit func(hash string) int
+	// Returns the commit status of a merge candidate's benchmark, which
+	// depends on the service level objectives of the merge queue
+	MergeQueueState func(tr *common.TestRun) (string, string)
+
+	client           *http.Client
+	installToken     string
+	installExpires   time.Time
+	installTokenLock sync.Mutex
+}
+
+// Name implements LifecycleHook
+func (g *GitHubReporter) Name() string {
+	return fmt.Sprintf("github %s", g.Repository)
+}
+
+// Run implements LifecycleHook
+func (g *GitHubReporter) Run(
+	point LifecycleHookPoint,
+	tr *common.TestRun,
+) error {
+	if hasTag(tr, common.TestRunTagMergeQueue) {
+		return g.reportMergeCandidate(point, tr)
+	}
+	pr := g.PullRequestForCommit(tr.CommitHash)
+	if pr == 0 {
+		return nil
+	}
+	switch point {
+	case LifecycleHookPreLaunch:
+		// Failing to report shouldn't keep the test run from launching,
+		// which an error returned at this point would
+		err := g.postStatus(tr, "pending", "Test run launched")
+		if err != nil {
+			logging.Warnf(
+				"Unable to report test run %s to PR #%d: %v",
+				tr.ID,
+				pr,
+				err,
+			)
+		}
+		return nil
+	case LifecycleHookPostRun:
+		state, description := githubState(tr)
+		err := g.postStatus(tr, state, description)
+		if err != nil {
+			return err
+		}
+		return g.postComment(pr, githubComment(tr, g.detailsLink(tr)))
+	}
+	return nil
+}
+
+// reportMergeCandidate reports the benchmark of a merge candidate of the
+// merge queue in a commit status of its own, which the merge queue can
+// require to pass before merging
+func (g *GitHubReporter) reportMergeCandidate(
+	point LifecycleHookPoint,
+	tr *common.TestRun,
+) error {
+	switch point {
+	case LifecycleHookPreLaunch:
+		err := g.postStatusWithContext(
+			tr,
+			"pending",
+			"Benchmarking merge candidate",
+			g.mergeQueueContext(),
+		)
+		if err != nil {
+			logging.Warnf(
+				"Unable to report merge candidate %s: %v",
+				tr.CommitHash,
+				err,
+			)
+		}
+		return nil
+	case LifecycleHookPostRun:
+		state, description := githubState(tr)
+		if g.MergeQueueState != nil {
+			state, description = g.MergeQueueState(tr)
+		}
+		return g.postStatusWithContext(
+			tr,
+			state,
+			description,
+			g.mergeQueueContext(),
+		)
+	}
+	return nil
+}
+
+// mergeQueueContext returns the context of the commit statuses reported for
+// merge candidates
+func (g *GitHubReporter) mergeQueueContext() string {
+	return fmt.Sprintf("%s/merge-queue", g.Context)
+}
+
+// githubState maps the outcome of the test run to the state of its commit
+// status
+func githubState(tr *common.TestRun) (string, string) {
+	switch tr.Status {
+	case common.TestRunStatusCompleted:
+		if tr.Result == nil {
+			return "error", "Completed, but no results could be calculated"
+		}
+		return "success", fmt.Sprintf(
+			"%.2f tx/s, %.3fs average latency",
+			tr.Result.ThroughputAvg,
+			tr.Result.LatencyAvg,
+		)
+	case common.TestRunStatusFailed:
+		return "failure", tr.Details
+	}
+	return "error", string(tr.Status)
+}
+
+// githubComment renders the summary comment for the test run in markdown
+func githubComment(tr *common.TestRun, link string) string {
+	var b strings.Builder
+	verdict := "passed"
+	if tr.Status != common.TestRunStatusCompleted || tr.Result == nil {
+		verdict = "failed"
+	}
+	title := fmt.Sprintf("Test run %s", tr.ID)
+	if link != "" {
+		title = fmt.Sprintf("[%s](%s)", title, link)
+	}
+	fmt.Fprintf(
+		&b,
+		"### %s %s\n\nCommit %s, architecture `%s`, status **%s**",
+		title,
+		verdict,
+		tr.CommitHash,
+		tr.Architecture,
+		tr.Status,
+	)
+	if tr.Details != "" && tr.Details != string(tr.Status) {
+		fmt.Fprintf(&b, " (%s)", tr.Details)
+	}
+	b.WriteString("\n")
+
+	if res := tr.Result; res != nil {
+		b.WriteString("\n| Metric | Value |\n| --- | --- |\n")
+		fmt.Fprintf(
+			&b,
+			"| Throughput | %.2f tx/s (std %.2f) |\n",
+			res.ThroughputAvg,
+			res.ThroughputStd,
+		)
+		fmt.Fprintf(&b, "| Latency (avg) | %.3fs |\n", res.LatencyAvg)
+		for _, pct := range githubReportPercentiles {
+			for _, p := range res.LatencyPercentiles {
+				if p.Bucket == pct {
+					fmt.Fprintf(
+						&b,
+						"| Latency (p%g) | %.3fs |\n",
+						pct,
+						p.Value,
+					)
+				}
+			}
+		}
+		fmt.Fprintf(&b, "| Latency (max) | %.3fs |\n", res.LatencyMax)
+	}
+
+	if tr.Summary != nil && tr.Summary.Text != "" {
+		fmt.Fprintf(
+			&b,
+			"\n<details><summary>Summary</summary>\n\n%s\n\n</details>\n",
+			tr.Summary.Text,
+		)
+	}
+	return b.String()
+}
+
+// detailsLink returns the link to the test run in the web interface
+func (g *GitHubReporter) detailsLink(tr *common.TestRun) string {
+	if g.DetailsURL == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/testrun/%s", strings.TrimRight(g.DetailsURL, "/"), tr.ID)
+}
+
+// postStatus sets the commit status of the test run's commit
+func (g *GitHubReporter) postStatus(
+	tr *common.TestRun,
+	state, description string,
+) error {
+	return g.postStatusWithContext(
+		tr,
+		state,
+		description,
+		fmt.Sprintf("%s/%s", g.Context, tr.Architecture),
+	)
+}
+
+// postStatusWithContext sets the commit status with the given context of the
+// test run's commit
+func (g *GitHubReporter) postStatusWithContext(
+	tr *common.TestRun,
+	state, description, statusContext string,
+) error {
+	// GitHub rejects descriptions over 140 characters
+	if len(description) > 140 {
+		description = description[:137] + "..."
+	}
+	return g.request(
+		"POST",
+		fmt.Sprintf("/repos/%s/statuses/%s", g.Repository, tr.CommitHash),
+		map[string]string{
+			"state":       state,
+			"description": description,
+			"context":     statusContext,
+			"target_url":  g.detailsLink(tr),
+		},
+		nil,
+	)
+}
+
+// postComment adds a comment to the pull request
+func (g *GitHubReporter) postComment(pr int, body string) error {
+	return g.request(
+		"POST",
+		fmt.Sprintf("/repos/%s/issues/%d/comments", g.Repository, pr),
+		map[string]string{"body": body},
+		nil,
+	)
+}
+
+// request calls the GitHub API, authenticating with the configured token or
+// the GitHub App installation, and decodes the response into res if it isn't
+// nil
+func (g *GitHubReporter) request(
+	method, path string,
+	body interface{},
+	res interface{},
+) error {
+	token, err := g.authorization()
+	if err != nil {
+		return err
+	}
+	return g.do(method, path, token, body, res)
+}
+
+func (g *GitHubReporter) do(
+	method, path, authorization string,
+	body interface{},
+	res interface{},
+) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(
+		method,
+		strings.TrimRight(g.APIURL, "/")+path,
+		bytes.NewReader(b),
+	)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", authorization)
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf(
+			"%s %s returned status %d: %s",
+			method,
+			path,
+			resp.StatusCode,
+			strings.TrimSpace(string(msg)),
+		)
+	}
+	if res == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(res)
+}
+
+// authorization returns the Authorization header for API requests. With a
+// GitHub App, an installation token is requested and cached until shortly
+// before it expires
+func (g *GitHubReporter) authorization() (string, error) {
+	if g.Token != "" {
+		return "token " + g.Token, nil
+	}
+
+	g.installTokenLock.Lock()
+	defer g.installTokenLock.Unlock()
+	if g.installToken != "" && time.Now().Add(time.Minute).Before(g.installExpires) {
+		return "token " + g.installToken, nil
+	}
+	jwt, err := g.appJWT()
+	if err != nil {
+		return "", err
+	}
+	var res struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	err = g.do(
+		"POST",
+		fmt.Sprintf("/app/installations/%s/access_tokens", g.AppInstallationID),
+		"Bearer "+jwt,
+		map[string]string{},
+		&res,
+	)
+	if err != nil {
+		return "", fmt.Errorf("Unable to get installation token: %v", err)
+	}
+	g.installToken = res.Token
+	g.installExpires = res.ExpiresAt
+	return "token " + g.installToken, nil
+}
+
+// appJWT returns the JSON Web Token (RS256) that authenticates as the GitHub
+// App, valid for nine minutes. The issue time is set in the past to allow
+// for clock drift, as GitHub recommends
+func (g *GitHubReporter) appJWT() (string, error) {
+	enc := base64.RawURLEncoding
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims, err := json.Marshal(map[string]interface{}{
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": g.AppID,
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	h := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, g.AppPrivateKey, crypto.SHA256, h[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + enc.EncodeToString(sig), nil
+}
+
+// parseRSAPrivateKey parses a PEM encoded RSA private key in either PKCS#1 or
+// PKCS#8 format. GitHub issues App keys in PKCS#1
+func parseRSAPrivateKey(b []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("not an RSA private key")
+	}
+	return rsaKey, nil
+}
+
+// githubRepository returns the owner/name of the repository to report to,
+// from GITHUB_REPORT_REPOSITORY or else the path of
+// TRANSACTION_PROCESSOR_REPO_URL
+func githubRepository() string {
+	if r := os.Getenv("GITHUB_REPORT_REPOSITORY"); r != "" {
+		return r
+	}
+	u, err := url.Parse(os.Getenv("TRANSACTION_PROCESSOR_REPO_URL"))
+	if err != nil {
+		return ""
+	}
+	r := strings.TrimSuffix(strings.Trim(u.Path, "/"), ".git")
+	if strings.Count(r, "/") != 1 {
+		return ""
+	}
+	return r
+}
+
+// registerGitHubReporterFromEnv registers the GitHubReporter if credentials
+// are configured, either a token in GITHUB_REPORT_TOKEN or a GitHub App in
+// GITHUB_APP_ID, GITHUB_APP_INSTALLATION_ID and GITHUB_APP_PRIVATE_KEY (the
+// path to its PEM encoded private key). GITHUB_API_URL, GITHUB_REPORT_CONTEXT
+// and GITHUB_REPORT_DETAILS_URL optionally configure the API endpoint, the
+// status context and the link to the test run
+func (t *TestRunManager) registerGitHubReporterFromEnv() {
+	g := &GitHubReporter{
+		APIURL:               os.Getenv("GITHUB_API_URL"),
+		Repository:           githubRepository(),
+		Context:              os.Getenv("GITHUB_REPORT_CONTEXT"),
+		DetailsURL:           os.Getenv("GITHUB_REPORT_DETAILS_URL"),
+		Token:                os.Getenv("GITHUB_REPORT_TOKEN"),
+		AppID:                os.Getenv("GITHUB_APP_ID"),
+		AppInstallationID:    os.Getenv("GITHUB_APP_INSTALLATION_ID"),
+		PullRequestForCommit: t.src.PullRequestForCommit,
+		MergeQueueState:      t.mergeQueueState,
+		client:               &http.Client{Timeout: 30 * time.Second},
+	}
+	if g.Token == "" && g.AppID == "" {
+		return
+	}
+	if g.Repository == "" {
+		logging.Warnf("Not reporting to GitHub, unable to determine the repository")
+		return
+	}
+	if g.Token == "" {
+		b, err := ioutil.ReadFile(os.Getenv("GITHUB_APP_PRIVATE_KEY"))
+		if err == nil {
+			g.AppPrivateKey, err = parseRSAPrivateKey(b)
+		}
+		if err != nil {
+			logging.Warnf(
+				"Not reporting to GitHub, unable to read the App's private key: %v",
+				err,
+			)
+			return
+		}
+	}
+	if g.APIURL == "" {
+		g.APIURL = "https://api.github.com"
+	}
+	if g.Context == "" {
+		g.Context = "opencbdc-tctl"
+	}
+	logging.Infof("Reporting test runs of pull requests to GitHub %s", g.Repository)
+	t.RegisterLifecycleHook(g)
+}
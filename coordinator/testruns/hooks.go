@@ -0,0 +1,191 @@
+package testruns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// LifecycleHookPoint identifies the point in the lifecycle of a test run at
+// which hooks are fired
+type LifecycleHookPoint string
+
+// LifecycleHookPreLaunch is fired after the test run configuration has been
+// validated, before any binaries are compiled or agents are launched. An error
+// returned by a hook at this point fails the test run, which allows hooks to
+// implement custom approvals
+const LifecycleHookPreLaunch LifecycleHookPoint = "pre-launch"
+
+// LifecycleHookPostSeed is fired once the seeder binaries are available and
+// the preseed outputs have been generated, before agents are launched. An
+// error returned by a hook at this point fails the test run
+const LifecycleHookPostSeed LifecycleHookPoint = "post-seed"
+
+// LifecycleHookPostRun is fired when the execution of the test run has ended,
+// regardless of its outcome. Errors returned by hooks at this point are only
+// logged
+const LifecycleHookPostRun LifecycleHookPoint = "post-run"
+
+// LifecycleHook is the interface for integrating site-specific logic into the
+// lifecycle of test runs, such as ticket creation, approvals or syncing data
+// to other systems. Hooks are called synchronously and in order of
+// registration
+type LifecycleHook interface {
+	// Name returns a descriptive name for the hook, used in the test run log
+	Name() string
+	// Run is called at each lifecycle point for the test run
+	Run(point LifecycleHookPoint, tr *common.TestRun) error
+}
+
+// RegisterLifecycleHook adds a hook that is fired at the lifecycle points of
+// every test run
+func (t *TestRunManager) RegisterLifecycleHook(h LifecycleHook) {
+	t.lifecycleHooksLock.Lock()
+	defer t.lifecycleHooksLock.Unlock()
+	t.lifecycleHooks = append(t.lifecycleHooks, h)
+}
+
+// runLifecycleHooks fires all registered hooks for the given lifecycle point
+// and returns the first error encountered. All hooks are fired, even if an
+// earlier one returned an error
+func (t *TestRunManager) runLifecycleHooks(
+	point LifecycleHookPoint,
+	tr *common.TestRun,
+) error {
+	t.lifecycleHooksLock.Lock()
+	hooks := make([]LifecycleHook, len(t.lifecycleHooks))
+	copy(hooks, t.lifecycleHooks)
+	t.lifecycleHooksLock.Unlock()
+
+	var firstErr error
+	for _, h := range hooks {
+		err := h.Run(point, tr)
+		if err != nil {
+			t.WriteLog(tr, "Hook %s failed at %s: %v", h.Name(), point, err)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("Hook %s failed: %v", h.Name(), err)
+			}
+		}
+	}
+	return firstErr
+}
+
+// lifecycleHookPayload is the JSON document passed to external hooks
+type lifecycleHookPayload struct {
+	Point   LifecycleHookPoint `json:"point"`
+	TestRun *common.TestRun    `json:"testRun"`
+}
+
+// lifecycleHookTimeout returns the maximum time an external hook is allowed to
+// take, configured by LIFECYCLE_HOOK_TIMEOUT_SECONDS (default one minute)
+func lifecycleHookTimeout() time.Duration {
+	secs, err := strconv.Atoi(os.Getenv("LIFECYCLE_HOOK_TIMEOUT_SECONDS"))
+	if err != nil || secs <= 0 {
+		return time.Minute
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// WebhookLifecycleHook is a LifecycleHook that POSTs the lifecycle point and
+// the test run as JSON to a URL. A response status other than 2xx is treated
+// as an error
+type WebhookLifecycleHook struct {
+	URL string
+}
+
+// Name implements LifecycleHook
+func (w *WebhookLifecycleHook) Name() string {
+	return fmt.Sprintf("webhook %s", w.URL)
+}
+
+// Run implements LifecycleHook
+func (w *WebhookLifecycleHook) Run(
+	point LifecycleHookPoint,
+	tr *common.TestRun,
+) error {
+	b, err := json.Marshal(lifecycleHookPayload{Point: point, TestRun: tr})
+	if err != nil {
+		return err
+	}
+	clt := &http.Client{Timeout: lifecycleHookTimeout()}
+	resp, err := clt.Post(w.URL, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// ExecLifecycleHook is a LifecycleHook that executes a shell command. The
+// lifecycle point and test run ID are passed in the HOOK_POINT and TESTRUN_ID
+// environment variables, and the JSON payload is written to the command's
+// standard input. A non-zero exit code is treated as an error
+type ExecLifecycleHook struct {
+	Command string
+}
+
+// Name implements LifecycleHook
+func (e *ExecLifecycleHook) Name() string {
+	return fmt.Sprintf("exec %s", e.Command)
+}
+
+// Run implements LifecycleHook
+func (e *ExecLifecycleHook) Run(
+	point LifecycleHookPoint,
+	tr *common.TestRun,
+) error {
+	b, err := json.Marshal(lifecycleHookPayload{Point: point, TestRun: tr})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(
+		context.Background(),
+		lifecycleHookTimeout(),
+	)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", e.Command)
+	cmd.Env = append(
+		os.Environ(),
+		fmt.Sprintf("HOOK_POINT=%s", point),
+		fmt.Sprintf("TESTRUN_ID=%s", tr.ID),
+	)
+	cmd.Stdin = bytes.NewReader(b)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// registerLifecycleHooksFromEnv registers the external hooks configured in the
+// LIFECYCLE_WEBHOOKS (comma separated URLs) and LIFECYCLE_EXEC_HOOKS
+// (semicolon separated shell commands) environment variables
+func (t *TestRunManager) registerLifecycleHooksFromEnv() {
+	for _, u := range strings.Split(os.Getenv("LIFECYCLE_WEBHOOKS"), ",") {
+		u = strings.TrimSpace(u)
+		if u != "" {
+			logging.Infof("Registering lifecycle webhook %s", u)
+			t.RegisterLifecycleHook(&WebhookLifecycleHook{URL: u})
+		}
+	}
+	for _, c := range strings.Split(os.Getenv("LIFECYCLE_EXEC_HOOKS"), ";") {
+		c = strings.TrimSpace(c)
+		if c != "" {
+			logging.Infof("Registering lifecycle exec hook %s", c)
+			t.RegisterLifecycleHook(&ExecLifecycleHook{Command: c})
+		}
+	}
+}
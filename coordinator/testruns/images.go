@@ -0,0 +1,110 @@
+package testruns
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/coordinator/sources"
+)
+
+// validateBinariesImage checks that test runs that run their roles from a
+// binaries image can have the image built
+func (t *TestRunManager) validateBinariesImage(tr *common.TestRun) []error {
+	ret := []error{}
+	if !tr.RunFromBinariesImage {
+		return ret
+	}
+	if !sources.BinariesImagesEnabled() {
+		ret = append(ret, errors.New(
+			"Running from a binaries image requires BINARIES_IMAGE_REPOSITORY"+
+				" to be configured",
+		))
+	}
+	// Copies of test runs that ran from a binaries image carry its reference
+	// over, which is replaced once the image is prepared
+	if tr.ContainerImage != "" && !sources.IsBinariesImage(tr.ContainerImage) {
+		ret = append(ret, errors.New(
+			"A container image cannot be selected when running from a "+
+				"binaries image",
+		))
+	}
+	return ret
+}
+
+// PrepareBinariesImage builds and pushes the image with the test run's
+// binaries, if the test run runs its roles from it, and selects it as the
+// container image the roles run in. The binaries have to be compiled or
+// uploaded to binariesInS3 already
+func (t *TestRunManager) PrepareBinariesImage(
+	tr *common.TestRun,
+	archs []string,
+	binariesInS3 map[string]string,
+) error {
+	if !tr.RunFromBinariesImage {
+		return nil
+	}
+	// A test run runs all its roles in the same image
+	if len(archs) != 1 {
+		return fmt.Errorf(
+			"Running from a binaries image requires all agents to have the "+
+				"same architecture, found %v",
+			archs,
+		)
+	}
+	arch := archs[0]
+	debug := tr.RunPerf || tr.Debug
+	ref, ok := t.src.BinariesImage(tr.CommitHash, debug, arch, tr.BuildConfig)
+	if !ok {
+		path, err := sources.BinariesArchivePath(
+			tr.CommitHash,
+			debug,
+			arch,
+			tr.BuildConfig,
+		)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			err = t.awsm.DownloadFromS3(common.S3Download{
+				SourceRegion: os.Getenv("AWS_REGION"),
+				SourceBucket: os.Getenv("BINARIES_S3_BUCKET"),
+				SourcePath:   binariesInS3[arch],
+				TargetPath:   path,
+			})
+			if err != nil {
+				return fmt.Errorf("Unable to download binaries archive: %v", err)
+			}
+		}
+		t.UpdateStatus(
+			tr,
+			common.TestRunStatusRunning,
+			"Building binaries image",
+		)
+		ref, err = t.src.BuildBinariesImage(
+			tr.CommitHash,
+			debug,
+			arch,
+			tr.BuildConfig,
+		)
+		if err != nil {
+			return fmt.Errorf("Building binaries image failed: %v", err)
+		}
+	}
+	t.WriteLog(tr, "Running roles from binaries image %s", ref)
+	tr.ContainerImage = ref
+	t.PersistTestRun(tr)
+	return nil
+}
+
+// imageBinary returns the path of the binary inside the binaries image, if
+// the test run runs from it. Binaries of components are deployed into the
+// environment directory, so their paths are left as-is
+func imageBinary(tr *common.TestRun, bin string) string {
+	if !tr.RunFromBinariesImage || isComponentBinary(tr, bin) {
+		return bin
+	}
+	return filepath.Join(sources.BinariesImageDir, bin)
+}
@@ -0,0 +1,72 @@
+package testruns
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/coordinator/sources"
+)
+
+// binariesChecksums returns the SHA-256 manifest of the binaries archive for
+// the test run and architecture, which the agents verify the archive against
+// before extracting it. If the archive is present locally, it is verified
+// against the manifest first. Otherwise the manifest uploaded along with the
+// archive is downloaded from S3. Returns nil for archives that were uploaded
+// before manifests were introduced, unless binaries are signed
+func (t *TestRunManager) binariesChecksums(
+	tr *common.TestRun,
+	arch string,
+	binariesInS3 string,
+) (*common.ArchiveChecksums, error) {
+	debug := tr.RunPerf || tr.Debug
+	path, err := sources.BinariesArchivePath(
+		tr.CommitHash,
+		debug,
+		arch,
+		tr.BuildConfig,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(path); err == nil {
+		return t.src.VerifyBinaries(tr.CommitHash, debug, arch, tr.BuildConfig)
+	}
+
+	checksumsInS3 := common.ChecksumsPath(binariesInS3)
+	exist, err := t.awsm.FileExistsOnS3(
+		os.Getenv("AWS_REGION"),
+		os.Getenv("BINARIES_S3_BUCKET"),
+		checksumsInS3,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if !exist {
+		if t.src.SigningPublicKey() != nil {
+			// Agents with the signing key refuse archives without a signed
+			// checksum, so don't deploy it unverified
+			return nil, fmt.Errorf(
+				"%s has no checksums, but binaries must be signed",
+				binariesInS3,
+			)
+		}
+		t.WriteLog(
+			tr,
+			"Warning: %s has no checksums, deploying it unverified",
+			binariesInS3,
+		)
+		return nil, nil
+	}
+	err = t.awsm.DownloadFromS3(common.S3Download{
+		SourceRegion: os.Getenv("AWS_REGION"),
+		SourceBucket: os.Getenv("BINARIES_S3_BUCKET"),
+		SourcePath:   checksumsInS3,
+		TargetPath:   common.ChecksumsPath(path),
+		Retries:      10,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return common.ReadArchiveChecksums(path)
+}
@@ -0,0 +1,166 @@
+package testruns
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+)
+
+// labelFormat matches the labels users can put on test runs: either a plain
+// tag such as "baseline" or a key and value such as "owner:alice"
+var labelFormat = regexp.MustCompile(`^[A-Za-z0-9._/-]+(:[A-Za-z0-9._/-]+)?$`)
+
+// maxLabelLength is the maximum length of a single label
+const maxLabelLength = 128
+
+// systemTags are the tags the coordinator puts on the test runs it schedules
+// itself, which cannot be removed by users since they drive the pipelines
+var systemTags = []string{
+	common.TestRunTagNightly,
+	common.TestRunTagRecurring,
+	common.TestRunTagMergeQueue,
+	TestRunTagWeeklyReport,
+}
+
+// isSystemTag returns true if the label is one of the systemTags
+func isSystemTag(label string) bool {
+	for _, s := range systemTags {
+		if label == s {
+			return true
+		}
+	}
+	return false
+}
+
+// StripSystemTags removes the systemTags from a test run submitted by a user,
+// such that users can't make their test runs look like (and be handled as)
+// the ones the coordinator scheduled itself
+func StripSystemTags(tr *common.TestRun) {
+	tags := []string{}
+	for _, l := range tr.Tags {
+		if !isSystemTag(l) {
+			tags = append(tags, l)
+		}
+	}
+	tr.Tags = tags
+}
+
+// validateLabels checks the format of the labels of a test run
+func validateLabels(labels []string) []error {
+	ret := []error{}
+	for _, l := range labels {
+		if len(l) > maxLabelLength {
+			ret = append(ret, fmt.Errorf(
+				"Label %.20q... is longer than %d characters",
+				l,
+				maxLabelLength,
+			))
+		} else if !labelFormat.MatchString(l) {
+			ret = append(ret, fmt.Errorf(
+				"Label %q should be of the form tag or key:value",
+				l,
+			))
+		}
+	}
+	return ret
+}
+
+// SetTestRunLabels replaces the labels of a test run. The tags the
+// coordinator put on the test run are kept, and users can't add them
+func (t *TestRunManager) SetTestRunLabels(
+	testRunID string,
+	labels []string,
+) (*common.TestRun, error) {
+	if errs := validateLabels(labels); len(errs) > 0 {
+		return nil, errs[0]
+	}
+	for _, l := range labels {
+		if isSystemTag(l) {
+			return nil, fmt.Errorf("Label %q is reserved", l)
+		}
+	}
+	tr, ok := t.GetTestRun(testRunID)
+	if !ok {
+		return nil, fmt.Errorf("Unknown test run %s", testRunID)
+	}
+	t.testRunsLock.Lock()
+	tags := []string{}
+	for _, s := range systemTags {
+		if hasTag(tr, s) {
+			tags = append(tags, s)
+		}
+	}
+	for _, l := range labels {
+		tags = appendUnique(tags, l)
+	}
+	tr.Tags = tags
+	t.testRunsLock.Unlock()
+	t.PersistTestRun(tr)
+	return tr, nil
+}
+
+// labelTerm is a single term of a label expression, matching test runs with a
+// label matching any of its patterns, or none of them if negated
+type labelTerm struct {
+	negate   bool
+	patterns []string
+}
+
+// LabelExpression selects test runs by their labels. See
+// ParseLabelExpression for its syntax
+type LabelExpression struct {
+	terms []labelTerm
+}
+
+// ParseLabelExpression parses a label expression. Expressions consist of
+// whitespace-separated terms that must all match. A term matches test runs
+// with a label matching any of its |-separated glob patterns, such as
+// "experiment:*" or "owner:alice|owner:bob", and is negated by prefixing it
+// with !. The empty expression matches all test runs
+func ParseLabelExpression(expr string) (*LabelExpression, error) {
+	ret := &LabelExpression{terms: []labelTerm{}}
+	for _, f := range strings.Fields(expr) {
+		term := labelTerm{}
+		if strings.HasPrefix(f, "!") {
+			term.negate = true
+			f = f[1:]
+		}
+		for _, p := range strings.Split(f, "|") {
+			if p == "" {
+				return nil, fmt.Errorf("Empty label pattern in %q", f)
+			}
+			if _, err := path.Match(p, ""); err != nil {
+				return nil, fmt.Errorf("Invalid label pattern %q", p)
+			}
+			term.patterns = append(term.patterns, p)
+		}
+		ret.terms = append(ret.terms, term)
+	}
+	return ret, nil
+}
+
+// Matches returns true if the labels satisfy the expression
+func (e *LabelExpression) Matches(labels []string) bool {
+	for _, term := range e.terms {
+		if term.matches(labels) == term.negate {
+			return false
+		}
+	}
+	return true
+}
+
+// matches returns true if any of the labels matches any of the patterns of
+// the term, regardless of its negation
+func (lt labelTerm) matches(labels []string) bool {
+	for _, l := range labels {
+		for _, p := range lt.patterns {
+			if ok, _ := path.Match(p, l); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,37 @@
+package testruns
+
+import (
+	"fmt"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+)
+
+// maxIOWeight is the highest IO weight of a cgroup
+const maxIOWeight = 10000
+
+// validateRoleLimits checks that the resource limits of the roles are not
+// negative, and that their IO weight is in the range cgroups accept
+func validateRoleLimits(roles []*common.TestRunRole) []error {
+	ret := []error{}
+	for _, r := range roles {
+		if r.Limits == nil {
+			continue
+		}
+		if r.Limits.CPUs < 0 || r.Limits.MemoryMiB < 0 {
+			ret = append(ret, fmt.Errorf(
+				"%s %d: resource limits cannot be negative",
+				r.Role,
+				r.Index,
+			))
+		}
+		if r.Limits.IOWeight < 0 || r.Limits.IOWeight > maxIOWeight {
+			ret = append(ret, fmt.Errorf(
+				"%s %d: the IO weight must be between 1 and %d",
+				r.Role,
+				r.Index,
+				maxIOWeight,
+			))
+		}
+	}
+	return ret
+}
@@ -0,0 +1,379 @@
+package testruns
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// lintExpr is a compiled lint rule expression. The expression language is a
+// small subset of CEL: it supports number, string and boolean literals,
+// variables, parentheses, the arithmetic operators + - * / %, the comparison
+// operators == != < <= > >= and the logical operators && || !. Variable names
+// can contain hyphens, like the names of roles do, so subtracting a variable
+// needs spaces around the minus (agents - 1)
+type lintExpr interface {
+	eval(vars map[string]interface{}) (interface{}, error)
+}
+
+// compileLintExpr parses the given expression into a lintExpr that can be
+// evaluated against the variables of a test run
+func compileLintExpr(src string) (lintExpr, error) {
+	tokens, err := tokenizeLintExpr(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &lintExprParser{tokens: tokens}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("Unexpected token %s", p.tokens[p.pos].text)
+	}
+	return expr, nil
+}
+
+type lintTokenKind int
+
+const (
+	lintTokenNumber lintTokenKind = iota
+	lintTokenString
+	lintTokenIdent
+	lintTokenOperator
+)
+
+type lintToken struct {
+	kind lintTokenKind
+	text string
+}
+
+// lintOperators are the operators of the expression language, longest first
+// such that the tokenizer prefers "<=" over "<"
+var lintOperators = []string{
+	"&&", "||", "==", "!=", "<=", ">=",
+	"<", ">", "!", "+", "-", "*", "/", "%", "(", ")",
+}
+
+func tokenizeLintExpr(src string) ([]lintToken, error) {
+	tokens := []lintToken{}
+	i := 0
+	for i < len(src) {
+		c := rune(src[i])
+		if unicode.IsSpace(c) {
+			i++
+			continue
+		}
+
+		if unicode.IsDigit(c) || c == '.' {
+			start := i
+			for i < len(src) && (unicode.IsDigit(rune(src[i])) || src[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, lintToken{lintTokenNumber, src[start:i]})
+			continue
+		}
+
+		if unicode.IsLetter(c) || c == '_' {
+			start := i
+			for i < len(src) && (isLintIdentChar(src[i]) ||
+				src[i] == '.' ||
+				(src[i] == '-' && i+1 < len(src) && isLintIdentChar(src[i+1]))) {
+				i++
+			}
+			tokens = append(tokens, lintToken{lintTokenIdent, src[start:i]})
+			continue
+		}
+
+		if c == '"' || c == '\'' {
+			end := strings.IndexRune(src[i+1:], c)
+			if end < 0 {
+				return nil, fmt.Errorf("Unterminated string at position %d", i)
+			}
+			tokens = append(
+				tokens,
+				lintToken{lintTokenString, src[i+1 : i+1+end]},
+			)
+			i += end + 2
+			continue
+		}
+
+		matched := false
+		for _, op := range lintOperators {
+			if strings.HasPrefix(src[i:], op) {
+				tokens = append(tokens, lintToken{lintTokenOperator, op})
+				i += len(op)
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return nil, fmt.Errorf("Unexpected character %c at position %d", c, i)
+		}
+	}
+	return tokens, nil
+}
+
+// isLintIdentChar returns true if the character can be part of a variable name
+// on its own
+func isLintIdentChar(c byte) bool {
+	return unicode.IsLetter(rune(c)) || unicode.IsDigit(rune(c)) || c == '_'
+}
+
+type lintExprParser struct {
+	tokens []lintToken
+	pos    int
+}
+
+// accept consumes the next token if it is one of the given operators and
+// returns the operator, or an empty string if it is not
+func (p *lintExprParser) accept(ops ...string) string {
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != lintTokenOperator {
+		return ""
+	}
+	for _, op := range ops {
+		if p.tokens[p.pos].text == op {
+			p.pos++
+			return op
+		}
+	}
+	return ""
+}
+
+func (p *lintExprParser) parseBinary(
+	next func() (lintExpr, error),
+	ops ...string,
+) (lintExpr, error) {
+	left, err := next()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.accept(ops...)
+		if op == "" {
+			return left, nil
+		}
+		right, err := next()
+		if err != nil {
+			return nil, err
+		}
+		left = &lintBinaryExpr{op: op, left: left, right: right}
+	}
+}
+
+func (p *lintExprParser) parseOr() (lintExpr, error) {
+	return p.parseBinary(p.parseAnd, "||")
+}
+
+func (p *lintExprParser) parseAnd() (lintExpr, error) {
+	return p.parseBinary(p.parseComparison, "&&")
+}
+
+func (p *lintExprParser) parseComparison() (lintExpr, error) {
+	return p.parseBinary(p.parseSum, "==", "!=", "<=", ">=", "<", ">")
+}
+
+func (p *lintExprParser) parseSum() (lintExpr, error) {
+	return p.parseBinary(p.parseProduct, "+", "-")
+}
+
+func (p *lintExprParser) parseProduct() (lintExpr, error) {
+	return p.parseBinary(p.parseUnary, "*", "/", "%")
+}
+
+func (p *lintExprParser) parseUnary() (lintExpr, error) {
+	if op := p.accept("!", "-"); op != "" {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &lintUnaryExpr{op: op, operand: operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *lintExprParser) parsePrimary() (lintExpr, error) {
+	if p.accept("(") != "" {
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.accept(")") == "" {
+			return nil, fmt.Errorf("Missing closing parenthesis")
+		}
+		return expr, nil
+	}
+
+	if p.pos >= len(p.tokens) {
+		return nil, fmt.Errorf("Unexpected end of expression")
+	}
+	tok := p.tokens[p.pos]
+	p.pos++
+	switch tok.kind {
+	case lintTokenNumber:
+		f, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid number %s", tok.text)
+		}
+		return &lintLiteralExpr{value: f}, nil
+	case lintTokenString:
+		return &lintLiteralExpr{value: tok.text}, nil
+	case lintTokenIdent:
+		switch tok.text {
+		case "true":
+			return &lintLiteralExpr{value: true}, nil
+		case "false":
+			return &lintLiteralExpr{value: false}, nil
+		}
+		return &lintVariableExpr{name: tok.text}, nil
+	}
+	return nil, fmt.Errorf("Unexpected token %s", tok.text)
+}
+
+type lintLiteralExpr struct {
+	value interface{}
+}
+
+func (e *lintLiteralExpr) eval(_ map[string]interface{}) (interface{}, error) {
+	return e.value, nil
+}
+
+type lintVariableExpr struct {
+	name string
+}
+
+func (e *lintVariableExpr) eval(
+	vars map[string]interface{},
+) (interface{}, error) {
+	v, ok := vars[e.name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown variable %s", e.name)
+	}
+	return v, nil
+}
+
+type lintUnaryExpr struct {
+	op      string
+	operand lintExpr
+}
+
+func (e *lintUnaryExpr) eval(vars map[string]interface{}) (interface{}, error) {
+	v, err := e.operand.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	switch e.op {
+	case "!":
+		b, ok := v.(bool)
+		if !ok {
+			return nil, fmt.Errorf("Operator ! requires a boolean")
+		}
+		return !b, nil
+	case "-":
+		f, ok := v.(float64)
+		if !ok {
+			return nil, fmt.Errorf("Operator - requires a number")
+		}
+		return -f, nil
+	}
+	return nil, fmt.Errorf("Unknown operator %s", e.op)
+}
+
+type lintBinaryExpr struct {
+	op    string
+	left  lintExpr
+	right lintExpr
+}
+
+func (e *lintBinaryExpr) eval(vars map[string]interface{}) (interface{}, error) {
+	l, err := e.left.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+
+	// Short-circuit the logical operators
+	if e.op == "&&" || e.op == "||" {
+		lb, ok := l.(bool)
+		if !ok {
+			return nil, fmt.Errorf("Operator %s requires booleans", e.op)
+		}
+		if (e.op == "&&" && !lb) || (e.op == "||" && lb) {
+			return lb, nil
+		}
+		r, err := e.right.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		rb, ok := r.(bool)
+		if !ok {
+			return nil, fmt.Errorf("Operator %s requires booleans", e.op)
+		}
+		return rb, nil
+	}
+
+	r, err := e.right.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+
+	switch e.op {
+	case "==":
+		return l == r, nil
+	case "!=":
+		return l != r, nil
+	}
+
+	if ls, ok := l.(string); ok {
+		rs, ok := r.(string)
+		if !ok {
+			return nil, fmt.Errorf("Cannot compare string with %T", r)
+		}
+		switch e.op {
+		case "+":
+			return ls + rs, nil
+		case "<":
+			return ls < rs, nil
+		case "<=":
+			return ls <= rs, nil
+		case ">":
+			return ls > rs, nil
+		case ">=":
+			return ls >= rs, nil
+		}
+		return nil, fmt.Errorf("Operator %s is not supported on strings", e.op)
+	}
+
+	lf, lok := l.(float64)
+	rf, rok := r.(float64)
+	if !lok || !rok {
+		return nil, fmt.Errorf("Operator %s requires numbers", e.op)
+	}
+	switch e.op {
+	case "+":
+		return lf + rf, nil
+	case "-":
+		return lf - rf, nil
+	case "*":
+		return lf * rf, nil
+	case "/":
+		if rf == 0 {
+			return nil, fmt.Errorf("Division by zero")
+		}
+		return lf / rf, nil
+	case "%":
+		if int64(rf) == 0 {
+			return nil, fmt.Errorf("Division by zero")
+		}
+		return float64(int64(lf) % int64(rf)), nil
+	case "<":
+		return lf < rf, nil
+	case "<=":
+		return lf <= rf, nil
+	case ">":
+		return lf > rf, nil
+	case ">=":
+		return lf >= rf, nil
+	}
+	return nil, fmt.Errorf("Unknown operator %s", e.op)
+}
@@ -0,0 +1,238 @@
+package testruns
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// LintRuleAction determines what happens to a submitted test run that matches
+// a lint rule
+type LintRuleAction string
+
+// LintRuleActionReject refuses to schedule the test run
+const LintRuleActionReject LintRuleAction = "reject"
+
+// LintRuleActionRequireApproval schedules the test run, but holds it in the
+// queue until it is approved by a different user than the one that submitted
+// it
+const LintRuleActionRequireApproval LintRuleAction = "requireApproval"
+
+// LintRuleActionWarn schedules the test run and returns the rule's message to
+// the user that submitted it
+const LintRuleActionWarn LintRuleAction = "warn"
+
+// LintRule is a custom validation rule applied to every submitted test run
+// configuration. The Expression is evaluated against the test run's
+// parameters (by their JSON name, for instance `sampleCount` or `runPerf`) and
+// a few derived variables: `agents` (the total number of agents in the run),
+// `sweepRuns` (the number of runs in the submission) and `roles.<role>` (the
+// number of agents for a particular role). When the expression evaluates to
+// true, the rule's action is applied. For example, `sampleCount > 7200` with
+// action requireApproval requires approval for runs over two hours
+type LintRule struct {
+	ID         string         `json:"id"`
+	Name       string         `json:"name"`
+	Expression string         `json:"expression"`
+	Message    string         `json:"message"`
+	Action     LintRuleAction `json:"action"`
+	Enabled    bool           `json:"enabled"`
+}
+
+// LintViolation describes a lint rule that matched a submitted test run
+type LintViolation struct {
+	RuleID  string         `json:"ruleID"`
+	Name    string         `json:"name"`
+	Message string         `json:"message"`
+	Action  LintRuleAction `json:"action"`
+}
+
+// LintRules returns the configured lint rules
+func (t *TestRunManager) LintRules() []LintRule {
+	rules := t.Config().LintRules
+	if rules == nil {
+		return []LintRule{}
+	}
+	return rules
+}
+
+// SetLintRules validates the given lint rules, assigns IDs to new rules and
+// persists them in the config
+func (t *TestRunManager) SetLintRules(rules []LintRule) error {
+	for i := range rules {
+		err := validateLintRule(rules[i])
+		if err != nil {
+			return fmt.Errorf("Rule %s is invalid: %v", rules[i].Name, err)
+		}
+		if rules[i].ID == "" {
+			rules[i].ID, err = common.RandomID(12)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	t.configLock.Lock()
+	t.config.LintRules = rules
+	t.configLock.Unlock()
+	return t.PersistConfig()
+}
+
+// validateLintRule checks the rule's action and compiles its expression. The
+// expression is evaluated once against an empty test run, to catch references
+// to unknown variables and expressions that do not evaluate to a boolean
+func validateLintRule(rule LintRule) error {
+	switch rule.Action {
+	case LintRuleActionReject,
+		LintRuleActionRequireApproval,
+		LintRuleActionWarn:
+	default:
+		return fmt.Errorf("Unknown action %s", rule.Action)
+	}
+	expr, err := compileLintExpr(rule.Expression)
+	if err != nil {
+		return err
+	}
+	v, err := expr.eval(lintVariables(&common.TestRun{}, 1))
+	if err != nil {
+		return err
+	}
+	if _, ok := v.(bool); !ok {
+		return fmt.Errorf("Expression does not evaluate to a boolean")
+	}
+	return nil
+}
+
+// lintVariables returns the variables a lint rule expression can refer to for
+// the given test run. Numeric parameters are exposed as float64
+func lintVariables(tr *common.TestRun, sweepRuns int) map[string]interface{} {
+	vars := map[string]interface{}{}
+	v := reflect.ValueOf(tr).Elem()
+	typ := v.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		f := v.Field(i)
+		switch f.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+			reflect.Int64:
+			vars[name] = float64(f.Int())
+		case reflect.Float32, reflect.Float64:
+			vars[name] = f.Float()
+		case reflect.Bool:
+			vars[name] = f.Bool()
+		case reflect.String:
+			vars[name] = f.String()
+		}
+	}
+
+	vars["agents"] = float64(len(tr.Roles))
+	vars["sweepRuns"] = float64(sweepRuns)
+	for role := range roleBinaries {
+		vars[fmt.Sprintf("roles.%s", role)] = float64(0)
+	}
+	for _, r := range tr.Roles {
+		key := fmt.Sprintf("roles.%s", r.Role)
+		vars[key] = vars[key].(float64) + 1
+	}
+	return vars
+}
+
+// LintTestRuns applies the enabled lint rules to the given runs, which are the
+// (sweep expanded) runs of a single submission. Each matching rule is reported
+// once, even if it matches multiple runs. Rules that fail to evaluate are
+// logged and otherwise ignored. Besides the configured rules, a warning is
+// reported when debug logging is enabled
+func (t *TestRunManager) LintTestRuns(runs []*common.TestRun) []LintViolation {
+	violations := []LintViolation{}
+	for _, rule := range t.LintRules() {
+		if !rule.Enabled {
+			continue
+		}
+		expr, err := compileLintExpr(rule.Expression)
+		if err != nil {
+			logging.Warnf("Unable to compile lint rule %s: %v", rule.ID, err)
+			continue
+		}
+		for _, tr := range runs {
+			v, err := expr.eval(lintVariables(tr, len(runs)))
+			if err != nil {
+				logging.Warnf("Unable to evaluate lint rule %s: %v", rule.ID, err)
+				break
+			}
+			if match, ok := v.(bool); ok && match {
+				violations = append(violations, LintViolation{
+					RuleID:  rule.ID,
+					Name:    rule.Name,
+					Message: rule.Message,
+					Action:  rule.Action,
+				})
+				break
+			}
+		}
+	}
+	if v := t.verboseLoggingViolation(runs); v != nil {
+		violations = append(violations, *v)
+	}
+	return violations
+}
+
+// scheduleLintedRuns schedules test runs the coordinator creates itself, such
+// as those of scheduled jobs and the later runs of sweeps. They are subject to
+// the same lint rules as submissions from the frontend, so runs matching a rule
+// that requires approval are held until they are approved again
+func (t *TestRunManager) scheduleLintedRuns(runs []*common.TestRun) error {
+	requireApproval := false
+	for _, v := range t.LintTestRuns(runs) {
+		if v.Action == LintRuleActionReject {
+			return fmt.Errorf("Rejected by lint rule %s: %s", v.Name, v.Message)
+		}
+		if v.Action == LintRuleActionRequireApproval {
+			requireApproval = true
+		}
+	}
+	for _, tr := range runs {
+		tr.AwaitingApproval = requireApproval
+		if requireApproval {
+			tr.ApprovedByThumbprint = ""
+		}
+		t.ScheduleTestRun(tr)
+	}
+	return nil
+}
+
+// ApproveTestRun releases a test run that is held in the queue because it
+// matched a lint rule requiring approval. Other runs of the same sweep that
+// are awaiting approval are released as well. The approver cannot be the user
+// that submitted the test run
+func (t *TestRunManager) ApproveTestRun(
+	tr *common.TestRun,
+	approverThumbprint string,
+) error {
+	if !tr.AwaitingApproval {
+		return fmt.Errorf("Test run is not awaiting approval")
+	}
+	if tr.CreatedByThumbprint == approverThumbprint {
+		return fmt.Errorf("Test run cannot be approved by its submitter")
+	}
+
+	runs := []*common.TestRun{tr}
+	if tr.SweepID != "" {
+		for _, r := range t.GetTestRuns() {
+			if r != tr && r.SweepID == tr.SweepID && r.AwaitingApproval {
+				runs = append(runs, r)
+			}
+		}
+	}
+	for _, r := range runs {
+		r.AwaitingApproval = false
+		r.ApprovedByThumbprint = approverThumbprint
+		t.UpdateStatus(r, r.Status, "Approved")
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package testruns
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/coordinator"
+	"github.com/mit-dci/opencbdc-tctl/wire"
+)
+
+// liveMetricsInterval is the interval at which the load generators of a
+// running test run are sampled
+const liveMetricsInterval = 5 * time.Second
+
+// liveMetricsHistory is the number of seconds of live metrics kept for a test
+// run, such that users opening a running test run see its recent history
+const liveMetricsHistory = 3600
+
+// liveSampleSource is the sample file of a load generator that is read while
+// the test run executes
+type liveSampleSource struct {
+	role    *common.TestRunRole
+	path    string
+	offset  int64
+	failing bool
+}
+
+// liveMetrics holds the samples of the load generators of a running test run,
+// aggregated per second
+type liveMetrics struct {
+	lock    sync.Mutex
+	buckets map[int64]*wire.SampleBucket
+}
+
+// add merges the buckets read from a load generator into the live metrics,
+// and marks the seconds they cover as updated
+func (lm *liveMetrics) add(buckets []wire.SampleBucket, updated map[int64]bool) {
+	lm.lock.Lock()
+	defer lm.lock.Unlock()
+	for _, b := range buckets {
+		if float64(b.Second)*1e9 <= minTxSampleTime {
+			continue
+		}
+		existing, ok := lm.buckets[b.Second]
+		if !ok {
+			existing = &wire.SampleBucket{Second: b.Second}
+			lm.buckets[b.Second] = existing
+		}
+		existing.Count += b.Count
+		existing.LatencySum += b.LatencySum
+		if b.LatencyMax > existing.LatencyMax {
+			existing.LatencyMax = b.LatencyMax
+		}
+		updated[b.Second] = true
+	}
+
+	// Drop the seconds that fell out of the history
+	newest := int64(0)
+	for sec := range lm.buckets {
+		if sec > newest {
+			newest = sec
+		}
+	}
+	for sec := range lm.buckets {
+		if sec <= newest-liveMetricsHistory {
+			delete(lm.buckets, sec)
+			delete(updated, sec)
+		}
+	}
+}
+
+// points returns the points for the given seconds, or all seconds if nil, in
+// chronological order
+func (lm *liveMetrics) points(seconds map[int64]bool) []coordinator.LiveMetricsPoint {
+	lm.lock.Lock()
+	defer lm.lock.Unlock()
+	ret := []coordinator.LiveMetricsPoint{}
+	for sec, b := range lm.buckets {
+		if seconds != nil && !seconds[sec] {
+			continue
+		}
+		p := coordinator.LiveMetricsPoint{
+			Time:       sec,
+			Throughput: float64(b.Count),
+			LatencyMax: b.LatencyMax,
+		}
+		if b.Count > 0 {
+			p.LatencyAvg = b.LatencySum / float64(b.Count)
+		}
+		ret = append(ret, p)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Time < ret[j].Time
+	})
+	return ret
+}
+
+// StreamLiveMetrics is run in a goroutine by RunBinaries to periodically read
+// the transaction samples the load generators wrote so far, and stream the
+// throughput and latency per second to the frontend. This allows users to
+// follow the test run and terminate it early if it's obviously broken. The
+// metrics of soak tests are checkpointed into the test run. When `cancel` is
+// closed, the streaming stops
+func (t *TestRunManager) StreamLiveMetrics(
+	tr *common.TestRun,
+	cancel chan bool,
+) {
+	sources := []*liveSampleSource{}
+	for _, r := range tr.Roles {
+		if t.isLoadGenRole(tr, r.Role) {
+			sources = append(sources, &liveSampleSource{
+				role: r,
+				path: fmt.Sprintf("tx_samples_%d.txt", r.Index),
+			})
+		}
+	}
+	if len(sources) == 0 {
+		return
+	}
+
+	lm := &liveMetrics{buckets: map[int64]*wire.SampleBucket{}}
+	t.liveMetrics.Store(tr.ID, lm)
+	defer t.liveMetrics.Delete(tr.ID)
+
+	// Soak tests checkpoint the metrics periodically
+	var checkpoint <-chan time.Time
+	if tr.Soak != nil {
+		ticker := time.NewTicker(
+			time.Duration(tr.Soak.CheckpointMinutes) * time.Minute,
+		)
+		defer ticker.Stop()
+		checkpoint = ticker.C
+	}
+
+	for {
+		select {
+		case <-cancel:
+			return
+		case <-checkpoint:
+			t.checkpointSoak(tr, lm)
+			continue
+		case <-time.After(liveMetricsInterval):
+		}
+
+		updated := map[int64]bool{}
+		for _, s := range sources {
+			buckets, offset, err := t.am.ReadLiveSamples(
+				s.role.AgentID,
+				tr.Environments[s.role.AgentID],
+				s.path,
+				s.offset,
+			)
+			if err != nil {
+				// Only log the first of consecutive failures
+				if !s.failing {
+					t.WriteLog(
+						tr,
+						"Unable to read live samples of %s %d: %v",
+						s.role.Role,
+						s.role.Index,
+						err,
+					)
+				}
+				s.failing = true
+				continue
+			}
+			s.failing = false
+			s.offset = offset
+			lm.add(buckets, updated)
+		}
+		if len(updated) == 0 {
+			continue
+		}
+		t.ev <- coordinator.Event{
+			Type: coordinator.EventTypeLiveMetrics,
+			Payload: coordinator.LiveMetricsPayload{
+				TestRunID: tr.ID,
+				Points:    lm.points(updated),
+			},
+		}
+	}
+}
+
+// LiveMetrics returns the live metrics of a test run that is generating load.
+// Returns false if the test run is not generating load
+func (t *TestRunManager) LiveMetrics(
+	tr *common.TestRun,
+) ([]coordinator.LiveMetricsPoint, bool) {
+	v, ok := t.liveMetrics.Load(tr.ID)
+	if !ok {
+		return nil, false
+	}
+	return v.(*liveMetrics).points(nil), true
+}
@@ -0,0 +1,390 @@
+package testruns
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+)
+
+// maxLoadProfilePoints is the maximum number of points a load profile can be
+// made up of. Sine profiles are sampled more coarsely to stay within it
+const maxLoadProfilePoints = 5000
+
+// loadProfileSineSamples is the number of points a period of a sine profile
+// is sampled at, unless that exceeds maxLoadProfilePoints
+const loadProfileSineSamples = 40
+
+// loadProfileRampStepTime is the step time, in seconds, the load generators
+// approximate a ramp with
+const loadProfileRampStepTime = 1.0
+
+// loadProfileSeriesID is the ID of the time series with the throughput the
+// load profile prescribed, which is overlaid on the throughput and latency
+// series
+const loadProfileSeriesID = "load-profile"
+
+// validateLoadProfile checks the load profile of a test run
+func (t *TestRunManager) validateLoadProfile(tr *common.TestRun) []error {
+	ret := []error{}
+	p := tr.LoadProfile
+	if p == nil {
+		return ret
+	}
+	if tr.LoadGenTPSTarget <= 0 {
+		ret = append(ret, errors.New(
+			"Load profile: the load generators need a target TPS to scale",
+		))
+	}
+	if p.StartPercent < 0 || p.StartPercent > 100 ||
+		p.EndPercent < 0 || p.EndPercent > 100 {
+		ret = append(ret, errors.New(
+			"Load profile: percentages should be between 0 and 100",
+		))
+	}
+	// The load generators can only increase their rate from the start, the
+	// profiles the agents throttle them to can go both ways
+	if !loadProfileThrottled(p) &&
+		(p.EndPercent <= 0 || p.StartPercent > p.EndPercent) {
+		ret = append(ret, errors.New(
+			"Load profile: the load should increase to a positive end percentage",
+		))
+	}
+	if loadProfileThrottled(p) && loadProfilePeak(p) <= 0 {
+		ret = append(ret, errors.New(
+			"Load profile: the load should be positive at its peak",
+		))
+	}
+	if p.PeriodSeconds <= 0 {
+		ret = append(ret, errors.New(
+			"Load profile: the period should be positive",
+		))
+	}
+	switch p.Kind {
+	case common.LoadProfileRamp, common.LoadProfileSine:
+	case common.LoadProfileStep:
+		if p.StepPercent <= 0 {
+			ret = append(ret, errors.New(
+				"Load profile: the step should be positive",
+			))
+		}
+	case common.LoadProfileBurst:
+		if p.BurstSeconds <= 0 || p.BurstSeconds >= p.PeriodSeconds {
+			ret = append(ret, errors.New(
+				"Load profile: bursts should be shorter than the period",
+			))
+		}
+	default:
+		ret = append(ret, fmt.Errorf(
+			"Load profile: unknown kind %s",
+			p.Kind,
+		))
+	}
+	if len(ret) > 0 {
+		return ret
+	}
+	offsets, _ := loadProfilePoints(p, t.loadDuration(tr))
+	if len(offsets) > maxLoadProfilePoints {
+		ret = append(ret, fmt.Errorf(
+			"Load profile: %d points exceed the maximum of %d, use a longer period",
+			len(offsets),
+			maxLoadProfilePoints,
+		))
+	}
+	return ret
+}
+
+// loadProfilePoints returns the points of a load profile lasting d, as the
+// percentages of the target TPS at the offsets from the start of the profile.
+// The percentage is interpolated linearly between the points, and two points
+// at the same offset form a step
+func loadProfilePoints(
+	p *common.LoadProfile,
+	d time.Duration,
+) ([]time.Duration, []float64) {
+	offsets := []time.Duration{}
+	percents := []float64{}
+	add := func(o time.Duration, pct float64) {
+		offsets = append(offsets, o)
+		percents = append(percents, pct)
+	}
+	period := time.Duration(p.PeriodSeconds * float64(time.Second))
+	switch p.Kind {
+	case common.LoadProfileRamp:
+		add(0, p.StartPercent)
+		if period < d {
+			add(period, p.EndPercent)
+			add(d, p.EndPercent)
+		} else {
+			pct := p.StartPercent +
+				(p.EndPercent-p.StartPercent)*float64(d)/float64(period)
+			add(d, pct)
+		}
+	case common.LoadProfileStep:
+		pct := p.StartPercent
+		add(0, pct)
+		for o := period; o < d && pct < p.EndPercent; o += period {
+			add(o, pct)
+			pct = math.Min(pct+p.StepPercent, p.EndPercent)
+			add(o, pct)
+			if len(offsets) > maxLoadProfilePoints {
+				break
+			}
+		}
+		add(d, pct)
+	case common.LoadProfileSine:
+		interval := period / loadProfileSineSamples
+		if min := d / maxLoadProfilePoints; interval < min {
+			interval = min
+		}
+		if interval <= 0 {
+			interval = time.Second
+		}
+		mid := (p.StartPercent + p.EndPercent) / 2
+		amp := (p.EndPercent - p.StartPercent) / 2
+		for o := time.Duration(0); o < d; o += interval {
+			add(o, mid+amp*math.Sin(2*math.Pi*float64(o)/float64(period)))
+		}
+		add(d, mid+amp*math.Sin(2*math.Pi*float64(d)/float64(period)))
+	case common.LoadProfileBurst:
+		burst := time.Duration(p.BurstSeconds * float64(time.Second))
+		add(0, p.StartPercent)
+		for o := period - burst; o < d; o += period {
+			add(o, p.StartPercent)
+			add(o, p.EndPercent)
+			if o+burst >= d {
+				break
+			}
+			add(o+burst, p.EndPercent)
+			add(o+burst, p.StartPercent)
+			if len(offsets) > maxLoadProfilePoints {
+				break
+			}
+		}
+		add(d, percents[len(percents)-1])
+	}
+	return offsets, percents
+}
+
+// loadProfileThrottled returns true if the load profile can't be generated
+// with the step parameters of the load generators, because the load goes
+// down as well as up. The agents throttle the load generators to these
+// profiles
+func loadProfileThrottled(p *common.LoadProfile) bool {
+	return p.Kind == common.LoadProfileSine || p.Kind == common.LoadProfileBurst
+}
+
+// loadProfilePeak returns the highest percentage of the target TPS the load
+// profile prescribes
+func loadProfilePeak(p *common.LoadProfile) float64 {
+	return math.Max(p.StartPercent, p.EndPercent)
+}
+
+// loadProfileStepParams returns the load generator parameters that generate
+// the load profile: the fraction of the target TPS to step up to, and the
+// step time, step percentage and step start as fractions of that. The load
+// generators of throttled profiles run at the peak of the profile at a fixed
+// rate
+func loadProfileStepParams(
+	p *common.LoadProfile,
+) (target, stepTime, stepPercent, stepStart float64) {
+	if loadProfileThrottled(p) {
+		return loadProfilePeak(p) / 100, 0, 0, 1
+	}
+	target = p.EndPercent / 100
+	stepStart = p.StartPercent / p.EndPercent
+	switch p.Kind {
+	case common.LoadProfileStep:
+		stepTime = p.PeriodSeconds
+		stepPercent = p.StepPercent / p.EndPercent
+	default:
+		stepTime = loadProfileRampStepTime
+		stepPercent = (1 - stepStart) * loadProfileRampStepTime /
+			p.PeriodSeconds
+	}
+	return target, stepTime, stepPercent, stepStart
+}
+
+// loadProfilePercent returns the percentage of the target TPS the points of
+// a load profile prescribe at the given offset from its start
+func loadProfilePercent(
+	offsets []time.Duration,
+	percents []float64,
+	elapsed time.Duration,
+) float64 {
+	if len(offsets) == 0 {
+		return 100
+	}
+	if elapsed < offsets[0] {
+		return percents[0]
+	}
+	for i := 1; i < len(offsets); i++ {
+		if elapsed >= offsets[i] {
+			continue
+		}
+		pos := float64(elapsed-offsets[i-1]) / float64(offsets[i]-offsets[i-1])
+		return percents[i-1] + pos*(percents[i]-percents[i-1])
+	}
+	return percents[len(percents)-1]
+}
+
+// loadProfileElapsed returns how far the load profile of the test run had
+// progressed at the given time. The profile does not progress while the test
+// run is paused
+func (t *TestRunManager) loadProfileElapsed(
+	tr *common.TestRun,
+	at time.Time,
+) time.Duration {
+	elapsed := at.Sub(tr.LoadProfileStarted)
+	t.pausesLock.Lock()
+	defer t.pausesLock.Unlock()
+	for _, p := range tr.Pauses {
+		end := p.Resumed
+		if end.IsZero() || end.After(at) {
+			end = at
+		}
+		if p.Paused.Before(end) {
+			elapsed -= end.Sub(p.Paused)
+		}
+	}
+	return elapsed
+}
+
+// startLoadProfile records when the load generators of the test run started
+// generating the load of its profile, from which the prescribed load is
+// plotted. The load generators of a soak test resumed after a coordinator
+// restart kept running, so their profile keeps its start. Throttled profiles
+// are pushed to the agents of the load generators, and continue where they
+// left off
+func (t *TestRunManager) startLoadProfile(
+	tr *common.TestRun,
+	cmds []runningCommand,
+) {
+	if tr.LoadProfile == nil {
+		return
+	}
+	if tr.LoadProfileStarted.IsZero() {
+		tr.LoadProfileStarted = time.Now()
+		t.WriteLog(
+			tr,
+			"Started %s load profile on the load generators",
+			tr.LoadProfile.Kind,
+		)
+		t.PersistTestRun(tr)
+	}
+	if !loadProfileThrottled(tr.LoadProfile) {
+		return
+	}
+
+	elapsed := t.loadProfileElapsed(tr, time.Now())
+	offsets, percents := loadProfilePoints(tr.LoadProfile, t.loadDuration(tr))
+	peak := loadProfilePeak(tr.LoadProfile)
+	offsetsMs := make([]int64, len(offsets))
+	fractions := make([]float64, len(percents))
+	for i := range offsets {
+		offsetsMs[i] = offsets[i].Milliseconds()
+		fractions[i] = percents[i] / peak
+	}
+
+	// The roles pausing leaves alone hold the state of the system, and are
+	// not throttled either
+	loadGens := map[common.SystemRole]bool{}
+	for _, r := range tr.Roles {
+		if t.pausableRole(tr, r.Role) {
+			loadGens[r.Role] = true
+		}
+	}
+	applied := 0
+	errs := []string{}
+	for role := range loadGens {
+		for _, c := range t.FilterCommandsByRole(tr, cmds, role) {
+			err := t.am.SetLoadProfile(
+				c.agentID,
+				c.commandID,
+				elapsed.Milliseconds(),
+				offsetsMs,
+				fractions,
+			)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf(
+					"command %x on agent %d: %v",
+					c.commandID,
+					c.agentID,
+					err,
+				))
+				continue
+			}
+			applied++
+		}
+	}
+	if len(errs) > 0 {
+		t.WriteLog(
+			tr,
+			"Unable to apply the load profile to some load generators: %s",
+			strings.Join(errs, "; "),
+		)
+	}
+	t.WriteLog(
+		tr,
+		"Throttling %d load generators to the %s load profile",
+		applied,
+		tr.LoadProfile.Kind,
+	)
+}
+
+// writeLoadProfileSeries writes the throughput the load profile of the test
+// run prescribed for every second of its load to the series directory, and
+// overlays it on the system throughput and the latency series
+func (t *TestRunManager) writeLoadProfileSeries(
+	tr *common.TestRun,
+	dir string,
+	idx *timeSeriesIndex,
+) error {
+	if tr.LoadProfile == nil || tr.LoadProfileStarted.IsZero() {
+		return nil
+	}
+	offsets, percents := loadProfilePoints(tr.LoadProfile, t.loadDuration(tr))
+	s, err := createTimeSeries(dir, TimeSeriesInfo{
+		ID:    loadProfileSeriesID,
+		Name:  fmt.Sprintf("Load profile (%s)", tr.LoadProfile.Kind),
+		XUnit: "unix time (s)",
+		YUnit: "tx/s",
+	}, true)
+	if err != nil {
+		return err
+	}
+	d := offsets[len(offsets)-1]
+	for at := tr.LoadProfileStarted; err == nil; at = at.Add(time.Second) {
+		elapsed := t.loadProfileElapsed(tr, at)
+		if elapsed > d {
+			break
+		}
+		pct := loadProfilePercent(offsets, percents, elapsed)
+		err = s.add(
+			float64(at.Unix()),
+			pct/100*float64(tr.LoadGenTPSTarget),
+		)
+	}
+	if err2 := s.close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return err
+	}
+	for i := range idx.Series {
+		id := idx.Series[i].ID
+		if id == "throughput" ||
+			(strings.HasPrefix(id, "latency-") &&
+				idx.Series[i].XUnit == "unix time (s)") {
+			idx.Series[i].Overlay = append(
+				idx.Series[i].Overlay,
+				loadProfileSeriesID,
+			)
+		}
+	}
+	idx.Series = append(idx.Series, s.info)
+	return nil
+}
@@ -0,0 +1,103 @@
+package testruns
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+)
+
+// logLevels are the log levels supported by the transaction processor, from
+// least to most verbose
+var logLevels = []string{"FATAL", "ERROR", "WARN", "INFO", "DEBUG", "TRACE"}
+
+// verboseLogLevels are the log levels that produce enough output to slow the
+// roles down noticeably
+var verboseLogLevels = map[string]bool{"DEBUG": true, "TRACE": true}
+
+// verboseLoggingRuleID is the ID of the built-in lint rule warning about debug
+// logging
+const verboseLoggingRuleID = "builtin-verbose-logging"
+
+// validateLogLevels returns an error for every role whose configured log
+// level is not supported by the transaction processor
+func (t *TestRunManager) validateLogLevels(tr *common.TestRun) []error {
+	errs := []error{}
+	invalid := map[string]bool{}
+	for _, r := range tr.Roles {
+		level := t.RoleLogLevel(tr, r)
+		valid := false
+		for _, l := range logLevels {
+			if l == level {
+				valid = true
+				break
+			}
+		}
+		if !valid && !invalid[level] {
+			invalid[level] = true
+			errs = append(errs, fmt.Errorf(
+				"Log level %s of role %s is invalid, must be one of %s",
+				level,
+				r.Role,
+				strings.Join(logLevels, ", "),
+			))
+		}
+	}
+	return errs
+}
+
+// verboseLoggingRoles returns the role types that are configured to log at
+// DEBUG or TRACE level
+func (t *TestRunManager) verboseLoggingRoles(tr *common.TestRun) []string {
+	roles := map[string]bool{}
+	for _, r := range tr.Roles {
+		if verboseLogLevels[t.RoleLogLevel(tr, r)] {
+			roles[string(r.Role)] = true
+		}
+	}
+	ret := make([]string, 0, len(roles))
+	for r := range roles {
+		ret = append(ret, r)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// verboseLoggingWarning returns the warning to show for a performance run
+// with debug logging enabled, or an empty string if there's nothing to warn
+// about. Runs in debug mode are not meant to measure performance and are not
+// warned about
+func (t *TestRunManager) verboseLoggingWarning(tr *common.TestRun) string {
+	if tr.Debug {
+		return ""
+	}
+	roles := t.verboseLoggingRoles(tr)
+	if len(roles) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(
+		"Debug logging is enabled for %s, which slows down the system "+
+			"and skews the results",
+		strings.Join(roles, ", "),
+	)
+}
+
+// verboseLoggingViolation returns the built-in lint warning for the first of
+// the submitted runs that has debug logging enabled, if any
+func (t *TestRunManager) verboseLoggingViolation(
+	runs []*common.TestRun,
+) *LintViolation {
+	for _, tr := range runs {
+		msg := t.verboseLoggingWarning(tr)
+		if msg != "" {
+			return &LintViolation{
+				RuleID:  verboseLoggingRuleID,
+				Name:    "Debug logging in performance run",
+				Message: msg,
+				Action:  LintRuleActionWarn,
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,513 @@
+package testruns
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// SampleFormat is the format of a sample file in the outputs of a test run,
+// which determines how it is ingested as time series
+type SampleFormat string
+
+// SampleFormatTx is a file with a line `<unix timestamp in nanoseconds>
+// <latency in nanoseconds>` per completed transaction. These are counted
+// towards the system throughput
+const SampleFormatTx SampleFormat = "tx"
+
+// SampleFormatBlockThroughput is a file with the number of transactions
+// completed per block on each line
+const SampleFormatBlockThroughput SampleFormat = "blockThroughput"
+
+// SampleFormatLatency is a file with the latency of a transaction in
+// nanoseconds on each line
+const SampleFormatLatency SampleFormat = "latency"
+
+// SampleFormatQueue is a file with a line `<unix timestamp in nanoseconds>
+// <queue depth> <nanoseconds blocked since the previous sample>` per sample.
+// None of the built-in roles report their queues, architectures whose roles
+// do declare the files in their manifest
+const SampleFormatQueue SampleFormat = "queue"
+
+// MetricsParser ingests the output files with a name containing FilePrefix
+// as time series of the given format
+type MetricsParser struct {
+	FilePrefix string       `json:"filePrefix"`
+	Format     SampleFormat `json:"format"`
+}
+
+// builtinMetricsParsers are the parsers for the sample files written by the
+// roles of the built-in architectures
+var builtinMetricsParsers = []MetricsParser{
+	{FilePrefix: "tx_samples_", Format: SampleFormatTx},
+	{FilePrefix: "tp_samples", Format: SampleFormatBlockThroughput},
+	{FilePrefix: "latency_samples_", Format: SampleFormatLatency},
+}
+
+// ManifestRole describes a role of an architecture defined by a manifest
+type ManifestRole struct {
+	Role       common.SystemRole `json:"role"`
+	Title      string            `json:"title"`
+	ShortTitle string            `json:"shortTitle"`
+	// Binary is the location of the executable in the binaries archive
+	Binary string `json:"binary"`
+	// Params are the parameters passed to the binary, with the placeholders
+	// handled by SubstituteParameters
+	Params []string `json:"params"`
+	// Port is the port the role listens on, to which the increments of the
+	// readiness probes are added
+	Port int `json:"port"`
+	// Outputs are the files copied from the agent once the test run is done.
+	// Files suffixed with %%OPT are optional
+	Outputs []string `json:"outputs"`
+	// LoadGenerator marks the roles that generate the load, which are paused
+	// with the test run and sampled for live metrics. Load generators write
+	// their samples to tx_samples_<index>.txt, from which the results of the
+	// test run are calculated
+	LoadGenerator bool `json:"loadGenerator"`
+}
+
+// ArchitectureManifest defines an architecture of the system under test, such
+// that it can be tested without changing the controller. Test runs with an
+// architecture ID starting with the ID of the manifest use it
+type ArchitectureManifest struct {
+	ID    string         `json:"id"`
+	Name  string         `json:"name"`
+	Roles []ManifestRole `json:"roles"`
+	// ConfigTemplate is a text/template that renders the configuration file
+	// placed on all agents. It is executed with a manifestConfigData
+	ConfigTemplate string `json:"configTemplate"`
+	// Startup is the order in which the roles are started, and the rules
+	// that determine when they are ready. If a role runs to completion, the
+	// test run ends when it exits, otherwise after its sample count in
+	// seconds
+	Startup StartupPlan     `json:"startup"`
+	Metrics []MetricsParser `json:"metrics"`
+	// DefaultTest is the test run the frontend offers when composing a test
+	// run with the architecture
+	DefaultTest *common.TestRun `json:"defaultTest,omitempty"`
+	// Source is the file the manifest was loaded from
+	Source string    `json:"source"`
+	Loaded time.Time `json:"loaded"`
+}
+
+// manifestConfigData is the data the configuration template of a manifest is
+// executed with. Roles holds the roles of the test run by type, ordered by
+// their index
+type manifestConfigData struct {
+	TestRun *common.TestRun
+	Roles   map[string][]manifestConfigRole
+}
+
+// manifestConfigRole is a role of the test run in the configuration template
+// of a manifest
+type manifestConfigRole struct {
+	Index   int
+	AgentID int32
+	IP      string
+	Port    int
+}
+
+// Endpoint returns the endpoint the role listens on at the given increment
+// from its port
+func (r manifestConfigRole) Endpoint(increment int) string {
+	return fmt.Sprintf("%s:%d", r.IP, r.Port+increment)
+}
+
+// buildOutputDir is the directory of the binaries archive the executables
+// of the roles are built in
+const buildOutputDir = "sources/build/"
+
+// checkBuildOutputPath checks that the path points to a file in the build
+// output of the binaries archive, such that manifests can't have agents run
+// arbitrary executables
+func checkBuildOutputPath(p string) error {
+	if filepath.IsAbs(p) || path.Clean(p) != p ||
+		!strings.HasPrefix(p, buildOutputDir) {
+		return fmt.Errorf("%s is not a file in %s", p, buildOutputDir)
+	}
+	return nil
+}
+
+// architectureManifestsDir is the directory the architecture manifests are
+// loaded from
+func architectureManifestsDir() string {
+	return filepath.Join(common.DataDir(), "architectures")
+}
+
+// role returns the role of the manifest with the given type, or nil if it has
+// none
+func (m *ArchitectureManifest) role(role common.SystemRole) *ManifestRole {
+	for i := range m.Roles {
+		if m.Roles[i].Role == role {
+			return &m.Roles[i]
+		}
+	}
+	return nil
+}
+
+// Validate checks that the manifest doesn't overlap with the built-in
+// architectures, that its roles are complete and all started by its startup
+// plan, and that its configuration template and metrics parsers are valid
+func (m *ArchitectureManifest) Validate() error {
+	if m.ID == "" {
+		return errors.New("The manifest has no ID")
+	}
+	for _, a := range common.AvailableArchitectures {
+		if strings.HasPrefix(m.ID, a.ID) || strings.HasPrefix(a.ID, m.ID) {
+			return fmt.Errorf(
+				"ID %s overlaps with built-in architecture %s",
+				m.ID,
+				a.ID,
+			)
+		}
+	}
+	if len(m.Roles) == 0 {
+		return errors.New("The manifest has no roles")
+	}
+	seen := map[common.SystemRole]bool{}
+	for _, r := range m.Roles {
+		if r.Role == "" {
+			return errors.New("A role has no name")
+		}
+		if seen[r.Role] {
+			return fmt.Errorf("Role %s is defined twice", r.Role)
+		}
+		seen[r.Role] = true
+		if r.Binary == "" {
+			return fmt.Errorf("Role %s has no binary", r.Role)
+		}
+		if err := checkBuildOutputPath(r.Binary); err != nil {
+			return fmt.Errorf("Role %s has invalid binary: %v", r.Role, err)
+		}
+		if r.Port < 0 || r.Port > 65535 {
+			return fmt.Errorf("Role %s has invalid port %d", r.Role, r.Port)
+		}
+	}
+
+	err := m.Startup.Validate()
+	if err != nil {
+		return fmt.Errorf("Startup plan is invalid: %v", err)
+	}
+	inPlan := map[common.SystemRole]bool{}
+	for _, r := range m.Startup.Roles {
+		if !seen[r.Role] {
+			return fmt.Errorf("Startup plan starts unknown role %s", r.Role)
+		}
+		inPlan[r.Role] = true
+	}
+	for _, r := range m.Roles {
+		if !inPlan[r.Role] {
+			return fmt.Errorf("Role %s is not in the startup plan", r.Role)
+		}
+	}
+
+	_, err = template.New(m.ID).Parse(m.ConfigTemplate)
+	if err != nil {
+		return fmt.Errorf("Config template is invalid: %v", err)
+	}
+
+	for _, p := range m.Metrics {
+		if p.FilePrefix == "" {
+			return errors.New("A metrics parser has no file prefix")
+		}
+		switch p.Format {
+		case SampleFormatTx, SampleFormatBlockThroughput, SampleFormatLatency,
+			SampleFormatQueue:
+		default:
+			return fmt.Errorf(
+				"Metrics parser for %s has unknown format %q",
+				p.FilePrefix,
+				p.Format,
+			)
+		}
+	}
+	return nil
+}
+
+// Architecture returns the description of the architecture the frontend uses
+// to compose test runs
+func (m *ArchitectureManifest) Architecture() common.SystemArchitecture {
+	a := common.SystemArchitecture{
+		ID:          m.ID,
+		Name:        m.Name,
+		Roles:       []common.SystemArchitectureRole{},
+		DefaultTest: m.DefaultTest,
+	}
+	for _, r := range m.Roles {
+		a.Roles = append(a.Roles, common.SystemArchitectureRole{
+			Role:       r.Role,
+			Title:      r.Title,
+			ShortTitle: r.ShortTitle,
+		})
+	}
+	return a
+}
+
+// LoadArchitectureManifests (re)loads the architecture manifests from the
+// JSON and YAML files in the architectures directory. Manifests that cannot be
+// read or are invalid are skipped, and their errors returned. Test runs that
+// already started keep running with the manifest they started with
+func (t *TestRunManager) LoadArchitectureManifests() []error {
+	errs := []error{}
+	manifests := []*ArchitectureManifest{}
+	files := []string{}
+	for ext := range manifestExtensions {
+		extFiles, err := filepath.Glob(
+			filepath.Join(architectureManifestsDir(), "*"+ext),
+		)
+		if err != nil {
+			return []error{err}
+		}
+		files = append(files, extFiles...)
+	}
+	sort.Strings(files)
+	ids := map[string]string{}
+	for _, f := range files {
+		var m *ArchitectureManifest
+		b, err := os.ReadFile(f)
+		if err == nil {
+			m, err = ParseArchitectureManifest(
+				b,
+				manifestExtensions[filepath.Ext(f)],
+			)
+		}
+		if err == nil {
+			err = m.Validate()
+		}
+		if err == nil {
+			for id, other := range ids {
+				if strings.HasPrefix(m.ID, id) || strings.HasPrefix(id, m.ID) {
+					err = fmt.Errorf("ID %s overlaps with %s in %s", m.ID, id, other)
+				}
+			}
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", filepath.Base(f), err))
+			continue
+		}
+		ids[m.ID] = filepath.Base(f)
+		m.Source = filepath.Base(f)
+		m.Loaded = time.Now()
+		manifests = append(manifests, m)
+	}
+	sort.Slice(manifests, func(i, j int) bool {
+		return manifests[i].ID < manifests[j].ID
+	})
+
+	t.manifestsLock.Lock()
+	t.manifests = manifests
+	t.manifestsLock.Unlock()
+	for _, err := range errs {
+		logging.Warnf("Skipping architecture manifest %v", err)
+	}
+	logging.Infof("Loaded %d architecture manifest(s)", len(manifests))
+	return errs
+}
+
+// ArchitectureManifests returns the loaded architecture manifests
+func (t *TestRunManager) ArchitectureManifests() []*ArchitectureManifest {
+	t.manifestsLock.Lock()
+	defer t.manifestsLock.Unlock()
+	ret := make([]*ArchitectureManifest, len(t.manifests))
+	copy(ret, t.manifests)
+	return ret
+}
+
+// Architectures returns the built-in architectures and the ones defined by
+// manifests, to inform the frontend of the architectures and roles to pick
+// from
+func (t *TestRunManager) Architectures() []common.SystemArchitecture {
+	ret := append([]common.SystemArchitecture{}, common.AvailableArchitectures...)
+	for _, m := range t.ArchitectureManifests() {
+		ret = append(ret, m.Architecture())
+	}
+	return ret
+}
+
+// architectureManifest returns the manifest defining the architecture, or nil
+// if it is a built-in architecture
+func (t *TestRunManager) architectureManifest(
+	architectureID string,
+) *ArchitectureManifest {
+	for _, m := range t.ArchitectureManifests() {
+		if strings.HasPrefix(architectureID, m.ID) {
+			return m
+		}
+	}
+	return nil
+}
+
+// defaultRoleBinary returns the location of the executable for the role in
+// the binaries archive, from the manifest of the test run's architecture or
+// roleBinaries. Returns an empty string for unknown roles
+func (t *TestRunManager) defaultRoleBinary(
+	tr *common.TestRun,
+	role common.SystemRole,
+) string {
+	if m := t.architectureManifest(tr.Architecture); m != nil {
+		if r := m.role(role); r != nil {
+			return r.Binary
+		}
+		return ""
+	}
+	return roleBinaries[role]
+}
+
+// roleParams returns the parameters to pass to the binary of the role
+func (t *TestRunManager) roleParams(
+	tr *common.TestRun,
+	role common.SystemRole,
+) []string {
+	if m := t.architectureManifest(tr.Architecture); m != nil {
+		if r := m.role(role); r != nil {
+			return r.Params
+		}
+		return nil
+	}
+	return roleParameters[role]
+}
+
+// roleOutputs returns the files to copy from the agents running the role once
+// the test run is done
+func (t *TestRunManager) roleOutputs(
+	tr *common.TestRun,
+	role common.SystemRole,
+) []string {
+	if m := t.architectureManifest(tr.Architecture); m != nil {
+		if r := m.role(role); r != nil {
+			return r.Outputs
+		}
+		return nil
+	}
+	return copyFiles[role]
+}
+
+// rolePort returns the port the role listens on
+func (t *TestRunManager) rolePort(
+	tr *common.TestRun,
+	role common.SystemRole,
+) int {
+	if m := t.architectureManifest(tr.Architecture); m != nil {
+		if r := m.role(role); r != nil {
+			return r.Port
+		}
+		return 0
+	}
+	return portNums[role]
+}
+
+// isLoadGenRole returns true if the role generates the load of the test run
+func (t *TestRunManager) isLoadGenRole(
+	tr *common.TestRun,
+	role common.SystemRole,
+) bool {
+	if m := t.architectureManifest(tr.Architecture); m != nil {
+		r := m.role(role)
+		return r != nil && r.LoadGenerator
+	}
+	return loadGenRoles[role]
+}
+
+// metricsParsers returns the parsers for the sample files of the test run:
+// the ones of the manifest of its architecture before the built-in ones
+func (t *TestRunManager) metricsParsers(tr *common.TestRun) []MetricsParser {
+	ret := []MetricsParser{}
+	if m := t.architectureManifest(tr.Architecture); m != nil {
+		ret = append(ret, m.Metrics...)
+	}
+	return append(ret, builtinMetricsParsers...)
+}
+
+// sampleFileFormat returns the format of the sample file with the given name
+// by the first matching parser, or an empty format if none matches
+func sampleFileFormat(parsers []MetricsParser, name string) SampleFormat {
+	for _, p := range parsers {
+		if strings.Contains(name, p.FilePrefix) {
+			return p.Format
+		}
+	}
+	return ""
+}
+
+// ValidateTestRunManifest validates the role composition of a test run with
+// an architecture defined by a manifest. Reports all errors back as an array
+func (t *TestRunManager) ValidateTestRunManifest(
+	tr *common.TestRun,
+	m *ArchitectureManifest,
+) []error {
+	errs := make([]error, 0)
+	unknown := map[common.SystemRole]bool{}
+	for _, r := range tr.Roles {
+		if m.role(r.Role) == nil && !unknown[r.Role] {
+			unknown[r.Role] = true
+			errs = append(errs, fmt.Errorf(
+				"role %s is not part of architecture %s",
+				r.Role,
+				m.ID,
+			))
+		}
+	}
+	if len(tr.Roles) == 0 {
+		errs = append(errs, errors.New("the system needs at least 1 role"))
+	}
+	if tr.PreseedShards {
+		errs = append(errs, fmt.Errorf(
+			"preseeding shards is not supported by architecture %s",
+			m.ID,
+		))
+	}
+	return errs
+}
+
+// GenerateConfigManifest renders the configuration template of the manifest
+// for the test run. For dummy configs, the IP addresses of the roles are
+// dummies
+func (t *TestRunManager) GenerateConfigManifest(
+	tr *common.TestRun,
+	m *ArchitectureManifest,
+	dummy bool,
+) ([]byte, error) {
+	tmpl, err := template.New(m.ID).
+		Option("missingkey=error").
+		Parse(m.ConfigTemplate)
+	if err != nil {
+		return nil, err
+	}
+	data := manifestConfigData{
+		TestRun: tr,
+		Roles:   map[string][]manifestConfigRole{},
+	}
+	for _, mr := range m.Roles {
+		roles := []manifestConfigRole{}
+		for _, r := range t.GetAllRolesSorted(tr, mr.Role) {
+			a, err := t.GetAgentOrDummy(r.AgentID, dummy)
+			if err != nil {
+				return nil, err
+			}
+			roles = append(roles, manifestConfigRole{
+				Index:   r.Index,
+				AgentID: r.AgentID,
+				IP:      a.SystemInfo.PrivateIPs[0].String(),
+				Port:    mr.Port,
+			})
+		}
+		data.Roles[string(mr.Role)] = roles
+	}
+	var cfg bytes.Buffer
+	err = tmpl.Execute(&cfg, data)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to render config template: %v", err)
+	}
+	return cfg.Bytes(), nil
+}
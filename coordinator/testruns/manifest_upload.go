@@ -0,0 +1,193 @@
+package testruns
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"gopkg.in/yaml.v2"
+)
+
+// ErrManifestNotFound is returned when no architecture manifest with the
+// requested ID is loaded
+var ErrManifestNotFound = errors.New("Architecture manifest not found")
+
+// manifestExtensions are the extensions of the manifest files loaded from the
+// architectures directory, and whether the files are YAML
+var manifestExtensions = map[string]bool{
+	".json": false,
+	".yaml": true,
+	".yml":  true,
+}
+
+// manifestFileName matches the characters that cannot be used in the file
+// name of a manifest derived from its ID
+var manifestFileName = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// ParseArchitectureManifest parses a manifest in JSON, or in YAML if isYAML is
+// set. YAML manifests use the same field names as JSON ones
+func ParseArchitectureManifest(
+	b []byte,
+	isYAML bool,
+) (*ArchitectureManifest, error) {
+	if isYAML {
+		var err error
+		b, err = yamlToJSON(b)
+		if err != nil {
+			return nil, err
+		}
+	}
+	m := &ArchitectureManifest{}
+	err := json.Unmarshal(b, m)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// yamlToJSON converts a YAML document to JSON, such that it can be decoded
+// using the JSON field names of the structs
+func yamlToJSON(b []byte) ([]byte, error) {
+	var v interface{}
+	err := yaml.Unmarshal(b, &v)
+	if err != nil {
+		return nil, err
+	}
+	v, err = jsonCompatible(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// jsonCompatible converts the maps with interface{} keys the YAML decoder
+// returns to maps with string keys
+func jsonCompatible(v interface{}) (interface{}, error) {
+	switch e := v.(type) {
+	case map[interface{}]interface{}:
+		ret := map[string]interface{}{}
+		for k, val := range e {
+			key, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("Key %v is not a string", k)
+			}
+			conv, err := jsonCompatible(val)
+			if err != nil {
+				return nil, err
+			}
+			ret[key] = conv
+		}
+		return ret, nil
+	case []interface{}:
+		for i := range e {
+			conv, err := jsonCompatible(e[i])
+			if err != nil {
+				return nil, err
+			}
+			e[i] = conv
+		}
+	}
+	return v, nil
+}
+
+// SaveArchitectureManifest validates an uploaded manifest in JSON or YAML and
+// stores it in the architectures directory, replacing the manifest with the
+// same ID if there is one. The manifests are reloaded, such that the
+// architecture can be tested right away. The original document is stored,
+// such that comments in YAML manifests are kept
+func (t *TestRunManager) SaveArchitectureManifest(
+	b []byte,
+	isYAML bool,
+) (*ArchitectureManifest, error) {
+	m, err := ParseArchitectureManifest(b, isYAML)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse manifest: %v", err)
+	}
+	err = m.Validate()
+	if err != nil {
+		return nil, err
+	}
+	base := manifestFileName.ReplaceAllString(m.ID, "_")
+	var replaced *ArchitectureManifest
+	for _, e := range t.ArchitectureManifests() {
+		if e.ID == m.ID {
+			replaced = e
+		} else if strings.HasPrefix(m.ID, e.ID) ||
+			strings.HasPrefix(e.ID, m.ID) {
+			return nil, fmt.Errorf("ID %s overlaps with %s", m.ID, e.ID)
+		} else if strings.TrimSuffix(e.Source, filepath.Ext(e.Source)) == base {
+			// Both IDs would be stored in the same file
+			return nil, fmt.Errorf(
+				"ID %s collides with %s in %s",
+				m.ID,
+				e.ID,
+				e.Source,
+			)
+		}
+	}
+
+	ext := ".json"
+	if isYAML {
+		ext = ".yaml"
+	}
+	name := base + ext
+	err = os.MkdirAll(architectureManifestsDir(), 0755)
+	if err != nil {
+		return nil, err
+	}
+	err = os.WriteFile(filepath.Join(architectureManifestsDir(), name), b, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if replaced != nil && replaced.Source != name {
+		err = os.Remove(filepath.Join(architectureManifestsDir(), replaced.Source))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	t.LoadArchitectureManifests()
+	for _, e := range t.ArchitectureManifests() {
+		if e.ID == m.ID {
+			return e, nil
+		}
+	}
+	return nil, fmt.Errorf("Manifest %s was saved but not loaded", m.ID)
+}
+
+// DeleteArchitectureManifest removes the manifest with the given ID from the
+// architectures directory and reloads the manifests. Manifests of test runs
+// that are queued or running cannot be removed
+func (t *TestRunManager) DeleteArchitectureManifest(id string) error {
+	var m *ArchitectureManifest
+	for _, e := range t.ArchitectureManifests() {
+		if e.ID == id {
+			m = e
+		}
+	}
+	if m == nil {
+		return ErrManifestNotFound
+	}
+	for _, tr := range t.GetTestRuns() {
+		if (tr.Status == common.TestRunStatusQueued ||
+			tr.Status == common.TestRunStatusRunning) &&
+			strings.HasPrefix(tr.Architecture, m.ID) {
+			return fmt.Errorf(
+				"Test run %s with architecture %s has not ended yet",
+				tr.ID,
+				tr.Architecture,
+			)
+		}
+	}
+	err := os.Remove(filepath.Join(architectureManifestsDir(), m.Source))
+	if err != nil {
+		return err
+	}
+	t.LoadArchitectureManifests()
+	return nil
+}
@@ -97,7 +97,12 @@ func (t *TestRunManager) GenerateMatrixForRuns(
 			ResultCount: len(results[k]),
 			Results:     results[k],
 		}
+		failovers := []common.FailoverRecovery{}
 		for _, r := range results[k] {
+			if r.Failover != nil {
+				failovers = append(failovers, r.Failover.Recoveries...)
+			}
+
 			// Summarize the results - if the testrun's min or max exceeds the
 			// summary's min or max, update it. For average, stddev and the
 			// percentile buckets, add this testrun's value to the summary's
@@ -194,6 +199,11 @@ func (t *TestRunManager) GenerateMatrixForRuns(
 				),
 			}
 		}
+		// The recovery times of repeated failover test runs are summarized
+		// over the failovers of all runs
+		if len(failovers) > 0 {
+			mr.ResultAvg.Failover = summarizeFailoverRecoveries(failovers)
+		}
 		res = append(res, mr)
 	}
 
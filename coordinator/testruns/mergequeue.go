@@ -0,0 +1,200 @@
+package testruns
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// MergeQueueConfig configures the merge queue mode, in which merge candidates
+// of the GitHub merge queue are benchmarked before they land on the main
+// branch. The commit status reported for the candidate is only successful if
+// its results meet the service level objectives, such that the merge queue
+// rejects candidates that regress performance
+type MergeQueueConfig struct {
+	// Enables benchmarking merge candidates
+	Enabled bool `json:"enabled"`
+	// The (fast) test run the candidates are benchmarked with. Its commit is
+	// replaced with the one of the candidate
+	Template *common.TestRun `json:"template"`
+	// The service level objectives the results have to meet. Objectives set
+	// to zero are not checked
+	MinThroughputAvg float64 `json:"minThroughputAvg"`
+	MaxLatencyAvg    float64 `json:"maxLatencyAvg"`
+	MaxLatencyP99    float64 `json:"maxLatencyP99"`
+}
+
+// SetMergeQueueConfig changes the merge queue configuration and persists it
+func (t *TestRunManager) SetMergeQueueConfig(cfg MergeQueueConfig) error {
+	t.configLock.Lock()
+	t.config.MergeQueue = cfg
+	t.configLock.Unlock()
+	return t.PersistConfig()
+}
+
+// Validate checks the benchmark and objectives of the merge queue
+func (cfg MergeQueueConfig) Validate() error {
+	if cfg.MinThroughputAvg < 0 || cfg.MaxLatencyAvg < 0 ||
+		cfg.MaxLatencyP99 < 0 {
+		return errors.New("Service level objectives cannot be negative")
+	}
+	if !cfg.Enabled {
+		return nil
+	}
+	if cfg.Template == nil || len(cfg.Template.Roles) == 0 {
+		return errors.New("No benchmark configured for merge candidates")
+	}
+	if cfg.Template.Sweep != "" || cfg.Template.Repeat > 1 {
+		return errors.New(
+			"Merge candidates are benchmarked with a single test run",
+		)
+	}
+	return nil
+}
+
+// CheckSLOs returns the service level objectives the results of the test run
+// violate
+func (cfg MergeQueueConfig) CheckSLOs(res *common.TestResult) []string {
+	ret := []string{}
+	if cfg.MinThroughputAvg > 0 && res.ThroughputAvg < cfg.MinThroughputAvg {
+		ret = append(ret, fmt.Sprintf(
+			"throughput %.2f tx/s < %.2f",
+			res.ThroughputAvg,
+			cfg.MinThroughputAvg,
+		))
+	}
+	if cfg.MaxLatencyAvg > 0 && res.LatencyAvg > cfg.MaxLatencyAvg {
+		ret = append(ret, fmt.Sprintf(
+			"average latency %.3fs > %.3fs",
+			res.LatencyAvg,
+			cfg.MaxLatencyAvg,
+		))
+	}
+	if cfg.MaxLatencyP99 > 0 {
+		for _, p := range res.LatencyPercentiles {
+			if p.Bucket == 99 && p.Value > cfg.MaxLatencyP99 {
+				ret = append(ret, fmt.Sprintf(
+					"p99 latency %.3fs > %.3fs",
+					p.Value,
+					cfg.MaxLatencyP99,
+				))
+			}
+		}
+	}
+	return ret
+}
+
+// mergeQueueState maps the outcome of a merge candidate's benchmark to the
+// state of its commit status
+func (t *TestRunManager) mergeQueueState(
+	tr *common.TestRun,
+) (string, string) {
+	state, description := githubState(tr)
+	if state != "success" {
+		return state, description
+	}
+	violations := t.Config().MergeQueue.CheckSLOs(tr.Result)
+	if len(violations) > 0 {
+		return "failure", fmt.Sprintf(
+			"SLOs not met: %s",
+			strings.Join(violations, ", "),
+		)
+	}
+	return state, fmt.Sprintf("SLOs met: %s", description)
+}
+
+// BenchmarkMergeCandidate schedules the benchmark of a merge candidate of the
+// GitHub merge queue, given the branch the merge queue created for it and its
+// head commit
+func (t *TestRunManager) BenchmarkMergeCandidate(
+	ref, headSha string,
+) (*common.TestRun, error) {
+	cfg := t.Config().MergeQueue
+	if !cfg.Enabled {
+		return nil, errors.New("The merge queue mode is disabled")
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	// The merge queue's branch has to be fetched for its head commit to be
+	// available for compilation
+	err := t.src.EnsureSourcesUpdated()
+	if err != nil {
+		return nil, err
+	}
+	hash, _, err := t.src.ResolveRef(ref)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to resolve %s: %v", ref, err)
+	}
+	if hash != headSha {
+		return nil, fmt.Errorf(
+			"%s points to %s rather than the merge candidate %s",
+			ref,
+			hash,
+			headSha,
+		)
+	}
+
+	_, tr, err := common.GetTestRunCopy(cfg.Template)
+	if err != nil {
+		return nil, err
+	}
+	tr.CommitHash = headSha
+	tr.SourceRef = ref
+	tr.CreatedByThumbprint = ""
+	tr.SweepID = ""
+	tr.AwaitingApproval = false
+	tr.ApprovedByThumbprint = ""
+	tr.Tags = appendUnique(tr.Tags, common.TestRunTagMergeQueue)
+	ApplySubmissionDefaults(tr)
+
+	// Approval requirements are not applied, the candidate would hold up
+	// the merge queue until someone approves the run
+	for _, v := range t.LintTestRuns([]*common.TestRun{tr}) {
+		if v.Action == LintRuleActionReject {
+			return nil, fmt.Errorf(
+				"Rejected by lint rule %s: %s",
+				v.Name,
+				v.Message,
+			)
+		}
+	}
+	t.ScheduleTestRun(tr)
+	logging.Infof(
+		"[Merge queue] Benchmarking merge candidate %s in test run %s",
+		headSha,
+		tr.ID,
+	)
+	return tr, nil
+}
+
+// CancelMergeCandidate aborts the benchmarks of a merge candidate that was
+// removed from the merge queue and are still queued
+func (t *TestRunManager) CancelMergeCandidate(headSha string) {
+	for _, tr := range t.GetTestRuns() {
+		if tr.CommitHash != headSha ||
+			tr.Status != common.TestRunStatusQueued ||
+			!hasTag(tr, common.TestRunTagMergeQueue) {
+			continue
+		}
+		t.UpdateStatus(
+			tr,
+			common.TestRunStatusCanceled,
+			"Merge candidate was removed from the merge queue",
+		)
+	}
+}
+
+// hasTag returns true if the test run is tagged with tag
+func hasTag(tr *common.TestRun, tag string) bool {
+	for _, t := range tr.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
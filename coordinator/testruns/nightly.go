@@ -0,0 +1,286 @@
+package testruns
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/coordinator/sources"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// ErrNightlyRunning is returned when the nightly pipeline is triggered while
+// it is already running
+var ErrNightlyRunning = errors.New("The nightly pipeline is already running")
+
+// nightlyCatchUp is how long after its scheduled time a nightly run that was
+// missed (because the coordinator was down) is still started
+const nightlyCatchUp = 6 * time.Hour
+
+// nightlyHistoryLength is the number of nightly runs kept in the history
+const nightlyHistoryLength = 365
+
+// NightlyConfig configures the nightly benchmark pipeline, which every night
+// refreshes the sources, compiles the head of the main branch and runs a set
+// of baseline test runs against it, such that performance regressions on the
+// main branch are caught without anyone having to schedule runs
+type NightlyConfig struct {
+	// Enables the nightly pipeline
+	Enabled bool `json:"enabled"`
+	// The time of day (UTC) the pipeline runs at
+	Hour   int `json:"hour"`
+	Minute int `json:"minute"`
+	// The branch to benchmark. If empty, the head of the main branch of the
+	// commit history is used
+	Branch string `json:"branch"`
+	// The baseline test runs, scheduled like submissions from the frontend.
+	// Their commit is replaced with the one benchmarked
+	Templates []common.TestRun `json:"templates"`
+}
+
+// NightlyRun is a single run of the nightly pipeline
+type NightlyRun struct {
+	// The scheduled time of the run, or the time it was triggered for manual
+	// runs
+	Slot    time.Time `json:"slot"`
+	Manual  bool      `json:"manual"`
+	Started time.Time `json:"started"`
+	// The commit that was benchmarked
+	CommitHash string `json:"commitHash"`
+	// The test runs the pipeline scheduled
+	TestRunIDs []string `json:"testRunIDs"`
+	// Why the pipeline failed, empty if it scheduled the test runs
+	Error string `json:"error,omitempty"`
+}
+
+// nightlyState holds the history of the nightly pipeline
+type nightlyState struct {
+	runs    []*NightlyRun
+	loaded  bool
+	running bool
+	lock    sync.Mutex
+}
+
+// SetNightlyConfig changes the nightly pipeline's configuration and persists
+// it
+func (t *TestRunManager) SetNightlyConfig(cfg NightlyConfig) error {
+	t.configLock.Lock()
+	t.config.Nightly = cfg
+	t.configLock.Unlock()
+	return t.PersistConfig()
+}
+
+// Validate checks the configured schedule and templates
+func (cfg NightlyConfig) Validate() error {
+	if cfg.Hour < 0 || cfg.Hour > 23 || cfg.Minute < 0 || cfg.Minute > 59 {
+		return fmt.Errorf("Invalid time of day %02d:%02d", cfg.Hour, cfg.Minute)
+	}
+	if cfg.Enabled && len(cfg.Templates) == 0 {
+		return errors.New("No baseline test runs configured")
+	}
+	return nil
+}
+
+// nightlySlot returns the most recent scheduled time of the pipeline at or
+// before now
+func (cfg NightlyConfig) nightlySlot(now time.Time) time.Time {
+	return dailySlot(now, cfg.Hour, cfg.Minute)
+}
+
+// NextNightlyRun returns the next time the nightly pipeline is scheduled to
+// run, or the zero time if it is disabled
+func (t *TestRunManager) NextNightlyRun() time.Time {
+	cfg := t.Config().Nightly
+	if !cfg.Enabled {
+		return time.Time{}
+	}
+	return cfg.nightlySlot(time.Now()).AddDate(0, 0, 1)
+}
+
+// nightlyHistoryPath returns the path of the file the history of the nightly
+// pipeline is persisted in
+func nightlyHistoryPath() string {
+	return filepath.Join(common.DataDir(), "testruns", "nightly-runs.json")
+}
+
+// loadNightlyHistory reads the history of the nightly pipeline from disk.
+// Must be called with the lock of the nightly state held
+func (t *TestRunManager) loadNightlyHistory() {
+	if t.nightly.loaded {
+		return
+	}
+	t.nightly.loaded = true
+	loadJobHistory(nightlyHistoryPath(), &t.nightly.runs)
+}
+
+// persistNightlyHistory writes the history of the nightly pipeline to disk.
+// Must be called with the lock of the nightly state held
+func (t *TestRunManager) persistNightlyHistory() error {
+	if len(t.nightly.runs) > nightlyHistoryLength {
+		t.nightly.runs = t.nightly.runs[:nightlyHistoryLength]
+	}
+	return persistJobHistory(nightlyHistoryPath(), t.nightly.runs)
+}
+
+// NightlyHistory returns the runs of the nightly pipeline, most recent first
+func (t *TestRunManager) NightlyHistory() []NightlyRun {
+	t.nightly.lock.Lock()
+	defer t.nightly.lock.Unlock()
+	t.loadNightlyHistory()
+	ret := make([]NightlyRun, len(t.nightly.runs))
+	for i, r := range t.nightly.runs {
+		ret[i] = *r
+	}
+	return ret
+}
+
+// NightlyPipeline is the loop that starts the nightly pipeline at its
+// scheduled time. Runs missed by less than nightlyCatchUp while the
+// coordinator was down are started when it comes back
+func (t *TestRunManager) NightlyPipeline() {
+	t.runScheduledJob(scheduledJob{
+		name:    "Nightly",
+		poll:    time.Second * 30,
+		catchUp: nightlyCatchUp,
+		slot: func(now time.Time) (time.Time, bool) {
+			cfg := t.Config().Nightly
+			return cfg.nightlySlot(now), cfg.Enabled
+		},
+		ran: func(slot time.Time) bool {
+			t.nightly.lock.Lock()
+			defer t.nightly.lock.Unlock()
+			t.loadNightlyHistory()
+			for _, r := range t.nightly.runs {
+				if !r.Manual && r.Slot.Equal(slot) {
+					return true
+				}
+			}
+			return false
+		},
+		run: func(slot time.Time) error {
+			_, err := t.RunNightly(slot, false)
+			return err
+		},
+		errRunning: ErrNightlyRunning,
+	})
+}
+
+// TriggerNightly runs the nightly pipeline now, regardless of its schedule
+func (t *TestRunManager) TriggerNightly() (*NightlyRun, error) {
+	return t.RunNightly(time.Now().UTC(), true)
+}
+
+// RunNightly runs the nightly pipeline for the given slot: it refreshes the
+// sources, compiles the commit to benchmark and schedules the baseline test
+// runs against it, tagged as nightly. The run is recorded in the history,
+// also if it fails
+func (t *TestRunManager) RunNightly(
+	slot time.Time,
+	manual bool,
+) (*NightlyRun, error) {
+	t.nightly.lock.Lock()
+	if t.nightly.running {
+		t.nightly.lock.Unlock()
+		return nil, ErrNightlyRunning
+	}
+	t.nightly.running = true
+	t.loadNightlyHistory()
+	run := &NightlyRun{
+		Slot:       slot,
+		Manual:     manual,
+		Started:    time.Now(),
+		TestRunIDs: []string{},
+	}
+	t.nightly.runs = append([]*NightlyRun{run}, t.nightly.runs...)
+	t.nightly.lock.Unlock()
+
+	// The progress is recorded in a copy, the run in the history is only
+	// modified with the lock held
+	result := *run
+	err := t.runNightly(&result)
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	t.nightly.lock.Lock()
+	defer t.nightly.lock.Unlock()
+	*run = result
+	t.nightly.running = false
+	if perr := t.persistNightlyHistory(); perr != nil {
+		logging.Warnf("Unable to persist nightly history: %v", perr)
+	}
+	return &result, err
+}
+
+// NightlyRunning returns true if the nightly pipeline is currently running
+func (t *TestRunManager) NightlyRunning() bool {
+	t.nightly.lock.Lock()
+	defer t.nightly.lock.Unlock()
+	return t.nightly.running
+}
+
+// runNightly performs the steps of the nightly pipeline, recording its
+// progress in run
+func (t *TestRunManager) runNightly(run *NightlyRun) error {
+	cfg := t.Config().Nightly
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if len(cfg.Templates) == 0 {
+		// Manual runs are allowed while the schedule is disabled
+		return errors.New("No baseline test runs configured")
+	}
+
+	var err error
+	run.CommitHash, err = t.jobCommit("Nightly", cfg.Branch)
+	if err != nil {
+		return err
+	}
+
+	logging.Infof("[Nightly] Compiling %s", run.CommitHash)
+	err = t.src.Compile(
+		run.CommitHash,
+		false,
+		sources.DefaultTargetArch,
+		nil,
+		nil,
+	)
+	if err != nil {
+		return fmt.Errorf("Compilation failed: %v", err)
+	}
+
+	runs := []*common.TestRun{}
+	for i := range cfg.Templates {
+		tr, err := jobTestRun(&cfg.Templates[i], common.TestRunTagNightly)
+		if err != nil {
+			return err
+		}
+		tr.CommitHash = run.CommitHash
+		tr.SourceRef = cfg.Branch
+		ApplySubmissionDefaults(tr)
+
+		sweepID, err := common.RandomID(12)
+		if err != nil {
+			return err
+		}
+		expanded := common.ExpandSweepRun(tr, sweepID)
+		runs = append(runs, InitialSweepRuns(tr, expanded)...)
+	}
+
+	err = t.scheduleLintedRuns(runs)
+	if err != nil {
+		return err
+	}
+	for _, tr := range runs {
+		run.TestRunIDs = append(run.TestRunIDs, tr.ID)
+	}
+	logging.Infof(
+		"[Nightly] Scheduled %d test run(s) for %s",
+		len(runs),
+		run.CommitHash,
+	)
+	return nil
+}
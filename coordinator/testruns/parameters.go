@@ -46,7 +46,7 @@ func (t *TestRunManager) SubstituteParameters(
 		p = strings.ReplaceAll(
 			p,
 			"%SAMPLE_COUNT%",
-			fmt.Sprintf("%d", tr.SampleCount),
+			fmt.Sprintf("%d", sampleCount(tr)),
 		)
 		p = strings.ReplaceAll(p, "%SIGN_TXS%", "1") // Always sign
 		p = strings.ReplaceAll(
@@ -0,0 +1,285 @@
+package testruns
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+)
+
+// loadGenRoles are the roles that generate the load on the system under test.
+// Pausing a test run suspends these, the system roles keep running
+var loadGenRoles = map[common.SystemRole]bool{
+	common.SystemRoleAtomizerCliWatchtower: true,
+	common.SystemRoleTwoPhaseGen:           true,
+	common.SystemRoleParsecGen:             true,
+}
+
+// pauseExcludedRoles are never suspended by pausing a test run, even if the
+// manifest of the architecture marks them as load generators. The atomizer
+// and archiver hold the state of the system, which the other roles would
+// time out on
+var pauseExcludedRoles = map[common.SystemRole]bool{
+	common.SystemRoleRaftAtomizer: true,
+	common.SystemRoleArchiver:     true,
+}
+
+// pausableRole returns true if pausing the test run suspends the role
+func (t *TestRunManager) pausableRole(
+	tr *common.TestRun,
+	role common.SystemRole,
+) bool {
+	return t.isLoadGenRole(tr, role) && !pauseExcludedRoles[role]
+}
+
+// trackCommands registers the commands of a test run that is executing its
+// load, such that the load generators among them can be paused, and the
+// coordinator can find them again if a soak test is resumed
+func (t *TestRunManager) trackCommands(
+	tr *common.TestRun,
+	cmds []runningCommand,
+) {
+	t.runningCommands.Store(tr.ID, cmds)
+	t.recordSoakState(tr, cmds)
+	t.startLoadProfile(tr, cmds)
+}
+
+// untrackCommands is called once the load of a test run is done executing,
+// before its commands are stopped. Load generators that are still paused are
+// resumed, since suspended processes don't handle the signals to stop them
+func (t *TestRunManager) untrackCommands(tr *common.TestRun) {
+	if t.IsPaused(tr) {
+		err := t.ResumeTestRun(tr, "")
+		if err != nil {
+			t.WriteLog(tr, "Unable to resume the load generators: %v", err)
+		}
+	}
+	t.runningCommands.Delete(tr.ID)
+	t.pauseLocks.Delete(tr.ID)
+}
+
+// IsPaused returns true if the load generators of the test run are suspended
+func (t *TestRunManager) IsPaused(tr *common.TestRun) bool {
+	t.pausesLock.Lock()
+	defer t.pausesLock.Unlock()
+	return len(tr.Pauses) > 0 && tr.Pauses[len(tr.Pauses)-1].Resumed.IsZero()
+}
+
+// pausedDuration returns the total time the test run has been paused
+func (t *TestRunManager) pausedDuration(tr *common.TestRun) time.Duration {
+	t.pausesLock.Lock()
+	defer t.pausesLock.Unlock()
+	d := time.Duration(0)
+	for _, p := range tr.Pauses {
+		end := p.Resumed
+		if end.IsZero() {
+			end = time.Now()
+		}
+		d += end.Sub(p.Paused)
+	}
+	return d
+}
+
+// loadGenCommands returns the running commands of the load generators of the
+// test run. Load generators that share their agent with a system role cannot
+// be told apart from it, so those prevent pausing the test run
+func (t *TestRunManager) loadGenCommands(
+	tr *common.TestRun,
+) ([]runningCommand, error) {
+	v, ok := t.runningCommands.Load(tr.ID)
+	if !ok {
+		return nil, errors.New(
+			"The test run can only be paused while it is generating load",
+		)
+	}
+	cmds := v.([]runningCommand)
+
+	agentRoles := map[int32][]common.SystemRole{}
+	for _, r := range tr.Roles {
+		agentRoles[r.AgentID] = append(agentRoles[r.AgentID], r.Role)
+	}
+	ret := []runningCommand{}
+	loadGens := map[common.SystemRole]bool{}
+	for _, r := range tr.Roles {
+		if t.pausableRole(tr, r.Role) {
+			loadGens[r.Role] = true
+		}
+	}
+	for role := range loadGens {
+		for _, c := range t.FilterCommandsByRole(tr, cmds, role) {
+			for _, other := range agentRoles[c.agentID] {
+				if !t.pausableRole(tr, other) {
+					return nil, fmt.Errorf(
+						"The load generator on agent %d shares it with %s, which would be paused as well",
+						c.agentID,
+						other,
+					)
+				}
+			}
+			ret = append(ret, c)
+		}
+	}
+	if len(ret) == 0 {
+		return nil, errors.New("The test run has no load generators to pause")
+	}
+	return ret, nil
+}
+
+// suspendCommands suspends or resumes the commands, and returns the errors of
+// the commands that could not be suspended or resumed
+func (t *TestRunManager) suspendCommands(
+	cmds []runningCommand,
+	resume bool,
+) error {
+	errs := []string{}
+	for _, c := range cmds {
+		err := t.am.SuspendCommand(c.agentID, c.commandID, resume)
+		if err != nil {
+			errs = append(
+				errs,
+				fmt.Sprintf("command %x on agent %d: %v", c.commandID, c.agentID, err),
+			)
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// pauseLock returns the lock that serializes pausing and resuming the test
+// run
+func (t *TestRunManager) pauseLock(tr *common.TestRun) *sync.Mutex {
+	l, _ := t.pauseLocks.LoadOrStore(tr.ID, &sync.Mutex{})
+	return l.(*sync.Mutex)
+}
+
+// PauseTestRun suspends the load generators of a running test run, keeping the
+// system roles alive such that they can be inspected. The time the test run
+// is paused is added to its duration, and excluded from its throughput
+func (t *TestRunManager) PauseTestRun(
+	tr *common.TestRun,
+	userThumbprint string,
+) error {
+	l := t.pauseLock(tr)
+	l.Lock()
+	defer l.Unlock()
+	if tr.Status != common.TestRunStatusRunning {
+		return errors.New("Only running test runs can be paused")
+	}
+	if t.IsPaused(tr) {
+		return errors.New("The test run is already paused")
+	}
+	cmds, err := t.loadGenCommands(tr)
+	if err != nil {
+		return err
+	}
+	err = t.suspendCommands(cmds, false)
+	if err != nil {
+		// Don't leave part of the load generators suspended
+		_ = t.suspendCommands(cmds, true)
+		return fmt.Errorf("Unable to pause the load generators: %v", err)
+	}
+
+	t.pausesLock.Lock()
+	tr.Pauses = append(tr.Pauses, common.PauseInterval{
+		Paused:         time.Now(),
+		UserThumbprint: userThumbprint,
+	})
+	t.pausesLock.Unlock()
+	t.UpdateStatus(
+		tr,
+		common.TestRunStatusRunning,
+		fmt.Sprintf("Paused %d load generator(s)", len(cmds)),
+	)
+	return nil
+}
+
+// ResumeTestRun resumes the load generators of a paused test run
+func (t *TestRunManager) ResumeTestRun(
+	tr *common.TestRun,
+	userThumbprint string,
+) error {
+	l := t.pauseLock(tr)
+	l.Lock()
+	defer l.Unlock()
+	if !t.IsPaused(tr) {
+		return errors.New("The test run is not paused")
+	}
+	cmds, err := t.loadGenCommands(tr)
+	if err != nil {
+		return err
+	}
+	err = t.suspendCommands(cmds, true)
+	if err != nil {
+		return fmt.Errorf("Unable to resume the load generators: %v", err)
+	}
+
+	t.pausesLock.Lock()
+	p := &tr.Pauses[len(tr.Pauses)-1]
+	p.Resumed = time.Now()
+	paused := p.Resumed.Sub(p.Paused)
+	t.pausesLock.Unlock()
+	if userThumbprint != "" {
+		t.WriteLog(tr, "Resumed by %s", userThumbprint)
+	}
+	t.UpdateStatus(
+		tr,
+		common.TestRunStatusRunning,
+		fmt.Sprintf(
+			"Resumed load generator(s) after %s",
+			paused.Round(time.Second),
+		),
+	)
+	return nil
+}
+
+// loadTimer returns a channel that receives once the test run has generated
+// load for the given duration. The time the test run was paused does not
+// count towards the duration
+func (t *TestRunManager) loadTimer(
+	tr *common.TestRun,
+	d time.Duration,
+) <-chan time.Time {
+	c := make(chan time.Time, 1)
+	start := time.Now()
+	go func() {
+		for {
+			remaining := d + t.pausedDuration(tr) - time.Since(start)
+			if remaining <= 0 {
+				c <- time.Now()
+				return
+			}
+			if _, ok := t.runningCommands.Load(tr.ID); !ok {
+				// The test run stopped generating load before the timer
+				// expired
+				return
+			}
+			if remaining > time.Second {
+				remaining = time.Second
+			}
+			time.Sleep(remaining)
+		}
+	}()
+	return c
+}
+
+// pausesEnv formats the pause intervals of the test run for the result
+// calculation as comma separated `<paused>:<resumed>` unix nanosecond pairs
+func pausesEnv(tr *common.TestRun) string {
+	intervals := []string{}
+	for _, p := range tr.Pauses {
+		if p.Resumed.IsZero() {
+			continue
+		}
+		intervals = append(intervals, fmt.Sprintf(
+			"%d:%d",
+			p.Paused.UnixNano(),
+			p.Resumed.UnixNano(),
+		))
+	}
+	return strings.Join(intervals, ",")
+}
@@ -50,8 +50,15 @@ func (t *TestRunManager) PersistTestRun(tr *common.TestRun) {
 	}
 	defer f.Close()
 
-	// Encode the testrun as JSON into the created file
-	err = json.NewEncoder(f).Encode(tr)
+	// Encode the testrun as JSON into the created file. The preemptions of a
+	// test run are changed by the scheduler while it runs, so they're
+	// encoded under their lock
+	t.preemptionsLock.Lock()
+	b, err := json.Marshal(tr)
+	t.preemptionsLock.Unlock()
+	if err == nil {
+		_, err = f.Write(b)
+	}
 	if err != nil {
 		logging.Warnf("Unable to persist testrun %s: %v", tr.ID, err)
 		return
@@ -107,6 +114,7 @@ func (t *TestRunManager) LoadAllTestRuns() {
 	// Keep track of test runs that were interrupted such that we can reschedule
 	// them if necessary
 	runsToReschedule := make([]*common.TestRun, 0)
+	runsToResume := make([]*common.TestRun, 0)
 	t.testRunsLock.Lock()
 	err = filepath.WalkDir(
 		activeDir,
@@ -145,8 +153,15 @@ func (t *TestRunManager) LoadAllTestRuns() {
 					// If test run is "Running" then the coordinator crashed
 					// while running it - we should change the state to
 					// "interrupted" to prevent the system from trying to resume
-					// it but also reschedule it due to failure
-					if tr.Status == common.TestRunStatusRunning {
+					// it but also reschedule it due to failure. Soak tests
+					// keep generating load on the agents while the
+					// coordinator restarts, so we resume collecting their
+					// results instead
+					resume := tr.Status == common.TestRunStatusRunning &&
+						tr.SoakState != nil
+					if resume {
+						runsToResume = append(runsToResume, tr)
+					} else if tr.Status == common.TestRunStatusRunning {
 						t.UpdateStatus(
 							tr,
 							common.TestRunStatusInterrupted,
@@ -161,7 +176,7 @@ func (t *TestRunManager) LoadAllTestRuns() {
 					// Don't load failed run older than a week - they're no
 					// longer interesting and do take up memory space
 					skip := false
-					if tr.Status != common.TestRunStatusCompleted {
+					if tr.Status != common.TestRunStatusCompleted && !resume {
 						if tr.Created.Before(time.Now().Add(-24 * time.Hour)) {
 							skip = true
 						}
@@ -203,6 +218,9 @@ func (t *TestRunManager) LoadAllTestRuns() {
 	for i := range runsToReschedule {
 		t.Reschedule(runsToReschedule[i])
 	}
+	for i := range runsToResume {
+		go t.ResumeSoakTest(runsToResume[i])
+	}
 
 	t.testRunsLock.Lock()
 	t.loadComplete = true
@@ -0,0 +1,333 @@
+package testruns
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+)
+
+// PlacementSlot is an agent running one or more roles of a test run
+type PlacementSlot struct {
+	// The connected agent the roles run on, or -1 if a new AWS agent is
+	// spawned for them or an agent of their pool is yet to be chosen
+	AgentID             int32                   `json:"agentID"`
+	AgentPool           string                  `json:"agentPool,omitempty"`
+	AwsLaunchTemplateID string                  `json:"awsLaunchTemplateID"`
+	InstanceType        string                  `json:"instanceType"`
+	Region              string                  `json:"region"`
+	Architecture        string                  `json:"architecture"`
+	Roles               []common.TestRunRoleRef `json:"roles"`
+	// The number of accelerators of each kind the agent has, -1 if the
+	// launch template doesn't specify how many
+	Accelerators map[string]int `json:"accelerators"`
+	// Set if any of the roles was placed in the slot manually
+	Manual bool `json:"manual"`
+}
+
+// TestRunPlacement is the assignment of the roles of a test run to agents
+type TestRunPlacement struct {
+	Slots   []PlacementSlot          `json:"slots"`
+	Changes []common.PlacementChange `json:"changes"`
+}
+
+// findRole returns the role of the test run the reference refers to
+func findRole(
+	roles []*common.TestRunRole,
+	ref common.TestRunRoleRef,
+) *common.TestRunRole {
+	for _, r := range roles {
+		if r.Role == ref.Role && r.Index == ref.Index {
+			return r
+		}
+	}
+	return nil
+}
+
+// hostRole follows the colocations of the role to the role that determines
+// the agent it runs on. Returns an error if the colocations form a cycle or
+// refer to roles that do not exist
+func hostRole(
+	roles []*common.TestRunRole,
+	r *common.TestRunRole,
+) (*common.TestRunRole, error) {
+	host := r
+	for i := 0; host.ColocateWith != nil; i++ {
+		if i == len(roles) {
+			return nil, fmt.Errorf(
+				"Colocation of %s %d is circular",
+				r.Role,
+				r.Index,
+			)
+		}
+		next := findRole(roles, *host.ColocateWith)
+		if next == nil {
+			return nil, fmt.Errorf(
+				"%s %d is colocated with %s %d, which does not exist",
+				host.Role,
+				host.Index,
+				host.ColocateWith.Role,
+				host.ColocateWith.Index,
+			)
+		}
+		host = next
+	}
+	return host, nil
+}
+
+// syncColocatedRoles copies the agent and launch template of the host roles
+// to the roles colocated with them. Colocated roles are never spawned
+// themselves, but need the launch template to determine their region and
+// architecture
+func syncColocatedRoles(roles []*common.TestRunRole) {
+	for _, r := range roles {
+		if r.ColocateWith == nil {
+			continue
+		}
+		host, err := hostRole(roles, r)
+		if err != nil {
+			continue
+		}
+		r.AgentID = host.AgentID
+		r.AwsLaunchTemplateID = host.AwsLaunchTemplateID
+	}
+}
+
+// Placement returns the agents the roles of the test run are (to be) placed
+// on. Before the test run starts, roles without an agent are on a slot of
+// their own, since the scheduler spawns a new AWS agent for each of them
+func (t *TestRunManager) Placement(tr *common.TestRun) TestRunPlacement {
+	slots := []PlacementSlot{}
+	slotIdx := map[interface{}]int{}
+	for _, r := range tr.Roles {
+		host, err := hostRole(tr.Roles, r)
+		if err != nil {
+			host = r
+		}
+		// Roles on the same connected agent share a slot, unspawned roles
+		// share the slot of their host role
+		var key interface{} = host
+		if host.AgentID > 0 {
+			key = host.AgentID
+		}
+		i, ok := slotIdx[key]
+		if !ok {
+			lt, _ := t.awsm.GetLaunchTemplate(host.AwsLaunchTemplateID)
+			slots = append(slots, PlacementSlot{
+				AgentID:             host.AgentID,
+				AgentPool:           host.AgentPool,
+				AwsLaunchTemplateID: host.AwsLaunchTemplateID,
+				InstanceType:        lt.InstanceType,
+				Region:              lt.Region,
+				Architecture:        t.roleArchitecture(host),
+				Accelerators:        t.agentAccelerators(host),
+				Roles:               []common.TestRunRoleRef{},
+			})
+			i = len(slots) - 1
+			slotIdx[key] = i
+		}
+		slots[i].Roles = append(
+			slots[i].Roles,
+			common.TestRunRoleRef{Role: r.Role, Index: r.Index},
+		)
+		slots[i].Manual = slots[i].Manual || r.ManualPlacement
+	}
+	changes := tr.PlacementChanges
+	if changes == nil {
+		changes = []common.PlacementChange{}
+	}
+	return TestRunPlacement{Slots: slots, Changes: changes}
+}
+
+// agentInUse returns the test run other than tr that is running on the agent,
+// if any
+func (t *TestRunManager) agentInUse(
+	tr *common.TestRun,
+	agentID int32,
+) *common.TestRun {
+	for _, other := range t.GetTestRuns() {
+		if other == tr || other.Status != common.TestRunStatusRunning {
+			continue
+		}
+		for _, r := range other.Roles {
+			if r.AgentID == agentID {
+				return other
+			}
+		}
+	}
+	return nil
+}
+
+// rolePorts returns the ports the role may listen on: its default port, and
+// the RAFT and client ports derived from it
+func rolePorts(r *common.TestRunRole) []int {
+	base, ok := portNums[r.Role]
+	if !ok {
+		return []int{}
+	}
+	return []int{
+		base + int(PortIncrementDefaultPort),
+		base + int(PortIncrementRaftPort),
+		base + int(PortIncrementClientPort),
+	}
+}
+
+// validatePlacement checks that the roles can run on the agents they are
+// placed on. The port numbers in the generated configuration assume every
+// role has an agent of its own, so roles that share an agent cannot listen on
+// overlapping ports
+func validatePlacement(roles []*common.TestRunRole) error {
+	ports := map[interface{}]map[int]*common.TestRunRole{}
+	for _, r := range roles {
+		host, err := hostRole(roles, r)
+		if err != nil {
+			return err
+		}
+		var key interface{} = host
+		if host.AgentID > 0 {
+			key = host.AgentID
+		}
+		if _, ok := ports[key]; !ok {
+			ports[key] = map[int]*common.TestRunRole{}
+		}
+		for _, p := range rolePorts(r) {
+			if other, ok := ports[key][p]; ok {
+				return fmt.Errorf(
+					"%s %d and %s %d cannot share an agent, both listen on port %d",
+					other.Role,
+					other.Index,
+					r.Role,
+					r.Index,
+					p,
+				)
+			}
+			ports[key][p] = r
+		}
+	}
+	return nil
+}
+
+// errPlacementStarted is returned when the placement of a test run is changed
+// after it started
+var errPlacementStarted = errors.New(
+	"Placement can only be changed before the test run starts",
+)
+
+// ChangePlacement applies manual changes to the placement of the roles of a
+// queued test run. The changes are validated together and either all applied
+// or none, and recorded in the test run along with the user that made them.
+// The scheduler starts test runs under testRunsLock, so the roles are copied
+// and replaced under it as well
+func (t *TestRunManager) ChangePlacement(
+	tr *common.TestRun,
+	changes []common.PlacementChange,
+	userThumbprint string,
+) error {
+	// Apply the changes to a copy of the roles, such that a failed
+	// validation leaves the test run untouched
+	t.testRunsLock.Lock()
+	if tr.Status != common.TestRunStatusQueued {
+		t.testRunsLock.Unlock()
+		return errPlacementStarted
+	}
+	roles := make([]*common.TestRunRole, len(tr.Roles))
+	for i, r := range tr.Roles {
+		c := *r
+		roles[i] = &c
+	}
+	t.testRunsLock.Unlock()
+
+	now := time.Now()
+	for i, c := range changes {
+		r := findRole(roles, common.TestRunRoleRef{Role: c.Role, Index: c.Index})
+		if r == nil {
+			return fmt.Errorf("The test run has no role %s %d", c.Role, c.Index)
+		}
+		targets := 0
+		if c.AgentID > 0 {
+			targets++
+		}
+		if c.AwsLaunchTemplateID != "" {
+			targets++
+		}
+		if c.ColocateWith != nil {
+			targets++
+		}
+		if targets != 1 {
+			return fmt.Errorf(
+				"Placement of %s %d needs exactly one of an agent, a launch template or a role to colocate with",
+				c.Role,
+				c.Index,
+			)
+		}
+
+		r.ManualPlacement = true
+		r.ColocateWith = nil
+		r.AgentPool = ""
+		r.AwsAgentInstanceId = ""
+		switch {
+		case c.AgentID > 0:
+			a, err := t.coord.GetAgent(c.AgentID)
+			if err != nil {
+				return fmt.Errorf("Agent %d is not connected", c.AgentID)
+			}
+			if other := t.agentInUse(tr, a.ID); other != nil {
+				return fmt.Errorf(
+					"Agent %d is in use by test run %s",
+					a.ID,
+					other.ID,
+				)
+			}
+			r.AgentID = a.ID
+			r.AwsLaunchTemplateID = ""
+		case c.AwsLaunchTemplateID != "":
+			_, err := t.awsm.GetLaunchTemplate(c.AwsLaunchTemplateID)
+			if err != nil {
+				return fmt.Errorf(
+					"Launch template %s does not exist",
+					c.AwsLaunchTemplateID,
+				)
+			}
+			r.AgentID = -1
+			r.AwsLaunchTemplateID = c.AwsLaunchTemplateID
+		default:
+			if findRole(roles, *c.ColocateWith) == nil {
+				return fmt.Errorf(
+					"The test run has no role %s %d",
+					c.ColocateWith.Role,
+					c.ColocateWith.Index,
+				)
+			}
+			ref := *c.ColocateWith
+			r.ColocateWith = &ref
+		}
+		changes[i].UserThumbprint = userThumbprint
+		changes[i].Applied = now
+	}
+
+	syncColocatedRoles(roles)
+	err := validatePlacement(roles)
+	if err != nil {
+		return err
+	}
+	if errs := t.validateAccelerators(roles); len(errs) > 0 {
+		return errs[0]
+	}
+
+	t.testRunsLock.Lock()
+	if tr.Status != common.TestRunStatusQueued {
+		t.testRunsLock.Unlock()
+		return errPlacementStarted
+	}
+	for i, r := range roles {
+		*tr.Roles[i] = *r
+	}
+	tr.PlacementChanges = append(tr.PlacementChanges, changes...)
+	t.testRunsLock.Unlock()
+	for _, c := range changes {
+		t.WriteLog(tr, "Placement of %s %d changed manually", c.Role, c.Index)
+	}
+	t.PersistTestRun(tr)
+	return nil
+}
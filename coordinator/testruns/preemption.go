@@ -0,0 +1,225 @@
+package testruns
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// PreemptionConfig configures the preemption mode, in which a queued test run
+// of a high priority that can't start for lack of capacity aborts running
+// test runs of a lower priority. The aborted test runs are requeued
+// automatically
+type PreemptionConfig struct {
+	// Enables preemption
+	Enabled bool `json:"enabled"`
+	// The minimum priority of a test run to preempt others
+	MinPriority int `json:"minPriority"`
+}
+
+// SetPreemptionConfig changes the preemption configuration and persists it
+func (t *TestRunManager) SetPreemptionConfig(cfg PreemptionConfig) error {
+	t.configLock.Lock()
+	t.config.Preemption = cfg
+	t.configLock.Unlock()
+	return t.PersistConfig()
+}
+
+// Validate checks that only test runs of a priority above normal can preempt
+// others
+func (cfg PreemptionConfig) Validate() error {
+	if cfg.Enabled && cfg.MinPriority <= common.TestRunPriorityNormal {
+		return fmt.Errorf(
+			"The minimum priority to preempt must be above %d",
+			common.TestRunPriorityNormal,
+		)
+	}
+	return nil
+}
+
+// pendingPreemption returns the preemption of the test run that was not
+// handled yet, if any
+func (t *TestRunManager) pendingPreemption(
+	tr *common.TestRun,
+) (common.Preemption, bool) {
+	t.preemptionsLock.Lock()
+	defer t.preemptionsLock.Unlock()
+	if len(tr.Preemptions) == 0 {
+		return common.Preemption{}, false
+	}
+	p := tr.Preemptions[len(tr.Preemptions)-1]
+	return p, p.RequeuedAs == ""
+}
+
+// setRequeuedAs records the ID of the test run the pending preemption of the
+// test run was requeued as
+func (t *TestRunManager) setRequeuedAs(tr *common.TestRun, id string) {
+	t.preemptionsLock.Lock()
+	defer t.preemptionsLock.Unlock()
+	tr.Preemptions[len(tr.Preemptions)-1].RequeuedAs = id
+}
+
+// preemptFor aborts running test runs of a lower priority than the queued
+// test run, such that the capacity they free up allows the test run to
+// start. Runs are only preempted if that frees up enough capacity, lowest
+// priority and most recently started first. Returns true if the test run is
+// waiting for preempted runs to stop. Must be called with testRunsLock held
+func (t *TestRunManager) preemptFor(
+	tr *common.TestRun,
+	runningVCPUs map[string]int32,
+	runningAgents int,
+) bool {
+	cfg := t.Config()
+	if !cfg.Preemption.Enabled || tr.Priority < cfg.Preemption.MinPriority {
+		return false
+	}
+
+	candidates := []*common.TestRun{}
+	for _, r := range t.testRuns {
+		if r.Status != common.TestRunStatusRunning || r.AWSInstancesStopped {
+			continue
+		}
+		if p, ok := t.pendingPreemption(r); ok {
+			if p.PreemptedBy == tr.ID {
+				// Still waiting for an earlier preemption
+				return true
+			}
+			continue
+		}
+		if r.Priority < tr.Priority {
+			candidates = append(candidates, r)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Priority != candidates[j].Priority {
+			return candidates[i].Priority < candidates[j].Priority
+		}
+		return candidates[i].Started.After(candidates[j].Started)
+	})
+
+	required := t.GetRequiredVCPUs(tr)
+	vcpus := map[string]int32{}
+	for k, v := range runningVCPUs {
+		vcpus[k] = v
+	}
+	agents := runningAgents
+	fits := func() bool {
+		if agents+len(tr.Roles) > cfg.MaxAgents {
+			return false
+		}
+		for k, v := range required {
+			if vcpus[k]+v > t.awsm.GetVCPULimit(k) {
+				return false
+			}
+		}
+		return true
+	}
+
+	victims := []*common.TestRun{}
+	for _, c := range candidates {
+		if fits() {
+			break
+		}
+		victims = append(victims, c)
+		agents -= len(c.Roles)
+		for k, v := range t.GetRequiredVCPUs(c) {
+			vcpus[k] -= v
+		}
+	}
+	if len(victims) == 0 || !fits() {
+		return false
+	}
+
+	for _, v := range victims {
+		t.preemptionsLock.Lock()
+		v.Preemptions = append(v.Preemptions, common.Preemption{
+			PreemptedBy: tr.ID,
+			Preempted:   time.Now(),
+		})
+		t.preemptionsLock.Unlock()
+		t.WriteLog(
+			v,
+			"Preempted by test run %s of priority %d, aborting",
+			tr.ID,
+			tr.Priority,
+		)
+		t.PersistTestRun(v)
+		select {
+		case v.TerminateChan <- true:
+		default:
+		}
+		t.WriteLog(tr, "Preempting test run %s of priority %d", v.ID, v.Priority)
+	}
+	return true
+}
+
+// reserveCapacity adds the vCPUs the test run requires to the tally, and
+// returns the number of agents it requires. The capacity freed up by
+// preempted runs is reserved like this, such that test runs of a lower
+// priority don't take it before the test run that preempted them can start
+func (t *TestRunManager) reserveCapacity(
+	tr *common.TestRun,
+	vcpus map[string]int32,
+) int {
+	for k, v := range t.GetRequiredVCPUs(tr) {
+		vcpus[k] += v
+	}
+	return len(tr.Roles)
+}
+
+// requeuePreempted schedules a copy of a test run that was preempted, once its
+// execution has ended. Test runs that completed before they could be aborted
+// are not requeued
+func (t *TestRunManager) requeuePreempted(tr *common.TestRun) {
+	p, ok := t.pendingPreemption(tr)
+	if !ok {
+		return
+	}
+	if tr.Status == common.TestRunStatusCompleted {
+		t.WriteLog(tr, "Completed before it could be preempted")
+		t.setRequeuedAs(tr, "-")
+		t.PersistTestRun(tr)
+		return
+	}
+	t.UpdateStatus(
+		tr,
+		common.TestRunStatusAborted,
+		fmt.Sprintf("Preempted by test run %s", p.PreemptedBy),
+	)
+
+	var newTr common.TestRun
+	t.preemptionsLock.Lock()
+	b, err := json.Marshal(tr)
+	t.preemptionsLock.Unlock()
+	if err == nil {
+		err = json.Unmarshal(b, &newTr)
+	}
+	if err != nil {
+		logging.Warnf("Could not copy preempted test run %s: %v", tr.ID, err)
+		return
+	}
+	for i := range newTr.Roles {
+		// Roles manually placed on a connected agent keep their agent
+		if newTr.Roles[i].ManualPlacement &&
+			newTr.Roles[i].AwsLaunchTemplateID == "" {
+			continue
+		}
+		newTr.Roles[i].AgentID = -1
+	}
+	newTr.Failovers = nil
+	newTr.FaultTimeline = nil
+	newTr.Result = nil
+	newTr.PerformanceDataAvailable = false
+	t.ScheduleTestRun(&newTr)
+
+	// The copy carries the history of preemptions, which includes this one
+	t.setRequeuedAs(tr, newTr.ID)
+	t.setRequeuedAs(&newTr, newTr.ID)
+	t.PersistTestRun(&newTr)
+	t.WriteLog(tr, "Requeued as test run %s", newTr.ID)
+	t.PersistTestRun(tr)
+}
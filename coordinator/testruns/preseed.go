@@ -97,6 +97,7 @@ func (t *TestRunManager) PreseedShards(
 				Unpack:        true,
 				FlatUnpack:    true,
 				UnpackNoDir:   tarCreateNoDir,
+				SeedData:      true,
 			},
 			10*time.Minute,
 		)
@@ -237,6 +238,7 @@ func (t *TestRunManager) CheckPreseed(tr *common.TestRun, cfg []byte) error {
 		SeedMode:   seedMode,
 		Shards:     numShards,
 		CommitHash: tr.SeederHash,
+		Value:      awsmgr.DefaultSeedValue,
 		TestRunID:  tr.ID,
 	}
 	hasSeed, err := t.awsm.HasSeed(wantSeed, false)
@@ -244,13 +246,21 @@ func (t *TestRunManager) CheckPreseed(tr *common.TestRun, cfg []byte) error {
 		return fmt.Errorf("error checking preseed existence: %v", err)
 	}
 
-	if !hasSeed {
+	if hasSeed {
+		t.awsm.RecordSeedLookup(wantSeed, awsmgr.SeedLookupHit)
+		t.WriteLog(tr, "Reusing cached preseed %s", wantSeed.CacheKey())
+	} else {
 		t.UpdateStatus(tr, common.TestRunStatusRunning, "Generating preseed")
 		hasSeed, err := t.awsm.HasSeed(wantSeed, true)
 		if err != nil {
 			return fmt.Errorf("error checking preseed existence: %v", err)
 		}
-		if !hasSeed {
+		if hasSeed {
+			// Another test run (such as another point in the same sweep) is
+			// generating the same seed already
+			t.awsm.RecordSeedLookup(wantSeed, awsmgr.SeedLookupShared)
+		} else {
+			t.awsm.RecordSeedLookup(wantSeed, awsmgr.SeedLookupMiss)
 			err := t.awsm.GenerateSeed(wantSeed, cfg)
 			if err != nil {
 				return fmt.Errorf("error generating preseed: %v", err)
@@ -0,0 +1,115 @@
+package testruns
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+)
+
+// resultCalculationScript returns the path to the result calculation script,
+// which is expected to be placed next to the main coordinator assembly
+func resultCalculationScript() (string, error) {
+	exeDir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(exeDir, "calculate_results.py"), nil
+}
+
+// pipelineScriptHash returns the hex encoded SHA-256 hash of the result
+// calculation script, or an empty string if the script cannot be read
+func pipelineScriptHash(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// stampResultProvenance records the controller version, result schema version
+// and pipeline version on the freshly calculated result of the test run and
+// writes the result back to disk. The provenance of the result it replaces
+// (if any) is preserved in the history
+func (t *TestRunManager) stampResultProvenance(
+	tr *common.TestRun,
+	previous *common.TestResultProvenance,
+	calcScript string,
+) error {
+	prov := &common.TestResultProvenance{
+		ControllerVersion:   t.commitHash,
+		ResultSchemaVersion: TestResultVersion,
+		PipelineVersion:     ResultPipelineVersion,
+		PipelineScriptHash:  pipelineScriptHash(calcScript),
+		Calculated:          time.Now(),
+		History:             []common.TestResultProvenance{},
+	}
+	if previous != nil {
+		prov.History = append(prov.History, previous.History...)
+		old := *previous
+		old.History = nil
+		prov.History = append(prov.History, old)
+	}
+	tr.Result.Provenance = prov
+
+	f, err := os.OpenFile(
+		filepath.Join(
+			common.DataDir(),
+			fmt.Sprintf("testruns/%s", tr.ID),
+			fmt.Sprintf("results%d.json", TestResultVersion),
+		),
+		os.O_CREATE|os.O_WRONLY|os.O_TRUNC,
+		0644,
+	)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(tr.Result)
+}
+
+// IsResultOutdated returns true if the test run's result was calculated by an
+// older version of the results pipeline than the one currently deployed, or if
+// it was calculated before provenance was recorded
+func (t *TestRunManager) IsResultOutdated(tr *common.TestRun) bool {
+	if tr.Result == nil {
+		return false
+	}
+	prov := tr.Result.Provenance
+	if prov == nil || prov.PipelineVersion < ResultPipelineVersion {
+		return true
+	}
+	calcScript, err := resultCalculationScript()
+	if err != nil {
+		return false
+	}
+	hash := pipelineScriptHash(calcScript)
+	return hash != "" && prov.PipelineScriptHash != hash
+}
+
+// ReprocessOutdatedResults starts a re-processing job for all completed test
+// runs for which IsResultOutdated returns true
+func (t *TestRunManager) ReprocessOutdatedResults(
+	createdBy string,
+) (ReprocessJob, error) {
+	outdated := []string{}
+	for _, tr := range t.GetTestRuns() {
+		if tr.Status == common.TestRunStatusCompleted &&
+			t.IsResultOutdated(tr) {
+			outdated = append(outdated, tr.ID)
+		}
+	}
+	return t.StartReprocessJob(outdated, createdBy)
+}
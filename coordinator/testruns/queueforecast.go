@@ -0,0 +1,409 @@
+package testruns
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+)
+
+// defaultRunOverhead is the time a test run is assumed to spend launching
+// agents, deploying binaries and collecting results on top of generating load,
+// if there are no historical runs of its architecture to estimate it from
+const defaultRunOverhead = 15 * time.Minute
+
+// overdueRunMargin is the time a running test run that is already past its
+// estimated duration is assumed to still need
+const overdueRunMargin = 5 * time.Minute
+
+// maxDurationHistory is the number of most recent completed test runs of a
+// similar configuration the duration of a test run is estimated from
+const maxDurationHistory = 20
+
+// DurationBasis indicates what the estimated duration of a test run in the
+// queue forecast is based on
+type DurationBasis string
+
+// DurationBasisLayout means the duration is the median of completed runs with
+// the same architecture, role layout and load duration
+const DurationBasisLayout DurationBasis = "layout"
+
+// DurationBasisArchitecture means the duration is the load duration plus the
+// median overhead of completed runs with the same architecture
+const DurationBasisArchitecture DurationBasis = "architecture"
+
+// DurationBasisDefault means there were no completed runs of the architecture,
+// and the duration is the load duration plus a default overhead
+const DurationBasisDefault DurationBasis = "default"
+
+// QueueForecastEntry is the projection for a single running or queued test run
+type QueueForecastEntry struct {
+	TestRunID string               `json:"testRunID"`
+	Status    common.TestRunStatus `json:"status"`
+	Priority  int                  `json:"priority"`
+	Agents    int                  `json:"agents"`
+	// The projected start and end, and the estimated duration in seconds. A
+	// running test run has its actual start time. Zero if the test run is
+	// blocked
+	ProjectedStart    time.Time     `json:"projectedStart"`
+	ProjectedEnd      time.Time     `json:"projectedEnd"`
+	EstimatedDuration float64       `json:"estimatedDuration"`
+	DurationBasis     DurationBasis `json:"durationBasis"`
+	// The number of historical runs the duration was estimated from
+	HistorySamples int `json:"historySamples"`
+	// The reason the test run cannot be projected to start, if any
+	Blocked string `json:"blocked,omitempty"`
+}
+
+// QueueForecast projects when the queued test runs start based on the
+// estimated durations of the running and queued test runs and the capacity
+// the scheduler is allowed to use
+type QueueForecast struct {
+	Generated time.Time `json:"generated"`
+	MaxAgents int       `json:"maxAgents"`
+	// Set if the coordinator is in maintenance mode. The projection assumes it
+	// is lifted right away
+	Maintenance bool                 `json:"maintenance"`
+	Running     []QueueForecastEntry `json:"running"`
+	Queued      []QueueForecastEntry `json:"queued"`
+}
+
+// runDuration returns the wall clock duration of a completed test run
+func runDuration(tr *common.TestRun) time.Duration {
+	return tr.Completed.Sub(tr.Started)
+}
+
+// roleLayout describes the number of roles of each type of the test run, such
+// as "shard:4,sentinel:2"
+func roleLayout(tr *common.TestRun) string {
+	counts := map[common.SystemRole]int{}
+	for _, r := range tr.Roles {
+		counts[r.Role]++
+	}
+	layout := []string{}
+	for role, n := range counts {
+		layout = append(layout, fmt.Sprintf("%s:%d", role, n))
+	}
+	sort.Strings(layout)
+	return strings.Join(layout, ",")
+}
+
+// medianDuration returns the median of the durations
+func medianDuration(d []time.Duration) time.Duration {
+	sort.Slice(d, func(i, j int) bool { return d[i] < d[j] })
+	if len(d)%2 == 1 {
+		return d[len(d)/2]
+	}
+	return (d[len(d)/2-1] + d[len(d)/2]) / 2
+}
+
+// durationEstimator estimates the duration of test runs from the completed
+// test runs
+type durationEstimator struct {
+	t         *TestRunManager
+	completed []*common.TestRun
+}
+
+// newDurationEstimator creates an estimator from the completed test runs in
+// the list, most recent first
+func (t *TestRunManager) newDurationEstimator(
+	runs []*common.TestRun,
+) *durationEstimator {
+	e := &durationEstimator{t: t, completed: []*common.TestRun{}}
+	for _, tr := range runs {
+		if tr.Status == common.TestRunStatusCompleted &&
+			!tr.Started.IsZero() && runDuration(tr) > 0 {
+			e.completed = append(e.completed, tr)
+		}
+	}
+	sort.Slice(e.completed, func(i, j int) bool {
+		return e.completed[i].Completed.After(e.completed[j].Completed)
+	})
+	return e
+}
+
+// estimate returns the estimated duration of the test run, what it is based
+// on, and the number of historical runs it was estimated from
+func (e *durationEstimator) estimate(
+	tr *common.TestRun,
+) (time.Duration, DurationBasis, int) {
+	load := e.t.loadDuration(tr)
+	layout := roleLayout(tr)
+	same := []time.Duration{}
+	overheads := []time.Duration{}
+	for _, c := range e.completed {
+		if c.Architecture != tr.Architecture {
+			continue
+		}
+		if len(same) < maxDurationHistory && roleLayout(c) == layout &&
+			e.t.loadDuration(c) == load {
+			same = append(same, runDuration(c))
+		}
+		if len(overheads) < maxDurationHistory {
+			overhead := runDuration(c) - e.t.loadDuration(c)
+			if overhead < 0 {
+				overhead = 0
+			}
+			overheads = append(overheads, overhead)
+		}
+	}
+	if len(same) > 0 {
+		return medianDuration(same), DurationBasisLayout, len(same)
+	}
+	if len(overheads) > 0 {
+		return load + medianDuration(overheads),
+			DurationBasisArchitecture,
+			len(overheads)
+	}
+	return load + defaultRunOverhead, DurationBasisDefault, 0
+}
+
+// forecastCapacity tracks the agents and vCPUs in use during the simulation
+// of the queue
+type forecastCapacity struct {
+	t         *TestRunManager
+	maxAgents int
+	agents    int
+	vcpus     map[string]int32
+	quotas    *quotaUsage
+}
+
+// fits returns true if the test run can start with the capacity in use
+func (c *forecastCapacity) fits(tr *common.TestRun) bool {
+	if c.agents+len(tr.Roles) > c.maxAgents {
+		return false
+	}
+	vcpus := c.t.GetRequiredVCPUs(tr)
+	for k, v := range vcpus {
+		if c.vcpus[k]+v > c.t.awsm.GetVCPULimit(k) {
+			return false
+		}
+	}
+	return c.quotas.blocked(tr, totalVCPUs(vcpus)) == ""
+}
+
+// add claims (or with sign -1 releases) the capacity of the test run
+func (c *forecastCapacity) add(tr *common.TestRun, sign int) {
+	c.agents += sign * len(tr.Roles)
+	vcpus := c.t.GetRequiredVCPUs(tr)
+	for k, v := range vcpus {
+		c.vcpus[k] += int32(sign) * v
+	}
+	c.quotas.add(tr, totalVCPUs(vcpus), sign)
+}
+
+// neverFits returns the reason the test run can never start with the
+// configured limits, or the empty string if it can
+func (c *forecastCapacity) neverFits(tr *common.TestRun) string {
+	if len(tr.Roles) > c.maxAgents {
+		return fmt.Sprintf(
+			"Needs %d agents, the limit is %d",
+			len(tr.Roles),
+			c.maxAgents,
+		)
+	}
+	vcpus := c.t.GetRequiredVCPUs(tr)
+	for k, v := range vcpus {
+		if limit := c.t.awsm.GetVCPULimit(k); v > limit {
+			return fmt.Sprintf(
+				"Needs %d vCPUs in %s, the limit is %d",
+				v,
+				k,
+				limit,
+			)
+		}
+	}
+	return c.quotas.neverFits(tr, totalVCPUs(vcpus))
+}
+
+// QueueForecast projects the start time of each queued test run. It simulates
+// the scheduler: queued runs start in priority order once their dependencies
+// ended and the agents and vCPUs they need are available within the quotas
+// of the user that scheduled them, and each run is assumed to take as long as
+// similar runs took historically. Runs that are held in the queue are
+// reported as blocked
+func (t *TestRunManager) QueueForecast() *QueueForecast {
+	now := time.Now()
+	runs := t.GetTestRuns()
+	est := t.newDurationEstimator(runs)
+	ret := &QueueForecast{
+		Generated:   now,
+		MaxAgents:   t.config.MaxAgents,
+		Maintenance: t.coord.GetMaintenance(),
+		Running:     []QueueForecastEntry{},
+		Queued:      []QueueForecastEntry{},
+	}
+	capacity := &forecastCapacity{
+		t:         t,
+		maxAgents: t.config.MaxAgents,
+		vcpus:     map[string]int32{},
+		quotas:    t.newQuotaUsage(),
+	}
+
+	// The projected end of the running and started test runs, by ID
+	ends := map[string]time.Time{}
+	for _, tr := range runs {
+		if tr.Status != common.TestRunStatusRunning {
+			continue
+		}
+		d, basis, n := est.estimate(tr)
+		end := tr.Started.Add(d)
+		if end.Before(now) {
+			end = now.Add(overdueRunMargin)
+		}
+		ends[tr.ID] = end
+		if !tr.AWSInstancesStopped {
+			capacity.add(tr, 1)
+		}
+		ret.Running = append(ret.Running, QueueForecastEntry{
+			TestRunID:         tr.ID,
+			Status:            tr.Status,
+			Priority:          tr.Priority,
+			Agents:            len(tr.Roles),
+			ProjectedStart:    tr.Started,
+			ProjectedEnd:      end,
+			EstimatedDuration: d.Seconds(),
+			DurationBasis:     basis,
+			HistorySamples:    n,
+		})
+	}
+
+	// Sort the queue like the scheduler does, and set aside the runs that
+	// cannot be projected
+	pending := []*common.TestRun{}
+	entries := map[string]*QueueForecastEntry{}
+	for _, tr := range runs {
+		if tr.Status != common.TestRunStatusQueued {
+			continue
+		}
+		d, basis, n := est.estimate(tr)
+		entries[tr.ID] = &QueueForecastEntry{
+			TestRunID:         tr.ID,
+			Status:            tr.Status,
+			Priority:          tr.Priority,
+			Agents:            len(tr.Roles),
+			EstimatedDuration: d.Seconds(),
+			DurationBasis:     basis,
+			HistorySamples:    n,
+		}
+		_, skip := t.dependencyState(tr)
+		switch {
+		case tr.AwaitingApproval:
+			entries[tr.ID].Blocked = "Awaiting approval"
+		case tr.SweepBudgetHold:
+			entries[tr.ID].Blocked = "Held by the sweep budget"
+		case skip != "":
+			entries[tr.ID].Blocked = skip
+		default:
+			entries[tr.ID].Blocked = capacity.neverFits(tr)
+		}
+		if entries[tr.ID].Blocked == "" {
+			pending = append(pending, tr)
+		}
+	}
+	sort.SliceStable(pending, func(i, j int) bool {
+		if pending[i].Priority != pending[j].Priority {
+			return pending[i].Priority > pending[j].Priority
+		}
+		return pending[i].Created.Before(pending[j].Created)
+	})
+
+	// Step through the moments at which runs end or become eligible, and
+	// start the runs that can start at each of them
+	active := map[string]*common.TestRun{}
+	for _, tr := range runs {
+		if tr.Status == common.TestRunStatusRunning && !tr.AWSInstancesStopped {
+			active[tr.ID] = tr
+		}
+	}
+	clock := now
+	for len(pending) > 0 {
+		for id, tr := range active {
+			if !ends[id].After(clock) {
+				capacity.add(tr, -1)
+				delete(active, id)
+			}
+		}
+
+		waiting := []*common.TestRun{}
+		for _, tr := range pending {
+			if !t.forecastEligible(tr, clock, ends) || !capacity.fits(tr) {
+				waiting = append(waiting, tr)
+				continue
+			}
+			e := entries[tr.ID]
+			e.ProjectedStart = clock
+			e.ProjectedEnd = clock.Add(
+				time.Duration(e.EstimatedDuration * float64(time.Second)),
+			)
+			ends[tr.ID] = e.ProjectedEnd
+			active[tr.ID] = tr
+			capacity.add(tr, 1)
+		}
+		pending = waiting
+
+		// Advance to the next moment something changes
+		next := time.Time{}
+		for id := range active {
+			if next.IsZero() || ends[id].Before(next) {
+				next = ends[id]
+			}
+		}
+		for _, tr := range pending {
+			if tr.DontRunBefore.After(clock) &&
+				(next.IsZero() || tr.DontRunBefore.Before(next)) {
+				next = tr.DontRunBefore
+			}
+		}
+		if next.IsZero() {
+			break
+		}
+		clock = next
+	}
+	for _, tr := range pending {
+		entries[tr.ID].Blocked = "Waiting for a dependency that is not queued"
+	}
+
+	for _, tr := range runs {
+		if e, ok := entries[tr.ID]; ok {
+			ret.Queued = append(ret.Queued, *e)
+		}
+	}
+	sort.SliceStable(ret.Queued, func(i, j int) bool {
+		a, b := ret.Queued[i], ret.Queued[j]
+		if a.ProjectedStart.IsZero() != b.ProjectedStart.IsZero() {
+			return !a.ProjectedStart.IsZero()
+		}
+		return a.ProjectedStart.Before(b.ProjectedStart)
+	})
+	return ret
+}
+
+// forecastEligible returns true if the queued test run may start at the given
+// time: it is allowed to run by then, and all of its dependencies are
+// projected to have ended. Dependencies are assumed to end as required
+func (t *TestRunManager) forecastEligible(
+	tr *common.TestRun,
+	at time.Time,
+	ends map[string]time.Time,
+) bool {
+	if !tr.DontRunBefore.IsZero() && tr.DontRunBefore.After(at) {
+		return false
+	}
+	for _, d := range tr.DependsOn {
+		dep, ok := t.GetTestRun(d.TestRunID)
+		if !ok {
+			return false
+		}
+		if isTerminalStatus(dep.Status) {
+			continue
+		}
+		end, ok := ends[dep.ID]
+		if !ok || end.After(at) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,194 @@
+package testruns
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+)
+
+// throughputDipPercent is the percentage of the median system throughput
+// below which a second is considered a throughput dip
+const throughputDipPercent = 50
+
+// queueSampleFile is a queue sample file in the outputs of a test run
+type queueSampleFile struct {
+	path  string
+	role  common.SystemRole
+	index int
+}
+
+// queueSampleFiles returns the files in the outputs of the test run that the
+// metrics parsers of its architecture read as SampleFormatQueue. Returns
+// nothing if the system under test didn't report queue metrics
+func (t *TestRunManager) queueSampleFiles(
+	tr *common.TestRun,
+) ([]queueSampleFile, error) {
+	outputsDir := filepath.Join(
+		common.DataDir(),
+		fmt.Sprintf("testruns/%s/outputs", tr.ID),
+	)
+	entries, err := ioutil.ReadDir(outputsDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []queueSampleFile{}, nil
+		}
+		return nil, err
+	}
+
+	parsers := t.metricsParsers(tr)
+	files := make([]queueSampleFile, 0)
+	for _, e := range entries {
+		if e.IsDir() ||
+			sampleFileFormat(parsers, e.Name()) != SampleFormatQueue {
+			continue
+		}
+		if r, _ := roleForOutputFile(tr, e.Name()); r != nil {
+			files = append(files, queueSampleFile{
+				path:  filepath.Join(outputsDir, e.Name()),
+				role:  r.Role,
+				index: r.Index,
+			})
+		}
+	}
+	return files, nil
+}
+
+// throughputDips returns the seconds between first and last in which the
+// system throughput was below throughputDipPercent of its median, along with
+// that threshold
+func throughputDips(
+	tps map[int64]float64,
+	first, last int64,
+) (map[int64]bool, float64) {
+	vals := make([]float64, 0, last-first+1)
+	for sec := first; sec <= last; sec++ {
+		vals = append(vals, tps[sec])
+	}
+	sort.Float64s(vals)
+	threshold := vals[len(vals)/2] * throughputDipPercent / 100
+
+	dips := map[int64]bool{}
+	for sec := first; sec <= last; sec++ {
+		if tps[sec] < threshold {
+			dips[sec] = true
+		}
+	}
+	return dips, threshold
+}
+
+// queueResult summarizes the queue metrics reported by the roles of the test
+// run, and correlates them with the dips in the system throughput. Returns
+// nil if the system under test didn't report queue metrics
+func (t *TestRunManager) queueResult(
+	tr *common.TestRun,
+) (*common.QueueResult, error) {
+	files, err := t.queueSampleFiles(tr)
+	if err != nil || len(files) == 0 {
+		return nil, err
+	}
+	tps, first, last, err := systemThroughput(tr)
+	if err != nil {
+		return nil, err
+	}
+	dips, threshold := throughputDips(tps, first, last)
+	res := &common.QueueResult{
+		Dips:         len(dips),
+		DipThreshold: threshold,
+		Roles:        []common.QueueRoleResult{},
+	}
+
+	for _, f := range files {
+		depthSum := map[int64]float64{}
+		depthCount := map[int64]float64{}
+		rr := common.QueueRoleResult{Role: f.role, Index: f.index}
+		var samples, sampledFrom, sampledUntil float64
+		err = readSampleFile(f.path, 3, func(fields []float64) error {
+			if fields[0] <= minTxSampleTime {
+				return nil
+			}
+			if samples == 0 {
+				sampledFrom = fields[0]
+			}
+			sampledUntil = fields[0]
+			samples++
+			rr.DepthAvg += fields[1]
+			rr.DepthMax = math.Max(rr.DepthMax, fields[1])
+			rr.BlockedTime += fields[2] / 1e9
+			sec := int64(fields[0] / 1e9)
+			depthSum[sec] += fields[1]
+			depthCount[sec]++
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Error reading %s: %v", f.path, err)
+		}
+		if samples == 0 {
+			continue
+		}
+		rr.DepthAvg /= samples
+		if sampledUntil > sampledFrom {
+			rr.BlockedPct = rr.BlockedTime /
+				((sampledUntil - sampledFrom) / 1e9) * 100
+		}
+
+		// Correlate the average depth in each second with the throughput in
+		// that second, over the seconds both are known for
+		var dipSum, dipN, normalSum, normalN float64
+		xs, ys := []float64{}, []float64{}
+		for sec := first; sec <= last; sec++ {
+			if depthCount[sec] == 0 {
+				continue
+			}
+			depth := depthSum[sec] / depthCount[sec]
+			if dips[sec] {
+				dipSum += depth
+				dipN++
+			} else {
+				normalSum += depth
+				normalN++
+			}
+			xs = append(xs, depth)
+			ys = append(ys, tps[sec])
+		}
+		if dipN > 0 {
+			rr.DipDepthAvg = dipSum / dipN
+		}
+		if normalN > 0 {
+			rr.NormalDepthAvg = normalSum / normalN
+		}
+		rr.ThroughputCorrelation = pearsonCorrelation(xs, ys)
+		res.Roles = append(res.Roles, rr)
+	}
+	return res, nil
+}
+
+// pearsonCorrelation returns the correlation coefficient of the two series,
+// or zero if either of them is constant
+func pearsonCorrelation(xs, ys []float64) float64 {
+	n := float64(len(xs))
+	if n < 2 {
+		return 0
+	}
+	var avgX, avgY float64
+	for i := range xs {
+		avgX += xs[i]
+		avgY += ys[i]
+	}
+	avgX /= n
+	avgY /= n
+	var cov, varX, varY float64
+	for i := range xs {
+		cov += (xs[i] - avgX) * (ys[i] - avgY)
+		varX += math.Pow(xs[i]-avgX, 2)
+		varY += math.Pow(ys[i]-avgY, 2)
+	}
+	if varX == 0 || varY == 0 {
+		return 0
+	}
+	return cov / math.Sqrt(varX*varY)
+}
@@ -0,0 +1,270 @@
+package testruns
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+)
+
+// QuotaLimit limits the test runs a user or team can have running at the same
+// time, and the EC2 vCPUs these can use together. Zero means unlimited
+type QuotaLimit struct {
+	MaxRuns  int   `json:"maxRuns"`
+	MaxVCPUs int32 `json:"maxVCPUs"`
+}
+
+// TeamQuota limits the test runs of the members of a team together, on top
+// of the limits of the members themselves
+type TeamQuota struct {
+	Name string `json:"name"`
+	// The thumbprints of the users in the team
+	Members []string   `json:"members"`
+	Limit   QuotaLimit `json:"limit"`
+}
+
+// QuotaConfig configures the quotas enforced by the scheduler, such that a
+// single user's large sweep can't occupy all capacity. Test runs that exceed
+// a quota stay queued until the runs of the same user or team end. Test runs
+// scheduled by the controller itself, such as nightly runs, are exempt
+type QuotaConfig struct {
+	// The limit of users without a limit of their own
+	DefaultUser QuotaLimit `json:"defaultUser"`
+	// The limits of specific users, by thumbprint
+	Users map[string]QuotaLimit `json:"users"`
+	Teams []TeamQuota           `json:"teams"`
+}
+
+// QuotaUsage is the number of test runs and vCPUs a user or team has running,
+// along with its limit
+type QuotaUsage struct {
+	// The thumbprint of the user or the name of the team
+	Subject string     `json:"subject"`
+	Team    bool       `json:"team"`
+	Runs    int        `json:"runs"`
+	VCPUs   int32      `json:"vCPUs"`
+	Limit   QuotaLimit `json:"limit"`
+}
+
+// SetQuotaConfig changes the quotas and persists them
+func (t *TestRunManager) SetQuotaConfig(cfg QuotaConfig) error {
+	t.configLock.Lock()
+	t.config.Quotas = cfg
+	t.configLock.Unlock()
+	return t.PersistConfig()
+}
+
+// Validate checks that limits are not negative and team names are unique
+func (cfg QuotaConfig) Validate() error {
+	limits := []QuotaLimit{cfg.DefaultUser}
+	for _, l := range cfg.Users {
+		limits = append(limits, l)
+	}
+	names := map[string]bool{}
+	for _, tq := range cfg.Teams {
+		if tq.Name == "" {
+			return errors.New("Teams need a name")
+		}
+		if names[tq.Name] {
+			return fmt.Errorf("Team %s is configured more than once", tq.Name)
+		}
+		names[tq.Name] = true
+		limits = append(limits, tq.Limit)
+	}
+	for _, l := range limits {
+		if l.MaxRuns < 0 || l.MaxVCPUs < 0 {
+			return errors.New("Quota limits cannot be negative")
+		}
+	}
+	return nil
+}
+
+// userLimit returns the limit of the user with the given thumbprint
+func (cfg QuotaConfig) userLimit(thumbprint string) QuotaLimit {
+	if l, ok := cfg.Users[thumbprint]; ok {
+		return l
+	}
+	return cfg.DefaultUser
+}
+
+// userTeams returns the teams the user with the given thumbprint is part of
+func (cfg QuotaConfig) userTeams(thumbprint string) []TeamQuota {
+	ret := []TeamQuota{}
+	for _, tq := range cfg.Teams {
+		for _, m := range tq.Members {
+			if m == thumbprint {
+				ret = append(ret, tq)
+				break
+			}
+		}
+	}
+	return ret
+}
+
+// totalVCPUs returns the sum of the vCPUs required in each region
+func totalVCPUs(vcpus map[string]int32) int32 {
+	var ret int32
+	for _, v := range vcpus {
+		ret += v
+	}
+	return ret
+}
+
+// quotaUsage tallies the test runs and vCPUs in use per user and team
+type quotaUsage struct {
+	cfg   QuotaConfig
+	runs  map[string]int
+	vcpus map[string]int32
+}
+
+// newQuotaUsage returns an empty tally for the configured quotas
+func (t *TestRunManager) newQuotaUsage() *quotaUsage {
+	return &quotaUsage{
+		cfg:   t.Config().Quotas,
+		runs:  map[string]int{},
+		vcpus: map[string]int32{},
+	}
+}
+
+// quotaKeys returns the keys the usage of the user and their teams are
+// tallied by
+func (u *quotaUsage) quotaKeys(thumbprint string) []string {
+	ret := []string{"user:" + thumbprint}
+	for _, tq := range u.cfg.userTeams(thumbprint) {
+		ret = append(ret, "team:"+tq.Name)
+	}
+	return ret
+}
+
+// add claims (or with sign -1 releases) the quotas of the user that created
+// the test run and their teams
+func (u *quotaUsage) add(tr *common.TestRun, vcpus int32, sign int) {
+	if tr.CreatedByThumbprint == "" {
+		return
+	}
+	for _, k := range u.quotaKeys(tr.CreatedByThumbprint) {
+		u.runs[k] += sign
+		u.vcpus[k] += int32(sign) * vcpus
+	}
+}
+
+// quotaExceeded returns the reason the limit is exceeded with the given usage, or
+// an empty string if it isn't
+func quotaExceeded(
+	subject string,
+	l QuotaLimit,
+	runs int,
+	vcpus int32,
+) string {
+	if l.MaxRuns > 0 && runs > l.MaxRuns {
+		return fmt.Sprintf(
+			"%s reached the quota of %d concurrent test runs",
+			subject,
+			l.MaxRuns,
+		)
+	}
+	if l.MaxVCPUs > 0 && vcpus > l.MaxVCPUs {
+		return fmt.Sprintf(
+			"%s would use %d vCPUs, over the quota of %d",
+			subject,
+			vcpus,
+			l.MaxVCPUs,
+		)
+	}
+	return ""
+}
+
+// blocked returns the reason starting the test run would exceed the quota of
+// the user that created it or one of their teams, or an empty string if it
+// doesn't
+func (u *quotaUsage) blocked(tr *common.TestRun, vcpus int32) string {
+	thumb := tr.CreatedByThumbprint
+	if thumb == "" {
+		return ""
+	}
+	k := "user:" + thumb
+	reason := quotaExceeded(
+		"The user",
+		u.cfg.userLimit(thumb),
+		u.runs[k]+1,
+		u.vcpus[k]+vcpus,
+	)
+	if reason != "" {
+		return reason
+	}
+	for _, tq := range u.cfg.userTeams(thumb) {
+		k = "team:" + tq.Name
+		reason = quotaExceeded(
+			fmt.Sprintf("Team %s", tq.Name),
+			tq.Limit,
+			u.runs[k]+1,
+			u.vcpus[k]+vcpus,
+		)
+		if reason != "" {
+			return reason
+		}
+	}
+	return ""
+}
+
+// neverFits returns the reason the test run can never start within the
+// quotas of the user that created it, or an empty string if it can
+func (u *quotaUsage) neverFits(tr *common.TestRun, vcpus int32) string {
+	empty := &quotaUsage{
+		cfg:   u.cfg,
+		runs:  map[string]int{},
+		vcpus: map[string]int32{},
+	}
+	return empty.blocked(tr, vcpus)
+}
+
+// setQueueBlocked records why the queued test run can't start yet, and
+// persists it if the reason changed
+func (t *TestRunManager) setQueueBlocked(tr *common.TestRun, reason string) {
+	if tr.QueueBlocked == reason {
+		return
+	}
+	tr.QueueBlocked = reason
+	t.PersistTestRun(tr)
+}
+
+// QuotaUsage returns the test runs and vCPUs in use by each user and team
+// that has test runs running
+func (t *TestRunManager) QuotaUsage() []QuotaUsage {
+	u := t.newQuotaUsage()
+	for _, tr := range t.GetTestRuns() {
+		if tr.Status == common.TestRunStatusRunning &&
+			!tr.AWSInstancesStopped {
+			u.add(tr, totalVCPUs(t.GetRequiredVCPUs(tr)), 1)
+		}
+	}
+	ret := []QuotaUsage{}
+	for k, runs := range u.runs {
+		if runs == 0 {
+			continue
+		}
+		usage := QuotaUsage{Runs: runs, VCPUs: u.vcpus[k]}
+		if strings.HasPrefix(k, "team:") {
+			usage.Subject = strings.TrimPrefix(k, "team:")
+			usage.Team = true
+			for _, tq := range u.cfg.Teams {
+				if tq.Name == usage.Subject {
+					usage.Limit = tq.Limit
+				}
+			}
+		} else {
+			usage.Subject = strings.TrimPrefix(k, "user:")
+			usage.Limit = u.cfg.userLimit(usage.Subject)
+		}
+		ret = append(ret, usage)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Team != ret[j].Team {
+			return ret[i].Team
+		}
+		return ret[i].Subject < ret[j].Subject
+	})
+	return ret
+}
@@ -0,0 +1,290 @@
+package testruns
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// ErrLeakNotFound is returned when no leaked resource with the requested ID is
+// on the reconciliation list
+var ErrLeakNotFound = errors.New("Leaked resource not found")
+
+// teardownGracePeriod is the time the commands of a test run are given to
+// exit after they were interrupted, before they are killed
+const teardownGracePeriod = 30 * time.Second
+
+// teardownKillTimeout is the time the agents are given to report the commands
+// of a test run stopped after they were killed
+const teardownKillTimeout = 10 * time.Second
+
+// reconciliationInterval is the interval at which the reconciliation sweeper
+// retries cleaning up the leaked resources
+const reconciliationInterval = 10 * time.Minute
+
+// LeakedResourceKind is the kind of resource a test run left behind
+type LeakedResourceKind string
+
+// LeakedInstance is an EC2 instance launched for a test run that could not be
+// terminated
+const LeakedInstance LeakedResourceKind = "instance"
+
+// LeakedEnvironment is an environment on an agent that outlives the test run,
+// with processes still running in it, ports still in use or its directory
+// not removed
+const LeakedEnvironment LeakedResourceKind = "environment"
+
+// LeakedResource is a resource the teardown of a test run could not clean up.
+// Leaked resources are kept on the reconciliation list, and the sweeper keeps
+// trying to clean them up until it succeeds or they are dismissed
+type LeakedResource struct {
+	ID        string             `json:"id"`
+	Kind      LeakedResourceKind `json:"kind"`
+	TestRunID string             `json:"testRunID"`
+	// The EC2 instance of a leaked instance
+	InstanceID string `json:"instanceID,omitempty"`
+	// The agent, environment and ports of a leaked environment. Agents get a
+	// new ID when they reconnect, so the host name is used to find the agent
+	// again
+	AgentID       int32  `json:"agentID,omitempty"`
+	HostName      string `json:"hostName,omitempty"`
+	EnvironmentID string `json:"environmentID,omitempty"`
+	Ports         []int  `json:"ports,omitempty"`
+	// What was left behind
+	Detail      string    `json:"detail"`
+	Recorded    time.Time `json:"recorded"`
+	Attempts    int       `json:"attempts"`
+	LastAttempt time.Time `json:"lastAttempt,omitempty"`
+	LastError   string    `json:"lastError,omitempty"`
+}
+
+// reconciliationPath returns the path of the file the reconciliation list is
+// persisted in
+func reconciliationPath() string {
+	return filepath.Join(common.DataDir(), "testruns", "reconciliation.json")
+}
+
+// loadReconciliation reads the reconciliation list from disk
+func (t *TestRunManager) loadReconciliation() error {
+	b, err := os.ReadFile(reconciliationPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	t.reconciliationLock.Lock()
+	defer t.reconciliationLock.Unlock()
+	return json.Unmarshal(b, &t.reconciliation)
+}
+
+// persistReconciliation writes the reconciliation list to disk. Must be
+// called with reconciliationLock held
+func (t *TestRunManager) persistReconciliation() error {
+	b, err := json.Marshal(t.reconciliation)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(reconciliationPath()), 0755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(reconciliationPath(), b, 0644)
+}
+
+// recordLeak adds a resource the teardown of the test run could not clean up
+// to the reconciliation list
+func (t *TestRunManager) recordLeak(tr *common.TestRun, l *LeakedResource) {
+	var err error
+	l.ID, err = common.RandomID(12)
+	if err != nil {
+		logging.Errorf("Unable to record leaked resource: %v", err)
+		return
+	}
+	l.TestRunID = tr.ID
+	l.Recorded = time.Now()
+
+	t.reconciliationLock.Lock()
+	defer t.reconciliationLock.Unlock()
+	for _, e := range t.reconciliation {
+		// The teardown can be retried, don't record the same resource twice
+		if e.Kind == l.Kind && e.InstanceID == l.InstanceID &&
+			e.EnvironmentID == l.EnvironmentID {
+			return
+		}
+	}
+	t.WriteLog(
+		tr,
+		"Leaked %s (%s), added to the reconciliation list",
+		l.Kind,
+		l.Detail,
+	)
+	t.reconciliation = append(t.reconciliation, l)
+	err = t.persistReconciliation()
+	if err != nil {
+		logging.Errorf("Unable to persist reconciliation list: %v", err)
+	}
+}
+
+// recordLeakedEnvironment adds the environment of the test run on the agent
+// to the reconciliation list
+func (t *TestRunManager) recordLeakedEnvironment(
+	tr *common.TestRun,
+	agentID int32,
+	envID []byte,
+	ports []int,
+	detail string,
+) {
+	l := &LeakedResource{
+		Kind:          LeakedEnvironment,
+		AgentID:       agentID,
+		EnvironmentID: hex.EncodeToString(envID),
+		Ports:         ports,
+		Detail:        detail,
+	}
+	if a, err := t.coord.GetAgent(agentID); err == nil {
+		l.HostName = a.SystemInfo.HostName
+	}
+	t.recordLeak(tr, l)
+}
+
+// Reconciliation returns the resources on the reconciliation list
+func (t *TestRunManager) Reconciliation() []*LeakedResource {
+	t.reconciliationLock.Lock()
+	defer t.reconciliationLock.Unlock()
+	return append([]*LeakedResource{}, t.reconciliation...)
+}
+
+// DismissLeak removes a resource from the reconciliation list without
+// cleaning it up, for instance because it was cleaned up manually
+func (t *TestRunManager) DismissLeak(id string) error {
+	if !t.removeLeak(id) {
+		return ErrLeakNotFound
+	}
+	return nil
+}
+
+// removeLeak removes a resource from the reconciliation list. Returns false
+// if it was not on the list
+func (t *TestRunManager) removeLeak(id string) bool {
+	t.reconciliationLock.Lock()
+	defer t.reconciliationLock.Unlock()
+	for i, l := range t.reconciliation {
+		if l.ID == id {
+			t.reconciliation = append(
+				t.reconciliation[:i],
+				t.reconciliation[i+1:]...,
+			)
+			err := t.persistReconciliation()
+			if err != nil {
+				logging.Errorf("Unable to persist reconciliation list: %v", err)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// ReconciliationSweeper is the loop that periodically retries cleaning up the
+// resources on the reconciliation list. Resources that are cleaned up are
+// removed from the list
+func (t *TestRunManager) ReconciliationSweeper() {
+	for {
+		time.Sleep(reconciliationInterval)
+		for _, l := range t.Reconciliation() {
+			err := t.reconcile(l)
+			if err == nil {
+				logging.Infof(
+					"Reconciled leaked %s of test run %s (%s)",
+					l.Kind,
+					l.TestRunID,
+					l.Detail,
+				)
+				t.removeLeak(l.ID)
+				continue
+			}
+			t.reconciliationLock.Lock()
+			l.Attempts++
+			l.LastAttempt = time.Now()
+			l.LastError = err.Error()
+			perr := t.persistReconciliation()
+			t.reconciliationLock.Unlock()
+			if perr != nil {
+				logging.Errorf("Unable to persist reconciliation list: %v", perr)
+			}
+		}
+	}
+}
+
+// reconcile tries to clean up a leaked resource. Returns nil once the
+// resource is gone
+func (t *TestRunManager) reconcile(l *LeakedResource) error {
+	switch l.Kind {
+	case LeakedInstance:
+		running, err := t.awsm.InstancesRunning([]string{l.InstanceID})
+		if err != nil {
+			return err
+		}
+		if len(running) == 0 {
+			return nil
+		}
+		err = t.awsm.StopAgentsByInstanceIds([]string{l.InstanceID})
+		if err != nil {
+			return err
+		}
+		running, err = t.awsm.InstancesRunning([]string{l.InstanceID})
+		if err != nil {
+			return err
+		}
+		if len(running) > 0 {
+			return fmt.Errorf("Instance %s is still running", l.InstanceID)
+		}
+		return nil
+	case LeakedEnvironment:
+		agentID, ok := t.leakAgent(l)
+		if !ok {
+			return fmt.Errorf("Agent %s is not connected", l.HostName)
+		}
+		envID, err := hex.DecodeString(l.EnvironmentID)
+		if err != nil {
+			return err
+		}
+		rep, err := t.am.VerifyCleanup(agentID, envID, l.Ports, true)
+		if err != nil {
+			return err
+		}
+		if !rep.Cleaned &&
+			(len(rep.Processes) > 0 || len(rep.Ports) > 0 || len(rep.Dirs) > 0) {
+			return fmt.Errorf(
+				"processes %v, ports in use %v, directories %v",
+				rep.Processes,
+				rep.Ports,
+				rep.Dirs,
+			)
+		}
+		return nil
+	}
+	return fmt.Errorf("Unknown kind of resource %s", l.Kind)
+}
+
+// leakAgent returns the ID of the connected agent a leaked environment is on
+func (t *TestRunManager) leakAgent(l *LeakedResource) (int32, bool) {
+	for _, a := range t.coord.GetAgents() {
+		if l.HostName != "" && a.SystemInfo.HostName == l.HostName {
+			return a.ID, true
+		}
+	}
+	if l.HostName == "" {
+		if _, err := t.coord.GetAgent(l.AgentID); err == nil {
+			return l.AgentID, true
+		}
+	}
+	return 0, false
+}
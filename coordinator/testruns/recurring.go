@@ -0,0 +1,520 @@
+package testruns
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// ErrRecurringScheduleNotFound is returned when no recurring schedule with
+// the requested ID exists
+var ErrRecurringScheduleNotFound = errors.New("Recurring schedule not found")
+
+// ErrRecurringScheduleForbidden is returned when a user other than the one
+// that created a recurring schedule, who is not an admin, tries to change it
+var ErrRecurringScheduleForbidden = errors.New(
+	"Only the creator of a recurring schedule or an admin can change it",
+)
+
+// recurringCatchUp is how long after its scheduled time an occurrence that
+// was missed (because the coordinator was down) is still started. Older
+// occurrences are recorded as skipped
+const recurringCatchUp = 15 * time.Minute
+
+// recurringHistoryLength is the number of occurrences kept per schedule
+const recurringHistoryLength = 100
+
+// BlackoutWindow is a period in which the occurrences of a recurring schedule
+// are skipped, for instance during maintenance or a release freeze. It is
+// either a fixed period (Start to End), or recurs at the times matching Cron
+// and lasts DurationMinutes
+type BlackoutWindow struct {
+	Start           time.Time `json:"start,omitempty"`
+	End             time.Time `json:"end,omitempty"`
+	Cron            string    `json:"cron,omitempty"`
+	DurationMinutes int       `json:"durationMinutes,omitempty"`
+	Reason          string    `json:"reason"`
+}
+
+// validate checks that the window is either a fixed or a recurring period
+func (b BlackoutWindow) validate() error {
+	if b.Cron == "" {
+		if b.Start.IsZero() || !b.End.After(b.Start) {
+			return errors.New(
+				"Blackout windows need a start before their end, or a cron expression",
+			)
+		}
+		return nil
+	}
+	if _, err := ParseCron(b.Cron); err != nil {
+		return err
+	}
+	if b.DurationMinutes <= 0 {
+		return errors.New("Recurring blackout windows need a duration")
+	}
+	return nil
+}
+
+// contains returns true if the window covers the given time
+func (b BlackoutWindow) contains(t time.Time) bool {
+	if b.Cron == "" {
+		return !t.Before(b.Start) && t.Before(b.End)
+	}
+	c, err := ParseCron(b.Cron)
+	if err != nil {
+		return false
+	}
+	// The window covers t if it started within its duration before t
+	d := time.Duration(b.DurationMinutes) * time.Minute
+	start := c.Next(t.Add(-d - time.Minute))
+	return !start.IsZero() && !start.After(t)
+}
+
+// RecurringOccurrence is a single time a recurring schedule was due
+type RecurringOccurrence struct {
+	Slot       time.Time `json:"slot"`
+	TestRunIDs []string  `json:"testRunIDs"`
+	// Why the occurrence was skipped, empty if its runs were scheduled
+	Skipped string `json:"skipped,omitempty"`
+}
+
+// RecurringSchedule schedules a test run (or sweep) at the times matching its
+// cron expression, such as an hourly smoke test or a weekly large scale run.
+// The run is either defined inline, or created from a test run template
+type RecurringSchedule struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+	Cron    string `json:"cron"`
+	// The test run to schedule. Set its SourceRef to benchmark the head of a
+	// branch at the time of each occurrence in stead of a fixed commit
+	TestRun *common.TestRun `json:"testRun,omitempty"`
+	// The template to create the test run from in stead, with parameters
+	// overriding the ones of the template. Version 0 uses the latest version
+	TemplateID        string                 `json:"templateID,omitempty"`
+	TemplateVersion   int                    `json:"templateVersion,omitempty"`
+	TemplateOverrides map[string]interface{} `json:"templateOverrides,omitempty"`
+	Blackouts         []BlackoutWindow       `json:"blackouts"`
+	// By default an occurrence is skipped while the runs of the previous
+	// occurrence are still queued or running
+	AllowOverlap        bool                  `json:"allowOverlap"`
+	Created             time.Time             `json:"created"`
+	CreatedByThumbprint string                `json:"createdByThumbprint"`
+	Updated             time.Time             `json:"updated"`
+	UpdatedByThumbprint string                `json:"updatedByThumbprint"`
+	Occurrences         []RecurringOccurrence `json:"occurrences"`
+	// The next time the schedule is due, calculated when listing schedules
+	Next time.Time `json:"next"`
+}
+
+// validateRecurringSchedule checks the cron expression, blackout windows and
+// the definition of the test run of a recurring schedule
+func (t *TestRunManager) validateRecurringSchedule(
+	s *RecurringSchedule,
+) []error {
+	errs := []error{}
+	if strings.TrimSpace(s.Name) == "" {
+		errs = append(errs, errors.New("Recurring schedules need a name"))
+	}
+	if _, err := ParseCron(s.Cron); err != nil {
+		errs = append(errs, err)
+	}
+	for i, b := range s.Blackouts {
+		if err := b.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("Blackout window %d: %v", i+1, err))
+		}
+	}
+	if (s.TestRun == nil) == (s.TemplateID == "") {
+		errs = append(
+			errs,
+			errors.New("Recurring schedules need either a test run or a template"),
+		)
+	} else if _, err := t.recurringTestRun(s); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// recurringTestRun returns a copy of the test run the schedule schedules
+func (t *TestRunManager) recurringTestRun(
+	s *RecurringSchedule,
+) (*common.TestRun, error) {
+	if s.TemplateID != "" {
+		return t.TestRunFromTemplate(
+			s.TemplateID,
+			s.TemplateVersion,
+			s.TemplateOverrides,
+		)
+	}
+	_, tr, err := common.GetTestRunCopy(s.TestRun)
+	return tr, err
+}
+
+// RecurringPriority returns the priority of the test runs the schedule
+// schedules, or normal priority if it doesn't resolve to a test run
+func (t *TestRunManager) RecurringPriority(s *RecurringSchedule) int {
+	tr, err := t.recurringTestRun(s)
+	if err != nil || tr == nil {
+		return common.TestRunPriorityNormal
+	}
+	return tr.Priority
+}
+
+// recurringSchedulesPath returns the path of the file the recurring schedules
+// are persisted in
+func recurringSchedulesPath() string {
+	return filepath.Join(common.DataDir(), "testruns", "recurring.json")
+}
+
+// loadRecurringSchedules reads the recurring schedules from disk
+func (t *TestRunManager) loadRecurringSchedules() error {
+	b, err := os.ReadFile(recurringSchedulesPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	t.recurringLock.Lock()
+	defer t.recurringLock.Unlock()
+	return json.Unmarshal(b, &t.recurring)
+}
+
+// persistRecurringSchedules writes the recurring schedules to disk. Must be
+// called with recurringLock held
+func (t *TestRunManager) persistRecurringSchedules() error {
+	b, err := json.Marshal(t.recurring)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(recurringSchedulesPath()), 0755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(recurringSchedulesPath(), b, 0644)
+}
+
+// recurringValidationError combines the errors found validating a recurring
+// schedule
+func recurringValidationError(errs []error) error {
+	msgs := make([]string, len(errs))
+	for i, e := range errs {
+		msgs[i] = e.Error()
+	}
+	return errors.New(strings.Join(msgs, "; "))
+}
+
+// CreateRecurringSchedule validates and saves a new recurring schedule
+func (t *TestRunManager) CreateRecurringSchedule(
+	s *RecurringSchedule,
+	createdByThumbprint string,
+) (*RecurringSchedule, error) {
+	if errs := t.validateRecurringSchedule(s); len(errs) > 0 {
+		return nil, recurringValidationError(errs)
+	}
+	var err error
+	s.ID, err = common.RandomID(12)
+	if err != nil {
+		return nil, err
+	}
+	s.Created = time.Now()
+	s.CreatedByThumbprint = createdByThumbprint
+	s.Updated = s.Created
+	s.UpdatedByThumbprint = createdByThumbprint
+	s.Occurrences = []RecurringOccurrence{}
+
+	t.recurringLock.Lock()
+	defer t.recurringLock.Unlock()
+	t.recurring = append(t.recurring, s)
+	err = t.persistRecurringSchedules()
+	if err != nil {
+		t.recurring = t.recurring[:len(t.recurring)-1]
+		return nil, err
+	}
+	return s, nil
+}
+
+// UpdateRecurringSchedule validates and replaces the definition of the
+// recurring schedule with the given ID, keeping its history. Since its runs
+// are scheduled as the user that created it, only that user or an admin can
+// change it
+func (t *TestRunManager) UpdateRecurringSchedule(
+	id string,
+	s *RecurringSchedule,
+	updatedByThumbprint string,
+	admin bool,
+) (*RecurringSchedule, error) {
+	if errs := t.validateRecurringSchedule(s); len(errs) > 0 {
+		return nil, recurringValidationError(errs)
+	}
+
+	t.recurringLock.Lock()
+	defer t.recurringLock.Unlock()
+	for i, e := range t.recurring {
+		if e.ID != id {
+			continue
+		}
+		if e.CreatedByThumbprint != updatedByThumbprint && !admin {
+			return nil, ErrRecurringScheduleForbidden
+		}
+		s.ID = id
+		s.Created = e.Created
+		s.CreatedByThumbprint = e.CreatedByThumbprint
+		s.Updated = time.Now()
+		s.UpdatedByThumbprint = updatedByThumbprint
+		s.Occurrences = e.Occurrences
+		t.recurring[i] = s
+		err := t.persistRecurringSchedules()
+		if err != nil {
+			t.recurring[i] = e
+			return nil, err
+		}
+		return s, nil
+	}
+	return nil, ErrRecurringScheduleNotFound
+}
+
+// RecurringSchedules returns the recurring schedules with the next time they
+// are due
+func (t *TestRunManager) RecurringSchedules() []RecurringSchedule {
+	t.recurringLock.Lock()
+	defer t.recurringLock.Unlock()
+	ret := make([]RecurringSchedule, len(t.recurring))
+	for i, s := range t.recurring {
+		ret[i] = *s
+		ret[i].Occurrences = append([]RecurringOccurrence{}, s.Occurrences...)
+		if c, err := ParseCron(s.Cron); err == nil && s.Enabled {
+			ret[i].Next = c.Next(time.Now())
+		}
+	}
+	return ret
+}
+
+// GetRecurringSchedule returns the recurring schedule with the given ID
+func (t *TestRunManager) GetRecurringSchedule(
+	id string,
+) (RecurringSchedule, error) {
+	for _, s := range t.RecurringSchedules() {
+		if s.ID == id {
+			return s, nil
+		}
+	}
+	return RecurringSchedule{}, ErrRecurringScheduleNotFound
+}
+
+// DeleteRecurringSchedule removes a recurring schedule on behalf of the user
+// with the given thumbprint, who must have created it or be an admin. The
+// test runs it scheduled are kept
+func (t *TestRunManager) DeleteRecurringSchedule(
+	id string,
+	userThumbprint string,
+	admin bool,
+) error {
+	t.recurringLock.Lock()
+	defer t.recurringLock.Unlock()
+	for i, s := range t.recurring {
+		if s.ID == id {
+			if s.CreatedByThumbprint != userThumbprint && !admin {
+				return ErrRecurringScheduleForbidden
+			}
+			t.recurring = append(t.recurring[:i], t.recurring[i+1:]...)
+			return t.persistRecurringSchedules()
+		}
+	}
+	return ErrRecurringScheduleNotFound
+}
+
+// dueRecurringSlot returns the most recent time at or before now the schedule
+// was due and that has no occurrence yet, or the zero time if there is none
+func dueRecurringSlot(s *RecurringSchedule, now time.Time) time.Time {
+	c, err := ParseCron(s.Cron)
+	if err != nil {
+		return time.Time{}
+	}
+	from := s.Updated
+	if len(s.Occurrences) > 0 && s.Occurrences[0].Slot.After(from) {
+		from = s.Occurrences[0].Slot
+	}
+	// Don't look back further than a day, schedules due every minute would
+	// take long to catch up on otherwise
+	if from.Before(now.Add(-24 * time.Hour)) {
+		from = now.Add(-24 * time.Hour)
+	}
+	due := time.Time{}
+	for next := c.Next(from); !next.IsZero() && !next.After(now); next = c.Next(next) {
+		due = next
+	}
+	return due
+}
+
+// RecurringScheduler is the loop that schedules the runs of the recurring
+// schedules when they are due
+func (t *TestRunManager) RecurringScheduler() {
+	for {
+		time.Sleep(time.Second * 30)
+		if !t.loadComplete {
+			continue
+		}
+		t.recurringLock.Lock()
+		schedules := append([]*RecurringSchedule{}, t.recurring...)
+		t.recurringLock.Unlock()
+		for _, s := range schedules {
+			if !s.Enabled {
+				continue
+			}
+			slot := dueRecurringSlot(s, time.Now())
+			if slot.IsZero() {
+				continue
+			}
+			t.runRecurringOccurrence(s, slot)
+		}
+	}
+}
+
+// runRecurringOccurrence schedules the runs for an occurrence of the
+// schedule, unless it falls in a blackout window, was missed for too long or
+// the previous occurrence is still running. The occurrence is recorded in the
+// history of the schedule either way
+func (t *TestRunManager) runRecurringOccurrence(
+	s *RecurringSchedule,
+	slot time.Time,
+) {
+	occ := RecurringOccurrence{Slot: slot, TestRunIDs: []string{}}
+	occ.Skipped = t.recurringSkipReason(s, slot)
+	if occ.Skipped == "" {
+		ids, err := t.scheduleRecurringRuns(s)
+		if err != nil {
+			occ.Skipped = fmt.Sprintf("Scheduling failed: %v", err)
+		}
+		occ.TestRunIDs = ids
+	}
+	if occ.Skipped != "" {
+		logging.Infof(
+			"[Recurring] Skipped occurrence %s of %s: %s",
+			slot.Format(time.RFC3339),
+			s.Name,
+			occ.Skipped,
+		)
+	}
+
+	t.recurringLock.Lock()
+	defer t.recurringLock.Unlock()
+	// The schedule may have been updated in the meantime, which replaces it
+	for _, e := range t.recurring {
+		if e.ID != s.ID {
+			continue
+		}
+		e.Occurrences = append([]RecurringOccurrence{occ}, e.Occurrences...)
+		if len(e.Occurrences) > recurringHistoryLength {
+			e.Occurrences = e.Occurrences[:recurringHistoryLength]
+		}
+		if err := t.persistRecurringSchedules(); err != nil {
+			logging.Warnf("Unable to persist recurring schedules: %v", err)
+		}
+	}
+}
+
+// recurringSkipReason returns why the occurrence of the schedule at slot
+// should be skipped, or an empty string if its runs should be scheduled
+func (t *TestRunManager) recurringSkipReason(
+	s *RecurringSchedule,
+	slot time.Time,
+) string {
+	if time.Since(slot) > recurringCatchUp {
+		return "Missed while the coordinator was not running"
+	}
+	for _, b := range s.Blackouts {
+		if b.contains(slot) {
+			return fmt.Sprintf("Blackout window: %s", b.Reason)
+		}
+	}
+	if s.AllowOverlap {
+		return ""
+	}
+	// The most recent occurrence that scheduled runs. Sweeps schedule their
+	// remaining runs as earlier ones finish, so these are checked by sweep
+	for _, o := range s.Occurrences {
+		if len(o.TestRunIDs) == 0 {
+			continue
+		}
+		ids := map[string]bool{}
+		sweeps := map[string]bool{}
+		for _, id := range o.TestRunIDs {
+			ids[id] = true
+			if tr, ok := t.GetTestRun(id); ok && tr.SweepID != "" {
+				sweeps[tr.SweepID] = true
+			}
+		}
+		t.testRunsLock.Lock()
+		defer t.testRunsLock.Unlock()
+		for _, tr := range t.testRuns {
+			if !ids[tr.ID] && !sweeps[tr.SweepID] {
+				continue
+			}
+			if tr.Status == common.TestRunStatusQueued ||
+				tr.Status == common.TestRunStatusRunning {
+				return fmt.Sprintf(
+					"Test run %s of the previous occurrence is still %s",
+					tr.ID,
+					strings.ToLower(string(tr.Status)),
+				)
+			}
+		}
+		break
+	}
+	return ""
+}
+
+// scheduleRecurringRuns schedules the test run of the schedule like a
+// submission from the frontend by its owner, and returns the IDs of the
+// scheduled runs
+func (t *TestRunManager) scheduleRecurringRuns(
+	s *RecurringSchedule,
+) ([]string, error) {
+	tr, err := t.recurringTestRun(s)
+	if err != nil {
+		return nil, err
+	}
+	tr.CreatedByThumbprint = s.CreatedByThumbprint
+	tr.SweepID = ""
+	tr.AwaitingApproval = false
+	tr.ApprovedByThumbprint = ""
+	tr.Tags = appendUnique(tr.Tags, common.TestRunTagRecurring)
+	ApplySubmissionDefaults(tr)
+
+	sweepID, err := common.RandomID(12)
+	if err != nil {
+		return nil, err
+	}
+	runs := InitialSweepRuns(tr, common.ExpandSweepRun(tr, sweepID))
+
+	// Recurring runs are subject to the same lint rules as submissions from
+	// the frontend
+	requireApproval := false
+	for _, v := range t.LintTestRuns(runs) {
+		if v.Action == LintRuleActionReject {
+			return nil, fmt.Errorf(
+				"Rejected by lint rule %s: %s",
+				v.Name,
+				v.Message,
+			)
+		}
+		if v.Action == LintRuleActionRequireApproval {
+			requireApproval = true
+		}
+	}
+	ids := []string{}
+	for _, run := range runs {
+		run.AwaitingApproval = requireApproval
+		t.ScheduleTestRun(run)
+		ids = append(ids, run.ID)
+	}
+	return ids, nil
+}
@@ -0,0 +1,377 @@
+package testruns
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/coordinator/awsmgr"
+)
+
+// The minimum RAFT timing (in milliseconds) of test runs spanning multiple
+// regions. The round trip between regions takes up to a few hundred
+// milliseconds, which causes spurious elections with the timing of test runs
+// within a single region. Test runs with a lower timing are rejected rather
+// than having their timing changed, since it's a parameter of the benchmark
+const (
+	crossRegionHeartbeat            = 500
+	crossRegionElectionTimeoutLower = 2000
+	crossRegionElectionTimeoutUpper = 3000
+)
+
+// RegionPoolsConfig limits the number of agents the test runs can have
+// running in each AWS region at the same time, on top of the maximum number
+// of agents overall. Regions without a limit are only bound by their vCPU
+// quota
+type RegionPoolsConfig map[string]int
+
+// SetRegionPoolsConfig changes the agent pools of the regions and persists
+// them
+func (t *TestRunManager) SetRegionPoolsConfig(cfg RegionPoolsConfig) error {
+	t.configLock.Lock()
+	t.config.RegionPools = cfg
+	t.configLock.Unlock()
+	return t.PersistConfig()
+}
+
+// Validate checks that the limits of the region pools are not negative
+func (cfg RegionPoolsConfig) Validate() error {
+	for region, max := range cfg {
+		if region == "" {
+			return errors.New("The region of a pool cannot be empty")
+		}
+		if max < 0 {
+			return fmt.Errorf("The pool of region %s cannot be negative", region)
+		}
+	}
+	return nil
+}
+
+// regionTemplate returns the launch template in the region that launches the
+// same kind of instance as the given launch template
+func (t *TestRunManager) regionTemplate(
+	lt awsmgr.AwsLaunchTemplate,
+	region string,
+) (awsmgr.AwsLaunchTemplate, bool) {
+	if lt.Region == region {
+		return lt, true
+	}
+	for _, other := range t.awsm.LaunchTemplates() {
+		if other.Region == region &&
+			other.InstanceType == lt.InstanceType &&
+			other.Architecture == lt.Architecture &&
+			other.Accelerator == lt.Accelerator {
+			return other, true
+		}
+	}
+	return awsmgr.AwsLaunchTemplate{}, false
+}
+
+// regionPlacement returns the region the roles of the given kind are placed
+// in, or an empty string if they stay in the region of their launch template
+func regionPlacement(tr *common.TestRun, role common.SystemRole) string {
+	for _, p := range tr.RegionPlacement {
+		if p.Role == role {
+			return p.Region
+		}
+	}
+	return ""
+}
+
+// placedTemplate returns the launch template the role is spawned from once
+// the region placement of the test run is applied, or an empty string if the
+// role runs on a connected agent. Roles on a pool of static agents are not
+// placed in a region
+func (t *TestRunManager) placedTemplate(
+	tr *common.TestRun,
+	r *common.TestRunRole,
+) (string, error) {
+	region := regionPlacement(tr, r.Role)
+	if region == "" || r.ManualPlacement || r.ColocateWith != nil ||
+		r.AgentPool != "" {
+		return r.AwsLaunchTemplateID, nil
+	}
+	if r.AwsLaunchTemplateID == "" {
+		return "", fmt.Errorf(
+			"%s %d runs on agent %d and can't be placed in region %s",
+			r.Role,
+			r.Index,
+			r.AgentID,
+			region,
+		)
+	}
+	lt, err := t.awsm.GetLaunchTemplate(r.AwsLaunchTemplateID)
+	if err != nil {
+		return "", fmt.Errorf(
+			"Launch template %s of %s %d does not exist",
+			r.AwsLaunchTemplateID,
+			r.Role,
+			r.Index,
+		)
+	}
+	placed, ok := t.regionTemplate(lt, region)
+	if !ok {
+		return "", fmt.Errorf(
+			"%s %d can't be placed in region %s: there is no launch template for %s (%s) there",
+			r.Role,
+			r.Index,
+			region,
+			lt.InstanceType,
+			lt.Architecture,
+		)
+	}
+	return placed.TemplateID, nil
+}
+
+// validateRegionPlacement checks that the roles of the test run can be placed
+// in the regions it requests, and that the agents it needs in each region fit
+// in the pool of that region
+func (t *TestRunManager) validateRegionPlacement(tr *common.TestRun) []error {
+	ret := []error{}
+	seen := map[common.SystemRole]bool{}
+	for _, p := range tr.RegionPlacement {
+		if p.Region == "" {
+			ret = append(ret, fmt.Errorf(
+				"Region placement of %s needs a region",
+				p.Role,
+			))
+		}
+		if seen[p.Role] {
+			ret = append(ret, fmt.Errorf(
+				"%s is placed in more than one region",
+				p.Role,
+			))
+		}
+		seen[p.Role] = true
+	}
+	if len(ret) > 0 {
+		return ret
+	}
+	for _, r := range tr.Roles {
+		if _, err := t.placedTemplate(tr, r); err != nil {
+			ret = append(ret, err)
+		}
+	}
+	pools := t.Config().RegionPools
+	agents := t.regionAgents(tr)
+	for region, n := range agents {
+		if max, ok := pools[region]; ok && n > max {
+			ret = append(ret, fmt.Errorf(
+				"The test run needs %d agents in region %s, but its pool has %d",
+				n,
+				region,
+				max,
+			))
+		}
+	}
+	return append(ret, t.validateCrossRegion(tr, agents)...)
+}
+
+// validateCrossRegion checks that a test run with agents in more than one
+// region can run across them. The roles address each other by their private
+// IP, which requires the VPCs of the regions to be peered, and need a RAFT
+// timing that allows for the round trip between the regions
+func (t *TestRunManager) validateCrossRegion(
+	tr *common.TestRun,
+	agents map[string]int,
+) []error {
+	regions := []string{}
+	for region := range agents {
+		regions = append(regions, region)
+	}
+	if len(regions) < 2 {
+		return nil
+	}
+	sort.Strings(regions)
+
+	ret := []error{}
+	for i, a := range regions {
+		for _, b := range regions[i+1:] {
+			peered, err := t.awsm.RegionsPeered(a, b)
+			if err != nil {
+				ret = append(ret, fmt.Errorf(
+					"Unable to check the VPC peering of regions %s and %s: %v",
+					a,
+					b,
+					err,
+				))
+			} else if !peered {
+				ret = append(ret, fmt.Errorf(
+					"The VPCs of regions %s and %s are not peered, so the roles in them can't reach each other",
+					a,
+					b,
+				))
+			}
+		}
+	}
+	if tr.ElectionTimeoutLower < crossRegionElectionTimeoutLower ||
+		tr.ElectionTimeoutUpper < crossRegionElectionTimeoutUpper ||
+		tr.Heartbeat < crossRegionHeartbeat {
+		ret = append(ret, fmt.Errorf(
+			"Test runs spanning multiple regions need an election timeout of at least %d-%d ms and a heartbeat of at least %d ms",
+			crossRegionElectionTimeoutLower,
+			crossRegionElectionTimeoutUpper,
+			crossRegionHeartbeat,
+		))
+	}
+	return ret
+}
+
+// applyRegionPlacement replaces the launch templates of the roles placed in
+// another region with their equivalent in that region
+func (t *TestRunManager) applyRegionPlacement(tr *common.TestRun) {
+	for _, r := range tr.Roles {
+		id, err := t.placedTemplate(tr, r)
+		if err == nil && id != "" {
+			r.AwsLaunchTemplateID = id
+		}
+	}
+	syncColocatedRoles(tr.Roles)
+}
+
+// regionAgents returns the number of AWS agents the test run needs in each
+// region
+func (t *TestRunManager) regionAgents(tr *common.TestRun) map[string]int {
+	ret := map[string]int{}
+	for _, r := range tr.Roles {
+		// Colocated roles don't need an agent of their own
+		if r.ColocateWith != nil {
+			continue
+		}
+		id, err := t.placedTemplate(tr, r)
+		if err != nil || id == "" {
+			continue
+		}
+		if region := t.awsm.GetLaunchTemplateRegion(id); region != "" {
+			ret[region]++
+		}
+	}
+	return ret
+}
+
+// regionPoolExceeded returns the region whose pool starting the test run
+// would exceed, given the agents running in each region, or an empty string
+// if it fits in all of them
+func (t *TestRunManager) regionPoolExceeded(
+	tr *common.TestRun,
+	running map[string]int,
+) string {
+	pools := t.Config().RegionPools
+	for region, n := range t.regionAgents(tr) {
+		max, ok := pools[region]
+		if ok && running[region]+n > max {
+			return region
+		}
+	}
+	return ""
+}
+
+// roleRegion returns the AWS region the role runs in, which is the region of
+// the launch template of the role it is colocated with, if any
+func (t *TestRunManager) roleRegion(
+	tr *common.TestRun,
+	r *common.TestRunRole,
+) string {
+	host, err := hostRole(tr.Roles, r)
+	if err != nil {
+		host = r
+	}
+	return t.awsm.GetLaunchTemplateRegion(host.AwsLaunchTemplateID)
+}
+
+// regionResult calculates the latencies of the transactions sent by the load
+// generators in each region, from the transaction samples in the outputs of
+// the test run. Returns nil if the load generators all ran in the same region
+func (t *TestRunManager) regionResult(
+	tr *common.TestRun,
+) ([]common.RegionResult, error) {
+	loadGens := map[string]int{}
+	for _, r := range tr.Roles {
+		if !t.isLoadGenRole(tr, r.Role) {
+			continue
+		}
+		region := t.roleRegion(tr, r)
+		if region == "" {
+			continue
+		}
+		loadGens[region]++
+	}
+	if len(loadGens) < 2 {
+		return nil, nil
+	}
+
+	outputsDir := filepath.Join(
+		common.DataDir(),
+		fmt.Sprintf("testruns/%s/outputs", tr.ID),
+	)
+	entries, err := ioutil.ReadDir(outputsDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	parsers := t.metricsParsers(tr)
+	latencies := map[string][]float64{}
+	for _, e := range entries {
+		if e.IsDir() || sampleFileFormat(parsers, e.Name()) != SampleFormatTx {
+			continue
+		}
+		r, _ := roleForOutputFile(tr, e.Name())
+		if r == nil || !t.isLoadGenRole(tr, r.Role) {
+			continue
+		}
+		region := t.roleRegion(tr, r)
+		if region == "" {
+			continue
+		}
+		path := filepath.Join(outputsDir, e.Name())
+		err = readSampleFile(path, 2, func(fields []float64) error {
+			if fields[0] > minTxSampleTime {
+				latencies[region] = append(latencies[region], fields[1]/1e9)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Error reading %s: %v", path, err)
+		}
+	}
+
+	ret := []common.RegionResult{}
+	for region, n := range loadGens {
+		res := common.RegionResult{Region: region, LoadGenerators: n}
+		l := latencies[region]
+		if len(l) > 0 {
+			sort.Float64s(l)
+			res.Transactions = len(l)
+			res.LatencyMin = l[0]
+			res.LatencyMax = l[len(l)-1]
+			res.LatencyP50 = percentile(l, 50)
+			res.LatencyP99 = percentile(l, 99)
+			for _, v := range l {
+				res.LatencyAvg += v
+			}
+			res.LatencyAvg /= float64(len(l))
+		}
+		ret = append(ret, res)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Region < ret[j].Region
+	})
+	return ret, nil
+}
+
+// percentile returns the pct-th percentile of the sorted values, using the
+// nearest rank
+func percentile(sorted []float64, pct float64) float64 {
+	rank := int(math.Ceil(pct/100*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
@@ -0,0 +1,239 @@
+package testruns
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// ReprocessJobStatus is the status of a batch re-processing job
+type ReprocessJobStatus string
+
+const ReprocessJobStatusRunning ReprocessJobStatus = "Running"
+const ReprocessJobStatusCompleted ReprocessJobStatus = "Completed"
+
+// ReprocessJob is a batch job that re-runs the results pipeline over the
+// stored raw outputs of a set of historical test runs
+type ReprocessJob struct {
+	ID         string             `json:"id"`
+	CreatedBy  string             `json:"createdBy"`
+	Created    time.Time          `json:"created"`
+	Completed  time.Time          `json:"completed"`
+	Status     ReprocessJobStatus `json:"status"`
+	TestRunIDs []string           `json:"testRunIDs"`
+	// The number of test runs that have been processed so far
+	Processed int `json:"processed"`
+	// The errors for the test runs that failed re-processing, by test run ID
+	Failed map[string]string `json:"failed"`
+	lock   sync.Mutex
+}
+
+// resultHistoryDir returns the directory in which earlier versions of the
+// test run's result are preserved when it is re-processed
+func resultHistoryDir(tr *common.TestRun) string {
+	return filepath.Join(
+		common.DataDir(),
+		fmt.Sprintf("testruns/%s/results-history", tr.ID),
+	)
+}
+
+// archiveTestResult copies the current result of the test run into the result
+// history, such that recalculating the result does not overwrite it
+func archiveTestResult(tr *common.TestRun) error {
+	current := filepath.Join(
+		common.DataDir(),
+		fmt.Sprintf("testruns/%s", tr.ID),
+		fmt.Sprintf("results%d.json", TestResultVersion),
+	)
+	b, err := ioutil.ReadFile(current)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	err = os.MkdirAll(resultHistoryDir(tr), 0755)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(
+		filepath.Join(
+			resultHistoryDir(tr),
+			fmt.Sprintf(
+				"results%d-%d.json",
+				TestResultVersion,
+				time.Now().UnixNano(),
+			),
+		),
+		b,
+		0644,
+	)
+}
+
+// ResultVersions returns all versions of the test run's result, oldest first.
+// The last element is the current result
+func (t *TestRunManager) ResultVersions(
+	tr *common.TestRun,
+) ([]*common.TestResult, error) {
+	versions := []*common.TestResult{}
+	entries, err := ioutil.ReadDir(resultHistoryDir(tr))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	// The file names contain the time of archival, so sorting by name sorts
+	// them chronologically
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	for _, e := range entries {
+		b, err := ioutil.ReadFile(filepath.Join(resultHistoryDir(tr), e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var res common.TestResult
+		err = json.Unmarshal(b, &res)
+		if err != nil {
+			logging.Warnf("Unable to decode result version %s: %v", e.Name(), err)
+			continue
+		}
+		versions = append(versions, &res)
+	}
+	if tr.Result != nil {
+		versions = append(versions, tr.Result)
+	}
+	return versions, nil
+}
+
+// StartReprocessJob starts a background job that recalculates the results of
+// the given test runs with the current results pipeline. Only completed test
+// runs can be re-processed. If the raw outputs of a test run are not present
+// locally, they are downloaded from S3 first. The earlier results are kept in
+// the result history. Returns a snapshot of the job as it started
+func (t *TestRunManager) StartReprocessJob(
+	testRunIDs []string,
+	createdBy string,
+) (ReprocessJob, error) {
+	runs := make([]*common.TestRun, 0, len(testRunIDs))
+	for _, id := range testRunIDs {
+		tr, ok := t.GetTestRun(id)
+		if !ok {
+			return ReprocessJob{}, fmt.Errorf("Test run %s not found", id)
+		}
+		if tr.Status != common.TestRunStatusCompleted {
+			return ReprocessJob{}, fmt.Errorf("Test run %s is not completed", id)
+		}
+		runs = append(runs, tr)
+	}
+
+	id, err := common.RandomID(12)
+	if err != nil {
+		return ReprocessJob{}, err
+	}
+	job := &ReprocessJob{
+		ID:         id,
+		CreatedBy:  createdBy,
+		Created:    time.Now(),
+		Status:     ReprocessJobStatusRunning,
+		TestRunIDs: testRunIDs,
+		Failed:     map[string]string{},
+	}
+	t.reprocessJobsLock.Lock()
+	t.reprocessJobs = append(t.reprocessJobs, job)
+	t.reprocessJobsLock.Unlock()
+
+	go func() {
+		for _, tr := range runs {
+			err := t.reprocessTestRun(tr)
+			job.lock.Lock()
+			if err != nil {
+				logging.Warnf(
+					"[Reprocess job %s] Failed re-processing %s: %v",
+					job.ID,
+					tr.ID,
+					err,
+				)
+				job.Failed[tr.ID] = err.Error()
+			}
+			job.Processed++
+			job.lock.Unlock()
+		}
+		job.lock.Lock()
+		job.Status = ReprocessJobStatusCompleted
+		job.Completed = time.Now()
+		job.lock.Unlock()
+		logging.Infof(
+			"[Reprocess job %s] Re-processed %d test runs (%d failed)",
+			job.ID,
+			len(runs),
+			len(job.Failed),
+		)
+	}()
+	return job.snapshot(), nil
+}
+
+// reprocessTestRun makes sure the raw outputs of the test run are available
+// and recalculates its result
+func (t *TestRunManager) reprocessTestRun(tr *common.TestRun) error {
+	outputsDir := filepath.Join(
+		common.DataDir(),
+		fmt.Sprintf("testruns/%s/outputs", tr.ID),
+	)
+	if _, err := os.Stat(outputsDir); os.IsNotExist(err) {
+		err = t.RedownloadTestOutputsFromS3(tr)
+		if err != nil {
+			return fmt.Errorf("Unable to download raw outputs: %v", err)
+		}
+	}
+	t.WriteLog(
+		tr,
+		"Re-processing results with pipeline version %d",
+		ResultPipelineVersion,
+	)
+	_, err := t.CalculateResults(tr, true)
+	return err
+}
+
+// ReprocessJobs returns a snapshot of all re-processing jobs started since
+// the coordinator started
+func (t *TestRunManager) ReprocessJobs() []ReprocessJob {
+	t.reprocessJobsLock.Lock()
+	defer t.reprocessJobsLock.Unlock()
+	jobs := make([]ReprocessJob, 0, len(t.reprocessJobs))
+	for _, j := range t.reprocessJobs {
+		jobs = append(jobs, j.snapshot())
+	}
+	return jobs
+}
+
+// snapshot returns a copy of the job taken under its lock, which is safe to
+// serialize while the job is running
+func (j *ReprocessJob) snapshot() ReprocessJob {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return ReprocessJob{
+		ID:         j.ID,
+		CreatedBy:  j.CreatedBy,
+		Created:    j.Created,
+		Completed:  j.Completed,
+		Status:     j.Status,
+		TestRunIDs: j.TestRunIDs,
+		Processed:  j.Processed,
+		Failed:     copyStringMap(j.Failed),
+	}
+}
+
+func copyStringMap(m map[string]string) map[string]string {
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
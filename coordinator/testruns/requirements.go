@@ -0,0 +1,388 @@
+package testruns
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/coordinator/awsmgr"
+)
+
+// agentMemoryTolerance is the fraction of the required memory an agent may
+// lack, since the memory the kernel reports is less than the nominal memory
+// of the instance type
+const agentMemoryTolerance = 0.1
+
+// RoleRequirementsConfig are the requirements of the roles of each kind that
+// don't declare requirements of their own, for instance that shards require
+// NVMe storage or that sentinels need at least 16 vCPUs
+type RoleRequirementsConfig map[common.SystemRole]common.RoleRequirements
+
+// SetRoleRequirementsConfig changes the default requirements of the roles and
+// persists them
+func (t *TestRunManager) SetRoleRequirementsConfig(
+	cfg RoleRequirementsConfig,
+) error {
+	t.configLock.Lock()
+	t.config.RoleRequirements = cfg
+	t.configLock.Unlock()
+	return t.PersistConfig()
+}
+
+// Validate checks the requirements of each kind of role
+func (cfg RoleRequirementsConfig) Validate() error {
+	for role, req := range cfg {
+		if role == "" {
+			return errors.New("The role of requirements cannot be empty")
+		}
+		if err := validateRequirements(req); err != nil {
+			return fmt.Errorf("Requirements of %s: %v", role, err)
+		}
+	}
+	return nil
+}
+
+// validateRequirements checks that the requirements are not negative and
+// refer to a known architecture
+func validateRequirements(req common.RoleRequirements) error {
+	if req.MinVCPUs < 0 {
+		return errors.New("the minimum number of vCPUs cannot be negative")
+	}
+	if req.MinMemoryMiB < 0 {
+		return errors.New("the minimum memory cannot be negative")
+	}
+	if req.Architecture != "" && req.Architecture != "amd64" &&
+		req.Architecture != "arm64" {
+		return fmt.Errorf("unknown architecture %s", req.Architecture)
+	}
+	return nil
+}
+
+// roleRequirements returns the requirements of the role, which are those of
+// the role itself or otherwise the ones configured for its kind. Returns nil
+// if the role has no requirements
+func (t *TestRunManager) roleRequirements(
+	r *common.TestRunRole,
+) *common.RoleRequirements {
+	if r.Requirements != nil {
+		return r.Requirements
+	}
+	if req, ok := t.Config().RoleRequirements[r.Role]; ok {
+		return &req
+	}
+	return nil
+}
+
+// hostRequirements combines the requirements of the host role and the roles
+// colocated with it, since they all run on the agent of the host role.
+// Returns nil if none of them have requirements, and an error if their
+// requirements conflict
+func (t *TestRunManager) hostRequirements(
+	roles []*common.TestRunRole,
+	host *common.TestRunRole,
+) (*common.RoleRequirements, error) {
+	var ret *common.RoleRequirements
+	for _, r := range roles {
+		if h, err := hostRole(roles, r); err != nil || h != host {
+			continue
+		}
+		req := t.roleRequirements(r)
+		if req == nil {
+			continue
+		}
+		if ret == nil {
+			ret = &common.RoleRequirements{}
+		}
+		if req.MinVCPUs > ret.MinVCPUs {
+			ret.MinVCPUs = req.MinVCPUs
+		}
+		if req.MinMemoryMiB > ret.MinMemoryMiB {
+			ret.MinMemoryMiB = req.MinMemoryMiB
+		}
+		ret.NVMe = ret.NVMe || req.NVMe
+		for _, f := range []struct {
+			name     string
+			have     *string
+			required string
+		}{
+			{"architecture", &ret.Architecture, req.Architecture},
+			{"region", &ret.Region, req.Region},
+			{"availability zone", &ret.AvailabilityZone, req.AvailabilityZone},
+		} {
+			if f.required == "" {
+				continue
+			}
+			if *f.have != "" && *f.have != f.required {
+				return nil, fmt.Errorf(
+					"The roles on the agent of %s %d require conflicting %ss %s and %s",
+					host.Role,
+					host.Index,
+					f.name,
+					*f.have,
+					f.required,
+				)
+			}
+			*f.have = f.required
+		}
+	}
+	return ret, nil
+}
+
+// templateUnmet returns the requirements the instances of the launch template
+// don't meet. The memory and number of vCPUs are only checked if the launch
+// template specifies them, and checked again once the agent is online
+func templateUnmet(
+	lt awsmgr.AwsLaunchTemplate,
+	req common.RoleRequirements,
+) []string {
+	ret := []string{}
+	if req.MinVCPUs > 0 && lt.VCPUCount > 0 &&
+		int(lt.VCPUCount) < req.MinVCPUs {
+		ret = append(ret, fmt.Sprintf("%d vCPUs", req.MinVCPUs))
+	}
+	if req.MinMemoryMiB > 0 && lt.MemoryMiB > 0 &&
+		lt.MemoryMiB < req.MinMemoryMiB {
+		ret = append(ret, fmt.Sprintf("%d MiB of memory", req.MinMemoryMiB))
+	}
+	if req.NVMe && !lt.NVMe {
+		ret = append(ret, "NVMe storage")
+	}
+	if req.Architecture != "" && lt.Architecture != req.Architecture {
+		ret = append(ret, fmt.Sprintf("architecture %s", req.Architecture))
+	}
+	if req.Region != "" && lt.Region != req.Region {
+		ret = append(ret, fmt.Sprintf("region %s", req.Region))
+	}
+	if req.AvailabilityZone != "" {
+		ret = append(ret, fmt.Sprintf(
+			"availability zone %s (only connected agents can meet this)",
+			req.AvailabilityZone,
+		))
+	}
+	return ret
+}
+
+// agentUnmet returns the requirements the system of a connected agent doesn't
+// meet
+func agentUnmet(
+	info common.AgentSystemInfo,
+	req common.RoleRequirements,
+) []string {
+	ret := []string{}
+	if req.MinVCPUs > 0 && info.NumCPU < req.MinVCPUs {
+		ret = append(ret, fmt.Sprintf("%d vCPUs", req.MinVCPUs))
+	}
+	// The total memory is reported in kB
+	memMiB := float64(info.TotalMemory) / 1024
+	if req.MinMemoryMiB > 0 &&
+		memMiB < float64(req.MinMemoryMiB)*(1-agentMemoryTolerance) {
+		ret = append(ret, fmt.Sprintf("%d MiB of memory", req.MinMemoryMiB))
+	}
+	if req.NVMe && !info.NVMe {
+		ret = append(ret, "NVMe storage")
+	}
+	if req.Architecture != "" && info.Architecture != req.Architecture {
+		ret = append(ret, fmt.Sprintf("architecture %s", req.Architecture))
+	}
+	if req.Region != "" && info.Region != req.Region {
+		ret = append(ret, fmt.Sprintf("region %s", req.Region))
+	}
+	if req.AvailabilityZone != "" &&
+		info.AvailabilityZone != req.AvailabilityZone {
+		ret = append(ret, fmt.Sprintf(
+			"availability zone %s",
+			req.AvailabilityZone,
+		))
+	}
+	return ret
+}
+
+// hostAccelerator returns the kind of accelerator the roles on the agent of
+// the host role require, if any
+func hostAccelerator(
+	roles []*common.TestRunRole,
+	host *common.TestRunRole,
+) string {
+	for _, r := range roles {
+		if h, err := hostRole(roles, r); err == nil && h == host &&
+			r.Accelerator != "" {
+			return r.Accelerator
+		}
+	}
+	return ""
+}
+
+// requirementTemplate returns the launch template the role is spawned from to
+// meet the requirements of the roles on its agent. This is the launch template
+// of the role if it meets them, and otherwise the smallest launch template
+// that does, preferring the region and architecture of the launch template of
+// the role. Roles placed in a region by the test run only get a launch
+// template in that region, since the region placement would otherwise be
+// undone. Roles that are placed manually, colocated with another role or
+// run on a connected agent or a pool of static agents keep their placement.
+// Returns an empty string if the role doesn't run on a launch template
+func (t *TestRunManager) requirementTemplate(
+	tr *common.TestRun,
+	r *common.TestRunRole,
+) (string, error) {
+	if r.ManualPlacement || r.ColocateWith != nil || r.AgentID > 0 ||
+		r.AgentPool != "" {
+		return r.AwsLaunchTemplateID, nil
+	}
+	req, err := t.hostRequirements(tr.Roles, r)
+	if err != nil || req == nil {
+		return r.AwsLaunchTemplateID, err
+	}
+	current, err := t.awsm.GetLaunchTemplate(r.AwsLaunchTemplateID)
+	if err == nil && len(templateUnmet(current, *req)) == 0 {
+		return current.TemplateID, nil
+	}
+
+	placement := regionPlacement(tr, r.Role)
+	region := placement
+	if region == "" {
+		region = current.Region
+	}
+	accelerator := hostAccelerator(tr.Roles, r)
+	candidates := []awsmgr.AwsLaunchTemplate{}
+	for _, lt := range t.awsm.LaunchTemplates() {
+		if placement != "" && lt.Region != placement {
+			continue
+		}
+		if len(templateUnmet(lt, *req)) == 0 &&
+			(accelerator == "" || lt.Accelerator == accelerator) {
+			candidates = append(candidates, lt)
+		}
+	}
+	if len(candidates) == 0 && placement != "" {
+		return "", fmt.Errorf(
+			"There is no launch template for %s %d in region %s that meets its requirements: %s",
+			r.Role,
+			r.Index,
+			placement,
+			strings.Join(templateUnmet(current, *req), ", "),
+		)
+	}
+	if len(candidates) == 0 {
+		return "", fmt.Errorf(
+			"There is no launch template for %s %d that meets its requirements: %s",
+			r.Role,
+			r.Index,
+			strings.Join(templateUnmet(current, *req), ", "),
+		)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if (a.Region == region) != (b.Region == region) {
+			return a.Region == region
+		}
+		if (a.Architecture == current.Architecture) !=
+			(b.Architecture == current.Architecture) {
+			return a.Architecture == current.Architecture
+		}
+		if a.VCPUCount != b.VCPUCount {
+			return a.VCPUCount < b.VCPUCount
+		}
+		if a.MemoryMiB != b.MemoryMiB {
+			return a.MemoryMiB < b.MemoryMiB
+		}
+		return a.TemplateID < b.TemplateID
+	})
+	return candidates[0].TemplateID, nil
+}
+
+// placeRoles moves the roles of the test run whose launch template doesn't
+// meet their requirements to one that does
+func (t *TestRunManager) placeRoles(tr *common.TestRun) {
+	for _, r := range tr.Roles {
+		id, err := t.requirementTemplate(tr, r)
+		if err == nil && id != "" && id != r.AwsLaunchTemplateID {
+			t.WriteLog(
+				tr,
+				"Placed %s %d on launch template %s to meet its requirements",
+				r.Role,
+				r.Index,
+				id,
+			)
+			r.AwsLaunchTemplateID = id
+		}
+	}
+	syncColocatedRoles(tr.Roles)
+}
+
+// validateRoleRequirements checks that the agents of the roles meet their
+// requirements once the test run is placed. For connected agents these are
+// checked against the system they reported, for agents that are yet to be
+// spawned against their launch template. Since spawned agents only report
+// their system once they are online, this is checked again after they have
+// connected
+func (t *TestRunManager) validateRoleRequirements(
+	tr *common.TestRun,
+) []error {
+	ret := []error{}
+	for _, r := range tr.Roles {
+		if r.Requirements != nil {
+			if err := validateRequirements(*r.Requirements); err != nil {
+				ret = append(ret, fmt.Errorf(
+					"Requirements of %s %d: %v",
+					r.Role,
+					r.Index,
+					err,
+				))
+			}
+		}
+		if r.ColocateWith != nil {
+			continue
+		}
+		req, err := t.hostRequirements(tr.Roles, r)
+		if err != nil {
+			ret = append(ret, err)
+			continue
+		}
+		// Reported by validateAgentPools until an agent is chosen
+		if unassignedPoolRole(r) {
+			continue
+		}
+		if req == nil {
+			continue
+		}
+
+		var unmet []string
+		if r.AgentID > 0 {
+			a, err := t.coord.GetAgent(r.AgentID)
+			if err != nil {
+				continue
+			}
+			unmet = agentUnmet(a.SystemInfo, *req)
+		} else {
+			id, err := t.requirementTemplate(tr, r)
+			if err != nil {
+				ret = append(ret, err)
+				continue
+			}
+			placed := *r
+			placed.AwsLaunchTemplateID = id
+			id, err = t.placedTemplate(tr, &placed)
+			if err != nil || id == "" {
+				// Reported by validateRegionPlacement
+				continue
+			}
+			lt, err := t.awsm.GetLaunchTemplate(id)
+			if err != nil {
+				continue
+			}
+			unmet = templateUnmet(lt, *req)
+		}
+		if len(unmet) > 0 {
+			ret = append(ret, fmt.Errorf(
+				"The agent of %s %d does not meet its requirements: %s",
+				r.Role,
+				r.Index,
+				strings.Join(unmet, ", "),
+			))
+		}
+	}
+	return ret
+}
@@ -0,0 +1,113 @@
+package testruns
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/coordinator/sources"
+)
+
+// RoleBinary returns the executable to launch for the given role in the test
+// run. This is the override configured in the test run if present, or the
+// default from the architecture manifest or roleBinaries otherwise
+func (t *TestRunManager) RoleBinary(
+	tr *common.TestRun,
+	role common.SystemRole,
+) string {
+	if tr.RoleBinaryOverrides != nil {
+		if bin, ok := tr.RoleBinaryOverrides[role]; ok && bin != "" {
+			return imageBinary(tr, bin)
+		}
+	}
+	return imageBinary(tr, t.defaultRoleBinary(tr, role))
+}
+
+// ValidateRoleBinaryOverrides checks that all role binary overrides in the test
+// run refer to roles that are part of the test run and to executables that are
+// present in the binaries archive for the test run's commit, or in the
+// binaries of one of its components. If the archive is
+// not present locally (because it was compiled earlier and only exists in S3)
+// it is downloaded from binariesInS3 first. The archives for the different
+// architectures contain the same files, so only the one for arch is checked
+func (t *TestRunManager) ValidateRoleBinaryOverrides(
+	tr *common.TestRun,
+	arch string,
+	binariesInS3 string,
+) error {
+	if len(tr.RoleBinaryOverrides) == 0 {
+		return nil
+	}
+
+	debug := tr.RunPerf || tr.Debug
+	path, err := sources.BinariesArchivePath(
+		tr.CommitHash,
+		debug,
+		arch,
+		tr.BuildConfig,
+	)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		err = t.awsm.DownloadFromS3(common.S3Download{
+			SourceRegion: os.Getenv("AWS_REGION"),
+			SourceBucket: os.Getenv("BINARIES_S3_BUCKET"),
+			SourcePath:   binariesInS3,
+			TargetPath:   path,
+		})
+		if err != nil {
+			return fmt.Errorf("Unable to download binaries archive: %v", err)
+		}
+	}
+
+	manifest, err := sources.BinariesManifest(
+		tr.CommitHash,
+		debug,
+		arch,
+		tr.BuildConfig,
+	)
+	if err != nil {
+		return fmt.Errorf("Unable to read binaries manifest: %v", err)
+	}
+	inManifest := map[string]bool{}
+	for _, f := range manifest {
+		inManifest[f] = true
+	}
+
+	for role, bin := range tr.RoleBinaryOverrides {
+		if t.defaultRoleBinary(tr, role) == "" {
+			return fmt.Errorf("Cannot override binary for unknown role %s", role)
+		}
+		hasRole := false
+		for _, r := range tr.Roles {
+			if r.Role == role {
+				hasRole = true
+				break
+			}
+		}
+		if !hasRole {
+			return fmt.Errorf(
+				"Cannot override binary for role %s, which is not part of the test run",
+				role,
+			)
+		}
+		bin = filepath.Clean(bin)
+		// Binaries of components are deployed from their own archives
+		if !inManifest[bin] && !isComponentBinary(tr, bin) {
+			return fmt.Errorf(
+				"Binary %s for role %s is not present in the binaries archive",
+				bin,
+				role,
+			)
+		}
+		tr.RoleBinaryOverrides[role] = bin
+		t.WriteLog(tr, "Using binary %s for role %s", bin, role)
+	}
+
+	// Persist the validated selection such that it is recorded in the test
+	// run's metadata
+	t.PersistTestRun(tr)
+	return nil
+}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/mit-dci/opencbdc-tctl/common"
 	"github.com/mit-dci/opencbdc-tctl/coordinator"
+	"github.com/mit-dci/opencbdc-tctl/coordinator/awsmgr"
 )
 
 // GenerateConfig creates a configuration file to place on all nodes
@@ -26,7 +27,18 @@ func (t *TestRunManager) GenerateConfig(
 		common.TestRunStatusRunning,
 		fmt.Sprintf("Generating config (Dummy=%t)", dummy),
 	)
-	if t.Is2PC(tr.Architecture) {
+	return t.generateConfig(tr, dummy)
+}
+
+// generateConfig generates the configuration file for the architecture of the
+// test run, without updating its status
+func (t *TestRunManager) generateConfig(
+	tr *common.TestRun,
+	dummy bool,
+) ([]byte, error) {
+	if m := t.architectureManifest(tr.Architecture); m != nil {
+		return t.GenerateConfigManifest(tr, m, dummy)
+	} else if t.Is2PC(tr.Architecture) {
 		return t.GenerateConfigTwoPhase(tr, dummy)
 	} else if t.IsAtomizer(tr.Architecture) {
 		return t.GenerateConfigAtomizer(tr, dummy)
@@ -208,19 +220,33 @@ func (t *TestRunManager) writeTestRunConfigVariables(
 		numClis += numRoles[common.SystemRoleParsecGen]
 		numClis += numRoles[common.SystemRoleTwoPhaseGen]
 
+		target := float64(tr.LoadGenTPSTarget)
+		stepTime := tr.LoadGenTPSStepTime
+		stepPercent := tr.LoadGenTPSStepPercent
+		stepStart := tr.LoadGenTPSStepStart
+		if tr.LoadProfile != nil {
+			// The load generators step up to the end of the profile
+			// themselves, or run at its peak if the agents throttle them
+			var fraction float64
+			fraction, stepTime, stepPercent, stepStart = loadProfileStepParams(
+				tr.LoadProfile,
+			)
+			target *= fraction
+		}
+
 		// Calculate target per role
-		tpsTarget := int(float64(tr.LoadGenTPSTarget) / float64(numClis))
+		tpsTarget := int(target / float64(numClis))
 
 		if _, err := cfg.Write([]byte(fmt.Sprintf("loadgen_tps_target=%d\n", tpsTarget))); err != nil {
 			return err
 		}
-		if _, err := cfg.Write([]byte(fmt.Sprintf("loadgen_tps_step_time=%.5f\n", tr.LoadGenTPSStepTime))); err != nil {
+		if _, err := cfg.Write([]byte(fmt.Sprintf("loadgen_tps_step_time=%.5f\n", stepTime))); err != nil {
 			return err
 		}
-		if _, err := cfg.Write([]byte(fmt.Sprintf("loadgen_tps_step_percentage=%.5f\n", tr.LoadGenTPSStepPercent))); err != nil {
+		if _, err := cfg.Write([]byte(fmt.Sprintf("loadgen_tps_step_percentage=%.5f\n", stepPercent))); err != nil {
 			return err
 		}
-		if _, err := cfg.Write([]byte(fmt.Sprintf("loadgen_tps_step_start=%.5f\n", tr.LoadGenTPSStepStart))); err != nil {
+		if _, err := cfg.Write([]byte(fmt.Sprintf("loadgen_tps_step_start=%.5f\n", stepStart))); err != nil {
 			return err
 		}
 	}
@@ -242,7 +268,7 @@ func (t *TestRunManager) writePreseedConfigVariables(
 		); err != nil {
 			return err
 		}
-		if _, err := cfg.Write([]byte("seed_value=1000000\n")); err != nil {
+		if _, err := cfg.Write([]byte(fmt.Sprintf("seed_value=%d\n", awsmgr.DefaultSeedValue))); err != nil {
 			return err
 		}
 		if _, err := cfg.Write([]byte("seed_from=0\n")); err != nil {
@@ -321,6 +347,17 @@ func (t *TestRunManager) RoleLogLevel(
 		loglevel = tr.WatchtowerLogLevel
 	case common.SystemRoleCoordinator:
 		loglevel = tr.CoordinatorLogLevel
+	case common.SystemRoleAtomizerCliWatchtower:
+		fallthrough
+	case common.SystemRoleTwoPhaseGen:
+		fallthrough
+	case common.SystemRoleParsecGen:
+		fallthrough
+	case common.SystemRoleLoadGen:
+		loglevel = tr.LoadGenLogLevel
+	}
+	if loglevel == "" {
+		loglevel = "WARN"
 	}
 	return loglevel
 }
@@ -0,0 +1,182 @@
+package testruns
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/coordinator"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// roleLogRefresh is how often the agents streaming the logs of roles are
+// asked to continue, which must be well within the lease of their stream
+const roleLogRefresh = 10 * time.Second
+
+// roleLogLinesPerSecond is the maximum rate at which each agent streams the
+// output of its roles
+const roleLogLinesPerSecond = 200
+
+// roleCommand is the role of a test run a command was started for
+type roleCommand struct {
+	testRunID string
+	role      common.TestRunRoleRef
+}
+
+// recordRoleCommand remembers the role the command was started for, such that
+// its output and exit can be attributed to the role rather than to the agent,
+// which can run several roles
+func (t *TestRunManager) recordRoleCommand(
+	tr *common.TestRun,
+	r *common.TestRunRole,
+	commandID []byte,
+) {
+	t.roleCommands.Store(fmt.Sprintf("%x", commandID), roleCommand{
+		testRunID: tr.ID,
+		role:      common.TestRunRoleRef{Role: r.Role, Index: r.Index},
+	})
+}
+
+// commandRole returns the role the command with the hex encoded ID was
+// started for, if it was started for a role of a running test run
+func (t *TestRunManager) commandRole(
+	commandID string,
+) (common.TestRunRoleRef, bool) {
+	v, ok := t.roleCommands.Load(commandID)
+	if !ok {
+		return common.TestRunRoleRef{}, false
+	}
+	return v.(roleCommand).role, true
+}
+
+// forgetRoleCommands forgets the roles of the commands of the test run once
+// it's done
+func (t *TestRunManager) forgetRoleCommands(tr *common.TestRun) {
+	t.roleCommands.Range(func(k, v interface{}) bool {
+		if v.(roleCommand).testRunID == tr.ID {
+			t.roleCommands.Delete(k)
+		}
+		return true
+	})
+}
+
+// SubscribeRoleLogs makes the agents of the roles selected by the filter
+// stream their output while the test run is running, until the returned func
+// is called. The lines are published as EventTypeRoleLogLines events
+func (t *TestRunManager) SubscribeRoleLogs(
+	f coordinator.RoleLogFilter,
+) func() {
+	sub := &f
+	t.roleLogSubscriptionsLock.Lock()
+	t.roleLogSubscriptions[sub] = true
+	t.roleLogSubscriptionsLock.Unlock()
+	go t.refreshRoleLogStreams()
+	return func() {
+		t.roleLogSubscriptionsLock.Lock()
+		delete(t.roleLogSubscriptions, sub)
+		t.roleLogSubscriptionsLock.Unlock()
+		go t.refreshRoleLogStreams()
+	}
+}
+
+// roleLogStreamLoop keeps the agents the users subscribed to the logs of
+// streaming, and picks up the agents of test runs that were placed after the
+// subscription
+func (t *TestRunManager) roleLogStreamLoop() {
+	for {
+		time.Sleep(roleLogRefresh)
+		t.refreshRoleLogStreams()
+	}
+}
+
+// refreshRoleLogStreams asks the agents of the roles selected by the
+// subscriptions to (continue to) stream their output, and the agents that are
+// no longer selected to stop
+func (t *TestRunManager) refreshRoleLogStreams() {
+	t.roleLogRefreshLock.Lock()
+	defer t.roleLogRefreshLock.Unlock()
+
+	t.roleLogSubscriptionsLock.Lock()
+	subs := make([]coordinator.RoleLogFilter, 0, len(t.roleLogSubscriptions))
+	for f := range t.roleLogSubscriptions {
+		subs = append(subs, *f)
+	}
+	previous := t.roleLogAgents
+	t.roleLogSubscriptionsLock.Unlock()
+	if len(subs) == 0 && len(previous) == 0 {
+		return
+	}
+
+	wanted := map[int32]bool{}
+	for _, f := range subs {
+		tr, ok := t.GetTestRun(f.TestRunID)
+		if !ok || tr.Status != common.TestRunStatusRunning {
+			continue
+		}
+		for _, r := range tr.Roles {
+			if r.AgentID != 0 &&
+				f.MatchesAgent(r.AgentID, agentRoles(tr, r.AgentID)) {
+				wanted[r.AgentID] = true
+			}
+		}
+	}
+	for agentID := range wanted {
+		err := t.am.SetLogStream(agentID, true, roleLogLinesPerSecond)
+		if err != nil {
+			logging.Warnf(
+				"Unable to stream the output of agent %d: %v",
+				agentID,
+				err,
+			)
+		}
+	}
+	for agentID := range previous {
+		if wanted[agentID] {
+			continue
+		}
+		err := t.am.SetLogStream(agentID, false, 0)
+		if err != nil {
+			// The stream ends by itself once its lease expires
+			logging.Debugf(
+				"Unable to stop streaming the output of agent %d: %v",
+				agentID,
+				err,
+			)
+		}
+	}
+
+	t.roleLogSubscriptionsLock.Lock()
+	t.roleLogAgents = wanted
+	t.roleLogSubscriptionsLock.Unlock()
+}
+
+// publishRoleLogLines is set as the agent log lines func of the coordinator.
+// If the agent is part of a running test run, the lines are attributed to the
+// roles whose commands wrote them and published to the users subscribed to
+// the logs of these roles
+func (t *TestRunManager) publishRoleLogLines(
+	agentID int32,
+	lines []coordinator.RoleLogLine,
+	skippedBytes int64,
+) {
+	tr := t.agentInUse(nil, agentID)
+	if tr == nil {
+		return
+	}
+	for i := range lines {
+		if ref, ok := t.commandRole(lines[i].CommandID); ok {
+			lines[i].Role = ref.Role
+			lines[i].Index = ref.Index
+		}
+	}
+	t.ev <- coordinator.Event{
+		Type: coordinator.EventTypeRoleLogLines,
+		Payload: coordinator.RoleLogLinesPayload{
+			TestRunID:    tr.ID,
+			AgentID:      agentID,
+			Roles:        agentRoles(tr, agentID),
+			Lines:        lines,
+			SkippedBytes: skippedBytes,
+		},
+	}
+}
@@ -0,0 +1,86 @@
+package testruns
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+)
+
+// roleOverridesFile is the name of the file in the outputs of a test run that
+// records the command line and environment overrides of its roles
+const roleOverridesFile = "role_overrides.json"
+
+// envAssignment matches a KEY=VALUE environment variable assignment
+var envAssignment = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*=`)
+
+// reservedEnvPrefixes are the prefixes of the environment variables the
+// coordinator sets for the roles itself, which cannot be overridden
+var reservedEnvPrefixes = []string{"TESTRUN_", "AWS_"}
+
+// roleOverride is the record of the overrides of a single role
+type roleOverride struct {
+	Role      common.SystemRole `json:"role"`
+	Index     int               `json:"roleIdx"`
+	ExtraArgs []string          `json:"extraArgs,omitempty"`
+	ExtraEnv  []string          `json:"extraEnv,omitempty"`
+}
+
+// validateRoleOverrides checks that the extra environment variables of the
+// roles are KEY=VALUE assignments that don't override the variables set by
+// the coordinator
+func validateRoleOverrides(roles []*common.TestRunRole) []error {
+	ret := []error{}
+	for _, r := range roles {
+		for _, e := range r.ExtraEnv {
+			if !envAssignment.MatchString(e) {
+				ret = append(ret, fmt.Errorf(
+					"%s %d: environment variable %q is not of the form KEY=VALUE",
+					r.Role,
+					r.Index,
+					e,
+				))
+				continue
+			}
+			for _, p := range reservedEnvPrefixes {
+				if strings.HasPrefix(e, p) {
+					ret = append(ret, fmt.Errorf(
+						"%s %d: environment variables starting with %s are set by the coordinator",
+						r.Role,
+						r.Index,
+						p,
+					))
+				}
+			}
+		}
+	}
+	return ret
+}
+
+// UploadRoleOverrides records the command line and environment overrides of
+// the roles of the test run verbatim in its outputs, next to the
+// configuration file. Nothing is uploaded if no role has overrides
+func (t *TestRunManager) UploadRoleOverrides(tr *common.TestRun) error {
+	overrides := []roleOverride{}
+	for _, r := range tr.Roles {
+		if len(r.ExtraArgs) == 0 && len(r.ExtraEnv) == 0 {
+			continue
+		}
+		overrides = append(overrides, roleOverride{
+			Role:      r.Role,
+			Index:     r.Index,
+			ExtraArgs: r.ExtraArgs,
+			ExtraEnv:  r.ExtraEnv,
+		})
+	}
+	if len(overrides) == 0 {
+		return nil
+	}
+	b, err := json.MarshalIndent(overrides, "", "  ")
+	if err != nil {
+		return err
+	}
+	return t.uploadRunOutput(tr, roleOverridesFile, b)
+}
@@ -0,0 +1,136 @@
+package testruns
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+)
+
+// ErrSavedSearchNotFound is returned when no saved search with the requested
+// ID exists
+var ErrSavedSearchNotFound = errors.New("Saved search not found")
+
+// SavedSearch is a label expression saved under a name, such that recurring
+// selections of test runs don't have to be typed again
+type SavedSearch struct {
+	ID                  string    `json:"id"`
+	Name                string    `json:"name"`
+	Expression          string    `json:"expression"`
+	Created             time.Time `json:"created"`
+	CreatedByThumbprint string    `json:"createdByThumbprint"`
+}
+
+// savedSearchesPath returns the path of the file the saved searches are
+// persisted in
+func savedSearchesPath() string {
+	return filepath.Join(common.DataDir(), "testruns", "savedsearches.json")
+}
+
+// loadSavedSearches reads the saved searches from disk
+func (t *TestRunManager) loadSavedSearches() error {
+	b, err := os.ReadFile(savedSearchesPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	t.savedSearchesLock.Lock()
+	defer t.savedSearchesLock.Unlock()
+	return json.Unmarshal(b, &t.savedSearches)
+}
+
+// persistSavedSearches writes the saved searches to disk. Must be called with
+// savedSearchesLock held
+func (t *TestRunManager) persistSavedSearches() error {
+	b, err := json.Marshal(t.savedSearches)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(savedSearchesPath()), 0755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(savedSearchesPath(), b, 0644)
+}
+
+// CreateSavedSearch validates and saves a named label expression. Names must
+// be unique
+func (t *TestRunManager) CreateSavedSearch(
+	s *SavedSearch,
+	createdByThumbprint string,
+) (*SavedSearch, error) {
+	s.Name = strings.TrimSpace(s.Name)
+	if s.Name == "" {
+		return nil, errors.New("Saved search has no name")
+	}
+	if _, err := ParseLabelExpression(s.Expression); err != nil {
+		return nil, err
+	}
+	var err error
+	s.ID, err = common.RandomID(12)
+	if err != nil {
+		return nil, err
+	}
+	s.Created = time.Now()
+	s.CreatedByThumbprint = createdByThumbprint
+
+	t.savedSearchesLock.Lock()
+	defer t.savedSearchesLock.Unlock()
+	for _, e := range t.savedSearches {
+		if strings.EqualFold(e.Name, s.Name) {
+			return nil, fmt.Errorf(
+				"A saved search named %q already exists",
+				s.Name,
+			)
+		}
+	}
+	t.savedSearches = append(t.savedSearches, s)
+	err = t.persistSavedSearches()
+	if err != nil {
+		t.savedSearches = t.savedSearches[:len(t.savedSearches)-1]
+		return nil, err
+	}
+	return s, nil
+}
+
+// SavedSearches returns the saved searches
+func (t *TestRunManager) SavedSearches() []*SavedSearch {
+	t.savedSearchesLock.Lock()
+	defer t.savedSearchesLock.Unlock()
+	return append([]*SavedSearch{}, t.savedSearches...)
+}
+
+// GetSavedSearch returns the saved search with the given ID
+func (t *TestRunManager) GetSavedSearch(id string) (*SavedSearch, error) {
+	t.savedSearchesLock.Lock()
+	defer t.savedSearchesLock.Unlock()
+	for _, s := range t.savedSearches {
+		if s.ID == id {
+			return s, nil
+		}
+	}
+	return nil, ErrSavedSearchNotFound
+}
+
+// DeleteSavedSearch removes a saved search
+func (t *TestRunManager) DeleteSavedSearch(id string) error {
+	t.savedSearchesLock.Lock()
+	defer t.savedSearchesLock.Unlock()
+	for i, s := range t.savedSearches {
+		if s.ID == id {
+			t.savedSearches = append(
+				t.savedSearches[:i],
+				t.savedSearches[i+1:]...,
+			)
+			return t.persistSavedSearches()
+		}
+	}
+	return ErrSavedSearchNotFound
+}
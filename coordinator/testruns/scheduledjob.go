@@ -0,0 +1,155 @@
+package testruns
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// scheduledJob is a job the coordinator starts at recurring times, such as
+// the nightly pipeline and the weekly report
+type scheduledJob struct {
+	// The name the job logs under
+	name string
+	// How often the job checks whether it's due
+	poll time.Duration
+	// How long after its scheduled time a job that was missed (because the
+	// coordinator was down) is still started
+	catchUp time.Duration
+	// Returns the most recent scheduled time of the job at or before now,
+	// and false if the job is disabled
+	slot func(now time.Time) (time.Time, bool)
+	// Returns true if the job already ran for the scheduled time
+	ran func(slot time.Time) bool
+	// Runs the job for the scheduled time
+	run func(slot time.Time) error
+	// The error run returns when the job is already running
+	errRunning error
+}
+
+// runScheduledJob is the loop that starts the job at its scheduled times
+func (t *TestRunManager) runScheduledJob(j scheduledJob) {
+	for {
+		time.Sleep(j.poll)
+		if !t.loadComplete {
+			continue
+		}
+		slot, enabled := j.slot(time.Now())
+		if !enabled || time.Since(slot) > j.catchUp || j.ran(slot) {
+			continue
+		}
+		err := j.run(slot)
+		if err != nil && err != j.errRunning {
+			logging.Errorf("[%s] Job failed: %v", j.name, err)
+		}
+	}
+}
+
+// dailySlot returns the most recent time at the given time of day (UTC) at
+// or before now
+func dailySlot(now time.Time, hour, minute int) time.Time {
+	now = now.UTC()
+	slot := time.Date(
+		now.Year(),
+		now.Month(),
+		now.Day(),
+		hour,
+		minute,
+		0,
+		0,
+		time.UTC,
+	)
+	if slot.After(now) {
+		slot = slot.AddDate(0, 0, -1)
+	}
+	return slot
+}
+
+// weeklySlot returns the most recent time at the given day of the week and
+// time of day (UTC) at or before now
+func weeklySlot(
+	now time.Time,
+	weekday time.Weekday,
+	hour, minute int,
+) time.Time {
+	slot := dailySlot(now, hour, minute)
+	offset := (int(slot.Weekday()) - int(weekday) + 7) % 7
+	return slot.AddDate(0, 0, -offset)
+}
+
+// loadJobHistory reads the history of a scheduled job from the file into v
+func loadJobHistory(path string, v interface{}) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logging.Warnf("Unable to read job history %s: %v", path, err)
+		}
+		return
+	}
+	err = json.Unmarshal(b, v)
+	if err != nil {
+		logging.Warnf("Unable to parse job history %s: %v", path, err)
+	}
+}
+
+// persistJobHistory writes the history of a scheduled job to the file
+func persistJobHistory(path string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0644)
+}
+
+// jobCommit refreshes the sources and returns the head of the branch a
+// scheduled job benchmarks, or the head of the main branch if it's empty
+func (t *TestRunManager) jobCommit(name, branch string) (string, error) {
+	logging.Infof("[%s] Updating sources", name)
+	err := t.src.EnsureSourcesUpdated()
+	if err != nil {
+		return "", err
+	}
+	var commit string
+	if branch != "" {
+		commit, _, err = t.src.ResolveRef(branch)
+	} else {
+		commit, err = t.src.MainlineHead()
+	}
+	if err != nil {
+		return "", fmt.Errorf(
+			"Unable to determine the commit to benchmark: %v",
+			err,
+		)
+	}
+	return commit, nil
+}
+
+// jobTestRun returns a copy of the template for a test run scheduled by a
+// job, without the fields of the submission it was copied from and tagged
+// with the tag of the job
+func jobTestRun(template *common.TestRun, tag string) (*common.TestRun, error) {
+	_, tr, err := common.GetTestRunCopy(template)
+	if err != nil {
+		return nil, err
+	}
+	tr.CreatedByThumbprint = ""
+	tr.SweepID = ""
+	tr.AwaitingApproval = false
+	tr.ApprovedByThumbprint = ""
+	tr.Tags = appendUnique(tr.Tags, tag)
+	return tr, nil
+}
+
+// appendUnique appends s to the list unless it's in it already
+func appendUnique(list []string, s string) []string {
+	for _, e := range list {
+		if e == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
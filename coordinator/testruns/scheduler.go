@@ -12,6 +12,41 @@ import (
 	"github.com/mit-dci/opencbdc-tctl/logging"
 )
 
+// ApplySubmissionDefaults sets the defaults of the fields of a submitted test
+// run that are not set, before it is expanded into the runs of its sweep
+func ApplySubmissionDefaults(tr *common.TestRun) {
+	if tr.Repeat == 0 {
+		tr.Repeat = 1
+	}
+
+	if tr.WatchtowerErrorCacheSize == 0 {
+		tr.WatchtowerErrorCacheSize = 10000000
+	}
+
+	if tr.FailoverRole != "" {
+		if tr.FailoverCount == 0 {
+			tr.FailoverCount = 1
+		}
+		if tr.FailoverInterval == 0 {
+			tr.FailoverInterval = 60
+		}
+		if tr.FailoverRecovery == 0 {
+			tr.FailoverRecovery = 90
+		}
+	}
+
+	if tr.Sweep == "peak" {
+		tr.SweepOneAtATime = true
+	}
+
+	// The runs of a comparison are executed back-to-back such that both
+	// commits are tested under the same circumstances
+	if tr.Sweep == "comparison" {
+		tr.SweepOneAtATime = false
+		tr.SweepConcurrency = 1
+	}
+}
+
 // ScheduleTestRun will add the given testrun to the set of queued testruns.
 // This method will assign a testrun its ID and set the creation time, initiate
 // certain fields with their defaults if not set, persist it and broadcast it
@@ -28,11 +63,33 @@ func (t *TestRunManager) ScheduleTestRun(tr *common.TestRun) {
 	}
 
 	tr.Created = time.Now()
+	tr.FeatureFlags = t.coord.FeatureFlagsForRun(tr.ID, tr.CreatedByThumbprint)
 	tr.Completed = time.Date(0001, 1, 1, 00, 00, 00, 00, time.UTC)
 	tr.Started = time.Date(0001, 1, 1, 00, 00, 00, 00, time.UTC)
 	tr.Status = common.TestRunStatusQueued
 	tr.Details = ""
+	if len(tr.DependsOn) > 0 {
+		tr.Details = "Waiting for dependencies"
+	}
+	if tr.AwaitingApproval {
+		tr.Details = "Awaiting approval"
+	}
+	// Runs of a sweep that reached its budget are held from the start
+	tr.SweepBudgetHold = tr.SweepID != "" && t.sweepBudgetReached(tr.SweepID)
 	tr.ExecutedCommands = []*common.ExecutedCommand{}
+	// Copies of earlier test runs don't carry over how those ended
+	tr.FailureClass = ""
+	tr.FailureClassReason = ""
+	tr.Pauses = nil
+	tr.FaultTimeline = nil
+	tr.SoakCheckpoints = nil
+	tr.SoakState = nil
+	tr.Annotations = nil
+	tr.LoadProfileStarted = time.Time{}
+	tr.QueueBlocked = ""
+	placePoolRoles(tr)
+	t.placeRoles(tr)
+	t.applyRegionPlacement(tr)
 
 	if tr.ArchiverLogLevel == "" {
 		tr.ArchiverLogLevel = "WARN"
@@ -49,6 +106,18 @@ func (t *TestRunManager) ScheduleTestRun(tr *common.TestRun) {
 	if tr.WatchtowerLogLevel == "" {
 		tr.WatchtowerLogLevel = "WARN"
 	}
+	if tr.CoordinatorLogLevel == "" {
+		tr.CoordinatorLogLevel = "WARN"
+	}
+	if tr.AgentLogLevel == "" {
+		tr.AgentLogLevel = "WARN"
+	}
+	if tr.TicketerLogLevel == "" {
+		tr.TicketerLogLevel = "WARN"
+	}
+	if tr.LoadGenLogLevel == "" {
+		tr.LoadGenLogLevel = "WARN"
+	}
 	if tr.LoadGenAccounts == 0 {
 		tr.LoadGenAccounts = 100
 	}
@@ -78,6 +147,19 @@ func (t *TestRunManager) Scheduler() {
 			// This is a janitor routine to look for running instances that are
 			// not associated with a running testrun - they might have been left
 			// running by mistake and should be terminated.
+			// Instances kept in a warm environment outlive the test run
+			// that launched them (and is in their tag) while the environment
+			// is idle or reused by a running test run
+			warm := map[string]bool{}
+			for _, w := range t.WarmEnvironments() {
+				warm[w.ID] = true
+			}
+			for _, r := range t.GetTestRuns() {
+				if r.Status == common.TestRunStatusRunning &&
+					r.WarmEnvironmentID != "" {
+					warm[r.WarmEnvironmentID] = true
+				}
+			}
 			instances := t.awsm.RunningInstances()
 			killInstances := []*awsmgr.AwsInstance{}
 			for _, i := range instances {
@@ -90,6 +172,9 @@ func (t *TestRunManager) Scheduler() {
 
 				if testrunID != "" {
 					r, ok := t.GetTestRun(testrunID)
+					if ok && warm[r.WarmEnvironmentID] {
+						continue
+					}
 					if !ok {
 						logging.Infof(
 							"Instance %s (region %s) is active for an unknown testrun %s - killing",
@@ -122,6 +207,11 @@ func (t *TestRunManager) Scheduler() {
 			// results) while the test agents have already been shut down)
 			runningVCPUs := map[string]int32{}
 			runningAgents := 0
+			runningRegionAgents := map[string]int{}
+			quotas := t.newQuotaUsage()
+			// The static agents chosen for the test runs started in this
+			// iteration, which aren't running yet
+			poolAgentsTaken := map[int32]bool{}
 			var nextQueued []*common.TestRun
 			t.testRunsLock.Lock()
 			for _, tr := range t.testRuns {
@@ -137,18 +227,40 @@ func (t *TestRunManager) Scheduler() {
 						}
 					}
 					runningAgents += len(tr.Roles)
+					for k, v := range t.regionAgents(tr) {
+						runningRegionAgents[k] += v
+					}
+					quotas.add(tr, totalVCPUs(runningVCPUsForTestRun), 1)
 				}
 			}
 
-			// Sort the queue by priority
-			queue := t.testRuns[:]
-			sort.Slice(queue, func(i, j int) bool {
-				return queue[i].Priority > queue[j].Priority
+			// Sort the queue by priority, runs of the same priority are
+			// started in the order they were scheduled. The queue is a copy,
+			// such that sorting it leaves the order of t.testRuns intact
+			queue := make([]*common.TestRun, len(t.testRuns))
+			copy(queue, t.testRuns)
+			sort.SliceStable(queue, func(i, j int) bool {
+				if queue[i].Priority != queue[j].Priority {
+					return queue[i].Priority > queue[j].Priority
+				}
+				return queue[i].Created.Before(queue[j].Created)
 			})
 
 			for i, tr := range queue {
 				if tr.Status == common.TestRunStatusQueued {
 
+					// Test runs that depend on other test runs wait until
+					// those ended, and are skipped if one of them didn't end
+					// as required
+					ready, skip := t.dependencyState(tr)
+					if skip != "" {
+						t.UpdateStatus(tr, common.TestRunStatusSkipped, skip)
+						continue
+					}
+					if !ready {
+						continue
+					}
+
 					// Test runs (specifically: time sweeps) can have a
 					// configuration disallowing running the testrun before a
 					// certain time - in which case this test run shouldn't be
@@ -159,10 +271,40 @@ func (t *TestRunManager) Scheduler() {
 						continue
 					}
 
+					// Test runs that matched a lint rule requiring approval
+					// are held in the queue until they are approved
+					if tr.AwaitingApproval {
+						continue
+					}
+
+					// Test runs of a sweep that reached its budget are held
+					// until the owner extends the budget
+					if tr.SweepBudgetHold {
+						continue
+					}
+
 					// See how many VCPUs are needed for this testrun, and if
 					// they fall within our allowed quota. If not, we cannot
 					// consider this test run for execution
 					requiredVCPUsForTestRun := t.GetRequiredVCPUs(tr)
+
+					// Check if executing this test would exceed the quota of
+					// the user that scheduled it or their team, such that a
+					// single large sweep can't starve everyone else
+					reason := quotas.blocked(
+						tr,
+						totalVCPUs(requiredVCPUsForTestRun),
+					)
+					if reason != "" {
+						logging.Infof(
+							"Can't start test run %s because of its quota: %s",
+							tr.ID,
+							reason,
+						)
+						t.setQueueBlocked(tr, reason)
+						continue
+					}
+
 					for k, v := range requiredVCPUsForTestRun {
 						cur, ok := runningVCPUs[k]
 						if !ok {
@@ -180,6 +322,10 @@ func (t *TestRunManager) Scheduler() {
 							"Can't start test run %s because there's not enough capacity",
 							tr.ID,
 						)
+						t.setQueueBlocked(tr, "Waiting for vCPU capacity")
+						if t.preemptFor(tr, runningVCPUs, runningAgents) {
+							runningAgents += t.reserveCapacity(tr, runningVCPUs)
+						}
 						continue
 					}
 
@@ -191,6 +337,44 @@ func (t *TestRunManager) Scheduler() {
 							"Can't start test run %s because of the max agent limit",
 							tr.ID,
 						)
+						t.setQueueBlocked(tr, fmt.Sprintf(
+							"Waiting for agents, the limit is %d",
+							t.config.MaxAgents,
+						))
+						if t.preemptFor(tr, runningVCPUs, runningAgents) {
+							runningAgents += t.reserveCapacity(tr, runningVCPUs)
+						}
+						continue
+					}
+
+					// Check if executing this test would put the number of
+					// running agents in any of its regions over the pool of
+					// that region
+					region := t.regionPoolExceeded(tr, runningRegionAgents)
+					if region != "" {
+						logging.Infof(
+							"Can't start test run %s because of the agent pool of region %s",
+							tr.ID,
+							region,
+						)
+						t.setQueueBlocked(tr, fmt.Sprintf(
+							"Waiting for agents in region %s",
+							region,
+						))
+						continue
+					}
+
+					// Roles running on a pool of static agents need an idle
+					// agent of that pool, which is chosen here such that
+					// test runs started together don't pick the same one
+					reason = t.assignPoolAgents(tr, poolAgentsTaken)
+					if reason != "" {
+						logging.Infof(
+							"Can't start test run %s: %s",
+							tr.ID,
+							reason,
+						)
+						t.setQueueBlocked(tr, reason)
 						continue
 					}
 
@@ -207,6 +391,11 @@ func (t *TestRunManager) Scheduler() {
 						}
 					}
 					runningAgents += len(tr.Roles)
+					for k, v := range t.regionAgents(tr) {
+						runningRegionAgents[k] += v
+					}
+					quotas.add(tr, totalVCPUs(requiredVCPUsForTestRun), 1)
+					tr.QueueBlocked = ""
 					nextQueued = append(nextQueued, t.testRuns[i])
 				}
 			}
@@ -220,7 +409,10 @@ func (t *TestRunManager) Scheduler() {
 						common.TestRunStatusRunning,
 						"Executing test run ...",
 					)
-					go t.ExecuteTestRun(nextQueued[i])
+					go func(tr *common.TestRun) {
+						t.ExecuteTestRun(tr)
+						t.requeuePreempted(tr)
+					}(nextQueued[i])
 				}
 			}
 			t.testRunsLock.Unlock()
@@ -244,18 +436,31 @@ func (t *TestRunManager) Reschedule(tr *common.TestRun) {
 	}
 
 	for i := range newTr.Roles {
+		// Roles manually placed on a connected agent keep their agent
+		if newTr.Roles[i].ManualPlacement &&
+			newTr.Roles[i].AwsLaunchTemplateID == "" {
+			continue
+		}
 		newTr.Roles[i].AgentID = -1
 	}
 
+	// The failovers and faults of the failed attempt don't apply to the retry
+	newTr.Failovers = nil
+	newTr.FaultTimeline = nil
+
 	newTr.MaxRetries = newTr.MaxRetries - 1
 	if newTr.MaxRetries > 0 {
 		newTr.Priority = 3
+		newTr.DependsOn = nil
 		t.ScheduleTestRun(&newTr)
 		t.UpdateStatus(
 			&newTr,
 			common.TestRunStatusQueued,
 			"Requeued because of a failure",
 		)
+		t.testRunsLock.Lock()
+		t.redirectDependencies(tr.ID, newTr.ID)
+		t.testRunsLock.Unlock()
 	}
 }
 
@@ -265,6 +470,10 @@ func (t *TestRunManager) Reschedule(tr *common.TestRun) {
 func (t *TestRunManager) GetRequiredVCPUs(tr *common.TestRun) map[string]int32 {
 	ret := map[string]int32{}
 	for i := range tr.Roles {
+		// Colocated roles don't need an instance of their own
+		if tr.Roles[i].ColocateWith != nil {
+			continue
+		}
 		lt, err := t.awsm.GetLaunchTemplate(tr.Roles[i].AwsLaunchTemplateID)
 		if err == nil {
 			key := fmt.Sprintf("%s-ondem", lt.Region)
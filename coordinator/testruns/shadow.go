@@ -0,0 +1,548 @@
+package testruns
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+)
+
+// ErrDeploymentSnapshotNotFound is returned when no deployment snapshot with
+// the requested ID was imported
+var ErrDeploymentSnapshotNotFound = errors.New("Deployment snapshot not found")
+
+// DeploymentSnapshot is the topology and configuration of an external OpenCBDC
+// deployment, imported from its configuration file. Shadow test runs re-create
+// the deployment on test agents, to validate changes against realistic
+// settings before they are released
+type DeploymentSnapshot struct {
+	ID                   string    `json:"id"`
+	Name                 string    `json:"name"`
+	Imported             time.Time `json:"imported"`
+	ImportedByThumbprint string    `json:"importedByThumbprint"`
+	// The configuration file the snapshot was imported from
+	Config       string `json:"config"`
+	Architecture string `json:"architectureID"`
+	// The number of replicas of every shard (and for two-phase commit,
+	// coordinator) cluster
+	ShardReplicationFactor int                       `json:"shardReplicationFactor"`
+	Roles                  map[common.SystemRole]int `json:"roles"`
+	// The test run parameters equivalent to the settings of the deployment,
+	// keyed by their JSON name
+	Parameters map[string]interface{} `json:"parameters"`
+	// Settings that describe where the deployment runs rather than how, such
+	// as the endpoints, which shadow runs replace with their own
+	Ignored []string `json:"ignored"`
+	// Settings that have no equivalent test run parameter, in which shadow
+	// runs differ from the deployment
+	Unsupported []string `json:"unsupported"`
+}
+
+// shadowParameter maps a setting of the configuration file to the test run
+// parameter it is generated from
+type shadowParameter struct {
+	param string
+	kind  reflect.Kind
+}
+
+// shadowParameters are the settings of the configuration file that map onto
+// test run parameters
+var shadowParameters = map[string]shadowParameter{
+	"stxo_cache_depth":            {"stxoCacheDepth", reflect.Int},
+	"window_size":                 {"windowSize", reflect.Int},
+	"batch_size":                  {"batchSize", reflect.Int},
+	"watchtower_block_cache_size": {"watchtowerBlockCacheSize", reflect.Int},
+	"watchtower_error_cache_size": {"watchtowerErrorCacheSize", reflect.Int},
+	"audit_interval":              {"auditInterval", reflect.Int},
+	"attestation_threshold":       {"sentinelAttestations", reflect.Int},
+	"target_block_interval":       {"targetBlockInterval", reflect.Int},
+	"election_timeout_upper":      {"electionTimeoutUpper", reflect.Int},
+	"election_timeout_lower":      {"electionTimeoutLower", reflect.Int},
+	"heartbeat":                   {"heartbeat", reflect.Int},
+	"raft_max_batch":              {"raftMaxBatch", reflect.Int},
+	"snapshot_distance":           {"snapshotDistance", reflect.Int},
+	"loadgen_sendtx_input_count":  {"loadGenInputCount", reflect.Int},
+	"loadgen_sendtx_output_count": {"loadGenOutputCount", reflect.Int},
+	"loadgen_invalid_tx_rate":     {"invalidTxRate", reflect.Float64},
+	"loadgen_fixed_tx_rate":       {"fixedTxRate", reflect.Float64},
+	"batch_delay":                 {"batchDelay", reflect.Int},
+	"enable_telemetry":            {"telemetry", reflect.Bool},
+	"seed_to":                     {"preseedCount", reflect.Int},
+}
+
+// shadowIgnoredSetting matches the settings that are generated from the
+// placement of the roles, or are otherwise specific to where the deployment
+// runs
+var shadowIgnoredSetting = regexp.MustCompile(
+	`^([a-z_]+[0-9]+(_[0-9]+)?_(endpoint|raft_endpoint|client_endpoint|` +
+		`internal_endpoint|loglevel|telemetrylevel|db|audit_log|private_key|` +
+		`public_key|start|end|count)|[a-z_]+_count|2pc|seed_privkey|` +
+		`seed_value|seed_from|loadgen_tps_[a-z_]+)$`,
+)
+
+// parseShadowConfig parses a configuration file in the key=value format of
+// OpenCBDC, with string values in double quotes and comments starting with #
+func parseShadowConfig(cfg string) (map[string]string, error) {
+	ret := map[string]string{}
+	s := bufio.NewScanner(strings.NewReader(cfg))
+	line := 0
+	for s.Scan() {
+		line++
+		l := strings.TrimSpace(s.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		kv := strings.SplitN(l, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("Line %d is not a key=value pair", line)
+		}
+		ret[strings.TrimSpace(kv[0])] = strings.Trim(
+			strings.TrimSpace(kv[1]),
+			`"`,
+		)
+	}
+	return ret, s.Err()
+}
+
+// shadowCount reads a count from the configuration, which is zero if it is not
+// set
+func shadowCount(cfg map[string]string, key string) (int, error) {
+	v, ok := cfg[key]
+	if !ok {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s is not a count: %s", key, v)
+	}
+	return n, nil
+}
+
+// shadowRolesAtomizer derives the roles of an atomizer deployment. Shard
+// replicas share a prefix range, so the replication factor is the number of
+// shards per distinct range
+func shadowRolesAtomizer(
+	cfg map[string]string,
+	snap *DeploymentSnapshot,
+) error {
+	counts := map[string]common.SystemRole{
+		"atomizer_count":   common.SystemRoleRaftAtomizer,
+		"archiver_count":   common.SystemRoleArchiver,
+		"sentinel_count":   common.SystemRoleSentinel,
+		"shard_count":      common.SystemRoleShard,
+		"watchtower_count": common.SystemRoleWatchtower,
+		"loadgen_count":    common.SystemRoleAtomizerCliWatchtower,
+	}
+	for key, role := range counts {
+		n, err := shadowCount(cfg, key)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			snap.Roles[role] = n
+		}
+	}
+	shards := snap.Roles[common.SystemRoleShard]
+	if shards == 0 {
+		return errors.New("The deployment has no shards")
+	}
+	ranges := map[string]bool{}
+	for i := 0; i < shards; i++ {
+		start, ok := cfg[fmt.Sprintf("shard%d_start", i)]
+		if !ok {
+			return fmt.Errorf("Shard %d has no prefix range", i)
+		}
+		ranges[start+"-"+cfg[fmt.Sprintf("shard%d_end", i)]] = true
+	}
+	if shards%len(ranges) != 0 {
+		return fmt.Errorf(
+			"%d shards cannot be evenly replicated over %d prefix ranges",
+			shards,
+			len(ranges),
+		)
+	}
+	snap.ShardReplicationFactor = shards / len(ranges)
+	return nil
+}
+
+// shadowRolesTwoPhase derives the roles of a two-phase commit deployment,
+// where shards and coordinators are configured as clusters with a number of
+// replicas each
+func shadowRolesTwoPhase(
+	cfg map[string]string,
+	snap *DeploymentSnapshot,
+) error {
+	counts := map[string]common.SystemRole{
+		"sentinel_count": common.SystemRoleSentinelTwoPhase,
+		"loadgen_count":  common.SystemRoleTwoPhaseGen,
+	}
+	for key, role := range counts {
+		n, err := shadowCount(cfg, key)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			snap.Roles[role] = n
+		}
+	}
+	for prefix, role := range map[string]common.SystemRole{
+		"shard":       common.SystemRoleShardTwoPhase,
+		"coordinator": common.SystemRoleCoordinator,
+	} {
+		clusters, err := shadowCount(cfg, prefix+"_count")
+		if err != nil {
+			return err
+		}
+		if clusters == 0 {
+			return fmt.Errorf("The deployment has no %s clusters", prefix)
+		}
+		for i := 0; i < clusters; i++ {
+			replicas, err := shadowCount(cfg, fmt.Sprintf("%s%d_count", prefix, i))
+			if err != nil {
+				return err
+			}
+			if snap.ShardReplicationFactor == 0 {
+				snap.ShardReplicationFactor = replicas
+			}
+			if replicas == 0 || replicas != snap.ShardReplicationFactor {
+				return errors.New(
+					"Clusters with different numbers of replicas are not " +
+						"supported",
+				)
+			}
+		}
+		snap.Roles[role] = clusters * snap.ShardReplicationFactor
+	}
+	return nil
+}
+
+// ParseDeploymentSnapshot parses the configuration file of an OpenCBDC
+// deployment into a snapshot of its topology and settings. Atomizer and
+// two-phase commit deployments are supported
+func ParseDeploymentSnapshot(
+	name string,
+	config string,
+) (*DeploymentSnapshot, error) {
+	cfg, err := parseShadowConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	snap := &DeploymentSnapshot{
+		Name:         name,
+		Config:       config,
+		Architecture: "default",
+		Roles:        map[common.SystemRole]int{},
+		Parameters:   map[string]interface{}{},
+		Ignored:      []string{},
+		Unsupported:  []string{},
+	}
+	if cfg["2pc"] == "1" {
+		snap.Architecture = "2pc"
+		err = shadowRolesTwoPhase(cfg, snap)
+	} else {
+		err = shadowRolesAtomizer(cfg, snap)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for key, v := range cfg {
+		p, ok := shadowParameters[key]
+		if !ok {
+			if shadowIgnoredSetting.MatchString(key) {
+				snap.Ignored = append(snap.Ignored, key)
+			} else {
+				snap.Unsupported = append(snap.Unsupported, key)
+			}
+			continue
+		}
+		// Parameters are kept as their JSON representation, such that they
+		// can be compared with and applied to test runs through their JSON
+		// encoding
+		switch p.kind {
+		case reflect.Bool:
+			snap.Parameters[p.param] = v == "1" || v == "true"
+		default:
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil || (p.kind == reflect.Int && f != float64(int64(f))) {
+				return nil, fmt.Errorf("%s has an invalid value: %s", key, v)
+			}
+			snap.Parameters[p.param] = f
+		}
+	}
+	if _, ok := snap.Parameters["preseedCount"]; ok {
+		snap.Parameters["preseedShards"] = true
+	}
+	sort.Strings(snap.Ignored)
+	sort.Strings(snap.Unsupported)
+	return snap, nil
+}
+
+// shadowSnapshotsPath returns the path of the file the imported deployment
+// snapshots are persisted in
+func shadowSnapshotsPath() string {
+	return filepath.Join(
+		common.DataDir(),
+		"testruns",
+		"deployment-snapshots.json",
+	)
+}
+
+// loadDeploymentSnapshots reads the imported deployment snapshots from disk
+func (t *TestRunManager) loadDeploymentSnapshots() error {
+	b, err := os.ReadFile(shadowSnapshotsPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	t.shadowSnapshotsLock.Lock()
+	defer t.shadowSnapshotsLock.Unlock()
+	return json.Unmarshal(b, &t.shadowSnapshots)
+}
+
+// persistDeploymentSnapshots writes the imported deployment snapshots to
+// disk. Must be called with shadowSnapshotsLock held
+func (t *TestRunManager) persistDeploymentSnapshots() error {
+	b, err := json.Marshal(t.shadowSnapshots)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(shadowSnapshotsPath()), 0755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(shadowSnapshotsPath(), b, 0644)
+}
+
+// ImportDeploymentSnapshot parses the configuration file of a deployment and
+// stores the resulting snapshot, such that shadow test runs can be created
+// from it
+func (t *TestRunManager) ImportDeploymentSnapshot(
+	name string,
+	config string,
+	importedByThumbprint string,
+) (*DeploymentSnapshot, error) {
+	snap, err := ParseDeploymentSnapshot(name, config)
+	if err != nil {
+		return nil, err
+	}
+	snap.ID, err = common.RandomID(12)
+	if err != nil {
+		return nil, err
+	}
+	snap.Imported = time.Now()
+	snap.ImportedByThumbprint = importedByThumbprint
+
+	t.shadowSnapshotsLock.Lock()
+	defer t.shadowSnapshotsLock.Unlock()
+	t.shadowSnapshots = append(t.shadowSnapshots, snap)
+	err = t.persistDeploymentSnapshots()
+	if err != nil {
+		t.shadowSnapshots = t.shadowSnapshots[:len(t.shadowSnapshots)-1]
+		return nil, err
+	}
+	return snap, nil
+}
+
+// DeploymentSnapshots returns the imported deployment snapshots
+func (t *TestRunManager) DeploymentSnapshots() []*DeploymentSnapshot {
+	t.shadowSnapshotsLock.Lock()
+	defer t.shadowSnapshotsLock.Unlock()
+	return append([]*DeploymentSnapshot{}, t.shadowSnapshots...)
+}
+
+// GetDeploymentSnapshot returns the imported deployment snapshot with the
+// given ID
+func (t *TestRunManager) GetDeploymentSnapshot(
+	id string,
+) (*DeploymentSnapshot, error) {
+	t.shadowSnapshotsLock.Lock()
+	defer t.shadowSnapshotsLock.Unlock()
+	for _, s := range t.shadowSnapshots {
+		if s.ID == id {
+			return s, nil
+		}
+	}
+	return nil, ErrDeploymentSnapshotNotFound
+}
+
+// DeleteDeploymentSnapshot removes an imported deployment snapshot. Shadow
+// runs of it that were already scheduled still run, but can no longer be
+// checked against it
+func (t *TestRunManager) DeleteDeploymentSnapshot(id string) error {
+	t.shadowSnapshotsLock.Lock()
+	defer t.shadowSnapshotsLock.Unlock()
+	for i, s := range t.shadowSnapshots {
+		if s.ID == id {
+			t.shadowSnapshots = append(
+				t.shadowSnapshots[:i],
+				t.shadowSnapshots[i+1:]...,
+			)
+			return t.persistDeploymentSnapshots()
+		}
+	}
+	return ErrDeploymentSnapshotNotFound
+}
+
+// testRunParameters returns the parameters of the test run keyed by their
+// JSON name
+func testRunParameters(tr *common.TestRun) (map[string]interface{}, error) {
+	b, err := json.Marshal(tr)
+	if err != nil {
+		return nil, err
+	}
+	m := map[string]interface{}{}
+	err = json.Unmarshal(b, &m)
+	return m, err
+}
+
+// ShadowTestRun creates a test run that re-creates the deployment of the
+// snapshot. The parameters the snapshot does not determine, such as the
+// commit and the duration, are taken from the template. Every role runs on
+// the launch template of the template's role of the same kind, or of its
+// first role if it has none of that kind. The returned test run is not
+// scheduled
+func (t *TestRunManager) ShadowTestRun(
+	id string,
+	template *common.TestRun,
+) (*common.TestRun, error) {
+	snap, err := t.GetDeploymentSnapshot(id)
+	if err != nil {
+		return nil, err
+	}
+	params, err := testRunParameters(template)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range snap.Parameters {
+		params[k] = v
+	}
+	params["architectureID"] = snap.Architecture
+	params["shardReplicationFactor"] = snap.ShardReplicationFactor
+	delete(params, "roles")
+	b, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	tr := &common.TestRun{}
+	err = json.Unmarshal(b, tr)
+	if err != nil {
+		return nil, err
+	}
+	tr.ShadowSnapshotID = snap.ID
+
+	launchTemplates := map[common.SystemRole]string{}
+	fallback := ""
+	for _, r := range template.Roles {
+		if r.AwsLaunchTemplateID == "" {
+			continue
+		}
+		if fallback == "" {
+			fallback = r.AwsLaunchTemplateID
+		}
+		if _, ok := launchTemplates[r.Role]; !ok {
+			launchTemplates[r.Role] = r.AwsLaunchTemplateID
+		}
+	}
+	if fallback == "" {
+		return nil, errors.New(
+			"The template needs a role with a launch template to place the " +
+				"roles of the deployment on",
+		)
+	}
+
+	roles := make([]common.SystemRole, 0, len(snap.Roles))
+	for role := range snap.Roles {
+		roles = append(roles, role)
+	}
+	sort.Slice(roles, func(i, j int) bool { return roles[i] < roles[j] })
+	tr.Roles = []*common.TestRunRole{}
+	for _, role := range roles {
+		lt, ok := launchTemplates[role]
+		if !ok {
+			lt = fallback
+		}
+		for i := 0; i < snap.Roles[role]; i++ {
+			tr.Roles = append(tr.Roles, &common.TestRunRole{
+				Role:                role,
+				Index:               i,
+				AwsLaunchTemplateID: lt,
+			})
+		}
+	}
+	return tr, nil
+}
+
+// validateShadow checks that a shadow test run still re-creates the topology
+// and settings of its deployment snapshot, such that its results are
+// representative of the deployment
+func (t *TestRunManager) validateShadow(tr *common.TestRun) []error {
+	if tr.ShadowSnapshotID == "" {
+		return []error{}
+	}
+	snap, err := t.GetDeploymentSnapshot(tr.ShadowSnapshotID)
+	if err != nil {
+		return []error{err}
+	}
+	ret := []error{}
+	if tr.Architecture != snap.Architecture {
+		ret = append(ret, fmt.Errorf(
+			"Shadow run uses architecture %s, but the deployment %s",
+			tr.Architecture,
+			snap.Architecture,
+		))
+	}
+	if tr.ShardReplicationFactor != snap.ShardReplicationFactor {
+		ret = append(ret, fmt.Errorf(
+			"Shadow run replicates shards %d times, but the deployment %d "+
+				"times",
+			tr.ShardReplicationFactor,
+			snap.ShardReplicationFactor,
+		))
+	}
+	counts := t.countRoles(tr)
+	expected := map[common.SystemRole]int{}
+	for role := range counts {
+		expected[role] = 0
+	}
+	for role, n := range snap.Roles {
+		expected[role] = n
+	}
+	for role, n := range expected {
+		if counts[role] != n {
+			ret = append(ret, fmt.Errorf(
+				"Shadow run has %d %s roles, but the deployment %d",
+				counts[role],
+				role,
+				n,
+			))
+		}
+	}
+	params, err := testRunParameters(tr)
+	if err != nil {
+		return append(ret, err)
+	}
+	for k, v := range snap.Parameters {
+		if !reflect.DeepEqual(params[k], v) {
+			ret = append(ret, fmt.Errorf(
+				"Shadow run has %s set to %v, but the deployment to %v",
+				k,
+				params[k],
+				v,
+			))
+		}
+	}
+	return ret
+}
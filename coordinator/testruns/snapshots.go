@@ -0,0 +1,243 @@
+package testruns
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/wire"
+)
+
+// defaultSnapshotRetentionDays is the number of days agent snapshots are kept
+// if the test run doesn't specify it
+const defaultSnapshotRetentionDays = 7
+
+// failedAgents returns the agents affected by the failure of the test run:
+// the agents running commands that failed unexpectedly, or all agents of the
+// test run if the failure can't be attributed to a command
+func failedAgents(tr *common.TestRun) []int32 {
+	deliberate := map[string]bool{}
+	for _, id := range tr.DeliberateFailures {
+		deliberate[id] = true
+	}
+	seen := map[int32]bool{}
+	ret := []int32{}
+	for _, c := range tr.ExecutedCommands {
+		if c.ExitCode != 0 && !deliberate[c.CommandID] && !seen[c.AgentID] {
+			seen[c.AgentID] = true
+			ret = append(ret, c.AgentID)
+		}
+	}
+	if len(ret) > 0 {
+		return ret
+	}
+	for _, r := range tr.Roles {
+		if r.AgentID > 0 && !seen[r.AgentID] {
+			seen[r.AgentID] = true
+			ret = append(ret, r.AgentID)
+		}
+	}
+	return ret
+}
+
+// SnapshotFailedAgents captures the state of the agents affected by the
+// failure of the test run, such that it can be inspected after the agents are
+// torn down. Depending on the test run's settings, the environment directories
+// of the agents are archived to S3, and/or EBS snapshots are taken of the
+// volumes of their instances. The snapshots are registered as artifacts of the
+// test run and deleted once they expire
+func (t *TestRunManager) SnapshotFailedAgents(tr *common.TestRun) {
+	if !tr.SnapshotDataOnFailure && !tr.SnapshotVolumesOnFailure {
+		return
+	}
+	retention := tr.SnapshotRetentionDays
+	if retention <= 0 {
+		retention = defaultSnapshotRetentionDays
+	}
+	expires := time.Now().Add(time.Duration(retention) * 24 * time.Hour)
+
+	agents := failedAgents(tr)
+	t.UpdateStatus(
+		tr,
+		common.TestRunStatusRunning,
+		fmt.Sprintf("Snapshotting %d agent(s) for postmortem", len(agents)),
+	)
+
+	snapshots := []common.AgentSnapshot{}
+	snapshotsLock := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for _, agentID := range agents {
+		roles := []common.TestRunRoleRef{}
+		for _, r := range tr.Roles {
+			if r.AgentID == agentID {
+				roles = append(
+					roles,
+					common.TestRunRoleRef{Role: r.Role, Index: r.Index},
+				)
+			}
+		}
+
+		wg.Add(1)
+		go func(agentID int32, roles []common.TestRunRoleRef) {
+			defer wg.Done()
+			snaps := []common.AgentSnapshot{}
+			if tr.SnapshotDataOnFailure {
+				s, err := t.snapshotAgentData(tr, agentID, expires)
+				if err != nil {
+					t.WriteLog(
+						tr,
+						"Unable to snapshot data of agent %d: %v",
+						agentID,
+						err,
+					)
+				} else {
+					snaps = append(snaps, s)
+				}
+			}
+			if tr.SnapshotVolumesOnFailure {
+				s, err := t.snapshotAgentVolumes(tr, agentID, expires)
+				if err != nil {
+					t.WriteLog(
+						tr,
+						"Unable to snapshot volumes of agent %d: %v",
+						agentID,
+						err,
+					)
+				}
+				snaps = append(snaps, s...)
+			}
+			for i := range snaps {
+				snaps[i].Roles = roles
+			}
+			snapshotsLock.Lock()
+			snapshots = append(snapshots, snaps...)
+			snapshotsLock.Unlock()
+		}(agentID, roles)
+	}
+	wg.Wait()
+
+	t.WriteLog(
+		tr,
+		"Took %d snapshot(s), which expire at %s",
+		len(snapshots),
+		expires.Format(time.RFC3339),
+	)
+	tr.FailureSnapshots = append(tr.FailureSnapshots, snapshots...)
+	t.PersistTestRun(tr)
+}
+
+// snapshotAgentData archives the environment directory of the agent to S3
+func (t *TestRunManager) snapshotAgentData(
+	tr *common.TestRun,
+	agentID int32,
+	expires time.Time,
+) (common.AgentSnapshot, error) {
+	env, ok := tr.Environments[agentID]
+	if !ok {
+		return common.AgentSnapshot{}, fmt.Errorf(
+			"no environment was deployed to the agent",
+		)
+	}
+	snap := common.AgentSnapshot{
+		AgentID: agentID,
+		Kind:    common.AgentSnapshotData,
+		Region:  os.Getenv("AWS_REGION"),
+		Bucket:  os.Getenv("OUTPUTS_S3_BUCKET"),
+		Path: fmt.Sprintf(
+			"testruns/%s/snapshots/agent-%d.tar.gz",
+			tr.ID,
+			agentID,
+		),
+		Created: time.Now(),
+		Expires: expires,
+	}
+	msg, err := t.am.QueryAgentWithTimeout(
+		agentID,
+		&wire.UploadFileToS3RequestMsg{
+			EnvironmentID: env,
+			SourcePath:    "",
+			Archive:       true,
+			TargetRegion:  snap.Region,
+			TargetBucket:  snap.Bucket,
+			TargetPath:    snap.Path,
+		},
+		15*time.Minute,
+	)
+	err = t.processS3UploadResponse(agentID, msg, err)
+	return snap, err
+}
+
+// snapshotAgentVolumes creates EBS snapshots of the volumes of the agent's
+// instance
+func (t *TestRunManager) snapshotAgentVolumes(
+	tr *common.TestRun,
+	agentID int32,
+	expires time.Time,
+) ([]common.AgentSnapshot, error) {
+	a, err := t.coord.GetAgent(agentID)
+	if err != nil {
+		return nil, err
+	}
+	if !a.SystemInfo.AWS || a.SystemInfo.EC2InstanceID == "" {
+		return nil, fmt.Errorf("agent does not run on AWS EC2")
+	}
+	vols, err := t.awsm.SnapshotInstanceVolumes(
+		a.SystemInfo.EC2InstanceID,
+		tr.ID,
+		expires,
+	)
+	ret := []common.AgentSnapshot{}
+	for _, v := range vols {
+		ret = append(ret, common.AgentSnapshot{
+			AgentID:    agentID,
+			Kind:       common.AgentSnapshotVolume,
+			Region:     v.Region,
+			InstanceID: a.SystemInfo.EC2InstanceID,
+			VolumeID:   v.VolumeID,
+			SnapshotID: v.SnapshotID,
+			Created:    time.Now(),
+			Expires:    expires,
+		})
+	}
+	return ret, err
+}
+
+// deleteAgentSnapshot deletes the snapshot from S3 or EBS
+func (t *TestRunManager) deleteAgentSnapshot(s common.AgentSnapshot) error {
+	if s.Kind == common.AgentSnapshotVolume {
+		return t.awsm.DeleteVolumeSnapshot(s.Region, s.SnapshotID)
+	}
+	return t.awsm.DeleteFromS3(s.Region, s.Bucket, s.Path)
+}
+
+// agentSnapshotExpiryLoop deletes expired agent snapshots every hour
+func (t *TestRunManager) agentSnapshotExpiryLoop() {
+	for {
+		time.Sleep(time.Hour)
+		for _, tr := range t.GetTestRuns() {
+			changed := false
+			for i, s := range tr.FailureSnapshots {
+				if s.Deleted || time.Now().Before(s.Expires) {
+					continue
+				}
+				err := t.deleteAgentSnapshot(s)
+				if err != nil {
+					t.WriteLog(
+						tr,
+						"Unable to delete expired snapshot of agent %d: %v",
+						s.AgentID,
+						err,
+					)
+					continue
+				}
+				tr.FailureSnapshots[i].Deleted = true
+				changed = true
+			}
+			if changed {
+				t.PersistTestRun(tr)
+			}
+		}
+	}
+}
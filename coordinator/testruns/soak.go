@@ -0,0 +1,361 @@
+package testruns
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/coordinator"
+)
+
+// maxSoakDurationMinutes is the longest a soak test can generate load
+const maxSoakDurationMinutes = 14 * 24 * 60
+
+// maxSoakCheckpointMinutes is the longest interval between checkpoints of a
+// soak test. Checkpoints are taken from the live metrics, so the interval
+// cannot exceed their history
+const maxSoakCheckpointMinutes = liveMetricsHistory / 60
+
+// soakResumeTimeout is how long the coordinator waits for the agents of a soak
+// test to reconnect after it was restarted, before interrupting the soak test
+const soakResumeTimeout = 15 * time.Minute
+
+// soakCommandTimeoutMargin is the time the commands of a soak test are
+// allowed to run beyond its duration, to start up and shut down
+const soakCommandTimeoutMargin = time.Hour
+
+// defaultRoleCommandTimeout is the time in seconds the roles of test runs
+// other than soak tests are allowed to run
+const defaultRoleCommandTimeout = 15000
+
+// soakSettleSeconds is the number of most recent seconds of live metrics that
+// are left out of a checkpoint, since the load generators may not have
+// written all of their samples for them yet
+const soakSettleSeconds = int64(liveMetricsInterval / time.Second)
+
+// validateSoak checks the soak configuration of a test run
+func validateSoak(tr *common.TestRun) []error {
+	ret := []error{}
+	s := tr.Soak
+	if s == nil {
+		return ret
+	}
+	if s.DurationMinutes <= 0 || s.DurationMinutes > maxSoakDurationMinutes {
+		ret = append(ret, fmt.Errorf(
+			"Soak: duration should be between 1 and %d minutes",
+			maxSoakDurationMinutes,
+		))
+	}
+	if s.CheckpointMinutes <= 0 ||
+		s.CheckpointMinutes > maxSoakCheckpointMinutes {
+		ret = append(ret, fmt.Errorf(
+			"Soak: checkpoint interval should be between 1 and %d minutes",
+			maxSoakCheckpointMinutes,
+		))
+	}
+	if s.LogRotateMB < 0 || s.LogRotateKeep < 0 {
+		ret = append(ret, errors.New(
+			"Soak: log rotation settings cannot be negative",
+		))
+	}
+	return ret
+}
+
+// loadDuration returns how long the test run generates load: the duration of
+// a soak test, or one second per sample otherwise
+func (t *TestRunManager) loadDuration(tr *common.TestRun) time.Duration {
+	if tr.Soak != nil {
+		return time.Duration(tr.Soak.DurationMinutes) * time.Minute
+	}
+	return time.Duration(tr.SampleCount) * time.Second
+}
+
+// soakTimer returns a channel that receives once a soak test has generated
+// load for its duration, or a channel that never receives if the test run is
+// not a soak test
+func (t *TestRunManager) soakTimer(tr *common.TestRun) <-chan time.Time {
+	if tr.Soak == nil {
+		return nil
+	}
+	return t.loadTimer(tr, t.loadDuration(tr))
+}
+
+// sampleCount returns the number of samples the roles of the test run take.
+// Soak tests end after their duration, so their roles don't stop sampling
+func sampleCount(tr *common.TestRun) int {
+	if tr.Soak != nil {
+		return math.MaxInt32
+	}
+	return tr.SampleCount
+}
+
+// roleCommandTimeout returns the time in seconds the roles of the test run are
+// allowed to run
+func roleCommandTimeout(tr *common.TestRun) int {
+	if tr.Soak == nil {
+		return defaultRoleCommandTimeout
+	}
+	d := time.Duration(tr.Soak.DurationMinutes)*time.Minute +
+		soakCommandTimeoutMargin
+	if int(d.Seconds()) < defaultRoleCommandTimeout {
+		return defaultRoleCommandTimeout
+	}
+	return int(d.Seconds())
+}
+
+// soakLogRotation returns the size in bytes at which the agents rotate the
+// logs of the roles of the test run, and the number of rotated logs to keep
+func soakLogRotation(tr *common.TestRun) (int64, int) {
+	if tr.Soak == nil || tr.Soak.LogRotateMB == 0 {
+		return 0, 0
+	}
+	return int64(tr.Soak.LogRotateMB) * 1024 * 1024, tr.Soak.LogRotateKeep
+}
+
+// checkpointSoak records the live metrics since the previous checkpoint of a
+// soak test as a new checkpoint, and persists the test run such that the
+// metrics gathered so far survive a restart of the coordinator
+func (t *TestRunManager) checkpointSoak(
+	tr *common.TestRun,
+	lm *liveMetrics,
+) {
+	from := int64(math.MinInt64)
+	if n := len(tr.SoakCheckpoints); n > 0 {
+		from = tr.SoakCheckpoints[n-1].Until + 1
+	}
+	points := lm.points(nil)
+	if len(points) == 0 {
+		return
+	}
+	until := points[len(points)-1].Time - soakSettleSeconds
+
+	cp := common.SoakCheckpoint{Time: time.Now()}
+	latencySum := float64(0)
+	covered := 0
+	for _, p := range points {
+		if p.Time < from || p.Time > until {
+			continue
+		}
+		if covered == 0 {
+			cp.From = p.Time
+		}
+		covered++
+		cp.Until = p.Time
+		cp.Transactions += int64(p.Throughput)
+		latencySum += p.LatencyAvg * p.Throughput
+		if p.LatencyMax > cp.LatencyMax {
+			cp.LatencyMax = p.LatencyMax
+		}
+	}
+	if covered == 0 {
+		return
+	}
+	cp.Throughput = float64(cp.Transactions) / float64(cp.Until-cp.From+1)
+	if cp.Transactions > 0 {
+		cp.LatencyAvg = latencySum / float64(cp.Transactions)
+	}
+
+	tr.SoakCheckpoints = append(tr.SoakCheckpoints, cp)
+	t.WriteLog(
+		tr,
+		"Soak checkpoint %d: %d transactions, %.2f tx/s, %.4fs average latency",
+		len(tr.SoakCheckpoints),
+		cp.Transactions,
+		cp.Throughput,
+		cp.LatencyAvg,
+	)
+	t.PersistTestRun(tr)
+}
+
+// recordSoakState persists the environments and commands of a soak test once
+// it starts generating load, such that the coordinator can find them again
+// if it is restarted while the soak test runs
+func (t *TestRunManager) recordSoakState(
+	tr *common.TestRun,
+	cmds []runningCommand,
+) {
+	if tr.Soak == nil {
+		return
+	}
+	state := &common.SoakState{
+		LoadStarted: time.Now(),
+		Agents:      []common.SoakAgent{},
+	}
+	if tr.SoakState != nil {
+		state.LoadStarted = tr.SoakState.LoadStarted
+		state.Resumed = tr.SoakState.Resumed
+	}
+	agents := map[int32]int{}
+	for _, c := range cmds {
+		i, ok := agents[c.agentID]
+		if !ok {
+			sa := common.SoakAgent{
+				AgentID:       c.agentID,
+				EnvironmentID: hex.EncodeToString(tr.Environments[c.agentID]),
+				CommandIDs:    []string{},
+			}
+			if a, err := t.coord.GetAgent(c.agentID); err == nil {
+				sa.EC2InstanceID = a.SystemInfo.EC2InstanceID
+				sa.HostName = a.SystemInfo.HostName
+			}
+			state.Agents = append(state.Agents, sa)
+			i = len(state.Agents) - 1
+			agents[c.agentID] = i
+		}
+		state.Agents[i].CommandIDs = append(
+			state.Agents[i].CommandIDs,
+			hex.EncodeToString(c.commandID),
+		)
+	}
+	tr.SoakState = state
+	t.PersistTestRun(tr)
+}
+
+// findSoakAgent returns the connected agent that ran the roles of a soak test
+// on the given agent before the coordinator was restarted, or nil if it did
+// not reconnect (yet)
+func (t *TestRunManager) findSoakAgent(
+	sa common.SoakAgent,
+) *coordinator.ConnectedAgent {
+	for _, a := range t.coord.GetAgents() {
+		// Agents with a persistent identity reconnect with the same ID
+		if a.ID == sa.AgentID && a.Identity != "" {
+			return a
+		}
+		if sa.EC2InstanceID != "" {
+			if a.SystemInfo.EC2InstanceID == sa.EC2InstanceID {
+				return a
+			}
+		} else if sa.HostName != "" && a.SystemInfo.HostName == sa.HostName {
+			return a
+		}
+	}
+	return nil
+}
+
+// reattachSoakAgents waits for the agents of a soak test to reconnect after
+// the coordinator was restarted, and moves the roles, environments and
+// commands of the soak test over to the IDs the agents reconnected with
+func (t *TestRunManager) reattachSoakAgents(
+	tr *common.TestRun,
+) (map[int32][]byte, []runningCommand, error) {
+	deadline := time.Now().Add(soakResumeTimeout)
+	for {
+		ids := map[int32]int32{}
+		for _, sa := range tr.SoakState.Agents {
+			if a := t.findSoakAgent(sa); a != nil {
+				ids[sa.AgentID] = a.ID
+			}
+		}
+		if len(ids) == len(tr.SoakState.Agents) {
+			envs := map[int32][]byte{}
+			cmds := []runningCommand{}
+			for i, sa := range tr.SoakState.Agents {
+				env, err := hex.DecodeString(sa.EnvironmentID)
+				if err != nil {
+					return nil, nil, err
+				}
+				envs[ids[sa.AgentID]] = env
+				for _, c := range sa.CommandIDs {
+					cmdID, err := hex.DecodeString(c)
+					if err != nil {
+						return nil, nil, err
+					}
+					cmds = append(cmds, runningCommand{
+						agentID:   ids[sa.AgentID],
+						commandID: cmdID,
+					})
+				}
+				tr.SoakState.Agents[i].AgentID = ids[sa.AgentID]
+			}
+			for _, r := range tr.Roles {
+				if id, ok := ids[r.AgentID]; ok {
+					r.AgentID = id
+				}
+			}
+			return envs, cmds, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, nil, fmt.Errorf(
+				"%d of %d agents did not reconnect within %.0f minutes",
+				len(tr.SoakState.Agents)-len(ids),
+				len(tr.SoakState.Agents),
+				soakResumeTimeout.Minutes(),
+			)
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// ResumeSoakTest resumes a soak test that was running when the coordinator
+// was restarted. The roles of the soak test kept running on the agents, so
+// once the agents reconnect the coordinator continues checkpointing its
+// metrics, and collects its results when its duration has passed. Crashes of
+// its roles are no longer detected, since the coordinator lost track of the
+// status of their commands
+func (t *TestRunManager) ResumeSoakTest(tr *common.TestRun) {
+	tr.TerminateChan = make(chan bool, 1)
+	tr.RetrySpawnChan = make(chan bool, 1)
+	t.UpdateStatus(
+		tr,
+		common.TestRunStatusRunning,
+		"Waiting for the agents to reconnect after a coordinator restart",
+	)
+	envs, cmds, err := t.reattachSoakAgents(tr)
+	if err != nil {
+		t.WriteLog(tr, "Unable to resume the soak test: %v", err)
+		t.UpdateStatus(tr, common.TestRunStatusInterrupted, "Interrupted")
+		t.PersistTestRun(tr)
+		return
+	}
+	tr.Environments = envs
+	tr.SoakState.Resumed = append(tr.SoakState.Resumed, time.Now())
+	t.WriteLog(
+		tr,
+		"Resumed the soak test on %d agents after a coordinator restart",
+		len(envs),
+	)
+
+	cancel := make(chan bool, 1)
+	go t.StreamLiveMetrics(tr, cancel)
+	t.trackCommands(tr, cmds)
+	if t.IsPaused(tr) {
+		// The load generators were suspended when the coordinator was
+		// restarted. Resume them, since the pause can no longer be ended
+		err := t.ResumeTestRun(tr, "")
+		if err != nil {
+			t.WriteLog(tr, "Unable to resume the load generators: %v", err)
+		}
+	}
+
+	remaining := t.loadDuration(tr) - time.Since(tr.SoakState.LoadStarted)
+	t.UpdateStatus(
+		tr,
+		common.TestRunStatusRunning,
+		fmt.Sprintf(
+			"Waiting for manual termination or timeout (%.1f minutes)",
+			math.Max(remaining.Minutes(), 0),
+		),
+	)
+	select {
+	case <-tr.TerminateChan:
+	case <-t.loadTimer(tr, remaining):
+	}
+	close(cancel)
+	t.untrackCommands(tr)
+
+	if t.Is2PC(tr.Architecture) {
+		err = t.CleanupCommands2PC(tr, cmds, envs)
+	} else {
+		err = t.CleanupCommands(tr, cmds, envs)
+	}
+	if err != nil {
+		t.FailTestRun(tr, err)
+		return
+	}
+	t.PersistTestRun(tr)
+	t.completeTestRun(tr, envs)
+}
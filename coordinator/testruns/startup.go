@@ -0,0 +1,657 @@
+package testruns
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/coordinator/agents"
+)
+
+// ReadinessProbeKind determines how a readiness probe checks a role
+type ReadinessProbeKind string
+
+// ReadinessProbePort is ready once a TCP connection can be opened to the port
+// of the role
+const ReadinessProbePort ReadinessProbeKind = "port"
+
+// ReadinessProbeLogLine is ready once a line of the output of the role
+// matches the pattern
+const ReadinessProbeLogLine ReadinessProbeKind = "logLine"
+
+// ReadinessProbeRPC is ready once the command, which typically sends a
+// health check request to the role, exits with code zero
+const ReadinessProbeRPC ReadinessProbeKind = "rpc"
+
+// readinessProbeInterval is the time between attempts of log line and RPC
+// probes
+const readinessProbeInterval = 2 * time.Second
+
+// ReadinessProbe is a check that roles have to pass before the roles that
+// depend on them are started
+type ReadinessProbe struct {
+	Kind ReadinessProbeKind `json:"kind"`
+	// The port of port probes, and the endpoint passed to RPC probes
+	Port PortIncrement `json:"port"`
+	// The regular expression log line probes match the output with
+	Pattern string `json:"pattern,omitempty"`
+	// The command RPC probes run on the agent of the role, with its
+	// parameters. The placeholder %ENDPOINT% is replaced with the endpoint of
+	// the role at the port of the probe
+	Command string   `json:"command,omitempty"`
+	Params  []string `json:"params,omitempty"`
+	// How many of the roles have to pass the probe. Zero means all of them.
+	// With PerCluster set, one member of each RAFT cluster (of
+	// ShardReplicationFactor members) has to pass it
+	Count      int  `json:"count,omitempty"`
+	PerCluster bool `json:"perCluster,omitempty"`
+}
+
+// RoleStartup declares how the roles of a type are started: which roles have
+// to be ready first, and which probes they have to pass to be ready
+// themselves. All roles of the type are started at once
+type RoleStartup struct {
+	Role      common.SystemRole   `json:"role"`
+	DependsOn []common.SystemRole `json:"dependsOn"`
+	Probes    []ReadinessProbe    `json:"probes"`
+	// How long each probe waits for the roles to pass it, and in stead when
+	// the shards are preseeded, since loading large preseeds takes a while
+	TimeoutSeconds        int `json:"timeoutSeconds"`
+	PreseedTimeoutSeconds int `json:"preseedTimeoutSeconds,omitempty"`
+	// Time to wait before starting the roles once their dependencies are
+	// ready
+	DelaySeconds int `json:"delaySeconds,omitempty"`
+	// The roles run until the test run is complete, such as the archiver
+	// that stops after a fixed number of blocks. Their commands are reported
+	// to the architecture once they exit. At most one role per plan can
+	// run to completion
+	RunToCompletion bool `json:"runToCompletion,omitempty"`
+}
+
+// StartupPlan is the dependency graph in which the roles of an architecture
+// are started
+type StartupPlan struct {
+	Roles []RoleStartup `json:"roles"`
+}
+
+// portProbes returns port probes for the given ports of all roles
+func portProbes(ports ...PortIncrement) []ReadinessProbe {
+	ret := []ReadinessProbe{}
+	for _, p := range ports {
+		ret = append(ret, ReadinessProbe{Kind: ReadinessProbePort, Port: p})
+	}
+	return ret
+}
+
+// builtinStartupPlans are the startup plans of the architectures, by the
+// prefix of their ID. RAFT clusters elect a random leader, so all members are
+// started at once and have to have their RAFT port up, but only the leader of
+// each cluster responds on its RPC port. Load generators don't accept
+// incoming connections, so they have no probes
+var builtinStartupPlans = map[string]StartupPlan{
+	"default": {Roles: []RoleStartup{
+		{
+			Role:           common.SystemRoleWatchtower,
+			Probes:         portProbes(PortIncrementDefaultPort, PortIncrementClientPort),
+			TimeoutSeconds: 60,
+		},
+		{
+			Role:      common.SystemRoleRaftAtomizer,
+			DependsOn: []common.SystemRole{common.SystemRoleWatchtower},
+			Probes: []ReadinessProbe{
+				{Kind: ReadinessProbePort, Port: PortIncrementRaftPort},
+				{Kind: ReadinessProbePort, Port: PortIncrementDefaultPort, Count: 1},
+			},
+			TimeoutSeconds: 60,
+		},
+		{
+			Role:            common.SystemRoleArchiver,
+			DependsOn:       []common.SystemRole{common.SystemRoleRaftAtomizer},
+			Probes:          portProbes(PortIncrementDefaultPort),
+			TimeoutSeconds:  60,
+			RunToCompletion: true,
+		},
+		{
+			Role:           common.SystemRoleShard,
+			DependsOn:      []common.SystemRole{common.SystemRoleArchiver},
+			Probes:         portProbes(PortIncrementDefaultPort),
+			TimeoutSeconds: 900,
+		},
+		{
+			Role:           common.SystemRoleSentinel,
+			DependsOn:      []common.SystemRole{common.SystemRoleShard},
+			Probes:         portProbes(PortIncrementDefaultPort),
+			TimeoutSeconds: 60,
+		},
+		{
+			Role:           common.SystemRoleAtomizerCliWatchtower,
+			DependsOn:      []common.SystemRole{common.SystemRoleSentinel},
+			TimeoutSeconds: 60,
+		},
+	}},
+	"2pc": {Roles: []RoleStartup{
+		{
+			Role: common.SystemRoleShardTwoPhase,
+			Probes: []ReadinessProbe{
+				{Kind: ReadinessProbePort, Port: PortIncrementRaftPort},
+				{Kind: ReadinessProbePort, Port: PortIncrementClientPort, PerCluster: true},
+			},
+			TimeoutSeconds:        60,
+			PreseedTimeoutSeconds: 900,
+		},
+		{
+			Role:      common.SystemRoleCoordinator,
+			DependsOn: []common.SystemRole{common.SystemRoleShardTwoPhase},
+			Probes: []ReadinessProbe{
+				{Kind: ReadinessProbePort, Port: PortIncrementRaftPort},
+				{Kind: ReadinessProbePort, Port: PortIncrementDefaultPort, PerCluster: true},
+			},
+			TimeoutSeconds: 60,
+		},
+		{
+			Role:           common.SystemRoleSentinelTwoPhase,
+			DependsOn:      []common.SystemRole{common.SystemRoleCoordinator},
+			Probes:         portProbes(PortIncrementDefaultPort),
+			TimeoutSeconds: 60,
+		},
+		{
+			Role:           common.SystemRoleTwoPhaseGen,
+			DependsOn:      []common.SystemRole{common.SystemRoleSentinelTwoPhase},
+			TimeoutSeconds: 60,
+			DelaySeconds:   10,
+		},
+	}},
+	"parsec": {Roles: []RoleStartup{
+		{
+			Role: common.SystemRoleTicketMachine,
+			Probes: []ReadinessProbe{
+				{Kind: ReadinessProbePort, Port: PortIncrementRaftPort},
+				{Kind: ReadinessProbePort, Port: PortIncrementDefaultPort, PerCluster: true},
+			},
+			TimeoutSeconds: 240,
+		},
+		{
+			Role:      common.SystemRoleRuntimeLockingShard,
+			DependsOn: []common.SystemRole{common.SystemRoleTicketMachine},
+			Probes: []ReadinessProbe{
+				{Kind: ReadinessProbePort, Port: PortIncrementRaftPort},
+				{Kind: ReadinessProbePort, Port: PortIncrementDefaultPort, PerCluster: true},
+			},
+			TimeoutSeconds: 240,
+		},
+		{
+			Role:           common.SystemRoleAgent,
+			DependsOn:      []common.SystemRole{common.SystemRoleRuntimeLockingShard},
+			Probes:         portProbes(PortIncrementDefaultPort),
+			TimeoutSeconds: 240,
+		},
+		{
+			Role:           common.SystemRoleParsecGen,
+			DependsOn:      []common.SystemRole{common.SystemRoleAgent},
+			TimeoutSeconds: 240,
+		},
+	}},
+}
+
+// StartupPlans returns the startup plans of the architectures: the built-in
+// ones and the ones of the architecture manifests, replaced by the configured
+// ones
+func (t *TestRunManager) StartupPlans() map[string]StartupPlan {
+	ret := map[string]StartupPlan{}
+	for k, v := range builtinStartupPlans {
+		ret[k] = v
+	}
+	for _, m := range t.ArchitectureManifests() {
+		ret[m.ID] = m.Startup
+	}
+	t.configLock.Lock()
+	defer t.configLock.Unlock()
+	for k, v := range t.config.StartupPlans {
+		ret[k] = v
+	}
+	return ret
+}
+
+// SetStartupPlans validates and persists the configured startup plans, by
+// architecture ID (prefix). These replace the built-in plans
+func (t *TestRunManager) SetStartupPlans(plans map[string]StartupPlan) error {
+	for arch, p := range plans {
+		if err := p.Validate(); err != nil {
+			return fmt.Errorf("Startup plan for %s is invalid: %v", arch, err)
+		}
+	}
+	t.configLock.Lock()
+	t.config.StartupPlans = plans
+	t.configLock.Unlock()
+	return t.PersistConfig()
+}
+
+// startupPlan returns the startup plan of the architecture. The plan with the
+// longest ID prefix matching the architecture is used
+func (t *TestRunManager) startupPlan(architectureID string) (StartupPlan, error) {
+	best := ""
+	var plan StartupPlan
+	for prefix, p := range t.StartupPlans() {
+		if strings.HasPrefix(architectureID, prefix) && len(prefix) >= len(best) {
+			best = prefix
+			plan = p
+		}
+	}
+	if best == "" {
+		return plan, fmt.Errorf(
+			"No startup plan for architecture %s",
+			architectureID,
+		)
+	}
+	return plan, nil
+}
+
+// Validate checks that the roles of the plan appear once, that their
+// dependencies are in the plan and don't form a cycle, and that their probes
+// are complete
+func (p StartupPlan) Validate() error {
+	byRole := map[common.SystemRole]RoleStartup{}
+	completing := 0
+	for _, r := range p.Roles {
+		if _, ok := byRole[r.Role]; ok {
+			return fmt.Errorf("Role %s appears more than once", r.Role)
+		}
+		byRole[r.Role] = r
+		if r.RunToCompletion {
+			completing++
+		}
+		if r.TimeoutSeconds <= 0 && len(r.Probes) > 0 {
+			return fmt.Errorf("Role %s needs a timeout for its probes", r.Role)
+		}
+		for _, pr := range r.Probes {
+			switch pr.Kind {
+			case ReadinessProbePort:
+			case ReadinessProbeLogLine:
+				if _, err := regexp.Compile(pr.Pattern); err != nil ||
+					pr.Pattern == "" {
+					return fmt.Errorf(
+						"Log line probe of %s has an invalid pattern",
+						r.Role,
+					)
+				}
+			case ReadinessProbeRPC:
+				if pr.Command == "" {
+					return fmt.Errorf("RPC probe of %s has no command", r.Role)
+				}
+				// Plans can be configured at runtime, so they can't have
+				// agents run arbitrary executables
+				if err := checkBuildOutputPath(pr.Command); err != nil {
+					return fmt.Errorf(
+						"RPC probe of %s has invalid command: %v",
+						r.Role,
+						err,
+					)
+				}
+			default:
+				return fmt.Errorf(
+					"Unknown probe %q for role %s",
+					pr.Kind,
+					r.Role,
+				)
+			}
+		}
+	}
+	if completing > 1 {
+		return errors.New("At most one role can run to completion")
+	}
+
+	// Depth first search for cycles
+	state := map[common.SystemRole]int{}
+	var visit func(common.SystemRole) error
+	visit = func(role common.SystemRole) error {
+		switch state[role] {
+		case 1:
+			return fmt.Errorf("Dependency cycle through %s", role)
+		case 2:
+			return nil
+		}
+		state[role] = 1
+		for _, d := range byRole[role].DependsOn {
+			if _, ok := byRole[d]; !ok {
+				return fmt.Errorf(
+					"Role %s depends on %s, which is not in the plan",
+					role,
+					d,
+				)
+			}
+			if err := visit(d); err != nil {
+				return err
+			}
+		}
+		state[role] = 2
+		return nil
+	}
+	for _, r := range p.Roles {
+		if err := visit(r.Role); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startupResult is reported by the launch of the roles of a type once they
+// are ready, or failed to start
+type startupResult struct {
+	role common.SystemRole
+	cmds []runningCommand
+	err  error
+}
+
+// startRoles starts the roles of the test run following the startup plan of
+// its architecture: the roles of a type are started once the roles they
+// depend on are ready, and are ready themselves once they passed their
+// probes. Independent roles are started in parallel. The commands of the role
+// that runs to completion, if any, are sent to completion once it exits, and
+// errors running it to errChan. Returns true if the test run was terminated
+// while starting the roles
+func (t *TestRunManager) startRoles(
+	tr *common.TestRun,
+	envs map[int32][]byte,
+	cmd chan *common.ExecutedCommand,
+	failures chan *common.ExecutedCommand,
+	completion chan []runningCommand,
+	errChan chan error,
+) ([]runningCommand, bool, error) {
+	plan, err := t.startupPlan(tr.Architecture)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := plan.Validate(); err != nil {
+		return nil, false, err
+	}
+
+	allCmds := []runningCommand{}
+	ready := map[common.SystemRole]bool{}
+	started := map[common.SystemRole]bool{}
+	results := make(chan startupResult, len(plan.Roles))
+	running := 0
+	stop := false
+	var firstErr error
+
+	launchReady := func() {
+		for _, r := range plan.Roles {
+			if started[r.Role] {
+				continue
+			}
+			depsReady := true
+			for _, d := range r.DependsOn {
+				depsReady = depsReady && ready[d]
+			}
+			if !depsReady {
+				continue
+			}
+			started[r.Role] = true
+			running++
+			go func(r RoleStartup) {
+				cmds, err := t.startRole(tr, r, envs, cmd, completion, errChan)
+				results <- startupResult{role: r.Role, cmds: cmds, err: err}
+			}(r)
+		}
+	}
+
+	launchReady()
+	for running > 0 {
+		res := <-results
+		running--
+		allCmds = append(allCmds, res.cmds...)
+		if res.err != nil {
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			stop = true
+			continue
+		}
+		ready[res.role] = true
+		if stop {
+			continue
+		}
+		if running > 0 && t.ShouldTerminate(tr) {
+			// Wait for the roles that are still starting, such that their
+			// commands are stopped as well, and put the request back for
+			// TerminateIfNeeded
+			stop = true
+			select {
+			case tr.TerminateChan <- true:
+			default:
+			}
+			continue
+		}
+		if running == 0 {
+			if t.TerminateIfNeeded(tr, allCmds, envs, failures) {
+				return allCmds, true, nil
+			}
+		}
+		launchReady()
+	}
+	if firstErr != nil {
+		return allCmds, false, firstErr
+	}
+	if t.TerminateIfNeeded(tr, allCmds, envs, failures) {
+		return allCmds, true, nil
+	}
+	return allCmds, false, nil
+}
+
+// startRole starts all roles of a type and waits for them to pass their
+// probes
+func (t *TestRunManager) startRole(
+	tr *common.TestRun,
+	r RoleStartup,
+	envs map[int32][]byte,
+	cmd chan *common.ExecutedCommand,
+	completion chan []runningCommand,
+	errChan chan error,
+) ([]runningCommand, error) {
+	roles := t.GetAllRolesSorted(tr, r.Role)
+	if len(roles) == 0 {
+		return []runningCommand{}, nil
+	}
+	if r.DelaySeconds > 0 {
+		t.WriteLog(
+			tr,
+			"Waiting for %d seconds before starting %d %s(s)",
+			r.DelaySeconds,
+			len(roles),
+			r.Role,
+		)
+		time.Sleep(time.Duration(r.DelaySeconds) * time.Second)
+	}
+	t.UpdateStatus(
+		tr,
+		common.TestRunStatusRunning,
+		fmt.Sprintf("Starting %d %s(s)", len(roles), r.Role),
+	)
+
+	cmds := []runningCommand{}
+	if r.RunToCompletion {
+		// Its commands are reported through the completion channel once they
+		// exit, rather than as running commands of the test run
+		go func() {
+			newCmds, err := t.StartRoleBinaries(
+				[]runningCommand{},
+				roles,
+				tr,
+				envs,
+				cmd,
+				true,
+			)
+			if err != nil {
+				errChan <- err
+			}
+			// FIXME: return newCmds in the error case as well
+			completion <- newCmds
+		}()
+	} else {
+		var err error
+		cmds, err = t.StartRoleBinaries(cmds, roles, tr, envs, cmd, false)
+		if err != nil {
+			return cmds, err
+		}
+	}
+
+	timeout := time.Duration(r.TimeoutSeconds) * time.Second
+	if tr.PreseedShards && r.PreseedTimeoutSeconds > 0 {
+		timeout = time.Duration(r.PreseedTimeoutSeconds) * time.Second
+	}
+	for _, p := range r.Probes {
+		needed := p.Count
+		if p.PerCluster && tr.ShardReplicationFactor > 0 {
+			needed = len(roles) / tr.ShardReplicationFactor
+		}
+		if needed <= 0 || needed > len(roles) {
+			needed = len(roles)
+		}
+		err := t.probeRoles(tr, roles, cmds, p, timeout, needed)
+		if err != nil {
+			return cmds, err
+		}
+	}
+
+	t.UpdateStatus(
+		tr,
+		common.TestRunStatusRunning,
+		fmt.Sprintf("Started %d %s(s)", len(roles), r.Role),
+	)
+	return cmds, nil
+}
+
+// probeRoles waits until the given number of roles pass the probe, or returns
+// an error once the timeout elapses
+func (t *TestRunManager) probeRoles(
+	tr *common.TestRun,
+	roles []*common.TestRunRole,
+	cmds []runningCommand,
+	p ReadinessProbe,
+	timeout time.Duration,
+	needed int,
+) error {
+	if p.Kind == ReadinessProbePort {
+		return t.WaitForRolesOnline(tr, roles, p.Port, timeout, needed)
+	}
+
+	t.WriteLog(
+		tr,
+		"Waiting for %d of %d %s to pass the %s probe",
+		needed,
+		len(roles),
+		roles[0].Role,
+		p.Kind,
+	)
+	deadline := time.Now().Add(timeout)
+	var passed int32
+	wg := sync.WaitGroup{}
+	errs := make([]string, len(roles))
+	for i := range roles {
+		wg.Add(1)
+		go func(i int, r *common.TestRunRole) {
+			defer wg.Done()
+			for time.Now().Before(deadline) &&
+				int(atomic.LoadInt32(&passed)) < needed {
+				ok, err := t.probeRole(tr, r, cmds, p)
+				if err != nil {
+					errs[i] = err.Error()
+				}
+				if ok {
+					atomic.AddInt32(&passed, 1)
+					return
+				}
+				time.Sleep(readinessProbeInterval)
+			}
+		}(i, roles[i])
+	}
+	wg.Wait()
+
+	if int(passed) < needed {
+		msgs := []string{}
+		for i, e := range errs {
+			if e != "" {
+				msgs = append(msgs, fmt.Sprintf(
+					"%s %d: %s",
+					roles[i].Role,
+					roles[i].Index,
+					e,
+				))
+			}
+		}
+		return fmt.Errorf(
+			"Only %d of %d %s passed the %s probe within %s: %s",
+			passed,
+			needed,
+			roles[0].Role,
+			p.Kind,
+			timeout,
+			strings.Join(msgs, "; "),
+		)
+	}
+	return nil
+}
+
+// probeRole checks once whether the role passes a log line or RPC probe
+func (t *TestRunManager) probeRole(
+	tr *common.TestRun,
+	r *common.TestRunRole,
+	cmds []runningCommand,
+	p ReadinessProbe,
+) (bool, error) {
+	switch p.Kind {
+	case ReadinessProbeLogLine:
+		for _, c := range cmds {
+			if c.agentID != r.AgentID {
+				continue
+			}
+			matched, err := t.am.MatchCommandOutput(
+				r.AgentID,
+				tr.Environments[r.AgentID],
+				c.commandID,
+				p.Pattern,
+			)
+			if err != nil || matched {
+				return matched, err
+			}
+		}
+		return false, nil
+	case ReadinessProbeRPC:
+		endpoint, err := t.GetRoleEndpoint(tr, r, p.Port)
+		if err != nil {
+			return false, err
+		}
+		params := make([]string, len(p.Params))
+		for i := range p.Params {
+			params[i] = strings.ReplaceAll(p.Params[i], "%ENDPOINT%", endpoint)
+		}
+		results := make(chan *common.ExecutedCommand, 1)
+		_, _, err = t.am.ExecuteCommand(r.AgentID, agents.ExecuteCommandOptions{
+			Command:        p.Command,
+			Params:         params,
+			Env:            []string{fmt.Sprintf("TESTRUN_ID=%s", tr.ID)},
+			EnvironmentID:  tr.Environments[r.AgentID],
+			Timeout:        int(readinessProbeInterval.Seconds()) * 5,
+			Results:        results,
+			Wait:           true,
+			ContainerImage: tr.ContainerImage,
+		})
+		if err != nil {
+			return false, err
+		}
+		select {
+		case res := <-results:
+			if res.ExitCode != 0 {
+				return false, fmt.Errorf("exited with code %d", res.ExitCode)
+			}
+			return true, nil
+		case <-time.After(readinessProbeInterval):
+			return false, errors.New("no exit code reported")
+		}
+	}
+	return false, fmt.Errorf("unknown probe %q", p.Kind)
+}
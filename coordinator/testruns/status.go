@@ -43,6 +43,19 @@ func (t *TestRunManager) UpdateStatus(
 			shouldLog = false
 		}
 	}
+	// Classify how unsuccessful test runs ended, and record the outcome of
+	// every test run once it is done executing
+	ended := !isTerminalStatus(tr.Status) && isTerminalStatus(newStatus)
+	if ended && newStatus != common.TestRunStatusCompleted &&
+		tr.FailureClass == "" {
+		tr.FailureClass, tr.FailureClassReason = t.classifyFailure(
+			tr,
+			newStatus,
+			details,
+			nil,
+		)
+	}
+
 	if shouldLog {
 		t.WriteLog(
 			tr,
@@ -80,6 +93,11 @@ func (t *TestRunManager) UpdateStatus(
 
 	// Persist the testrun to ensure the status is preserved
 	t.PersistTestRun(tr)
+
+	if ended {
+		t.recordOutcome(tr)
+		go t.accrueSweepBudget(tr.SweepID)
+	}
 }
 
 // FailTestRun will set the status of a testrun to failed, with the given
@@ -90,6 +108,29 @@ func (t *TestRunManager) UpdateStatus(
 func (t *TestRunManager) FailTestRun(tr *common.TestRun, err error) {
 	t.WriteLog(tr, "Test run failed: [%s]", err.Error())
 
+	// Classify the failure by the error that caused it, rather than the
+	// failures that follow from it
+	if tr.Status != common.TestRunStatusFailed && tr.FailureClass == "" {
+		tr.FailureClass, tr.FailureClassReason = t.classifyFailure(
+			tr,
+			common.TestRunStatusFailed,
+			err.Error(),
+			err,
+		)
+		t.WriteLog(
+			tr,
+			"Classified failure as %s (%s)",
+			tr.FailureClass,
+			tr.FailureClassReason,
+		)
+	}
+
+	// Capture the state of the affected agents before they are torn down, if
+	// the test run asked for it
+	if tr.Status != common.TestRunStatusFailed {
+		t.SnapshotFailedAgents(tr)
+	}
+
 	// If the test run has roles running in AWS, we need to terminate all of
 	// them when the test fails.
 	if t.HasAWSRoles(tr) {
@@ -136,5 +177,9 @@ func (t *TestRunManager) FailTestRun(tr *common.TestRun, err error) {
 		if tr.RetryOnFailure {
 			t.Reschedule(tr)
 		}
+		// A failed run frees up a slot of a sweep with limited concurrency
+		if !tr.SweepOneAtATime && tr.SweepConcurrency > 0 {
+			t.ContinueConcurrentSweep(tr)
+		}
 	}
 }
@@ -0,0 +1,385 @@
+package testruns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// maxSummaryErrors is the maximum number of distinct error lines from the
+// test run log that are included in the summary
+const maxSummaryErrors = 10
+
+// Summarizer turns the facts gathered about a test run into the text of its
+// summary, for instance by prompting a language model. When no summarizer is
+// registered, or all of them fail, the text is assembled from the facts
+type Summarizer interface {
+	// Name returns a descriptive name for the summarizer, used in the test
+	// run log and recorded in the summary
+	Name() string
+	// Summarize returns the summary text for the test run
+	Summarize(tr *common.TestRun, summary *common.TestRunSummary) (string, error)
+}
+
+// RegisterSummarizer adds a summarizer. Summarizers are tried in order of
+// registration, the first one to succeed produces the summary text
+func (t *TestRunManager) RegisterSummarizer(s Summarizer) {
+	t.summarizersLock.Lock()
+	defer t.summarizersLock.Unlock()
+	t.summarizers = append(t.summarizers, s)
+}
+
+// SummarizeTestRun produces the summary of a test run whose execution has
+// ended and stores it with the test run. It is called before the post-run
+// hooks are fired, such that notifications sent by them can include it
+func (t *TestRunManager) SummarizeTestRun(tr *common.TestRun) {
+	summary := t.summaryFacts(tr)
+	summary.Text = summaryText(tr, summary)
+	summary.Summarizer = "built-in"
+
+	t.summarizersLock.Lock()
+	summarizers := make([]Summarizer, len(t.summarizers))
+	copy(summarizers, t.summarizers)
+	t.summarizersLock.Unlock()
+
+	for _, s := range summarizers {
+		text, err := s.Summarize(tr, summary)
+		if err != nil {
+			t.WriteLog(tr, "Summarizer %s failed: %v", s.Name(), err)
+			continue
+		}
+		text = strings.TrimSpace(text)
+		if text != "" {
+			summary.Text = text
+			summary.Summarizer = s.Name()
+			break
+		}
+	}
+
+	tr.Summary = summary
+	t.PersistTestRun(tr)
+}
+
+// summaryFacts gathers the key metrics, the anomalies, the injected faults
+// and the errors logged for the test run
+func (t *TestRunManager) summaryFacts(
+	tr *common.TestRun,
+) *common.TestRunSummary {
+	summary := &common.TestRunSummary{
+		Metrics:   map[string]float64{},
+		Anomalies: []string{},
+		Faults:    []string{},
+		Errors:    []string{},
+		Generated: time.Now(),
+	}
+
+	if res := tr.Result; res != nil {
+		summary.Metrics["throughputAvg"] = res.ThroughputAvg
+		summary.Metrics["throughputStd"] = res.ThroughputStd
+		summary.Metrics["latencyAvg"] = res.LatencyAvg
+		summary.Metrics["latencyMax"] = res.LatencyMax
+		for _, p := range res.LatencyPercentiles {
+			if p.Bucket == 99 {
+				summary.Metrics["latency99"] = p.Value
+			}
+		}
+
+		if f := res.Failover; f != nil {
+			summary.Metrics["failoverRecoveryAvg"] = f.RecoveryAvg
+			summary.Metrics["failoverRecoveryMax"] = f.RecoveryMax
+			if f.Unrecovered > 0 {
+				summary.Anomalies = append(summary.Anomalies, fmt.Sprintf(
+					"Throughput did not recover from %d of %d failover(s)",
+					f.Unrecovered,
+					len(f.Recoveries),
+				))
+			}
+		}
+
+		if q := res.Queues; q != nil {
+			for _, r := range q.Roles {
+				key := fmt.Sprintf("queueDepthMax.%s.%d", r.Role, r.Index)
+				summary.Metrics[key] = r.DepthMax
+				// A queue that is considerably deeper while the throughput
+				// dips points at the role as the bottleneck
+				if q.Dips > 0 && r.DipDepthAvg > r.NormalDepthAvg*2 &&
+					r.DipDepthAvg > 0 {
+					summary.Anomalies = append(summary.Anomalies, fmt.Sprintf(
+						"The queue of %s %d was %.1fx deeper during the %d second(s) of throughput dips",
+						r.Role,
+						r.Index,
+						r.DipDepthAvg/math.Max(r.NormalDepthAvg, 1),
+						q.Dips,
+					))
+				}
+			}
+		}
+
+		if res.ThroughputAvg > 0 && res.ThroughputStd > res.ThroughputAvg/2 {
+			summary.Anomalies = append(summary.Anomalies, fmt.Sprintf(
+				"Throughput was unstable, its standard deviation is %.0f%% of the average",
+				res.ThroughputStd/res.ThroughputAvg*100,
+			))
+		}
+		if res.LatencyAvg > 0 && res.LatencyMax > res.LatencyAvg*10 {
+			summary.Anomalies = append(summary.Anomalies, fmt.Sprintf(
+				"Latency spiked to %.3fs, %.0fx the average",
+				res.LatencyMax,
+				res.LatencyMax/res.LatencyAvg,
+			))
+		}
+	} else if tr.Status == common.TestRunStatusCompleted {
+		summary.Anomalies = append(
+			summary.Anomalies,
+			"No results could be calculated",
+		)
+	}
+
+	deliberate := map[string]bool{}
+	for _, id := range tr.DeliberateFailures {
+		deliberate[id] = true
+	}
+	failedCmds := 0
+	for _, c := range tr.ExecutedCommands {
+		if c.ExitCode != 0 && !deliberate[c.CommandID] {
+			failedCmds++
+		}
+	}
+	if failedCmds > 0 {
+		summary.Anomalies = append(summary.Anomalies, fmt.Sprintf(
+			"%d command(s) exited with a non-zero exit code",
+			failedCmds,
+		))
+	}
+
+	for _, r := range tr.Roles {
+		if r.Failure == nil {
+			continue
+		}
+		f := fmt.Sprintf(
+			"%s %d failed after %d seconds",
+			r.Role,
+			r.Index,
+			r.Failure.After,
+		)
+		if !r.Failure.Failed {
+			f = fmt.Sprintf(
+				"%s %d was to fail after %d seconds, but the run ended earlier",
+				r.Role,
+				r.Index,
+				r.Failure.After,
+			)
+		}
+		summary.Faults = append(summary.Faults, f)
+	}
+
+	seen := map[string]bool{}
+	for _, line := range strings.Split(tr.FullLog(), "\n") {
+		// Strip the timestamp written by WriteLog
+		if strings.HasPrefix(line, "[") {
+			if i := strings.Index(line, "] "); i > 0 {
+				line = line[i+2:]
+			}
+		}
+		line = strings.TrimSpace(line)
+		lower := strings.ToLower(line)
+		if !strings.Contains(lower, "error") &&
+			!strings.Contains(lower, "failed") {
+			continue
+		}
+		if seen[line] {
+			continue
+		}
+		seen[line] = true
+		summary.Errors = append(summary.Errors, line)
+		if len(summary.Errors) == maxSummaryErrors {
+			break
+		}
+	}
+	return summary
+}
+
+// summaryText assembles the summary text from the gathered facts
+func summaryText(tr *common.TestRun, summary *common.TestRunSummary) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Test run %s %s", tr.ID, strings.ToLower(string(tr.Status)))
+	if tr.Details != "" && tr.Details != string(tr.Status) {
+		fmt.Fprintf(&b, " (%s)", tr.Details)
+	}
+	if !tr.Started.IsZero() && tr.Completed.After(tr.Started) {
+		fmt.Fprintf(
+			&b,
+			" after %s",
+			tr.Completed.Sub(tr.Started).Round(time.Second),
+		)
+	}
+	b.WriteString(".")
+	if tr.Result != nil {
+		fmt.Fprintf(
+			&b,
+			" Throughput averaged %.2f tx/s (std %.2f), latency averaged %.3fs",
+			tr.Result.ThroughputAvg,
+			tr.Result.ThroughputStd,
+			tr.Result.LatencyAvg,
+		)
+		if p99, ok := summary.Metrics["latency99"]; ok {
+			fmt.Fprintf(&b, " with a 99th percentile of %.3fs", p99)
+		}
+		b.WriteString(".")
+	}
+	sections := []struct {
+		title string
+		lines []string
+	}{
+		{"Anomalies", summary.Anomalies},
+		{"Faults injected", summary.Faults},
+		{"Errors", summary.Errors},
+	}
+	for _, s := range sections {
+		if len(s.lines) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "\n\n%s:", s.title)
+		for _, l := range s.lines {
+			fmt.Fprintf(&b, "\n- %s", l)
+		}
+	}
+	return b.String()
+}
+
+// summarizerPayload is the JSON document passed to external summarizers
+type summarizerPayload struct {
+	TestRun *common.TestRun        `json:"testRun"`
+	Summary *common.TestRunSummary `json:"summary"`
+	// The last part of the test run log, for summarizers that want to look
+	// beyond the errors that were picked out
+	LogTail string `json:"logTail"`
+}
+
+// summarizerLogTail is the number of bytes of the end of the test run log
+// passed to external summarizers
+const summarizerLogTail = 16 * 1024
+
+func newSummarizerPayload(
+	tr *common.TestRun,
+	summary *common.TestRunSummary,
+) ([]byte, error) {
+	log := tr.FullLog()
+	if len(log) > summarizerLogTail {
+		log = log[len(log)-summarizerLogTail:]
+	}
+	return json.Marshal(summarizerPayload{
+		TestRun: tr,
+		Summary: summary,
+		LogTail: log,
+	})
+}
+
+// summarizerTimeout returns the maximum time an external summarizer is
+// allowed to take, configured by SUMMARIZER_TIMEOUT_SECONDS (default two
+// minutes, since summarizers backed by language models can be slow)
+func summarizerTimeout() time.Duration {
+	secs, err := strconv.Atoi(os.Getenv("SUMMARIZER_TIMEOUT_SECONDS"))
+	if err != nil || secs <= 0 {
+		return 2 * time.Minute
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// WebhookSummarizer is a Summarizer that POSTs the test run, the gathered
+// facts and the tail of the log as JSON to a URL, and uses the response body
+// as summary text
+type WebhookSummarizer struct {
+	URL string
+}
+
+// Name implements Summarizer
+func (w *WebhookSummarizer) Name() string {
+	return fmt.Sprintf("webhook %s", w.URL)
+}
+
+// Summarize implements Summarizer
+func (w *WebhookSummarizer) Summarize(
+	tr *common.TestRun,
+	summary *common.TestRunSummary,
+) (string, error) {
+	b, err := newSummarizerPayload(tr, summary)
+	if err != nil {
+		return "", err
+	}
+	clt := &http.Client{Timeout: summarizerTimeout()}
+	resp, err := clt.Post(w.URL, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	text, err := ioutil.ReadAll(resp.Body)
+	return string(text), err
+}
+
+// ExecSummarizer is a Summarizer that executes a shell command with the JSON
+// payload on its standard input, and uses its standard output as summary
+// text. The test run ID is passed in the TESTRUN_ID environment variable
+type ExecSummarizer struct {
+	Command string
+}
+
+// Name implements Summarizer
+func (e *ExecSummarizer) Name() string {
+	return fmt.Sprintf("exec %s", e.Command)
+}
+
+// Summarize implements Summarizer
+func (e *ExecSummarizer) Summarize(
+	tr *common.TestRun,
+	summary *common.TestRunSummary,
+) (string, error) {
+	b, err := newSummarizerPayload(tr, summary)
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(
+		context.Background(),
+		summarizerTimeout(),
+	)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", e.Command)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("TESTRUN_ID=%s", tr.ID))
+	cmd.Stdin = bytes.NewReader(b)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+// registerSummarizersFromEnv registers the external summarizers configured in
+// the SUMMARIZER_WEBHOOK (URL) and SUMMARIZER_EXEC (shell command) environment
+// variables
+func (t *TestRunManager) registerSummarizersFromEnv() {
+	if u := strings.TrimSpace(os.Getenv("SUMMARIZER_WEBHOOK")); u != "" {
+		logging.Infof("Registering summarizer webhook %s", u)
+		t.RegisterSummarizer(&WebhookSummarizer{URL: u})
+	}
+	if c := strings.TrimSpace(os.Getenv("SUMMARIZER_EXEC")); c != "" {
+		logging.Infof("Registering summarizer exec %s", c)
+		t.RegisterSummarizer(&ExecSummarizer{Command: c})
+	}
+}
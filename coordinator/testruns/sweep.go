@@ -12,6 +12,10 @@ func (t *TestRunManager) ContinueSweep(tr *common.TestRun, sweepID string) {
 	if sweepID == "" && tr != nil {
 		sweepID = tr.SweepID
 	}
+	if t.sweepTrimmed(sweepID) {
+		t.WriteLog(tr, "Sweep was trimmed - not scheduling further runs")
+		return
+	}
 
 	// Get all test runs that are part of the sweep
 	sweepRuns := []*common.TestRun{}
@@ -116,7 +120,10 @@ func (t *TestRunManager) ContinueSweep(tr *common.TestRun, sweepID string) {
 			if tr.Sweep == "peak" {
 				scheduleRuns = missing
 			}
-			t.ScheduleSweepRuns(scheduleRuns)
+			err := t.ScheduleSweepRuns(scheduleRuns)
+			if err != nil {
+				t.WriteLog(tr, "Not scheduling next sweep run: %v", err)
+			}
 
 		} else {
 			t.WriteLog(tr, "No missing runs returned - sweep done")
@@ -124,13 +131,18 @@ func (t *TestRunManager) ContinueSweep(tr *common.TestRun, sweepID string) {
 	}
 }
 
-func (t *TestRunManager) ScheduleSweepRuns(scheduleRuns []*common.TestRun) {
+// ScheduleSweepRuns schedules further runs of a sweep. The runs are linted
+// like the runs of the submission were, since their parameters can differ
+// from those
+func (t *TestRunManager) ScheduleSweepRuns(
+	scheduleRuns []*common.TestRun,
+) error {
 	for i := range scheduleRuns {
 		scheduleRuns[i].AWSInstancesStopped = false
 		for j := range scheduleRuns[i].Roles {
 			scheduleRuns[i].Roles[j].AgentID = -1
 		}
 		scheduleRuns[i].Result = nil
-		t.ScheduleTestRun(scheduleRuns[i])
 	}
+	return t.scheduleLintedRuns(scheduleRuns)
 }
@@ -0,0 +1,445 @@
+package testruns
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/coordinator"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// ErrSweepBudgetNotFound is returned when no budget is attached to the
+// requested sweep
+var ErrSweepBudgetNotFound = errors.New("Sweep budget not found")
+
+// ErrSweepBudgetForbidden is returned when a user other than the owner of a
+// sweep, who is not an admin, tries to change its budget
+var ErrSweepBudgetForbidden = errors.New(
+	"Only the owner of a sweep or an admin can change its budget",
+)
+
+// sweepBudgetInterval is how often the usage of the running runs of sweeps
+// with a budget is accrued
+const sweepBudgetInterval = time.Minute
+
+// SweepPointUsage is what one run of a sweep used
+type SweepPointUsage struct {
+	TestRunID  string  `json:"testRunID"`
+	FleetHours float64 `json:"fleetHours"`
+	CostUSD    float64 `json:"costUSD"`
+	// Set once the run ended, after which its usage no longer changes
+	Final bool `json:"final"`
+}
+
+// SweepBudgetExtension records the budget of a sweep being changed after it
+// was submitted
+type SweepBudgetExtension struct {
+	Time           time.Time          `json:"time"`
+	UserThumbprint string             `json:"userThumbprint"`
+	Previous       common.SweepBudget `json:"previous"`
+	Budget         common.SweepBudget `json:"budget"`
+}
+
+// SweepBudgetState is the budget attached to a sweep and the usage accrued by
+// its runs
+type SweepBudgetState struct {
+	SweepID         string                      `json:"sweepID"`
+	OwnerThumbprint string                      `json:"ownerThumbprint"`
+	Budget          common.SweepBudget          `json:"budget"`
+	Usage           map[string]*SweepPointUsage `json:"usage"`
+	// The moment the budget was reached, zero while it is not
+	Reached time.Time `json:"reached"`
+	// Set when the owner chose to drop the remaining runs of the sweep in
+	// stead of extending its budget
+	Trimmed    bool                   `json:"trimmed"`
+	Extensions []SweepBudgetExtension `json:"extensions"`
+}
+
+// Used returns the total usage of the runs of the sweep
+func (s *SweepBudgetState) Used() common.SweepBudget {
+	used := common.SweepBudget{}
+	for _, u := range s.Usage {
+		used.CostUSD += u.CostUSD
+		used.FleetHours += u.FleetHours
+	}
+	return used
+}
+
+// clone returns a copy of the state that can be used without holding
+// sweepBudgetsLock
+func (s *SweepBudgetState) clone() SweepBudgetState {
+	c := *s
+	c.Usage = make(map[string]*SweepPointUsage, len(s.Usage))
+	for k, u := range s.Usage {
+		uc := *u
+		c.Usage[k] = &uc
+	}
+	c.Extensions = append([]SweepBudgetExtension{}, s.Extensions...)
+	return c
+}
+
+// budgetReached returns true if the usage reached any of the limits of the
+// budget
+func budgetReached(budget, used common.SweepBudget) bool {
+	return (budget.CostUSD > 0 && used.CostUSD >= budget.CostUSD) ||
+		(budget.FleetHours > 0 && used.FleetHours >= budget.FleetHours)
+}
+
+// ValidateSweepBudget checks that the budget limits anything at all
+func ValidateSweepBudget(b common.SweepBudget) error {
+	if b.CostUSD < 0 || b.FleetHours < 0 {
+		return errors.New("Sweep budgets cannot be negative")
+	}
+	if b.CostUSD == 0 && b.FleetHours == 0 {
+		return errors.New("Sweep budgets need a cost or fleet hour limit")
+	}
+	return nil
+}
+
+// sweepBudgetsPath returns the path of the file the sweep budgets are
+// persisted in
+func sweepBudgetsPath() string {
+	return filepath.Join(common.DataDir(), "testruns", "sweepbudgets.json")
+}
+
+// loadSweepBudgets reads the sweep budgets from disk
+func (t *TestRunManager) loadSweepBudgets() error {
+	b, err := os.ReadFile(sweepBudgetsPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	t.sweepBudgetsLock.Lock()
+	defer t.sweepBudgetsLock.Unlock()
+	return json.Unmarshal(b, &t.sweepBudgets)
+}
+
+// persistSweepBudgets writes the sweep budgets to disk. Must be called with
+// sweepBudgetsLock held
+func (t *TestRunManager) persistSweepBudgets() error {
+	b, err := json.Marshal(t.sweepBudgets)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(sweepBudgetsPath()), 0755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(sweepBudgetsPath(), b, 0644)
+}
+
+// SetInstanceHourlyCosts changes the hourly cost (in US dollars) of the
+// instance types, used to calculate the cost of sweeps with a budget
+func (t *TestRunManager) SetInstanceHourlyCosts(
+	costs map[string]float64,
+) error {
+	t.configLock.Lock()
+	t.config.InstanceHourlyCosts = costs
+	t.configLock.Unlock()
+	return t.PersistConfig()
+}
+
+// runUsage calculates the fleet hours and cost of the test run up to now.
+// Every role that isn't colocated with another role has its own agent
+func (t *TestRunManager) runUsage(tr *common.TestRun) (float64, float64) {
+	if tr.Started.IsZero() {
+		return 0, 0
+	}
+	end := time.Now()
+	if !tr.Completed.IsZero() && tr.Completed.After(tr.Started) {
+		end = tr.Completed
+	}
+	hours := end.Sub(tr.Started).Hours()
+
+	fleetHours, cost := 0.0, 0.0
+	costs := t.Config().InstanceHourlyCosts
+	for _, r := range tr.Roles {
+		if r.ColocateWith != nil {
+			continue
+		}
+		fleetHours += hours
+		if r.AwsLaunchTemplateID == "" {
+			continue
+		}
+		lt, err := t.awsm.GetLaunchTemplate(r.AwsLaunchTemplateID)
+		if err != nil {
+			continue
+		}
+		cost += hours * costs[lt.InstanceType]
+	}
+	return fleetHours, cost
+}
+
+// SetSweepBudget attaches the budget to the sweep, or changes the budget of
+// the sweep if it has one. Raising the budget of a sweep that reached it
+// releases its held runs. Only the owner of the sweep or an admin can change
+// its budget
+func (t *TestRunManager) SetSweepBudget(
+	sweepID string,
+	userThumbprint string,
+	admin bool,
+	budget common.SweepBudget,
+) (SweepBudgetState, error) {
+	if err := ValidateSweepBudget(budget); err != nil {
+		return SweepBudgetState{}, err
+	}
+	if !admin {
+		for _, tr := range t.sweepRuns(sweepID) {
+			if tr.CreatedByThumbprint != userThumbprint {
+				return SweepBudgetState{}, ErrSweepBudgetForbidden
+			}
+		}
+	}
+
+	t.sweepBudgetsLock.Lock()
+	s, ok := t.sweepBudgets[sweepID]
+	if ok && s.OwnerThumbprint != userThumbprint && !admin {
+		t.sweepBudgetsLock.Unlock()
+		return SweepBudgetState{}, ErrSweepBudgetForbidden
+	}
+	if !ok {
+		s = &SweepBudgetState{
+			SweepID:         sweepID,
+			OwnerThumbprint: userThumbprint,
+			Usage:           map[string]*SweepPointUsage{},
+			Extensions:      []SweepBudgetExtension{},
+		}
+		t.sweepBudgets[sweepID] = s
+	} else {
+		if s.Trimmed {
+			t.sweepBudgetsLock.Unlock()
+			return SweepBudgetState{}, errors.New(
+				"The remaining runs of the sweep were trimmed",
+			)
+		}
+		if budgetReached(budget, s.Used()) {
+			t.sweepBudgetsLock.Unlock()
+			return SweepBudgetState{}, errors.New(
+				"The sweep already used more than the new budget",
+			)
+		}
+		s.Extensions = append(s.Extensions, SweepBudgetExtension{
+			Time:           time.Now(),
+			UserThumbprint: userThumbprint,
+			Previous:       s.Budget,
+			Budget:         budget,
+		})
+	}
+	s.Budget = budget
+	wasReached := !s.Reached.IsZero()
+	s.Reached = time.Time{}
+	ret := s.clone()
+	err := t.persistSweepBudgets()
+	t.sweepBudgetsLock.Unlock()
+	if err != nil {
+		return SweepBudgetState{}, err
+	}
+
+	if wasReached {
+		for _, tr := range t.sweepRuns(sweepID) {
+			t.testRunsLock.Lock()
+			release := tr.Status == common.TestRunStatusQueued &&
+				tr.SweepBudgetHold
+			if release {
+				tr.SweepBudgetHold = false
+			}
+			t.testRunsLock.Unlock()
+			if !release {
+				continue
+			}
+			t.WriteLog(tr, "Sweep budget was extended, releasing the run")
+			t.PersistTestRun(tr)
+		}
+	}
+	return ret, nil
+}
+
+// GetSweepBudget returns the budget of the sweep and its usage so far
+func (t *TestRunManager) GetSweepBudget(
+	sweepID string,
+) (SweepBudgetState, error) {
+	t.accrueSweepBudget(sweepID)
+	t.sweepBudgetsLock.Lock()
+	defer t.sweepBudgetsLock.Unlock()
+	s, ok := t.sweepBudgets[sweepID]
+	if !ok {
+		return SweepBudgetState{}, ErrSweepBudgetNotFound
+	}
+	return s.clone(), nil
+}
+
+// sweepBudgetReached returns true if the runs of the sweep have to be held
+// because the sweep reached its budget
+func (t *TestRunManager) sweepBudgetReached(sweepID string) bool {
+	t.sweepBudgetsLock.Lock()
+	defer t.sweepBudgetsLock.Unlock()
+	s, ok := t.sweepBudgets[sweepID]
+	return ok && !s.Reached.IsZero()
+}
+
+// sweepTrimmed returns true if the owner of the sweep dropped its remaining
+// runs, in which case no more of its runs are scheduled
+func (t *TestRunManager) sweepTrimmed(sweepID string) bool {
+	t.sweepBudgetsLock.Lock()
+	defer t.sweepBudgetsLock.Unlock()
+	s, ok := t.sweepBudgets[sweepID]
+	return ok && s.Trimmed
+}
+
+// TrimSweep cancels the runs of the sweep that are held because it reached its
+// budget, and stops scheduling further runs of the sweep. Only the owner of
+// the sweep or an admin can trim it
+func (t *TestRunManager) TrimSweep(
+	sweepID string,
+	userThumbprint string,
+	admin bool,
+) (int, error) {
+	t.sweepBudgetsLock.Lock()
+	s, ok := t.sweepBudgets[sweepID]
+	if !ok {
+		t.sweepBudgetsLock.Unlock()
+		return 0, ErrSweepBudgetNotFound
+	}
+	if s.OwnerThumbprint != userThumbprint && !admin {
+		t.sweepBudgetsLock.Unlock()
+		return 0, ErrSweepBudgetForbidden
+	}
+	s.Trimmed = true
+	err := t.persistSweepBudgets()
+	t.sweepBudgetsLock.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	trimmed := 0
+	for _, tr := range t.sweepRuns(sweepID) {
+		t.testRunsLock.Lock()
+		held := tr.Status == common.TestRunStatusQueued && tr.SweepBudgetHold
+		t.testRunsLock.Unlock()
+		if !held {
+			continue
+		}
+		t.UpdateStatus(
+			tr,
+			common.TestRunStatusCanceled,
+			fmt.Sprintf(
+				"Sweep trimmed by %s after reaching its budget",
+				userThumbprint,
+			),
+		)
+		trimmed++
+	}
+	return trimmed, nil
+}
+
+// accrueSweepBudget updates the usage of the runs of the sweep, and holds its
+// queued runs once the budget is reached. Runs that are executing are left to
+// complete, so the usage can end up exceeding the budget by what they use
+func (t *TestRunManager) accrueSweepBudget(sweepID string) {
+	if sweepID == "" {
+		return
+	}
+	// Collect the runs before taking the budget lock, ScheduleTestRun checks
+	// the budget while holding testRunsLock
+	runs := t.sweepRuns(sweepID)
+
+	t.sweepBudgetsLock.Lock()
+	s, ok := t.sweepBudgets[sweepID]
+	if !ok {
+		t.sweepBudgetsLock.Unlock()
+		return
+	}
+	for _, tr := range runs {
+		if tr.Started.IsZero() {
+			continue
+		}
+		u, ok := s.Usage[tr.ID]
+		if !ok {
+			u = &SweepPointUsage{TestRunID: tr.ID}
+			s.Usage[tr.ID] = u
+		}
+		if u.Final {
+			continue
+		}
+		u.FleetHours, u.CostUSD = t.runUsage(tr)
+		u.Final = isTerminalStatus(tr.Status)
+	}
+	used := s.Used()
+	reached := s.Reached.IsZero() && !s.Trimmed &&
+		budgetReached(s.Budget, used)
+	if reached {
+		s.Reached = time.Now()
+	}
+	budget := s.Budget
+	owner := s.OwnerThumbprint
+	err := t.persistSweepBudgets()
+	t.sweepBudgetsLock.Unlock()
+	if err != nil {
+		logging.Errorf("Unable to persist sweep budgets: %v", err)
+	}
+	if !reached {
+		return
+	}
+
+	held := 0
+	for _, tr := range runs {
+		// The scheduler reads the hold while holding testRunsLock
+		t.testRunsLock.Lock()
+		hold := tr.Status == common.TestRunStatusQueued && !tr.SweepBudgetHold
+		if hold {
+			tr.SweepBudgetHold = true
+		}
+		t.testRunsLock.Unlock()
+		if !hold {
+			continue
+		}
+		t.WriteLog(
+			tr,
+			"Sweep reached its budget (%.2f USD, %.1f fleet hours used), holding the run until the budget is extended",
+			used.CostUSD,
+			used.FleetHours,
+		)
+		t.PersistTestRun(tr)
+		held++
+	}
+	logging.Infof(
+		"Sweep %s reached its budget, held %d queued run(s)",
+		sweepID,
+		held,
+	)
+	t.ev <- coordinator.Event{
+		Type: coordinator.EventTypeSweepBudgetReached,
+		Payload: coordinator.SweepBudgetReachedPayload{
+			SweepID:         sweepID,
+			OwnerThumbprint: owner,
+			Budget:          budget,
+			Used:            used,
+			HeldRuns:        held,
+		},
+	}
+}
+
+// SweepBudgetMonitor periodically accrues the usage of the running runs of
+// sweeps with a budget, such that sweeps running many runs in parallel are
+// stopped close to their budget
+func (t *TestRunManager) SweepBudgetMonitor() {
+	for {
+		time.Sleep(sweepBudgetInterval)
+		sweeps := map[string]bool{}
+		for _, tr := range t.GetTestRuns() {
+			if tr.SweepID != "" && tr.Status == common.TestRunStatusRunning {
+				sweeps[tr.SweepID] = true
+			}
+		}
+		for sweepID := range sweeps {
+			t.accrueSweepBudget(sweepID)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package testruns
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+)
+
+// ErrSweepNotFound is returned when no test run is part of the requested
+// sweep
+var ErrSweepNotFound = errors.New("Sweep not found")
+
+// SweepMatrixCell summarizes the test runs of one cell of a matrix sweep
+type SweepMatrixCell struct {
+	Values    common.SweepCellValues `json:"values"`
+	Pending   int                    `json:"pending"`
+	Completed int                    `json:"completed"`
+	Failed    int                    `json:"failed"`
+	RunIDs    []string               `json:"runIDs"`
+	// The results of the completed runs of the cell, averaged
+	ThroughputAvg float64 `json:"throughputAvg"`
+	LatencyAvg    float64 `json:"latencyAvg"`
+	Latency99     float64 `json:"latency99"`
+}
+
+// SweepMatrixReport is the aggregated outcome of a matrix sweep
+type SweepMatrixReport struct {
+	SweepID     string                  `json:"sweepID"`
+	Dimensions  []common.SweepDimension `json:"dimensions"`
+	Concurrency int                     `json:"concurrency"`
+	Cells       []*SweepMatrixCell      `json:"cells"`
+}
+
+// InitialSweepRuns returns the runs of an expanded sweep to schedule right
+// away. Sweeps run one at a time or with a limited concurrency schedule the
+// remaining runs as earlier ones finish
+func InitialSweepRuns(
+	tr *common.TestRun,
+	runs []*common.TestRun,
+) []*common.TestRun {
+	limit := tr.SweepConcurrency
+	if tr.SweepOneAtATime {
+		limit = 1
+	}
+	if limit > 0 && len(runs) > limit {
+		return runs[:limit]
+	}
+	return runs
+}
+
+// sweepRuns returns all test runs that are part of the sweep
+func (t *TestRunManager) sweepRuns(sweepID string) []*common.TestRun {
+	ret := []*common.TestRun{}
+	for _, tr := range t.GetTestRuns() {
+		if tr.SweepID == sweepID {
+			ret = append(ret, tr)
+		}
+	}
+	return ret
+}
+
+// unscheduledSweepRuns returns the runs the sweep expands into that were not
+// scheduled yet. Unlike FindMissingSweepRuns, runs that failed count as
+// scheduled, such that a failing configuration is not retried indefinitely
+func unscheduledSweepRuns(runs []*common.TestRun) []*common.TestRun {
+	if len(runs) == 0 {
+		return []*common.TestRun{}
+	}
+	first := runs[0]
+	for _, r := range runs {
+		if r.Created.Before(first.Created) {
+			first = r
+		}
+	}
+
+	configHash := func(r *common.TestRun) string {
+		nc := r.NormalizedConfigWithAgentData(false)
+		nc.ControllerCommitHash = ""
+		return fmt.Sprintf("%x", nc.Hash())
+	}
+	scheduled := map[string]int{}
+	for _, r := range runs {
+		scheduled[configHash(r)]++
+	}
+
+	ret := []*common.TestRun{}
+	for _, r := range common.ExpandSweepRun(first, first.SweepID) {
+		h := configHash(r)
+		if scheduled[h] > 0 {
+			scheduled[h]--
+			continue
+		}
+		ret = append(ret, r)
+	}
+	return ret
+}
+
+// ContinueConcurrentSweep schedules the next runs of a sweep with a limited
+// concurrency, such that the number of its queued and running runs goes back
+// up to the limit. Runs of the same sweep finishing at the same time would
+// otherwise both see the same free slots and missing runs, and schedule them
+// twice, so the sweep is continued under its own lock
+func (t *TestRunManager) ContinueConcurrentSweep(tr *common.TestRun) {
+	if tr.SweepID == "" || tr.SweepConcurrency <= 0 {
+		return
+	}
+	l, _ := t.sweepLocks.LoadOrStore(tr.SweepID, &sync.Mutex{})
+	lock := l.(*sync.Mutex)
+	lock.Lock()
+	defer lock.Unlock()
+	if t.sweepTrimmed(tr.SweepID) {
+		return
+	}
+	runs := t.sweepRuns(tr.SweepID)
+	active := 0
+	for _, r := range runs {
+		if r.Status == common.TestRunStatusQueued ||
+			r.Status == common.TestRunStatusRunning {
+			active++
+		}
+	}
+	missing := unscheduledSweepRuns(runs)
+	if len(missing) == 0 {
+		if active == 0 {
+			t.WriteLog(tr, "No missing runs returned - sweep done")
+			if tr.Sweep == "comparison" {
+				t.storeComparisonReport(tr)
+			}
+		}
+		return
+	}
+	free := tr.SweepConcurrency - active
+	if free <= 0 {
+		return
+	}
+	if free < len(missing) {
+		missing = missing[:free]
+	}
+	t.WriteLog(tr, "Scheduling %d next sweep run(s)", len(missing))
+	err := t.ScheduleSweepRuns(missing)
+	if err != nil {
+		t.WriteLog(tr, "Not scheduling next sweep run(s): %v", err)
+	}
+}
+
+// GenerateSweepMatrixReport aggregates the test runs of a matrix sweep per
+// cell of the matrix, in the order the sweep expands them
+func (t *TestRunManager) GenerateSweepMatrixReport(
+	sweepID string,
+) (*SweepMatrixReport, error) {
+	runs := t.sweepRuns(sweepID)
+	if len(runs) == 0 {
+		return nil, ErrSweepNotFound
+	}
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].Created.Before(runs[j].Created)
+	})
+	first := runs[0]
+	if first.Sweep != "matrix" {
+		return nil, fmt.Errorf("Sweep %s is not a matrix sweep", sweepID)
+	}
+
+	report := &SweepMatrixReport{
+		SweepID:     sweepID,
+		Dimensions:  first.SweepMatrix,
+		Concurrency: first.SweepConcurrency,
+		Cells:       []*SweepMatrixCell{},
+	}
+	cells := map[string]*SweepMatrixCell{}
+	for _, values := range common.SweepMatrixCells(first.SweepMatrix) {
+		c := &SweepMatrixCell{Values: values, RunIDs: []string{}}
+		cells[values.Key()] = c
+		report.Cells = append(report.Cells, c)
+	}
+
+	results := map[*SweepMatrixCell]int{}
+	for _, r := range runs {
+		c, ok := cells[r.SweepCell.Key()]
+		if !ok {
+			continue
+		}
+		c.RunIDs = append(c.RunIDs, r.ID)
+		switch r.Status {
+		case common.TestRunStatusQueued, common.TestRunStatusRunning:
+			c.Pending++
+		case common.TestRunStatusCompleted:
+			c.Completed++
+			if r.Result == nil {
+				continue
+			}
+			results[c]++
+			c.ThroughputAvg += r.Result.ThroughputAvg
+			c.LatencyAvg += r.Result.LatencyAvg
+			for _, p := range r.Result.LatencyPercentiles {
+				if p.Bucket == 99 {
+					c.Latency99 += p.Value
+				}
+			}
+		default:
+			c.Failed++
+		}
+	}
+
+	for c, n := range results {
+		c.ThroughputAvg /= float64(n)
+		c.LatencyAvg /= float64(n)
+		c.Latency99 /= float64(n)
+	}
+	return report, nil
+}
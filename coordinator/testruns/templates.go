@@ -0,0 +1,441 @@
+package testruns
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+)
+
+// ErrTestRunTemplateNotFound is returned when no template (or template
+// version) with the requested ID was saved
+var ErrTestRunTemplateNotFound = errors.New("Test run template not found")
+
+// maxTemplateInheritanceDepth limits how many templates deep a template can
+// inherit its parameters
+const maxTemplateInheritanceDepth = 16
+
+// templateReservedParameters are the test run fields that describe the
+// lifecycle of a single test run rather than its configuration, and can
+// therefore not be set by a template
+var templateReservedParameters = []string{
+	"id",
+	"createdByuserThumbprint",
+	"impersonatedByThumbprint",
+	"created",
+	"started",
+	"completed",
+	"status",
+	"details",
+	"executedCommands",
+	"testrunAgentData",
+	"testrunAgentDataEnd",
+	"performanceDataAvailable",
+	"controllerCommitHash",
+	"result",
+	"observedPeak",
+	"sweepID",
+	"awaitingApproval",
+	"approvedByThumbprint",
+	"sweepBudgetHold",
+	"templateID",
+	"templateVersion",
+	"summary",
+	"failureSnapshots",
+	"failovers",
+	"preemptions",
+	"pauses",
+	"faultTimeline",
+	"failureClass",
+	"failureClassReason",
+	"outputValidationErrors",
+	"placementChanges",
+}
+
+// templateParameters are the test run parameters a template can set, keyed by
+// their JSON name
+var templateParameters = jsonFieldKinds(reflect.TypeOf(common.TestRun{}))
+
+// TestRunTemplate is a named set of test run parameters that test runs can
+// inherit from. Every save creates a new version of the template, earlier
+// versions are kept such that the test runs created from them can be
+// reproduced
+type TestRunTemplate struct {
+	ID          string `json:"id"`
+	Version     int    `json:"version"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// The template (and version of it) this template inherits its parameters
+	// from, if any. A parent version of 0 is pinned to the latest version of
+	// the parent when the template is saved
+	ParentID      string `json:"parentID,omitempty"`
+	ParentVersion int    `json:"parentVersion,omitempty"`
+	// The test run parameters set by this template keyed by their JSON name,
+	// overriding the ones inherited from the parent
+	Parameters          map[string]interface{} `json:"parameters"`
+	Created             time.Time              `json:"created"`
+	CreatedByThumbprint string                 `json:"createdByThumbprint"`
+}
+
+// validateTestRunTemplate checks that the template only sets known,
+// non-reserved test run parameters with values of the right type
+func validateTestRunTemplate(tpl *TestRunTemplate) []error {
+	ret := []error{}
+	if strings.TrimSpace(tpl.Name) == "" {
+		ret = append(ret, errors.New("Template has no name"))
+	}
+	for k, v := range tpl.Parameters {
+		if _, ok := templateParameters[k]; !ok {
+			ret = append(ret, fmt.Errorf("Unknown test run parameter %s", k))
+			continue
+		}
+		for _, r := range templateReservedParameters {
+			if k == r {
+				ret = append(ret, fmt.Errorf(
+					"Parameter %s cannot be set by a template",
+					k,
+				))
+			}
+		}
+		b, err := json.Marshal(map[string]interface{}{k: v})
+		if err == nil {
+			err = json.Unmarshal(b, &common.TestRun{})
+		}
+		if err != nil {
+			ret = append(ret, fmt.Errorf("Invalid value for %s: %v", k, err))
+		}
+	}
+	return ret
+}
+
+// templateValidationError combines the errors found validating a template
+func templateValidationError(errs []error) error {
+	msgs := make([]string, len(errs))
+	for i, e := range errs {
+		msgs[i] = e.Error()
+	}
+	return errors.New(strings.Join(msgs, "; "))
+}
+
+// testRunTemplatesPath returns the path of the file the test run templates
+// are persisted in
+func testRunTemplatesPath() string {
+	return filepath.Join(common.DataDir(), "testruns", "templates.json")
+}
+
+// loadTestRunTemplates reads the saved test run templates from disk
+func (t *TestRunManager) loadTestRunTemplates() error {
+	b, err := os.ReadFile(testRunTemplatesPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	t.templatesLock.Lock()
+	defer t.templatesLock.Unlock()
+	return json.Unmarshal(b, &t.templates)
+}
+
+// persistTestRunTemplates writes the saved test run templates to disk. Must
+// be called with templatesLock held
+func (t *TestRunManager) persistTestRunTemplates() error {
+	b, err := json.Marshal(t.templates)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(testRunTemplatesPath()), 0755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(testRunTemplatesPath(), b, 0644)
+}
+
+// getTestRunTemplate returns the given version of the template, or its
+// latest version if version is 0. Must be called with templatesLock held
+func (t *TestRunManager) getTestRunTemplate(
+	id string,
+	version int,
+) (*TestRunTemplate, error) {
+	var ret *TestRunTemplate
+	for _, tpl := range t.templates {
+		if tpl.ID != id {
+			continue
+		}
+		if tpl.Version == version {
+			return tpl, nil
+		}
+		if version == 0 && (ret == nil || tpl.Version > ret.Version) {
+			ret = tpl
+		}
+	}
+	if ret == nil {
+		return nil, ErrTestRunTemplateNotFound
+	}
+	return ret, nil
+}
+
+// SaveTestRunTemplate validates the template and saves it as a new template
+// if id is empty, or as the next version of the template with the given ID
+func (t *TestRunManager) SaveTestRunTemplate(
+	id string,
+	tpl *TestRunTemplate,
+	createdByThumbprint string,
+) (*TestRunTemplate, error) {
+	if errs := validateTestRunTemplate(tpl); len(errs) > 0 {
+		return nil, templateValidationError(errs)
+	}
+	if tpl.Parameters == nil {
+		tpl.Parameters = map[string]interface{}{}
+	}
+
+	t.templatesLock.Lock()
+	defer t.templatesLock.Unlock()
+
+	if tpl.ParentID != "" {
+		parent, err := t.getTestRunTemplate(tpl.ParentID, tpl.ParentVersion)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"Parent template %s: %v",
+				tpl.ParentID,
+				err,
+			)
+		}
+		tpl.ParentVersion = parent.Version
+	} else {
+		tpl.ParentVersion = 0
+	}
+
+	if id == "" {
+		var err error
+		id, err = common.RandomID(12)
+		if err != nil {
+			return nil, err
+		}
+		tpl.Version = 1
+	} else {
+		latest, err := t.getTestRunTemplate(id, 0)
+		if err != nil {
+			return nil, err
+		}
+		tpl.Version = latest.Version + 1
+	}
+	tpl.ID = id
+	tpl.Created = time.Now()
+	tpl.CreatedByThumbprint = createdByThumbprint
+
+	t.templates = append(t.templates, tpl)
+	err := t.persistTestRunTemplates()
+	if err != nil {
+		t.templates = t.templates[:len(t.templates)-1]
+		return nil, err
+	}
+	return tpl, nil
+}
+
+// TestRunTemplates returns the latest version of every saved test run
+// template
+func (t *TestRunManager) TestRunTemplates() []*TestRunTemplate {
+	t.templatesLock.Lock()
+	defer t.templatesLock.Unlock()
+	latest := map[string]*TestRunTemplate{}
+	for _, tpl := range t.templates {
+		if l, ok := latest[tpl.ID]; !ok || tpl.Version > l.Version {
+			latest[tpl.ID] = tpl
+		}
+	}
+	ret := make([]*TestRunTemplate, 0, len(latest))
+	for _, tpl := range latest {
+		ret = append(ret, tpl)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret
+}
+
+// TestRunTemplateVersions returns all versions of the test run template with
+// the given ID, oldest first
+func (t *TestRunManager) TestRunTemplateVersions(
+	id string,
+) ([]*TestRunTemplate, error) {
+	t.templatesLock.Lock()
+	defer t.templatesLock.Unlock()
+	ret := []*TestRunTemplate{}
+	for _, tpl := range t.templates {
+		if tpl.ID == id {
+			ret = append(ret, tpl)
+		}
+	}
+	if len(ret) == 0 {
+		return nil, ErrTestRunTemplateNotFound
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Version < ret[j].Version })
+	return ret, nil
+}
+
+// GetTestRunTemplate returns the given version of the test run template, or
+// its latest version if version is 0
+func (t *TestRunManager) GetTestRunTemplate(
+	id string,
+	version int,
+) (*TestRunTemplate, error) {
+	t.templatesLock.Lock()
+	defer t.templatesLock.Unlock()
+	return t.getTestRunTemplate(id, version)
+}
+
+// DeleteTestRunTemplate removes all versions of a test run template. Templates
+// other templates still inherit from, or that test runs or recurring
+// schedules were created from, cannot be removed, since those record the
+// template version they were created from to be reproducible
+func (t *TestRunManager) DeleteTestRunTemplate(id string) error {
+	for _, tr := range t.GetTestRuns() {
+		if tr.TemplateID == id {
+			return fmt.Errorf(
+				"Test run %s was created from this template",
+				tr.ID,
+			)
+		}
+	}
+	t.recurringLock.Lock()
+	for _, s := range t.recurring {
+		if s.TemplateID == id {
+			t.recurringLock.Unlock()
+			return fmt.Errorf(
+				"Recurring schedule %s (%s) is created from this template",
+				s.ID,
+				s.Name,
+			)
+		}
+	}
+	t.recurringLock.Unlock()
+
+	t.templatesLock.Lock()
+	defer t.templatesLock.Unlock()
+	if _, err := t.getTestRunTemplate(id, 0); err != nil {
+		return err
+	}
+	kept := make([]*TestRunTemplate, 0, len(t.templates))
+	for _, tpl := range t.templates {
+		if tpl.ParentID == id && tpl.ID != id {
+			return fmt.Errorf(
+				"Template %s (%s) inherits from this template",
+				tpl.ID,
+				tpl.Name,
+			)
+		}
+		if tpl.ID != id {
+			kept = append(kept, tpl)
+		}
+	}
+	prev := t.templates
+	t.templates = kept
+	err := t.persistTestRunTemplates()
+	if err != nil {
+		t.templates = prev
+	}
+	return err
+}
+
+// resolveTestRunTemplate returns the parameters of the given template
+// version including the ones inherited from its ancestors. Must be called
+// with templatesLock held
+func (t *TestRunManager) resolveTestRunTemplate(
+	tpl *TestRunTemplate,
+) (map[string]interface{}, error) {
+	chain := []*TestRunTemplate{tpl}
+	for tpl.ParentID != "" {
+		if len(chain) > maxTemplateInheritanceDepth {
+			return nil, fmt.Errorf(
+				"Template inherits more than %d templates deep",
+				maxTemplateInheritanceDepth,
+			)
+		}
+		parent, err := t.getTestRunTemplate(tpl.ParentID, tpl.ParentVersion)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"Parent template %s version %d: %v",
+				tpl.ParentID,
+				tpl.ParentVersion,
+				err,
+			)
+		}
+		chain = append(chain, parent)
+		tpl = parent
+	}
+	params := map[string]interface{}{}
+	for i := len(chain) - 1; i >= 0; i-- {
+		for k, v := range chain[i].Parameters {
+			params[k] = v
+		}
+	}
+	return params, nil
+}
+
+// TestRunFromTemplate creates a test run with the parameters of the given
+// template version (or its latest version if version is 0), overridden by
+// the given parameters keyed by their JSON name. Submitted test runs carry
+// all of their fields, so overrides that are empty (null, zero, an empty
+// string, list or object, or false) are considered not set and don't
+// override the template. The template and version used are recorded on the
+// returned test run, which is not scheduled
+func (t *TestRunManager) TestRunFromTemplate(
+	id string,
+	version int,
+	overrides map[string]interface{},
+) (*common.TestRun, error) {
+	t.templatesLock.Lock()
+	tpl, err := t.getTestRunTemplate(id, version)
+	if err != nil {
+		t.templatesLock.Unlock()
+		return nil, err
+	}
+	params, err := t.resolveTestRunTemplate(tpl)
+	t.templatesLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range overrides {
+		if !emptyParameter(v) {
+			params[k] = v
+		}
+	}
+	b, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	tr := &common.TestRun{}
+	err = json.Unmarshal(b, tr)
+	if err != nil {
+		return nil, err
+	}
+	tr.TemplateID = tpl.ID
+	tr.TemplateVersion = tpl.Version
+	return tr, nil
+}
+
+// emptyParameter returns true if the JSON decoded parameter value is the
+// empty value of its type
+func emptyParameter(v interface{}) bool {
+	switch val := v.(type) {
+	case nil:
+		return true
+	case bool:
+		return !val
+	case float64:
+		return val == 0
+	case string:
+		return val == ""
+	case []interface{}:
+		return len(val) == 0
+	case map[string]interface{}:
+		return len(val) == 0
+	}
+	return false
+}
@@ -1,7 +1,6 @@
 package testruns
 
 import (
-	"fmt"
 	"time"
 
 	"github.com/mit-dci/opencbdc-tctl/common"
@@ -44,8 +43,14 @@ func (t *TestRunManager) TerminateIfNeeded(
 				// way
 				logging.Warnf("Error terminating commands: %v", err)
 			}
+		}
 
-			time.Sleep(5 * time.Second)
+		// Aborted runs are the most likely to leave processes behind, so the
+		// agents that outlive the test run are cleaned regardless of the
+		// settings of the test run. What can't be cleaned is recorded on the
+		// reconciliation list
+		if envs != nil {
+			t.verifyCleanup(tr, envs, true)
 		}
 
 		// Upon manual termination, need to kill AWS agents
@@ -76,20 +81,12 @@ func (t *TestRunManager) TerminateIfNeeded(
 	if failures != nil {
 		select {
 		case fail := <-failures:
+			// HandleCommandFailure fails the test run with the reason of
+			// the failure
 			err := t.HandleCommandFailure(tr, allCmds, envs, fail)
 			if err != nil {
 				logging.Errorf("Error handling command failure: %v", err)
 			}
-			t.FailTestRun(
-				tr,
-				fmt.Errorf(
-					"command %s [%s] on agent %d failed with exit code %d",
-					fail.CommandID,
-					fail.Description,
-					fail.AgentID,
-					fail.ExitCode,
-				),
-			)
 			return true
 		default:
 		}
@@ -1,6 +1,7 @@
 package testruns
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
@@ -39,16 +40,24 @@ func (t *TestRunManager) ResultCalculator() {
 		tr := job.calculateForRun
 		logging.Debugf("Calculating test run %s results", tr.ID)
 
-		// The result calculation script is expected to be placed next to
-		// the main coordinator assembly
-		exeDir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+		// Keep the provenance of the current result (if any) such that it
+		// can be preserved in the history of the recalculated result
+		var previous *common.TestResultProvenance
+		if tr.Result != nil {
+			previous = tr.Result.Provenance
+			err := archiveTestResult(tr)
+			if err != nil {
+				logging.Warnf("Unable to archive result of %s: %v", tr.ID, err)
+			}
+		}
+
+		calcScript, err := resultCalculationScript()
 		if err != nil {
 			if job.responseChan != nil {
 				job.responseChan <- err
 			}
 			continue
 		}
-		calcScript := filepath.Join(exeDir, "calculate_results.py")
 
 		// Create the `plots` subdirectory of the testrun folder where the
 		// time series, latency distribution and throughput distribution plots
@@ -92,6 +101,21 @@ func (t *TestRunManager) ResultCalculator() {
 			cmd.Env,
 			fmt.Sprintf("TRIM_ZEROES_END=%d", trimZeroesEnd),
 		)
+		// The periods the load generators were paused are excluded from
+		// the throughput
+		cmd.Env = append(
+			cmd.Env,
+			fmt.Sprintf("PAUSES=%s", pausesEnv(tr)),
+		)
+		// The script finds the sample files by the prefixes of the
+		// manifest of the architecture, or the built-in ones
+		parsers, err := json.Marshal(t.metricsParsers(tr))
+		if err == nil {
+			cmd.Env = append(
+				cmd.Env,
+				fmt.Sprintf("SAMPLE_FILES=%s", parsers),
+			)
+		}
 		cmd.Dir = testRunDir
 
 		// Execute the calculation script
@@ -124,6 +148,63 @@ func (t *TestRunManager) ResultCalculator() {
 				tr.Result,
 			)
 		} else {
+			tr.Result.Pauses = tr.Pauses
+
+			// Determine the recovery times of failover test runs from the
+			// system throughput around the failovers
+			tr.Result.Failover, err = t.failoverResult(tr)
+			if err != nil {
+				logging.Warnf(
+					"Unable to calculate failover recovery for %s: %v",
+					tr.ID,
+					err,
+				)
+			}
+
+			// Determine the throughput around the injected faults
+			tr.Result.Faults, err = t.faultImpacts(tr)
+			if err != nil {
+				logging.Warnf(
+					"Unable to calculate fault impact for %s: %v",
+					tr.ID,
+					err,
+				)
+			}
+
+			// Correlate the queue metrics reported by the system under test
+			// with the dips in the system throughput
+			if t.FeatureEnabled(tr, FeatureQueueCorrelation) {
+				tr.Result.Queues, err = t.queueResult(tr)
+				if err != nil {
+					logging.Warnf(
+						"Unable to calculate queue metrics for %s: %v",
+						tr.ID,
+						err,
+					)
+				}
+			}
+
+			// Break down the transaction latency by the region of the load
+			// generators of test runs spanning multiple regions
+			tr.Result.Regions, err = t.regionResult(tr)
+			if err != nil {
+				logging.Warnf(
+					"Unable to calculate region latencies for %s: %v",
+					tr.ID,
+					err,
+				)
+			}
+
+			// Watermark the result with the versions that produced it
+			err = t.stampResultProvenance(tr, previous, calcScript)
+			if err != nil {
+				logging.Warnf(
+					"Unable to record result provenance for %s: %v",
+					tr.ID,
+					err,
+				)
+			}
+
 			// Notify the real time channel that the result is available - this
 			// will trigger the frontend to show the results
 			t.ev <- coordinator.Event{
@@ -17,6 +17,11 @@ import (
 // recalculation
 // on startup of the coordinator
 const TestResultVersion = 2
+
+// Increase this if the derived metrics calculated by the results pipeline
+// change without changing the results schema. Results calculated by an older
+// pipeline version are considered outdated and can be re-processed
+const ResultPipelineVersion = 2
 const PerformanceDataVersion = 4
 
 type TestRunManager struct {
@@ -31,8 +36,72 @@ type TestRunManager struct {
 	testRunResultsLock    sync.Mutex
 	loadComplete          bool
 	config                *TestManagerConfig
+	configLock            sync.Mutex
 	resultCalculationChan chan resultCalculation
 	pendingBinaryUploads  sync.Map
+	reprocessJobs         []*ReprocessJob
+	reprocessJobsLock     sync.Mutex
+	lifecycleHooks        []LifecycleHook
+	lifecycleHooksLock    sync.Mutex
+	timeSeriesLock        sync.Mutex
+	summarizers           []Summarizer
+	summarizersLock       sync.Mutex
+	shadowSnapshots       []*DeploymentSnapshot
+	shadowSnapshotsLock   sync.Mutex
+	dashboards            []*Dashboard
+	dashboardsLock        sync.Mutex
+	templates             []*TestRunTemplate
+	templatesLock         sync.Mutex
+	nightly               nightlyState
+	weeklyReports         weeklyReportState
+	runCredentials        sync.Map
+	runCredentialsLock    sync.Mutex
+	runningCommands       sync.Map
+	pausesLock            sync.Mutex
+	preemptionsLock       sync.Mutex
+	failureSteps          sync.Map
+	runOutcomes           []RunOutcome
+	runOutcomesLoaded     bool
+	runOutcomesLock       sync.Mutex
+	sweepBudgets          map[string]*SweepBudgetState
+	sweepBudgetsLock      sync.Mutex
+	recurring             []*RecurringSchedule
+	recurringLock         sync.Mutex
+	liveMetrics           sync.Map
+	manifests             []*ArchitectureManifest
+	manifestsLock         sync.Mutex
+	abortTriggerLock      sync.Mutex
+	baselines             []*ResultBaseline
+	baselinesLock         sync.Mutex
+	warmEnvironments      []*WarmEnvironment
+	warmEnvironmentsLock  sync.Mutex
+	savedSearches         []*SavedSearch
+	savedSearchesLock     sync.Mutex
+	reconciliation        []*LeakedResource
+	reconciliationLock    sync.Mutex
+	annotationsLock       sync.Mutex
+	agentBinaries         []*AgentBinary
+	agentBinariesLock     sync.Mutex
+	agentRollouts         []*AgentRollout
+	agentRolloutsLock     sync.Mutex
+	agentHealthLock       sync.Mutex
+	// The binaries archives uploaded to S3, by their path in the bucket
+	distributedBinaries     map[string]*DistributedBinaries
+	distributedBinariesLock sync.Mutex
+	// The subscriptions of users to the logs of roles, and the agents that
+	// were asked to stream their output for them
+	roleLogSubscriptions     map[*coordinator.RoleLogFilter]bool
+	roleLogAgents            map[int32]bool
+	roleLogSubscriptionsLock sync.Mutex
+	roleLogRefreshLock       sync.Mutex
+	// The roles the commands of the running test runs were started for, by
+	// hex encoded command ID
+	roleCommands sync.Map
+	// The locks that serialize continuing concurrent sweeps, by sweep ID
+	sweepLocks sync.Map
+	// The locks that serialize pausing and resuming test runs, by test run
+	// ID
+	pauseLocks sync.Map
 }
 
 func NewTestRunManager(
@@ -59,13 +128,94 @@ func NewTestRunManager(
 		awsm:                 awsm,
 		commitHash:           commitHash,
 		pendingBinaryUploads: sync.Map{},
+		reprocessJobs:        []*ReprocessJob{},
+		reprocessJobsLock:    sync.Mutex{},
+		lifecycleHooks:       []LifecycleHook{},
+		lifecycleHooksLock:   sync.Mutex{},
+		timeSeriesLock:       sync.Mutex{},
+		summarizers:          []Summarizer{},
+		summarizersLock:      sync.Mutex{},
+		shadowSnapshots:      []*DeploymentSnapshot{},
+		shadowSnapshotsLock:  sync.Mutex{},
+		dashboards:           []*Dashboard{},
+		dashboardsLock:       sync.Mutex{},
+		templates:            []*TestRunTemplate{},
+		templatesLock:        sync.Mutex{},
+		sweepBudgets:         map[string]*SweepBudgetState{},
+		recurring:            []*RecurringSchedule{},
+		baselines:            []*ResultBaseline{},
+		warmEnvironments:     []*WarmEnvironment{},
+		savedSearches:        []*SavedSearch{},
+		reconciliation:       []*LeakedResource{},
+		agentBinaries:        []*AgentBinary{},
+		agentRollouts:        []*AgentRollout{},
+		distributedBinaries:  map[string]*DistributedBinaries{},
+		roleLogSubscriptions: map[*coordinator.RoleLogFilter]bool{},
+		roleLogAgents:        map[int32]bool{},
 	}
+	tr.registerLifecycleHooksFromEnv()
+	tr.registerSummarizersFromEnv()
+	tr.registerGitHubReporterFromEnv()
+	src.SetArtifactUsageFunc(tr.commitsInUse)
+	c.SetAgentHealthFunc(tr.recordAgentHealth)
+	c.SetAgentLogLinesFunc(tr.publishRoleLogLines)
 	err := tr.LoadConfig()
 	if err != nil {
 		return nil, err
 	}
+	err = tr.loadDeploymentSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	err = tr.loadDashboards()
+	if err != nil {
+		return nil, err
+	}
+	err = tr.loadBaselines()
+	if err != nil {
+		return nil, err
+	}
+	err = tr.loadSavedSearches()
+	if err != nil {
+		return nil, err
+	}
+	err = tr.loadReconciliation()
+	if err != nil {
+		return nil, err
+	}
+	err = tr.loadTestRunTemplates()
+	if err != nil {
+		return nil, err
+	}
+	err = tr.loadSweepBudgets()
+	if err != nil {
+		return nil, err
+	}
+	err = tr.loadRecurringSchedules()
+	if err != nil {
+		return nil, err
+	}
+	err = tr.loadAgentBinaries()
+	if err != nil {
+		return nil, err
+	}
+	err = tr.loadDistributedBinaries()
+	if err != nil {
+		return nil, err
+	}
+	// Invalid manifests are logged and skipped, such that they don't keep
+	// the coordinator from starting
+	tr.LoadArchitectureManifests()
 
 	go tr.Scheduler()
+	go tr.CapacityPlanner()
+	go tr.NightlyPipeline()
+	go tr.WeeklyReportPipeline()
+	go tr.agentSnapshotExpiryLoop()
+	go tr.SweepBudgetMonitor()
+	go tr.RecurringScheduler()
+	go tr.ReconciliationSweeper()
+	go tr.roleLogStreamLoop()
 
 	for i := 0; i < ParallelResultCalculation; i++ {
 		go tr.ResultCalculator()
@@ -0,0 +1,789 @@
+package testruns
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// timeSeriesVersion is the version of the on-disk layout of the time series.
+// Series ingested with a different version are ingested again
+const timeSeriesVersion = 4
+
+// timeSeriesChunkSize is the number of values read from a column at once.
+// Reading columns in chunks keeps the memory used by downsampling constant,
+// regardless of the length of the series
+const timeSeriesChunkSize = 8192
+
+// minTxSampleTime filters out corrupt transaction samples, mirroring the
+// filter applied by the result calculation script
+const minTxSampleTime = 1609459200000
+
+// ErrTimeSeriesNotFound is returned when the requested series does not exist
+// for the test run
+var ErrTimeSeriesNotFound = errors.New("time series not found")
+
+// TimeSeriesInfo describes a time series extracted from the outputs of a test
+// run
+type TimeSeriesInfo struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	XUnit  string `json:"xUnit"`
+	YUnit  string `json:"yUnit"`
+	Points int64  `json:"points"`
+	// IDs of the series this series is meant to be plotted against
+	Overlay []string `json:"overlay,omitempty"`
+	// Number of points of the series at each of the precomputed aggregation
+	// levels. Empty if the X values are not times
+	Levels map[string]int64 `json:"levels,omitempty"`
+}
+
+// TimeSeriesData contains the (possibly downsampled) points of a time series
+type TimeSeriesData struct {
+	TimeSeriesInfo
+	Level       string    `json:"level,omitempty"`
+	Downsampled bool      `json:"downsampled"`
+	X           []float64 `json:"x"`
+	Y           []float64 `json:"y"`
+}
+
+// timeSeriesIndex is persisted next to the columns and lists the series that
+// were ingested
+type timeSeriesIndex struct {
+	Version int              `json:"version"`
+	Series  []TimeSeriesInfo `json:"series"`
+}
+
+// timeSeriesDir returns the folder the columnar time series of a test run are
+// stored in. Every series consists of two files containing the X and Y values
+// as consecutive little-endian float64s, such that any range of points can be
+// read without parsing the preceding ones
+func timeSeriesDir(tr *common.TestRun) string {
+	return filepath.Join(
+		common.DataDir(),
+		fmt.Sprintf("testruns/%s/series", tr.ID),
+	)
+}
+
+// timeSeriesColumnPath returns the path of the given column (x or y) of the
+// series with the given ID
+func timeSeriesColumnPath(dir, id, column string) string {
+	return filepath.Join(dir, fmt.Sprintf("%s.%s.col", id, column))
+}
+
+// timeSeriesColumnWriter appends values to a column file
+type timeSeriesColumnWriter struct {
+	f   *os.File
+	w   *bufio.Writer
+	buf [8]byte
+}
+
+func createTimeSeriesColumn(path string) (*timeSeriesColumnWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &timeSeriesColumnWriter{f: f, w: bufio.NewWriterSize(f, 1<<20)}, nil
+}
+
+func (c *timeSeriesColumnWriter) write(v float64) error {
+	binary.LittleEndian.PutUint64(c.buf[:], math.Float64bits(v))
+	_, err := c.w.Write(c.buf[:])
+	return err
+}
+
+func (c *timeSeriesColumnWriter) close() error {
+	err := c.w.Flush()
+	if err2 := c.f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// timeSeriesWriter writes the X and Y columns of a single series, and those of
+// its aggregation levels
+type timeSeriesWriter struct {
+	info   TimeSeriesInfo
+	dir    string
+	x      *timeSeriesColumnWriter
+	y      *timeSeriesColumnWriter
+	levels []*timeSeriesAggregator
+}
+
+// createTimeSeries creates the columns for a series in dir. When aggregate is
+// set, the X values are times in seconds and the series is also aggregated at
+// the timeSeriesLevels
+func createTimeSeries(
+	dir string,
+	info TimeSeriesInfo,
+	aggregate bool,
+) (*timeSeriesWriter, error) {
+	x, err := createTimeSeriesColumn(timeSeriesColumnPath(dir, info.ID, "x"))
+	if err != nil {
+		return nil, err
+	}
+	y, err := createTimeSeriesColumn(timeSeriesColumnPath(dir, info.ID, "y"))
+	if err != nil {
+		x.close()
+		return nil, err
+	}
+	s := &timeSeriesWriter{info: info, dir: dir, x: x, y: y}
+	if aggregate {
+		for _, l := range timeSeriesLevels {
+			s.levels = append(s.levels, newTimeSeriesAggregator(l))
+		}
+	}
+	return s, nil
+}
+
+func (s *timeSeriesWriter) add(x, y float64) error {
+	err := s.x.write(x)
+	if err != nil {
+		return err
+	}
+	s.info.Points++
+	for _, l := range s.levels {
+		l.add(x, y)
+	}
+	return s.y.write(y)
+}
+
+func (s *timeSeriesWriter) close() error {
+	err := s.x.close()
+	if err2 := s.y.close(); err == nil {
+		err = err2
+	}
+	if err != nil || len(s.levels) == 0 {
+		return err
+	}
+	s.info.Levels = map[string]int64{}
+	for _, l := range s.levels {
+		s.info.Levels[l.level.Name], err = l.write(s.dir, s.info.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// timeSeriesColumn reads the values of a column file in chunks
+type timeSeriesColumn struct {
+	f   *os.File
+	len int64
+	buf []byte
+}
+
+func openTimeSeriesColumn(path string) (*timeSeriesColumn, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &timeSeriesColumn{
+		f:   f,
+		len: fi.Size() / 8,
+		buf: make([]byte, timeSeriesChunkSize*8),
+	}, nil
+}
+
+// readChunk reads up to timeSeriesChunkSize values starting at index from
+// into vals, and returns the number of values read
+func (c *timeSeriesColumn) readChunk(from int64, vals []float64) (int, error) {
+	n := int64(len(vals))
+	if from+n > c.len {
+		n = c.len - from
+	}
+	if n <= 0 {
+		return 0, nil
+	}
+	b := c.buf[:n*8]
+	_, err := c.f.ReadAt(b, from*8)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	for i := int64(0); i < n; i++ {
+		vals[i] = math.Float64frombits(binary.LittleEndian.Uint64(b[i*8:]))
+	}
+	return int(n), nil
+}
+
+func (c *timeSeriesColumn) close() {
+	c.f.Close()
+}
+
+// timeSeriesReader reads the points of a series from its X and Y columns
+type timeSeriesReader struct {
+	x, y   *timeSeriesColumn
+	xs, ys []float64
+}
+
+func openTimeSeries(dir, id string) (*timeSeriesReader, error) {
+	x, err := openTimeSeriesColumn(timeSeriesColumnPath(dir, id, "x"))
+	if err != nil {
+		return nil, err
+	}
+	y, err := openTimeSeriesColumn(timeSeriesColumnPath(dir, id, "y"))
+	if err != nil {
+		x.close()
+		return nil, err
+	}
+	if x.len != y.len {
+		x.close()
+		y.close()
+		return nil, fmt.Errorf("columns of series %s differ in length", id)
+	}
+	return &timeSeriesReader{
+		x:  x,
+		y:  y,
+		xs: make([]float64, timeSeriesChunkSize),
+		ys: make([]float64, timeSeriesChunkSize),
+	}, nil
+}
+
+func (r *timeSeriesReader) len() int64 {
+	return r.x.len
+}
+
+// scan calls f for every point in the range [from, to)
+func (r *timeSeriesReader) scan(from, to int64, f func(x, y float64)) error {
+	for from < to {
+		n := int64(timeSeriesChunkSize)
+		if to-from < n {
+			n = to - from
+		}
+		nx, err := r.x.readChunk(from, r.xs[:n])
+		if err != nil {
+			return err
+		}
+		ny, err := r.y.readChunk(from, r.ys[:n])
+		if err != nil {
+			return err
+		}
+		if nx == 0 || nx != ny {
+			return fmt.Errorf("unexpected end of series at point %d", from)
+		}
+		for i := 0; i < nx; i++ {
+			f(r.xs[i], r.ys[i])
+		}
+		from += int64(nx)
+	}
+	return nil
+}
+
+func (r *timeSeriesReader) close() {
+	r.x.close()
+	r.y.close()
+}
+
+// downsampleLTTB reduces the series to the given number of points using the
+// Largest-Triangle-Three-Buckets algorithm, which preserves the visual shape
+// of the series (including its peaks) much better than averaging or taking
+// every n-th point. The series is streamed from disk bucket by bucket, so
+// only the selected points are kept in memory
+func downsampleLTTB(
+	r *timeSeriesReader,
+	threshold int,
+) ([]float64, []float64, error) {
+	n := r.len()
+	if threshold >= int(n) || threshold < 3 {
+		xs := make([]float64, 0, n)
+		ys := make([]float64, 0, n)
+		err := r.scan(0, n, func(x, y float64) {
+			xs = append(xs, x)
+			ys = append(ys, y)
+		})
+		return xs, ys, err
+	}
+
+	xs := make([]float64, 0, threshold)
+	ys := make([]float64, 0, threshold)
+	var ax, ay float64
+	err := r.scan(0, 1, func(x, y float64) {
+		ax, ay = x, y
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	xs = append(xs, ax)
+	ys = append(ys, ay)
+
+	// The first and last points are always kept, the points in between are
+	// divided into threshold-2 buckets
+	every := float64(n-2) / float64(threshold-2)
+	bucketStart := func(i int) int64 {
+		s := int64(math.Floor(float64(i)*every)) + 1
+		if s > n-1 {
+			s = n - 1
+		}
+		return s
+	}
+	for i := 0; i < threshold-2; i++ {
+		// Average of the next bucket, which is the last point for the last
+		// bucket
+		nextStart, nextEnd := bucketStart(i+1), bucketStart(i+2)
+		if i == threshold-3 {
+			nextStart, nextEnd = n-1, n
+		}
+		var avgX, avgY float64
+		err = r.scan(nextStart, nextEnd, func(x, y float64) {
+			avgX += x
+			avgY += y
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		if cnt := float64(nextEnd - nextStart); cnt > 0 {
+			avgX /= cnt
+			avgY /= cnt
+		}
+
+		// Select the point in the current bucket forming the largest
+		// triangle with the previously selected point and the average of the
+		// next bucket
+		maxArea := -1.0
+		var selX, selY float64
+		err = r.scan(bucketStart(i), bucketStart(i+1), func(x, y float64) {
+			area := math.Abs((ax-avgX)*(y-ay)-(ax-x)*(avgY-ay)) * 0.5
+			if area > maxArea {
+				maxArea = area
+				selX, selY = x, y
+			}
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		if maxArea < 0 {
+			continue
+		}
+		xs = append(xs, selX)
+		ys = append(ys, selY)
+		ax, ay = selX, selY
+	}
+
+	err = r.scan(n-1, n, func(x, y float64) {
+		xs = append(xs, x)
+		ys = append(ys, y)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return xs, ys, nil
+}
+
+// parseSampleLine splits a line of an output file into its numeric fields,
+// returning false if any of them is malformed
+func parseSampleLine(line string, fields []float64) bool {
+	parts := strings.Fields(line)
+	if len(parts) < len(fields) {
+		return false
+	}
+	for i := range fields {
+		v, err := strconv.ParseFloat(parts[i], 64)
+		if err != nil {
+			return false
+		}
+		fields[i] = v
+	}
+	return true
+}
+
+// readSampleFile reads an output file line by line and calls f with the
+// numeric fields of every well-formed line
+func readSampleFile(path string, numFields int, f func([]float64) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fields := make([]float64, numFields)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if !parseSampleLine(scanner.Text(), fields) {
+			continue
+		}
+		err = f(fields)
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// ingestTimeSeries converts the sample files in the outputs of the test run
+// into the columnar layout. The sample files are streamed, so no more than one
+// line of them is held in memory, except for the per-second transaction
+// counts needed for the system throughput
+func (t *TestRunManager) ingestTimeSeries(
+	tr *common.TestRun,
+) (*timeSeriesIndex, error) {
+	outputsDir := filepath.Join(
+		common.DataDir(),
+		fmt.Sprintf("testruns/%s/outputs", tr.ID),
+	)
+	entries, err := ioutil.ReadDir(outputsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := timeSeriesDir(tr)
+	tmpDir := dir + ".tmp"
+	err = os.RemoveAll(tmpDir)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(tmpDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	idx := &timeSeriesIndex{Version: timeSeriesVersion}
+	txPerSecond := map[int64]float64{}
+	blockInterval := float64(tr.TargetBlockInterval) / 1000
+	if blockInterval <= 0 {
+		blockInterval = 1
+	}
+	parsers := t.metricsParsers(tr)
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".txt") {
+			continue
+		}
+		path := filepath.Join(outputsDir, e.Name())
+		base := strings.TrimSuffix(e.Name(), ".txt")
+
+		// Most sample files are ingested as a single series, files with
+		// several metrics per line as one series per metric
+		var infos []TimeSeriesInfo
+		var numFields int
+		aggregate := true
+		var add func(s []*timeSeriesWriter, i int64, fields []float64) error
+		switch sampleFileFormat(parsers, base) {
+		case SampleFormatTx:
+			// Each line is `<unix timestamp in nanoseconds> <latency in
+			// nanoseconds>` for a completed transaction
+			infos = []TimeSeriesInfo{{
+				ID:    "latency-" + base,
+				Name:  fmt.Sprintf("Transaction latency (%s)", base),
+				XUnit: "unix time (s)",
+				YUnit: "s",
+			}}
+			numFields = 2
+			add = func(s []*timeSeriesWriter, _ int64, fields []float64) error {
+				if fields[0] <= minTxSampleTime {
+					return nil
+				}
+				txPerSecond[int64(fields[0]/1e9)]++
+				return s[0].add(fields[0]/1e9, fields[1]/1e9)
+			}
+		case SampleFormatBlockThroughput:
+			// Each line is the number of transactions completed in a block
+			infos = []TimeSeriesInfo{{
+				ID:    "throughput-" + base,
+				Name:  fmt.Sprintf("Throughput per block (%s)", base),
+				XUnit: "s",
+				YUnit: "tx/s",
+			}}
+			numFields = 1
+			add = func(s []*timeSeriesWriter, i int64, fields []float64) error {
+				return s[0].add(
+					float64(i)*blockInterval,
+					fields[0]/blockInterval,
+				)
+			}
+		case SampleFormatLatency:
+			// Each line is the latency of a transaction in nanoseconds
+			infos = []TimeSeriesInfo{{
+				ID:    "latency-" + base,
+				Name:  fmt.Sprintf("Transaction latency (%s)", base),
+				XUnit: "sample",
+				YUnit: "s",
+			}}
+			numFields = 1
+			aggregate = false
+			add = func(s []*timeSeriesWriter, i int64, fields []float64) error {
+				return s[0].add(float64(i), fields[0]/1e9)
+			}
+		case SampleFormatQueue:
+			// Each line is `<unix timestamp in nanoseconds> <queue depth>
+			// <nanoseconds blocked since the previous sample>`. Both are
+			// plotted against the system throughput and its dips
+			overlay := []string{"throughput", "throughput-dips"}
+			infos = []TimeSeriesInfo{{
+				ID:      "queue-depth-" + base,
+				Name:    fmt.Sprintf("Queue depth (%s)", base),
+				XUnit:   "unix time (s)",
+				YUnit:   "items",
+				Overlay: overlay,
+			}, {
+				ID:      "queue-blocked-" + base,
+				Name:    fmt.Sprintf("Time blocked on queue (%s)", base),
+				XUnit:   "unix time (s)",
+				YUnit:   "s",
+				Overlay: overlay,
+			}}
+			numFields = 3
+			add = func(s []*timeSeriesWriter, _ int64, fields []float64) error {
+				if fields[0] <= minTxSampleTime {
+					return nil
+				}
+				err := s[0].add(fields[0]/1e9, fields[1])
+				if err != nil {
+					return err
+				}
+				return s[1].add(fields[0]/1e9, fields[2]/1e9)
+			}
+		default:
+			continue
+		}
+
+		series := make([]*timeSeriesWriter, 0, len(infos))
+		for _, info := range infos {
+			s, err := createTimeSeries(tmpDir, info, aggregate)
+			if err != nil {
+				for _, s := range series {
+					s.close()
+				}
+				return nil, err
+			}
+			series = append(series, s)
+		}
+		i := int64(0)
+		err = readSampleFile(path, numFields, func(fields []float64) error {
+			err := add(series, i, fields)
+			i++
+			return err
+		})
+		for _, s := range series {
+			if err2 := s.close(); err == nil {
+				err = err2
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error ingesting %s: %v", e.Name(), err)
+		}
+		for _, s := range series {
+			idx.Series = append(idx.Series, s.info)
+		}
+	}
+
+	// The system throughput is the number of transactions completed by all
+	// load generators per second, with the seconds without any completed
+	// transaction included as zero
+	if len(txPerSecond) > 0 {
+		seconds := make([]int64, 0, len(txPerSecond))
+		for sec := range txPerSecond {
+			seconds = append(seconds, sec)
+		}
+		sort.Slice(seconds, func(i, j int) bool {
+			return seconds[i] < seconds[j]
+		})
+		s, err := createTimeSeries(tmpDir, TimeSeriesInfo{
+			ID:    "throughput",
+			Name:  "System throughput",
+			XUnit: "unix time (s)",
+			YUnit: "tx/s",
+		}, true)
+		if err != nil {
+			return nil, err
+		}
+		for sec := seconds[0]; sec <= seconds[len(seconds)-1] && err == nil; sec++ {
+			err = s.add(float64(sec), txPerSecond[sec])
+		}
+		if err2 := s.close(); err == nil {
+			err = err2
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// The dips mark the seconds in which the system throughput fell
+		// below throughputDipPercent of its median, such that they can be
+		// correlated with the other series
+		first, last := seconds[0], seconds[len(seconds)-1]
+		dips, _ := throughputDips(txPerSecond, first, last)
+		d, err := createTimeSeries(tmpDir, TimeSeriesInfo{
+			ID:    "throughput-dips",
+			Name:  "System throughput dips",
+			XUnit: "unix time (s)",
+			YUnit: "dip",
+		}, true)
+		if err != nil {
+			return nil, err
+		}
+		for sec := first; sec <= last && err == nil; sec++ {
+			dip := 0.0
+			if dips[sec] {
+				dip = 1
+			}
+			err = d.add(float64(sec), dip)
+		}
+		if err2 := d.close(); err == nil {
+			err = err2
+		}
+		if err != nil {
+			return nil, err
+		}
+		idx.Series = append([]TimeSeriesInfo{s.info, d.info}, idx.Series...)
+	}
+	err = t.writeLoadProfileSeries(tr, tmpDir, idx)
+	if err != nil {
+		return nil, err
+	}
+	err = t.writeAgentHealthSeries(tr, tmpDir, idx)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := json.Marshal(idx)
+	if err != nil {
+		return nil, err
+	}
+	err = ioutil.WriteFile(filepath.Join(tmpDir, "index.json"), b, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = os.RemoveAll(dir)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Rename(tmpDir, dir)
+	if err != nil {
+		return nil, err
+	}
+	logging.Infof(
+		"Ingested %d time series for test run %s",
+		len(idx.Series),
+		tr.ID,
+	)
+	return idx, nil
+}
+
+// timeSeriesIndexFor returns the index of the time series of the test run,
+// ingesting them from the outputs first if that hasn't happened yet
+func (t *TestRunManager) timeSeriesIndexFor(
+	tr *common.TestRun,
+) (*timeSeriesIndex, error) {
+	t.timeSeriesLock.Lock()
+	defer t.timeSeriesLock.Unlock()
+
+	b, err := ioutil.ReadFile(filepath.Join(timeSeriesDir(tr), "index.json"))
+	if err == nil {
+		idx := &timeSeriesIndex{}
+		err = json.Unmarshal(b, idx)
+		if err == nil && idx.Version == timeSeriesVersion {
+			return idx, nil
+		}
+	}
+
+	if tr.Status != common.TestRunStatusCompleted {
+		return nil, fmt.Errorf("test run %s has not completed", tr.ID)
+	}
+	return t.ingestTimeSeries(tr)
+}
+
+// InvalidateTimeSeries removes the ingested time series of the test run, such
+// that they are ingested again from the outputs the next time they are
+// requested
+func (t *TestRunManager) InvalidateTimeSeries(tr *common.TestRun) error {
+	t.timeSeriesLock.Lock()
+	defer t.timeSeriesLock.Unlock()
+	return os.RemoveAll(timeSeriesDir(tr))
+}
+
+// TimeSeries returns the time series available for the test run
+func (t *TestRunManager) TimeSeries(
+	tr *common.TestRun,
+) ([]TimeSeriesInfo, error) {
+	idx, err := t.timeSeriesIndexFor(tr)
+	if err != nil {
+		return nil, err
+	}
+	if idx.Series == nil {
+		return []TimeSeriesInfo{}, nil
+	}
+	return idx.Series, nil
+}
+
+// TimeSeriesData returns the points of the series with the given ID,
+// downsampled to at most maxPoints points. A maxPoints of zero returns all
+// points. If level is set to the name of one of the precomputed aggregation
+// levels (1s, 10s or 1m), the series aggregated at that level is read instead
+// of the raw series, and downsampled further if it exceeds maxPoints
+func (t *TestRunManager) TimeSeriesData(
+	tr *common.TestRun,
+	id string,
+	level string,
+	maxPoints int,
+) (*TimeSeriesData, error) {
+	idx, err := t.timeSeriesIndexFor(tr)
+	if err != nil {
+		return nil, err
+	}
+	var info *TimeSeriesInfo
+	for i := range idx.Series {
+		if idx.Series[i].ID == id {
+			info = &idx.Series[i]
+			break
+		}
+	}
+	if info == nil {
+		return nil, ErrTimeSeriesNotFound
+	}
+
+	columnsID := id
+	if level != "" {
+		l, err := findTimeSeriesLevel(level)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := info.Levels[l.Name]; !ok {
+			return nil, fmt.Errorf(
+				"Series %s cannot be aggregated over time",
+				id,
+			)
+		}
+		columnsID = timeSeriesLevelID(id, l)
+	}
+
+	r, err := openTimeSeries(timeSeriesDir(tr), columnsID)
+	if err != nil {
+		return nil, err
+	}
+	defer r.close()
+
+	threshold := int(r.len())
+	if maxPoints > 0 && maxPoints < threshold {
+		threshold = maxPoints
+		if threshold < 3 {
+			threshold = 3
+		}
+	}
+	xs, ys, err := downsampleLTTB(r, threshold)
+	if err != nil {
+		return nil, err
+	}
+	return &TimeSeriesData{
+		TimeSeriesInfo: *info,
+		Level:          level,
+		Downsampled:    level != "" || int64(len(xs)) < r.len(),
+		X:              xs,
+		Y:              ys,
+	}, nil
+}
@@ -0,0 +1,108 @@
+package testruns
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// timeSeriesLevel is a precomputed aggregation of a time series into buckets
+// of a fixed duration
+type timeSeriesLevel struct {
+	Name    string
+	Seconds float64
+}
+
+// timeSeriesLevels are the aggregation levels computed when the time series
+// are ingested. Requesting a series at one of these levels only reads the
+// (much smaller) aggregated columns, which makes loading many runs at once -
+// for instance to compare the runs of a sweep - cheap
+var timeSeriesLevels = []timeSeriesLevel{
+	{Name: "1s", Seconds: 1},
+	{Name: "10s", Seconds: 10},
+	{Name: "1m", Seconds: 60},
+}
+
+// findTimeSeriesLevel returns the aggregation level with the given name
+func findTimeSeriesLevel(name string) (timeSeriesLevel, error) {
+	for _, l := range timeSeriesLevels {
+		if l.Name == name {
+			return l, nil
+		}
+	}
+	return timeSeriesLevel{}, fmt.Errorf(
+		"Unsupported downsampling level %s",
+		name,
+	)
+}
+
+// timeSeriesLevelID returns the ID the columns of the series aggregated at
+// the given level are stored under
+func timeSeriesLevelID(id string, level timeSeriesLevel) string {
+	return fmt.Sprintf("%s@%s", id, level.Name)
+}
+
+type timeSeriesBucket struct {
+	sum   float64
+	count int64
+}
+
+// timeSeriesAggregator averages the points of a series per bucket of the
+// level's duration. Only the buckets are kept in memory, of which even a run
+// lasting many hours has no more than a few tens of thousands at the finest
+// level. The points don't have to be sorted by time, since the transaction
+// samples of a load generator are only roughly ordered
+type timeSeriesAggregator struct {
+	level   timeSeriesLevel
+	buckets map[int64]*timeSeriesBucket
+}
+
+func newTimeSeriesAggregator(level timeSeriesLevel) *timeSeriesAggregator {
+	return &timeSeriesAggregator{
+		level:   level,
+		buckets: map[int64]*timeSeriesBucket{},
+	}
+}
+
+func (a *timeSeriesAggregator) add(x, y float64) {
+	k := int64(math.Floor(x / a.level.Seconds))
+	b, ok := a.buckets[k]
+	if !ok {
+		b = &timeSeriesBucket{}
+		a.buckets[k] = b
+	}
+	b.sum += y
+	b.count++
+}
+
+// write stores the mean of every bucket as a series in dir, with the start of
+// the bucket as X value, and returns the number of points written
+func (a *timeSeriesAggregator) write(dir, id string) (int64, error) {
+	keys := make([]int64, 0, len(a.buckets))
+	for k := range a.buckets {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i] < keys[j]
+	})
+
+	s, err := createTimeSeries(
+		dir,
+		TimeSeriesInfo{ID: timeSeriesLevelID(id, a.level)},
+		false,
+	)
+	if err != nil {
+		return 0, err
+	}
+	for _, k := range keys {
+		b := a.buckets[k]
+		err = s.add(float64(k)*a.level.Seconds, b.sum/float64(b.count))
+		if err != nil {
+			break
+		}
+	}
+	if err2 := s.close(); err == nil {
+		err = err2
+	}
+	return s.info.Points, err
+}
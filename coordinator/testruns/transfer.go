@@ -37,11 +37,15 @@ var copyFiles = map[common.SystemRole][]string{
 		"latency_samples_%IDX%.txt%%OPT",
 		"tx_samples_%IDX%.txt%%OPT",
 		"telemetry.bin%%OPT",
+		"tx_trace_%IDX%.txt%%OPT",
+	},
+	common.SystemRoleSentinel: {
+		"tx_trace_%IDX%.txt%%OPT",
 	},
-	common.SystemRoleSentinel: {},
 	common.SystemRoleShard: {
 		"tp_samples.txt%%OPT",
 		"block_log.txt%%OPT",
+		"tx_trace_%IDX%.txt%%OPT",
 	},
 	common.SystemRoleCoordinator: {
 		"telemetry.bin%%OPT",
@@ -52,30 +56,55 @@ var copyFiles = map[common.SystemRole][]string{
 	},
 	common.SystemRoleShardTwoPhase: {
 		"telemetry.bin%%OPT",
+		"tx_trace_%IDX%.txt%%OPT",
 	},
 	common.SystemRoleSentinelTwoPhase: {
 		"telemetry.bin%%OPT",
+		"tx_trace_%IDX%.txt%%OPT",
 	},
 	common.SystemRoleTwoPhaseGen: {
 		"tx_samples_%IDX%.txt",
 		"tps_target_%IDX%.txt%%OPT",
 		"telemetry.bin%%OPT",
+		"tx_trace_%IDX%.txt%%OPT",
 	},
 	common.SystemRoleParsecGen: {
 		"tx_samples_%IDX%.txt",
 		"telemetry.bin%%OPT",
+		"tx_trace_%IDX%.txt%%OPT",
 	},
 	common.SystemRoleAgent: {
 		"telemetry.bin%%OPT",
 	},
 	common.SystemRoleRuntimeLockingShard: {
 		"telemetry.bin%%OPT",
+		"tx_trace_%IDX%.txt%%OPT",
 	},
 }
 
+// roleForOutputFile returns the role of the test run that the file in its
+// outputs was copied from, which CopyOutputs prefixes with the role and its
+// index, along with the rest of the file name. Returns nil if the file is not
+// from one of the roles
+func roleForOutputFile(
+	tr *common.TestRun,
+	name string,
+) (*common.TestRunRole, string) {
+	// Match the file against the roles in the test run, since role names
+	// themselves can contain dashes
+	for _, r := range tr.Roles {
+		prefix := fmt.Sprintf("%s-%d-", r.Role, r.Index)
+		if strings.HasPrefix(name, prefix) {
+			return r, strings.TrimPrefix(name, prefix)
+		}
+	}
+	return nil, ""
+}
+
 // CopyOutputs will use the `copyFiles` map to instruct the agents to upload all
 // indicated files from its file system to S3 so that the coordinator can
-// download them later
+// download them later. Test runs with DirectTransfer fetch the files from the
+// agents right away in stead
 func (t *TestRunManager) CopyOutputs(
 	tr *common.TestRun,
 	envs map[int32][]byte,
@@ -86,18 +115,22 @@ func (t *TestRunManager) CopyOutputs(
 		fmt.Sprintf("testruns/%s/outputs", tr.ID),
 	)
 
+	desc := "Uploading testrun output files from agents to S3"
+	if tr.DirectTransfer {
+		desc = "Fetching testrun output files from agents"
+	}
 	t.UpdateStatus(
 		tr,
 		common.TestRunStatusRunning,
-		"Uploading testrun output files from agents to S3 (0%)",
+		fmt.Sprintf("%s (0%%)", desc),
 	)
 
 	allDownloads := make([]common.S3Download, 0)
 	allDownloadsLock := sync.Mutex{}
 
 	f := func(role *common.TestRunRole) error {
-		if len(copyFiles[common.SystemRole(role.Role)]) > 0 {
-			for _, f := range t.SubstituteParameters(copyFiles[common.SystemRole(role.Role)], role, tr) {
+		if outputs := t.roleOutputs(tr, role.Role); len(outputs) > 0 {
+			for _, f := range t.SubstituteParameters(outputs, role, tr) {
 				// Optionally ignore failures for files that may or may not
 				// exist on the target agent
 				ignoreFile := false
@@ -106,6 +139,13 @@ func (t *TestRunManager) CopyOutputs(
 					ignoreFile = true
 				}
 
+				// Transaction traces are only needed when the test run asked
+				// for them to be correlated
+				if strings.HasPrefix(f, txTraceFilePrefix) &&
+					tr.TxTraceSamples <= 0 {
+					continue
+				}
+
 				// Calculate the target path in the outputs bucket based on the
 				// test run ID, system role, index and filename
 				targetPath := fmt.Sprintf(
@@ -115,20 +155,56 @@ func (t *TestRunManager) CopyOutputs(
 					role.Index,
 					f,
 				)
-
-				// Instruct the agent to upload the file to S3
-				msg, err := t.am.QueryAgentWithTimeout(
-					role.AgentID,
-					&wire.UploadFileToS3RequestMsg{
-						EnvironmentID: envs[role.AgentID],
-						SourcePath:    f,
-						TargetRegion:  os.Getenv("AWS_REGION"),
-						TargetBucket:  os.Getenv("OUTPUTS_S3_BUCKET"),
-						TargetPath:    targetPath,
-					},
-					3*time.Minute,
+				localPath := filepath.Join(
+					path,
+					fmt.Sprintf(
+						"%s-%d-%s",
+						string(role.Role),
+						role.Index,
+						f,
+					),
 				)
-				err = t.processS3UploadResponse(role.AgentID, msg, err)
+
+				var validationError string
+				var err error
+				if tr.DirectTransfer {
+					// Fetch the file from the agent over its connection to
+					// the coordinator
+					validationError, err = t.am.FetchFile(
+						role.AgentID,
+						envs[role.AgentID],
+						f,
+						localPath,
+						true,
+					)
+				} else {
+					// Instruct the agent to upload the file to S3
+					var msg wire.Msg
+					msg, err = t.am.QueryAgentWithTimeout(
+						role.AgentID,
+						&wire.UploadFileToS3RequestMsg{
+							EnvironmentID: envs[role.AgentID],
+							SourcePath:    f,
+							TargetRegion:  os.Getenv("AWS_REGION"),
+							TargetBucket:  os.Getenv("OUTPUTS_S3_BUCKET"),
+							TargetPath:    targetPath,
+							Validate:      true,
+						},
+						3*time.Minute,
+					)
+					err = t.processS3UploadResponse(role.AgentID, msg, err)
+					if resp, ok := msg.(*wire.UploadFileToS3ResponseMsg); ok {
+						validationError = resp.ValidationError
+					}
+				}
+				if err == nil {
+					err = t.processOutputValidation(
+						tr,
+						role,
+						f,
+						validationError,
+					)
+				}
 				if err != nil {
 					// Watchtower CLI temporarily ignored due to new tx_samples
 					// usage (optional)
@@ -143,18 +219,14 @@ func (t *TestRunManager) CopyOutputs(
 					}
 					return err
 				}
+				if tr.DirectTransfer {
+					// The file was fetched into place already
+					continue
+				}
 				// Append this uploaded file to the array of downloads
 				allDownloadsLock.Lock()
 				allDownloads = append(allDownloads, common.S3Download{
-					TargetPath: filepath.Join(
-						path,
-						fmt.Sprintf(
-							"%s-%d-%s",
-							string(role.Role),
-							role.Index,
-							f,
-						),
-					),
+					TargetPath:   localPath,
 					SourceRegion: os.Getenv("AWS_REGION"),
 					SourceBucket: os.Getenv("OUTPUTS_S3_BUCKET"),
 					SourcePath:   targetPath,
@@ -166,12 +238,7 @@ func (t *TestRunManager) CopyOutputs(
 		}
 		return nil
 	}
-	err := t.RunForAllAgents(
-		f,
-		tr,
-		"Uploading testrun output files from agents to S3",
-		time.Minute*10,
-	)
+	err := t.RunForAllAgents(f, tr, desc, time.Minute*10)
 	if err != nil {
 		return err
 	}
@@ -460,25 +527,32 @@ func (t *TestRunManager) RedownloadTestOutputsFromS3(tr *common.TestRun) error {
 		tr.ID,
 	)
 
-	return t.awsm.DownloadMultipleFromS3(downloads)
+	err := t.awsm.DownloadMultipleFromS3(downloads)
+	if err != nil {
+		return err
+	}
+
+	// The time series have to be ingested again from the fresh outputs
+	return t.InvalidateTimeSeries(tr)
 }
 
-// BinariesExistInS3 checks existence and returns an empty string
-// if not, and the path in S3 if it does.
+// BinariesExistInS3 checks existence of the binaries for the given
+// architecture and returns an empty string if not, and the path in S3 if it
+// does.
 func (t *TestRunManager) BinariesExistInS3(
 	tr *common.TestRun,
 	seeder bool,
+	arch string,
 ) (string, error) {
 	hash := tr.CommitHash
 	debug := tr.RunPerf || tr.Debug
+	cfg := tr.BuildConfig
 	if seeder {
 		hash = tr.SeederHash
 		debug = false
+		cfg = nil
 	}
-	binariesInS3 := fmt.Sprintf("binaries/%s.tar.gz", hash)
-	if debug {
-		binariesInS3 = fmt.Sprintf("binaries/%s-debug.tar.gz", hash)
-	}
+	binariesInS3 := binariesS3Path(hash, debug, arch, cfg)
 	exist, err := t.awsm.FileExistsOnS3(os.Getenv("AWS_REGION"),
 		os.Getenv("BINARIES_S3_BUCKET"),
 		binariesInS3)
@@ -488,32 +562,41 @@ func (t *TestRunManager) BinariesExistInS3(
 	return binariesInS3, nil
 }
 
-// UploadBinaries upload binaries for this testrun to S3
+// UploadBinaries upload binaries for this testrun and architecture to S3
 func (t *TestRunManager) UploadBinaries(
 	tr *common.TestRun,
 	seeder bool,
+	arch string,
 ) (string, error) {
 
 	hash := tr.CommitHash
 	debug := tr.RunPerf || tr.Debug
+	cfg := tr.BuildConfig
 	if seeder {
 		hash = tr.SeederHash
 		debug = false
+		cfg = nil
 	}
 	sourcePath, err := sources.BinariesArchivePath(
 		hash,
 		debug,
+		arch,
+		cfg,
 	)
 	if err != nil {
 		return "", err
 	}
 
-	binariesInS3 := fmt.Sprintf("binaries/%s.tar.gz", hash)
-	if debug {
-		// We need a separate archive for debug binaries since they perform
-		// much worse. We can't run debugging or perf on a binary set with
-		// optimizations because the stacktraces won't make much sense.
-		binariesInS3 = fmt.Sprintf("binaries/%s-debug.tar.gz", hash)
+	// Never ship an archive that got corrupted on disk
+	checksums, err := t.src.VerifyBinaries(hash, debug, arch, cfg)
+	if err != nil {
+		return "", err
+	}
+
+	binariesInS3 := binariesS3Path(hash, debug, arch, cfg)
+	if t.binariesDistributed(binariesInS3, checksums.SHA256) {
+		// This archive was uploaded before
+		return binariesInS3, nil
 	}
 	_, loaded := t.pendingBinaryUploads.LoadOrStore(binariesInS3, true)
 	if loaded {
@@ -526,12 +609,36 @@ func (t *TestRunManager) UploadBinaries(
 		return "", err
 	}
 
-	err = t.awsm.UploadToS3IfNotExists(common.S3Upload{
-		SourcePath:   sourcePath,
-		TargetRegion: os.Getenv("AWS_REGION"),
-		TargetBucket: os.Getenv("BINARIES_S3_BUCKET"),
-		TargetPath:   binariesInS3,
-	})
+	// Upload the archive unless it's in S3 already. An archive that was
+	// rebuilt since it was uploaded is uploaded again, such that it matches
+	// the checksums uploaded along with it
+	exists, err := t.awsm.FileExistsOnS3(
+		os.Getenv("AWS_REGION"),
+		os.Getenv("BINARIES_S3_BUCKET"),
+		binariesInS3,
+	)
+	upload := !exists || t.binariesStale(binariesInS3, checksums.SHA256)
+	if err == nil && upload {
+		err = t.awsm.UploadToS3(common.S3Upload{
+			SourcePath:   sourcePath,
+			TargetRegion: os.Getenv("AWS_REGION"),
+			TargetBucket: os.Getenv("BINARIES_S3_BUCKET"),
+			TargetPath:   binariesInS3,
+		})
+	}
+	if err == nil {
+		// The checksums are uploaded along with the archive, such that they
+		// can be verified when the archive is deployed from S3 later
+		err = t.awsm.UploadToS3(common.S3Upload{
+			SourcePath:   common.ChecksumsPath(sourcePath),
+			TargetRegion: os.Getenv("AWS_REGION"),
+			TargetBucket: os.Getenv("BINARIES_S3_BUCKET"),
+			TargetPath:   common.ChecksumsPath(binariesInS3),
+		})
+	}
+	if err == nil {
+		err = t.recordDistributedBinaries(binariesInS3, checksums, upload)
+	}
 	t.pendingBinaryUploads.Delete(binariesInS3)
 	if err != nil {
 		return "", err
@@ -556,6 +663,17 @@ func (t *TestRunManager) WaitForBinaryUploadComplete(path string) error {
 // UploadConfig uploads the contents of the configuration file for the system
 // to S3 for future reference
 func (t *TestRunManager) UploadConfig(cfg []byte, tr *common.TestRun) error {
+	return t.uploadRunOutput(tr, "config.cfg", cfg)
+}
+
+// uploadRunOutput uploads a file the coordinator generated for the test run to
+// the outputs of the test run in S3, and queues its download with the other
+// outputs of the test run
+func (t *TestRunManager) uploadRunOutput(
+	tr *common.TestRun,
+	name string,
+	cfg []byte,
+) error {
 	file, err := ioutil.TempFile("", "")
 	if err != nil {
 		return err
@@ -572,7 +690,7 @@ func (t *TestRunManager) UploadConfig(cfg []byte, tr *common.TestRun) error {
 		)
 	}
 
-	path := fmt.Sprintf("testruns/%s/outputs/config.cfg", tr.ID)
+	path := fmt.Sprintf("testruns/%s/outputs/%s", tr.ID, name)
 
 	dl := common.S3Download{
 		TargetPath:   filepath.Join(common.DataDir(), path),
@@ -594,6 +712,32 @@ func (t *TestRunManager) UploadConfig(cfg []byte, tr *common.TestRun) error {
 	})
 }
 
+// processOutputValidation records the validation failure the agent reported
+// when uploading or sending an output file, if any, and returns it as error such that
+// the test run fails while its agents are still available for debugging
+func (t *TestRunManager) processOutputValidation(
+	tr *common.TestRun,
+	role *common.TestRunRole,
+	file string,
+	validationError string,
+) error {
+	if validationError == "" {
+		return nil
+	}
+	desc := fmt.Sprintf(
+		"%s-%d-%s: %s",
+		string(role.Role),
+		role.Index,
+		file,
+		validationError,
+	)
+	t.testRunsLock.Lock()
+	tr.OutputValidationErrors = append(tr.OutputValidationErrors, desc)
+	t.testRunsLock.Unlock()
+	t.WriteLog(tr, "Output file failed validation: %s", desc)
+	return fmt.Errorf("output file failed validation: %s", desc)
+}
+
 // processS3UploadResponse will look at the message and error returned by the
 // call to QueryAgentWithTimeout with an UploadFileToS3RequestMsg. It will
 // return the error from the function (if any), or check for a mismatching
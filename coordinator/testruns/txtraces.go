@@ -0,0 +1,240 @@
+package testruns
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+)
+
+// txTraceFilePrefix is the (role, index prefixed) name of the files in the
+// test run outputs that contain the per-transaction records logged by the
+// system under test. Each line in these files is formatted as
+// `<txid> <unix timestamp in nanoseconds> [event]`
+const txTraceFilePrefix = "tx_trace_"
+
+// txTraceClientRoles are the roles that originate transactions. Only
+// transactions seen by one of these roles are considered for sampling
+var txTraceClientRoles = map[common.SystemRole]bool{
+	common.SystemRoleAtomizerCliWatchtower: true,
+	common.SystemRoleTwoPhaseGen:           true,
+	common.SystemRoleParsecGen:             true,
+}
+
+// TxTraceEvent is a single record of a transaction being observed by one of
+// the roles in the system
+type TxTraceEvent struct {
+	Role      common.SystemRole `json:"role"`
+	Index     int               `json:"index"`
+	Timestamp int64             `json:"timestamp"`
+	Event     string            `json:"event,omitempty"`
+}
+
+// TxTrace is the end-to-end trace of a single transaction, correlating the
+// records of all roles that observed it
+type TxTrace struct {
+	TxID string `json:"txid"`
+	// The events sorted by timestamp
+	Events []TxTraceEvent `json:"events"`
+	// The time between the first and the last event in nanoseconds
+	EndToEndLatency int64 `json:"endToEndLatency"`
+}
+
+// TxTracesPath returns the path of the artifact containing the correlated
+// transaction traces for a test run
+func TxTracesPath(tr *common.TestRun) string {
+	return filepath.Join(
+		common.DataDir(),
+		fmt.Sprintf("testruns/%s/tx_traces.json", tr.ID),
+	)
+}
+
+// txTraceFile describes a transaction trace file found in the test run outputs
+type txTraceFile struct {
+	path  string
+	role  common.SystemRole
+	index int
+}
+
+// findTxTraceFiles returns all transaction trace files in the test run's
+// outputs folder. The files are named `<role>-<index>-tx_trace_<idx>.txt` by
+// CopyOutputs
+func (t *TestRunManager) findTxTraceFiles(
+	tr *common.TestRun,
+) ([]txTraceFile, error) {
+	outputsDir := filepath.Join(
+		common.DataDir(),
+		fmt.Sprintf("testruns/%s/outputs", tr.ID),
+	)
+	entries, err := ioutil.ReadDir(outputsDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []txTraceFile{}, nil
+		}
+		return nil, err
+	}
+
+	files := make([]txTraceFile, 0)
+	for _, e := range entries {
+		if e.IsDir() || !strings.Contains(e.Name(), txTraceFilePrefix) {
+			continue
+		}
+		r, rest := roleForOutputFile(tr, e.Name())
+		if r != nil && strings.HasPrefix(rest, txTraceFilePrefix) {
+			files = append(files, txTraceFile{
+				path:  filepath.Join(outputsDir, e.Name()),
+				role:  r.Role,
+				index: r.Index,
+			})
+		}
+	}
+	return files, nil
+}
+
+// readTxTraceFile reads a transaction trace file line by line and calls f for
+// every well-formed record in it
+func readTxTraceFile(
+	path string,
+	f func(txid string, timestamp int64, event string),
+) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		ts, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		event := ""
+		if len(fields) > 2 {
+			event = strings.Join(fields[2:], " ")
+		}
+		f(fields[0], ts, event)
+	}
+	return scanner.Err()
+}
+
+// CorrelateTransactionTraces joins the per-transaction records logged by the
+// clients, sentinels and shards by transaction ID, producing end-to-end traces
+// for a sampled subset of the transactions. The number of sampled transactions
+// is configured by TxTraceSamples on the test run. The sampling is
+// deterministic for a given test run, such that re-running the correlation
+// yields the same traces. The traces are written to TxTracesPath
+func (t *TestRunManager) CorrelateTransactionTraces(
+	tr *common.TestRun,
+) error {
+	if tr.TxTraceSamples <= 0 {
+		return nil
+	}
+
+	files, err := t.findTxTraceFiles(tr)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		t.WriteLog(tr, "No transaction trace files found, skipping correlation")
+		return nil
+	}
+
+	// First pass: collect the transaction IDs seen by the clients
+	txids := make([]string, 0)
+	seen := map[string]bool{}
+	for _, f := range files {
+		if !txTraceClientRoles[f.role] {
+			continue
+		}
+		err = readTxTraceFile(f.path, func(txid string, _ int64, _ string) {
+			if !seen[txid] {
+				seen[txid] = true
+				txids = append(txids, txid)
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("Error reading %s: %v", f.path, err)
+		}
+	}
+	seen = nil
+
+	// Sample the requested number of transactions, seeding the random
+	// generator with the test run ID for reproducibility
+	sort.Strings(txids)
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(tr.ID))
+	rnd := rand.New(rand.NewSource(int64(h.Sum64())))
+	rnd.Shuffle(len(txids), func(i, j int) {
+		txids[i], txids[j] = txids[j], txids[i]
+	})
+	if len(txids) > tr.TxTraceSamples {
+		txids = txids[:tr.TxTraceSamples]
+	}
+	traces := map[string]*TxTrace{}
+	for _, txid := range txids {
+		traces[txid] = &TxTrace{TxID: txid, Events: []TxTraceEvent{}}
+	}
+
+	// Second pass: collect the records of all roles for the sampled
+	// transactions
+	for _, f := range files {
+		err = readTxTraceFile(
+			f.path,
+			func(txid string, timestamp int64, event string) {
+				trace, ok := traces[txid]
+				if !ok {
+					return
+				}
+				trace.Events = append(trace.Events, TxTraceEvent{
+					Role:      f.role,
+					Index:     f.index,
+					Timestamp: timestamp,
+					Event:     event,
+				})
+			},
+		)
+		if err != nil {
+			return fmt.Errorf("Error reading %s: %v", f.path, err)
+		}
+	}
+
+	result := make([]*TxTrace, 0, len(traces))
+	for _, trace := range traces {
+		sort.SliceStable(trace.Events, func(i, j int) bool {
+			return trace.Events[i].Timestamp < trace.Events[j].Timestamp
+		})
+		if len(trace.Events) > 0 {
+			trace.EndToEndLatency = trace.Events[len(trace.Events)-1].Timestamp -
+				trace.Events[0].Timestamp
+		}
+		result = append(result, trace)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].TxID < result[j].TxID
+	})
+
+	b, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(TxTracesPath(tr), b, 0644)
+	if err != nil {
+		return err
+	}
+	t.WriteLog(tr, "Correlated %d transaction traces", len(result))
+	return nil
+}
@@ -4,18 +4,44 @@ import (
 	"github.com/mit-dci/opencbdc-tctl/common"
 )
 
-// ValidateTestRun validates the role composition of the test run by calling
-// the architecture-specific function and return all errors reported
+// ValidateTestRun validates the role composition of the test run by calling the
+// architecture-specific function, the configured log levels, the failover
+// settings, the injected faults, the abort conditions, the accelerators and
+// capabilities required by the roles, the pools of static agents they run on,
+// their command line and environment overrides and resource limits and the
+// labels, and return all errors reported. The test run is not modified, such
+// that it can also be used to validate test runs that are not scheduled
 func (t *TestRunManager) ValidateTestRun(
 	tr *common.TestRun,
 ) []error {
 
 	ret := []error{}
-	t.UpdateStatus(tr, common.TestRunStatusRunning, "Validating test run")
-	if t.Is2PC(tr.Architecture) {
+	if m := t.architectureManifest(tr.Architecture); m != nil {
+		ret = t.ValidateTestRunManifest(tr, m)
+	} else if t.Is2PC(tr.Architecture) {
 		ret = t.ValidateTestRunTwoPhase(tr)
 	} else if t.IsAtomizer(tr.Architecture) {
 		ret = t.ValidateTestRunAtomizer(tr)
 	}
+	ret = append(ret, t.validateLogLevels(tr)...)
+	ret = append(ret, t.validateFailover(tr)...)
+	ret = append(ret, t.validateFaults(tr)...)
+	ret = append(ret, t.validateAbortConditions(tr)...)
+	ret = append(ret, t.validateRegressionGate(tr)...)
+	ret = append(ret, validateSoak(tr)...)
+	ret = append(ret, t.validateLoadProfile(tr)...)
+	ret = append(ret, t.validateAccelerators(tr.Roles)...)
+	ret = append(ret, t.validateRoleRequirements(tr)...)
+	ret = append(ret, t.validateAgentPools(tr)...)
+	ret = append(ret, t.validateRegionPlacement(tr)...)
+	ret = append(ret, validateRoleOverrides(tr.Roles)...)
+	ret = append(ret, validateRoleLimits(tr.Roles)...)
+	ret = append(ret, validateLabels(tr.Tags)...)
+	ret = append(ret, t.validateShadow(tr)...)
+	ret = append(ret, t.validateComponents(tr)...)
+	ret = append(ret, tr.BuildConfig.Validate()...)
+	ret = append(ret, t.validateBinariesImage(tr)...)
+	ret = append(ret, validateDistribution(tr)...)
+	ret = append(ret, t.validateCloudAccess(tr)...)
 	return ret
 }
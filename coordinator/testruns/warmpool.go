@@ -0,0 +1,350 @@
+package testruns
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// ErrWarmEnvironmentNotFound is returned when no idle warm environment with
+// the requested ID exists
+var ErrWarmEnvironmentNotFound = errors.New("Warm environment not found")
+
+// warmEnvironmentIdleTimeout is how long a warm environment is kept after its
+// last test run ended. If no test run reuses it within that time, its agents
+// are terminated
+const warmEnvironmentIdleTimeout = 20 * time.Minute
+
+// warmResetPaths are the files the roles persist across restarts, which are
+// removed from a warm environment in addition to the outputs of the roles,
+// such that the state of a test run does not leak into the next one. This
+// includes the shard and archiver databases; the shards are seeded again from
+// the preseed snapshot when the environment is reused
+var warmResetPaths = []string{
+	"*_raft_log_*",
+	"*_raft_config_*",
+	"*_raft_state_*",
+	"db",
+	"archiver[0-9]*",
+}
+
+// WarmEnvironment is an agent fleet that is kept alive after a test run with
+// environment reuse enabled, together with the binaries deployed to it, such
+// that the next test run with the same architecture, commit and roles can skip
+// launching agents and deploying
+type WarmEnvironment struct {
+	ID           string `json:"id"`
+	Architecture string `json:"architectureID"`
+	CommitHash   string `json:"commitHash"`
+	// The test run that last used the environment
+	LastTestRunID string                `json:"lastTestRunID"`
+	Roles         []*common.TestRunRole `json:"roles"`
+	RunCount      int                   `json:"runCount"`
+	Released      time.Time             `json:"released"`
+	Expires       time.Time             `json:"expires"`
+
+	key  string
+	envs map[int32][]byte
+}
+
+// warmEnvironmentKey returns the key under which the environment of a test
+// run can be reused: test runs with the same architecture, commit, seed and
+// role layout can run on the same agents with the same data
+func warmEnvironmentKey(tr *common.TestRun) string {
+	roles := []string{}
+	for _, r := range tr.Roles {
+		placement := fmt.Sprintf("agent-%d", r.AgentID)
+		if r.AwsLaunchTemplateID != "" {
+			placement = r.AwsLaunchTemplateID
+		}
+		if r.AgentPool != "" {
+			placement = fmt.Sprintf("pool-%s", r.AgentPool)
+		}
+		if r.ColocateWith != nil {
+			placement = fmt.Sprintf(
+				"with-%s-%d",
+				r.ColocateWith.Role,
+				r.ColocateWith.Index,
+			)
+		}
+		roles = append(roles, fmt.Sprintf("%s-%d@%s", r.Role, r.Index, placement))
+	}
+	sort.Strings(roles)
+	return fmt.Sprintf(
+		"%s|%s|%s|%t|%d|%t|%s",
+		tr.Architecture,
+		tr.CommitHash,
+		tr.SeederHash,
+		tr.PreseedShards,
+		tr.PreseedCount,
+		tr.RunFromBinariesImage,
+		strings.Join(roles, ","),
+	)
+}
+
+// acquireWarmEnvironment takes an idle warm environment matching the test run
+// from the pool, if the test run reuses environments and one is available
+// with all of its agents still connected. The roles of the test run are
+// placed on the agents of the environment, and the environments on the
+// agents are returned. Returns nil if no warm environment can be reused
+func (t *TestRunManager) acquireWarmEnvironment(
+	tr *common.TestRun,
+) map[int32][]byte {
+	if !tr.ReuseEnvironment {
+		return nil
+	}
+	key := warmEnvironmentKey(tr)
+
+	w := t.takeWarmEnvironment(func(e *WarmEnvironment) bool {
+		return e.key == key && t.warmEnvironmentOnline(e)
+	})
+	if w == nil {
+		t.WriteLog(tr, "No warm environment available, launching a new one")
+		return nil
+	}
+
+	placed := map[common.TestRunRoleRef]*common.TestRunRole{}
+	for _, r := range w.Roles {
+		placed[common.TestRunRoleRef{Role: r.Role, Index: r.Index}] = r
+	}
+	for _, r := range tr.Roles {
+		p := placed[common.TestRunRoleRef{Role: r.Role, Index: r.Index}]
+		r.AgentID = p.AgentID
+		r.AwsAgentInstanceId = p.AwsAgentInstanceId
+	}
+	tr.WarmEnvironmentID = w.ID
+	t.WriteLog(
+		tr,
+		"Reusing warm environment %s of test run %s (used %d times)",
+		w.ID,
+		w.LastTestRunID,
+		w.RunCount,
+	)
+	t.PersistTestRun(tr)
+	return w.envs
+}
+
+// warmEnvironmentOnline returns true if all agents of the warm environment
+// are still connected
+func (t *TestRunManager) warmEnvironmentOnline(w *WarmEnvironment) bool {
+	for _, r := range w.Roles {
+		if _, err := t.coord.GetAgent(r.AgentID); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// releaseWarmEnvironment cleans the environments of a completed test run
+// explicitly for the next test run, and returns its agents to the pool of
+// warm environments instead of terminating them. Returns false if the test
+// run does not reuse environments or the cleanup failed, in which case the
+// environment has to be torn down as usual
+func (t *TestRunManager) releaseWarmEnvironment(
+	tr *common.TestRun,
+	envs map[int32][]byte,
+) bool {
+	if !tr.ReuseEnvironment || tr.SkipCleanUp {
+		return false
+	}
+	t.UpdateStatus(
+		tr,
+		common.TestRunStatusRunning,
+		"Cleaning the environment for the next test run",
+	)
+
+	ports := map[int32][]int{}
+	paths := map[int32][]string{}
+	for _, r := range tr.Roles {
+		if _, ok := paths[r.AgentID]; !ok {
+			paths[r.AgentID] = append([]string{}, warmResetPaths...)
+		}
+		for _, f := range t.SubstituteParameters(t.roleOutputs(tr, r.Role), r, tr) {
+			paths[r.AgentID] = append(
+				paths[r.AgentID],
+				strings.TrimSuffix(f, "%%OPT"),
+			)
+		}
+		if p := t.rolePort(tr, r.Role); p > 0 {
+			ports[r.AgentID] = append(
+				ports[r.AgentID],
+				p+int(PortIncrementDefaultPort),
+				p+int(PortIncrementRaftPort),
+				p+int(PortIncrementClientPort),
+			)
+		}
+	}
+
+	clean := true
+	cleanLock := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for agentID := range paths {
+		wg.Add(1)
+		go func(agentID int32) {
+			defer wg.Done()
+			rep, err := t.am.ResetEnvironment(
+				agentID,
+				envs[agentID],
+				ports[agentID],
+				paths[agentID],
+			)
+			if err == nil && !rep.Cleaned &&
+				(len(rep.Processes) > 0 || len(rep.Ports) > 0) {
+				err = fmt.Errorf(
+					"processes %v, ports in use %v",
+					rep.Processes,
+					rep.Ports,
+				)
+			}
+			if err != nil {
+				t.WriteLog(
+					tr,
+					"Unable to clean the environment on agent %d: %v",
+					agentID,
+					err,
+				)
+				cleanLock.Lock()
+				clean = false
+				cleanLock.Unlock()
+			}
+		}(agentID)
+	}
+	wg.Wait()
+	if !clean {
+		t.WriteLog(tr, "Not keeping the environment warm, tearing it down")
+		return false
+	}
+
+	w := &WarmEnvironment{
+		ID:            tr.WarmEnvironmentID,
+		Architecture:  tr.Architecture,
+		CommitHash:    tr.CommitHash,
+		LastTestRunID: tr.ID,
+		Roles:         []*common.TestRunRole{},
+		Released:      time.Now(),
+		Expires:       time.Now().Add(warmEnvironmentIdleTimeout),
+		key:           warmEnvironmentKey(tr),
+		envs:          envs,
+	}
+	if w.ID == "" {
+		var err error
+		w.ID, err = common.RandomID(12)
+		if err != nil {
+			t.WriteLog(tr, "Unable to keep the environment warm: %v", err)
+			return false
+		}
+	}
+	for _, r := range tr.Roles {
+		w.Roles = append(w.Roles, &common.TestRunRole{
+			Role:                r.Role,
+			Index:               r.Index,
+			AgentID:             r.AgentID,
+			AwsLaunchTemplateID: r.AwsLaunchTemplateID,
+			AwsAgentInstanceId:  r.AwsAgentInstanceId,
+		})
+	}
+	for _, e := range t.GetTestRuns() {
+		if e.WarmEnvironmentID == w.ID {
+			w.RunCount++
+		}
+	}
+
+	t.warmEnvironmentsLock.Lock()
+	t.warmEnvironments = append(t.warmEnvironments, w)
+	t.warmEnvironmentsLock.Unlock()
+	time.AfterFunc(warmEnvironmentIdleTimeout, func() {
+		// Only expire the environment if it was not reused since
+		if t.takeWarmEnvironment(func(e *WarmEnvironment) bool {
+			return e == w
+		}) == nil {
+			return
+		}
+		err := t.teardownWarmEnvironment(w)
+		if err != nil {
+			logging.Warnf("Unable to tear down warm environment %s: %v", w.ID, err)
+		}
+	})
+	tr.WarmEnvironmentID = w.ID
+	t.WriteLog(
+		tr,
+		"Keeping the environment warm as %s for %.0f minutes",
+		w.ID,
+		warmEnvironmentIdleTimeout.Minutes(),
+	)
+	return true
+}
+
+// WarmEnvironments returns the idle warm environments
+func (t *TestRunManager) WarmEnvironments() []*WarmEnvironment {
+	t.warmEnvironmentsLock.Lock()
+	defer t.warmEnvironmentsLock.Unlock()
+	return append([]*WarmEnvironment{}, t.warmEnvironments...)
+}
+
+// takeWarmEnvironment removes the first idle warm environment matching the
+// given function from the pool, and returns it or nil if none matched
+func (t *TestRunManager) takeWarmEnvironment(
+	match func(*WarmEnvironment) bool,
+) *WarmEnvironment {
+	t.warmEnvironmentsLock.Lock()
+	defer t.warmEnvironmentsLock.Unlock()
+	for i, e := range t.warmEnvironments {
+		if match(e) {
+			t.warmEnvironments = append(
+				t.warmEnvironments[:i],
+				t.warmEnvironments[i+1:]...,
+			)
+			return e
+		}
+	}
+	return nil
+}
+
+// TeardownWarmEnvironment removes an idle warm environment from the pool and
+// tears it down. Warm environments in use by a test run are not affected
+func (t *TestRunManager) TeardownWarmEnvironment(id string) error {
+	w := t.takeWarmEnvironment(func(e *WarmEnvironment) bool {
+		return e.ID == id
+	})
+	if w == nil {
+		return ErrWarmEnvironmentNotFound
+	}
+	return t.teardownWarmEnvironment(w)
+}
+
+// teardownWarmEnvironment terminates the agents of a warm environment that
+// were launched in AWS, and removes the environments from its other agents
+func (t *TestRunManager) teardownWarmEnvironment(w *WarmEnvironment) error {
+	instanceIDs := []string{}
+	launched := map[int32]bool{}
+	for _, r := range w.Roles {
+		if r.AwsAgentInstanceId != "" {
+			instanceIDs = append(instanceIDs, r.AwsAgentInstanceId)
+			launched[r.AgentID] = true
+		}
+	}
+	for agentID, envID := range w.envs {
+		if launched[agentID] {
+			continue
+		}
+		err := t.am.DestroyEnvironment(agentID, envID)
+		if err != nil {
+			logging.Warnf(
+				"Unable to remove warm environment %s from agent %d: %v",
+				w.ID,
+				agentID,
+				err,
+			)
+		}
+	}
+	if len(instanceIDs) == 0 {
+		return nil
+	}
+	return t.awsm.StopAgentsByInstanceIds(instanceIDs)
+}
@@ -0,0 +1,467 @@
+package testruns
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+	"github.com/mit-dci/opencbdc-tctl/coordinator"
+	"github.com/mit-dci/opencbdc-tctl/logging"
+)
+
+// ErrWeeklyReportRunning is returned when the weekly report job is triggered
+// while it is already running
+var ErrWeeklyReportRunning = errors.New(
+	"The weekly report job is already running",
+)
+
+// weeklyReportCatchUp is how long after its scheduled time a weekly report
+// that was missed (because the coordinator was down) is still started
+const weeklyReportCatchUp = 24 * time.Hour
+
+// weeklyReportHistoryLength is the number of weekly reports kept in the
+// history
+const weeklyReportHistoryLength = 104
+
+// TestRunTagWeeklyReport tags the test runs scheduled by the weekly report
+// job
+const TestRunTagWeeklyReport = "weekly-report"
+
+// ReportGeneratorFunc renders a report definition (in the format of the
+// report generator of the web interface) and returns the ID under which the
+// rendered report can be retrieved
+type ReportGeneratorFunc func(title, definition string) (string, error)
+
+// WeeklyReportConfig configures the weekly report job, which every week
+// benchmarks the head of the main branch against the latest release on the
+// baseline configuration and publishes the differences
+type WeeklyReportConfig struct {
+	// Enables the weekly report job
+	Enabled bool `json:"enabled"`
+	// The day of the week and time of day (UTC) the job runs at
+	Weekday time.Weekday `json:"weekday"`
+	Hour    int          `json:"hour"`
+	Minute  int          `json:"minute"`
+	// The branch to benchmark. If empty, the head of the main branch of the
+	// commit history is used
+	Branch string `json:"branch"`
+	// The baseline configuration both commits are tested with. It is run as
+	// a comparison run with interleaved repetitions, its commits are replaced
+	Template *common.TestRun `json:"template"`
+	// URLs the outcome of the report is POSTed to as JSON
+	NotifyWebhooks []string `json:"notifyWebhooks"`
+}
+
+// WeeklyReport is a single run of the weekly report job
+type WeeklyReport struct {
+	// The scheduled time of the report, or the time it was triggered for
+	// manual runs
+	Slot    time.Time `json:"slot"`
+	Manual  bool      `json:"manual"`
+	Started time.Time `json:"started"`
+	// The release and main branch commits that are compared
+	ReleaseTag    string `json:"releaseTag"`
+	ReleaseCommit string `json:"releaseCommit"`
+	MainCommit    string `json:"mainCommit"`
+	// The sweep ID of the comparison run
+	SweepID string `json:"sweepID"`
+	// The ID of the generated report and when it was published, once the
+	// comparison run is done
+	ReportID  string    `json:"reportID,omitempty"`
+	Published time.Time `json:"published"`
+	// Why the job failed, empty if it succeeded so far
+	Error string `json:"error,omitempty"`
+}
+
+// weeklyReportState holds the history of the weekly report job
+type weeklyReportState struct {
+	reports   []*WeeklyReport
+	loaded    bool
+	running   bool
+	generator ReportGeneratorFunc
+	lock      sync.Mutex
+}
+
+// SetReportGeneratorFunc registers the function the weekly reports are
+// rendered with
+func (t *TestRunManager) SetReportGeneratorFunc(f ReportGeneratorFunc) {
+	t.weeklyReports.lock.Lock()
+	defer t.weeklyReports.lock.Unlock()
+	t.weeklyReports.generator = f
+}
+
+// SetWeeklyReportConfig changes the weekly report job's configuration and
+// persists it
+func (t *TestRunManager) SetWeeklyReportConfig(cfg WeeklyReportConfig) error {
+	t.configLock.Lock()
+	t.config.WeeklyReport = cfg
+	t.configLock.Unlock()
+	return t.PersistConfig()
+}
+
+// Validate checks the configured schedule and baseline configuration
+func (cfg WeeklyReportConfig) Validate() error {
+	if cfg.Weekday < time.Sunday || cfg.Weekday > time.Saturday {
+		return fmt.Errorf("Invalid day of the week %d", cfg.Weekday)
+	}
+	if cfg.Hour < 0 || cfg.Hour > 23 || cfg.Minute < 0 || cfg.Minute > 59 {
+		return fmt.Errorf("Invalid time of day %02d:%02d", cfg.Hour, cfg.Minute)
+	}
+	if cfg.Enabled && (cfg.Template == nil || len(cfg.Template.Roles) == 0) {
+		return errors.New("No baseline configuration set")
+	}
+	return nil
+}
+
+// weeklyReportSlot returns the most recent scheduled time of the job at or
+// before now
+func (cfg WeeklyReportConfig) weeklyReportSlot(now time.Time) time.Time {
+	return weeklySlot(now, cfg.Weekday, cfg.Hour, cfg.Minute)
+}
+
+// NextWeeklyReport returns the next time the weekly report job is scheduled
+// to run, or the zero time if it is disabled
+func (t *TestRunManager) NextWeeklyReport() time.Time {
+	cfg := t.Config().WeeklyReport
+	if !cfg.Enabled {
+		return time.Time{}
+	}
+	return cfg.weeklyReportSlot(time.Now()).AddDate(0, 0, 7)
+}
+
+// weeklyReportHistoryPath returns the path of the file the history of the
+// weekly report job is persisted in
+func weeklyReportHistoryPath() string {
+	return filepath.Join(common.DataDir(), "testruns", "weekly-reports.json")
+}
+
+// loadWeeklyReportHistory reads the history of the weekly report job from
+// disk. Must be called with the lock of the weekly report state held
+func (t *TestRunManager) loadWeeklyReportHistory() {
+	if t.weeklyReports.loaded {
+		return
+	}
+	t.weeklyReports.loaded = true
+	loadJobHistory(weeklyReportHistoryPath(), &t.weeklyReports.reports)
+}
+
+// persistWeeklyReportHistory writes the history of the weekly report job to
+// disk. Must be called with the lock of the weekly report state held
+func (t *TestRunManager) persistWeeklyReportHistory() error {
+	reports := t.weeklyReports.reports
+	if len(reports) > weeklyReportHistoryLength {
+		t.weeklyReports.reports = reports[:weeklyReportHistoryLength]
+	}
+	return persistJobHistory(
+		weeklyReportHistoryPath(),
+		t.weeklyReports.reports,
+	)
+}
+
+// WeeklyReportHistory returns the runs of the weekly report job, most recent
+// first
+func (t *TestRunManager) WeeklyReportHistory() []WeeklyReport {
+	t.weeklyReports.lock.Lock()
+	defer t.weeklyReports.lock.Unlock()
+	t.loadWeeklyReportHistory()
+	ret := make([]WeeklyReport, len(t.weeklyReports.reports))
+	for i, r := range t.weeklyReports.reports {
+		ret[i] = *r
+	}
+	return ret
+}
+
+// WeeklyReportRunning returns true if the weekly report job is currently
+// scheduling its comparison run
+func (t *TestRunManager) WeeklyReportRunning() bool {
+	t.weeklyReports.lock.Lock()
+	defer t.weeklyReports.lock.Unlock()
+	return t.weeklyReports.running
+}
+
+// WeeklyReportPipeline is the loop that starts the weekly report job at its
+// scheduled time. Reports missed by less than weeklyReportCatchUp while the
+// coordinator was down are started when it comes back
+func (t *TestRunManager) WeeklyReportPipeline() {
+	t.runScheduledJob(scheduledJob{
+		name:    "Weekly report",
+		poll:    time.Minute,
+		catchUp: weeklyReportCatchUp,
+		slot: func(now time.Time) (time.Time, bool) {
+			cfg := t.Config().WeeklyReport
+			return cfg.weeklyReportSlot(now), cfg.Enabled
+		},
+		ran: func(slot time.Time) bool {
+			t.weeklyReports.lock.Lock()
+			defer t.weeklyReports.lock.Unlock()
+			t.loadWeeklyReportHistory()
+			for _, r := range t.weeklyReports.reports {
+				if !r.Manual && r.Slot.Equal(slot) {
+					return true
+				}
+			}
+			return false
+		},
+		run: func(slot time.Time) error {
+			_, err := t.RunWeeklyReport(slot, false)
+			return err
+		},
+		errRunning: ErrWeeklyReportRunning,
+	})
+}
+
+// TriggerWeeklyReport runs the weekly report job now, regardless of its
+// schedule
+func (t *TestRunManager) TriggerWeeklyReport() (*WeeklyReport, error) {
+	return t.RunWeeklyReport(time.Now().UTC(), true)
+}
+
+// RunWeeklyReport runs the weekly report job for the given slot: it refreshes
+// the sources, determines the latest release and the head of the main branch
+// and schedules a comparison run between them. The report is published once
+// the comparison run is done. The run is recorded in the history, also if it
+// fails
+func (t *TestRunManager) RunWeeklyReport(
+	slot time.Time,
+	manual bool,
+) (*WeeklyReport, error) {
+	t.weeklyReports.lock.Lock()
+	if t.weeklyReports.running {
+		t.weeklyReports.lock.Unlock()
+		return nil, ErrWeeklyReportRunning
+	}
+	t.weeklyReports.running = true
+	t.loadWeeklyReportHistory()
+	report := &WeeklyReport{
+		Slot:    slot,
+		Manual:  manual,
+		Started: time.Now(),
+	}
+	t.weeklyReports.reports = append(
+		[]*WeeklyReport{report},
+		t.weeklyReports.reports...,
+	)
+	t.weeklyReports.lock.Unlock()
+
+	// The progress is recorded in a copy, the report in the history is only
+	// modified with the lock held
+	result := *report
+	err := t.runWeeklyReport(&result)
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	t.weeklyReports.lock.Lock()
+	defer t.weeklyReports.lock.Unlock()
+	*report = result
+	t.weeklyReports.running = false
+	if perr := t.persistWeeklyReportHistory(); perr != nil {
+		logging.Warnf("Unable to persist weekly report history: %v", perr)
+	}
+	return &result, err
+}
+
+// runWeeklyReport performs the steps of the weekly report job, recording its
+// progress in report
+func (t *TestRunManager) runWeeklyReport(report *WeeklyReport) error {
+	cfg := t.Config().WeeklyReport
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if cfg.Template == nil || len(cfg.Template.Roles) == 0 {
+		// Manual runs are allowed while the schedule is disabled
+		return errors.New("No baseline configuration set")
+	}
+
+	var err error
+	report.MainCommit, err = t.jobCommit("Weekly report", cfg.Branch)
+	if err != nil {
+		return err
+	}
+	report.ReleaseTag, err = t.src.LatestReleaseTag()
+	if err != nil {
+		return fmt.Errorf("Unable to determine the latest release: %v", err)
+	}
+	report.ReleaseCommit, _, err = t.src.ResolveRef(report.ReleaseTag)
+	if err != nil {
+		return fmt.Errorf("Unable to resolve %s: %v", report.ReleaseTag, err)
+	}
+
+	tr, err := jobTestRun(cfg.Template, TestRunTagWeeklyReport)
+	if err != nil {
+		return err
+	}
+	tr.Sweep = "comparison"
+	tr.CommitHash = report.ReleaseCommit
+	tr.CompareCommitHash = report.MainCommit
+	tr.CompareInterleaved = true
+	tr.SourceRef = ""
+	ApplySubmissionDefaults(tr)
+	if errs := common.ValidateComparisonRun(tr); len(errs) > 0 {
+		return errs[0]
+	}
+
+	report.SweepID, err = common.RandomID(12)
+	if err != nil {
+		return err
+	}
+	runs := InitialSweepRuns(tr, common.ExpandSweepRun(tr, report.SweepID))
+	err = t.scheduleLintedRuns(runs)
+	if err != nil {
+		return err
+	}
+	logging.Infof(
+		"[Weekly report] Comparing %s (%s) against %s",
+		report.MainCommit,
+		cfg.Branch,
+		report.ReleaseTag,
+	)
+	return nil
+}
+
+// weeklyReportDefinition returns the definition of the report generator
+// rendering the outcome of the comparison
+func weeklyReportDefinition(
+	report *WeeklyReport,
+	cmp *ComparisonReport,
+) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(
+		&buf,
+		"<h1>%%TITLE%%</h1><p>Head of main <code>%s</code> compared to "+
+			"release %s (<code>%s</code>), %d and %d runs, %d failed</p>",
+		html.EscapeString(report.MainCommit),
+		html.EscapeString(report.ReleaseTag),
+		html.EscapeString(report.ReleaseCommit),
+		len(cmp.RunIDsB),
+		len(cmp.RunIDsA),
+		cmp.Failed,
+	)
+	buf.WriteString(
+		"<table><tr><th>Metric</th><th>Release</th><th>Main</th>" +
+			"<th>Delta</th><th>95% confidence interval</th></tr>",
+	)
+	for _, m := range cmp.Metrics {
+		ci := "n/a"
+		if m.CIAvailable {
+			ci = fmt.Sprintf("%.4f &ndash; %.4f", m.CILow, m.CIHigh)
+			if m.Significant {
+				ci = fmt.Sprintf("<b>%s</b>", ci)
+			}
+		}
+		fmt.Fprintf(
+			&buf,
+			"<tr><td>%s</td><td>%.4f</td><td>%.4f</td>"+
+				"<td>%+.4f (%+.2f%%)</td><td>%s</td></tr>",
+			html.EscapeString(m.Name),
+			m.A.Mean,
+			m.B.Mean,
+			m.Delta,
+			m.DeltaPercent,
+			ci,
+		)
+	}
+	buf.WriteString("</table>")
+	fmt.Fprintf(&buf, `[cfg]{"sweepID":%q}[/cfg]`, cmp.SweepID)
+	return buf.String()
+}
+
+// weeklyReportSummary returns a one-line summary of the throughput and
+// latency differences of the comparison
+func weeklyReportSummary(report *WeeklyReport, cmp *ComparisonReport) string {
+	parts := []string{}
+	for _, m := range cmp.Metrics {
+		if m.Name != "throughputAvg" && m.Name != "latencyAvg" {
+			continue
+		}
+		s := fmt.Sprintf("%s %+.2f%%", m.Name, m.DeltaPercent)
+		if m.Significant {
+			s += " (significant)"
+		}
+		parts = append(parts, s)
+	}
+	return fmt.Sprintf(
+		"Weekly performance report: main (%.8s) vs %s: %s",
+		report.MainCommit,
+		report.ReleaseTag,
+		strings.Join(parts, ", "),
+	)
+}
+
+// publishWeeklyReport renders and publishes the report of the weekly report
+// job the finished comparison run belongs to, if any: as an announcement to
+// the users of the web interface and to the configured webhooks
+func (t *TestRunManager) publishWeeklyReport(cmp *ComparisonReport) {
+	t.weeklyReports.lock.Lock()
+	t.loadWeeklyReportHistory()
+	var report *WeeklyReport
+	for _, r := range t.weeklyReports.reports {
+		if r.SweepID == cmp.SweepID {
+			report = r
+			break
+		}
+	}
+	generator := t.weeklyReports.generator
+	if report == nil || !report.Published.IsZero() {
+		t.weeklyReports.lock.Unlock()
+		return
+	}
+	result := *report
+	t.weeklyReports.lock.Unlock()
+
+	title := fmt.Sprintf(
+		"Weekly performance report %s",
+		result.Slot.Format("2006-01-02"),
+	)
+	if generator != nil {
+		id, err := generator(title, weeklyReportDefinition(&result, cmp))
+		if err != nil {
+			logging.Warnf("[Weekly report] Unable to render report: %v", err)
+		} else {
+			result.ReportID = id
+		}
+	}
+	result.Published = time.Now()
+
+	summary := weeklyReportSummary(&result, cmp)
+	_, err := t.coord.AddAnnouncement(coordinator.Announcement{
+		Message:   summary,
+		Severity:  coordinator.AnnouncementSeverityInfo,
+		Expires:   time.Now().AddDate(0, 0, 7),
+		CreatedBy: "Weekly report",
+	})
+	if err != nil {
+		logging.Warnf("[Weekly report] Unable to announce report: %v", err)
+	}
+	b, err := json.Marshal(map[string]interface{}{
+		"summary":    summary,
+		"report":     result,
+		"comparison": cmp,
+	})
+	if err == nil {
+		clt := &http.Client{Timeout: lifecycleHookTimeout()}
+		for _, u := range t.Config().WeeklyReport.NotifyWebhooks {
+			resp, err := clt.Post(u, "application/json", bytes.NewReader(b))
+			if err != nil {
+				logging.Warnf("[Weekly report] Unable to notify %s: %v", u, err)
+				continue
+			}
+			resp.Body.Close()
+		}
+	}
+
+	t.weeklyReports.lock.Lock()
+	defer t.weeklyReports.lock.Unlock()
+	*report = result
+	if err := t.persistWeeklyReportHistory(); err != nil {
+		logging.Warnf("Unable to persist weekly report history: %v", err)
+	}
+}
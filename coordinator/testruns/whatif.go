@@ -0,0 +1,251 @@
+package testruns
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+
+	"github.com/mit-dci/opencbdc-tctl/common"
+)
+
+// WhatIfPointKind indicates how the expected metrics of a what-if point were
+// obtained
+type WhatIfPointKind string
+
+// WhatIfPointObserved means historical runs exist for the parameter value, and
+// the metrics are the average over those runs
+const WhatIfPointObserved WhatIfPointKind = "observed"
+
+// WhatIfPointInterpolated means the metrics were linearly interpolated between
+// the nearest observed parameter values on either side
+const WhatIfPointInterpolated WhatIfPointKind = "interpolated"
+
+// WhatIfPointExtrapolated means the parameter value lies outside of the range
+// of observed values, and the metrics were linearly extrapolated from the two
+// nearest observed values
+const WhatIfPointExtrapolated WhatIfPointKind = "extrapolated"
+
+// whatIfAlwaysIgnored are the normalized config parameters that never prevent
+// a historical run from being used in a what-if estimate. Agent CPU and RAM
+// are not considered either, since the template has no agent data yet
+var whatIfAlwaysIgnored = []string{
+	"hourUTC",
+	"dayUTC",
+	"monthUTC",
+	"controllerCommitHash",
+}
+
+// WhatIfRequest describes a parameter to vary over a test run template. The
+// parameter is referred to by its JSON name in the normalized config, for
+// instance `clients` or `batchSize`
+type WhatIfRequest struct {
+	Template  *common.TestRun `json:"template"`
+	Parameter string          `json:"parameter"`
+	Values    []float64       `json:"values"`
+	// Additional normalized config parameters that are allowed to differ
+	// between the template and the historical runs, for instance `commitHash`
+	// to also use results from other versions of the system under test
+	IgnoreParameters []string `json:"ignoreParameters"`
+}
+
+// WhatIfPoint holds the expected metrics for a single value of the varied
+// parameter
+type WhatIfPoint struct {
+	Value float64         `json:"value"`
+	Kind  WhatIfPointKind `json:"kind"`
+	// The number of historical runs the point is based on. For interpolated
+	// and extrapolated points this is the total over the observed points used
+	SampleCount int                `json:"sampleCount"`
+	Metrics     map[string]float64 `json:"metrics"`
+}
+
+// WhatIfResult contains the observed historical data points and the expected
+// metrics for each of the requested parameter values
+type WhatIfResult struct {
+	Parameter string        `json:"parameter"`
+	Observed  []WhatIfPoint `json:"observed"`
+	Points    []WhatIfPoint `json:"points"`
+}
+
+// whatIfMetrics extracts the metrics that are estimated from a test result.
+// Latency is in seconds, like in the test result itself
+func whatIfMetrics(r *common.TestResult) map[string]float64 {
+	m := map[string]float64{
+		"throughputAvg": r.ThroughputAvg,
+		"throughputStd": r.ThroughputStd,
+		"latencyAvg":    r.LatencyAvg,
+		"latencyStd":    r.LatencyStd,
+	}
+	for _, p := range r.LatencyPercentiles {
+		m[fmt.Sprintf("latencyPercentile%g", p.Bucket)] = p.Value
+	}
+	for _, p := range r.ThroughputPercentiles {
+		m[fmt.Sprintf("throughputPercentile%g", p.Bucket)] = p.Value
+	}
+	return m
+}
+
+// normalizedConfigMap returns the normalized config of the test run without
+// agent data as a map keyed by the JSON names of the parameters
+func normalizedConfigMap(tr *common.TestRun) (map[string]interface{}, error) {
+	b, err := json.Marshal(tr.NormalizedConfigWithAgentData(false))
+	if err != nil {
+		return nil, err
+	}
+	m := map[string]interface{}{}
+	err = json.Unmarshal(b, &m)
+	return m, err
+}
+
+// WhatIf estimates the metrics a test run based on the template would produce
+// as the requested parameter is varied. It uses the results of completed runs
+// that share the template's configuration apart from the varied (and ignored)
+// parameters. Values for which there are no historical runs are linearly
+// interpolated or extrapolated from the observed values
+func (t *TestRunManager) WhatIf(req WhatIfRequest) (*WhatIfResult, error) {
+	if req.Template == nil {
+		return nil, fmt.Errorf("Request is missing the template")
+	}
+	template, err := normalizedConfigMap(req.Template)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := template[req.Parameter].(float64); !ok {
+		return nil, fmt.Errorf("Unknown or non-numeric parameter %s", req.Parameter)
+	}
+
+	ignored := map[string]bool{req.Parameter: true}
+	for _, p := range whatIfAlwaysIgnored {
+		ignored[p] = true
+	}
+	for _, p := range req.IgnoreParameters {
+		ignored[p] = true
+	}
+
+	// Collect the metrics of all matching runs per parameter value
+	sums := map[float64]map[string]float64{}
+	counts := map[float64]map[string]int{}
+	samples := map[float64]int{}
+	for _, tr := range t.GetTestRuns() {
+		if tr.Status != common.TestRunStatusCompleted || tr.Result == nil {
+			continue
+		}
+		cfg, err := normalizedConfigMap(tr)
+		if err != nil {
+			continue
+		}
+		if !whatIfConfigMatches(template, cfg, ignored) {
+			continue
+		}
+		v, ok := cfg[req.Parameter].(float64)
+		if !ok {
+			continue
+		}
+		if _, ok := sums[v]; !ok {
+			sums[v] = map[string]float64{}
+			counts[v] = map[string]int{}
+		}
+		for k, m := range whatIfMetrics(tr.Result) {
+			sums[v][k] += m
+			counts[v][k]++
+		}
+		samples[v]++
+	}
+
+	observed := make([]WhatIfPoint, 0, len(sums))
+	for v := range sums {
+		p := WhatIfPoint{
+			Value:       v,
+			Kind:        WhatIfPointObserved,
+			SampleCount: samples[v],
+			Metrics:     map[string]float64{},
+		}
+		for k, s := range sums[v] {
+			p.Metrics[k] = s / float64(counts[v][k])
+		}
+		observed = append(observed, p)
+	}
+	sort.Slice(observed, func(i, j int) bool {
+		return observed[i].Value < observed[j].Value
+	})
+
+	res := &WhatIfResult{
+		Parameter: req.Parameter,
+		Observed:  observed,
+		Points:    make([]WhatIfPoint, 0, len(req.Values)),
+	}
+	if len(observed) == 0 {
+		return res, nil
+	}
+	for _, v := range req.Values {
+		res.Points = append(res.Points, estimateWhatIfPoint(observed, v))
+	}
+	return res, nil
+}
+
+// whatIfConfigMatches returns true if the historical config equals the
+// template in all parameters that are not ignored. Parameters can hold slices
+// and maps, so they are compared deeply rather than with == (which would panic)
+func whatIfConfigMatches(
+	template, cfg map[string]interface{},
+	ignored map[string]bool,
+) bool {
+	for k, v := range template {
+		if ignored[k] {
+			continue
+		}
+		if !reflect.DeepEqual(cfg[k], v) {
+			return false
+		}
+	}
+	return true
+}
+
+// estimateWhatIfPoint returns the expected metrics for value v given the
+// observed points, which must be sorted by value and non-empty
+func estimateWhatIfPoint(observed []WhatIfPoint, v float64) WhatIfPoint {
+	idx := sort.Search(len(observed), func(i int) bool {
+		return observed[i].Value >= v
+	})
+	if idx < len(observed) && observed[idx].Value == v {
+		return observed[idx]
+	}
+	if len(observed) == 1 {
+		// Nothing to derive a trend from, assume the metrics stay constant
+		p := observed[0]
+		p.Value = v
+		p.Kind = WhatIfPointExtrapolated
+		return p
+	}
+
+	kind := WhatIfPointInterpolated
+	lo, hi := idx-1, idx
+	if idx == 0 {
+		kind = WhatIfPointExtrapolated
+		lo, hi = 0, 1
+	} else if idx == len(observed) {
+		kind = WhatIfPointExtrapolated
+		lo, hi = len(observed)-2, len(observed)-1
+	}
+
+	a, b := observed[lo], observed[hi]
+	frac := (v - a.Value) / (b.Value - a.Value)
+	p := WhatIfPoint{
+		Value:       v,
+		Kind:        kind,
+		SampleCount: a.SampleCount + b.SampleCount,
+		Metrics:     map[string]float64{},
+	}
+	for k, am := range a.Metrics {
+		bm, ok := b.Metrics[k]
+		if !ok {
+			continue
+		}
+		// None of the metrics can be negative, which extrapolating a steep
+		// trend would otherwise produce
+		p.Metrics[k] = math.Max(0, am+(bm-am)*frac)
+	}
+	return p
+}
@@ -11,8 +11,11 @@ require (
 	github.com/aws/aws-sdk-go-v2/service/ec2 v1.7.0
 	github.com/aws/aws-sdk-go-v2/service/s3 v1.7.0
 	github.com/aws/aws-sdk-go-v2/service/servicequotas v1.2.2
+	github.com/aws/aws-sdk-go-v2/service/sts v1.4.0
+	github.com/aws/smithy-go v1.10.0
 	github.com/beevik/ntp v0.3.0
 	github.com/btcsuite/btcd v0.22.0-beta
+	github.com/go-git/go-git/v5 v5.4.2
 	github.com/google/gopacket v1.1.19
 	github.com/gorilla/handlers v1.5.1
 	github.com/gorilla/mux v1.8.0
@@ -20,4 +23,5 @@ require (
 	github.com/kelindar/binary v1.0.9
 	github.com/rs/cors v1.7.0
 	golang.org/x/net v0.0.0-20210510120150-4163338589ed // indirect
+	gopkg.in/yaml.v2 v2.3.0
 )
@@ -1,6 +1,7 @@
 package wire
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -13,14 +14,85 @@ import (
 	"github.com/mit-dci/opencbdc-tctl/logging"
 )
 
-// Conn describes a connection between agent and coordinator
+// maxFramePayload is the maximum number of bytes of a message's payload
+// written in a single frame. Messages with a larger payload are split up in
+// multiple frames, such that messages of a higher priority can be written in
+// between them
+const maxFramePayload = 32 * 1024
+
+// frameFlagFinal marks the last frame of a message
+const frameFlagFinal = uint8(1)
+
+// protocolMagic starts the preamble both ends write to a connection before
+// any frames, followed by their protocolVersion
+var protocolMagic = [4]byte{'T', 'C', 'T', 'L'}
+
+// protocolVersion is the version of the framing of messages on the wire. It
+// is raised whenever the format of the frames changes, since ends using
+// another format can't read each other's messages
+const protocolVersion = uint16(2)
+
+// maxPartialMessages is the maximum number of messages that can be partially
+// received at the same time. The writer only interleaves the frames of the
+// first message queued in each priority class, so a peer exceeding this is
+// misbehaving
+const maxPartialMessages = int(numPriorities)
+
+// maxPartialBytes is the maximum number of bytes of partially received
+// messages kept at the same time
+const maxPartialBytes = 1 << 30
+
+// ErrProtocolVersion is returned when the other end of a connection doesn't
+// use the same version of the wire protocol
+var ErrProtocolVersion = errors.New("unsupported wire protocol version")
+
+// ErrConnClosed is returned when sending a message over a connection that is
+// already closed
+var ErrConnClosed = errors.New("connection is closed")
+
+// outgoingMsg is a message queued for sending and the part of its payload
+// that has been written to the wire so far
+type outgoingMsg struct {
+	streamID uint32
+	mt       MessageType
+	payload  []byte
+	sent     int
+	done     chan error
+}
+
+// Conn describes a connection between agent and coordinator. Messages are
+// written to the underlying connection in frames by a single writer, which
+// always picks the next frame from the highest priority class that has
+// messages queued. Within a priority class, messages are written in the order
+// they were queued
 type Conn struct {
 	conn          net.Conn
 	connLock      sync.Mutex
 	nextMessageID int32
+	nextStreamID  uint32
+	queues        [numPriorities][]*outgoingMsg
+	wake          chan struct{}
+	closed        bool
+	closeErr      error
+	partial       map[uint32][]byte
+	partialBytes  int
+	peerChecked   bool
 	Tag           string
 }
 
+// newConn wraps the network connection and starts writing the messages queued
+// for it
+func newConn(c net.Conn) *Conn {
+	conn := &Conn{
+		conn:     c,
+		connLock: sync.Mutex{},
+		wake:     make(chan struct{}, 1),
+		partial:  map[uint32][]byte{},
+	}
+	go conn.writeLoop()
+	return conn
+}
+
 // Listener describes a server that can accept new connections
 type Listener struct {
 	listener net.Listener
@@ -46,10 +118,7 @@ func (l *Listener) Accept() (*Conn, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Conn{
-		conn:     c,
-		connLock: sync.Mutex{},
-	}, nil
+	return newConn(c), nil
 }
 
 // NewClient will open a TCP connection to the given host and port and return an
@@ -66,19 +135,42 @@ func NewClient(host string, port int) (*Conn, error) {
 			}
 			time.Sleep(time.Second * 1)
 		} else {
-			return &Conn{
-				conn:     c,
-				connLock: sync.Mutex{},
-			}, nil
+			return newConn(c), nil
 		}
 	}
 }
 
-// Close will close the connection
+// RemoteAddr returns the address of the remote end of the connection
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Close will close the connection. Messages that are still queued are not
+// sent, and their senders get an error
 func (c *Conn) Close() error {
+	c.fail(ErrConnClosed)
 	return c.conn.Close()
 }
 
+// fail marks the connection as closed and fails all queued messages with the
+// given error
+func (c *Conn) fail(err error) {
+	c.connLock.Lock()
+	defer c.connLock.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.closeErr = err
+	for p := range c.queues {
+		for _, m := range c.queues[p] {
+			m.done <- err
+		}
+		c.queues[p] = nil
+	}
+	close(c.wake)
+}
+
 // readBytes will try to read exactly the passed number of bytes from the
 // connection - blocking until the bytes are all received, or fail when it is
 // unable to read
@@ -99,44 +191,149 @@ func (c *Conn) SetMessageID(msg Msg) {
 	SetMessageHeaderID(msg, "ID", int(id))
 }
 
+// ContinueMessageIDs makes the connection continue the message IDs of the
+// previous connection of the same session, such that replies to messages sent
+// over the previous connection can't be mistaken for replies to messages sent
+// over this one
+func (c *Conn) ContinueMessageIDs(prev *Conn) {
+	atomic.StoreInt32(&c.nextMessageID, atomic.LoadInt32(&prev.nextMessageID))
+}
+
+// readPreamble reads the preamble the other end writes before any frames, and
+// checks it uses the same version of the wire protocol
+func (c *Conn) readPreamble() error {
+	var preamble struct {
+		Magic   [4]byte
+		Version uint16
+	}
+	err := binary.Read(c.conn, binary.BigEndian, &preamble)
+	if err != nil {
+		return err
+	}
+	if preamble.Magic != protocolMagic {
+		return fmt.Errorf(
+			"%w: the other end uses a version before %d",
+			ErrProtocolVersion,
+			protocolVersion,
+		)
+	}
+	if preamble.Version != protocolVersion {
+		return fmt.Errorf(
+			"%w: the other end uses version %d, expected %d",
+			ErrProtocolVersion,
+			preamble.Version,
+			protocolVersion,
+		)
+	}
+	return nil
+}
+
 // Recv will try to read a Msg from the wire connection or return an error if it
 // is unable to do so. The method call will block until either a message or
-// error is available
+// error is available. Frames of messages of different priorities can arrive
+// interleaved, they are reassembled until the final frame of a message is
+// received. Recv must not be called concurrently
 func (c *Conn) Recv() (Msg, error) {
-	// First read the message type (uint16)
-	var mti16 int16
-	err := binary.Read(c.conn, binary.BigEndian, &mti16)
-	if err != nil {
-		return nil, err
+	if !c.peerChecked {
+		err := c.readPreamble()
+		if err != nil {
+			return nil, err
+		}
+		c.peerChecked = true
 	}
-	mt := MessageType(mti16)
+	for {
+		// Read the frame header: message type (int16), stream ID (uint32),
+		// flags (uint8) and payload length (int32)
+		var mti16 int16
+		err := binary.Read(c.conn, binary.BigEndian, &mti16)
+		if err != nil {
+			return nil, err
+		}
+		mt := MessageType(mti16)
 
-	// Then read the message length (int32)
-	var msglen int32
-	err = binary.Read(c.conn, binary.BigEndian, &msglen)
-	if err != nil {
-		return nil, err
-	}
+		var streamID uint32
+		err = binary.Read(c.conn, binary.BigEndian, &streamID)
+		if err != nil {
+			return nil, err
+		}
 
-	// Read the whole message payload from the wire or die trying
-	b, err := c.readBytes(int(msglen))
-	if err != nil {
-		return nil, err
-	}
+		var flags uint8
+		err = binary.Read(c.conn, binary.BigEndian, &flags)
+		if err != nil {
+			return nil, err
+		}
 
-	// Once the whole message is read, decode it and return it
-	msg, err := msgFromBytes(mt, b)
-	if err != nil {
-		return nil, err
+		var framelen int32
+		err = binary.Read(c.conn, binary.BigEndian, &framelen)
+		if err != nil {
+			return nil, err
+		}
+		if framelen < 0 || framelen > maxFramePayload {
+			return nil, fmt.Errorf("invalid frame length %d", framelen)
+		}
+
+		// Read the whole frame payload from the wire or die trying
+		b, err := c.readBytes(int(framelen))
+		if err != nil {
+			return nil, err
+		}
+
+		prev, ok := c.partial[streamID]
+		if !ok && flags&frameFlagFinal == 0 &&
+			len(c.partial) >= maxPartialMessages {
+			return nil, fmt.Errorf(
+				"more than %d messages partially received",
+				maxPartialMessages,
+			)
+		}
+		if c.partialBytes+len(b) > maxPartialBytes {
+			return nil, fmt.Errorf(
+				"more than %d bytes of messages partially received",
+				maxPartialBytes,
+			)
+		}
+		payload := append(prev, b...)
+		if flags&frameFlagFinal == 0 {
+			c.partial[streamID] = payload
+			c.partialBytes += len(b)
+			continue
+		}
+		delete(c.partial, streamID)
+		c.partialBytes -= len(prev)
+
+		// Once the whole message is read, decode it and return it
+		msg, err := msgFromBytes(mt, payload)
+		if err != nil {
+			return nil, err
+		}
+
+		return msg, nil
 	}
+}
 
-	return msg, nil
+// Queue will encode a message into bytes and queue it for sending over the
+// wire in its priority class, without waiting for it to be sent. If writing
+// the message fails, the connection is closed
+func (c *Conn) Queue(msg Msg) error {
+	_, err := c.queue(msg)
+	return err
 }
 
-// Send will encode a message into bytes and send it over the wire
+// Send will encode a message into bytes and send it over the wire, blocking
+// until it is written
 func (c *Conn) Send(msg Msg) error {
+	done, err := c.queue(msg)
+	if err != nil {
+		return err
+	}
+	return <-done
+}
+
+// queue encodes the message and appends it to the queue of its priority
+// class. The returned channel receives the result of writing the message
+func (c *Conn) queue(msg Msg) (chan error, error) {
 	if msg == nil {
-		return errors.New("cannot send nil message")
+		return nil, errors.New("cannot send nil message")
 	}
 	// Set an incremental message ID if one has not been set by the caller
 	if GetMessageHeaderID(msg, "ID") == 0 {
@@ -146,44 +343,123 @@ func (c *Conn) Send(msg Msg) error {
 	// Encode the message into a byte array
 	msgb, err := msgToBytes(msg)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	m := &outgoingMsg{
+		streamID: atomic.AddUint32(&c.nextStreamID, 1),
+		mt:       GetMessageType(msg),
+		payload:  msgb,
+		done:     make(chan error, 1),
 	}
+	p := GetMessagePriority(msg)
 
-	// Make sure no two callers submit over the wire at the same time by locking
-	// the connLock mutex
 	c.connLock.Lock()
 	defer c.connLock.Unlock()
+	if c.closed {
+		return nil, c.closeErr
+	}
+	c.queues[p] = append(c.queues[p], m)
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	return m.done, nil
+}
 
-	// Write the message type
-	err = binary.Write(c.conn, binary.BigEndian, int16(GetMessageType(msg)))
-	if err != nil {
-		return err
+// nextOutgoing returns the message to write the next frame of, which is the
+// first message queued in the highest priority class that has any. Blocks
+// until a message is queued, and returns nil if the connection is closed
+func (c *Conn) nextOutgoing() *outgoingMsg {
+	for {
+		c.connLock.Lock()
+		if c.closed {
+			c.connLock.Unlock()
+			return nil
+		}
+		for p := range c.queues {
+			if len(c.queues[p]) > 0 {
+				m := c.queues[p][0]
+				c.connLock.Unlock()
+				return m
+			}
+		}
+		c.connLock.Unlock()
+		if _, ok := <-c.wake; !ok {
+			return nil
+		}
 	}
+}
 
-	// Write the message length
-	err = binary.Write(c.conn, binary.BigEndian, int32(len(msgb)))
+// writeLoop writes the preamble and then the queued messages to the wire frame
+// by frame, until the connection is closed or writing to it fails
+func (c *Conn) writeLoop() {
+	var preamble bytes.Buffer
+	preamble.Write(protocolMagic[:])
+	_ = binary.Write(&preamble, binary.BigEndian, protocolVersion)
+	_, err := c.conn.Write(preamble.Bytes())
 	if err != nil {
-		return err
+		logging.Warnf("%s: unable to write preamble: %v", c.Tag, err)
+		c.fail(err)
+		c.conn.Close()
+		return
 	}
 
-	// Write the message to the wire
-	sent := 0
-	for sent < len(msgb) {
-		n, err := c.conn.Write(msgb[sent:])
-		sent += n
-		// If err is nil, but we didn't write all bytes for some reason, we just
-		// go another cycle to retry.
-		if sent != len(msgb) && err != nil {
-			return fmt.Errorf(
-				"not all bytes sent: %d vs %d - %v - MessageType: %d",
-				n,
-				len(msgb),
-				err,
-				GetMessageType(msg),
-			)
+	for {
+		m := c.nextOutgoing()
+		if m == nil {
+			return
 		}
-	}
 
-	// All good - it's sent!
-	return nil
+		n := len(m.payload) - m.sent
+		if n > maxFramePayload {
+			n = maxFramePayload
+		}
+		flags := uint8(0)
+		if m.sent+n == len(m.payload) {
+			flags |= frameFlagFinal
+		}
+
+		var buf bytes.Buffer
+		_ = binary.Write(&buf, binary.BigEndian, int16(m.mt))
+		_ = binary.Write(&buf, binary.BigEndian, m.streamID)
+		_ = binary.Write(&buf, binary.BigEndian, flags)
+		_ = binary.Write(&buf, binary.BigEndian, int32(n))
+		buf.Write(m.payload[m.sent : m.sent+n])
+
+		frame := buf.Bytes()
+		sent := 0
+		for sent < len(frame) {
+			w, err := c.conn.Write(frame[sent:])
+			sent += w
+			// If err is nil, but we didn't write all bytes for some reason, we
+			// just go another cycle to retry.
+			if sent != len(frame) && err != nil {
+				err = fmt.Errorf(
+					"not all bytes sent: %d vs %d - %v - MessageType: %d",
+					sent,
+					len(frame),
+					err,
+					m.mt,
+				)
+				logging.Warnf("%s: %v", c.Tag, err)
+				c.fail(err)
+				c.conn.Close()
+				return
+			}
+		}
+
+		c.connLock.Lock()
+		m.sent += n
+		if flags&frameFlagFinal != 0 && !c.closed {
+			for p := range c.queues {
+				if len(c.queues[p]) > 0 && c.queues[p][0] == m {
+					c.queues[p] = c.queues[p][1:]
+				}
+			}
+			// All good - it's sent!
+			m.done <- nil
+		}
+		c.connLock.Unlock()
+	}
 }
@@ -4,19 +4,38 @@ import "github.com/mit-dci/opencbdc-tctl/common"
 
 // HelloMsg is sent from agent to controller upon first connection. It
 // identifies which version the agent is running and provides the initial system
-// information of the agent
+// information of the agent. When the coordinator requires enrollment, the
+// agent also passes the method it uses to prove its identity and the
+// corresponding credential. Agents with a persistent identity pass it along
+// with the resume token the coordinator issued for it, if any, in which case
+// the coordinator resumes their session rather than enrolling them again. To
+// resync the session, the agent passes the commands it is running and the
+// exit codes of the commands that finished recently
 type HelloMsg struct {
-	Header       MsgHeader
-	SystemInfo   common.AgentSystemInfo
-	AgentVersion string
+	Header               MsgHeader
+	SystemInfo           common.AgentSystemInfo
+	AgentVersion         string
+	EnrollmentMethod     string
+	EnrollmentCredential []byte
+	AgentIdentity        string
+	ResumeToken          []byte
+	RunningCommands      [][]byte
+	FinishedCommands     [][]byte
+	FinishedExitCodes    []int
 }
 
 // HelloResponseMsg is sent from controller to agent in response to HelloMsg and
 // both acknowledges to the agent that the coordinator has accepted the
-// HelloMsg, and tells the agent which AgentID it has on the coordinator
+// HelloMsg, and tells the agent which AgentID it has on the coordinator. When
+// the agent registered a persistent identity, the coordinator hands it the
+// token to resume its session with. Resumed is set if the coordinator resumed
+// the session of the agent, in which case the replies to the requests it
+// received before reconnecting are still expected
 type HelloResponseMsg struct {
 	Header      MsgHeader
 	YourAgentID int32
+	ResumeToken []byte
+	Resumed     bool
 }
 
 // UpdateSystemInfoMsg is sent from the agent to the controller to let the
@@ -82,6 +101,21 @@ type DeployFileFromS3RequestMsg struct {
 	SourceRegion string
 	// Do not create a folder with the base name of the archive
 	UnpackNoDir bool
+	// The hex encoded SHA-256 digest the downloaded file must have, if set
+	SHA256 string
+	// The signature of the coordinator over the digest. Agents configured
+	// with the coordinator's signing key refuse files without a valid one
+	Signature []byte
+	// The file is data rather than binaries, such as seeded shard data, and
+	// is deployed without a checksum. Agents configured with the
+	// coordinator's signing key refuse other files without a checksum
+	SeedData bool
+	// If set, the agent reports the progress of the download, verification
+	// and unpacking of the file in TransferProgressMsgs with this ID
+	TransferID []byte
+	// A pre-signed URL to download the file with. If set, the agent uses it
+	// in stead of its own S3 credentials
+	PresignedURL string
 }
 
 // DeployFileFromS3ResponseMsg is sent from agent to controller to inform the
@@ -91,6 +125,37 @@ type DeployFileFromS3ResponseMsg struct {
 	Success bool
 }
 
+// TransferPhase describes what the agent is doing with a file it's deploying
+type TransferPhase string
+
+const (
+	// The agent is downloading the file
+	TransferPhaseDownload TransferPhase = "download"
+	// The agent is verifying the file against its checksum
+	TransferPhaseVerify TransferPhase = "verify"
+	// The agent is unpacking the file
+	TransferPhaseUnpack TransferPhase = "unpack"
+	// The file was deployed succesfully
+	TransferPhaseDone TransferPhase = "done"
+	// Deploying the file failed
+	TransferPhaseFailed TransferPhase = "failed"
+)
+
+// TransferProgressMsg is sent by the agent to the controller while deploying
+// a file for a DeployFileFromS3RequestMsg or FileTransferFinishRequestMsg with
+// a TransferID. It's sent periodically during the download, and whenever the
+// phase changes
+type TransferProgressMsg struct {
+	Header MsgHeader
+	// The TransferID of the DeployFileFromS3RequestMsg
+	TransferID []byte
+	Phase      TransferPhase
+	// The number of bytes downloaded so far, and the size of the file (if
+	// known)
+	Bytes      int64
+	TotalBytes int64
+}
+
 // DeployFileRequestMsg is sent from controller to agent to deploy (smaller)
 // files directly over the wire protocol without first having to upload it to
 // S3. This is specifically used for deploying the configuration files which are
@@ -141,6 +206,19 @@ type ExecuteCommandRequestMsg struct {
 	S3OutputBucket string
 	// Gather bandwidth stats
 	RecordNetworkTraffic bool
+	// Run the command inside this container image instead of directly on the
+	// agent. Empty to run on the agent
+	ContainerImage string
+	// Rotate the standard output and error of the command once they exceed
+	// this many bytes, keeping LogRotateKeep rotated files. Zero disables
+	// rotation
+	LogRotateBytes int64
+	LogRotateKeep  int
+	// Run the command in a cgroup (v2) that limits it to this many vCPUs,
+	// MiB of memory and IO weight. Zero values are not limited
+	CgroupCPUs      float64
+	CgroupMemoryMiB int64
+	CgroupIOWeight  int
 }
 
 // ExecuteCommandResponseMsg is sent by the agent to the controller in response
@@ -158,6 +236,9 @@ type ExecuteCommandResponseMsg struct {
 	Success bool
 	// If Success is false, this indicates what went wrong
 	Error string
+	// If the command runs in a container, the digest-pinned reference of the
+	// image it runs in
+	ImageDigest string
 }
 
 // CommandStatus is an enumeration of the status in which commands can be
@@ -214,6 +295,132 @@ type TerminateCommandRequestMsg struct {
 	CommandID []byte
 }
 
+// SuspendCommandRequestMsg is sent from the controller to the agent to have it
+// suspend (SIGSTOP) or resume (SIGCONT) a running command identified by
+// CommandID. The agent will respond with an AckMsg or ErrorMsg
+type SuspendCommandRequestMsg struct {
+	Header MsgHeader
+	// The ID of the command to suspend or resume
+	CommandID []byte
+	// Resume the command rather than suspending it
+	Resume bool
+}
+
+// InjectFaultRequestMsg is sent from the controller to the agent to have it
+// inject a fault into its network or disk for chaos testing, or to revert it.
+// Faults are tied to the environment they were injected for, and reverted
+// when it is destroyed. The agent will respond with an AckMsg or ErrorMsg
+type InjectFaultRequestMsg struct {
+	Header MsgHeader
+	// Identifies the fault, such that it can be reverted
+	FaultID       []byte
+	EnvironmentID []byte
+	// One of the common.FaultKind values that are injected on the agent
+	Kind string
+	// Revert the fault rather than injecting it
+	Revert bool
+	// The IPs to drop all traffic to and from for partitions
+	PeerIPs []string
+	// The delay, jitter and packet loss to add for netem faults
+	LatencyMs   int
+	JitterMs    int
+	LossPercent float64
+	// The read and write bandwidth of the processes of the environment for
+	// disk throttle faults
+	DiskBytesPerSecond int64
+}
+
+// MatchOutputRequestMsg is sent from the controller to the agent to
+// check whether the standard output or error of a command matches a regular
+// expression, which is used to probe if a role is ready. The agent will
+// respond with a MatchOutputResponseMsg
+type MatchOutputRequestMsg struct {
+	Header        MsgHeader
+	EnvironmentID []byte
+	CommandID     []byte
+	Pattern       string
+}
+
+// MatchOutputResponseMsg is a response to MatchOutputRequestMsg
+// to indicate whether a line of the command's output matched the pattern
+type MatchOutputResponseMsg struct {
+	Header  MsgHeader
+	Matched bool
+}
+
+// LiveSamplesRequestMsg is sent from the controller to the agent while a
+// test run is executing, to read the transaction samples a load generator
+// wrote to a file since the given offset. The agent will respond with a
+// LiveSamplesResponseMsg
+type LiveSamplesRequestMsg struct {
+	Header        MsgHeader
+	EnvironmentID []byte
+	SourcePath    string
+	Offset        int64
+}
+
+// SampleBucket aggregates the transactions completed in a second
+type SampleBucket struct {
+	Second     int64
+	Count      int64
+	LatencySum float64
+	LatencyMax float64
+}
+
+// LiveSamplesResponseMsg is a response to LiveSamplesRequestMsg with the
+// samples aggregated per second, and the offset up to which the file was read.
+// Only complete lines are read, such that the next request continues at the
+// start of a line
+type LiveSamplesResponseMsg struct {
+	Header  MsgHeader
+	Offset  int64
+	Buckets []SampleBucket
+}
+
+// VerifyCleanupRequestMsg is sent from controller to agent after the teardown
+// of a test run, to verify that no processes of the environment are left, the
+// given ports are released and the environment directory is removed. If Force
+// is set, the agent kills the processes and removes the directory it finds. If
+// Keep is set, the environment is kept for the next test run: its directory is
+// not residue, and only the RemovePaths within it are removed
+type VerifyCleanupRequestMsg struct {
+	Header        MsgHeader
+	EnvironmentID []byte
+	Ports         []int
+	Force         bool
+	Keep          bool
+	RemovePaths   []string
+}
+
+// VerifyCleanupResponseMsg is a response to VerifyCleanupRequestMsg listing
+// the residue the agent found. If the request was forced, Cleaned is set when
+// no residue was left after cleaning it
+type VerifyCleanupResponseMsg struct {
+	Header MsgHeader
+	// The processes running in the environment, as "<pid> <name>"
+	Processes []string
+	// The ports that are still in use
+	Ports []int
+	// The directories that were not removed
+	Dirs    []string
+	Cleaned bool
+}
+
+// LoadProfileRequestMsg is sent from the controller to the agent to have it
+// throttle a running load generator command identified by CommandID to the
+// given load profile. The profile consists of points with the fraction of the
+// configured rate to generate at their offset from the start of the profile,
+// between which the fraction is interpolated linearly. Two points at the
+// same offset form a step. The agent will respond with an AckMsg or ErrorMsg
+type LoadProfileRequestMsg struct {
+	Header    MsgHeader
+	CommandID []byte
+	// The time the profile has already been running for, in milliseconds
+	ElapsedMs int64
+	OffsetsMs []int64
+	Fractions []float64
+}
+
 // RenameFileRequestMsg is send from controller to agent and used to rename a
 // file on the agent. The agent will respond with an RenameFileResponseMsg.
 // Currently only used for renaming shard preseed files
@@ -246,6 +453,11 @@ type UploadFileToS3RequestMsg struct {
 	TargetBucket string
 	TargetPath   string
 	TargetRegion string
+	// When set, SourcePath is a directory that is uploaded as TAR.GZ archive
+	Archive bool
+	// When set, the file is validated against the schema of its output file
+	// format (if known) before it is uploaded
+	Validate bool
 }
 
 // UploadFileToS3ResponseMsg is a response to UploadFileToS3RequestMsg to
@@ -253,4 +465,218 @@ type UploadFileToS3RequestMsg struct {
 type UploadFileToS3ResponseMsg struct {
 	Header  MsgHeader
 	Success bool
+	// Describes why the file failed validation, if it was requested. The file
+	// is uploaded regardless, such that it can be inspected
+	ValidationError string
+}
+
+// RotateCredentialRequestMsg is sent from controller to agent to hand it a new
+// credential to enroll with on future connections. The agent stores the
+// credential and replies with a RotateCredentialResponseMsg, after which the
+// controller invalidates the agent's previous credential
+type RotateCredentialRequestMsg struct {
+	Header     MsgHeader
+	Credential []byte
+}
+
+// RotateCredentialResponseMsg is a response to RotateCredentialRequestMsg to
+// indicate whether the agent stored the new credential
+type RotateCredentialResponseMsg struct {
+	Header  MsgHeader
+	Success bool
+}
+
+// AgentUpdateRequestMsg is sent from controller to agent to have it replace
+// its own binary with the given version from S3. The agent refuses the update
+// unless it is configured with the agent update key and the binary matches
+// the checksum and signature in the request. On success the
+// agent replies with an AckMsg, then restarts itself on the new binary and
+// reconnects to the controller
+type AgentUpdateRequestMsg struct {
+	Header       MsgHeader
+	Version      string
+	Architecture string
+	SourceRegion string
+	SourceBucket string
+	SourcePath   string
+	// The hex encoded SHA-256 digest of the binary
+	SHA256 string
+	// The offline ed25519 signature over the version, architecture and
+	// digest
+	Signature []byte
+}
+
+// AgentHealthMsg is sent periodically from agent to controller with the
+// utilization of the agent's system since the previous message, such that
+// agents saturated during a test run can be identified
+type AgentHealthMsg struct {
+	Header MsgHeader
+	// The unix timestamp in nanoseconds the utilization was measured at
+	Time int64
+	// The CPU utilization over all cores, in percent
+	CPUPercent float64
+	// Memory and disk space, in kB
+	MemTotal      int64
+	MemAvailable  int64
+	DiskAvailable int64
+	// The throughput of the primary network interface, in bytes per second
+	NetRxBytesPerSec float64
+	NetTxBytesPerSec float64
+}
+
+// FileTransferStartRequestMsg is sent from controller to agent to start, or
+// resume, a chunked transfer of a file into an environment. The file is sent
+// in chunks of ChunkSize bytes in FileChunkRequestMsgs, of which several can
+// be in flight at once. The agent replies with a FileTransferStartResponseMsg
+type FileTransferStartRequestMsg struct {
+	Header        MsgHeader
+	EnvironmentID []byte
+	// Identifies the transfer. Starting a transfer with the ID of one the
+	// agent did not finish resumes it
+	TransferID []byte
+	// The target path, relative to the environment folder
+	Path      string
+	Size      int64
+	ChunkSize int64
+}
+
+// FileTransferStartResponseMsg is a response to FileTransferStartRequestMsg
+// with the indexes of the chunks the agent already received in an earlier
+// attempt of the transfer, which need not be sent again
+type FileTransferStartResponseMsg struct {
+	Header         MsgHeader
+	ReceivedChunks []int
+}
+
+// FileChunkRequestMsg is sent from controller to agent with one chunk of a
+// file transfer started with a FileTransferStartRequestMsg. The agent replies
+// with an AckMsg once the chunk is written
+type FileChunkRequestMsg struct {
+	Header        MsgHeader
+	EnvironmentID []byte
+	TransferID    []byte
+	Path          string
+	Index         int
+	Contents      []byte
+	// The SHA-256 digest of Contents
+	SHA256 []byte
+}
+
+// FileTransferFinishRequestMsg is sent from controller to agent once all
+// chunks of a file transfer were acknowledged. The agent verifies the file
+// against its checksum, optionally unpacks it, and replies with an AckMsg. It
+// reports the verify and unpack phases in TransferProgressMsgs with the
+// TransferID
+type FileTransferFinishRequestMsg struct {
+	Header        MsgHeader
+	EnvironmentID []byte
+	TransferID    []byte
+	Path          string
+	// The hex encoded SHA-256 digest of the whole file
+	SHA256 string
+	// The signature of the coordinator over the digest, checked like the one
+	// in DeployFileFromS3RequestMsg
+	Signature []byte
+	// Unpack the file if it is either a TAR or TAR.GZ
+	Unpack bool
+	// Ignore directory information in the archive
+	FlatUnpack bool
+	// Do not create a folder with the base name of the archive
+	UnpackNoDir bool
+}
+
+// FileReadRequestMsg is sent from controller to agent to read a range of a
+// file in an environment, such that the controller can fetch files from the
+// agent in chunks. A request with a Length of zero reads no contents, but
+// returns the size and checksum of the file. The agent replies with a
+// FileReadResponseMsg
+type FileReadRequestMsg struct {
+	Header        MsgHeader
+	EnvironmentID []byte
+	// The path, relative to the environment folder
+	Path   string
+	Offset int64
+	Length int64
+	// When set along with a Length of zero, the file is validated against the
+	// schema of its output file format (if known)
+	Validate bool
+}
+
+// FileReadResponseMsg is a response to FileReadRequestMsg
+type FileReadResponseMsg struct {
+	Header   MsgHeader
+	Size     int64
+	Contents []byte
+	// The hex encoded SHA-256 digest of the whole file, only set when no
+	// contents were requested
+	SHA256 string
+	// Describes why the file failed validation, if it was requested
+	ValidationError string
+}
+
+// DebugExecRequestMsg is sent from controller to agent to run a diagnostic
+// command on behalf of an admin. The agent only runs the commands in
+// common.DebugCommands, without a shell, and replies with a
+// DebugExecResponseMsg once the command exited or timed out
+type DebugExecRequestMsg struct {
+	Header MsgHeader
+	// The command and its arguments
+	Args []string
+	// The directory to run the command in. Relative paths are relative to the
+	// data directory of the agent
+	Dir string
+	// The time the command may run before it is killed
+	TimeoutSeconds int
+}
+
+// DebugExecResponseMsg is a response to DebugExecRequestMsg
+type DebugExecResponseMsg struct {
+	Header   MsgHeader
+	ExitCode int
+	Stdout   []byte
+	Stderr   []byte
+	// Set if the output was cut off at the maximum size the agent returns
+	Truncated bool
+	TimedOut  bool
+	// Describes why the command could not be run
+	Error string
+}
+
+// LogStreamRequestMsg is sent from controller to agent to start or stop
+// streaming the lines the running commands write to their standard output and
+// error in LogLinesMsgs. Streaming is a lease: the agent stops by itself if
+// the controller doesn't repeat the request within 30 seconds. The agent
+// replies with an AckMsg
+type LogStreamRequestMsg struct {
+	Header MsgHeader
+	Enable bool
+	// The maximum number of lines streamed per second. When the commands
+	// write faster, the agent falls behind and eventually skips output
+	MaxLinesPerSecond int
+}
+
+// LogLine is a line a command wrote to its standard output or error
+type LogLine struct {
+	CommandID []byte
+	Stderr    bool
+	Line      string
+}
+
+// LogLinesMsg is sent by the agent to the controller while streaming is
+// enabled by a LogStreamRequestMsg, with the lines the running commands wrote
+// since the previous message. The controller replies with a LogLinesAckMsg.
+// The agent only has a few messages underway without acknowledgement, such
+// that a controller that can't keep up slows the stream down
+type LogLinesMsg struct {
+	Header MsgHeader
+	Lines  []LogLine
+	// The number of bytes of output that were skipped since the previous
+	// message because the stream fell too far behind
+	SkippedBytes int64
+}
+
+// LogLinesAckMsg is a response to LogLinesMsg, once the controller passed the
+// lines on
+type LogLinesAckMsg struct {
+	Header MsgHeader
 }
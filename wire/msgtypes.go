@@ -29,6 +29,31 @@ var TypeToMessageTypeMap = map[reflect.Type]MessageType{
 	reflect.TypeOf(&RenameFileResponseMsg{}):        MessageType(23),
 	reflect.TypeOf(&UploadFileToS3RequestMsg{}):     MessageType(24),
 	reflect.TypeOf(&UploadFileToS3ResponseMsg{}):    MessageType(25),
+	reflect.TypeOf(&RotateCredentialRequestMsg{}):   MessageType(26),
+	reflect.TypeOf(&RotateCredentialResponseMsg{}):  MessageType(27),
+	reflect.TypeOf(&SuspendCommandRequestMsg{}):     MessageType(28),
+	reflect.TypeOf(&InjectFaultRequestMsg{}):        MessageType(29),
+	reflect.TypeOf(&MatchOutputRequestMsg{}):        MessageType(30),
+	reflect.TypeOf(&MatchOutputResponseMsg{}):       MessageType(31),
+	reflect.TypeOf(&LiveSamplesRequestMsg{}):        MessageType(32),
+	reflect.TypeOf(&LiveSamplesResponseMsg{}):       MessageType(33),
+	reflect.TypeOf(&TransferProgressMsg{}):          MessageType(34),
+	reflect.TypeOf(&VerifyCleanupRequestMsg{}):      MessageType(35),
+	reflect.TypeOf(&VerifyCleanupResponseMsg{}):     MessageType(36),
+	reflect.TypeOf(&LoadProfileRequestMsg{}):        MessageType(37),
+	reflect.TypeOf(&AgentUpdateRequestMsg{}):        MessageType(38),
+	reflect.TypeOf(&AgentHealthMsg{}):               MessageType(39),
+	reflect.TypeOf(&FileTransferStartRequestMsg{}):  MessageType(40),
+	reflect.TypeOf(&FileTransferStartResponseMsg{}): MessageType(41),
+	reflect.TypeOf(&FileChunkRequestMsg{}):          MessageType(42),
+	reflect.TypeOf(&FileTransferFinishRequestMsg{}): MessageType(43),
+	reflect.TypeOf(&FileReadRequestMsg{}):           MessageType(44),
+	reflect.TypeOf(&FileReadResponseMsg{}):          MessageType(45),
+	reflect.TypeOf(&DebugExecRequestMsg{}):          MessageType(46),
+	reflect.TypeOf(&DebugExecResponseMsg{}):         MessageType(47),
+	reflect.TypeOf(&LogStreamRequestMsg{}):          MessageType(48),
+	reflect.TypeOf(&LogLinesMsg{}):                  MessageType(49),
+	reflect.TypeOf(&LogLinesAckMsg{}):               MessageType(50),
 }
 
 // MessageTypeToTypeMap is the reverse of TypeToMessageTypeMap to translate in
@@ -0,0 +1,51 @@
+package wire
+
+import "reflect"
+
+// Priority is the class of a message that determines in what order messages
+// queued on the same connection are written to the wire. Messages of a higher
+// priority class are written in between the frames of a lower priority
+// message that is already being sent
+type Priority int
+
+const (
+	// PriorityControl is used for small messages that control the
+	// connection or running commands, such as pings and aborting commands
+	PriorityControl Priority = iota
+	// PriorityNormal is used for all messages not explicitly classified
+	PriorityNormal
+	// PriorityBulk is used for messages carrying large payloads, such as
+	// file contents
+	PriorityBulk
+
+	numPriorities
+)
+
+// TypeToPriorityMap classifies the message types that are not sent with
+// PriorityNormal
+var TypeToPriorityMap = map[reflect.Type]Priority{
+	reflect.TypeOf(&HelloMsg{}):                    PriorityControl,
+	reflect.TypeOf(&HelloResponseMsg{}):            PriorityControl,
+	reflect.TypeOf(&AckMsg{}):                      PriorityControl,
+	reflect.TypeOf(&ErrorMsg{}):                    PriorityControl,
+	reflect.TypeOf(&PingMsg{}):                     PriorityControl,
+	reflect.TypeOf(&BreakCommandRequestMsg{}):      PriorityControl,
+	reflect.TypeOf(&TerminateCommandRequestMsg{}):  PriorityControl,
+	reflect.TypeOf(&RotateCredentialRequestMsg{}):  PriorityControl,
+	reflect.TypeOf(&RotateCredentialResponseMsg{}): PriorityControl,
+	reflect.TypeOf(&DeployFileRequestMsg{}):        PriorityBulk,
+	reflect.TypeOf(&FileChunkRequestMsg{}):         PriorityBulk,
+	reflect.TypeOf(&FileReadResponseMsg{}):         PriorityBulk,
+	reflect.TypeOf(&DebugExecResponseMsg{}):        PriorityBulk,
+	reflect.TypeOf(&LogLinesMsg{}):                 PriorityBulk,
+	reflect.TypeOf(&LogLinesAckMsg{}):              PriorityControl,
+}
+
+// GetMessagePriority returns the priority class the message is sent with
+func GetMessagePriority(m Msg) Priority {
+	p, ok := TypeToPriorityMap[reflect.TypeOf(m)]
+	if !ok {
+		return PriorityNormal
+	}
+	return p
+}